@@ -0,0 +1,349 @@
+package suresql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Index advisor: statements of requests slower than query/slow_ms are kept by fingerprint (the statement
+// with its values replaced by ?), Advise reads the columns they filter (WHERE, JOIN ... ON) and sort
+// (ORDER BY) on and recommends an index for those the table has no index starting with. The parsing is
+// a tokenizer, not a SQL parser: unqualified columns of statements with more than one table and columns
+// the table does not have are skipped.
+
+const (
+	ADVISOR_MAX_STATEMENTS = 500 // fingerprints kept, the least recently seen is dropped
+	ADVISOR_MAX_COLUMNS    = 3   // columns of a recommended index
+)
+
+// SlowStatement is a fingerprint of the slow statement log
+type SlowStatement struct {
+	ID        string    `json:"id"`        // short hash of the fingerprint
+	Statement string    `json:"statement"` // the fingerprint, no values
+	Count     int64     `json:"count"`
+	TotalMs   float64   `json:"total_ms"`
+	MaxMs     float64   `json:"max_ms"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// IndexRecommendation is a missing index and the slow statements it would help
+type IndexRecommendation struct {
+	Table      string   `json:"table"`
+	Columns    []string `json:"columns"`
+	Reason     string   `json:"reason"`
+	Statements []string `json:"statements"` // ids of the slow statements
+	Count      int64    `json:"count"`      // slow executions of those statements
+	TotalMs    float64  `json:"total_ms"`
+	DDL        string   `json:"ddl,omitempty"` // for review, never run by SureSQL
+}
+
+var slowStatements = struct {
+	mu   sync.Mutex
+	byFP map[string]*SlowStatement
+}{byFP: map[string]*SlowStatement{}}
+
+var (
+	fingerprintString = regexp.MustCompile(`'(?:[^']|'')*'`)
+	fingerprintNumber = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	fingerprintParam  = regexp.MustCompile(`\$\d+|:[a-zA-Z_][a-zA-Z0-9_]*`)
+	fingerprintList   = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintSpace  = regexp.MustCompile(`\s+`)
+	sqlTokenRegex     = regexp.MustCompile("\"[^\"]*\"|`[^`]*`|[a-z_][a-z0-9_]*(?:\\.[a-z_][a-z0-9_]*)?|<=|>=|<>|!=|=|<|>|\\(|\\)|,|\\?|\\*")
+)
+
+// FingerprintSQL replaces the values of a statement with ? and normalizes case and spaces, statements
+// differing only in their values have the same fingerprint
+func FingerprintSQL(query string) string {
+	fp := fingerprintString.ReplaceAllString(query, "?")
+	fp = fingerprintParam.ReplaceAllString(fp, "?")
+	fp = fingerprintNumber.ReplaceAllString(fp, "?")
+	fp = fingerprintList.ReplaceAllString(fp, "(?)")
+	fp = fingerprintSpace.ReplaceAllString(strings.TrimSpace(fp), " ")
+	return strings.TrimSuffix(strings.ToLower(fp), ";")
+}
+
+// RecordSlowStatements adds the statements of a request that took longer than the slow threshold
+func RecordSlowStatements(statements []string, took time.Duration) {
+	threshold := SlowRequestThreshold()
+	if threshold == 0 || took < threshold || len(statements) == 0 {
+		return
+	}
+	ms := float64(took.Microseconds()) / 1000
+	now := CurrentClock.Now()
+	slowStatements.mu.Lock()
+	defer slowStatements.mu.Unlock()
+	for _, query := range statements {
+		fp := FingerprintSQL(query)
+		if fp == "" {
+			continue
+		}
+		s, ok := slowStatements.byFP[fp]
+		if !ok {
+			if len(slowStatements.byFP) >= ADVISOR_MAX_STATEMENTS {
+				evictSlowStatement()
+			}
+			sum := sha256.Sum256([]byte(fp))
+			s = &SlowStatement{ID: hex.EncodeToString(sum[:6]), Statement: fp}
+			slowStatements.byFP[fp] = s
+		}
+		s.Count++
+		s.TotalMs += ms
+		if ms > s.MaxMs {
+			s.MaxMs = ms
+		}
+		s.LastSeen = now
+	}
+}
+
+// evictSlowStatement drops the least recently seen fingerprint, the lock is held by the caller
+func evictSlowStatement() {
+	var oldest *SlowStatement
+	for _, s := range slowStatements.byFP {
+		if oldest == nil || s.LastSeen.Before(oldest.LastSeen) {
+			oldest = s
+		}
+	}
+	if oldest != nil {
+		delete(slowStatements.byFP, oldest.Statement)
+	}
+}
+
+// ListSlowStatements returns the slow statement log, the most total time first
+func ListSlowStatements() []SlowStatement {
+	slowStatements.mu.Lock()
+	list := make([]SlowStatement, 0, len(slowStatements.byFP))
+	for _, s := range slowStatements.byFP {
+		list = append(list, *s)
+	}
+	slowStatements.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].TotalMs > list[j].TotalMs })
+	return list
+}
+
+// ClearSlowStatements empties the slow statement log
+func ClearSlowStatements() {
+	slowStatements.mu.Lock()
+	slowStatements.byFP = map[string]*SlowStatement{}
+	slowStatements.mu.Unlock()
+}
+
+// statementColumns are the columns a statement filters and sorts on, by table
+type statementColumns struct {
+	filter map[string][]string
+	order  map[string][]string
+}
+
+// sqlKeywords end a table alias or an ORDER BY list
+var sqlKeywords = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true, "full": true, "cross": true,
+	"outer": true, "on": true, "group": true, "order": true, "by": true, "limit": true, "offset": true,
+	"having": true, "union": true, "set": true, "as": true, "and": true, "or": true, "not": true,
+	"asc": true, "desc": true, "nulls": true, "first": true, "last": true, "select": true, "from": true,
+	"natural": true, "using": true, "values": true, "returning": true, "window": true,
+}
+
+// filterOperators follow a column that is filtered on
+var filterOperators = map[string]bool{
+	"=": true, "<": true, ">": true, "<=": true, ">=": true, "<>": true, "!=": true,
+	"like": true, "in": true, "between": true, "is": true, "not": true, "glob": true, "ilike": true,
+}
+
+// parseStatementColumns reads the tables, their aliases and the filter and sort columns of a fingerprint
+func parseStatementColumns(fp string) statementColumns {
+	tokens := sqlTokenRegex.FindAllString(fp, -1)
+	for i, t := range tokens {
+		tokens[i] = strings.Trim(t, "\"`")
+	}
+	aliases := map[string]string{} // alias or table name -> table
+	tables := []string{}
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "from", "join", "update", "into":
+			if i+1 >= len(tokens) || tokens[i+1] == "(" || !identifierRegex.MatchString(tokens[i+1]) {
+				continue
+			}
+			table := tokens[i+1]
+			aliases[table] = table
+			tables = append(tables, table)
+			j := i + 2
+			if j < len(tokens) && tokens[j] == "as" {
+				j++
+			}
+			if j < len(tokens) && identifierRegex.MatchString(tokens[j]) && !sqlKeywords[tokens[j]] {
+				aliases[tokens[j]] = table
+			}
+		}
+	}
+
+	cols := statementColumns{filter: map[string][]string{}, order: map[string][]string{}}
+	resolve := func(name string) (string, string, bool) {
+		if dot := strings.IndexByte(name, '.'); dot > 0 {
+			table, ok := aliases[name[:dot]]
+			return table, name[dot+1:], ok
+		}
+		if len(tables) != 1 {
+			return "", "", false
+		}
+		return tables[0], name, true
+	}
+	add := func(m map[string][]string, name string) {
+		if table, column, ok := resolve(name); ok {
+			for _, c := range m[table] {
+				if c == column {
+					return
+				}
+			}
+			m[table] = append(m[table], column)
+		}
+	}
+
+	clause := ""
+	for i, t := range tokens {
+		switch {
+		case t == "where" || t == "on" || t == "having":
+			clause = "filter"
+		case t == "order" && i+1 < len(tokens) && tokens[i+1] == "by":
+			clause = "order"
+		case t == "group" || t == "limit" || t == "offset" || t == "union" || t == "select" || t == "from" || t == "set":
+			clause = ""
+		case sqlKeywords[t] || !identifierRegex.MatchString(t):
+		case clause == "filter":
+			next, prev := "", ""
+			if i+1 < len(tokens) {
+				next = tokens[i+1]
+			}
+			if i > 0 {
+				prev = tokens[i-1]
+			}
+			// a column before the operator, or a qualified one after it (join columns)
+			if filterOperators[next] || (filterOperators[prev] && strings.Contains(t, ".")) {
+				add(cols.filter, t)
+			}
+		case clause == "order":
+			add(cols.order, t)
+		}
+	}
+	return cols
+}
+
+// Advise recommends indexes for the slow statement log, withDDL adds the CREATE INDEX statements
+func Advise(withDDL bool) ([]IndexRecommendation, error) {
+	byKey := map[string]*IndexRecommendation{}
+	indexes := map[string][][]string{}
+	for _, s := range ListSlowStatements() {
+		cols := parseStatementColumns(s.Statement)
+		for table, filter := range cols.filter {
+			addRecommendation(byKey, indexes, s, table, filter, "filtered on in WHERE/ON")
+		}
+		for table, order := range cols.order {
+			if _, filtered := cols.filter[table]; !filtered {
+				addRecommendation(byKey, indexes, s, table, order, "sorted on in ORDER BY")
+			}
+		}
+	}
+	recs := make([]IndexRecommendation, 0, len(byKey))
+	for _, r := range byKey {
+		if withDDL {
+			r.DDL = IndexDDL(r.Table, r.Columns)
+		}
+		recs = append(recs, *r)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].TotalMs > recs[j].TotalMs })
+	return recs, nil
+}
+
+// addRecommendation adds the statement to the recommendation of the columns, unless the table does not
+// exist, is internal, or has an index (or primary key) starting with the first column
+func addRecommendation(byKey map[string]*IndexRecommendation, indexes map[string][][]string, s SlowStatement, table string, columns []string, reason string) {
+	if strings.HasPrefix(table, "_") || ValidateTableName(table, false) != nil {
+		return
+	}
+	schema, err := TableSchema(table, false)
+	if err != nil {
+		return
+	}
+	valid := []string{}
+	for _, c := range columns {
+		if col := findColumn(schema, c); col != nil && len(valid) < ADVISOR_MAX_COLUMNS {
+			if col.PrimaryKey && len(valid) == 0 {
+				return
+			}
+			valid = append(valid, col.Name)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	if _, ok := indexes[table]; !ok {
+		indexes[table] = TableIndexes(table)
+	}
+	for _, index := range indexes[table] {
+		if len(index) > 0 && strings.EqualFold(index[0], valid[0]) {
+			return
+		}
+	}
+	key := table + "(" + strings.Join(valid, ",") + ")"
+	r, ok := byKey[key]
+	if !ok {
+		r = &IndexRecommendation{Table: table, Columns: valid, Reason: strings.Join(valid, ", ") + " " + reason + " without an index"}
+		byKey[key] = r
+	}
+	r.Statements = append(r.Statements, s.ID)
+	r.Count += s.Count
+	r.TotalMs += s.TotalMs
+}
+
+// IndexDDL is the CREATE INDEX statement of the columns in the dialect of this node
+func IndexDDL(table string, columns []string) string {
+	name := "idx_" + table + "_" + strings.Join(columns, "_")
+	if CurrentDialect().Name == DialectMySQL.Name {
+		return "CREATE INDEX " + name + " ON " + table + " (" + strings.Join(columns, ", ") + ")"
+	}
+	return "CREATE INDEX IF NOT EXISTS " + name + " ON " + table + " (" + strings.Join(columns, ", ") + ")"
+}
+
+// TableIndexes returns the columns of every index of the table in index order, nil when they cannot be read
+func TableIndexes(table string) [][]string {
+	b := NewQueryBuilder(CurrentDialect())
+	var query orm.ParametereizedSQL
+	switch CurrentDialect().Name {
+	case DialectSQLite.Name:
+		query = orm.ParametereizedSQL{Query: "SELECT il.name AS index_name, ii.name AS column_name FROM pragma_index_list(" + b.Arg(table) +
+			") AS il, pragma_index_info(il.name) AS ii ORDER BY il.name, ii.seqno"}
+	case DialectMySQL.Name:
+		query = orm.ParametereizedSQL{Query: "SELECT INDEX_NAME AS index_name, COLUMN_NAME AS column_name FROM information_schema.statistics" +
+			" WHERE table_schema = DATABASE() AND table_name = " + b.Arg(table) + " ORDER BY INDEX_NAME, SEQ_IN_INDEX"}
+	default:
+		query = orm.ParametereizedSQL{Query: "SELECT i.relname AS index_name, a.attname AS column_name FROM pg_index x" +
+			" JOIN pg_class t ON t.oid = x.indrelid JOIN pg_class i ON i.oid = x.indexrelid" +
+			" JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = ANY(x.indkey)" +
+			" WHERE t.relname = " + b.Arg(table) + " ORDER BY i.relname, array_position(x.indkey::int2[], a.attnum)"}
+	}
+	query.Values = b.Args()
+	records, err := CurrentNode.GetInternalConnection().SelectOneSQLParameterized(query)
+	if err != nil {
+		return nil
+	}
+	order := []string{}
+	byName := map[string][]string{}
+	for _, rec := range records {
+		name, _ := rec.Data["index_name"].(string)
+		column, _ := rec.Data["column_name"].(string)
+		if _, ok := byName[name]; !ok {
+			order = append(order, name)
+		}
+		byName[name] = append(byName[name], column)
+	}
+	indexes := make([][]string, 0, len(order))
+	for _, name := range order {
+		indexes = append(indexes, byName[name])
+	}
+	return indexes
+}
@@ -0,0 +1,255 @@
+package suresql
+
+import (
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Aggregates without SQL: /db/api/aggregate counts, sums, averages and takes the minimum or maximum of
+// columns of the rows matching an orm.Condition, optionally per group of the group_by columns. Clients
+// that may not send raw SQL can count this way. The values are typed the same on every DBMS: COUNT is an
+// integer, AVG a float and SUM an integer when it has no fraction, also when the DBMS returns text
+// (PostgreSQL numeric). MIN and MAX are returned as the DBMS gives them, they work on text and dates too.
+// /db/api/query with group_by in its condition renders the same select: the group columns and aggregates
+// instead of SELECT *. Both take a having condition on the groups, its fields may name the aliases.
+
+const (
+	AGGREGATE_COUNT = "COUNT"
+	AGGREGATE_SUM   = "SUM"
+	AGGREGATE_AVG   = "AVG"
+	AGGREGATE_MIN   = "MIN"
+	AGGREGATE_MAX   = "MAX"
+)
+
+var (
+	ErrAggregateNone      = medaerror.MedaError{Message: "aggregate needs at least one function"}
+	ErrAggregateFunction  = medaerror.MedaError{Message: "aggregate function must be COUNT, SUM, AVG, MIN or MAX"}
+	ErrAggregateColumn    = medaerror.MedaError{Message: "aggregate function needs a column, only COUNT takes none"}
+	ErrAggregateAlias     = medaerror.MedaError{Message: "aggregate alias is invalid or used twice"}
+	ErrAggregateCondition = medaerror.MedaError{Message: "aggregate condition takes no group by, use group_by of the request"}
+)
+
+// BuildAggregateRequest checks the request and renders its select in the dialect of the node, it returns
+// the functions with their aliases filled in
+func BuildAggregateRequest(req AggregateRequest) (orm.ParametereizedSQL, []AggregateFunction, error) {
+	if err := ValidateTableName(req.Table, false); err != nil {
+		return orm.ParametereizedSQL{}, nil, err
+	}
+	if len(req.Aggregates) == 0 {
+		return orm.ParametereizedSQL{}, nil, ErrAggregateNone
+	}
+	if req.Condition != nil && len(req.Condition.GroupBy) > 0 {
+		return orm.ParametereizedSQL{}, nil, ErrAggregateCondition
+	}
+	b := NewQueryBuilder(CurrentDialect())
+	query, functions, err := b.groupedSelect(req.Table, req.GroupBy, req.Aggregates, req.Condition, req.Having)
+	if err != nil {
+		return orm.ParametereizedSQL{}, nil, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, functions, nil
+}
+
+// Grouped tells if the query groups its rows: group_by in the condition, aggregates or having
+func (r QueryRequest) Grouped() bool {
+	return (r.Condition != nil && len(r.Condition.GroupBy) > 0) || len(r.Aggregates) > 0 || r.Having != nil
+}
+
+// BuildGroupedQuery renders the select of a grouped QueryRequest: the group columns and the aggregates of
+// every group instead of SELECT *, which a DBMS refuses (PostgreSQL) or answers with an arbitrary row
+func BuildGroupedQuery(req QueryRequest) (orm.ParametereizedSQL, []AggregateFunction, error) {
+	c := orm.Condition{}
+	if req.Condition != nil {
+		c = *req.Condition
+	}
+	groupBy := c.GroupBy
+	c.GroupBy = nil
+	if req.SingleRow {
+		c.Limit = 1
+	}
+	b := NewQueryBuilder(CurrentDialect())
+	from := req.Table
+	if len(req.Joins) > 0 {
+		var err error
+		if from, _, err = b.joinedFrom(req.Table, req.Joins); err != nil {
+			return orm.ParametereizedSQL{}, nil, err
+		}
+	} else if err := ValidateTableName(req.Table, false); err != nil {
+		return orm.ParametereizedSQL{}, nil, err
+	}
+	query, functions, err := b.groupedSelect(from, groupBy, req.Aggregates, &c, req.Having)
+	if err != nil {
+		return orm.ParametereizedSQL{}, nil, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, functions, nil
+}
+
+// groupedSelect renders the select of the group columns and the aggregates from the validated table (and
+// joins) with WHERE, GROUP BY, HAVING, ORDER BY and LIMIT/OFFSET, it returns the aggregates with their
+// aliases filled in
+func (b *QueryBuilder) groupedSelect(from string, groupBy []string, aggregates []AggregateFunction, c, having *orm.Condition) (string, []AggregateFunction, error) {
+	if len(groupBy) == 0 && len(aggregates) == 0 {
+		return "", nil, ErrAggregateNone
+	}
+	group, err := b.GroupBy(groupBy)
+	if err != nil {
+		return "", nil, err
+	}
+	seen := map[string]bool{}
+	columns := make([]string, 0, len(groupBy)+len(aggregates))
+	for _, g := range groupBy {
+		g = strings.TrimSpace(g)
+		seen[strings.ToLower(g)] = true
+		columns = append(columns, g)
+	}
+	functions := make([]AggregateFunction, 0, len(aggregates))
+	expressions := make(map[string]string, len(aggregates))
+	for _, f := range aggregates {
+		expr, err := f.normalize()
+		if err != nil {
+			return "", nil, err
+		}
+		if seen[strings.ToLower(f.Alias)] {
+			return "", nil, medaerror.Errorf("%s: %q", ErrAggregateAlias.Message, f.Alias)
+		}
+		seen[strings.ToLower(f.Alias)] = true
+		expressions[strings.ToLower(f.Alias)] = expr
+		functions = append(functions, f)
+		columns = append(columns, expr+" AS "+f.Alias)
+	}
+
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM " + from
+	if c == nil {
+		c = &orm.Condition{}
+	}
+	where, err := b.Where(c)
+	if err != nil {
+		return "", nil, err
+	}
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if group != "" {
+		query += " GROUP BY " + group
+	}
+	if having != nil {
+		if len(having.GroupBy) > 0 || len(having.OrderBy) > 0 || having.Limit != 0 || having.Offset != 0 {
+			return "", nil, ErrHavingCondition
+		}
+		if group == "" {
+			return "", nil, ErrHavingNoGroupBy
+		}
+		clause, err := b.Having(having, expressions)
+		if err != nil {
+			return "", nil, err
+		}
+		if clause != "" {
+			query += " HAVING " + clause
+		}
+	}
+	// ORDER BY, LIMIT and OFFSET apply to the groups, the order may name a group column or an alias
+	tail, err := b.tail(&orm.Condition{OrderBy: c.OrderBy, Limit: c.Limit, Offset: c.Offset})
+	if err != nil {
+		return "", nil, err
+	}
+	return query + tail, functions, nil
+}
+
+// normalize upper-cases the function, fills in the alias (count, sum_amount, ...) and renders the expression
+func (f *AggregateFunction) normalize() (string, error) {
+	f.Function = strings.ToUpper(strings.TrimSpace(f.Function))
+	f.Column = strings.TrimSpace(f.Column)
+	switch f.Function {
+	case AGGREGATE_COUNT, AGGREGATE_SUM, AGGREGATE_AVG, AGGREGATE_MIN, AGGREGATE_MAX:
+	default:
+		return "", medaerror.Errorf("%s: %q", ErrAggregateFunction.Message, f.Function)
+	}
+	if f.Column == "*" {
+		f.Column = ""
+	}
+	if f.Column == "" && (f.Function != AGGREGATE_COUNT || f.Distinct) {
+		return "", ErrAggregateColumn
+	}
+	if f.Column != "" {
+		if err := ValidateIdentifier(f.Column); err != nil {
+			return "", err
+		}
+	}
+	if f.Alias == "" {
+		f.Alias = strings.ToLower(f.Function)
+		if f.Column != "" {
+			f.Alias += "_" + strings.ReplaceAll(f.Column, ".", "_")
+		}
+	}
+	if err := ValidateIdentifier(f.Alias); err != nil || strings.Contains(f.Alias, ".") {
+		return "", medaerror.Errorf("%s: %q", ErrAggregateAlias.Message, f.Alias)
+	}
+
+	arg := "*"
+	if f.Column != "" {
+		arg = f.Column
+		if f.Distinct {
+			arg = "DISTINCT " + arg
+		}
+	}
+	return f.Function + "(" + arg + ")", nil
+}
+
+// AggregateRows runs the select on db and returns its rows with the aggregate values typed
+func AggregateRows(db SureSQLDB, paramSQL orm.ParametereizedSQL, functions []AggregateFunction) ([]map[string]interface{}, error) {
+	records, err := db.SelectOneSQLParameterized(paramSQL)
+	if err != nil && err != orm.ErrSQLNoRows {
+		return nil, err
+	}
+	rows := make([]map[string]interface{}, 0, len(records))
+	for _, rec := range records {
+		row := rec.Data
+		if row == nil {
+			row = map[string]interface{}{}
+		}
+		for _, f := range functions {
+			row[f.Alias] = aggregateValue(f.Function, row[f.Alias])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// aggregateValue types the value of the function, NULL (SUM of no rows) stays nil
+func aggregateValue(function string, v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	if v == nil || function == AGGREGATE_MIN || function == AGGREGATE_MAX {
+		return v
+	}
+	if _, isBool := v.(bool); isBool {
+		return v
+	}
+	n, ok := numericValue(v)
+	if !ok {
+		if n, ok = numericString(v); !ok {
+			return v
+		}
+	}
+	switch function {
+	case AGGREGATE_AVG:
+		return n
+	case AGGREGATE_SUM:
+		if n != float64(int64(n)) {
+			return n
+		}
+	}
+	// integers stay exact, json and text ones come as float64 or string
+	switch i := v.(type) {
+	case int64:
+		return i
+	case int:
+		return int64(i)
+	case int32:
+		return int64(i)
+	}
+	return int64(n)
+}
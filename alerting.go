@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/medatechnology/goutil/simplelog"
@@ -35,7 +36,7 @@ type AlertManager struct {
 	poolWarningThreshold  float64 // Percentage
 	poolCriticalThreshold float64 // Percentage
 	checkInterval         time.Duration
-	ticker                *time.Ticker
+	ticker                Ticker
 	stopChan              chan struct{}
 	wg                    sync.WaitGroup
 	running               bool
@@ -69,7 +70,7 @@ func (am *AlertManager) Start(ctx context.Context) {
 	am.running = true
 	am.mu.Unlock()
 
-	am.ticker = time.NewTicker(am.checkInterval)
+	am.ticker = CurrentClock.NewTicker(am.checkInterval)
 	am.wg.Add(1)
 
 	go func() {
@@ -84,7 +85,7 @@ func (am *AlertManager) Start(ctx context.Context) {
 			case <-am.stopChan:
 				simplelog.LogThis("AlertManager", "Stop signal received, stopping alert monitoring")
 				return
-			case <-am.ticker.C:
+			case <-am.ticker.C():
 				am.checkSystemHealth()
 			}
 		}
@@ -136,7 +137,7 @@ func (am *AlertManager) checkConnectionPool() {
 
 	// Critical threshold
 	if usagePct >= am.poolCriticalThreshold {
-		if time.Since(am.lastPoolCritical) > am.alertCooldown {
+		if CurrentClock.Since(am.lastPoolCritical) > am.alertCooldown {
 			am.CreateAlert(AlertLevelCritical,
 				"Connection Pool Critical",
 				fmt.Sprintf("Connection pool at %.1f%% capacity (%d/%d). Immediate action required!",
@@ -147,11 +148,11 @@ func (am *AlertManager) checkConnectionPool() {
 					"usage_percentage":  usagePct,
 				},
 			)
-			am.lastPoolCritical = time.Now()
+			am.lastPoolCritical = CurrentClock.Now()
 		}
 	} else if usagePct >= am.poolWarningThreshold {
 		// Warning threshold
-		if time.Since(am.lastPoolWarning) > am.alertCooldown {
+		if CurrentClock.Since(am.lastPoolWarning) > am.alertCooldown {
 			am.CreateAlert(AlertLevelWarning,
 				"Connection Pool High Usage",
 				fmt.Sprintf("Connection pool at %.1f%% capacity (%d/%d). Consider scaling or investigating connection leaks.",
@@ -162,21 +163,22 @@ func (am *AlertManager) checkConnectionPool() {
 					"usage_percentage":  usagePct,
 				},
 			)
-			am.lastPoolWarning = time.Now()
+			am.lastPoolWarning = CurrentClock.Now()
 		}
 	}
 
 	// Check for pool exhaustion events
 	if Metrics != nil {
-		exhaustionCount := Metrics.PoolExhaustionCount
-		if exhaustionCount > 0 && time.Since(Metrics.LastPoolExhaustion) < 5*time.Minute {
+		exhaustionCount := atomic.LoadUint64(&Metrics.PoolExhaustionCount)
+		lastExhaustion := Metrics.LastPoolExhaustionTime()
+		if exhaustionCount > 0 && CurrentClock.Since(lastExhaustion) < 5*time.Minute {
 			am.CreateAlert(AlertLevelCritical,
 				"Connection Pool Exhaustion",
 				fmt.Sprintf("Connection pool has been exhausted %d times recently. Last occurrence: %s",
-					exhaustionCount, Metrics.LastPoolExhaustion.Format(time.RFC3339)),
+					exhaustionCount, lastExhaustion.Format(time.RFC3339)),
 				map[string]interface{}{
 					"exhaustion_count": exhaustionCount,
-					"last_exhaustion": Metrics.LastPoolExhaustion,
+					"last_exhaustion": lastExhaustion,
 				},
 			)
 		}
@@ -244,7 +246,7 @@ func (am *AlertManager) CreateAlert(level AlertLevel, title, message string, met
 		Level:     level,
 		Title:     title,
 		Message:   message,
-		Timestamp: time.Now(),
+		Timestamp: CurrentClock.Now(),
 		Metadata:  metadata,
 	}
 
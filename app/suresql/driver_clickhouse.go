@@ -0,0 +1,6 @@
+//go:build clickhouse
+
+package main
+
+// ClickHouse support (DBMS_TYPE=CLICKHOUSE): go build -tags clickhouse
+import _ "github.com/ClickHouse/clickhouse-go/v2"
@@ -0,0 +1,6 @@
+//go:build cockroach
+
+package main
+
+// CockroachDB support (DBMS_TYPE=COCKROACH): go build -tags cockroach
+import _ "github.com/jackc/pgx/v5/stdlib"
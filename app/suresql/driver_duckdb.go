@@ -0,0 +1,6 @@
+//go:build duckdb
+
+package main
+
+// DuckDB support (DBMS_TYPE=DUCKDB), embedded and needs cgo: go build -tags duckdb
+import _ "github.com/marcboeker/go-duckdb"
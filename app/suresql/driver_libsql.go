@@ -0,0 +1,6 @@
+//go:build libsql
+
+package main
+
+// libSQL/Turso support (DBMS_TYPE=LIBSQL): go build -tags libsql
+import _ "github.com/tursodatabase/libsql-client-go/libsql"
@@ -0,0 +1,6 @@
+//go:build mysql
+
+package main
+
+// MySQL/MariaDB support (DBMS_TYPE=MYSQL or MARIADB): go build -tags mysql
+import _ "github.com/go-sql-driver/mysql"
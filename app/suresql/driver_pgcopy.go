@@ -0,0 +1,31 @@
+//go:build pgcopy || cockroach
+
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/medatechnology/suresql"
+)
+
+// COPY FROM STDIN for the bulk loads on PostgreSQL and CockroachDB: go build -tags pgcopy
+func init() {
+	suresql.RegisterCopyFrom("pgx", func(ctx context.Context, db *sql.DB, table string, columns []string, rows [][]interface{}) (int64, error) {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		var copied int64
+		err = conn.Raw(func(driverConn interface{}) error {
+			var copyErr error
+			copied, copyErr = driverConn.(*stdlib.Conn).Conn().CopyFrom(ctx, pgx.Identifier{table}, columns, pgx.CopyFromRows(rows))
+			return copyErr
+		})
+		return copied, err
+	})
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/medatechnology/suresql"
 	"github.com/medatechnology/suresql/server"
 
@@ -8,7 +15,26 @@ import (
 )
 
 // SureSQL BackEnd Service
+// `suresql init` (or the binary named suresql-init) only initializes/migrates the DB and exits,
+// for init containers. It exits with 1 when that fails so the pod does not start the server.
+// `suresql generate -table users -rows 1000` inserts fake rows for development and exits.
 func main() {
+	if filepath.Base(os.Args[0]) == "suresql-init" || (len(os.Args) > 1 && os.Args[1] == "init") {
+		err := suresql.InitInternal()
+		suresql.StopEmbeddedRqlite()
+		if err != nil {
+			simplelog.LogErrorStr("sureSQL", err, "Cannot initialize internal DB")
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		os.Exit(generate(os.Args[2:]))
+	}
+
+	// the embedded rqlited (RQLITED_EMBED) is stopped with SureSQL
+	defer suresql.StopEmbeddedRqlite()
 	err := suresql.ConnectInternal()
 	if err != nil {
 		// Cannot connect to DBMS, exit the app
@@ -27,3 +53,46 @@ func main() {
 		simplelog.LogErrorStr("main", err, "cannot start SureSQL")
 	}
 }
+
+// generate is the generate verb, hints are -hint column=kind (repeatable)
+func generate(args []string) int {
+	var req suresql.GenerateRequest
+	hints := hintFlags{}
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	fs.StringVar(&req.Table, "table", "", "table to fill")
+	fs.IntVar(&req.Rows, "rows", 100, "number of rows")
+	fs.Int64Var(&req.Seed, "seed", 0, "same seed gives the same rows, 0 is random")
+	fs.BoolVar(&req.DryRun, "dry-run", false, "print a sample without inserting")
+	fs.Var(hints, "hint", "column=kind, ie: contact=email")
+	fs.Parse(args)
+	req.Hints = hints
+
+	defer suresql.StopEmbeddedRqlite()
+	if err := suresql.ConnectInternal(); err != nil {
+		simplelog.LogErrorStr("generate", err, "Cannot connect to internal DB")
+		return 1
+	}
+	result, err := suresql.GenerateRows(req)
+	if err != nil {
+		simplelog.LogErrorStr("generate", err, "Cannot generate rows")
+		return 1
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
+
+type hintFlags map[string]string
+
+func (h hintFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h hintFlags) Set(v string) error {
+	column, kind, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("hint must be column=kind")
+	}
+	h[column] = kind
+	return nil
+}
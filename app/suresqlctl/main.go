@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/medatechnology/suresql"
+)
+
+// SureSQL control tool
+// `suresqlctl init-cluster -nodes 3 -format compose -out cluster` writes docker-compose.yml (or systemd
+// units with -format systemd), the env file of every node and bootstrap.yaml, with new secrets.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "init-cluster":
+		os.Exit(initCluster(os.Args[2:]))
+	case "help", "-h", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: suresqlctl init-cluster [flags], run suresqlctl init-cluster -h for the flags")
+}
+
+// initCluster is the init-cluster verb, settings are -setting category.key=value (repeatable)
+func initCluster(args []string) int {
+	var spec suresql.ClusterSpec
+	var hosts, out string
+	var force bool
+	var settings settingFlags
+	fs := flag.NewFlagSet("init-cluster", flag.ExitOnError)
+	fs.IntVar(&spec.Nodes, "nodes", 3, "number of nodes")
+	fs.StringVar(&spec.Format, "format", suresql.CLUSTER_FORMAT_COMPOSE, "compose or systemd")
+	fs.StringVar(&spec.Name, "name", suresql.CLUSTER_DEFAULT_NAME, "prefix of the services, units and hostnames")
+	fs.StringVar(&hosts, "hosts", "", "systemd: comma separated host of every node, <name>-<n> when empty")
+	fs.StringVar(&spec.Image, "image", suresql.CLUSTER_DEFAULT_IMAGE, "compose: SureSQL image")
+	fs.StringVar(&spec.RqliteImage, "rqlite-image", suresql.CLUSTER_DEFAULT_RQLITE_IMAGE, "compose: rqlite image")
+	fs.IntVar(&spec.APIPort, "port", suresql.CLUSTER_DEFAULT_API_PORT, "SureSQL port, compose publishes node n on port+n-1")
+	fs.IntVar(&spec.HTTPPort, "rqlite-http-port", suresql.CLUSTER_DEFAULT_HTTP_PORT, "rqlite HTTP port")
+	fs.IntVar(&spec.RaftPort, "rqlite-raft-port", suresql.CLUSTER_DEFAULT_RAFT_PORT, "rqlite Raft port")
+	fs.StringVar(&spec.BinaryPath, "binary", "/usr/local/bin/suresql", "systemd: path of the suresql binary on the hosts")
+	fs.Var(&settings, "setting", "category.key=value, more _settings rows of bootstrap.yaml, ie: query.slow_ms=500")
+	fs.StringVar(&out, "out", "cluster", "output directory")
+	fs.BoolVar(&force, "force", false, "overwrite existing files")
+	fs.Parse(args)
+	if hosts != "" {
+		for _, h := range strings.Split(hosts, ",") {
+			spec.Hosts = append(spec.Hosts, strings.TrimSpace(h))
+		}
+	}
+	spec.Settings = settings
+
+	files, err := suresql.GenerateCluster(spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// nothing is written when one file exists, the secrets of a half overwritten cluster would not match
+	if !force {
+		for _, f := range files {
+			if _, err := os.Stat(filepath.Join(out, f.Path)); err == nil {
+				fmt.Fprintf(os.Stderr, "%s exists, use -force to overwrite\n", filepath.Join(out, f.Path))
+				return 1
+			}
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(out, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		mode := os.FileMode(0644)
+		if f.Secret {
+			mode = 0600
+		}
+		if err := os.WriteFile(path, []byte(f.Content), mode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(path)
+	}
+	return 0
+}
+
+type settingFlags []suresql.BootstrapSetting
+
+func (s *settingFlags) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *settingFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	category, key, dot := strings.Cut(name, ".")
+	if !ok || !dot {
+		return fmt.Errorf("setting must be category.key=value")
+	}
+	// the type follows the value, the int and bool settings are read from their own columns
+	typ := "text"
+	if _, err := strconv.Atoi(value); err == nil {
+		typ = "int"
+	} else if value == "true" || value == "false" {
+		typ = "bool"
+	}
+	*s = append(*s, suresql.BootstrapSetting{Category: category, Key: key, Type: typ, Value: value})
+	return nil
+}
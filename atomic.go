@@ -0,0 +1,140 @@
+package suresql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	orm "github.com/medatechnology/simpleorm"
+	"github.com/medatechnology/simpleorm/rqlite"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Atomic batches: the statements of one /db/api/sql request (atomic: true) run in one transaction,
+// the first failure rolls all of them back. rqlite runs them as one transaction request, the
+// database/sql backends in a transaction of their own connection, the Postgres package and
+// ClickHouse have no transaction to run them in.
+
+var ErrAtomicNotSupported = medaerror.MedaError{Message: "atomic batches are not supported by this DBMS"}
+
+// AtomicFailure is the data of the error of a batch that was rolled back, Statement counts from 1 over
+// the raw statements then the parameterized ones
+type AtomicFailure struct {
+	Statement int    `json:"statement"`
+	Error     string `json:"error"`
+}
+
+// atomicError is the error returned for the failed statement i (from 0)
+func atomicError(i int, err error) error {
+	e := medaerror.Errorf("statement %d failed, the batch was rolled back: %s", i+1, err.Error())
+	e.Data = AtomicFailure{Statement: i + 1, Error: err.Error()}
+	e.Err = err
+	return e
+}
+
+// ExecAtomic runs the statements in one transaction. The results stop at the failed statement, whose
+// error tells which one it was, nothing of the batch is applied then.
+func ExecAtomic(db SureSQLDB, ps []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	if f, ok := db.(faultyDB); ok {
+		if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+			return nil, err
+		}
+		db = f.SureSQLDB
+	}
+	if s, ok := db.(serializedDB); ok {
+		db = s.RQLiteDirectDB
+	}
+	switch d := db.(type) {
+	case *rqlite.RQLiteDirectDB:
+		return rqliteAtomic(d, ps)
+	case *SQLDatabase:
+		results, err := d.execTx(ps)
+		if err != nil {
+			for i, r := range results {
+				if r.Error != nil {
+					return results[:i+1], atomicError(i, r.Error)
+				}
+			}
+		}
+		return results, err
+	default:
+		return nil, ErrAtomicNotSupported
+	}
+}
+
+// rqliteAtomic posts the statements to /db/execute?transaction, rqlite stops at the first error and
+// rolls back, the orm package has no way to set the flag
+func rqliteAtomic(db *rqlite.RQLiteDirectDB, ps []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	results, err := rqliteExecute(db, ps, true)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range results {
+		if r.Error != nil {
+			return results[:i+1], atomicError(i, r.Error)
+		}
+	}
+	if len(results) != len(ps) {
+		return nil, medaerror.Errorf("rqlite execute returned %d results for %d statements", len(results), len(ps))
+	}
+	return results, nil
+}
+
+// rqliteExecute posts the statements to /db/execute and returns the result of each with its own error,
+// the orm package turns a failed statement into the error of all of them
+func rqliteExecute(db *rqlite.RQLiteDirectDB, ps []orm.ParametereizedSQL, transaction bool) ([]orm.BasicSQLResult, error) {
+	statements := make([][]interface{}, len(ps))
+	for i, p := range ps {
+		statements[i] = append([]interface{}{p.Query}, p.Values...)
+	}
+	body, err := json.Marshal(statements)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := db.Config.URL + "/db/execute?timings"
+	if transaction {
+		endpoint += "&transaction"
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if db.Config.Username != "" || db.Config.Password != "" {
+		req.SetBasicAuth(db.Config.Username, db.Config.Password)
+	}
+	resp, err := db.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, medaerror.Errorf("rqlite execute returned %s", resp.Status)
+	}
+
+	var out struct {
+		Results []struct {
+			LastInsertID int     `json:"last_insert_id"`
+			RowsAffected int     `json:"rows_affected"`
+			Time         float64 `json:"time"`
+			Error        string  `json:"error"`
+		} `json:"results"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.Error != "" {
+		return nil, errors.New(out.Error)
+	}
+	results := make([]orm.BasicSQLResult, len(out.Results))
+	for i, r := range out.Results {
+		results[i] = orm.BasicSQLResult{LastInsertID: r.LastInsertID, RowsAffected: r.RowsAffected, Timing: r.Time}
+		if r.Error != "" {
+			results[i].Error = errors.New(r.Error)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,118 @@
+package suresql
+
+import (
+	"context"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Batch updates: /db/api/update/batch takes records of any table that carry the key of their row, every
+// other column of a record is set on that row. One statement per record is sent in one round trip, with
+// atomic in one transaction like the atomic batches of /db/api/sql. The key is key_columns of the request
+// or the primary key of each table. Rows of integrity tables get their checksum written again.
+
+const BATCH_UPDATE_MAX_RECORDS = 1000
+
+// BuildBatchUpdate renders the update of every record in the dialect of the node, the problems of the
+// records are returned by record index like the validation of /db/api/insert
+func BuildBatchUpdate(req BatchUpdateRequest) ([]orm.ParametereizedSQL, []RecordFieldError) {
+	var errs []RecordFieldError
+	statements := make([]orm.ParametereizedSQL, 0, len(req.Records))
+	keys := map[string][]string{}
+	for i, rec := range req.Records {
+		fieldErr := func(field, msg string) {
+			errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Field: field, Message: msg})
+		}
+		if err := ValidateTableName(rec.TableName, false); err != nil {
+			fieldErr("", err.Error())
+			continue
+		}
+		key, ok := keys[rec.TableName]
+		if !ok {
+			key = req.KeyColumns
+			if len(key) == 0 {
+				key = primaryKeyColumns(rec.TableName)
+			}
+			keys[rec.TableName] = key
+		}
+		if len(key) == 0 {
+			fieldErr("", "table has no primary key, set key_columns")
+			continue
+		}
+
+		// the key columns select the row, the other columns are set
+		condition := orm.Condition{Logic: "AND"}
+		values := make(map[string]interface{}, len(rec.Data))
+		for column, v := range rec.Data {
+			values[column] = v
+		}
+		for _, column := range key {
+			v, ok := rec.Data[column]
+			if !ok || v == nil {
+				fieldErr(column, "key column is missing")
+				continue
+			}
+			condition.Nested = append(condition.Nested, orm.Condition{Field: column, Operator: "=", Value: v})
+			delete(values, column)
+		}
+		if len(condition.Nested) != len(key) {
+			continue
+		}
+		if len(values) == 0 {
+			fieldErr("", ErrUpdateNoValues.Message)
+			continue
+		}
+		if fieldErrs := ValidateUpdateValues(rec.TableName, values); len(fieldErrs) > 0 {
+			for _, fe := range fieldErrs {
+				fe.Record = i
+				errs = append(errs, fe)
+			}
+			continue
+		}
+		paramSQL, err := BuildUpdate(CurrentDialect(), rec.TableName, values, &condition)
+		if err != nil {
+			fieldErr("", err.Error())
+			continue
+		}
+		statements = append(statements, paramSQL)
+	}
+	return statements, errs
+}
+
+// BatchUpdateRows runs the statements of the request on db, in one transaction when it is atomic, and
+// rehashes the rows of integrity tables
+func BatchUpdateRows(db SureSQLDB, req BatchUpdateRequest, statements []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	var results []orm.BasicSQLResult
+	var err error
+	switch {
+	case req.Atomic:
+		results, err = ExecAtomic(db, statements)
+	case len(statements) == 1:
+		results = []orm.BasicSQLResult{db.ExecOneSQLParameterized(statements[0])}
+		err = results[0].Error
+	default:
+		results, err = db.ExecManySQLParameterized(statements)
+	}
+	if err != nil {
+		return results, err
+	}
+
+	// rows of integrity tables are rehashed by the key column of their checksum, when the record has it
+	rehash := map[string][]interface{}{}
+	for i, rec := range req.Records {
+		if i >= len(results) || results[i].Error != nil || results[i].RowsAffected == 0 {
+			continue
+		}
+		if t, checksummed := integrityTable(rec.TableName); checksummed {
+			if key, ok := rec.Data[t.KeyColumn]; ok {
+				rehash[rec.TableName] = append(rehash[rec.TableName], key)
+			}
+		}
+	}
+	for table, keys := range rehash {
+		if _, err := RehashIntegrity(context.Background(), table, keys); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
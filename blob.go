@@ -0,0 +1,347 @@
+package suresql
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Binary attachments linked to rows. Metadata is in _files, the content is kept by a BlobStore:
+//   - "db" (default): base64 chunks in _file_chunks, replicated together with the rest of the data
+//   - "dir": files in a directory, ie: a mounted object storage bucket shared by the nodes
+// The store is chosen with setting files/store, files/dir is the directory and files/max_size the
+// upload limit in bytes. Uploads and downloads are streamed chunk by chunk.
+
+const (
+	BLOB_STORE_DB  = "db"
+	BLOB_STORE_DIR = "dir"
+
+	DEFAULT_BLOB_MAX_SIZE   = 10 << 20 // 10MB
+	DEFAULT_BLOB_CHUNK_SIZE = 256 << 10
+	DEFAULT_BLOB_DIR        = "./files"
+)
+
+var (
+	ErrFileNotFound = medaerror.MedaError{Message: "file not found"}
+	ErrFileTooLarge = medaerror.MedaError{Message: "file exceeds the maximum size"}
+)
+
+// FileTable is the metadata of an attachment
+type FileTable struct {
+	ID          int       `json:"id,omitempty"            db:"id"`
+	TableName_  string    `json:"table_name"              db:"table_name"` // table of the row this file belongs to
+	RowID       string    `json:"row_id"                  db:"row_id"`
+	FileName    string    `json:"file_name"               db:"file_name"`
+	ContentType string    `json:"content_type"            db:"content_type"`
+	Size        int64     `json:"size"                    db:"size"`
+	Checksum    string    `json:"checksum"                db:"checksum"` // sha256 hex
+	Store       string    `json:"store"                   db:"store"`    // db or dir, where the content is
+	CreatedBy   string    `json:"created_by,omitempty"    db:"created_by"`
+	CreatedAt   time.Time `json:"created_at,omitempty"    db:"created_at"`
+}
+
+func (f FileTable) TableName() string {
+	return "_files"
+}
+
+// FileChunkTable is one chunk of a file kept by the db store
+type FileChunkTable struct {
+	ID     int    `json:"id,omitempty"   db:"id"`
+	FileID int    `json:"file_id"        db:"file_id"`
+	Seq    int    `json:"seq"            db:"seq"`
+	Data   string `json:"data"           db:"data"` // base64
+}
+
+func (f FileChunkTable) TableName() string {
+	return "_file_chunks"
+}
+
+// BlobStore keeps the content of the files
+type BlobStore interface {
+	Name() string
+	Put(fileID int, r io.Reader) error
+	Open(fileID int) (io.ReadCloser, error)
+	Delete(fileID int) error
+}
+
+// CurrentBlobStore returns the store configured in settings
+func CurrentBlobStore() BlobStore {
+	return blobStoreByName(fileSetting(SETTING_KEY_FILES_STORE, BLOB_STORE_DB))
+}
+
+func blobStoreByName(name string) BlobStore {
+	if name == BLOB_STORE_DIR {
+		return dirBlobStore{dir: fileSetting(SETTING_KEY_FILES_DIR, DEFAULT_BLOB_DIR)}
+	}
+	return dbBlobStore{}
+}
+
+// MaxBlobSize is the upload limit in bytes
+func MaxBlobSize() int64 {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_FILES, SETTING_KEY_FILES_MAX_SIZE); ok && tmp.IntValue > 0 {
+		return int64(tmp.IntValue)
+	}
+	return DEFAULT_BLOB_MAX_SIZE
+}
+
+func fileSetting(key, def string) string {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_FILES, key); ok && tmp.TextValue != "" {
+		return tmp.TextValue
+	}
+	return def
+}
+
+// SaveFile streams the content into the current store and records the metadata. size is what the client
+// announced, the content is cut at the max size anyway.
+func SaveFile(meta FileTable, r io.Reader) (FileTable, error) {
+	max := MaxBlobSize()
+	if meta.Size > max {
+		return meta, ErrFileTooLarge
+	}
+	store := CurrentBlobStore()
+	meta.Store = store.Name()
+	meta.CreatedAt = time.Now().UTC()
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+
+	// metadata first so the chunks have a file id, size and checksum are updated after streaming
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + meta.TableName() + " (table_name, row_id, file_name, content_type, size, checksum, store, created_by, created_at)" +
+			" VALUES (?, ?, ?, ?, 0, '', ?, ?, ?)",
+		Values: []interface{}{meta.TableName_, meta.RowID, meta.FileName, meta.ContentType, meta.Store, meta.CreatedBy, meta.CreatedAt},
+	})
+	if res.Error != nil {
+		return meta, res.Error
+	}
+	meta.ID = int(res.LastInsertID)
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(io.LimitReader(r, max+1), hash)}
+	err := store.Put(meta.ID, counter)
+	if err == nil && counter.n > max {
+		err = ErrFileTooLarge
+	}
+	if err != nil {
+		store.Delete(meta.ID)
+		deleteFileMeta(meta.ID)
+		return meta, err
+	}
+
+	meta.Size = counter.n
+	meta.Checksum = hex.EncodeToString(hash.Sum(nil))
+	res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "UPDATE " + meta.TableName() + " SET size = ?, checksum = ? WHERE id = ?",
+		Values: []interface{}{meta.Size, meta.Checksum, meta.ID},
+	})
+	return meta, res.Error
+}
+
+// GetFileMeta returns the metadata of a file
+func GetFileMeta(id int) (FileTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(FileTable{}.TableName(), &orm.Condition{Field: "id", Operator: "=", Value: id})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return FileTable{}, ErrFileNotFound
+		}
+		return FileTable{}, err
+	}
+	return object.MapToStructSlowDB[FileTable](rec.Data), nil
+}
+
+// ListFiles returns the files of a row (or the whole table when rowID is empty)
+func ListFiles(table, rowID string) ([]FileTable, error) {
+	condition := orm.Condition{Field: "table_name", Operator: "=", Value: table, OrderBy: []string{"id ASC"}}
+	if rowID != "" {
+		condition = orm.Condition{
+			Logic: "AND",
+			Nested: []orm.Condition{
+				{Field: "table_name", Operator: "=", Value: table},
+				{Field: "row_id", Operator: "=", Value: rowID},
+			},
+			OrderBy: []string{"id ASC"},
+		}
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(FileTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []FileTable{}, nil
+		}
+		return nil, err
+	}
+	files := make([]FileTable, 0, len(records))
+	for _, rec := range records {
+		files = append(files, object.MapToStructSlowDB[FileTable](rec.Data))
+	}
+	return files, nil
+}
+
+// OpenFile returns a reader of the content, from the store the file was saved in
+func OpenFile(meta FileTable) (io.ReadCloser, error) {
+	return blobStoreByName(meta.Store).Open(meta.ID)
+}
+
+// DeleteFile removes content and metadata
+func DeleteFile(meta FileTable) error {
+	if err := blobStoreByName(meta.Store).Delete(meta.ID); err != nil {
+		return err
+	}
+	return deleteFileMeta(meta.ID)
+}
+
+func deleteFileMeta(id int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + FileTable{}.TableName() + " WHERE id = ?",
+		Values: []interface{}{id},
+	})
+	return res.Error
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// dbBlobStore keeps the content as base64 chunks in _file_chunks
+type dbBlobStore struct{}
+
+func (dbBlobStore) Name() string { return BLOB_STORE_DB }
+
+func (dbBlobStore) Put(fileID int, r io.Reader) error {
+	buf := make([]byte, DEFAULT_BLOB_CHUNK_SIZE)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+				Query:  "INSERT INTO " + FileChunkTable{}.TableName() + " (file_id, seq, data) VALUES (?, ?, ?)",
+				Values: []interface{}{fileID, seq, base64.StdEncoding.EncodeToString(buf[:n])},
+			})
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (dbBlobStore) Open(fileID int) (io.ReadCloser, error) {
+	return &dbChunkReader{fileID: fileID}, nil
+}
+
+func (dbBlobStore) Delete(fileID int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + FileChunkTable{}.TableName() + " WHERE file_id = ?",
+		Values: []interface{}{fileID},
+	})
+	return res.Error
+}
+
+// dbChunkReader loads one chunk at a time so large files are not held in memory
+type dbChunkReader struct {
+	fileID int
+	seq    int
+	buf    []byte
+	done   bool
+}
+
+func (c *dbChunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(FileChunkTable{}.TableName(), &orm.Condition{
+			Logic: "AND",
+			Nested: []orm.Condition{
+				{Field: "file_id", Operator: "=", Value: c.fileID},
+				{Field: "seq", Operator: "=", Value: c.seq},
+			},
+		})
+		if err != nil {
+			if IsNoRowsError(err) {
+				c.done = true
+				continue
+			}
+			return 0, err
+		}
+		chunk := object.MapToStructSlowDB[FileChunkTable](rec.Data)
+		if c.buf, err = base64.StdEncoding.DecodeString(chunk.Data); err != nil {
+			return 0, err
+		}
+		c.seq++
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *dbChunkReader) Close() error { return nil }
+
+// dirBlobStore keeps the content as files named by id in a directory
+type dirBlobStore struct {
+	dir string
+}
+
+func (d dirBlobStore) Name() string { return BLOB_STORE_DIR }
+
+func (d dirBlobStore) path(fileID int) string {
+	return filepath.Join(d.dir, strconv.Itoa(fileID)+".blob")
+}
+
+func (d dirBlobStore) Put(fileID int, r io.Reader) error {
+	if err := os.MkdirAll(d.dir, 0o750); err != nil {
+		return err
+	}
+	// write to a temp name first so a failed upload never leaves a partial file under the real name
+	tmp := d.path(fileID) + ".part"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, d.path(fileID))
+}
+
+func (d dirBlobStore) Open(fileID int) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(fileID))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	return f, err
+}
+
+func (d dirBlobStore) Delete(fileID int) error {
+	err := os.Remove(d.path(fileID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
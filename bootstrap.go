@@ -0,0 +1,186 @@
+package suresql
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/encryption"
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Bootstrap file: declarative provisioning applied by InitDB on the first run, after the migrations.
+// It holds the initial schema (DDL), settings rows and admin users, so a new node is set up the same
+// way in every environment instead of with manual inserts. ${VAR} in user and setting values is taken
+// from the environment, keep passwords out of the file that way. Example:
+//
+//	schema:
+//	  - |
+//	    CREATE TABLE IF NOT EXISTS customers (id INTEGER PRIMARY KEY, name TEXT);
+//	settings:
+//	  - category: query
+//	    key: slow_ms
+//	    type: int
+//	    value: 500
+//	users:
+//	  - username: admin
+//	    password: ${ADMIN_PASSWORD}
+//	    role_name: admin
+
+const (
+	DEFAULT_BOOTSTRAP_FILE     = "bootstrap.yaml"
+	BOOTSTRAP_MIGRATION_PREFIX = "bootstrap:"
+)
+
+var ErrBootstrapInvalid = medaerror.MedaError{Message: "invalid bootstrap file"}
+
+type Bootstrap struct {
+	Schema   []string           `json:"schema,omitempty"`
+	Settings []BootstrapSetting `json:"settings,omitempty"`
+	Users    []BootstrapUser    `json:"users,omitempty"`
+}
+
+// BootstrapSetting is a _settings row, it replaces the row with the same category and key
+type BootstrapSetting struct {
+	Category string `json:"category"`
+	Key      string `json:"key"`
+	Type     string `json:"type"` // int, bool, float or text (default)
+	Value    string `json:"value"`
+}
+
+// BootstrapUser is created when the username does not exist yet. Password is hashed like /suresql/users
+// does, PasswordHash is stored as is (for hashes exported from another node with the same API key).
+type BootstrapUser struct {
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	RoleName     string `json:"role_name,omitempty"`
+	Tenant       string `json:"tenant,omitempty"`
+}
+
+// BootstrapFile is the path from SURESQL_BOOTSTRAP or bootstrap.yaml
+func BootstrapFile() string {
+	return utils.GetEnvString("SURESQL_BOOTSTRAP", DEFAULT_BOOTSTRAP_FILE)
+}
+
+// LoadBootstrap reads and validates the bootstrap file, ok is false when the file does not exist
+func LoadBootstrap(path string) (Bootstrap, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Bootstrap{}, false, nil
+		}
+		return Bootstrap{}, false, err
+	}
+	b, err := ParseBootstrap(data)
+	return b, true, err
+}
+
+// ParseBootstrap decodes the YAML content, unknown keys are an error so typos do not go unnoticed
+func ParseBootstrap(data []byte) (Bootstrap, error) {
+	var b Bootstrap
+	doc, err := ParseYAML(data)
+	if err != nil || doc == nil {
+		return b, err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return b, err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		return b, medaerror.Errorf("%s: %v", ErrBootstrapInvalid.Message, err)
+	}
+	return b, b.Validate()
+}
+
+func (b Bootstrap) Validate() error {
+	for i, s := range b.Settings {
+		if s.Category == "" || s.Key == "" {
+			return medaerror.Errorf("%s: settings[%d]: category and key are required", ErrBootstrapInvalid.Message, i)
+		}
+		if _, err := s.record(); err != nil {
+			return medaerror.Errorf("%s: settings[%d]: %v", ErrBootstrapInvalid.Message, i, err)
+		}
+	}
+	seen := map[string]bool{}
+	for i, u := range b.Users {
+		if (u.Password == "") == (u.PasswordHash == "") {
+			return medaerror.Errorf("%s: users[%d]: exactly one of password or password_hash is required", ErrBootstrapInvalid.Message, i)
+		}
+		// the password is checked after ${VAR} expansion, when it is applied
+		if err := ValidateUserFields(u.Username, "", u.RoleName); err != nil {
+			return medaerror.Errorf("%s: users[%d]: %v", ErrBootstrapInvalid.Message, i, err)
+		}
+		if seen[u.Username] {
+			return medaerror.Errorf("%s: users[%d]: duplicate username %s", ErrBootstrapInvalid.Message, i, u.Username)
+		}
+		seen[u.Username] = true
+	}
+	return nil
+}
+
+// record converts the value to the column of its type, environment variables in the value are expanded
+func (s BootstrapSetting) record() (SettingTable, error) {
+	return settingRecord(s.Category, s.Key, s.Type, os.ExpandEnv(s.Value))
+}
+
+// Steps are the statements InitDB runs for the file, in order: schema, settings, users. Every step is
+// safe to run again after a crash (settings are deleted then inserted, users are only inserted if missing).
+func (b Bootstrap) Steps() ([]orm.ParametereizedSQL, error) {
+	var steps []orm.ParametereizedSQL
+	for _, ddl := range b.Schema {
+		for _, cmd := range orm.ConvertSQLCommands(strings.Split(ddl, "\n")) {
+			steps = append(steps, orm.ParametereizedSQL{Query: cmd})
+		}
+	}
+	settingsTable := SettingTable{}.TableName()
+	for _, s := range b.Settings {
+		rec, err := s.record()
+		if err != nil {
+			return nil, err
+		}
+		if rec.TextValue, err = SealSetting(rec.Category, rec.SettingKey, rec.TextValue); err != nil {
+			return nil, err
+		}
+		steps = append(steps,
+			orm.ParametereizedSQL{
+				Query:  "DELETE FROM " + settingsTable + " WHERE category = ? AND setting_key = ?",
+				Values: []interface{}{rec.Category, rec.SettingKey},
+			},
+			orm.ParametereizedSQL{
+				Query:  "INSERT INTO " + settingsTable + " (category, data_type, setting_key, text_value, float_value, int_value) VALUES (?, ?, ?, ?, ?, ?)",
+				Values: []interface{}{rec.Category, rec.DataType, rec.SettingKey, rec.TextValue, rec.FloatValue, rec.IntValue},
+			})
+	}
+	for _, u := range b.Users {
+		hashed := u.PasswordHash
+		if u.Password != "" {
+			password := os.ExpandEnv(u.Password)
+			if err := ValidateUserFields(u.Username, password, u.RoleName); err != nil {
+				return nil, medaerror.Errorf("%s: user %s: %v", ErrBootstrapInvalid.Message, u.Username, err)
+			}
+			var err error
+			hashed, err = encryption.HashPin(password, CurrentNode.Config.APIKey, CurrentNode.Config.ClientID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		steps = append(steps, orm.ParametereizedSQL{
+			Query: "INSERT INTO _users (username, password, role_name, tenant, created_at)" +
+				" SELECT ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM _users WHERE username = ?)",
+			Values: []interface{}{u.Username, hashed, u.RoleName, u.Tenant, CurrentClock.Now().UTC(), u.Username},
+		})
+	}
+	return steps, nil
+}
+
+// bootstrapMigrationName is how the file is recorded in _migrations, after the numbered files
+func bootstrapMigrationName(path string) string {
+	return BOOTSTRAP_MIGRATION_PREFIX + filepath.Base(path)
+}
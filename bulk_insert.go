@@ -0,0 +1,171 @@
+package suresql
+
+import (
+	"sort"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Bulk inserts: the records of one table are inserted with multi-row INSERT ... VALUES (...), (...)
+// statements instead of one statement per record, the DBMS parses and plans once per statement. A
+// statement holds at most BULK_INSERT_MAX_ROWS rows and stays under the placeholder limit of the DBMS,
+// wide tables get fewer rows per statement. Consecutive records with the same columns share a
+// statement, a record missing a column gets the column default and not NULL. ClickHouse keeps its
+// native batches. Every statement has one result, its rows affected are the rows it inserted.
+
+const (
+	BULK_INSERT_MAX_ROWS           = 1000
+	BULK_INSERT_DEFAULT_MAX_PARAMS = 999 // SQLite before 3.32
+)
+
+var ErrBulkInsertEmpty = medaerror.MedaError{Message: "no records to insert"}
+
+// BulkInsertMaxParams is the number of placeholders a statement of the DBMS can have
+func BulkInsertMaxParams(dbms string) int {
+	switch strings.ToUpper(strings.TrimSpace(dbms)) {
+	case "", "RQLITE", "LIBSQL", "TURSO":
+		return 32766 // SQLITE_MAX_VARIABLE_NUMBER since 3.32
+	case "POSTGRESQL", "POSTGRES", "COCKROACH", "COCKROACHDB", "MYSQL", "MARIADB", "DUCKDB":
+		return 65535 // the parameter count is an uint16 in the wire protocols
+	default:
+		return BULK_INSERT_DEFAULT_MAX_PARAMS
+	}
+}
+
+// BuildBulkInsert renders the multi-row inserts of the records in the dialect, maxParams is the
+// placeholder limit of a statement
+func BuildBulkInsert(d Dialect, records []orm.DBRecord, maxParams int) []orm.ParametereizedSQL {
+	statements, _ := buildBulkInsert(d, records, maxParams)
+	return statements
+}
+
+// buildBulkInsert is BuildBulkInsert with the index of the first record of every statement
+func buildBulkInsert(d Dialect, records []orm.DBRecord, maxParams int) ([]orm.ParametereizedSQL, []int) {
+	var statements []orm.ParametereizedSQL
+	var starts []int
+	for start := 0; start < len(records); {
+		columns := recordColumns(records[start])
+		rows := BULK_INSERT_MAX_ROWS
+		if len(columns) > 0 && maxParams/len(columns) < rows {
+			rows = maxParams / len(columns)
+		}
+		if rows < 1 {
+			rows = 1
+		}
+
+		end := start + 1
+		for end < len(records) && end-start < rows && sameInsertShape(records[start], records[end], columns) {
+			end++
+		}
+
+		b := NewQueryBuilder(d)
+		values := make([]string, 0, end-start)
+		for _, rec := range records[start:end] {
+			params := make([]string, len(columns))
+			for i, column := range columns {
+				params[i] = b.Arg(rec.Data[column])
+			}
+			values = append(values, "("+strings.Join(params, ", ")+")")
+		}
+		query := "INSERT INTO " + records[start].TableName + " (" + strings.Join(columns, ", ") + ") VALUES " + strings.Join(values, ", ")
+		statements = append(statements, orm.ParametereizedSQL{Query: query, Values: b.Args()})
+		starts = append(starts, start)
+		start = end
+	}
+	return statements, starts
+}
+
+// recordColumns are the columns of the record, sorted so the statements are the same for the same shape
+func recordColumns(rec orm.DBRecord) []string {
+	columns := make([]string, 0, len(rec.Data))
+	for column := range rec.Data {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// sameInsertShape tells if next goes to the table of first with exactly its columns
+func sameInsertShape(first, next orm.DBRecord, columns []string) bool {
+	if next.TableName != first.TableName || len(next.Data) != len(columns) {
+		return false
+	}
+	for _, column := range columns {
+		if _, ok := next.Data[column]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// InsertManySameTable inserts the records of one table on db with COPY (see copy.go) or multi-row
+// statements, the way /db/api/insert, the write queue and the generator insert many records
+func InsertManySameTable(db SureSQLDB, records []orm.DBRecord) ([]orm.BasicSQLResult, error) {
+	if len(records) == 0 {
+		return nil, ErrBulkInsertEmpty
+	}
+	if results, ok := copyInsert(db, records); ok {
+		return results, nil
+	}
+	dbms := CurrentNode.GetInternalConfig().DBMS
+	if strings.EqualFold(strings.TrimSpace(dbms), "CLICKHOUSE") {
+		return db.InsertManyDBRecordsSameTable(records, false)
+	}
+	return db.ExecManySQLParameterized(BuildBulkInsert(CurrentDialect(), records, BulkInsertMaxParams(dbms)))
+}
+
+// InsertChunk inserts the records (of one or more tables) with COPY or multi-row statements as one atomic
+// batch (ExecAtomic), on error nothing is written and failed holds every record. ClickHouse writes the
+// records of one table in a native batch, the same. Where the DBMS has no atomic batches the statements
+// run one at a time up to the first that fails, the records before it are written and failed holds the
+// rest, so what is written is always the first records (a resumed upload skips them). failed are indexes
+// into records.
+func InsertChunk(db SureSQLDB, records []orm.DBRecord) (results []orm.BasicSQLResult, failed []int, err error) {
+	if len(records) == 0 {
+		return nil, nil, ErrBulkInsertEmpty
+	}
+	all := func() []int {
+		failed := make([]int, len(records))
+		for i := range failed {
+			failed[i] = i
+		}
+		return failed
+	}
+	sameTable := true
+	for _, rec := range records[1:] {
+		sameTable = sameTable && rec.TableName == records[0].TableName
+	}
+	if sameTable {
+		if results, ok := copyInsert(db, records); ok {
+			return results, nil, nil
+		}
+	}
+	dbms := CurrentNode.GetInternalConfig().DBMS
+	if sameTable && strings.EqualFold(strings.TrimSpace(dbms), "CLICKHOUSE") {
+		if results, err = db.InsertManyDBRecordsSameTable(records, false); err != nil {
+			return nil, all(), err
+		}
+		return results, nil, nil
+	}
+
+	statements, starts := buildBulkInsert(CurrentDialect(), records, BulkInsertMaxParams(dbms))
+	results, err = ExecAtomic(db, statements)
+	if err != ErrAtomicNotSupported {
+		if err != nil {
+			return nil, all(), err
+		}
+		return results, nil, nil
+	}
+	results = nil
+	for i, statement := range statements {
+		res := db.ExecOneSQLParameterized(statement)
+		if res.Error != nil {
+			return results, all()[starts[i]:], res.Error
+		}
+		results = append(results, res)
+	}
+	return results, nil, nil
+}
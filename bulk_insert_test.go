@@ -0,0 +1,98 @@
+package suresql
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	orm "github.com/medatechnology/simpleorm"
+	"github.com/medatechnology/simpleorm/rqlite"
+)
+
+func TestBuildBulkInsert(t *testing.T) {
+	var records []orm.DBRecord
+	for i := 0; i < 5; i++ {
+		records = append(records, orm.DBRecord{TableName: "users", Data: map[string]interface{}{"name": fmt.Sprint("u", i), "age": i}})
+	}
+	// a record without age breaks the statement, so age gets its default and not NULL
+	records = append(records, orm.DBRecord{TableName: "users", Data: map[string]interface{}{"name": "no age"}})
+
+	statements := BuildBulkInsert(DialectPostgres, records, 4)
+	if len(statements) != 4 {
+		t.Fatalf("got %d statements, want 4 (2+2+1 rows, then the other shape)", len(statements))
+	}
+	want := "INSERT INTO users (age, name) VALUES ($1, $2), ($3, $4)"
+	if statements[0].Query != want {
+		t.Fatalf("got %q, want %q", statements[0].Query, want)
+	}
+	if len(statements[0].Values) != 4 || statements[0].Values[0] != 0 || statements[0].Values[1] != "u0" {
+		t.Fatalf("values in the wrong order: %v", statements[0].Values)
+	}
+	if statements[3].Query != "INSERT INTO users (name) VALUES ($1)" {
+		t.Fatalf("got %q for the record without age", statements[3].Query)
+	}
+
+	rows := 0
+	for _, s := range BuildBulkInsert(DialectSQLite, benchRecords(2500), BulkInsertMaxParams("RQLITE")) {
+		if strings.Contains(s.Query, "$") || len(s.Values) > BulkInsertMaxParams("RQLITE") {
+			t.Fatalf("bad statement for sqlite: %d values", len(s.Values))
+		}
+		rows += len(s.Values) / 3
+	}
+	if rows != 2500 {
+		t.Fatalf("statements insert %d rows, want 2500", rows)
+	}
+}
+
+// Throughput of large imports, one statement per record against multi-row statements. They need a
+// running rqlite, ie: SURESQL_BENCH_RQLITE=http://localhost:4001 go test -run '^$' -bench Import .
+
+func BenchmarkImportPerRecord(b *testing.B) {
+	benchImport(b, func(records []orm.DBRecord) []orm.ParametereizedSQL {
+		return orm.ToInsertSQLParameterizedFromSlice(records)
+	})
+}
+
+func BenchmarkImportMultiRow(b *testing.B) {
+	benchImport(b, func(records []orm.DBRecord) []orm.ParametereizedSQL {
+		return BuildBulkInsert(DialectSQLite, records, BulkInsertMaxParams("RQLITE"))
+	})
+}
+
+func benchImport(b *testing.B, statements func([]orm.DBRecord) []orm.ParametereizedSQL) {
+	url := os.Getenv("SURESQL_BENCH_RQLITE")
+	if url == "" {
+		b.Skip("SURESQL_BENCH_RQLITE is not set")
+	}
+	db, err := rqlite.NewDatabase(rqlite.RqliteDirectConfig{URL: url, RetryCount: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{1000, 10000} {
+		records := benchRecords(size)
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if _, err := db.ExecManySQL([]string{"DROP TABLE IF EXISTS bench_import", "CREATE TABLE bench_import (id INTEGER PRIMARY KEY, name TEXT, email TEXT, age INTEGER)"}); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if _, err := db.ExecManySQLParameterized(statements(records)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func benchRecords(n int) []orm.DBRecord {
+	records := make([]orm.DBRecord, n)
+	for i := range records {
+		records[i] = orm.DBRecord{TableName: "bench_import", Data: map[string]interface{}{
+			"name": fmt.Sprint("user ", i), "email": fmt.Sprintf("user%d@example.com", i), "age": i % 90,
+		}}
+	}
+	return records
+}
@@ -0,0 +1,312 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Change data capture with triggers: a covered table gets AFTER INSERT/UPDATE/DELETE triggers that copy
+// the old and new row (as JSON) into _cdc_log. Triggers are plain SQLite so this works on RQLite where
+// every node applies them with the write. The log is what time-travel (AsOf) queries replay backwards.
+// The column list is captured when CDC is enabled, re-enable after changing the table schema.
+// changed_at is the clock of the node applying the write: rqlite fixes the time of the statements it
+// receives, not of the statements a trigger runs, so every node logs the same change at a slightly
+// different time. AsOf therefore reads the rows and the log from the leader (weak consistency), after a
+// leader change the times are those of the new leader and an as_of close to a change can flip sides.
+
+const (
+	CDC_OP_INSERT = "insert"
+	CDC_OP_UPDATE = "update"
+	CDC_OP_DELETE = "delete"
+
+	DEFAULT_CDC_KEY_COLUMN = "id"
+
+	// same format as the triggers write, sorts as text
+	CDC_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	ErrCDCNotEnabled   = medaerror.MedaError{Message: "cdc is not enabled for this table"}
+	ErrCDCUnsupported  = medaerror.MedaError{Message: "cdc triggers are only supported on sqlite/rqlite"}
+	ErrAsOfBeforeCDC   = medaerror.MedaError{Message: "as_of is before cdc was enabled for this table, history is incomplete"}
+	ErrCDCNoKeyColumn  = medaerror.MedaError{Message: "key column does not exist in the table"}
+	ErrCDCTableColumns = medaerror.MedaError{Message: "cannot read the table columns"}
+)
+
+// CDCTable is a table covered by CDC
+type CDCTable struct {
+	ID         int       `json:"id,omitempty"         db:"id"`
+	TableName_ string    `json:"table_name"           db:"table_name"`
+	KeyColumn  string    `json:"key_column"           db:"key_column"` // identifies a row across changes
+	Columns    string    `json:"columns"              db:"columns"`    // comma separated, captured by the triggers
+	EnabledAt  time.Time `json:"enabled_at,omitempty" db:"enabled_at"`
+}
+
+func (c CDCTable) TableName() string {
+	return "_cdc_tables"
+}
+
+// CDCChange is one captured change
+type CDCChange struct {
+	ID         int    `json:"id"                 db:"id"`
+	TableName_ string `json:"table_name"         db:"table_name"`
+	RowKey     string `json:"row_key"            db:"row_key"`
+	Op         string `json:"op"                 db:"op"`
+	OldData    string `json:"old_data,omitempty" db:"old_data"` // JSON object, empty for insert
+	NewData    string `json:"new_data,omitempty" db:"new_data"` // JSON object, empty for delete
+	ChangedAt  string `json:"changed_at"         db:"changed_at"`
+}
+
+func (c CDCChange) TableName() string {
+	return "_cdc_log"
+}
+
+// EnableCDC installs (or re-installs) the capture triggers on the table
+func EnableCDC(table, keyColumn string) (CDCTable, error) {
+	if keyColumn == "" {
+		keyColumn = DEFAULT_CDC_KEY_COLUMN
+	}
+	cfg := CDCTable{TableName_: table, KeyColumn: keyColumn, EnabledAt: time.Now().UTC()}
+	if err := ValidateTableName(table, false); err != nil {
+		return cfg, err
+	}
+	if err := ValidateIdentifier(keyColumn); err != nil {
+		return cfg, err
+	}
+	if CurrentDialect().Name != DialectSQLite.Name {
+		return cfg, ErrCDCUnsupported
+	}
+
+	columns, err := tableColumns(table)
+	if err != nil {
+		return cfg, err
+	}
+	hasKey := false
+	for _, col := range columns {
+		hasKey = hasKey || col == keyColumn
+	}
+	if !hasKey {
+		return cfg, ErrCDCNoKeyColumn
+	}
+	cfg.Columns = strings.Join(columns, ",")
+
+	stmts := append(dropCDCTriggers(table), createCDCTriggers(cfg, columns)...)
+	if _, err := CurrentNode.GetInternalConnection().ExecManySQL(stmts); err != nil {
+		return cfg, err
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + cfg.TableName() + " (table_name, key_column, columns, enabled_at) VALUES (?, ?, ?, ?)" +
+			" ON CONFLICT(table_name) DO UPDATE SET key_column=excluded.key_column, columns=excluded.columns",
+		Values: []interface{}{cfg.TableName_, cfg.KeyColumn, cfg.Columns, cfg.EnabledAt},
+	})
+	return cfg, res.Error
+}
+
+// DisableCDC drops the triggers, the captured log is kept
+func DisableCDC(table string) error {
+	if err := ValidateTableName(table, false); err != nil {
+		return err
+	}
+	if _, err := CurrentNode.GetInternalConnection().ExecManySQL(dropCDCTriggers(table)); err != nil {
+		return err
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + CDCTable{}.TableName() + " WHERE table_name = ?",
+		Values: []interface{}{table},
+	})
+	return res.Error
+}
+
+// GetCDCTable returns the CDC config of the table, ErrCDCNotEnabled if it is not covered
+func GetCDCTable(table string) (CDCTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(CDCTable{}.TableName(), &orm.Condition{Field: "table_name", Operator: "=", Value: table})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return CDCTable{}, ErrCDCNotEnabled
+		}
+		return CDCTable{}, err
+	}
+	return object.MapToStructSlowDB[CDCTable](rec.Data), nil
+}
+
+// ListCDCTables returns all tables covered by CDC
+func ListCDCTables() ([]CDCTable, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectMany(CDCTable{}.TableName())
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []CDCTable{}, nil
+		}
+		return nil, err
+	}
+	tables := make([]CDCTable, 0, len(records))
+	for _, rec := range records {
+		tables = append(tables, object.MapToStructSlowDB[CDCTable](rec.Data))
+	}
+	return tables, nil
+}
+
+// ChangesSince returns the changes of the table after t, newest first
+func ChangesSince(table string, t time.Time) ([]CDCChange, error) {
+	return changesSince(CurrentNode.GetInternalConnection(), table, t)
+}
+
+// changesSince reads the changes of the table after t on db
+func changesSince(db SureSQLDB, table string, t time.Time) ([]CDCChange, error) {
+	records, err := db.SelectOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "SELECT * FROM " + CDCChange{}.TableName() + " WHERE table_name = ? AND changed_at > ? ORDER BY id DESC",
+		Values: []interface{}{table, t.UTC().Format(CDC_TIME_FORMAT)},
+	})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []CDCChange{}, nil
+		}
+		return nil, err
+	}
+	changes := make([]CDCChange, 0, len(records))
+	for _, rec := range records {
+		changes = append(changes, object.MapToStructSlowDB[CDCChange](rec.Data))
+	}
+	return changes, nil
+}
+
+// ReconstructAsOf returns the rows of the table as they were at asOf: it reads the current rows and undoes
+// every change logged after asOf, newest first. Rows come back ordered by the key column.
+func ReconstructAsOf(db SureSQLDB, table string, asOf time.Time) ([]orm.DBRecord, error) {
+	cfg, err := GetCDCTable(table)
+	if err != nil {
+		return nil, err
+	}
+	if asOf.Before(cfg.EnabledAt) {
+		return nil, ErrAsOfBeforeCDC
+	}
+
+	// the rows and the log come from one node, the leader, see changed_at in the file comment
+	if db, _, err = ConsistentRead(db, ReadConsistency{Level: CONSISTENCY_WEAK}); err != nil {
+		return nil, err
+	}
+	current, err := db.SelectMany(table)
+	if err != nil && !IsNoRowsError(err) {
+		return nil, err
+	}
+	rows := make(map[string]map[string]interface{}, len(current))
+	for _, rec := range current {
+		rows[cdcKey(rec.Data[cfg.KeyColumn])] = rec.Data
+	}
+
+	changes, err := changesSince(db, table, asOf)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range changes {
+		oldRow, newRow, err := ch.decode()
+		if err != nil {
+			return nil, err
+		}
+		switch ch.Op {
+		case CDC_OP_INSERT:
+			delete(rows, cdcKey(newRow[cfg.KeyColumn]))
+		case CDC_OP_UPDATE:
+			delete(rows, cdcKey(newRow[cfg.KeyColumn]))
+			rows[cdcKey(oldRow[cfg.KeyColumn])] = oldRow
+		case CDC_OP_DELETE:
+			rows[cdcKey(oldRow[cfg.KeyColumn])] = oldRow
+		}
+	}
+
+	records := make([]orm.DBRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, orm.DBRecord{TableName: table, Data: row})
+	}
+	err = SortRecords(records, []string{cfg.KeyColumn})
+	return records, err
+}
+
+func (ch CDCChange) decode() (oldRow, newRow map[string]interface{}, err error) {
+	if ch.OldData != "" {
+		if err = json.Unmarshal([]byte(ch.OldData), &oldRow); err != nil {
+			return nil, nil, err
+		}
+	}
+	if ch.NewData != "" {
+		if err = json.Unmarshal([]byte(ch.NewData), &newRow); err != nil {
+			return nil, nil, err
+		}
+	}
+	return oldRow, newRow, nil
+}
+
+// cdcKey renders a key value the same way whether it came from the DB or from JSON (1 and 1.0 are "1")
+func cdcKey(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+			return strconv.FormatInt(int64(n), 10)
+		}
+	case json.Number:
+		return n.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func tableColumns(table string) ([]string, error) {
+	schema, err := TableSchema(table, true)
+	if err != nil {
+		if err == ErrTableNotExist {
+			return nil, ErrCDCTableColumns
+		}
+		return nil, err
+	}
+	columns := make([]string, 0, len(schema))
+	for _, col := range schema {
+		if err := ValidateIdentifier(col.Name); err != nil {
+			return nil, medaerror.Errorf("%s: %q", ErrCDCTableColumns.Message, col.Name)
+		}
+		columns = append(columns, col.Name)
+	}
+	return columns, nil
+}
+
+func cdcTriggerName(table, op string) string {
+	return "_cdc_" + table + "_" + op
+}
+
+func dropCDCTriggers(table string) []string {
+	return []string{
+		"DROP TRIGGER IF EXISTS " + cdcTriggerName(table, CDC_OP_INSERT),
+		"DROP TRIGGER IF EXISTS " + cdcTriggerName(table, CDC_OP_UPDATE),
+		"DROP TRIGGER IF EXISTS " + cdcTriggerName(table, CDC_OP_DELETE),
+	}
+}
+
+func createCDCTriggers(cfg CDCTable, columns []string) []string {
+	rowJSON := func(prefix string) string {
+		pairs := make([]string, len(columns))
+		for i, col := range columns {
+			pairs[i] = "'" + col + "', " + prefix + "." + col
+		}
+		return "json_object(" + strings.Join(pairs, ", ") + ")"
+	}
+	now := "strftime('%Y-%m-%dT%H:%M:%fZ', 'now')"
+	logInsert := "INSERT INTO " + CDCChange{}.TableName() + " (table_name, row_key, op, old_data, new_data, changed_at) VALUES "
+	table := cfg.TableName_
+	key := cfg.KeyColumn
+	return []string{
+		"CREATE TRIGGER " + cdcTriggerName(table, CDC_OP_INSERT) + " AFTER INSERT ON " + table + " BEGIN " +
+			logInsert + "('" + table + "', CAST(NEW." + key + " AS TEXT), '" + CDC_OP_INSERT + "', NULL, " + rowJSON("NEW") + ", " + now + "); END",
+		"CREATE TRIGGER " + cdcTriggerName(table, CDC_OP_UPDATE) + " AFTER UPDATE ON " + table + " BEGIN " +
+			logInsert + "('" + table + "', CAST(NEW." + key + " AS TEXT), '" + CDC_OP_UPDATE + "', " + rowJSON("OLD") + ", " + rowJSON("NEW") + ", " + now + "); END",
+		"CREATE TRIGGER " + cdcTriggerName(table, CDC_OP_DELETE) + " AFTER DELETE ON " + table + " BEGIN " +
+			logInsert + "('" + table + "', CAST(OLD." + key + " AS TEXT), '" + CDC_OP_DELETE + "', " + rowJSON("OLD") + ", NULL, " + now + "); END",
+	}
+}
@@ -0,0 +1,114 @@
+package suresql
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Client IP behind proxies. X-Forwarded-For and X-Real-IP can be sent by anyone, so they are only
+// believed when the connection comes from a trusted proxy (setting proxy/trusted, comma separated IPs
+// or CIDRs). X-Forwarded-For is read from the right, skipping trusted proxies, the first address that
+// is not a trusted proxy is the client: entries left of it were written by the client and can be forged.
+// Loopback is trusted too while the transport front end proxies every request to the HTTP server.
+
+var (
+	trustedProxyMu   sync.Mutex
+	trustedProxyText string
+	trustedProxyNets []*net.IPNet
+	trustLoopback    atomic.Bool
+)
+
+// TrustLoopbackProxy trusts (or stops trusting) 127.0.0.0/8 and ::1 as proxies besides proxy/trusted
+func TrustLoopbackProxy(on bool) {
+	trustLoopback.Store(on)
+}
+
+// ClientIP returns the real client IP of a request, from the connection address and the proxy headers
+func ClientIP(remoteAddr, forwardedFor, realIP string) string {
+	remote := stripPort(remoteAddr)
+	nets := trustedProxies()
+	if len(nets) == 0 || !ipInNets(remote, nets) {
+		return remote
+	}
+
+	if forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := stripPort(strings.TrimSpace(hops[i]))
+			if net.ParseIP(hop) == nil {
+				// garbage in the header, do not trust anything left of it
+				break
+			}
+			if i == 0 || !ipInNets(hop, nets) {
+				return hop
+			}
+		}
+	}
+	if ip := stripPort(strings.TrimSpace(realIP)); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return remote
+}
+
+// IsTrustedProxy reports whether the address is in setting proxy/trusted, or loopback with the front end
+func IsTrustedProxy(addr string) bool {
+	return ipInNets(stripPort(addr), trustedProxies())
+}
+
+// trustedProxies parses setting proxy/trusted, again only when it or the loopback trust changed
+func trustedProxies() []*net.IPNet {
+	text := ""
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_PROXY, SETTING_KEY_PROXY_TRUSTED); ok {
+		text = tmp.TextValue
+	}
+	if trustLoopback.Load() {
+		text += ",127.0.0.0/8,::1"
+	}
+	trustedProxyMu.Lock()
+	defer trustedProxyMu.Unlock()
+	if text == trustedProxyText {
+		return trustedProxyNets
+	}
+	nets := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	trustedProxyText, trustedProxyNets = text, nets
+	return nets
+}
+
+func ipInNets(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort removes the port of host:port and [ipv6]:port
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,100 @@
+package suresql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Client SDK versions. SDKs send X-SureSQL-Client: <sdk>/<version> (ie: suresql-go/1.4.2), the
+// policy settings client/min_version and client/reject_below are a version for every SDK (1.4.0)
+// or a list per SDK (suresql-go=1.4.0,suresql-js=0.9.0), an SDK that is not listed is not checked.
+
+const (
+	CLIENT_VERSION_OK       = "ok"
+	CLIENT_VERSION_OUTDATED = "outdated" // below min_version, still served with a warning
+	CLIENT_VERSION_REJECTED = "rejected" // below reject_below
+)
+
+// ParseClientHeader splits "suresql-go/1.4.2" into sdk and version, a bare version has no sdk
+func ParseClientHeader(header string) (sdk, version string) {
+	header = strings.TrimSpace(header)
+	if i := strings.LastIndex(header, "/"); i >= 0 {
+		return strings.ToLower(strings.TrimSpace(header[:i])), strings.TrimSpace(header[i+1:])
+	}
+	return "", header
+}
+
+// CompareVersions compares dotted versions numerically (1.10.0 > 1.9.3), a leading v and any
+// pre-release or build suffix (-beta, +abc) are ignored, missing parts count as 0
+func CompareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// clientVersionSetting returns the version of the setting that applies to the sdk, empty when none
+func clientVersionSetting(key, sdk string) string {
+	s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CLIENT, key)
+	if !ok || strings.TrimSpace(s.TextValue) == "" {
+		return ""
+	}
+	all := ""
+	for _, entry := range strings.Split(s.TextValue, ",") {
+		name, version, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			all = name
+			continue
+		}
+		if sdk != "" && strings.EqualFold(strings.TrimSpace(name), sdk) {
+			return strings.TrimSpace(version)
+		}
+	}
+	return all
+}
+
+// CheckClientVersion applies the policy to the X-SureSQL-Client header, returning the status and the
+// version the client should upgrade to. Requests without the header are not checked.
+func CheckClientVersion(header string) (status, minimum string) {
+	sdk, version := ParseClientHeader(header)
+	if version == "" {
+		return CLIENT_VERSION_OK, ""
+	}
+	if reject := clientVersionSetting(SETTING_KEY_CLIENT_REJECT_BELOW, sdk); reject != "" && CompareVersions(version, reject) < 0 {
+		minimum = clientVersionSetting(SETTING_KEY_CLIENT_MIN_VERSION, sdk)
+		if minimum == "" || CompareVersions(minimum, reject) < 0 {
+			minimum = reject
+		}
+		return CLIENT_VERSION_REJECTED, minimum
+	}
+	if min := clientVersionSetting(SETTING_KEY_CLIENT_MIN_VERSION, sdk); min != "" && CompareVersions(version, min) < 0 {
+		return CLIENT_VERSION_OUTDATED, min
+	}
+	return CLIENT_VERSION_OK, ""
+}
@@ -0,0 +1,59 @@
+package suresql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockAdvance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	after := clock.After(90 * time.Second)
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired before its interval")
+	case <-after:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	if got := <-ticker.C(); !got.Equal(start.Add(time.Minute)) {
+		t.Fatalf("tick at %v, want %v", got, start.Add(time.Minute))
+	}
+
+	clock.Advance(30 * time.Second)
+	if got := <-after; !got.Equal(start.Add(90 * time.Second)) {
+		t.Fatalf("timer at %v, want %v", got, start.Add(90*time.Second))
+	}
+	if got := clock.Since(start); got != 90*time.Second {
+		t.Fatalf("since start %v, want 90s", got)
+	}
+
+	// ticks that are not received are dropped, like time.Ticker
+	clock.Advance(5 * time.Minute)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("missed ticks were queued")
+	default:
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	if !CurrentClock.Now().Equal(time.Unix(0, 0)) {
+		t.Fatal("CurrentClock is not the fake clock")
+	}
+	SetClock(nil)
+	if _, ok := CurrentClock.(RealClock); !ok {
+		t.Fatal("SetClock(nil) did not restore the real clock")
+	}
+}
@@ -0,0 +1,332 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Cluster bootstrap: GenerateCluster writes the definitions of an N node SureSQL + rqlite cluster, so a
+// cluster is not put together by hand. Format compose is one docker-compose.yml with an rqlite and a
+// SureSQL container per node, format systemd is a unit per host running SureSQL with the embedded
+// rqlited (RQLITED_EMBED). Both get an env file per node with the same generated secrets (API key,
+// client ID, DBMS user, master and peer secrets), and a bootstrap.yaml with the nodes rows of _settings
+// that InitDB applies on the first start. Node 1 is the leader (LEADER_NODE_NUMBER) and reads and
+// writes, the others read. The files hold secrets, keep them out of the repository.
+
+const (
+	CLUSTER_FORMAT_COMPOSE = "compose"
+	CLUSTER_FORMAT_SYSTEMD = "systemd"
+
+	CLUSTER_DEFAULT_NAME         = "suresql"
+	CLUSTER_DEFAULT_IMAGE        = "suresql:latest"
+	CLUSTER_DEFAULT_RQLITE_IMAGE = "rqlite/rqlite:" + RQLITED_DEFAULT_VERSION
+	CLUSTER_DEFAULT_API_PORT     = 8080
+	CLUSTER_DEFAULT_HTTP_PORT    = 4001
+	CLUSTER_DEFAULT_RAFT_PORT    = 4002
+	CLUSTER_MAX_NODES            = 99
+)
+
+var ErrClusterInvalid = medaerror.MedaError{Message: "invalid cluster definition"}
+
+// ClusterSpec describes the cluster to generate, the zero values are the defaults
+type ClusterSpec struct {
+	Nodes       int      `json:"nodes"`
+	Format      string   `json:"format"` // compose or systemd
+	Name        string   `json:"name"`   // prefix of the services, units and hostnames
+	Hosts       []string `json:"hosts"`  // systemd: the host of each node, <name>-<n> when empty
+	Image       string   `json:"image"`
+	RqliteImage string   `json:"rqlite_image"`
+	APIPort     int      `json:"api_port"`  // compose: the port of node n on the host is APIPort+n-1
+	HTTPPort    int      `json:"http_port"` // rqlite
+	RaftPort    int      `json:"raft_port"`
+	BinaryPath  string   `json:"binary_path"` // systemd: the suresql binary on the hosts
+	// Settings are more _settings rows of bootstrap.yaml, the nodes rows are added
+	Settings []BootstrapSetting `json:"settings,omitempty"`
+}
+
+// ClusterFile is a generated file, Path is relative to the output directory
+type ClusterFile struct {
+	Path    string
+	Content string
+	Secret  bool // holds secrets, written 0600
+}
+
+// clusterSecrets are shared by every node of the cluster
+type clusterSecrets struct {
+	APIKey, ClientID, DBMSUser, DBMSPassword, MasterKey, PeerSecret string
+}
+
+func (s *ClusterSpec) defaults() error {
+	if s.Nodes == 0 {
+		s.Nodes = 3
+	}
+	if s.Nodes < 1 || s.Nodes > CLUSTER_MAX_NODES {
+		return medaerror.Errorf("%s: nodes must be 1 to %d", ErrClusterInvalid.Message, CLUSTER_MAX_NODES)
+	}
+	if s.Format == "" {
+		s.Format = CLUSTER_FORMAT_COMPOSE
+	}
+	if s.Format != CLUSTER_FORMAT_COMPOSE && s.Format != CLUSTER_FORMAT_SYSTEMD {
+		return medaerror.Errorf("%s: format must be %s or %s", ErrClusterInvalid.Message, CLUSTER_FORMAT_COMPOSE, CLUSTER_FORMAT_SYSTEMD)
+	}
+	if s.Name == "" {
+		s.Name = CLUSTER_DEFAULT_NAME
+	}
+	if !identifierRegex.MatchString(strings.ReplaceAll(s.Name, "-", "_")) {
+		return medaerror.Errorf("%s: name %q", ErrClusterInvalid.Message, s.Name)
+	}
+	if s.Format == CLUSTER_FORMAT_COMPOSE {
+		s.Hosts = nil
+	}
+	if len(s.Hosts) > 0 && len(s.Hosts) != s.Nodes {
+		return medaerror.Errorf("%s: %d hosts for %d nodes", ErrClusterInvalid.Message, len(s.Hosts), s.Nodes)
+	}
+	if s.Image == "" {
+		s.Image = CLUSTER_DEFAULT_IMAGE
+	}
+	if s.RqliteImage == "" {
+		s.RqliteImage = CLUSTER_DEFAULT_RQLITE_IMAGE
+	}
+	if s.APIPort == 0 {
+		s.APIPort = CLUSTER_DEFAULT_API_PORT
+	}
+	if s.HTTPPort == 0 {
+		s.HTTPPort = CLUSTER_DEFAULT_HTTP_PORT
+	}
+	if s.RaftPort == 0 {
+		s.RaftPort = CLUSTER_DEFAULT_RAFT_PORT
+	}
+	if s.BinaryPath == "" {
+		s.BinaryPath = "/usr/local/bin/suresql"
+	}
+	for _, st := range s.Settings {
+		if st.Category == "" || st.Key == "" {
+			return medaerror.Errorf("%s: setting without category or key", ErrClusterInvalid.Message)
+		}
+	}
+	return nil
+}
+
+// node is the name of node n (1 based)
+func (s ClusterSpec) node(n int) string {
+	return fmt.Sprintf("%s-%d", s.Name, n)
+}
+
+// host is where node n is reached by the others, its name unless Hosts are given
+func (s ClusterSpec) host(n int) string {
+	if len(s.Hosts) > 0 {
+		return s.Hosts[n-1]
+	}
+	return s.node(n)
+}
+
+func (s ClusterSpec) rqlite(n int) string {
+	return fmt.Sprintf("%s-rqlite-%d", s.Name, n)
+}
+
+// join is the Raft address of every node, the -join of rqlited
+func (s ClusterSpec) join(host func(int) string) string {
+	addrs := make([]string, s.Nodes)
+	for n := 1; n <= s.Nodes; n++ {
+		addrs[n-1] = fmt.Sprintf("%s:%d", host(n), s.RaftPort)
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (s ClusterSpec) mode(n int) string {
+	if n == LEADER_NODE_NUMBER {
+		return "rw"
+	}
+	return "r"
+}
+
+// GenerateCluster returns the files of the cluster, every call makes new secrets
+func GenerateCluster(spec ClusterSpec) ([]ClusterFile, error) {
+	if err := spec.defaults(); err != nil {
+		return nil, err
+	}
+	var secrets clusterSecrets
+	for _, v := range []*string{&secrets.APIKey, &secrets.ClientID, &secrets.DBMSPassword, &secrets.MasterKey, &secrets.PeerSecret} {
+		r, err := randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+		*v = r
+	}
+	secrets.DBMSUser = spec.Name
+
+	files := []ClusterFile{{Path: "bootstrap.yaml", Content: clusterBootstrap(spec)}}
+	for n := 1; n <= spec.Nodes; n++ {
+		files = append(files, ClusterFile{Path: "env/" + spec.node(n) + ".env", Content: clusterEnv(spec, secrets, n), Secret: true})
+	}
+	if spec.Format == CLUSTER_FORMAT_SYSTEMD {
+		for n := 1; n <= spec.Nodes; n++ {
+			files = append(files, ClusterFile{Path: "systemd/" + spec.node(n) + ".service", Content: clusterUnit(spec, n)})
+		}
+		return files, nil
+	}
+	auth, _ := json.MarshalIndent([]map[string]interface{}{{"username": secrets.DBMSUser, "password": secrets.DBMSPassword, "perms": []string{"all"}}}, "", "  ")
+	files = append(files,
+		ClusterFile{Path: "rqlite/" + RQLITED_AUTH_FILE, Content: string(auth) + "\n", Secret: true},
+		ClusterFile{Path: "docker-compose.yml", Content: clusterCompose(spec, secrets)},
+	)
+	return files, nil
+}
+
+// clusterBootstrap is bootstrap.yaml with the nodes rows, keyed master and peer-NN like the migrations
+func clusterBootstrap(spec ClusterSpec) string {
+	settings := append([]BootstrapSetting{}, spec.Settings...)
+	for n := 1; n <= spec.Nodes; n++ {
+		key := fmt.Sprintf("peer-%02d", n-1)
+		if n == LEADER_NODE_NUMBER {
+			key = "master"
+		}
+		value := strings.Join([]string{fmt.Sprint(n), spec.node(n), spec.host(n), spec.mode(n)}, SETTING_NODE_DELIMITER)
+		settings = append(settings, BootstrapSetting{Category: SETTING_CATEGORY_NODES, Key: key, Type: "text", Value: value})
+	}
+	sort.SliceStable(settings, func(i, j int) bool { return settings[i].Category < settings[j].Category })
+
+	var sb strings.Builder
+	sb.WriteString("# generated by suresqlctl init-cluster, applied once by the first node that starts\n")
+	sb.WriteString("settings:\n")
+	for _, st := range settings {
+		typ := st.Type
+		if typ == "" {
+			typ = "text"
+		}
+		fmt.Fprintf(&sb, "  - category: %s\n    key: %s\n    type: %s\n    value: %s\n", st.Category, st.Key, typ, yamlQuote(st.Value))
+	}
+	return sb.String()
+}
+
+// yamlQuote quotes the value the way the bootstrap reader takes it back (strconv.Unquote)
+func yamlQuote(v string) string {
+	return strconv.Quote(v)
+}
+
+// clusterEnv is the env file of node n
+func clusterEnv(spec ClusterSpec, secrets clusterSecrets, n int) string {
+	port := spec.APIPort
+	dbmsHost := spec.rqlite(n)
+	if spec.Format == CLUSTER_FORMAT_SYSTEMD {
+		dbmsHost = "127.0.0.1"
+	}
+	lines := []string{
+		"# " + spec.node(n) + ", generated by suresqlctl init-cluster",
+		"SURESQL_LABEL=" + spec.Name,
+		"SURESQL_HOST=" + spec.host(n),
+		fmt.Sprintf("SURESQL_PORT=%d", port),
+		"SURESQL_MODE=" + spec.mode(n),
+		fmt.Sprintf("SURESQL_NODES=%d", spec.Nodes),
+		fmt.Sprintf("SURESQL_NODE_NUMBER=%d", n),
+		"SURESQL_DBMS=RQLITE",
+		"SURESQL_API_KEY=" + secrets.APIKey,
+		"SURESQL_CLIENT_ID=" + secrets.ClientID,
+		"SURESQL_MASTER_KEY=" + secrets.MasterKey,
+		"SURESQL_PEER_SECRET=" + secrets.PeerSecret,
+		"SURESQL_BOOTSTRAP=" + clusterBootstrapPath(spec),
+		"",
+		"DBMS_TYPE=RQLITE",
+		"DBMS_HOST=" + dbmsHost,
+		fmt.Sprintf("DBMS_PORT=%d", spec.HTTPPort),
+		"DBMS_USERNAME=" + secrets.DBMSUser,
+		"DBMS_PASSWORD=" + secrets.DBMSPassword,
+	}
+	if spec.Format == CLUSTER_FORMAT_SYSTEMD {
+		lines = append(lines,
+			"",
+			"RQLITED_EMBED=true",
+			"RQLITED_DATA_DIR=/var/lib/"+spec.Name+"/rqlite",
+			"RQLITED_BIN_DIR=/var/lib/"+spec.Name+"/bin",
+			fmt.Sprintf("RQLITED_HTTP_ADDR=0.0.0.0:%d", spec.HTTPPort),
+			fmt.Sprintf("RQLITED_RAFT_ADDR=0.0.0.0:%d", spec.RaftPort),
+			fmt.Sprintf("RQLITED_NODE_ID=%d", n),
+			fmt.Sprintf("RQLITED_ARGS=\"-http-adv-addr %s:%d -raft-adv-addr %s:%d\"", spec.host(n), spec.HTTPPort, spec.host(n), spec.RaftPort),
+		)
+		if spec.Nodes > 1 {
+			lines = append(lines, "RQLITED_JOIN="+spec.join(spec.host), fmt.Sprintf("RQLITED_BOOTSTRAP_EXPECT=%d", spec.Nodes))
+		}
+	}
+	if spec.Nodes == 1 {
+		lines = append(lines, "DBMS_OPTIONS=\"disableClusterDiscovery=true\"")
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func clusterBootstrapPath(spec ClusterSpec) string {
+	if spec.Format == CLUSTER_FORMAT_SYSTEMD {
+		return "/etc/" + spec.Name + "/bootstrap.yaml"
+	}
+	return "/etc/suresql/bootstrap.yaml"
+}
+
+// clusterCompose is docker-compose.yml, rqlite node n and SureSQL node n on one network
+func clusterCompose(spec ClusterSpec, secrets clusterSecrets) string {
+	var sb strings.Builder
+	sb.WriteString("# generated by suresqlctl init-cluster\nservices:\n")
+	for n := 1; n <= spec.Nodes; n++ {
+		r := spec.rqlite(n)
+		fmt.Fprintf(&sb, "  %s:\n", r)
+		fmt.Fprintf(&sb, "    image: %s\n", spec.RqliteImage)
+		fmt.Fprintf(&sb, "    hostname: %s\n", r)
+		sb.WriteString("    restart: unless-stopped\n")
+		fmt.Fprintf(&sb, "    command: [\"-node-id\", \"%d\", \"-http-addr\", \"0.0.0.0:%d\", \"-http-adv-addr\", \"%s:%d\", \"-raft-addr\", \"0.0.0.0:%d\", \"-raft-adv-addr\", \"%s:%d\", \"-auth\", \"/rqlite/auth/%s\"",
+			n, spec.HTTPPort, r, spec.HTTPPort, spec.RaftPort, r, spec.RaftPort, RQLITED_AUTH_FILE)
+		if spec.Nodes > 1 {
+			fmt.Fprintf(&sb, ", \"-bootstrap-expect\", \"%d\", \"-join\", \"%s\", \"-join-as\", \"%s\"", spec.Nodes, spec.join(spec.rqlite), secrets.DBMSUser)
+		}
+		sb.WriteString("]\n")
+		sb.WriteString("    volumes:\n")
+		fmt.Fprintf(&sb, "      - %s-data:/rqlite/file\n", r)
+		fmt.Fprintf(&sb, "      - ./rqlite/%s:/rqlite/auth/%s:ro\n", RQLITED_AUTH_FILE, RQLITED_AUTH_FILE)
+
+		s := spec.node(n)
+		fmt.Fprintf(&sb, "  %s:\n", s)
+		fmt.Fprintf(&sb, "    image: %s\n", spec.Image)
+		fmt.Fprintf(&sb, "    hostname: %s\n", s)
+		sb.WriteString("    restart: unless-stopped\n")
+		fmt.Fprintf(&sb, "    env_file: ./env/%s.env\n", s)
+		fmt.Fprintf(&sb, "    depends_on: [%s]\n", r)
+		fmt.Fprintf(&sb, "    ports: [\"%d:%d\"]\n", spec.APIPort+n-1, spec.APIPort)
+		sb.WriteString("    volumes:\n")
+		fmt.Fprintf(&sb, "      - ./bootstrap.yaml:%s:ro\n", clusterBootstrapPath(spec))
+	}
+	sb.WriteString("volumes:\n")
+	for n := 1; n <= spec.Nodes; n++ {
+		fmt.Fprintf(&sb, "  %s-data:\n", spec.rqlite(n))
+	}
+	return sb.String()
+}
+
+// clusterUnit is the systemd unit of node n, its env file goes to /etc/<name>/<name>.env on the host
+func clusterUnit(spec ClusterSpec, n int) string {
+	lines := []string{
+		"# " + spec.node(n) + ", generated by suresqlctl init-cluster",
+		"# install: copy env/" + spec.node(n) + ".env to /etc/" + spec.Name + "/" + spec.Name + ".env and bootstrap.yaml to /etc/" + spec.Name + "/ on " + spec.host(n),
+		"[Unit]",
+		"Description=SureSQL node " + fmt.Sprint(n) + " of " + spec.Name + " with embedded rqlite",
+		"Wants=network-online.target",
+		"After=network-online.target",
+		"",
+		"[Service]",
+		"Type=simple",
+		"User=" + spec.Name,
+		"EnvironmentFile=/etc/" + spec.Name + "/" + spec.Name + ".env",
+		"WorkingDirectory=/var/lib/" + spec.Name,
+		"StateDirectory=" + spec.Name,
+		"ExecStart=" + spec.BinaryPath,
+		"Restart=on-failure",
+		"RestartSec=5",
+		"KillSignal=SIGTERM",
+		"TimeoutStopSec=30",
+		"",
+		"[Install]",
+		"WantedBy=multi-user.target",
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
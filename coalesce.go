@@ -0,0 +1,164 @@
+package suresql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Coalesced calls: concurrent callers of the same key share one call, the first one runs it and the others
+// wait for its result. Dashboards poll /status and the schema from many tabs at once, the DBMS gets one
+// request for all of them. Results are not kept, the next caller after the call returned runs it again.
+// Identical selects of /db/api/querysql share one execution the same way (dashboard refresh storms), keyed
+// by the user, the fingerprint of the statements and their values, and the state of the tables they read:
+// a select arriving after an API write of its tables does not get the result of a select started before.
+
+// CallGroup runs one call per key at a time
+type CallGroup struct {
+	mu     sync.Mutex
+	calls  map[string]*groupCall
+	shared atomic.Int64
+}
+
+type groupCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+var (
+	backendCalls = &CallGroup{}
+	queryFlights = &CallGroup{}
+
+	// the values of a statement, quoted identifiers are kept as they are too
+	flightValueRegex = regexp.MustCompile(`'(?:[^']|'')*'|"[^"]*"|` + "`[^`]*`" + `|\b\d+(?:\.\d+)?\b|\$\d+|:[a-zA-Z_][a-zA-Z0-9_]*`)
+
+	errCallPanicked = medaerror.MedaError{Message: "the shared call panicked"}
+)
+
+// Do runs fn, or waits for the call of the key running already and returns its result, shared is true then.
+// The callers share the value, they must not change it.
+func (g *CallGroup) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		g.shared.Add(1)
+		return c.val, c.err, true
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall)
+	}
+	c := &groupCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// a panic of fn must not leave the waiters blocked
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.err = errCallPanicked
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
+
+// Shared is the number of callers that got the result of another call
+func (g *CallGroup) Shared() int64 {
+	return g.shared.Load()
+}
+
+// CoalescedBackendCalls is the number of status and schema calls answered by a call of another caller
+func CoalescedBackendCalls() int64 {
+	return backendCalls.Shared()
+}
+
+// coalescedStatus is the status of the DBMS, one Status call for the callers at the same time
+func coalescedStatus(db SureSQLDB) (orm.NodeStatusStruct, error) {
+	v, err, _ := backendCalls.Do("status", func() (interface{}, error) {
+		return db.Status()
+	})
+	status, _ := v.(orm.NodeStatusStruct)
+	return status, err
+}
+
+// CoalescedSchema is the schema of the DBMS, one GetSchema call for the callers at the same time with the
+// same options
+func CoalescedSchema(db SureSQLDB, hideSQL, hideSureSQL bool) []orm.SchemaStruct {
+	key := "schema"
+	if hideSQL {
+		key += ":sql"
+	}
+	if hideSureSQL {
+		key += ":suresql"
+	}
+	v, _, _ := backendCalls.Do(key, func() (interface{}, error) {
+		return db.GetSchema(hideSQL, hideSureSQL), nil
+	})
+	schema, _ := v.([]orm.SchemaStruct)
+	return schema
+}
+
+// ShareQueries reads query/share, on unless set to 0
+func ShareQueries() bool {
+	s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_QUERY, SETTING_KEY_QUERY_SHARE)
+	return !ok || s.IntValue != 0
+}
+
+// SharedQueries is the number of selects answered by the execution of an identical select
+func SharedQueries() int64 {
+	return queryFlights.Shared()
+}
+
+// ShareQuery runs fn, the selects of the request, or waits for the identical selects of another request
+// running already and returns their result, shared is true then. tables are the tables the selects read.
+func ShareQuery(username, route string, req SQLRequest, tables []string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	if !ShareQueries() {
+		v, err = fn()
+		return v, err, false
+	}
+	return queryFlights.Do(queryFlightKey(username, route, req, ResultCache.Stamp(tables)), fn)
+}
+
+// queryFlightKey is the key of the selects of a user, the route they were read through (see RouteRead) and
+// the options changing their result are part of it
+func queryFlightKey(username, route string, req SQLRequest, stamp CacheStamp) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%t\x00%t\x00%d", username, route, req.Consistency, req.Freshness, req.SingleRow, req.Parallel, stamp)
+	for _, q := range req.Statements {
+		writeFlightStatement(h, q, nil)
+	}
+	for _, p := range req.ParamSQL {
+		writeFlightStatement(h, p.Query, p.Values)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeFlightStatement writes the fingerprint of the statement then its values. The values are taken before
+// the spaces are normalized, and unlike FingerprintSQL the lists are kept, x IN (1, 2) AND y IN (3) and
+// x IN (1) AND y IN (2, 3) have different keys.
+func writeFlightStatement(h hash.Hash, query string, params []interface{}) {
+	fp := flightValueRegex.ReplaceAllString(query, "?")
+	fp = fingerprintSpace.ReplaceAllString(strings.TrimSpace(fp), " ")
+	h.Write([]byte{0})
+	h.Write([]byte(strings.TrimSpace(strings.TrimSuffix(strings.ToLower(fp), ";"))))
+	for _, v := range flightValueRegex.FindAllString(query, -1) {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+	values, _ := json.Marshal(params)
+	h.Write([]byte{0})
+	h.Write(values)
+}
@@ -0,0 +1,315 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// In-memory evaluation of orm.Condition against a row, with the same operators and the same NULL
+// semantics as the SQL the query builder renders. Used where rows do not come straight from a
+// SELECT, ie: rows reconstructed from the CDC log.
+
+// MatchCondition reports whether the row satisfies the condition, nil or empty condition matches everything
+func MatchCondition(c *orm.Condition, row map[string]interface{}) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	if c.Field != "" {
+		return matchSimpleCondition(c, row)
+	}
+	if len(c.Nested) == 0 {
+		return true, nil
+	}
+	logic := strings.ToUpper(strings.TrimSpace(c.Logic))
+	if logic == "" {
+		logic = "AND"
+	}
+	if logic != "AND" && logic != "OR" {
+		return false, ErrInvalidLogic
+	}
+	for i := range c.Nested {
+		ok, err := MatchCondition(&c.Nested[i], row)
+		if err != nil {
+			return false, err
+		}
+		if logic == "OR" && ok {
+			return true, nil
+		}
+		if logic == "AND" && !ok {
+			return false, nil
+		}
+	}
+	return logic == "AND", nil
+}
+
+func matchSimpleCondition(c *orm.Condition, row map[string]interface{}) (bool, error) {
+	if err := ValidateIdentifier(c.Field); err != nil {
+		return false, err
+	}
+	op := strings.Join(strings.Fields(strings.ToUpper(c.Operator)), " ")
+	if op == "" {
+		op = "="
+	}
+	if _, ok := conditionOperators[op]; !ok {
+		return false, medaerror.Errorf("%s: %q", ErrInvalidOperator.Message, c.Operator)
+	}
+	value := rowValue(row, c.Field)
+
+	switch op {
+	case "IS NULL":
+		return value == nil, nil
+	case "IS NOT NULL":
+		return value != nil, nil
+	}
+
+	list, isList := listValue(c.Value)
+	switch {
+	case isList && op == "=":
+		op = "IN"
+	case isList && (op == "!=" || op == "<>"):
+		op = "NOT IN"
+	}
+
+	switch op {
+	case "IN", "NOT IN", "ANY":
+		if !isList {
+			return false, medaerror.Errorf("%s: %s", ErrListValueRequired.Message, op)
+		}
+		if len(list) == 0 {
+			return op == "NOT IN", nil
+		}
+		if value == nil {
+			return false, nil
+		}
+		found := false
+		for _, v := range list {
+			if cmp, ok := CompareValues(value, v); ok && cmp == 0 {
+				found = true
+				break
+			}
+		}
+		if op == "NOT IN" {
+			return !found, nil
+		}
+		return found, nil
+	}
+
+	if isList {
+		return false, medaerror.Errorf("%s: operator %s does not take a list", ErrInvalidOperator.Message, op)
+	}
+	// NULL compared with anything is unknown, which filters the row out like in SQL
+	if value == nil || c.Value == nil {
+		return false, nil
+	}
+	switch op {
+	case "LIKE":
+		return likeMatch(fmt.Sprint(c.Value), fmt.Sprint(value)), nil
+	case "NOT LIKE":
+		return !likeMatch(fmt.Sprint(c.Value), fmt.Sprint(value)), nil
+	}
+	cmp, ok := CompareValues(value, c.Value)
+	if !ok {
+		return false, nil
+	}
+	switch op {
+	case "=":
+		return cmp == 0, nil
+	case "!=", "<>":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, medaerror.Errorf("%s: %q", ErrInvalidOperator.Message, c.Operator)
+}
+
+// rowValue looks up the column, table.column falls back to column
+func rowValue(row map[string]interface{}, field string) interface{} {
+	if v, ok := row[field]; ok {
+		return v
+	}
+	if i := strings.LastIndex(field, "."); i >= 0 {
+		return row[field[i+1:]]
+	}
+	return nil
+}
+
+// CompareValues compares two column values, numerically when both are numbers (or one is a number and
+// the other a numeric string), otherwise as text. ok is false when one of them is NULL.
+func CompareValues(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	fa, aNum := numericValue(a)
+	fb, bNum := numericValue(b)
+	if aNum && !bNum {
+		fb, bNum = numericString(b)
+	} else if bNum && !aNum {
+		fa, aNum = numericString(a)
+	}
+	if aNum && bNum {
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)), true
+}
+
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func numericString(v interface{}) (float64, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil
+}
+
+// likeMatch is SQL LIKE: % any run, _ one character, ASCII case-insensitive like SQLite
+func likeMatch(pattern, s string) bool {
+	p := []rune(strings.ToLower(pattern))
+	t := []rune(strings.ToLower(s))
+	// classic two pointer wildcard match with backtracking to the last %
+	pi, ti, star, mark := 0, 0, -1, 0
+	for ti < len(t) {
+		switch {
+		case pi < len(p) && (p[pi] == '_' || p[pi] == t[ti]):
+			pi++
+			ti++
+		case pi < len(p) && p[pi] == '%':
+			star = pi
+			mark = ti
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			ti = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '%' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// SortRecords sorts in place by ORDER BY terms (column [ASC|DESC] [NULLS FIRST|LAST]). NULLs come first
+// ascending unless told otherwise, as in SQLite.
+func SortRecords(records []orm.DBRecord, orderBy []string) error {
+	type term struct {
+		field      string
+		desc       bool
+		nullsFirst bool
+	}
+	terms := make([]term, 0, len(orderBy))
+	for _, o := range orderBy {
+		o = strings.TrimSpace(o)
+		if !orderByRegex.MatchString(o) {
+			return medaerror.Errorf("%s: %q", ErrInvalidOrderBy.Message, o)
+		}
+		parts := strings.Fields(strings.ToUpper(o))
+		t := term{field: strings.Fields(o)[0]}
+		t.desc = len(parts) > 1 && parts[1] == "DESC"
+		t.nullsFirst = !t.desc
+		if n := len(parts); n >= 2 && parts[n-2] == "NULLS" {
+			t.nullsFirst = parts[n-1] == "FIRST"
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, t := range terms {
+			a := rowValue(records[i].Data, t.field)
+			b := rowValue(records[j].Data, t.field)
+			if a == nil || b == nil {
+				if (a == nil) == (b == nil) {
+					continue
+				}
+				return (a == nil) == t.nullsFirst
+			}
+			cmp, _ := CompareValues(a, b)
+			if cmp == 0 {
+				continue
+			}
+			if t.desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+	return nil
+}
+
+// PageRecords applies LIMIT/OFFSET the same way the query builder renders them
+func PageRecords(records []orm.DBRecord, limit, offset int) []orm.DBRecord {
+	if offset > 0 && limit < 1 {
+		limit = orm.DEFAULT_PAGINATION_LIMIT
+	}
+	if offset > 0 {
+		if offset >= len(records) {
+			return []orm.DBRecord{}
+		}
+		records = records[offset:]
+	}
+	if limit > 0 && limit < len(records) {
+		records = records[:limit]
+	}
+	return records
+}
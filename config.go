@@ -21,14 +21,150 @@ const (
 	NODE_MODE     = true  // copying the result into current node's status
 
 	// ConfigTable Categories and keys
-	SETTING_CATEGORY_TOKEN  = "token"
-	SETTING_KEY_TOKEN_EXP   = "token_exp"   // value int: in minutes
-	SETTING_KEY_REFRESH_EXP = "refresh_exp" // value int: in minutes
-	SETTING_KEY_TOKEN_TTL   = "token_ttl"   // value int: in minutes, beat for checking expiration
+	SETTING_CATEGORY_TOKEN    = "token"
+	SETTING_KEY_TOKEN_EXP     = "token_exp"   // value int: in minutes
+	SETTING_KEY_REFRESH_EXP   = "refresh_exp" // value int: in minutes
+	SETTING_KEY_TOKEN_TTL     = "token_ttl"   // value int: in minutes, beat for checking expiration
+	SETTING_KEY_TOKEN_PERSIST = "persist"     // value int (bool): keep issued tokens (hashed) in _tokens so they survive a restart
 
 	SETTING_CATEGORY_CONNECTION = "connection"
 	SETTING_KEY_MAX_POOL        = "max_pool" // value int: 0 overwrite pool_on, meaning no pooling, automatically pool_on=false
 	SETTING_KEY_ENABLE_POOL     = "pool_on"  // value string: true or false
+	SETTING_KEY_LEASE_TIMEOUT   = "lease_timeout" // value int: in minutes, idle connection can be reclaimed after this, 0 disables
+	SETTING_KEY_RECLAIM_PCT     = "reclaim_pct"   // value int: pool usage percentage from which idle connections are reclaimed
+	SETTING_KEY_MAX_INFLIGHT    = "max_inflight"  // value int: concurrent API requests before clients get 429
+	SETTING_KEY_MAX_ROWS        = "max_rows"        // value int: rows a query may return, more are cut and the response is truncated, 0 is no cap
+	SETTING_KEY_MAX_ROWS_REJECT = "max_rows_reject" // value int (bool): a query over max_rows is refused with 422 instead of cut
+	SETTING_KEY_MAX_QUERIES     = "max_queries"      // value int: data API requests running at once, the others wait in fair queues per token, 0 is no limit
+	SETTING_KEY_QUEUE_TIMEOUT   = "queue_timeout_ms" // value int: longest wait in the queue before 429, default 10000
+
+	SETTING_CATEGORY_METERING = "metering"
+	SETTING_KEY_WEBHOOK_URL   = "webhook_url" // value string: billing webhook, daily usage is POSTed here as JSON
+
+	SETTING_CATEGORY_SMTP     = "smtp"
+	SETTING_KEY_SMTP_HOST     = "host"     // value string: smtp server host
+	SETTING_KEY_SMTP_PORT     = "port"     // value string: 587 (STARTTLS) by default, 465 is implicit TLS
+	SETTING_KEY_SMTP_USERNAME = "username" // value string: empty means no auth
+	SETTING_KEY_SMTP_PASSWORD = "password" // value string
+	SETTING_KEY_SMTP_FROM     = "from"     // value string: sender address
+
+	SETTING_CATEGORY_FILES     = "files"
+	SETTING_KEY_FILES_STORE    = "store"    // value string: db (default, chunks in _file_chunks) or dir
+	SETTING_KEY_FILES_DIR      = "dir"      // value string: directory of the dir store
+	SETTING_KEY_FILES_MAX_SIZE = "max_size" // value int: upload limit in bytes
+
+	SETTING_CATEGORY_HEADERS            = "headers"
+	SETTING_KEY_HEADERS_ENABLED         = "enabled"          // value int (bool): add security headers to responses, default on
+	SETTING_KEY_HEADERS_HSTS_MAX_AGE    = "hsts_max_age"     // value int: Strict-Transport-Security max-age in seconds, 0 removes it
+	SETTING_KEY_HEADERS_HSTS_SUBDOMAINS = "hsts_subdomains"  // value int (bool): add includeSubDomains to HSTS
+	SETTING_KEY_HEADERS_FRAME_OPTIONS   = "frame_options"    // value text: X-Frame-Options
+	SETTING_KEY_HEADERS_REFERRER_POLICY = "referrer_policy"  // value text: Referrer-Policy
+	SETTING_KEY_HEADERS_CSP             = "content_security" // value text: Content-Security-Policy
+	SETTING_KEY_HEADERS_CUSTOM          = "custom"           // value text: JSON object of extra headers
+
+	SETTING_CATEGORY_PROXY     = "proxy"
+	SETTING_KEY_PROXY_TRUSTED  = "trusted"  // value text: comma separated IPs/CIDRs of load balancers whose X-Forwarded-For is believed
+	SETTING_KEY_PROXY_OUTBOUND = "outbound" // value text: proxy URL of outbound calls, "direct" for none, empty uses HTTP(S)_PROXY. outbound_<integration> overrides it
+
+	SETTING_CATEGORY_SECURITY     = "security"
+	SETTING_KEY_SECURITY_SIEM_URL = "siem_url" // value text: security events are posted here in batches (JSON array)
+
+	SETTING_CATEGORY_SIGNING     = "signing"
+	SETTING_KEY_SIGNING_REQUIRED = "required" // value int (bool): reject unsigned requests to /db/api
+	SETTING_KEY_SIGNING_MAX_SKEW = "max_skew" // value int: allowed clock difference of signed requests in seconds
+
+	SETTING_CATEGORY_CLIENT         = "client"
+	SETTING_KEY_CLIENT_MIN_VERSION  = "min_version"  // value text: clients below get a warning, ie: 1.4.0 or suresql-go=1.4.0,suresql-js=0.9.0
+	SETTING_KEY_CLIENT_REJECT_BELOW = "reject_below" // value text: clients below are refused with 426, same format as min_version
+
+	SETTING_CATEGORY_QUERY          = "query"
+	SETTING_KEY_QUERY_SLOW_MS       = "slow_ms"       // value int: API requests slower than this get a warning, 0 disables, default 1000
+	SETTING_KEY_QUERY_DEFAULT_LIMIT = "default_limit" // value int: row limit of /db/api/query without one, 0 is no limit
+	SETTING_KEY_QUERY_WORKERS       = "workers"       // value int: statements of parallel requests running at once on the node, default 8
+	SETTING_KEY_QUERY_SHARE         = "share"         // value int (bool): identical selects running at once share one execution, default on
+
+	SETTING_CATEGORY_CACHE        = "cache"
+	SETTING_KEY_CACHE_TTL_MS      = "ttl_ms"      // value int: /db/api/querysql results are kept this long, 0 (default) disables the cache
+	SETTING_KEY_CACHE_MAX_ENTRIES = "max_entries" // value int: results kept at most, default 1000
+
+	SETTING_CATEGORY_I18N           = "i18n"
+	SETTING_KEY_I18N_DEFAULT_LOCALE = "default_locale" // value text: locale of the messages in the code, default en
+
+	SETTING_CATEGORY_HTTP           = "http"
+	SETTING_KEY_HTTP_READ_TIMEOUT   = "read_timeout_ms"        // value int: request read timeout, 0 keeps SIMPLEHTTP_READ_TIMEOUT
+	SETTING_KEY_HTTP_WRITE_TIMEOUT  = "write_timeout_ms"       // value int: response write timeout, 0 keeps SIMPLEHTTP_WRITE_TIMEOUT
+	SETTING_KEY_HTTP_IDLE_TIMEOUT   = "idle_timeout_ms"        // value int: idle keep-alive connections are closed after this, 0 keeps SIMPLEHTTP_IDLE_TIMEOUT
+	SETTING_KEY_HTTP_KEEP_ALIVE     = "keep_alive"             // value int (bool): reuse client connections, default on
+	SETTING_KEY_HTTP_HTTP2          = "http2"                  // value int (bool): serve HTTP/2 (TLS and h2c) through the net/http front end
+	SETTING_KEY_HTTP_MAX_STREAMS    = "max_concurrent_streams" // value int: HTTP/2 streams per connection, default 250
+	SETTING_KEY_HTTP_CONCURRENCY    = "concurrency"            // value int: max concurrent connections of the server, 0 is the framework default
+
+	SETTING_CATEGORY_PEER      = "peer"
+	SETTING_KEY_PEER_MTLS      = "mtls"      // value int (bool): node to node traffic over mutual TLS, needs SURESQL_PEER_SECRET
+	SETTING_KEY_PEER_CERT_DAYS = "cert_days" // value int: lifetime of node certificates, renewed with a third left, default 30
+	SETTING_KEY_PEER_CA_DAYS   = "ca_days"   // value int: lifetime of the peer CA, rotated with a third left, default 365
+
+	SETTING_CATEGORY_INTEGRITY     = "integrity"
+	SETTING_KEY_INTEGRITY_VERIFY_H = "verify_hours" // value int: the leader verifies the row checksums of the tables this often, 0 disables
+
+	SETTING_CATEGORY_REPLICATION      = "replication"
+	SETTING_KEY_REPLICATION_HEARTBEAT = "heartbeat_sec" // value int: the leader writes the lag heartbeat this often, default 5, 0 disables lag monitoring
+	SETTING_KEY_REPLICATION_LAG_WARN  = "lag_warn_sec"  // value int: apply lag that raises a warning alert, default 10
+	SETTING_KEY_REPLICATION_LAG_MAX   = "lag_max_sec"   // value int: apply lag that suspends reads from this node until it is back under lag_warn_sec, default 30
+
+	SETTING_CATEGORY_ROUTING  = "routing"
+	SETTING_KEY_ROUTING_HINTS = "hints" // value text: X-SureSQL-Route hints clients may use, comma separated, default prefer-leader,prefer-replica,node, none for no hints
+
+	SETTING_CATEGORY_MAINTENANCE    = "maintenance"
+	SETTING_KEY_MAINTENANCE_CRON    = "_cron"        // value text: key suffix of the tasks, ie: analyze_cron is when ANALYZE runs (5 field cron, UTC), empty disables
+	SETTING_KEY_MAINTENANCE_HISTORY = "history_days" // value int: maintenance runs are kept this long, default 30
+
+	SETTING_CATEGORY_DISK          = "disk"
+	SETTING_KEY_DISK_CAPACITY_MB   = "capacity_mb"   // value int: disk capacity of the DBMS data in MB, 0 disables the projection
+	SETTING_KEY_DISK_SAMPLE_MIN    = "sample_min"    // value int: every node samples its DBMS size this often, default 15, 0 disables
+	SETTING_KEY_DISK_WINDOW_HOURS  = "window_hours"  // value int: the growth rate is fitted over the samples of this many hours, default 72
+	SETTING_KEY_DISK_WARN_DAYS     = "warn_days"     // value int: projected full within this many days raises a warning alert, default 14
+	SETTING_KEY_DISK_CRITICAL_DAYS = "critical_days" // value int: projected full within this many days raises a critical alert, default 3
+	SETTING_KEY_DISK_HISTORY_DAYS  = "history_days"  // value int: samples are kept this long, default 30
+
+	SETTING_CATEGORY_TX     = "tx"
+	SETTING_KEY_TX_IDLE_SEC = "idle_sec" // value int: an interactive transaction without statements for this long is rolled back, default 30
+	SETTING_KEY_TX_MAX_SEC  = "max_sec"  // value int: an interactive transaction open this long is rolled back, default 300
+	SETTING_KEY_TX_MAX_OPEN = "max_open" // value int: open interactive transactions per node, each holds a connection, default 20, 0 disables them
+
+	SETTING_CATEGORY_EXPERIMENT         = "experiment"
+	SETTING_KEY_EXPERIMENT_SAMPLE_PCT   = "sample_pct"   // value int: percent of the querysql requests mirrored to the alternate backend, 0 is off
+	SETTING_KEY_EXPERIMENT_MAX_INFLIGHT = "max_inflight" // value int: mirrors running at once, a sampled request is skipped beyond, default 4
+	SETTING_KEY_EXPERIMENT_KEEP         = "keep"         // value int: divergences kept for /monitoring/experiment, default 100
+
+	SETTING_CATEGORY_SHADOW         = "shadow"
+	SETTING_KEY_SHADOW_SAMPLE_PCT   = "sample_pct"   // value int: percent of the data API requests sent to the staging node (SHADOW_URL), 0 is off
+	SETTING_KEY_SHADOW_MODE         = "mode"         // value text: reads (default) or all, all sends the writes too, to a sandbox copy
+	SETTING_KEY_SHADOW_REDACT       = "redact"       // value text: comma separated JSON keys (columns, condition fields, values) masked before sending
+	SETTING_KEY_SHADOW_MAX_INFLIGHT = "max_inflight" // value int: requests sent at once, a sampled request is skipped beyond, default 8
+
+	SETTING_CATEGORY_SWITCHOVER           = "switchover"
+	SETTING_KEY_SWITCHOVER_CHECKSUM_ROWS  = "checksum_rows"  // value int: tables up to this many rows are compared row by row on verify, larger ones by count, default 10000
+	SETTING_KEY_SWITCHOVER_VERIFY_MAX_SEC = "verify_max_sec" // value int: a flip needs a passed verify this recent, default 300
+
+	SETTING_CATEGORY_WRITE_QUEUE        = "write_queue"
+	SETTING_KEY_WRITE_QUEUE_MAX_PENDING = "max_pending" // value int: records of queued inserts waiting at once, more are refused, default 10000
+	SETTING_KEY_WRITE_QUEUE_KEEP_SEC    = "keep_sec"    // value int: the outcome of a queued insert is kept this long for /db/api/queue, default 3600
+
+	SETTING_CATEGORY_WRITE_SERIALIZER      = "write_serializer"
+	SETTING_KEY_WRITE_SERIALIZER_ENABLED   = "enabled"        // value int (bool): rqlite writes of the API users are sent in batches, default off
+	SETTING_KEY_WRITE_SERIALIZER_FLUSH_MS  = "flush_ms"       // value int: a batch is sent this long after its first write, default 5
+	SETTING_KEY_WRITE_SERIALIZER_MAX_STMTS = "max_statements" // value int: a batch is sent at once when it has this many statements, default 100
+
+	SETTING_CATEGORY_COPY     = "copy"
+	SETTING_KEY_COPY_MIN_ROWS = "min_rows" // value int: same table inserts of this many records use COPY on PostgreSQL and CockroachDB, 0 disables, default 1000
+
+	SETTING_CATEGORY_INSERT_STREAM       = "insert_stream"
+	SETTING_KEY_INSERT_STREAM_CHUNK      = "chunk_records"  // value int: NDJSON inserts are validated and written this many records at a time, default 1000
+	SETTING_KEY_INSERT_STREAM_UPLOAD_TTL = "upload_ttl_sec" // value int: the parts of an upload are remembered this long after the last one, default 3600
+
+	SETTING_CATEGORY_CONFIG_EVENTS    = "config_events"
+	SETTING_KEY_CONFIG_EVENTS_WEBHOOK = "webhook_url" // value text: every settings change is POSTed here as JSON, empty disables
 
 	SETTING_CATEGORY_NODES = "nodes"
 	SETTING_KEY_NODE_NAME  = "node_name" // value string: node_number;hostname;ip;mode
@@ -70,6 +206,7 @@ type SureSQLDBMSConfig struct {
 	SSL         bool   `json:"ssl,omitempty"             db:"ssl"`
 	Options     string `json:"options,omitempty"         db:"options"`
 	Consistency string `json:"consistency,omitempty"     db:"consistency"`
+	AuthToken   string `json:"auth_token,omitempty"      db:"auth_token"` // bearer token of hosted DBMSs (libSQL/Turso)
 	// below are not yet used. Previously those are SureSQL Config instead of DBMS config
 	URL string `json:"url,omitempty"             db:"url"`
 	EnvConfig
@@ -97,6 +234,7 @@ func (sc *SureSQLDBMSConfig) PrintDebug(secure bool) {
 	fmt.Println("Max Retries   : ", sc.URL)
 	if secure {
 		fmt.Println("Password      : ", sc.Password)
+		fmt.Println("AuthToken     : ", sc.AuthToken)
 		fmt.Println("Token         : ", sc.Token)
 		fmt.Println("Refresh       : ", sc.RefreshToken)
 		fmt.Println("JWEKey        : ", sc.JWEKey)
@@ -183,6 +321,7 @@ func loadDBMSConfigFromEnvironment() SureSQLDBMSConfig {
 		SSL:         utils.GetEnvBool("DBMS_SSL", false),
 		Options:     utils.GetEnvString("DBMS_OPTIONS", ""),
 		Consistency: utils.GetEnvString("DBMS_CONSISTENCY", ""),
+		AuthToken:   utils.GetEnvString("DBMS_AUTH_TOKEN", ""),
 		EnvConfig: EnvConfig{
 			Token:        utils.GetEnvString("DBMS_TOKEN", ""),
 			RefreshToken: utils.GetEnvString("DBMS_TOKEN_REFRESH", ""),
@@ -230,8 +369,7 @@ func OverwriteConfigFromEnvironment() {
 		if len(iAPI) > 0 {
 			parts := strings.Split(iAPI, ":")
 			if len(parts) >= 2 {
-				CurrentNode.InternalConfig.Username = parts[0]
-				CurrentNode.InternalConfig.Password = parts[1]
+				CurrentNode.SetAdminCredentials(parts[0], parts[1])
 			}
 		}
 	}
@@ -294,6 +432,9 @@ func LoadConfigFromDB(db *SureSQLDB) error {
 
 	// Get from database
 	CurrentNode.Config = object.MapToStructSlow[ConfigTable](record.Data)
+	if err := openConfigSecrets(&CurrentNode.Config.EnvConfig); err != nil {
+		return err
+	}
 	CurrentNode.IsEncrypted = CurrentNode.Config.EncryptionMethod != "none"
 	OverwriteConfigFromEnvironment()
 	// TODO (Clustering): Fetch cluster peers and leader information from DBMS status endpoint
@@ -322,6 +463,9 @@ func LoadSettingsFromDB(db *SureSQLDB) error {
 		tmpConfigMap[tmp.SettingKey] = tmp
 		CurrentNode.Settings[tmp.Category] = tmpConfigMap
 	}
+	if err := openSecretSettings(CurrentNode.Settings); err != nil {
+		return err
+	}
 	// fmt.Println("DEBUG: reading configs table:", len(records), " rows")
 	// fmt.Println("DEBUG: current node configs :", len(CurrentNode.DBConfigs), " category")
 	return err
@@ -0,0 +1,110 @@
+package suresql
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Config change notifications: every change of a setting made through /suresql/settings is published
+// on ConfigEvents once the node applied it, with the old and the new value (secrets masked), who made
+// it and the node. Go code and plugins subscribe to the bus, operators follow it as server-sent events
+// on /suresql/settings/events, and when config_events/webhook_url is set every event is POSTed there
+// (failed deliveries go to the dead letters). Events are not persisted, _settings_history is the record.
+
+const (
+	CONFIG_EVENT_BUFFER          = 64 // events a subscriber may lag behind, more are dropped for it
+	CONFIG_EVENT_WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+// ConfigEvent is a change of a setting applied by a node. Applied tells if the node uses the new value
+// already, the other settings are read when the node starts.
+type ConfigEvent struct {
+	ID         int64     `json:"id"` // sequence of the node, from 1 at start
+	Category   string    `json:"category"`
+	SettingKey string    `json:"setting_key"`
+	Action     string    `json:"action"` // set or delete
+	OldValue   string    `json:"old_value,omitempty"`
+	NewValue   string    `json:"new_value,omitempty"`
+	ChangedBy  string    `json:"changed_by,omitempty"`
+	NodeNumber int       `json:"node_number"`
+	Applied    bool      `json:"applied"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// ConfigEventBus fans the events out to the subscribers, a slow subscriber loses events instead of
+// blocking the change
+type ConfigEventBus struct {
+	mu          sync.Mutex
+	subscribers map[int]chan ConfigEvent
+	next        int
+	sequence    int64
+	dropped     int64
+}
+
+// ConfigEvents is the bus of this node
+var ConfigEvents = &ConfigEventBus{subscribers: map[int]chan ConfigEvent{}}
+
+// Subscribe returns the channel of the events from now on and the function that ends the subscription
+func (b *ConfigEventBus) Subscribe() (<-chan ConfigEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	ch := make(chan ConfigEvent, CONFIG_EVENT_BUFFER)
+	b.subscribers[id] = ch
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// Publish numbers the event, sends it to the subscribers and to the webhook
+func (b *ConfigEventBus) Publish(e ConfigEvent) ConfigEvent {
+	b.mu.Lock()
+	b.sequence++
+	e.ID = b.sequence
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddInt64(&b.dropped, 1)
+		}
+	}
+	b.mu.Unlock()
+
+	if url := configEventsWebhookURL(); url != "" {
+		go postConfigEvent(url, e)
+	}
+	return e
+}
+
+// Dropped counts the events a subscriber did not get because it was behind
+func (b *ConfigEventBus) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+func postConfigEvent(url string, e ConfigEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err := PostWebhook(url, body, CONFIG_EVENT_WEBHOOK_TIMEOUT); err != nil {
+		simplelog.LogErrorAny("config_events", err, "cannot post config event")
+		AddDeadLetter(DEAD_LETTER_SOURCE_WEBHOOK, url, e.ChangedBy, WebhookDelivery{URL: url, Body: body}, err)
+	}
+}
+
+func configEventsWebhookURL() string {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CONFIG_EVENTS, SETTING_KEY_CONFIG_EVENTS_WEBHOOK); ok {
+		return tmp.TextValue
+	}
+	return ""
+}
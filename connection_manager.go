@@ -11,18 +11,28 @@ import (
 // ConnectionManager manages database connections and handles cleanup
 type ConnectionManager struct {
 	node           *SureSQLNode
-	cleanupTicker  *time.Ticker
+	cleanupTicker  Ticker
 	stopChan       chan struct{}
 	wg             sync.WaitGroup
 	cleanupRunning bool
 	mu             sync.Mutex
+
+	// Leases: last time a pooled connection (by token) was used. Connections that are idle longer than
+	// node.LeaseTimeout are reclaimed when the pool is under pressure, the token is remembered in reclaimed
+	// so the connection can be re-established lazily on the token's next request.
+	leaseMu     sync.Mutex
+	leases      map[string]time.Time
+	reclaimed   map[string]time.Time
+	reconnectMu sync.Mutex // serialize lazy reconnects so one token does not get 2 connections
 }
 
 // NewConnectionManager creates a new connection manager
 func NewConnectionManager(node *SureSQLNode) *ConnectionManager {
 	return &ConnectionManager{
-		node:     node,
-		stopChan: make(chan struct{}),
+		node:      node,
+		stopChan:  make(chan struct{}),
+		leases:    make(map[string]time.Time),
+		reclaimed: make(map[string]time.Time),
 	}
 }
 
@@ -41,7 +51,7 @@ func (cm *ConnectionManager) StartCleanupRoutine(ctx context.Context, interval t
 		interval = DEFAULT_TTL_TICKER_MINUTES
 	}
 
-	cm.cleanupTicker = time.NewTicker(interval)
+	cm.cleanupTicker = CurrentClock.NewTicker(interval)
 	cm.wg.Add(1)
 
 	go func() {
@@ -56,7 +66,7 @@ func (cm *ConnectionManager) StartCleanupRoutine(ctx context.Context, interval t
 			case <-cm.stopChan:
 				simplelog.LogThis("ConnectionManager", "Stop signal received, stopping cleanup routine")
 				return
-			case <-cm.cleanupTicker.C:
+			case <-cm.cleanupTicker.C():
 				cm.cleanupExpiredConnections()
 			}
 		}
@@ -93,6 +103,143 @@ func (cm *ConnectionManager) cleanupExpiredConnections() {
 			Metrics.RecordConnectionClosed()
 		}
 	}
+
+	// Free the slots held by idle leases if the pool is under pressure, then forget leases of
+	// connections that are already gone from the TTLMap.
+	cm.ReclaimIdleConnections()
+	cm.pruneLeases()
+}
+
+// TouchConnection marks the connection for this token as used now (renews the lease)
+func (cm *ConnectionManager) TouchConnection(token string) {
+	cm.leaseMu.Lock()
+	defer cm.leaseMu.Unlock()
+	cm.leases[token] = CurrentClock.Now()
+	delete(cm.reclaimed, token)
+}
+
+// ForgetConnection removes any lease information for this token, ie: when the token is refreshed or revoked
+func (cm *ConnectionManager) ForgetConnection(token string) {
+	cm.leaseMu.Lock()
+	defer cm.leaseMu.Unlock()
+	delete(cm.leases, token)
+	delete(cm.reclaimed, token)
+}
+
+// MarkReclaimed lets a token without a pooled connection get one on its next request, like a reclaimed
+// one, ie: a persisted token loaded after a restart
+func (cm *ConnectionManager) MarkReclaimed(token string) {
+	cm.leaseMu.Lock()
+	defer cm.leaseMu.Unlock()
+	cm.reclaimed[token] = CurrentClock.Now()
+}
+
+// WasReclaimed returns true if the connection of this token was closed by ReclaimIdleConnections
+func (cm *ConnectionManager) WasReclaimed(token string) bool {
+	cm.leaseMu.Lock()
+	defer cm.leaseMu.Unlock()
+	_, ok := cm.reclaimed[token]
+	return ok
+}
+
+// ReclaimIdleConnections closes the pooled connections whose token has not issued a query for longer
+// than the lease timeout. It only does so when the pool usage is at or above node.ReclaimPct, because an
+// idle connection is harmless as long as there are free slots. Returns number of reclaimed connections.
+func (cm *ConnectionManager) ReclaimIdleConnections() int {
+	timeout := cm.node.LeaseTimeout
+	if cm.node.DBConnections == nil || timeout <= 0 {
+		return 0
+	}
+	if cm.GetConnectionPoolUsage() < cm.node.ReclaimPct {
+		return 0
+	}
+
+	now := CurrentClock.Now()
+	var idle []string
+	cm.leaseMu.Lock()
+	for token := range cm.node.DBConnections.Map() {
+		last, ok := cm.leases[token]
+		if !ok {
+			// Connection was pooled before we tracked it, start the lease now
+			cm.leases[token] = now
+			continue
+		}
+		if now.Sub(last) >= timeout {
+			idle = append(idle, token)
+		}
+	}
+	cm.leaseMu.Unlock()
+
+	count := 0
+	for _, token := range idle {
+		if cm.closeConnection(token) {
+			count++
+			Metrics.RecordConnectionReclaimed()
+			cm.leaseMu.Lock()
+			delete(cm.leases, token)
+			cm.reclaimed[token] = now
+			cm.leaseMu.Unlock()
+		}
+	}
+	if count > 0 {
+		simplelog.LogFormat("ConnectionManager: reclaimed %d idle connections (lease timeout %s)", count, timeout)
+	}
+	return count
+}
+
+// pruneLeases drops leases of connections that are no longer in the pool, and reclaimed markers that are
+// older than the refresh token lifetime (the token cannot come back after that anyway).
+func (cm *ConnectionManager) pruneLeases() {
+	if cm.node.DBConnections == nil {
+		return
+	}
+	pooled := cm.node.DBConnections.Map()
+	maxAge := cm.node.Config.RefreshExp
+	if maxAge == 0 {
+		maxAge = DEFAULT_REFRESH_EXPIRES_MINUTES
+	}
+
+	cm.leaseMu.Lock()
+	defer cm.leaseMu.Unlock()
+	for token := range cm.leases {
+		if _, ok := pooled[token]; !ok {
+			delete(cm.leases, token)
+		}
+	}
+	for token, at := range cm.reclaimed {
+		if CurrentClock.Since(at) > maxAge {
+			delete(cm.reclaimed, token)
+		}
+	}
+}
+
+// reconnect re-establishes the connection of a token that was reclaimed while idle.
+func (cm *ConnectionManager) reconnect(token string) (SureSQLDB, error) {
+	cm.reconnectMu.Lock()
+	defer cm.reconnectMu.Unlock()
+
+	// Another request of the same token might have reconnected while we were waiting
+	if db, err := cm.node.GetDBConnectionByToken(token); err == nil {
+		return db, nil
+	}
+
+	if !cm.node.IsPoolAvailable() {
+		cm.ReclaimIdleConnections()
+		if !cm.node.IsPoolAvailable() {
+			Metrics.RecordPoolExhaustion()
+			return nil, ErrPoolExhausted
+		}
+	}
+
+	db, err := NewDatabase(cm.node.GetInternalConfig())
+	if err != nil {
+		return nil, err
+	}
+	cm.node.DBConnections.Put(token, 0, db)
+	cm.TouchConnection(token)
+	Metrics.RecordConnectionCreated()
+	Metrics.RecordConnectionReestablished()
+	return db, nil
 }
 
 // closeConnection closes a single connection by token
@@ -0,0 +1,131 @@
+package suresql
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/medatechnology/simpleorm/rqlite"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Per-request consistency: a read (QueryRequest, SQLRequest) can carry the rqlite read consistency it
+// wants, overriding the Consistency of the node for that call. Levels are those of rqlite: none (the copy
+// of this node), weak (the leader), linearizable and strong. freshness (a duration, with none only) is how
+// far behind the leader the copy may be, an older copy fails the read instead of serving stale rows.
+// The other DBMS have one consistency, the field is ignored there.
+
+const (
+	CONSISTENCY_NONE         = "none"
+	CONSISTENCY_WEAK         = "weak"
+	CONSISTENCY_LINEARIZABLE = "linearizable"
+	CONSISTENCY_STRONG       = "strong"
+
+	// freshness is kept in whole seconds up to an hour, every value is a connection of its own
+	CONSISTENCY_MAX_FRESHNESS = time.Hour
+)
+
+var (
+	ErrConsistencyInvalid = medaerror.MedaError{Message: "consistency must be none, weak, linearizable or strong"}
+	ErrFreshnessInvalid   = medaerror.MedaError{Message: "freshness must be a duration from 1s to 1h, with consistency none"}
+	consistencyLevels     = map[string]bool{CONSISTENCY_NONE: true, CONSISTENCY_WEAK: true, CONSISTENCY_LINEARIZABLE: true, CONSISTENCY_STRONG: true}
+)
+
+// ReadConsistency is the parsed consistency of a request, Level is empty when the request has none
+type ReadConsistency struct {
+	Level     string
+	Freshness time.Duration
+}
+
+// String is the level as told to the client, with its freshness
+func (c ReadConsistency) String() string {
+	if c.Freshness > 0 {
+		return c.Level + ";freshness=" + c.Freshness.String()
+	}
+	return c.Level
+}
+
+// ParseConsistency checks the consistency and freshness of a request. A freshness without a level is
+// read at none, freshness is rounded up to whole seconds.
+func ParseConsistency(level, freshness string) (ReadConsistency, error) {
+	c := ReadConsistency{Level: strings.ToLower(strings.TrimSpace(level))}
+	if freshness = strings.TrimSpace(freshness); freshness != "" {
+		d, err := time.ParseDuration(freshness)
+		if err != nil || d <= 0 || d > CONSISTENCY_MAX_FRESHNESS {
+			return ReadConsistency{}, ErrFreshnessInvalid
+		}
+		if c.Level == "" {
+			c.Level = CONSISTENCY_NONE
+		}
+		if c.Level != CONSISTENCY_NONE {
+			return ReadConsistency{}, ErrFreshnessInvalid
+		}
+		c.Freshness = (d + time.Second - 1).Truncate(time.Second)
+	}
+	if c.Level != "" && !consistencyLevels[c.Level] {
+		return ReadConsistency{}, ErrConsistencyInvalid
+	}
+	return c, nil
+}
+
+// ConsistentRead returns the connection reading at the consistency of the request and the level taken.
+// Reads at none while replica reads are suspended (replication_lag.go) are served by the leader, unless
+// a freshness bounds them already.
+func ConsistentRead(db SureSQLDB, c ReadConsistency) (SureSQLDB, string, error) {
+	dbms := strings.ToUpper(strings.TrimSpace(CurrentNode.GetInternalConfig().DBMS))
+	if c.Level == "" || (dbms != "" && dbms != "RQLITE") {
+		return db, "", nil
+	}
+	if c.Level == CONSISTENCY_NONE && c.Freshness == 0 && ReplicaReadsSuspended() {
+		c.Level = CONSISTENCY_WEAK
+	}
+	if c.Freshness == 0 {
+		conn, err := routeConnection(c.Level)
+		return WithFaults(conn), c.String(), err
+	}
+	conn, err := freshnessConnection(c.Freshness)
+	return WithFaults(conn), c.String(), err
+}
+
+// freshnessConnection returns the none connection of the freshness, shared with the routing ones
+func freshnessConnection(freshness time.Duration) (SureSQLDB, error) {
+	key := CONSISTENCY_NONE + ";freshness=" + freshness.String()
+	routeConnections.mu.Lock()
+	defer routeConnections.mu.Unlock()
+	if db, ok := routeConnections.dbs[key]; ok {
+		return db, nil
+	}
+	conf := CurrentNode.GetInternalConfig()
+	conf.Consistency = CONSISTENCY_NONE
+	db, err := NewDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	// the orm package has no freshness, it is added to the queries of the connection
+	if r, ok := db.(*rqlite.RQLiteDirectDB); ok && r.HTTPClient != nil {
+		r.HTTPClient.Transport = freshnessTransport{base: r.HTTPClient.Transport, freshness: freshness.String()}
+	}
+	routeConnections.dbs[key] = db
+	return db, nil
+}
+
+// freshnessTransport sets the freshness of the rqlite queries it sends
+type freshnessTransport struct {
+	base      http.RoundTripper
+	freshness string
+}
+
+func (t freshnessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if strings.HasSuffix(req.URL.Path, "/db/query") {
+		req = req.Clone(req.Context())
+		q := req.URL.Query()
+		q.Set("freshness", t.freshness)
+		req.URL.RawQuery = q.Encode()
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,157 @@
+package suresql
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// COPY bulk loads: on PostgreSQL and CockroachDB a same table insert of at least copy/min_rows records
+// is streamed with COPY FROM STDIN instead of INSERT statements, one round trip and no SQL to parse per
+// row. database/sql has no COPY, the program registers a CopyFromFunc of its driver (see
+// app/suresql/driver_pgcopy.go, -tags pgcopy). CockroachDB copies on its own connection, PostgreSQL goes
+// through the orm package and copies on a pgx connection of the same config, opened on first use.
+// Without a CopyFromFunc, on the other DBMS, for fewer records or records with different columns the
+// batched inserts are used. A COPY is all or nothing, it has one result with the rows copied; when it
+// fails (ie: a value the driver cannot encode for the column) nothing was written and the batched inserts
+// run instead, they report the error of the record if there is one.
+
+const (
+	COPY_DEFAULT_MIN_ROWS  = 1000
+	POSTGRES_DEFAULT_PORT  = "5432"
+	COPY_CONNECTION_IDLE   = 2
+	COPY_CONNECTION_MAXAGE = 30 * time.Minute
+)
+
+// CopyFromFunc copies the rows (values in the order of columns) into the table on db and returns the
+// rows copied. Table and columns are validated and lower case, as PostgreSQL folds them unquoted.
+type CopyFromFunc func(ctx context.Context, db *sql.DB, table string, columns []string, rows [][]interface{}) (int64, error)
+
+var (
+	copyFrom       CopyFromFunc
+	copyDriver     string
+	copyConnection struct {
+		mu sync.Mutex
+		db *sql.DB
+	}
+)
+
+// RegisterCopyFrom sets the COPY of the database/sql driver (ie: pgx), call it before the node starts
+func RegisterCopyFrom(driver string, fn CopyFromFunc) {
+	copyDriver, copyFrom = driver, fn
+}
+
+// copyMinRows reads copy/min_rows, 0 disables COPY
+func copyMinRows() int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_COPY, SETTING_KEY_COPY_MIN_ROWS); ok {
+		return s.IntValue
+	}
+	return COPY_DEFAULT_MIN_ROWS
+}
+
+// copyInsert copies the records when COPY applies, ok is false when the batched inserts have to be used
+func copyInsert(db SureSQLDB, records []orm.DBRecord) ([]orm.BasicSQLResult, bool) {
+	min := copyMinRows()
+	if copyFrom == nil || min <= 0 || len(records) < min {
+		return nil, false
+	}
+	conf := CurrentNode.GetInternalConfig()
+	if DialectFor(conf.DBMS).Name != DialectPostgres.Name {
+		return nil, false
+	}
+	columns := recordColumns(records[0])
+	for _, rec := range records[1:] {
+		if !sameInsertShape(records[0], rec, columns) {
+			return nil, false
+		}
+	}
+	table := strings.ToLower(records[0].TableName)
+	if ValidateTableName(table, true) != nil || len(columns) == 0 {
+		return nil, false
+	}
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		if ValidateIdentifier(column) != nil || strings.Contains(column, ".") {
+			return nil, false
+		}
+		names[i] = strings.ToLower(column)
+	}
+
+	// faults are injected on the batched inserts
+	if f, ok := db.(faultyDB); ok {
+		db = f.SureSQLDB
+	}
+	var conn *sql.DB
+	switch d := db.(type) {
+	case *SQLDatabase:
+		if d.Flavor.Driver != copyDriver {
+			return nil, false
+		}
+		conn = d.DB
+	default:
+		var err error
+		if conn, err = postgresCopyConnection(conf); err != nil {
+			simplelog.LogFormat("copy: cannot open the copy connection, inserting in batches: %s", err.Error())
+			return nil, false
+		}
+	}
+
+	rows := make([][]interface{}, len(records))
+	for i, rec := range records {
+		row := make([]interface{}, len(columns))
+		for j, column := range columns {
+			row[j] = rec.Data[column]
+		}
+		rows[i] = row
+	}
+	start := time.Now()
+	n, err := copyFrom(context.Background(), conn, table, names, rows)
+	if err != nil {
+		simplelog.LogFormat("copy: %d records into %s failed, inserting in batches: %s", len(records), table, err.Error())
+		return nil, false
+	}
+	return []orm.BasicSQLResult{{RowsAffected: int(n), Timing: time.Since(start).Seconds()}}, true
+}
+
+// postgresCopyConnection is the connection of the copy driver to the PostgreSQL of the config, kept open
+func postgresCopyConnection(conf SureSQLDBMSConfig) (*sql.DB, error) {
+	copyConnection.mu.Lock()
+	defer copyConnection.mu.Unlock()
+	if copyConnection.db != nil {
+		return copyConnection.db, nil
+	}
+	port := conf.Port
+	if port == "" {
+		port = POSTGRES_DEFAULT_PORT
+	}
+	// the same DSN as CockroachDB, with the sslmode the orm package connects with
+	dsn := cockroachDSN(conf, net.JoinHostPort(conf.Host, port))
+	if conf.SSL {
+		dsn = strings.Replace(dsn, "sslmode=verify-full", "sslmode=require", 1)
+	}
+	db, err := sql.Open(copyDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(COPY_CONNECTION_IDLE)
+	db.SetConnMaxLifetime(COPY_CONNECTION_MAXAGE)
+	copyConnection.db = db
+	return db, nil
+}
+
+// resetCopyConnection closes the copy connection, ie: after the node moved to another backend
+func resetCopyConnection() {
+	copyConnection.mu.Lock()
+	defer copyConnection.mu.Unlock()
+	if copyConnection.db != nil {
+		copyConnection.db.Close()
+		copyConnection.db = nil
+	}
+}
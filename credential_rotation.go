@@ -0,0 +1,168 @@
+package suresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// DBMS credential rotation: /suresql/dbms/rotate-credentials opens a connection with the new username and
+// password and reads through it, nothing changes when that fails. Then the internal connection and the
+// config are swapped and the read, freshness and copy connections dropped, they reopen with the new
+// credentials. The pooled user connections are re-keyed in the background one by one: a new connection
+// takes the place of the old one, which is closed CREDENTIAL_DRAIN later so the statements running on it
+// finish. A token whose new connection fails to open loses its connection and reconnects on its next
+// request, tokens stay valid. A rotation applies to the running process of the node it is called on, set
+// DBMS_USERNAME and DBMS_PASSWORD before the next restart and revoke the old credentials once every node
+// is done. The admin credentials (GetAdminCredentials) are separate and stay as they are.
+
+const (
+	CREDENTIAL_REKEY_PAUSE = 50 * time.Millisecond // between two re-keyed connections, logins are not sent in a burst
+	CREDENTIAL_DRAIN       = 30 * time.Second      // a replaced connection is closed this long after
+
+	ROTATION_IDLE     = "idle"
+	ROTATION_REKEYING = "rekeying"
+	ROTATION_DONE     = "done"
+)
+
+var (
+	ErrRotationMissing = medaerror.MedaError{Message: "username and password of the DBMS are required"}
+	ErrRotationRunning = medaerror.MedaError{Message: "a credential rotation is running"}
+)
+
+// CredentialRotationStatus is the step of the last rotation, never with a password
+type CredentialRotationStatus struct {
+	Phase     string     `json:"phase"`
+	Username  string     `json:"username"` // the DBMS user in use
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	DoneAt    *time.Time `json:"done_at,omitempty"`
+	Pooled    int        `json:"pooled"`  // user connections to re-key
+	Rekeyed   int        `json:"rekeyed"` // replaced by a connection with the new credentials
+	Dropped   int        `json:"dropped"` // failed to reopen, reconnected on the next request of the token
+}
+
+// CredentialRotation swaps the DBMS credentials of the node
+type CredentialRotation struct {
+	mu      sync.Mutex
+	running bool
+	status  CredentialRotationStatus
+}
+
+var Credentials = &CredentialRotation{status: CredentialRotationStatus{Phase: ROTATION_IDLE}}
+
+// Status returns the step of the last rotation
+func (r *CredentialRotation) Status() CredentialRotationStatus {
+	r.mu.Lock()
+	status := r.status
+	r.mu.Unlock()
+	status.Username = CurrentNode.GetInternalConfig().Username
+	return status
+}
+
+// Rotate verifies the new credentials with a test connection, swaps the internal connection and the config,
+// and starts the re-key of the pooled connections
+func (r *CredentialRotation) Rotate(username, password string) (CredentialRotationStatus, error) {
+	if username == "" || password == "" {
+		return r.Status(), ErrRotationMissing
+	}
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return r.Status(), ErrRotationRunning
+	}
+	r.running = true
+	r.mu.Unlock()
+
+	conf := CurrentNode.GetInternalConfig()
+	conf.Username, conf.Password = username, password
+	db, err := NewDatabase(conf)
+	if err == nil {
+		if _, err = db.SelectOnlyOneSQL("SELECT 1 AS ok"); err != nil {
+			closeDB(db)
+		}
+	}
+	if err != nil {
+		r.mu.Lock()
+		r.running = false
+		r.mu.Unlock()
+		return r.Status(), err
+	}
+
+	replaced := CurrentNode.SwapInternalConnection(db, conf)
+	tokens := []string{}
+	CurrentNode.mu.RLock()
+	if CurrentNode.DBConnections != nil {
+		for token := range CurrentNode.DBConnections.Map() {
+			tokens = append(tokens, token)
+		}
+	}
+	CurrentNode.mu.RUnlock()
+	resetRouteConnections()
+	resetCopyConnection()
+	drainDB(replaced)
+
+	now := CurrentClock.Now().UTC()
+	r.mu.Lock()
+	r.status = CredentialRotationStatus{Phase: ROTATION_REKEYING, StartedAt: &now, Pooled: len(tokens)}
+	r.mu.Unlock()
+	simplelog.LogFormat("credentials: DBMS user %s verified, re-keying %d pooled connections", username, len(tokens))
+	go r.rekey(conf, tokens)
+	return r.Status(), nil
+}
+
+// rekey replaces the connection of every token with one opened with conf, tokens gone meanwhile are skipped
+func (r *CredentialRotation) rekey(conf SureSQLDBMSConfig, tokens []string) {
+	for _, token := range tokens {
+		time.Sleep(CREDENTIAL_REKEY_PAUSE)
+		db, err := NewDatabase(conf)
+
+		CurrentNode.mu.Lock()
+		val, ok := CurrentNode.DBConnections.Get(token)
+		if ok && err == nil {
+			CurrentNode.DBConnections.Put(token, 0, db)
+		} else if ok {
+			CurrentNode.DBConnections.Delete(token)
+		}
+		CurrentNode.mu.Unlock()
+
+		if !ok {
+			if err == nil {
+				closeDB(db)
+			}
+			continue
+		}
+		if old, isDB := val.(SureSQLDB); isDB {
+			drainDB(old)
+		}
+		r.mu.Lock()
+		if err == nil {
+			r.status.Rekeyed++
+		} else {
+			r.status.Dropped++
+		}
+		r.mu.Unlock()
+		if err != nil {
+			simplelog.LogErrorAny("credentials", err, "failed to re-key a pooled connection, it reconnects on its next request")
+			if ConnectionMgr != nil {
+				ConnectionMgr.MarkReclaimed(token)
+			}
+		}
+	}
+
+	now := CurrentClock.Now().UTC()
+	r.mu.Lock()
+	r.status.Phase, r.status.DoneAt, r.running = ROTATION_DONE, &now, false
+	rekeyed, dropped := r.status.Rekeyed, r.status.Dropped
+	r.mu.Unlock()
+	simplelog.LogFormat("credentials: rotation done, %d connections re-keyed, %d dropped", rekeyed, dropped)
+}
+
+// drainDB closes the connection once the statements running on it had time to finish
+func drainDB(db SureSQLDB) {
+	if db == nil {
+		return
+	}
+	time.AfterFunc(CREDENTIAL_DRAIN, func() { closeDB(db) })
+}
@@ -0,0 +1,136 @@
+package suresql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Minimal 5 field cron expression: minute hour day-of-month month day-of-week.
+// Supports *, numbers, ranges (a-b), steps (*/n, a-b/n) and lists (a,b,c). Day of week is 0-7 where
+// both 0 and 7 are Sunday. Like standard cron, when both day fields are restricted a day matches if
+// either of them matches.
+
+var ErrCronSyntax = medaerror.MedaError{Message: "invalid cron expression"}
+
+type CronSchedule struct {
+	Expr        string
+	minute      uint64
+	hour        uint64
+	dom         uint64
+	month       uint64
+	dow         uint64
+	domWildcard bool
+	dowWildcard bool
+}
+
+// ParseCron parses a 5 field cron expression
+func ParseCron(expr string) (CronSchedule, error) {
+	c := CronSchedule{Expr: expr}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return c, medaerror.Errorf("%s %q: need 5 fields, got %d", ErrCronSyntax.Message, expr, len(fields))
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, err
+	}
+	// 7 is also Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domWildcard = fields[2] == "*"
+	c.dowWildcard = fields[4] == "*"
+	return c, nil
+}
+
+// Matches returns true if the schedule fires in the minute of t
+func (c CronSchedule) Matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return c.dayMatches(t)
+}
+
+// Next returns the first minute after t that the schedule fires, zero time if none within 5 years
+func (c CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) != 0:
+			return t
+		default:
+			t = t.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+func (c CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domWildcard || c.dowWildcard {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, medaerror.Errorf("%s: bad step in %q", ErrCronSyntax.Message, part)
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, medaerror.Errorf("%s: bad value %q", ErrCronSyntax.Message, part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, medaerror.Errorf("%s: bad value %q", ErrCronSyntax.Message, part)
+				}
+			} else if step > 1 {
+				// a/n means from a to max
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, medaerror.Errorf("%s: %q out of range %d-%d", ErrCronSyntax.Message, part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
@@ -0,0 +1,223 @@
+package suresql
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// CSV import: /db/api/import/csv takes a CSV upload (multipart field file) with a header row and inserts its
+// rows into one table. The header names the columns, the mapping query parameter (header:column pairs
+// separated by commas) renames them and then only the mapped headers are imported. The rows are read a
+// chunk at a time, a chunk is one atomic batch of multi-row INSERTs (InsertChunk) so it is written whole
+// or not at all, when it fails its rows are inserted one by one and only the bad ones fail. On a DBMS
+// without atomic batches the statements before the failing one stay written and only the rest is retried.
+// A row failing the checks of /db/api/insert is skipped and reported with its line, the import goes on.
+// Empty fields are NULL, the others are converted to the affinity of their column.
+
+const (
+	CSV_IMPORT_MAX_ERRORS = 1000 // problems reported, the rows failing after are only counted
+)
+
+var (
+	ErrCSVHeader    = medaerror.MedaError{Message: "the CSV needs a header row"}
+	ErrCSVMapping   = medaerror.MedaError{Message: "mapping is header:column pairs separated by commas"}
+	ErrCSVDelimiter = medaerror.MedaError{Message: "delimiter is one character (or tab), not a quote or a line break"}
+)
+
+// csvColumn is a column of the table filled from the field at index of every row
+type csvColumn struct {
+	index    int
+	name     string
+	affinity string
+}
+
+// CSVStream reads the rows of a CSV as records of table
+type CSVStream struct {
+	streamLines
+	r       *csv.Reader
+	table   string
+	columns []csvColumn
+	width   int // columns of the table, the widest a record can be
+}
+
+// ParseCSVDelimiter reads the delimiter query parameter, a comma when empty
+func ParseCSVDelimiter(s string) (rune, error) {
+	switch s {
+	case "":
+		return ',', nil
+	case "tab", `\t`, "\t":
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, ErrCSVDelimiter
+	}
+	return r, nil
+}
+
+// NewCSVStream reads the header row and maps its fields to the columns of table, a mapped header or column
+// that does not exist is an error before anything is inserted
+func NewCSVStream(r io.Reader, table, mapping string, delimiter rune) (*CSVStream, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = delimiter
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, ErrCSVHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the rows must have as many fields as the header
+	cr.FieldsPerRecord = len(header)
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	schema, err := TableSchema(table, false)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := csvMapping(header, mapping)
+	if err != nil {
+		return nil, err
+	}
+	s := &CSVStream{streamLines: streamLines{line: 1}, r: cr, table: table, width: len(schema)}
+	used := make(map[string]bool)
+	for _, p := range pairs {
+		col := findColumn(schema, p[1])
+		if col == nil {
+			// the column may be added since the schema was cached
+			if fresh, err := TableSchema(table, true); err == nil {
+				schema, s.width = fresh, len(fresh)
+				col = findColumn(schema, p[1])
+			}
+		}
+		if col == nil {
+			return nil, medaerror.Errorf("column %s is not in table %s", p[1], table)
+		}
+		if used[strings.ToLower(col.Name)] {
+			return nil, medaerror.Errorf("column %s is mapped twice", col.Name)
+		}
+		used[strings.ToLower(col.Name)] = true
+		index := 0
+		for header[index] != p[0] {
+			index++
+		}
+		s.columns = append(s.columns, csvColumn{index: index, name: col.Name, affinity: col.Affinity})
+	}
+	return s, nil
+}
+
+// csvMapping returns the header:column pairs, every header of the row when mapping is empty
+func csvMapping(header []string, mapping string) ([][2]string, error) {
+	var pairs [][2]string
+	if strings.TrimSpace(mapping) == "" {
+		for _, h := range header {
+			if h == "" {
+				return nil, medaerror.Errorf("%s, a header is empty", ErrCSVHeader.Message)
+			}
+			pairs = append(pairs, [2]string{h, h})
+		}
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		h, column, ok := strings.Cut(pair, ":")
+		h, column = strings.TrimSpace(h), strings.TrimSpace(column)
+		if !ok || h == "" || column == "" {
+			return nil, ErrCSVMapping
+		}
+		found := false
+		for _, name := range header {
+			found = found || name == h
+		}
+		if !found {
+			return nil, medaerror.Errorf("header %s is not in the CSV", h)
+		}
+		pairs = append(pairs, [2]string{h, column})
+	}
+	return pairs, nil
+}
+
+// Chunk is the rows of a chunk: insert_stream/chunk_records, fewer when a multi-row statement of the table
+// cannot hold that many
+func (s *CSVStream) Chunk() int {
+	n := InsertStreamChunk()
+	if n > BULK_INSERT_MAX_ROWS {
+		n = BULK_INSERT_MAX_ROWS
+	}
+	if max := BulkInsertMaxParams(CurrentNode.GetInternalConfig().DBMS) / s.width; s.width > 0 && max < n {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Next returns the records of up to max rows and the rows without the fields of the header (their record
+// is the line), io.EOF at the end of the CSV. A field the CSV cannot parse stops the stream with an error.
+func (s *CSVStream) Next(max int) ([]orm.DBRecord, []RecordFieldError, error) {
+	records := make([]orm.DBRecord, 0, max)
+	var bad []RecordFieldError
+	s.lines = s.lines[:0]
+	for len(records)+len(bad) < max {
+		fields, err := s.r.Read()
+		if err == io.EOF {
+			return records, bad, err
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			s.line = parseErr.StartLine
+			if errors.Is(err, csv.ErrFieldCount) {
+				bad = append(bad, RecordFieldError{Record: s.line, Table: s.table, Message: fmt.Sprintf("has %d fields, the header has %d", len(fields), s.r.FieldsPerRecord)})
+				continue
+			}
+		}
+		if err != nil {
+			return records, bad, err
+		}
+		s.line, _ = s.r.FieldPos(0)
+		records = append(records, s.record(fields))
+		s.lines = append(s.lines, s.line)
+	}
+	return records, bad, nil
+}
+
+// record converts the fields of a row to the values of its columns, a field that does not convert stays a
+// string for the validation to report
+func (s *CSVStream) record(fields []string) orm.DBRecord {
+	data := make(map[string]interface{}, len(s.columns))
+	for _, c := range s.columns {
+		v := fields[c.index]
+		if v == "" {
+			data[c.name] = nil
+			continue
+		}
+		data[c.name] = v
+		switch c.affinity {
+		case AFFINITY_INTEGER:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				data[c.name] = i
+			}
+		case AFFINITY_REAL:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				data[c.name] = f
+			}
+		case AFFINITY_BOOL:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				data[c.name] = b
+			}
+		}
+	}
+	return orm.DBRecord{TableName: s.table, Data: data}
+}
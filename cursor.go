@@ -0,0 +1,239 @@
+package suresql
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Keyset pagination: a QueryRequest with page_size and no page (or with a cursor) pages by cursor. The
+// rows are sorted by the order_by columns of the condition and the primary key, a full page answers with
+// next_cursor, an opaque token of the sort keys of its last row. The next request sends it back and gets the
+// rows after that row with a WHERE on the sort keys instead of OFFSET, so page 10000 costs what page 1 does
+// when an index covers the order. Without a primary key the order_by has to be unique. A cursor belongs to
+// its table, order and filter, it is refused with another one.
+
+var (
+	ErrCursorInvalid  = medaerror.MedaError{Message: "invalid cursor"}
+	ErrCursorQuery    = medaerror.MedaError{Message: "cursor pagination needs order_by columns of the table and no page, limit, offset, single_row, distinct, grouping, joins or as_of"}
+	ErrCursorMismatch = medaerror.MedaError{Message: "the cursor belongs to another table, order or filter"}
+	ErrCursorNull     = medaerror.MedaError{Message: "the last row has no value for a sort column, there is no next cursor"}
+)
+
+// CursorKey is a sort column of a cursor paged query
+type CursorKey struct {
+	Column string
+	Desc   bool
+}
+
+// CursorPage is a page of a cursor paged query, the next cursor is made from its records
+type CursorPage struct {
+	Keys   []CursorKey
+	Size   int
+	table  string
+	filter uint64
+}
+
+// queryCursor is the content of a cursor
+type queryCursor struct {
+	Table  string        `json:"t"`
+	Order  []string      `json:"o"`
+	Filter uint64        `json:"f"`
+	Values []interface{} `json:"v"`
+}
+
+// Cursored tells if the request pages by cursor
+func (r QueryRequest) Cursored() bool {
+	return r.Cursor != "" || (r.PageSize > 0 && r.Page == 0)
+}
+
+// ApplyCursor sets the order, limit and (after a cursor) the keyset condition on the request, it returns
+// the page, nil when the request is not paged by cursor
+func ApplyCursor(req *QueryRequest) (*CursorPage, error) {
+	if !req.Cursored() {
+		return nil, nil
+	}
+	if req.Page != 0 || req.SingleRow || req.Distinct || req.Grouped() || len(req.Joins) > 0 || req.AsOf != nil ||
+		req.Condition == nil || len(req.Condition.OrderBy) == 0 || req.Condition.Limit != 0 || req.Condition.Offset != 0 {
+		return nil, ErrCursorQuery
+	}
+	if req.PageSize < 0 || req.PageSize > QUERY_MAX_PAGE_SIZE {
+		return nil, ErrPageInvalid
+	}
+	size, err := pageSize(req.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := cursorKeys(req.Table, req.Condition.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cursor is checked against the filter, the condition without its order
+	filter := *req.Condition
+	filter.OrderBy, filter.GroupBy = nil, nil
+	c := orm.Condition{OrderBy: make([]string, len(keys)), Limit: size}
+	for i, k := range keys {
+		c.OrderBy[i] = k.String()
+	}
+	if req.Cursor != "" {
+		cur, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(cur.Table, req.Table) || strings.Join(cur.Order, ",") != strings.Join(c.OrderBy, ",") ||
+			cur.Filter != filterHash(filter) || len(cur.Values) != len(keys) {
+			return nil, ErrCursorMismatch
+		}
+		c.Logic, c.Nested = "AND", []orm.Condition{filter, keysetCondition(keys, cur.Values)}
+	} else {
+		c.Field, c.Operator, c.Value, c.Logic, c.Nested = filter.Field, filter.Operator, filter.Value, filter.Logic, filter.Nested
+	}
+	req.Condition = &c
+	return &CursorPage{Keys: keys, Size: size, table: req.Table, filter: filterHash(filter)}, nil
+}
+
+// String is the ORDER BY entry of the key
+func (k CursorKey) String() string {
+	if k.Desc {
+		return k.Column + " DESC"
+	}
+	return k.Column
+}
+
+// cursorKeys are the order_by columns, as in the schema, and the primary key columns not among them
+func cursorKeys(table string, orderBy []string) ([]CursorKey, error) {
+	keys := make([]CursorKey, 0, len(orderBy)+1)
+	seen := map[string]bool{}
+	for _, o := range orderBy {
+		o = strings.TrimSpace(o)
+		if !orderByRegex.MatchString(o) || strings.Contains(strings.ToUpper(o), "NULLS") {
+			return nil, ErrCursorQuery
+		}
+		parts := strings.Fields(o)
+		column := parts[0]
+		if i := strings.Index(column, "."); i >= 0 {
+			if !strings.EqualFold(column[:i], table) {
+				return nil, ErrCursorQuery
+			}
+			column = column[i+1:]
+		}
+		name, ok := tableColumn(table, column, false)
+		if !ok {
+			return nil, medaerror.Errorf("%s: %s", ErrFieldUnknown.Message, column)
+		}
+		if !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			keys = append(keys, CursorKey{Column: name, Desc: len(parts) > 1 && strings.EqualFold(parts[1], "DESC")})
+		}
+	}
+	for _, pk := range primaryKeyColumns(table) {
+		if !seen[strings.ToLower(pk)] {
+			keys = append(keys, CursorKey{Column: pk})
+		}
+	}
+	return keys, nil
+}
+
+// keysetCondition is the rows after the values in the order of the keys:
+// (a > va) OR (a = va AND b < vb) OR (a = va AND b = vb AND id > vid)
+func keysetCondition(keys []CursorKey, values []interface{}) orm.Condition {
+	after := orm.Condition{Logic: "OR"}
+	for i, k := range keys {
+		branch := orm.Condition{Logic: "AND"}
+		for j := 0; j < i; j++ {
+			branch.Nested = append(branch.Nested, orm.Condition{Field: keys[j].Column, Operator: "=", Value: values[j]})
+		}
+		op := ">"
+		if k.Desc {
+			op = "<"
+		}
+		branch.Nested = append(branch.Nested, orm.Condition{Field: k.Column, Operator: op, Value: values[i]})
+		after.Nested = append(after.Nested, branch)
+	}
+	return after
+}
+
+// CursorColumns adds the sort keys to the selected columns, the next cursor is read from them
+func CursorColumns(columns []string, keys []CursorKey) []string {
+	if len(columns) == 0 {
+		return columns
+	}
+	columns = append([]string(nil), columns...)
+	for _, k := range keys {
+		found := false
+		for _, column := range columns {
+			if strings.EqualFold(column, k.Column) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			columns = append(columns, k.Column)
+		}
+	}
+	return columns
+}
+
+// Next is the cursor after the last record of a full page, empty after the last page
+func (p *CursorPage) Next(records []orm.DBRecord) (string, error) {
+	if len(records) < p.Size || len(records) == 0 {
+		return "", nil
+	}
+	last := records[len(records)-1].Data
+	cur := queryCursor{Table: p.table, Order: make([]string, len(p.Keys)), Filter: p.filter, Values: make([]interface{}, len(p.Keys))}
+	for i, k := range p.Keys {
+		v, ok := lookupField(last, k.Column)
+		if !ok || v == nil {
+			return "", ErrCursorNull
+		}
+		if b, isBytes := v.([]byte); isBytes {
+			v = string(b)
+		}
+		cur.Order[i], cur.Values[i] = k.String(), v
+	}
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string) (queryCursor, error) {
+	var cur queryCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, ErrCursorInvalid
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&cur); err != nil {
+		return cur, ErrCursorInvalid
+	}
+	// integers stay exact (ids above 2^53), the drivers take int64 and float64 but not json.Number
+	for i, v := range cur.Values {
+		if n, ok := v.(json.Number); ok {
+			if iv, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+				cur.Values[i] = iv
+			} else if fv, err := n.Float64(); err == nil {
+				cur.Values[i] = fv
+			}
+		}
+	}
+	return cur, nil
+}
+
+// filterHash identifies the filter of the request a cursor was made for
+func filterHash(c orm.Condition) uint64 {
+	data, _ := json.Marshal(c)
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
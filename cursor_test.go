@@ -0,0 +1,55 @@
+package suresql
+
+import (
+	"testing"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	schemaCache["cursor_users"] = schemaCacheEntry{columns: []TableColumn{{Name: "country"}, {Name: "id", PrimaryKey: true}}, loaded: time.Now()}
+	tableExprCache["cursor_users"] = tableExprCacheEntry{loaded: time.Now()}
+	defer delete(schemaCache, "cursor_users")
+	defer delete(tableExprCache, "cursor_users")
+
+	filter := orm.Condition{Field: "country", Operator: "!=", Value: "XX", OrderBy: []string{"country DESC"}}
+	first := filter
+	req := QueryRequest{Table: "cursor_users", PageSize: 2, Condition: &first}
+	page, err := ApplyCursor(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an id above 2^53 has to come back exact
+	next, err := page.Next([]orm.DBRecord{
+		{Data: map[string]interface{}{"country": "NL", "id": int64(1)}},
+		{Data: map[string]interface{}{"country": "DE", "id": int64(9007199254740993)}},
+	})
+	if err != nil || next == "" {
+		t.Fatalf("no next cursor: %v", err)
+	}
+
+	second := filter
+	req = QueryRequest{Table: "cursor_users", PageSize: 2, Cursor: next, Condition: &second}
+	if _, err := ApplyCursor(&req); err != nil {
+		t.Fatal(err)
+	}
+	q, err := BuildSelect(DialectPostgres, req.Table, req.Condition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT * FROM cursor_users WHERE (country != $1) AND (((country < $2)) OR ((country = $3) AND (id > $4))) ORDER BY country DESC, id LIMIT 2"
+	if q.Query != want {
+		t.Fatalf("got %q, want %q", q.Query, want)
+	}
+	if q.Values[3] != int64(9007199254740993) {
+		t.Fatalf("id of the cursor is %v (%T)", q.Values[3], q.Values[3])
+	}
+
+	other := filter
+	other.Value = "YY"
+	req = QueryRequest{Table: "cursor_users", PageSize: 2, Cursor: next, Condition: &other}
+	if _, err := ApplyCursor(&req); err != ErrCursorMismatch {
+		t.Fatalf("a cursor of another filter gave %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package suresql
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -8,6 +9,7 @@ import (
 	orm "github.com/medatechnology/simpleorm"
 
 	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/medaerror"
 	"github.com/medatechnology/goutil/medattlmap"
 	"github.com/medatechnology/goutil/metrics"
 	"github.com/medatechnology/goutil/object"
@@ -56,6 +58,58 @@ func (n *SureSQLNode) GetInternalConfig() SureSQLDBMSConfig {
 	return n.InternalConfig
 }
 
+// GetInternalConnection returns the node's own connection (thread-safe), the switchover and the credential
+// rotation replace it while requests run
+func (n *SureSQLNode) GetInternalConnection() SureSQLDB {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.InternalConnection
+}
+
+// SwapInternalConnection replaces the node's own connection and its config (thread-safe), with the schema
+// table and driver name of its DBMS, it returns the connection replaced
+func (n *SureSQLNode) SwapInternalConnection(db SureSQLDB, conf SureSQLDBMSConfig) SureSQLDB {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	replaced := n.InternalConnection
+	n.InternalConnection, n.InternalConfig = db, conf
+	SchemaTable, n.Status.DBMSDriver = backendOf(conf)
+	if n.adminUsername == "" && n.adminPassword == "" {
+		n.adminUsername, n.adminPassword = conf.Username, conf.Password
+	}
+	return replaced
+}
+
+// GetAdminCredentials returns the basic auth of the internal API, the monitoring and impersonation
+// (thread-safe): SURESQL_INTERNAL_API, or the DBMS credentials the node started with. Rotating the
+// DBMS credentials or a switchover does not change them.
+func (n *SureSQLNode) GetAdminCredentials() (username, password string) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.adminUsername, n.adminPassword
+}
+
+// SetAdminCredentials replaces the basic auth of the internal API (thread-safe)
+func (n *SureSQLNode) SetAdminCredentials(username, password string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.adminUsername, n.adminPassword = username, password
+}
+
+// GetSchemaTable returns the schema table of the internal DBMS (thread-safe), read SchemaTable through it
+func (n *SureSQLNode) GetSchemaTable() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return SchemaTable
+}
+
+// GetDBMSDriver returns the driver name of the internal DBMS (thread-safe)
+func (n *SureSQLNode) GetDBMSDriver() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.Status.DBMSDriver
+}
+
 // UpdateConfig updates configuration safely (thread-safe)
 func (n *SureSQLNode) UpdateConfig(updateFn func(*ConfigTable)) {
 	n.mu.Lock()
@@ -106,6 +160,31 @@ func (n *SureSQLNode) GetDBConnectionByToken(token string) (SureSQLDB, error) {
 	return db, nil
 }
 
+// Same as GetDBConnectionByToken but renews the connection lease, and if the connection was reclaimed
+// while idle (see ConnectionManager.ReclaimIdleConnections) it is re-established lazily.
+// Handlers should use this one to get the connection for the token that makes the request.
+func (n *SureSQLNode) GetOrReconnectDBConnection(token string) (SureSQLDB, error) {
+	if err := InjectFault(FAULT_TARGET_CONNECTION); err != nil {
+		var none SureSQLDB
+		return none, err
+	}
+	db, err := n.GetDBConnectionByToken(token)
+	if ConnectionMgr == nil {
+		return WithFaults(WithSerializedWrites(db)), err
+	}
+	if err == nil {
+		if n.IsPoolEnabled {
+			ConnectionMgr.TouchConnection(token)
+		}
+		return WithFaults(WithSerializedWrites(db)), nil
+	}
+	if err != ErrNoDBConnection || !ConnectionMgr.WasReclaimed(token) {
+		return db, err
+	}
+	db, err = ConnectionMgr.reconnect(token)
+	return WithFaults(WithSerializedWrites(db)), err
+}
+
 // DEPRECATED: RenameDBConnection is deprecated and should not be used.
 // When refreshing tokens, close the old connection and create a new one instead.
 // This function is kept for backwards compatibility but will be removed in a future version.
@@ -150,79 +229,96 @@ func ConnectInternal() error {
 	InitMetrics()
 
 	// Set the global variable for when server is started from making the DBMS connection
-	ServerStartTime = time.Now()
+	ServerStartTime = CurrentClock.Now()
 
 	// IMPROVE: Change this maybe reading from environment or settings table!
 	// CurrentNode.IsPoolEnabled = DEFAULT_POOL_ENABLED
 	// CurrentNode.MaxPool = DEFAULT_MAX_POOL
 
-	el := metrics.StartTimeIt("Loading environment...", 0)
-	utils.ReloadEnvEach(".env.dev", SURESQL_ENV_FILE)
-	metrics.StopTimeItPrint(el, "Done")
-
-	el = metrics.StartTimeIt("Loading DBMS config... ", 0)
-	conf := LoadDBMSConfigFromEnvironment()
-	metrics.StopTimeItPrint(el, "Done")
-
-	// conf.PrintDebug(false)
-	el = metrics.StartTimeIt("Making internal connection to DB...", 0)
-	db, err := NewDatabase(conf)
+	conf, err := connectInternalDB()
 	if err != nil {
-		simplelog.LogErrorAny("Main", err, "Failed to connect to database")
 		return err
 	}
-	// Internal connection is used by the SureSQL Backend only
-	CurrentNode.InternalConnection = db
-	CurrentNode.InternalConfig = conf
-	// Parse SURESQL_INTERNAL_API for monitoring endpoints authentication
-	OverwriteConfigFromEnvironment()
-	// Preparing the DBPool connection that is called by the Handler /connect
-	metrics.StopTimeItPrint(el, "Done")
 
+	internal := CurrentNode.GetInternalConnection()
 	db_is_initialized := true
-	el = metrics.StartTimeIt("Reading config table...", 0)
-	err = LoadConfigFromDB(&CurrentNode.InternalConnection)
-	if err != nil {
+	el := metrics.StartTimeIt("Reading config table...", 0)
+	err = LoadConfigFromDB(&internal)
+	if IsSecretError(err) {
+		// initialized, but the secrets need the master key, do not run InitDB over it
+		return initFailed(err)
+	} else if err != nil {
 		simplelog.LogErrorStr("init", err, "cannot load settings from DB, it is not yet initialized")
-//		return err
+		db_is_initialized = false
+	} else if !CurrentNode.Config.IsInitDone {
+		// config row exists but is_init_done was never set: a previous InitDB stopped half way
+		simplelog.LogFormat("init: config table found but initialization was not completed, resuming")
 		db_is_initialized = false
 	}
 	metrics.StopTimeItPrint(el, "Done")
 
+	if !db_is_initialized && RequireExternalInit() {
+		// the init container (suresql init) has not finished, do not create the schema from here
+		return initFailed(ErrDBNotInitialized)
+	}
 	// Init DB is done after LoadSettings just in case if settings already initialized??
 	if !db_is_initialized {
+		setInitPhase(INIT_PHASE_MIGRATING)
 		el = metrics.StartTimeIt("Initializing DB tables...", -1)
 		err = InitDB(false)
-		if err == nil {
-			// if no error that means DB is initalized, if it's already initialized it will return err=ErrDBInitializedAlready
-			// call the LoadSEttings again
-			err := LoadConfigFromDB(&CurrentNode.InternalConnection)
-			if err != nil {
-				simplelog.LogErrorStr("connect internal", err, "cannot load settings from DB, it is not yet initialized")
-				return err
-			}
-		} else {
+		if err != nil && err != ErrDBInitializedAlready {
+			// the node is not usable half initialized, stop here. Progress is in _migrations so the
+			// next ConnectInternal (or restart) continues where this one stopped.
 			metrics.StopTimeItPrint(el, err.Error())
+			return initFailed(err)
 		}
 		metrics.StopTimeItPrint(el, "Done")
+		// if no error that means DB is initalized, call the LoadConfig again
+		err = LoadConfigFromDB(&internal)
+		if err != nil {
+			simplelog.LogErrorStr("connect internal", err, "cannot load settings from DB, it is not yet initialized")
+			return initFailed(err)
+		}
+	}
+	setInitPhase(INIT_PHASE_CONFIG)
+
+	version, pending, err := PendingMigrations()
+	if err != nil {
+		// databases initialized before migrations were tracked have no _migrations table
+		simplelog.LogErrorStr("init", err, "cannot read migration progress")
+	} else if len(pending) > 0 {
+		simplelog.LogFormat("init: %d migration file(s) not applied: %v", len(pending), pending)
+	}
+	updateInitProgress(func(p *InitProgress) {
+		p.SchemaVersion = version
+		p.PendingMigrations = pending
+	})
+	if len(pending) > 0 && RequireExternalInit() {
+		return initFailed(medaerror.Errorf("%s: run suresql init, pending: %v", ErrDBNotInitialized.Message, pending))
 	}
 
 	// Make the configMaps before reading from DB
 	CurrentNode.Settings = make(Settings)
 
 	el = metrics.StartTimeIt("Reading settings table...", 0)
-	err = LoadSettingsFromDB(&CurrentNode.InternalConnection)
+	err = LoadSettingsFromDB(&internal)
 	if err != nil {
 		simplelog.LogErrorStr("init", err, "cannot load configs from DB or not yet initialized")
-		return err
+		return initFailed(err)
 	}
 	metrics.StopTimeItPrint(el, "Done")
+	setInitPhase(INIT_PHASE_SETTINGS)
+
+	// secrets written before the master key was set (or with the previous one) are sealed now
+	if _, err := SealStoredSecrets(); err != nil {
+		simplelog.LogErrorStr("init", err, "cannot encrypt stored secrets")
+	}
 
 	el = metrics.StartTimeIt("Reading DBMS status...", 0)
-	_, err = GetStatusInternal(CurrentNode.InternalConnection, NODE_MODE)
+	_, err = GetStatusInternal(internal, NODE_MODE)
 	if err != nil {
 		simplelog.LogErrorStr("init", err, "cannot get status from DB")
-		return err
+		return initFailed(err)
 	}
 	metrics.StopTimeItPrint(el, "Done")
 
@@ -241,9 +337,88 @@ func ConnectInternal() error {
 	if len(CurrentNode.Status.Peers) > 0 {
 		CurrentNode.MaxPool = CurrentNode.Status.MaxPool * len(CurrentNode.Status.Peers)
 	}
+	setInitPhase(INIT_PHASE_READY)
 	return nil
 }
 
+// connectInternalDB loads the environment and makes the internal connection. It can be called again
+// after a failure, an existing connection is kept.
+func connectInternalDB() (SureSQLDBMSConfig, error) {
+	el := metrics.StartTimeIt("Loading environment...", 0)
+	utils.ReloadEnvEach(".env.dev", SURESQL_ENV_FILE)
+	metrics.StopTimeItPrint(el, "Done")
+
+	el = metrics.StartTimeIt("Loading DBMS config... ", 0)
+	conf := LoadDBMSConfigFromEnvironment()
+	metrics.StopTimeItPrint(el, "Done")
+
+	// RQLITED_EMBED: run rqlited here and connect to it
+	InitEmbeddedRqlite()
+	if err := StartEmbeddedRqlite(context.Background()); err != nil {
+		simplelog.LogErrorAny("Main", err, "Failed to start the embedded rqlited")
+		return conf, initFailed(err)
+	}
+	conf = EmbeddedDBMSConfig(conf)
+
+	// conf.PrintDebug(false)
+	el = metrics.StartTimeIt("Making internal connection to DB...", 0)
+	db := CurrentNode.GetInternalConnection()
+	if db == nil || !db.IsConnected() {
+		var err error
+		if db, err = NewDatabase(conf); err != nil {
+			simplelog.LogErrorAny("Main", err, "Failed to connect to database")
+			return conf, initFailed(err)
+		}
+	}
+	// Internal connection is used by the SureSQL Backend only
+	CurrentNode.SwapInternalConnection(db, conf)
+	// Parse SURESQL_INTERNAL_API for monitoring endpoints authentication
+	OverwriteConfigFromEnvironment()
+	// Preparing the DBPool connection that is called by the Handler /connect
+	metrics.StopTimeItPrint(el, "Done")
+	setInitPhase(INIT_PHASE_CONNECTED)
+	return conf, nil
+}
+
+// InitInternal only initializes or migrates the internal database and does not load anything else,
+// this is `suresql init` for init containers. On a new database it runs InitDB (migrations and the
+// bootstrap file), on an initialized one the migration files that are not applied yet.
+func InitInternal() error {
+	InitMetrics()
+	if _, err := connectInternalDB(); err != nil {
+		return err
+	}
+	setInitPhase(INIT_PHASE_MIGRATING)
+	internal := CurrentNode.GetInternalConnection()
+	err := LoadConfigFromDB(&internal)
+	if err != nil || !CurrentNode.Config.IsInitDone {
+		err = InitDB(false)
+	} else {
+		var applied int
+		applied, err = MigratePending()
+		simplelog.LogFormat("init: database already initialized, %d pending migration file(s) applied", applied)
+	}
+	if err != nil && err != ErrDBInitializedAlready {
+		return initFailed(err)
+	}
+	version, pending, err := PendingMigrations()
+	if err != nil {
+		return initFailed(err)
+	}
+	updateInitProgress(func(p *InitProgress) {
+		p.SchemaVersion = version
+		p.PendingMigrations = pending
+	})
+	simplelog.LogFormat("init: done, schema version %s", version)
+	return nil
+}
+
+// RequireExternalInit is SURESQL_REQUIRE_INIT, the server then refuses to start against a database
+// that is not initialized or has pending migrations instead of initializing it itself.
+func RequireExternalInit() bool {
+	return utils.GetEnvBool("SURESQL_REQUIRE_INIT", false)
+}
+
 // This is the status for SureSQL Nodes (not the internal DBMS nodes)
 // Status is pretty much taken from Settings, but this is used for response
 func (n *SureSQLNode) GetStatusFromSettings(conf SureSQLDBMSConfig) {
@@ -263,7 +438,7 @@ func (n *SureSQLNode) GetStatusFromSettings(conf SureSQLDBMSConfig) {
 		CurrentNode.Status.URL += ":" + CurrentNode.Config.Port
 	}
 	n.Status.StartTime = ServerStartTime
-	n.Status.Uptime = time.Since(ServerStartTime) // this is refreshed when Status handler is called
+	n.Status.Uptime = CurrentClock.Since(ServerStartTime) // this is refreshed when Status handler is called
 	n.Status.Mode = n.Config.Mode
 	n.Status.Nodes = n.Config.Nodes
 	n.Status.NodeNumber = n.Config.NodeNumber
@@ -328,6 +503,27 @@ func (n *SureSQLNode) ApplySettings(category, key string) bool {
 			} else {
 				n.MaxPool = DEFAULT_MAX_POOL
 			}
+		case SETTING_KEY_LEASE_TIMEOUT:
+			if ok {
+				n.LeaseTimeout = time.Duration(tmp.IntValue) * time.Minute
+				res = true
+			} else {
+				n.LeaseTimeout = DEFAULT_LEASE_TIMEOUT
+			}
+		case SETTING_KEY_RECLAIM_PCT:
+			if ok && tmp.IntValue > 0 {
+				n.ReclaimPct = float64(tmp.IntValue)
+				res = true
+			} else {
+				n.ReclaimPct = DEFAULT_RECLAIM_PCT
+			}
+		case SETTING_KEY_MAX_INFLIGHT:
+			if ok && tmp.IntValue > 0 {
+				n.MaxInFlight = int64(tmp.IntValue)
+				res = true
+			} else {
+				n.MaxInFlight = DEFAULT_MAX_INFLIGHT
+			}
 		default:
 		}
 	case SETTING_CATEGORY_NODES:
@@ -366,6 +562,9 @@ func (n *SureSQLNode) ApplyAllConfig() bool {
 	res := true
 	res = n.ApplySettings(SETTING_CATEGORY_CONNECTION, SETTING_KEY_MAX_POOL)
 	res = n.ApplySettings(SETTING_CATEGORY_CONNECTION, SETTING_KEY_ENABLE_POOL) || res
+	res = n.ApplySettings(SETTING_CATEGORY_CONNECTION, SETTING_KEY_LEASE_TIMEOUT) || res
+	res = n.ApplySettings(SETTING_CATEGORY_CONNECTION, SETTING_KEY_RECLAIM_PCT) || res
+	res = n.ApplySettings(SETTING_CATEGORY_CONNECTION, SETTING_KEY_MAX_INFLIGHT) || res
 	res = n.ApplySettings(SETTING_CATEGORY_TOKEN, SETTING_KEY_TOKEN_EXP) || res
 	res = n.ApplySettings(SETTING_CATEGORY_TOKEN, SETTING_KEY_REFRESH_EXP) || res
 	res = n.ApplySettings(SETTING_CATEGORY_TOKEN, SETTING_KEY_TOKEN_TTL) || res
@@ -374,92 +573,158 @@ func (n *SureSQLNode) ApplyAllConfig() bool {
 }
 
 func GetStatusInternal(db SureSQLDB, setNodeStatus bool) (orm.NodeStatusStruct, error) {
-	status, err := db.Status()
+	status, err := coalescedStatus(db)
 	if err != nil {
 		return orm.NodeStatusStruct{}, err
 	}
 	if setNodeStatus {
-		CurrentNode.Status.DirSize = status.DirSize
-		CurrentNode.Status.DBSize = status.DBSize
-		// CurrentNodeID is not the DBMS NodeID. status.NodeID is the DBMS NodeID (if clustered)
-		// CurrentNode.Status.NodeID = status.NodeID
-		CurrentNode.Status.LastBackup = status.LastBackup
-		CurrentNode.Status.Leader = status.Leader
-		if CurrentNode.Status.MaxPool == 0 {
-			if CurrentNode.MaxPool != 0 {
-				CurrentNode.Status.MaxPool = CurrentNode.MaxPool
-			} else {
-				CurrentNode.Status.MaxPool = DEFAULT_MAX_POOL
+		maxPool := CurrentNode.MaxPool
+		// under the node lock, the switchover writes the driver name of the status
+		CurrentNode.UpdateStatus(func(s *orm.NodeStatusStruct) {
+			s.DirSize = status.DirSize
+			s.DBSize = status.DBSize
+			// CurrentNodeID is not the DBMS NodeID. status.NodeID is the DBMS NodeID (if clustered)
+			// s.NodeID = status.NodeID
+			s.LastBackup = status.LastBackup
+			s.Leader = status.Leader
+			if s.MaxPool == 0 {
+				if maxPool != 0 {
+					s.MaxPool = maxPool
+				} else {
+					s.MaxPool = DEFAULT_MAX_POOL
+				}
 			}
-		}
-		CurrentNode.Status.Uptime = time.Since(ServerStartTime) // this is refreshed when Status handler is called
-
+			s.Uptime = CurrentClock.Since(ServerStartTime) // this is refreshed when Status handler is called
+		})
 	}
 	return status, err
 }
 
+// NodeInfo is the effective configuration of the node, what the startup banner prints, for deployment
+// tooling to check after a deploy. Secrets are only told as set or not.
+type NodeInfo struct {
+	App         string          `json:"app"`
+	Version     string          `json:"version"`
+	APIVersion  int             `json:"api_version"`
+	Label       string          `json:"label"`
+	NodeID      int             `json:"node_id"`
+	NodeNumber  int             `json:"node_number"`
+	Nodes       int             `json:"nodes"`
+	URL         string          `json:"url"`
+	IP          string          `json:"ip"`
+	Mode        string          `json:"mode"`
+	DBMS        string          `json:"dbms"`
+	Connected   bool            `json:"connected"`
+	Leader      string          `json:"leader,omitempty"`
+	Peers       []string        `json:"peers"` // empty for a single node
+	Consistency string          `json:"consistency"`
+	Options     string          `json:"options,omitempty"`
+	MaxPool     int             `json:"max_pool"`
+	Features    map[string]bool `json:"features"`
+	Encryption  NodeEncryption  `json:"encryption"`
+	StartedAt   time.Time       `json:"started_at"`
+}
+
+// NodeEncryption tells how the node encrypts and which secrets are fixed by the configuration
+type NodeEncryption struct {
+	Method    string `json:"method"`
+	HardToken bool   `json:"hard_token"` // token of the internal user set in the environment
+	HardJWE   bool   `json:"hard_jwe"`
+	APIKey    bool   `json:"api_key"`
+	ClientID  bool   `json:"client_id"`
+}
+
+// Info returns the effective configuration of the node, leader and peers are asked to the DBMS
+func (n *SureSQLNode) Info() NodeInfo {
+	prot := "http://"
+	if n.Config.SSL {
+		prot = "https://"
+	}
+	consistency := n.InternalConfig.Consistency
+	if consistency == "" {
+		consistency = "default"
+	}
+	info := NodeInfo{
+		App:         APP_NAME,
+		Version:     APP_VERSION,
+		APIVersion:  API_VERSION,
+		Label:       n.Config.Label,
+		NodeID:      n.Config.NodeID,
+		NodeNumber:  n.Config.NodeNumber,
+		Nodes:       n.Config.Nodes,
+		URL:         fmt.Sprintf("%s%s:%s", prot, n.Config.Host, n.Config.Port),
+		IP:          n.Config.IP,
+		Mode:        n.Config.Mode,
+		DBMS:        maintenanceDBMS(),
+		Peers:       []string{},
+		Consistency: consistency,
+		Options:     n.InternalConfig.Options,
+		MaxPool:     n.MaxPool,
+		Features: map[string]bool{
+			"db_init":     n.Config.IsInitDone,
+			"split_write": n.Config.IsSplitWrite,
+			"pool":        n.IsPoolEnabled,
+			"ssl":         n.Config.SSL,
+			"encrypted":   n.IsEncrypted,
+		},
+		Encryption: NodeEncryption{
+			Method:    n.Config.EncryptionMethod,
+			HardToken: n.InternalConfig.Token != "",
+			HardJWE:   n.InternalConfig.JWEKey != "",
+			APIKey:    n.Config.APIKey != "",
+			ClientID:  n.Config.ClientID != "",
+		},
+		StartedAt: ServerStartTime,
+	}
+	conn := n.GetInternalConnection()
+	if conn == nil || !conn.IsConnected() {
+		return info
+	}
+	info.Connected = true
+	for flag := range KnownFeatureFlags {
+		info.Features["flag:"+flag] = FeatureEnabled(flag)
+	}
+	if leader, err := conn.Leader(); err == nil {
+		info.Leader = leader
+	}
+	if peers, err := conn.Peers(); err == nil && len(peers) > 1 {
+		info.Peers = peers
+	}
+	return info
+}
+
 // Print the node information for console log
 func (n SureSQLNode) PrintWelcomePretty() {
 	fmt.Printf("")
-	if n.InternalConnection == nil {
+	if conn := n.GetInternalConnection(); conn == nil {
 		fmt.Println("Database not connected - nil")
 		return
-	} else if !n.InternalConnection.IsConnected() {
+	} else if !conn.IsConnected() {
 		fmt.Println("Database not connected - function")
 		return
 	}
 
-	prot := "http://"
-	heading1 := APP_NAME + " " + APP_VERSION
-	heading2 := fmt.Sprintf("%s (%d) - Node %d/%d", n.Config.Label, n.Config.NodeID, n.Config.NodeNumber, n.Config.Nodes)
-	if n.Config.SSL {
-		prot = "https://"
-	}
-	heading3 := fmt.Sprintf("%s%s:%s", prot, n.Config.Host, n.Config.Port)
-	appName := []string{heading1, heading2, heading3}
+	info := n.Info()
+	heading1 := info.App + " " + info.Version
+	heading2 := fmt.Sprintf("%s (%d) - Node %d/%d", info.Label, info.NodeID, info.NodeNumber, info.Nodes)
+	appName := []string{heading1, heading2, info.URL}
 	headingColors := []print.Color{
 		print.ColorCyan,
 		print.ColorGreen,
 		print.ColorNothing,
 	}
 
-	hardtoken := false
-	if n.InternalConfig.Token != "" {
-		hardtoken = true
-	}
-	hardjwe := false
-	if n.InternalConfig.JWEKey != "" {
-		hardjwe = true
-	}
-	consistency := n.InternalConfig.Consistency
-	if consistency == "" {
-		consistency = "default"
-	}
-	apikey := false
-	if n.Config.APIKey != "" {
-		apikey = true
-	}
-	clientid := false
-	if n.Config.ClientID != "" {
-		clientid = true
-	}
-
 	var clusters []print.KeyValue
-	leader, err := n.InternalConnection.Leader()
-
-	if err == nil {
-		clusters = append(clusters, print.Content(true, false, "Leader", leader))
+	if info.Leader != "" {
+		clusters = append(clusters, print.Content(true, false, "Leader", info.Leader))
 	}
-	peers, err := n.InternalConnection.Peers()
-	if err == nil {
-		if len(peers) > 1 {
-			for i, p := range peers {
-				pstr := fmt.Sprintf("Peer %d", i)
-				clusters = append(clusters, print.Content(true, false, pstr, p))
-			}
-		} else {
-			clusters = append(clusters, print.Content(true, false, "Peers", "None/Single Node"))
+	if len(info.Peers) > 1 {
+		for i, p := range info.Peers {
+			pstr := fmt.Sprintf("Peer %d", i)
+			clusters = append(clusters, print.Content(true, false, pstr, p))
 		}
+	} else {
+		clusters = append(clusters, print.Content(true, false, "Peers", "None/Single Node"))
 	}
 
 	// add a new line between leaders/peers information and settings
@@ -467,19 +732,19 @@ func (n SureSQLNode) PrintWelcomePretty() {
 
 	// Content defined in order
 	appSettings := []print.KeyValue{
-		print.Content(false, false, "Mode", n.Config.Mode),
-		print.Content(false, false, "Split-write", n.Config.IsSplitWrite),
-		print.Content(false, false, "IP", n.Config.IP),
-		print.Content(false, false, "DB init", n.Config.IsInitDone),
-		print.Content(false, false, "Pool", n.IsPoolEnabled),
-		print.Content(false, false, "Max pools", n.MaxPool),
-		print.Content(false, false, "Encryption", n.Config.EncryptionMethod),
-		print.Content(false, false, "Hard token", hardtoken),
-		print.Content(false, false, "Hard JWE", hardjwe),
-		print.Content(false, false, "API key", apikey),
-		print.Content(false, false, "Client ID", clientid),
-		print.Content(false, false, "Consistency", consistency),
-		print.Content(true, false, "Options", n.InternalConfig.Options),
+		print.Content(false, false, "Mode", info.Mode),
+		print.Content(false, false, "Split-write", info.Features["split_write"]),
+		print.Content(false, false, "IP", info.IP),
+		print.Content(false, false, "DB init", info.Features["db_init"]),
+		print.Content(false, false, "Pool", info.Features["pool"]),
+		print.Content(false, false, "Max pools", info.MaxPool),
+		print.Content(false, false, "Encryption", info.Encryption.Method),
+		print.Content(false, false, "Hard token", info.Encryption.HardToken),
+		print.Content(false, false, "Hard JWE", info.Encryption.HardJWE),
+		print.Content(false, false, "API key", info.Encryption.APIKey),
+		print.Content(false, false, "Client ID", info.Encryption.ClientID),
+		print.Content(false, false, "Consistency", info.Consistency),
+		print.Content(true, false, "Options", info.Options),
 	}
 
 	keyColor := print.ColorNothing
@@ -0,0 +1,214 @@
+package suresql
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Dead letters keep the payload of operations that failed so they can be inspected and retried later
+// instead of being lost: records of continue_on_error inserts, queued inserts the write queue failed to
+// write (the client got its answer before) and webhook deliveries (rules, billing). A synchronous insert
+// is answered with its error, it is not kept. Replication is applied by RQLite and CDC is captured by
+// triggers in the statement of the write, a failure there fails that write and is kept with it. A retry
+// runs with the internal connection and marks the dead letter resolved when it works, otherwise the retry
+// count and error are updated.
+
+const (
+	DEAD_LETTER_SOURCE_INSERT  = "insert"  // payload is a record of a continue_on_error insert
+	DEAD_LETTER_SOURCE_QUEUE   = "queue"   // payload is the records of a queued insert the write queue failed
+	DEAD_LETTER_SOURCE_WEBHOOK = "webhook" // payload is a WebhookDelivery
+
+	DEAD_LETTER_STATUS_PENDING  = "pending"
+	DEAD_LETTER_STATUS_RESOLVED = "resolved"
+
+	DEAD_LETTER_WEBHOOK_TIMEOUT = 30 * time.Second
+	DEAD_LETTER_LIST_LIMIT      = 100
+)
+
+var (
+	ErrDeadLetterNotFound      = medaerror.MedaError{Message: "dead letter not found"}
+	ErrDeadLetterUnknownSource = medaerror.MedaError{Message: "dead letter source cannot be retried"}
+)
+
+// DeadLetterTable is a failed operation with its payload
+type DeadLetterTable struct {
+	ID          int       `json:"id,omitempty"            db:"id"`
+	Source      string    `json:"source"                  db:"source"`  // insert, queue or webhook
+	Target      string    `json:"target"                  db:"target"`  // table or url depending on source
+	Payload     string    `json:"payload"                 db:"payload"` // JSON
+	Error       string    `json:"error"                   db:"error"`
+	RetryCount  int       `json:"retry_count"             db:"retry_count"`
+	Status      string    `json:"status"                  db:"status"`
+	Username    string    `json:"username,omitempty"      db:"username"`
+	CreatedAt   time.Time `json:"created_at,omitempty"    db:"created_at"`
+	LastRetryAt time.Time `json:"last_retry_at,omitempty" db:"last_retry_at"`
+}
+
+func (d DeadLetterTable) TableName() string {
+	return "_dead_letters"
+}
+
+// WebhookDelivery is the dead letter payload of a failed webhook call
+type WebhookDelivery struct {
+	URL  string          `json:"url"`
+	Body json.RawMessage `json:"body"`
+}
+
+// PostWebhook posts a JSON body, a non 2xx status is an error. It goes through the webhook outbound proxy.
+func PostWebhook(url string, body []byte, timeout time.Duration) error {
+	client := IntegrationHTTPClient(INTEGRATION_WEBHOOK, timeout)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return medaerror.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// AddDeadLetter stores a failed operation, payload is marshalled to JSON. Returns the dead letter id.
+func AddDeadLetter(source, target, username string, payload interface{}, cause error) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	errMsg := ""
+	if cause != nil {
+		errMsg = cause.Error()
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + DeadLetterTable{}.TableName() + " (source, target, payload, error, retry_count, status, username, created_at)" +
+			" VALUES (?, ?, ?, ?, 0, ?, ?, ?)",
+		Values: []interface{}{source, target, string(body), errMsg, DEAD_LETTER_STATUS_PENDING, username, time.Now().UTC()},
+	})
+	if res.Error != nil {
+		simplelog.LogErrorAny("DeadLetter", res.Error, "cannot store dead letter of "+source+" "+target)
+		return 0, res.Error
+	}
+	return res.LastInsertID, nil
+}
+
+// ListDeadLetters returns the newest dead letters, source and status are optional filters
+func ListDeadLetters(source, status string, limit int) ([]DeadLetterTable, error) {
+	if limit <= 0 {
+		limit = DEAD_LETTER_LIST_LIMIT
+	}
+	condition := orm.Condition{OrderBy: []string{"id DESC"}, Limit: limit}
+	var nested []orm.Condition
+	if source != "" {
+		nested = append(nested, orm.Condition{Field: "source", Operator: "=", Value: source})
+	}
+	if status != "" {
+		nested = append(nested, orm.Condition{Field: "status", Operator: "=", Value: status})
+	}
+	if len(nested) > 0 {
+		condition.Logic = "AND"
+		condition.Nested = nested
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(DeadLetterTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []DeadLetterTable{}, nil
+		}
+		return nil, err
+	}
+	letters := make([]DeadLetterTable, 0, len(records))
+	for _, rec := range records {
+		letters = append(letters, object.MapToStructSlowDB[DeadLetterTable](rec.Data))
+	}
+	return letters, nil
+}
+
+// GetDeadLetter returns the dead letter by id
+func GetDeadLetter(id int) (DeadLetterTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(DeadLetterTable{}.TableName(), &orm.Condition{Field: "id", Operator: "=", Value: id})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return DeadLetterTable{}, ErrDeadLetterNotFound
+		}
+		return DeadLetterTable{}, err
+	}
+	return object.MapToStructSlowDB[DeadLetterTable](rec.Data), nil
+}
+
+// RetryDeadLetter runs the operation again and records the outcome, returns the retry error if any
+func RetryDeadLetter(d DeadLetterTable) error {
+	err := replayDeadLetter(d)
+	status, errMsg := DEAD_LETTER_STATUS_RESOLVED, d.Error
+	if err != nil {
+		status, errMsg = DEAD_LETTER_STATUS_PENDING, err.Error()
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "UPDATE " + d.TableName() + " SET retry_count = retry_count + 1, status = ?, error = ?, last_retry_at = ? WHERE id = ?",
+		Values: []interface{}{status, errMsg, time.Now().UTC(), d.ID},
+	})
+	if err != nil {
+		return err
+	}
+	return res.Error
+}
+
+func replayDeadLetter(d DeadLetterTable) error {
+	switch d.Source {
+	case DEAD_LETTER_SOURCE_INSERT:
+		var rec orm.DBRecord
+		if err := json.Unmarshal([]byte(d.Payload), &rec); err != nil {
+			return err
+		}
+		return CurrentNode.GetInternalConnection().InsertOneDBRecord(rec, false).Error
+	case DEAD_LETTER_SOURCE_QUEUE:
+		var recs []orm.DBRecord
+		if err := json.Unmarshal([]byte(d.Payload), &recs); err != nil {
+			return err
+		}
+		_, err := CurrentNode.GetInternalConnection().InsertManyDBRecords(recs, false)
+		return err
+	case DEAD_LETTER_SOURCE_WEBHOOK:
+		var w WebhookDelivery
+		if err := json.Unmarshal([]byte(d.Payload), &w); err != nil {
+			return err
+		}
+		return PostWebhook(w.URL, w.Body, DEAD_LETTER_WEBHOOK_TIMEOUT)
+	}
+	return ErrDeadLetterUnknownSource
+}
+
+// PurgeDeadLetters deletes dead letters by status and/or source created before the time (zero means any),
+// returns the number deleted
+func PurgeDeadLetters(source, status string, before time.Time) (int, error) {
+	query := "DELETE FROM " + DeadLetterTable{}.TableName() + " WHERE 1=1"
+	var values []interface{}
+	if source != "" {
+		query += " AND source = ?"
+		values = append(values, source)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		values = append(values, status)
+	}
+	if !before.IsZero() {
+		query += " AND created_at < ?"
+		values = append(values, before.UTC())
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: values})
+	return res.RowsAffected, res.Error
+}
+
+// DeleteDeadLetter removes one dead letter
+func DeleteDeadLetter(id int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + DeadLetterTable{}.TableName() + " WHERE id = ?",
+		Values: []interface{}{id},
+	})
+	return res.Error
+}
@@ -0,0 +1,28 @@
+package suresql
+
+import (
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Deletes without SQL: /db/api/delete removes the rows of a table matching an orm.Condition, rendered by
+// the query builder like /db/api/update. A condition that filters nothing (no field, or nested ones that
+// are all empty) would empty the table, that needs allow_full_delete.
+
+var ErrDeleteNoCondition = medaerror.MedaError{Message: "delete without a condition removes every row, set allow_full_delete to do that"}
+
+// BuildDeleteRequest checks the request and renders its statement in the dialect of the node
+func BuildDeleteRequest(req DeleteRequest) (orm.ParametereizedSQL, error) {
+	if err := ValidateTableName(req.Table, false); err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	paramSQL, err := BuildDelete(CurrentDialect(), req.Table, req.Condition)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	if !req.AllowFullDelete && !conditionFilters(req.Condition) {
+		return orm.ParametereizedSQL{}, ErrDeleteNoCondition
+	}
+	return paramSQL, nil
+}
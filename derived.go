@@ -0,0 +1,369 @@
+package suresql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Derived tables: an aggregate of a source table (ie: daily_totals from orders) that SureSQL keeps up to
+// date. The source must be covered by CDC, the rule engine loop reads its changes and recomputes only the
+// groups those changes touched: the group key of the old and new row is evaluated by the DB, then the
+// rows of that group are deleted from the derived table and re-aggregated from the source.
+//
+//	group_by:   date(created_at) AS day, region
+//	aggregates: SUM(total) AS total, COUNT(*) AS orders
+//
+// Expressions are SQL (set by the admin, like report queries), every one needs an alias except plain columns.
+
+var (
+	ErrDerivedTableNotFound = medaerror.MedaError{Message: "derived table not found"}
+
+	// expression [AS alias], alias must be the last word
+	aliasRegex = regexp.MustCompile(`(?is)^(.+?)\s+AS\s+([a-zA-Z_][a-zA-Z0-9_]*)$`)
+)
+
+// DerivedTable is the definition of a derived table
+type DerivedTable struct {
+	ID            int       `json:"id,omitempty"              db:"id"`
+	Name          string    `json:"name"                      db:"name"` // the derived table
+	SourceTable   string    `json:"source_table"              db:"source_table"`
+	GroupBy       string    `json:"group_by"                  db:"group_by"`
+	Aggregates    string    `json:"aggregates"                db:"aggregates"`
+	LastChangeID  int       `json:"last_change_id,omitempty"  db:"last_change_id"`
+	LastRefreshAt time.Time `json:"last_refresh_at,omitempty" db:"last_refresh_at"`
+	LastError     string    `json:"last_error,omitempty"      db:"last_error"`
+	UpdatedAt     time.Time `json:"updated_at,omitempty"      db:"updated_at"`
+}
+
+func (d DerivedTable) TableName() string {
+	return "_derived_tables"
+}
+
+type derivedColumn struct {
+	expr  string
+	alias string
+}
+
+// Validate checks the definition before it is saved
+func (d DerivedTable) Validate() error {
+	if err := ValidateTableName(d.Name, false); err != nil {
+		return err
+	}
+	if d.Name == d.SourceTable {
+		return medaerror.NewString("derived table cannot be its own source")
+	}
+	if _, err := GetCDCTable(d.SourceTable); err != nil {
+		return err
+	}
+	if _, _, err := d.columns(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// columns parses group_by and aggregates
+func (d DerivedTable) columns() (keys, aggs []derivedColumn, err error) {
+	if keys, err = parseDerivedColumns(d.GroupBy, true); err != nil {
+		return nil, nil, err
+	}
+	if aggs, err = parseDerivedColumns(d.Aggregates, false); err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 || len(aggs) == 0 {
+		return nil, nil, medaerror.NewString("group_by and aggregates are required")
+	}
+	seen := map[string]bool{}
+	for _, c := range append(append([]derivedColumn{}, keys...), aggs...) {
+		if seen[strings.ToLower(c.alias)] {
+			return nil, nil, medaerror.Errorf("duplicate column %s", c.alias)
+		}
+		seen[strings.ToLower(c.alias)] = true
+	}
+	return keys, aggs, nil
+}
+
+// parseDerivedColumns splits on top level commas, plain columns are allowed without alias only for keys
+func parseDerivedColumns(s string, plainAllowed bool) ([]derivedColumn, error) {
+	if strings.ContainsAny(s, ";") || strings.Contains(s, "--") || strings.Contains(s, "/*") {
+		return nil, medaerror.NewString("expressions cannot contain ; or comments")
+	}
+	var cols []derivedColumn
+	depth, start := 0, 0
+	parts := []string{}
+	for i, ch := range s {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, medaerror.NewString("unbalanced parentheses")
+	}
+	parts = append(parts, s[start:])
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if m := aliasRegex.FindStringSubmatch(p); m != nil {
+			cols = append(cols, derivedColumn{expr: strings.TrimSpace(m[1]), alias: m[2]})
+			continue
+		}
+		if plainAllowed && ValidateIdentifier(p) == nil && !strings.Contains(p, ".") {
+			cols = append(cols, derivedColumn{expr: p, alias: p})
+			continue
+		}
+		return nil, medaerror.Errorf("%q needs an alias: expression AS name", p)
+	}
+	return cols, nil
+}
+
+// derivedSelect renders the aggregate select of the source, where is empty or a WHERE clause
+func derivedSelect(d DerivedTable, keys, aggs []derivedColumn, where string) string {
+	exprs := make([]string, 0, len(keys)+len(aggs))
+	group := make([]string, len(keys))
+	for i, k := range keys {
+		exprs = append(exprs, k.expr+" AS "+k.alias)
+		group[i] = k.expr
+	}
+	for _, a := range aggs {
+		exprs = append(exprs, a.expr+" AS "+a.alias)
+	}
+	return "SELECT " + strings.Join(exprs, ", ") + " FROM " + d.SourceTable + " " + where + " GROUP BY " + strings.Join(group, ", ")
+}
+
+func derivedColumnList(keys, aggs []derivedColumn) string {
+	names := make([]string, 0, len(keys)+len(aggs))
+	for _, c := range append(append([]derivedColumn{}, keys...), aggs...) {
+		names = append(names, c.alias)
+	}
+	return strings.Join(names, ", ")
+}
+
+// ListDerivedTables returns all derived table definitions
+func ListDerivedTables() ([]DerivedTable, error) {
+	condition := orm.Condition{OrderBy: []string{"id ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(DerivedTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []DerivedTable{}, nil
+		}
+		return nil, err
+	}
+	tables := make([]DerivedTable, 0, len(records))
+	for _, rec := range records {
+		tables = append(tables, object.MapToStructSlowDB[DerivedTable](rec.Data))
+	}
+	return tables, nil
+}
+
+// GetDerivedTable returns the definition by name
+func GetDerivedTable(name string) (DerivedTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(DerivedTable{}.TableName(), &orm.Condition{Field: "name", Operator: "=", Value: name})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return DerivedTable{}, ErrDerivedTableNotFound
+		}
+		return DerivedTable{}, err
+	}
+	return object.MapToStructSlowDB[DerivedTable](rec.Data), nil
+}
+
+// SaveDerivedTable creates or replaces the definition and rebuilds the derived table
+func SaveDerivedTable(d DerivedTable) (DerivedTable, error) {
+	if err := d.Validate(); err != nil {
+		return d, err
+	}
+	d.UpdatedAt = time.Now().UTC()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + d.TableName() + " (name, source_table, group_by, aggregates, updated_at) VALUES (?, ?, ?, ?, ?)" +
+			" ON CONFLICT(name) DO UPDATE SET source_table=excluded.source_table, group_by=excluded.group_by," +
+			" aggregates=excluded.aggregates, updated_at=excluded.updated_at",
+		Values: []interface{}{d.Name, d.SourceTable, d.GroupBy, d.Aggregates, d.UpdatedAt},
+	})
+	if res.Error != nil {
+		return d, res.Error
+	}
+	return RebuildDerivedTable(d)
+}
+
+// DeleteDerivedTable removes the definition, the derived table itself is kept
+func DeleteDerivedTable(name string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + DerivedTable{}.TableName() + " WHERE name = ?",
+		Values: []interface{}{name},
+	})
+	return res.Error
+}
+
+// RebuildDerivedTable recomputes the whole derived table (creating it if needed). Changes logged while it
+// runs are applied again by the next refresh, recomputing a group is idempotent.
+func RebuildDerivedTable(d DerivedTable) (DerivedTable, error) {
+	keys, aggs, err := d.columns()
+	if err != nil {
+		return d, err
+	}
+	last, err := lastCDCChangeID()
+	if err != nil {
+		return d, err
+	}
+	_, err = CurrentNode.GetInternalConnection().ExecManySQL([]string{
+		"CREATE TABLE IF NOT EXISTS " + d.Name + " AS " + derivedSelect(d, keys, aggs, "WHERE 1=0"),
+		"DELETE FROM " + d.Name,
+		"INSERT INTO " + d.Name + " (" + derivedColumnList(keys, aggs) + ") " + derivedSelect(d, keys, aggs, ""),
+	})
+	ResultCache.InvalidateTables(d.Name)
+	d.LastChangeID = last
+	d.recordRefresh(err)
+	return d, err
+}
+
+// RefreshDerivedTable applies the pending source changes, recomputing only the affected groups
+func RefreshDerivedTable(d DerivedTable) error {
+	keys, aggs, err := d.columns()
+	if err != nil {
+		return err
+	}
+	cfg, err := GetCDCTable(d.SourceTable)
+	if err != nil {
+		return err
+	}
+	changes, err := changesAfter(d.SourceTable, d.LastChangeID, RULES_BATCH_SIZE)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	var rows []map[string]interface{}
+	for _, ch := range changes {
+		oldRow, newRow, err := ch.decode()
+		if err != nil {
+			return err
+		}
+		if oldRow != nil {
+			rows = append(rows, oldRow)
+		}
+		if newRow != nil {
+			rows = append(rows, newRow)
+		}
+	}
+	groups, err := derivedGroupKeys(keys, splitList(cfg.Columns), rows)
+	if err != nil {
+		d.recordRefresh(err)
+		return err
+	}
+
+	defer ResultCache.InvalidateTables(d.Name)
+	for _, g := range groups {
+		deleteWhere := make([]string, len(keys))
+		sourceWhere := make([]string, len(keys))
+		for i, k := range keys {
+			// IS is the null safe equality in SQLite
+			deleteWhere[i] = k.alias + " IS ?"
+			sourceWhere[i] = "(" + k.expr + ") IS ?"
+		}
+		_, err = CurrentNode.GetInternalConnection().ExecManySQLParameterized([]orm.ParametereizedSQL{
+			{Query: "DELETE FROM " + d.Name + " WHERE " + strings.Join(deleteWhere, " AND "), Values: g},
+			{Query: "INSERT INTO " + d.Name + " (" + derivedColumnList(keys, aggs) + ") " + derivedSelect(d, keys, aggs, "WHERE "+strings.Join(sourceWhere, " AND ")), Values: g},
+		})
+		if err != nil {
+			d.recordRefresh(err)
+			return err
+		}
+	}
+	d.LastChangeID = changes[len(changes)-1].ID
+	d.recordRefresh(nil)
+	return nil
+}
+
+// derivedGroupKeys lets the DB evaluate the group expressions on the changed rows, returns distinct keys
+func derivedGroupKeys(keys []derivedColumn, columns []string, rows []map[string]interface{}) ([][]interface{}, error) {
+	exprs := make([]string, len(keys))
+	for i, k := range keys {
+		exprs[i] = k.expr + " AS " + k.alias
+	}
+	// keep a query under the SQLite parameter limit
+	perQuery := 500 / len(columns)
+	if perQuery < 1 {
+		perQuery = 1
+	}
+	seen := map[string]bool{}
+	var groups [][]interface{}
+	for start := 0; start < len(rows); start += perQuery {
+		end := start + perQuery
+		if end > len(rows) {
+			end = len(rows)
+		}
+		selects := make([]string, 0, end-start)
+		var values []interface{}
+		for _, row := range rows[start:end] {
+			cols := make([]string, len(columns))
+			for i, c := range columns {
+				cols[i] = "? AS " + c
+				values = append(values, row[c])
+			}
+			selects = append(selects, "SELECT "+strings.Join(cols, ", "))
+		}
+		records, err := CurrentNode.GetInternalConnection().SelectOneSQLParameterized(orm.ParametereizedSQL{
+			Query:  "SELECT DISTINCT " + strings.Join(exprs, ", ") + " FROM (" + strings.Join(selects, " UNION ALL ") + ")",
+			Values: values,
+		})
+		if err != nil && !IsNoRowsError(err) {
+			return nil, err
+		}
+		for _, rec := range records {
+			g := make([]interface{}, len(keys))
+			for i, k := range keys {
+				g[i] = rec.Data[k.alias]
+			}
+			id := fmt.Sprintf("%#v", g)
+			if !seen[id] {
+				seen[id] = true
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (d DerivedTable) recordRefresh(err error) {
+	lastErr := ""
+	if err != nil {
+		lastErr = err.Error()
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "UPDATE " + d.TableName() + " SET last_change_id = ?, last_refresh_at = ?, last_error = ? WHERE name = ?",
+		Values: []interface{}{d.LastChangeID, time.Now().UTC(), lastErr, d.Name},
+	})
+	if res.Error != nil {
+		simplelog.LogErrorAny("DerivedTable", res.Error, "cannot record refresh of "+d.Name)
+	}
+}
+
+// RefreshAllDerivedTables refreshes every derived table, called by the rule engine loop
+func RefreshAllDerivedTables() {
+	tables, err := ListDerivedTables()
+	if err != nil {
+		simplelog.LogErrorAny("DerivedTable", err, "cannot list derived tables")
+		return
+	}
+	for _, d := range tables {
+		if err := RefreshDerivedTable(d); err != nil {
+			simplelog.LogErrorAny("DerivedTable", err, "cannot refresh "+d.Name)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package suresql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Disk usage projection: every node samples the size of its DBMS (DirSize, or DBSize when the DBMS has
+// no data directory of its own) every disk/sample_min into _disk_usage. The growth per day is the least
+// squares slope of the samples of the last disk/window_hours, with disk/capacity_mb it gives the days
+// until the disk is full. Below disk/warn_days a warning alert is raised, below disk/critical_days (or
+// when the capacity is reached) a critical one, so there is time to act before writes start failing.
+
+const (
+	DISK_DEFAULT_SAMPLE_MIN    = 15
+	DISK_DEFAULT_WINDOW_HOURS  = 72
+	DISK_DEFAULT_WARN_DAYS     = 14
+	DISK_DEFAULT_CRITICAL_DAYS = 3
+	DISK_DEFAULT_HISTORY_DAYS  = 30
+	DISK_MIN_SAMPLES           = 3         // fewer samples give no growth rate
+	DISK_MIN_SPAN              = time.Hour // nor do samples closer together than this
+	DISK_ALERT_REPEAT          = 24 * time.Hour
+)
+
+// Disk usage levels
+const (
+	DISK_LEVEL_OK       = "ok"
+	DISK_LEVEL_WARNING  = "warning"
+	DISK_LEVEL_CRITICAL = "critical"
+)
+
+// DiskUsageTable is one size sample of a node
+type DiskUsageTable struct {
+	ID         int       `json:"id,omitempty"   db:"id"`
+	NodeNumber int       `json:"node_number"    db:"node_number"`
+	DirSize    int64     `json:"dir_size"       db:"dir_size"`
+	DBSize     int64     `json:"db_size"        db:"db_size"`
+	SampledAt  time.Time `json:"sampled_at"     db:"sampled_at"`
+}
+
+func (DiskUsageTable) TableName() string {
+	return "_disk_usage"
+}
+
+// Used is the size that grows towards the capacity
+func (d DiskUsageTable) Used() int64 {
+	if d.DirSize > 0 {
+		return d.DirSize
+	}
+	return d.DBSize
+}
+
+// DiskUsage is the last projection of this node, in /monitoring/disk and the metrics
+type DiskUsage struct {
+	Level           string    `json:"level"`
+	UsedBytes       int64     `json:"used_bytes"`
+	DirSize         int64     `json:"dir_size"`
+	DBSize          int64     `json:"db_size"`
+	CapacityBytes   int64     `json:"capacity_bytes,omitempty"` // 0 is not configured, nothing is projected
+	UsedPct         float64   `json:"used_pct,omitempty"`
+	GrowthPerDay    float64   `json:"growth_bytes_per_day"`      // negative when shrinking
+	DaysUntilFull   *float64  `json:"days_until_full,omitempty"` // nil without capacity or growth
+	ProjectedFullAt time.Time `json:"projected_full_at,omitempty"`
+	Samples         int       `json:"samples"` // in the window
+	WindowHours     int       `json:"window_hours"`
+	WarnDays        int       `json:"warn_days"`
+	CriticalDays    int       `json:"critical_days"`
+	MeasuredAt      time.Time `json:"measured_at"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// diskSetting reads an int setting of the disk category, def when not set
+func diskSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_DISK, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// ProjectDiskUsage fits a line through the samples (oldest first) and projects when it reaches the
+// capacity, the level is left to the caller
+func ProjectDiskUsage(samples []DiskUsageTable, capacity int64) DiskUsage {
+	usage := DiskUsage{CapacityBytes: capacity, Samples: len(samples)}
+	if len(samples) == 0 {
+		return usage
+	}
+	last := samples[len(samples)-1]
+	usage.UsedBytes, usage.DirSize, usage.DBSize = last.Used(), last.DirSize, last.DBSize
+	if capacity > 0 {
+		usage.UsedPct = float64(usage.UsedBytes) / float64(capacity) * 100
+	}
+	first := samples[0]
+	if len(samples) < DISK_MIN_SAMPLES || last.SampledAt.Sub(first.SampledAt) < DISK_MIN_SPAN {
+		return usage
+	}
+
+	// least squares slope in bytes per day, x in days since the first sample
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(samples))
+	for _, s := range samples {
+		x := s.SampledAt.Sub(first.SampledAt).Hours() / 24
+		y := float64(s.Used())
+		sumX, sumY, sumXY, sumXX = sumX+x, sumY+y, sumXY+x*y, sumXX+x*x
+	}
+	if d := n*sumXX - sumX*sumX; d != 0 {
+		usage.GrowthPerDay = (n*sumXY - sumX*sumY) / d
+	}
+
+	if capacity <= 0 {
+		return usage
+	}
+	days := 0.0
+	if usage.UsedBytes < capacity {
+		if usage.GrowthPerDay <= 0 {
+			return usage
+		}
+		days = float64(capacity-usage.UsedBytes) / usage.GrowthPerDay
+	}
+	days = math.Round(days*10) / 10
+	usage.DaysUntilFull = &days
+	usage.ProjectedFullAt = last.SampledAt.Add(time.Duration(days * 24 * float64(time.Hour))).Truncate(time.Minute)
+	return usage
+}
+
+// diskLevel is critical when full or about to be, warning ahead of that
+func diskLevel(usage DiskUsage) string {
+	switch {
+	case usage.CapacityBytes > 0 && usage.UsedBytes >= usage.CapacityBytes:
+		return DISK_LEVEL_CRITICAL
+	case usage.DaysUntilFull == nil:
+		return DISK_LEVEL_OK
+	case *usage.DaysUntilFull <= float64(usage.CriticalDays):
+		return DISK_LEVEL_CRITICAL
+	case *usage.DaysUntilFull <= float64(usage.WarnDays):
+		return DISK_LEVEL_WARNING
+	}
+	return DISK_LEVEL_OK
+}
+
+// ListDiskUsage returns the samples of a node since the time, oldest first
+func ListDiskUsage(node int, since time.Time) ([]DiskUsageTable, error) {
+	condition := orm.Condition{
+		Logic: "AND",
+		Nested: []orm.Condition{
+			{Field: "node_number", Operator: "=", Value: node},
+			{Field: "sampled_at", Operator: ">=", Value: since.UTC()},
+		},
+		OrderBy: []string{"sampled_at ASC"},
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(DiskUsageTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []DiskUsageTable{}, nil
+		}
+		return nil, err
+	}
+	samples := make([]DiskUsageTable, 0, len(records))
+	for _, rec := range records {
+		samples = append(samples, object.MapToStructSlowDB[DiskUsageTable](rec.Data))
+	}
+	return samples, nil
+}
+
+// DiskUsageMonitor samples the size of this node and keeps the projection
+type DiskUsageMonitor struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+
+	usageMu     sync.RWMutex
+	usage       DiskUsage
+	lastAlertAt time.Time
+}
+
+var (
+	DiskMonitor     *DiskUsageMonitor
+	diskMonitorOnce sync.Once
+)
+
+// InitDiskUsageMonitor initializes the global disk usage monitor
+func InitDiskUsageMonitor() {
+	diskMonitorOnce.Do(func() {
+		DiskMonitor = &DiskUsageMonitor{stopChan: make(chan struct{})}
+	})
+}
+
+// StartDiskUsageMonitor starts sampling the disk usage
+func StartDiskUsageMonitor(ctx context.Context) {
+	if DiskMonitor == nil {
+		InitDiskUsageMonitor()
+	}
+	DiskMonitor.Start(ctx)
+}
+
+// StopDiskUsageMonitor stops sampling the disk usage
+func StopDiskUsageMonitor() {
+	if DiskMonitor != nil {
+		DiskMonitor.Stop()
+	}
+}
+
+// CurrentDiskUsage returns the last projection, nil before the first sample
+func CurrentDiskUsage() *DiskUsage {
+	if DiskMonitor == nil {
+		return nil
+	}
+	DiskMonitor.usageMu.RLock()
+	defer DiskMonitor.usageMu.RUnlock()
+	if DiskMonitor.usage.MeasuredAt.IsZero() {
+		return nil
+	}
+	usage := DiskMonitor.usage
+	return &usage
+}
+
+// Start samples now and then every sample_min, it does nothing when sample_min is 0
+func (m *DiskUsageMonitor) Start(ctx context.Context) {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return
+	}
+	minutes := diskSetting(SETTING_KEY_DISK_SAMPLE_MIN, DISK_DEFAULT_SAMPLE_MIN)
+	if minutes <= 0 {
+		m.mu.Unlock()
+		return
+	}
+	m.running = true
+	m.ticker = CurrentClock.NewTicker(time.Duration(minutes) * time.Minute)
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		simplelog.LogFormat("DiskUsage: sampling every %d minutes", minutes)
+		m.Check()
+		for {
+			select {
+			case <-m.ticker.C():
+				m.Check()
+			case <-m.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the monitor
+func (m *DiskUsageMonitor) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+	m.ticker.Stop()
+	close(m.stopChan)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// Check samples the sizes, projects the window and prunes the old samples of this node
+func (m *DiskUsageMonitor) Check() {
+	now := CurrentClock.Now().UTC()
+	usage := DiskUsage{MeasuredAt: now}
+	if err := sampleDiskUsage(now); err != nil {
+		usage.Error = "sample: " + err.Error()
+		m.store(usage)
+		return
+	}
+	window := diskSetting(SETTING_KEY_DISK_WINDOW_HOURS, DISK_DEFAULT_WINDOW_HOURS)
+	samples, err := ListDiskUsage(CurrentNode.Config.NodeNumber, now.Add(-time.Duration(window)*time.Hour))
+	if err != nil {
+		usage.Error = "samples: " + err.Error()
+		m.store(usage)
+		return
+	}
+	usage = ProjectDiskUsage(samples, int64(diskSetting(SETTING_KEY_DISK_CAPACITY_MB, 0))*1024*1024)
+	usage.MeasuredAt, usage.WindowHours = now, window
+	m.store(usage)
+
+	history := diskSetting(SETTING_KEY_DISK_HISTORY_DAYS, DISK_DEFAULT_HISTORY_DAYS)
+	if err := pruneDiskUsage(now.AddDate(0, 0, -history)); err != nil {
+		simplelog.LogErrorAny("DiskUsage", err, "cannot prune disk usage samples")
+	}
+}
+
+// sampleDiskUsage reads the sizes from the DBMS status and keeps them
+func sampleDiskUsage(now time.Time) error {
+	status, err := GetStatusInternal(CurrentNode.GetInternalConnection(), NODE_MODE)
+	if err != nil {
+		return err
+	}
+	return CurrentNode.GetInternalConnection().InsertOneDBRecord(orm.DBRecord{
+		TableName: DiskUsageTable{}.TableName(),
+		Data: map[string]interface{}{
+			"node_number": CurrentNode.Config.NodeNumber,
+			"dir_size":    status.DirSize,
+			"db_size":     status.DBSize,
+			"sampled_at":  now,
+		},
+	}, false).Error
+}
+
+func pruneDiskUsage(before time.Time) error {
+	qb := NewQueryBuilder(CurrentDialect())
+	query := "DELETE FROM " + DiskUsageTable{}.TableName() + " WHERE node_number = " + qb.Arg(CurrentNode.Config.NodeNumber) + " AND sampled_at < " + qb.Arg(before)
+	return CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: qb.Args()}).Error
+}
+
+// store keeps the projection, the alerts are raised when the level changes and again every
+// DISK_ALERT_REPEAT while it is not ok
+func (m *DiskUsageMonitor) store(usage DiskUsage) {
+	usage.WarnDays = diskSetting(SETTING_KEY_DISK_WARN_DAYS, DISK_DEFAULT_WARN_DAYS)
+	usage.CriticalDays = diskSetting(SETTING_KEY_DISK_CRITICAL_DAYS, DISK_DEFAULT_CRITICAL_DAYS)
+	m.usageMu.Lock()
+	prev := m.usage
+	if usage.Error != "" {
+		// keep the last projection, a failed sample says nothing about the disk
+		usage.Level, usage.UsedBytes, usage.DirSize, usage.DBSize = prev.Level, prev.UsedBytes, prev.DirSize, prev.DBSize
+		usage.CapacityBytes, usage.UsedPct, usage.GrowthPerDay = prev.CapacityBytes, prev.UsedPct, prev.GrowthPerDay
+		usage.DaysUntilFull, usage.ProjectedFullAt, usage.Samples = prev.DaysUntilFull, prev.ProjectedFullAt, prev.Samples
+		usage.WindowHours = prev.WindowHours
+	} else {
+		usage.Level = diskLevel(usage)
+	}
+	if usage.Level == "" {
+		usage.Level = DISK_LEVEL_OK
+	}
+	if prev.Level == "" {
+		prev.Level = DISK_LEVEL_OK
+	}
+	alert := prev.Level != usage.Level || (usage.Level != DISK_LEVEL_OK && usage.MeasuredAt.Sub(m.lastAlertAt) >= DISK_ALERT_REPEAT)
+	if alert {
+		m.lastAlertAt = usage.MeasuredAt
+	}
+	m.usage = usage
+	m.usageMu.Unlock()
+
+	if usage.Error != "" {
+		simplelog.LogFormat("DiskUsage: %s", usage.Error)
+	}
+	if !alert {
+		return
+	}
+	simplelog.LogFormat("DiskUsage: %s -> %s, %d bytes used, %.0f bytes/day", prev.Level, usage.Level, usage.UsedBytes, usage.GrowthPerDay)
+	if AlertMgr == nil {
+		return
+	}
+	metadata := map[string]interface{}{
+		"node_number":          CurrentNode.Config.NodeNumber,
+		"used_bytes":           usage.UsedBytes,
+		"capacity_bytes":       usage.CapacityBytes,
+		"growth_bytes_per_day": usage.GrowthPerDay,
+	}
+	full := "the capacity is reached"
+	if usage.DaysUntilFull != nil {
+		metadata["days_until_full"] = *usage.DaysUntilFull
+		if *usage.DaysUntilFull > 0 {
+			full = fmt.Sprintf("full in %.1f days (%s)", *usage.DaysUntilFull, usage.ProjectedFullAt.Format(time.RFC3339))
+		}
+	}
+	switch usage.Level {
+	case DISK_LEVEL_CRITICAL:
+		AlertMgr.CreateAlert(AlertLevelCritical,
+			"Disk Space Critical",
+			fmt.Sprintf("Node %d uses %.1f%% of %d MB, %s. Free space or grow the disk now!",
+				CurrentNode.Config.NodeNumber, usage.UsedPct, usage.CapacityBytes/1024/1024, full),
+			metadata,
+		)
+	case DISK_LEVEL_WARNING:
+		AlertMgr.CreateAlert(AlertLevelWarning,
+			"Disk Space Running Out",
+			fmt.Sprintf("Node %d uses %.1f%% of %d MB, growing %.1f MB/day, %s.",
+				CurrentNode.Config.NodeNumber, usage.UsedPct, usage.CapacityBytes/1024/1024, usage.GrowthPerDay/1024/1024, full),
+			metadata,
+		)
+	default:
+		AlertMgr.CreateAlert(AlertLevelInfo,
+			"Disk Space Recovered",
+			fmt.Sprintf("Node %d uses %.1f%% of %d MB, no longer projected to fill up within %d days.",
+				CurrentNode.Config.NodeNumber, usage.UsedPct, usage.CapacityBytes/1024/1024, usage.WarnDays),
+			metadata,
+		)
+	}
+}
@@ -0,0 +1,111 @@
+package suresql
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// DuckDB for analytics through SQLDatabase with the github.com/marcboeker/go-duckdb driver (cgo),
+// compiled into app/suresql with -tags duckdb. DuckDB has no server, it runs embedded in the node on
+// the file DBMS_DATABASE (in memory when empty), DBMS_HOST and the credentials are not used. A file
+// can be open read-write by one process only: in a cluster every node has its own file, or they all
+// open a shared one with DBMS_OPTIONS=access_mode=READ_ONLY. Data files are read in the statements
+// themselves, ie: SELECT * FROM read_parquet('/data/events/*.parquet').
+
+const DUCKDB_SCHEMA_TABLE = "information_schema.tables"
+
+var DuckDBFlavor = SQLFlavor{
+	Name:     "duckdb",
+	Driver:   "duckdb",
+	BuildTag: "duckdb",
+	Schema:   duckdbSchema,
+	Status:   duckdbStatus,
+}
+
+// newDuckDBDatabase opens the embedded DuckDB database
+func newDuckDBDatabase(conf SureSQLDBMSConfig) (SureSQLDB, error) {
+	flavor := DuckDBFlavor
+	flavor.QueryTime = conf.HttpTimeout
+	path := conf.Database
+	if path == "" {
+		path = ":memory:"
+	}
+
+	db, err := OpenSQLDatabase(flavor, duckdbDSN(conf), path)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// duckdbDSN is the file path with the options as query (ie: access_mode=READ_ONLY&threads=4)
+func duckdbDSN(conf SureSQLDBMSConfig) string {
+	dsn := conf.Database
+	if options := strings.TrimPrefix(conf.Options, "?"); options != "" {
+		if _, err := url.ParseQuery(options); err == nil {
+			dsn += "?" + options
+		}
+	}
+	return dsn
+}
+
+// duckdbSchema lists the tables, views and indexes of the main schema
+func duckdbSchema(db *sql.DB, hideSQL, hideSureSQL bool) []orm.SchemaStruct {
+	schemas := []orm.SchemaStruct{}
+	rows, err := db.Query("SELECT CASE WHEN table_type = 'VIEW' THEN 'view' ELSE 'table' END, table_name FROM information_schema.tables" +
+		" WHERE table_schema = current_schema() ORDER BY table_type, table_name")
+	if err != nil {
+		return schemas
+	}
+	for rows.Next() {
+		var s orm.SchemaStruct
+		if rows.Scan(&s.ObjectType, &s.ObjectName) != nil || (hideSureSQL && strings.HasPrefix(s.ObjectName, "_")) {
+			continue
+		}
+		s.TableName = s.ObjectName
+		schemas = append(schemas, s)
+	}
+	rows.Close()
+
+	if !hideSQL {
+		for i, s := range schemas {
+			var create sql.NullString
+			if db.QueryRow("SELECT sql FROM duckdb_tables() WHERE table_name = ? UNION ALL SELECT sql FROM duckdb_views() WHERE view_name = ?", s.TableName, s.TableName).Scan(&create) == nil {
+				schemas[i].SQLCommand = create.String
+			}
+		}
+	}
+
+	rows, err = db.Query("SELECT index_name, table_name, COALESCE(sql, '') FROM duckdb_indexes() WHERE schema_name = current_schema() ORDER BY table_name, index_name")
+	if err != nil {
+		return schemas
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := orm.SchemaStruct{ObjectType: "index"}
+		if rows.Scan(&s.ObjectName, &s.TableName, &s.SQLCommand) != nil || (hideSureSQL && strings.HasPrefix(s.TableName, "_")) {
+			continue
+		}
+		if hideSQL {
+			s.SQLCommand = ""
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas
+}
+
+// duckdbStatus reads the version and the size of the database file
+func duckdbStatus(db *sql.DB) (orm.StatusStruct, error) {
+	status := orm.StatusStruct{DBMS: "duckdb"}
+	if err := db.QueryRow("SELECT version()").Scan(&status.Version); err != nil {
+		return status, err
+	}
+	var blocks, blockSize sql.NullInt64
+	if db.QueryRow("SELECT total_blocks, block_size FROM pragma_database_size() WHERE database_name = current_database()").Scan(&blocks, &blockSize) == nil {
+		status.DBSize = blocks.Int64 * blockSize.Int64
+	}
+	return status, nil
+}
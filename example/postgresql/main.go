@@ -43,7 +43,7 @@ func main() {
 	}
 
 	simplelog.LogThis("Successfully connected via SureSQL abstraction!")
-	simplelog.LogThis(fmt.Sprintf("Database driver: %s", suresql.CurrentNode.Status.DBMSDriver))
+	simplelog.LogThis(fmt.Sprintf("Database driver: %s", config.DBMS))
 
 	status, err := db.Status()
 	if err != nil {
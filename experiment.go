@@ -0,0 +1,324 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// A/B experiment: experiment/sample_pct percent of the /db/api/querysql requests are run again on an
+// alternate backend (EXPERIMENT_DBMS_* in the environment, same keys as DBMS_*), after the response and
+// off the request path. The latency of both is kept and the rows are compared as a multiset (order,
+// column name case and number types do not count), a difference is a divergence. The alternate can be
+// another DBMS to validate a migration, or the same one with other options or consistency. At most
+// experiment/max_inflight mirrors run at once, a request coming while they are busy is not mirrored.
+
+const (
+	EXPERIMENT_ENV_PREFIX           = "EXPERIMENT_DBMS_"
+	EXPERIMENT_DEFAULT_MAX_INFLIGHT = 4
+	EXPERIMENT_DEFAULT_KEEP         = 100 // divergences kept, the oldest is dropped
+	EXPERIMENT_REOPEN_AFTER         = time.Minute
+)
+
+// ExperimentDivergence is a mirrored statement whose alternate result differs
+type ExperimentDivergence struct {
+	Statement      string    `json:"statement"` // fingerprint, no values
+	Reason         string    `json:"reason"`    // rows, values or error
+	PrimaryRows    int       `json:"primary_rows"`
+	AlternateRows  int       `json:"alternate_rows"`
+	AlternateError string    `json:"alternate_error,omitempty"`
+	PrimaryMs      float64   `json:"primary_ms"`
+	AlternateMs    float64   `json:"alternate_ms"`
+	At             time.Time `json:"at"`
+}
+
+// ExperimentStatus is what the experiment measured since the start or the last reset
+type ExperimentStatus struct {
+	Enabled         bool                   `json:"enabled"`
+	Alternate       string                 `json:"alternate,omitempty"` // DBMS and host of the alternate backend
+	SamplePct       int                    `json:"sample_pct"`
+	Mirrored        int64                  `json:"mirrored"`
+	Skipped         int64                  `json:"skipped"` // sampled but the mirrors were busy
+	Matched         int64                  `json:"matched"`
+	Divergent       int64                  `json:"divergent"`
+	AlternateErrors int64                  `json:"alternate_errors"`
+	DivergenceRate  float64                `json:"divergence_rate"` // divergent / mirrored
+	PrimaryAvgMs    float64                `json:"primary_avg_ms"`
+	AlternateAvgMs  float64                `json:"alternate_avg_ms"`
+	AlternateMaxMs  float64                `json:"alternate_max_ms"`
+	Since           time.Time              `json:"since"`
+	Recent          []ExperimentDivergence `json:"recent"` // newest first
+}
+
+// ExperimentMirror holds the alternate connection and the counters
+type ExperimentMirror struct {
+	mu        sync.Mutex
+	conf      SureSQLDBMSConfig
+	db        SureSQLDB
+	openErrAt time.Time
+	inflight  int
+	status    ExperimentStatus
+	primaryMs float64
+	altMs     float64
+}
+
+var (
+	Experiment     *ExperimentMirror
+	experimentOnce sync.Once
+)
+
+// alternateDBMSConfig reads a DBMS config from the environment keys with the prefix (same keys as
+// DBMS_*), the timeouts are the ones of the primary
+func alternateDBMSConfig(prefix string) SureSQLDBMSConfig {
+	primary := LoadDBMSConfigFromEnvironment()
+	conf := SureSQLDBMSConfig{
+		DBMS:        utils.GetEnvString(prefix+"TYPE", ""),
+		Host:        utils.GetEnvString(prefix+"HOST", ""),
+		Port:        utils.GetEnvString(prefix+"PORT", ""),
+		Username:    utils.GetEnvString(prefix+"USERNAME", ""),
+		Password:    utils.GetEnvString(prefix+"PASSWORD", ""),
+		Database:    utils.GetEnvString(prefix+"DATABASE", ""),
+		SSL:         utils.GetEnvBool(prefix+"SSL", false),
+		Options:     utils.GetEnvString(prefix+"OPTIONS", ""),
+		Consistency: utils.GetEnvString(prefix+"CONSISTENCY", ""),
+		AuthToken:   utils.GetEnvString(prefix+"AUTH_TOKEN", ""),
+	}
+	conf.HttpTimeout, conf.RetryTimeout, conf.MaxRetries = primary.HttpTimeout, primary.RetryTimeout, primary.MaxRetries
+	return conf
+}
+
+// openAlternate opens a backend other than the node's and returns its schema table and driver name,
+// the ones of the node do not change
+func openAlternate(conf SureSQLDBMSConfig) (db SureSQLDB, schemaTable, driver string, err error) {
+	db, err = NewDatabase(conf)
+	schemaTable, driver = backendOf(conf)
+	return db, schemaTable, driver, err
+}
+
+// CurrentExperiment returns the experiment, set up from the environment on first use
+func CurrentExperiment() *ExperimentMirror {
+	experimentOnce.Do(func() {
+		Experiment = &ExperimentMirror{conf: alternateDBMSConfig(EXPERIMENT_ENV_PREFIX)}
+		Experiment.status.Since = time.Now().UTC()
+	})
+	return Experiment
+}
+
+// experimentSetting reads experiment/<key>
+func experimentSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_EXPERIMENT, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// Enabled tells if there is an alternate backend and a sample to send it
+func (e *ExperimentMirror) Enabled() bool {
+	return e.conf.DBMS != "" && experimentSetting(SETTING_KEY_EXPERIMENT_SAMPLE_PCT, 0) > 0
+}
+
+// alternate opens the alternate connection once, after a failure it is tried again a minute later
+func (e *ExperimentMirror) alternate() (SureSQLDB, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.db != nil {
+		return e.db, nil
+	}
+	if time.Since(e.openErrAt) < EXPERIMENT_REOPEN_AFTER {
+		return nil, medaerror.Errorf("alternate backend %s unavailable, retried after %s", e.conf.DBMS, EXPERIMENT_REOPEN_AFTER)
+	}
+	db, _, _, err := openAlternate(e.conf)
+	if err != nil {
+		e.openErrAt = time.Now()
+		simplelog.LogErrorAny("Experiment", err, "cannot open the alternate backend "+e.conf.DBMS)
+		return nil, err
+	}
+	e.db = db
+	return db, nil
+}
+
+// Mirror runs the read statements again on the alternate backend when the request is sampled, primary
+// are the result sets returned to the client (one per statement) and took the time they took
+func (e *ExperimentMirror) Mirror(statements []orm.ParametereizedSQL, singleRow bool, primary [][]orm.DBRecord, took time.Duration) {
+	pct := experimentSetting(SETTING_KEY_EXPERIMENT_SAMPLE_PCT, 0)
+	if e.conf.DBMS == "" || pct <= 0 || len(statements) == 0 || rand.Intn(100) >= pct {
+		return
+	}
+	if len(primary) == 0 {
+		primary = make([][]orm.DBRecord, len(statements)) // no rows at all
+	}
+	if len(primary) != len(statements) {
+		return
+	}
+	e.mu.Lock()
+	if e.inflight >= experimentSetting(SETTING_KEY_EXPERIMENT_MAX_INFLIGHT, EXPERIMENT_DEFAULT_MAX_INFLIGHT) {
+		e.status.Skipped++
+		e.mu.Unlock()
+		return
+	}
+	e.inflight++
+	e.mu.Unlock()
+
+	go func() {
+		defer func() {
+			e.mu.Lock()
+			e.inflight--
+			e.mu.Unlock()
+		}()
+		primaryMs := float64(took.Microseconds()) / 1000 / float64(len(statements))
+		for i, p := range statements {
+			e.compare(p, singleRow, primary[i], primaryMs)
+		}
+	}()
+}
+
+// compare runs one statement on the alternate and records the outcome
+func (e *ExperimentMirror) compare(p orm.ParametereizedSQL, singleRow bool, primary []orm.DBRecord, primaryMs float64) {
+	d := ExperimentDivergence{Statement: FingerprintSQL(p.Query), PrimaryRows: len(primary), PrimaryMs: primaryMs, At: time.Now().UTC()}
+	var records []orm.DBRecord
+	db, err := e.alternate()
+	if err == nil {
+		start := time.Now()
+		records, err = db.SelectOneSQLParameterized(p)
+		d.AlternateMs = float64(time.Since(start).Microseconds()) / 1000
+		if IsNoRowsError(err) {
+			records, err = nil, nil
+		}
+	}
+	if singleRow && len(records) > 1 {
+		records = records[:1]
+	}
+	d.AlternateRows = len(records)
+	switch {
+	case err != nil:
+		d.Reason, d.AlternateError = "error", err.Error()
+	case len(records) != len(primary):
+		d.Reason = "rows"
+	case !sameRows(primary, records):
+		d.Reason = "values"
+	}
+	e.record(d, err != nil)
+}
+
+func (e *ExperimentMirror) record(d ExperimentDivergence, failed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status.Mirrored++
+	e.primaryMs += d.PrimaryMs
+	if !failed {
+		e.altMs += d.AlternateMs
+		if d.AlternateMs > e.status.AlternateMaxMs {
+			e.status.AlternateMaxMs = d.AlternateMs
+		}
+	} else {
+		e.status.AlternateErrors++
+	}
+	if d.Reason == "" {
+		e.status.Matched++
+		return
+	}
+	e.status.Divergent++
+	keep := experimentSetting(SETTING_KEY_EXPERIMENT_KEEP, EXPERIMENT_DEFAULT_KEEP)
+	e.status.Recent = append([]ExperimentDivergence{d}, e.status.Recent...)
+	if keep >= 0 && len(e.status.Recent) > keep {
+		e.status.Recent = e.status.Recent[:keep]
+	}
+}
+
+// Status returns the counters and the latest divergences
+func (e *ExperimentMirror) Status() ExperimentStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := e.status
+	status.Enabled = e.Enabled()
+	status.SamplePct = experimentSetting(SETTING_KEY_EXPERIMENT_SAMPLE_PCT, 0)
+	if e.conf.DBMS != "" {
+		status.Alternate = strings.ToUpper(e.conf.DBMS) + " " + e.conf.Host
+		if e.conf.Port != "" {
+			status.Alternate += ":" + e.conf.Port
+		}
+	}
+	if status.Mirrored > 0 {
+		status.DivergenceRate = float64(status.Divergent) / float64(status.Mirrored)
+		status.PrimaryAvgMs = e.primaryMs / float64(status.Mirrored)
+	}
+	if ok := status.Mirrored - status.AlternateErrors; ok > 0 {
+		status.AlternateAvgMs = e.altMs / float64(ok)
+	}
+	status.Recent = append([]ExperimentDivergence{}, e.status.Recent...)
+	return status
+}
+
+// Reset clears the counters and the divergences, ie: after a fix on the alternate
+func (e *ExperimentMirror) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status = ExperimentStatus{Since: time.Now().UTC()}
+	e.primaryMs, e.altMs = 0, 0
+}
+
+// sameRows compares the result sets as multisets of normalized rows
+func sameRows(a, b []orm.DBRecord) bool {
+	ka, kb := rowKeys(a), rowKeys(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rowKeys turns every row into a comparable string and sorts them
+func rowKeys(records []orm.DBRecord) []string {
+	keys := make([]string, len(records))
+	for i, rec := range records {
+		row := make(map[string]interface{}, len(rec.Data))
+		for k, v := range rec.Data {
+			row[strings.ToLower(k)] = normalizeValue(v)
+		}
+		b, _ := json.Marshal(row) // map keys are sorted
+		keys[i] = string(b)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalizeValue makes the values of different drivers comparable: numbers as one type, bytes as text,
+// times in UTC
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case bool:
+		if x {
+			return float64(1)
+		}
+		return float64(0)
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case nil, string, float64:
+		return x
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -0,0 +1,931 @@
+package suresql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// A small sandboxed expression language for per-table validation, computed columns and response
+// transformations. Expressions read values (columns of the row, ie: price, or nested: new.price) and
+// return one value, there are no loops, assignments or access to anything outside the given values:
+//
+//	price * quantity
+//	status in ('open', 'paid') and total >= 0
+//	if(discount is null, total, round(total * (1 - discount / 100), 2))
+//	upper(trim(country)) + '-' + string(zip)
+//
+// Operators: or and not (also || && !), = == != <> < <= > >= in, not in, like, is null, is not null,
+// + (numbers, or concatenation when one side is text) - * / %. Functions are listed in exprFunctions.
+
+const (
+	EXPR_MAX_LENGTH   = 4096
+	EXPR_MAX_NODES    = 1000
+	EXPR_MAX_DEPTH    = 64
+	EXPR_MAX_REGEX    = 256
+	EXPR_CACHE_LIMIT  = 1000
+	exprTokenEOF      = 0
+	exprTokenNumber   = 1
+	exprTokenString   = 2
+	exprTokenIdent    = 3
+	exprTokenOperator = 4
+)
+
+var (
+	ErrExpressionSyntax = medaerror.MedaError{Message: "expression syntax error"}
+	ErrExpressionEval   = medaerror.MedaError{Message: "expression evaluation error"}
+
+	exprCache   sync.Map
+	exprCacheN  int
+	exprCacheMu sync.Mutex
+)
+
+// Expression is a compiled expression, safe for concurrent use
+type Expression struct {
+	Source string
+	root   exprNode
+}
+
+// CompileExpression parses the expression, compiled expressions are cached by source
+func CompileExpression(source string) (*Expression, error) {
+	if cached, ok := exprCache.Load(source); ok {
+		return cached.(*Expression), nil
+	}
+	if len(source) > EXPR_MAX_LENGTH {
+		return nil, medaerror.Errorf("%s: longer than %d characters", ErrExpressionSyntax.Message, EXPR_MAX_LENGTH)
+	}
+	tokens, err := exprTokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != exprTokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	expr := &Expression{Source: source, root: root}
+
+	exprCacheMu.Lock()
+	if exprCacheN < EXPR_CACHE_LIMIT {
+		exprCache.Store(source, expr)
+		exprCacheN++
+	}
+	exprCacheMu.Unlock()
+	return expr, nil
+}
+
+// Eval evaluates the expression with the values, ie: a row
+func (e *Expression) Eval(values map[string]interface{}) (interface{}, error) {
+	return e.root.eval(values)
+}
+
+// EvalBool evaluates the expression as a condition
+func (e *Expression) EvalBool(values map[string]interface{}) (bool, error) {
+	v, err := e.root.eval(values)
+	if err != nil {
+		return false, err
+	}
+	return exprTruthy(v), nil
+}
+
+// EvalExpression compiles (cached) and evaluates source
+func EvalExpression(source string, values map[string]interface{}) (interface{}, error) {
+	expr, err := CompileExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Eval(values)
+}
+
+// ---- tokenizer
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func exprTokenize(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenNumber, text: src[start:i], pos: start})
+		case c == '\'' || c == '"':
+			start := i
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(src) {
+				if rune(src[i]) == c {
+					// doubled quote is an escaped quote, like SQL
+					if i+1 < len(src) && rune(src[i+1]) == c {
+						sb.WriteByte(src[i])
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if !closed {
+				return nil, medaerror.Errorf("%s: unterminated string at %d", ErrExpressionSyntax.Message, start)
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenString, text: sb.String(), pos: start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenIdent, text: src[start:i], pos: start})
+		default:
+			start := i
+			two := ""
+			if i+1 < len(src) {
+				two = src[i : i+2]
+			}
+			switch two {
+			case "==", "!=", "<>", "<=", ">=", "&&", "||":
+				tokens = append(tokens, exprToken{kind: exprTokenOperator, text: two, pos: start})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("+-*/%=<>!(),", c) {
+				return nil, medaerror.Errorf("%s: unexpected %q at %d", ErrExpressionSyntax.Message, c, start)
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenOperator, text: string(c), pos: start})
+			i++
+		}
+	}
+	return append(tokens, exprToken{kind: exprTokenEOF, pos: len(src)}), nil
+}
+
+// ---- parser
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	nodes  int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != exprTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the (case-insensitive) word
+func (p *exprParser) keyword(words ...string) bool {
+	for i, w := range words {
+		if p.pos+i >= len(p.tokens) {
+			return false
+		}
+		t := p.tokens[p.pos+i]
+		if t.kind != exprTokenIdent || !strings.EqualFold(t.text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *exprParser) operator(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != exprTokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return medaerror.Errorf("%s: %s at %d", ErrExpressionSyntax.Message, fmt.Sprintf(format, args...), p.peek().pos)
+}
+
+func (p *exprParser) node(n exprNode, depth int) (exprNode, error) {
+	p.nodes++
+	if p.nodes > EXPR_MAX_NODES {
+		return nil, p.errorf("expression too large")
+	}
+	if depth > EXPR_MAX_DEPTH {
+		return nil, p.errorf("expression nested too deep")
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseOr(depth int) (exprNode, error) {
+	left, err := p.parseAnd(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		_, isOp := p.operator("||")
+		if !isOp && !p.keyword("or") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseAnd(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(&exprLogical{and: false, left: left, right: right}, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseAnd(depth int) (exprNode, error) {
+	left, err := p.parseNot(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		_, isOp := p.operator("&&")
+		if !isOp && !p.keyword("and") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(&exprLogical{and: true, left: left, right: right}, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseNot(depth int) (exprNode, error) {
+	_, isOp := p.operator("!")
+	if isOp || p.keyword("not") {
+		p.next()
+		inner, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return p.node(&exprNot{inner: inner}, depth)
+	}
+	return p.parseComparison(depth + 1)
+}
+
+func (p *exprParser) parseComparison(depth int) (exprNode, error) {
+	left, err := p.parseAdditive(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.operator("=", "==", "!=", "<>", "<", "<=", ">", ">="); ok {
+		p.next()
+		right, err := p.parseAdditive(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return p.node(&exprBinary{op: op, left: left, right: right}, depth)
+	}
+	switch {
+	case p.keyword("is", "not", "null"):
+		p.pos += 3
+		return p.node(&exprIsNull{inner: left, not: true}, depth)
+	case p.keyword("is", "null"):
+		p.pos += 2
+		return p.node(&exprIsNull{inner: left}, depth)
+	case p.keyword("not", "in"):
+		p.pos += 2
+		return p.parseIn(left, true, depth)
+	case p.keyword("in"):
+		p.next()
+		return p.parseIn(left, false, depth)
+	case p.keyword("not", "like"):
+		p.pos += 2
+		right, err := p.parseAdditive(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return p.node(&exprNot{inner: &exprBinary{op: "like", left: left, right: right}}, depth)
+	case p.keyword("like"):
+		p.next()
+		right, err := p.parseAdditive(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return p.node(&exprBinary{op: "like", left: left, right: right}, depth)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseIn(left exprNode, not bool, depth int) (exprNode, error) {
+	if _, ok := p.operator("("); !ok {
+		return nil, p.errorf("expected ( after in")
+	}
+	p.next()
+	list, err := p.parseArgs(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	return p.node(&exprIn{value: left, list: list, not: not}, depth)
+}
+
+// parseArgs reads a comma separated list up to the closing parenthesis
+func (p *exprParser) parseArgs(depth int) ([]exprNode, error) {
+	var args []exprNode
+	if _, ok := p.operator(")"); ok {
+		p.next()
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if _, ok := p.operator(","); ok {
+			p.next()
+			continue
+		}
+		if _, ok := p.operator(")"); ok {
+			p.next()
+			return args, nil
+		}
+		return nil, p.errorf("expected , or )")
+	}
+}
+
+func (p *exprParser) parseAdditive(depth int) (exprNode, error) {
+	left, err := p.parseMultiplicative(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.operator("+", "-")
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseMultiplicative(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(&exprBinary{op: op, left: left, right: right}, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseMultiplicative(depth int) (exprNode, error) {
+	left, err := p.parseUnary(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.operator("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(&exprBinary{op: op, left: left, right: right}, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseUnary(depth int) (exprNode, error) {
+	if _, ok := p.operator("-"); ok {
+		p.next()
+		inner, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return p.node(&exprBinary{op: "-", left: &exprLiteral{value: int64(0)}, right: inner}, depth)
+	}
+	return p.parsePrimary(depth + 1)
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case exprTokenNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return p.node(&exprLiteral{value: n}, depth)
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", t.text)
+		}
+		return p.node(&exprLiteral{value: f}, depth)
+	case exprTokenString:
+		return p.node(&exprLiteral{value: t.text}, depth)
+	case exprTokenIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return p.node(&exprLiteral{value: true}, depth)
+		case "false":
+			return p.node(&exprLiteral{value: false}, depth)
+		case "null", "nil":
+			return p.node(&exprLiteral{value: nil}, depth)
+		}
+		if _, ok := p.operator("("); ok {
+			p.next()
+			name := strings.ToLower(t.text)
+			fn, known := exprFunctions[name]
+			if !known {
+				return nil, p.errorf("unknown function %s", t.text)
+			}
+			args, err := p.parseArgs(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) < fn.min || (fn.max >= 0 && len(args) > fn.max) {
+				return nil, p.errorf("wrong number of arguments for %s", name)
+			}
+			return p.node(&exprCall{name: name, fn: fn.fn, args: args}, depth)
+		}
+		return p.node(&exprIdent{path: strings.Split(t.text, ".")}, depth)
+	case exprTokenOperator:
+		if t.text == "(" {
+			inner, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.operator(")"); !ok {
+				return nil, p.errorf("expected )")
+			}
+			p.next()
+			return inner, nil
+		}
+	}
+	if t.kind == exprTokenEOF {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	p.pos-- // next() does not move past EOF, only step back over a real token
+	return nil, p.errorf("unexpected %q", t.text)
+}
+
+// ---- evaluation
+
+type exprNode interface {
+	eval(values map[string]interface{}) (interface{}, error)
+}
+
+type exprLiteral struct{ value interface{} }
+
+func (n *exprLiteral) eval(map[string]interface{}) (interface{}, error) { return n.value, nil }
+
+type exprIdent struct{ path []string }
+
+func (n *exprIdent) eval(values map[string]interface{}) (interface{}, error) {
+	var cur interface{} = values
+	for _, part := range n.path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		cur = m[part]
+	}
+	return cur, nil
+}
+
+type exprLogical struct {
+	and         bool
+	left, right exprNode
+}
+
+func (n *exprLogical) eval(values map[string]interface{}) (interface{}, error) {
+	l, err := n.left.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(l) != n.and {
+		return !n.and, nil
+	}
+	r, err := n.right.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	return exprTruthy(r), nil
+}
+
+type exprNot struct{ inner exprNode }
+
+func (n *exprNot) eval(values map[string]interface{}) (interface{}, error) {
+	v, err := n.inner.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	return !exprTruthy(v), nil
+}
+
+type exprIsNull struct {
+	inner exprNode
+	not   bool
+}
+
+func (n *exprIsNull) eval(values map[string]interface{}) (interface{}, error) {
+	v, err := n.inner.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != n.not, nil
+}
+
+type exprIn struct {
+	value exprNode
+	list  []exprNode
+	not   bool
+}
+
+func (n *exprIn) eval(values map[string]interface{}) (interface{}, error) {
+	v, err := n.value.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range n.list {
+		iv, err := item.eval(values)
+		if err != nil {
+			return nil, err
+		}
+		if exprEqual(v, iv) {
+			return !n.not, nil
+		}
+	}
+	return n.not, nil
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *exprBinary) eval(values map[string]interface{}) (interface{}, error) {
+	l, err := n.left.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "=", "==":
+		return exprEqual(l, r), nil
+	case "!=", "<>":
+		return !exprEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		cmp, ok := CompareValues(l, r)
+		if !ok {
+			return false, nil
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+	case "like":
+		if l == nil || r == nil {
+			return false, nil
+		}
+		return likeMatch(exprString(r), exprString(l)), nil
+	}
+	return exprArithmetic(n.op, l, r)
+}
+
+type exprCall struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []exprNode
+}
+
+func (n *exprCall) eval(values map[string]interface{}) (interface{}, error) {
+	// if() only evaluates the branch it returns
+	if n.name == "if" {
+		cond, err := n.args[0].eval(values)
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(cond) {
+			return n.args[1].eval(values)
+		}
+		return n.args[2].eval(values)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(values)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return n.fn(args)
+}
+
+// ---- values
+
+func exprTruthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	}
+	if f, ok := numericValue(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func exprEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	cmp, ok := CompareValues(a, b)
+	return ok && cmp == 0
+}
+
+func exprString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case time.Time:
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+func exprIsInt(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, bool:
+		return true
+	}
+	return false
+}
+
+// exprNumber returns a float64 result as int64 when both operands were integers
+func exprNumber(f float64, ints bool) interface{} {
+	if ints && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+	return f
+}
+
+func exprArithmetic(op string, l, r interface{}) (interface{}, error) {
+	if l == nil || r == nil {
+		// like SQL, arithmetic with NULL is NULL
+		return nil, nil
+	}
+	fl, lok := numericValue(l)
+	fr, rok := numericValue(r)
+	if op == "+" {
+		_, lstr := l.(string)
+		_, rstr := r.(string)
+		if lstr || rstr {
+			return exprString(l) + exprString(r), nil
+		}
+	}
+	if !lok {
+		fl, lok = numericString(l)
+	}
+	if !rok {
+		fr, rok = numericString(r)
+	}
+	if !lok || !rok {
+		return nil, medaerror.Errorf("%s: %s needs numbers, got %v and %v", ErrExpressionEval.Message, op, l, r)
+	}
+	ints := exprIsInt(l) && exprIsInt(r)
+	switch op {
+	case "+":
+		return exprNumber(fl+fr, ints), nil
+	case "-":
+		return exprNumber(fl-fr, ints), nil
+	case "*":
+		return exprNumber(fl*fr, ints), nil
+	case "/":
+		if fr == 0 {
+			return nil, medaerror.Errorf("%s: division by zero", ErrExpressionEval.Message)
+		}
+		return fl / fr, nil
+	case "%":
+		if fr == 0 {
+			return nil, medaerror.Errorf("%s: division by zero", ErrExpressionEval.Message)
+		}
+		return exprNumber(math.Mod(fl, fr), ints), nil
+	}
+	return nil, medaerror.Errorf("%s: unknown operator %s", ErrExpressionEval.Message, op)
+}
+
+// ---- functions
+
+type exprFunction struct {
+	min, max int // max -1 is any
+	fn       func(args []interface{}) (interface{}, error)
+}
+
+var exprFunctions map[string]exprFunction
+
+func init() {
+	num := func(v interface{}) (float64, bool) {
+		if f, ok := numericValue(v); ok {
+			return f, true
+		}
+		return numericString(v)
+	}
+	str1 := func(f func(string) interface{}) func([]interface{}) (interface{}, error) {
+		return func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			return f(exprString(a[0])), nil
+		}
+	}
+	num1 := func(f func(float64) float64) func([]interface{}) (interface{}, error) {
+		return func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			x, ok := num(a[0])
+			if !ok {
+				return nil, medaerror.Errorf("%s: not a number: %v", ErrExpressionEval.Message, a[0])
+			}
+			return exprNumber(f(x), true), nil
+		}
+	}
+
+	exprFunctions = map[string]exprFunction{
+		"if": {3, 3, nil}, // evaluated lazily in exprCall
+		"len": {1, 1, func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			return int64(len([]rune(exprString(a[0])))), nil
+		}},
+		"upper": {1, 1, str1(func(s string) interface{} { return strings.ToUpper(s) })},
+		"lower": {1, 1, str1(func(s string) interface{} { return strings.ToLower(s) })},
+		"trim":  {1, 1, str1(func(s string) interface{} { return strings.TrimSpace(s) })},
+		"string": {1, 1, func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			return exprString(a[0]), nil
+		}},
+		"number": {1, 1, func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			f, ok := num(a[0])
+			if !ok {
+				return nil, nil
+			}
+			return exprNumber(f, f == math.Trunc(f)), nil
+		}},
+		"abs":   {1, 1, num1(math.Abs)},
+		"floor": {1, 1, num1(math.Floor)},
+		"ceil":  {1, 1, num1(math.Ceil)},
+		"round": {1, 2, func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			x, ok := num(a[0])
+			if !ok {
+				return nil, medaerror.Errorf("%s: not a number: %v", ErrExpressionEval.Message, a[0])
+			}
+			places := 0.0
+			if len(a) == 2 {
+				places, _ = num(a[1])
+			}
+			pow := math.Pow(10, places)
+			r := math.Round(x*pow) / pow
+			return exprNumber(r, places <= 0), nil
+		}},
+		"min": {1, -1, func(a []interface{}) (interface{}, error) { return exprPick(a, -1), nil }},
+		"max": {1, -1, func(a []interface{}) (interface{}, error) { return exprPick(a, 1), nil }},
+		"coalesce": {1, -1, func(a []interface{}) (interface{}, error) {
+			for _, v := range a {
+				if v != nil {
+					return v, nil
+				}
+			}
+			return nil, nil
+		}},
+		"concat": {1, -1, func(a []interface{}) (interface{}, error) {
+			var sb strings.Builder
+			for _, v := range a {
+				sb.WriteString(exprString(v))
+			}
+			return sb.String(), nil
+		}},
+		"substr": {2, 3, func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			runes := []rune(exprString(a[0]))
+			start, _ := num(a[1])
+			from := int(start) - 1 // 1-based like SQL
+			if from < 0 {
+				from = 0
+			}
+			if from > len(runes) {
+				from = len(runes)
+			}
+			to := len(runes)
+			if len(a) == 3 {
+				n, _ := num(a[2])
+				if from+int(n) < to {
+					to = from + int(n)
+				}
+			}
+			if to < from {
+				to = from
+			}
+			return string(runes[from:to]), nil
+		}},
+		"replace": {3, 3, func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return nil, nil
+			}
+			return strings.ReplaceAll(exprString(a[0]), exprString(a[1]), exprString(a[2])), nil
+		}},
+		"contains": {2, 2, func(a []interface{}) (interface{}, error) {
+			return a[0] != nil && strings.Contains(exprString(a[0]), exprString(a[1])), nil
+		}},
+		"starts_with": {2, 2, func(a []interface{}) (interface{}, error) {
+			return a[0] != nil && strings.HasPrefix(exprString(a[0]), exprString(a[1])), nil
+		}},
+		"ends_with": {2, 2, func(a []interface{}) (interface{}, error) {
+			return a[0] != nil && strings.HasSuffix(exprString(a[0]), exprString(a[1])), nil
+		}},
+		"matches": {2, 2, func(a []interface{}) (interface{}, error) {
+			pattern := exprString(a[1])
+			if len(pattern) > EXPR_MAX_REGEX {
+				return nil, medaerror.Errorf("%s: pattern longer than %d", ErrExpressionEval.Message, EXPR_MAX_REGEX)
+			}
+			rx, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, medaerror.Errorf("%s: %v", ErrExpressionEval.Message, err)
+			}
+			return a[0] != nil && rx.MatchString(exprString(a[0])), nil
+		}},
+		"now": {0, 0, func(a []interface{}) (interface{}, error) {
+			return time.Now().UTC().Format(time.RFC3339), nil
+		}},
+	}
+}
+
+// exprPick returns the smallest (dir -1) or largest (dir 1) non-null argument
+func exprPick(args []interface{}, dir int) interface{} {
+	var best interface{}
+	for _, v := range args {
+		if v == nil {
+			continue
+		}
+		if best == nil {
+			best = v
+			continue
+		}
+		if cmp, ok := CompareValues(v, best); ok && cmp*dir > 0 {
+			best = v
+		}
+	}
+	return best
+}
@@ -0,0 +1,136 @@
+package suresql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var exprTestValues = map[string]interface{}{
+	"price":  int64(10),
+	"qty":    2,
+	"rate":   0.5,
+	"name":   " alice ",
+	"status": "paid",
+	"zip":    "12345",
+	"none":   nil,
+	"new":    map[string]interface{}{"price": 12.5, "tags": nil},
+}
+
+func TestEvalExpression(t *testing.T) {
+	cases := []struct {
+		name   string
+		source string
+		want   interface{}
+	}{
+		// precedence and associativity
+		{"mul before add", "1 + 2 * 3", int64(7)},
+		{"parentheses", "(1 + 2) * 3", int64(9)},
+		{"left assoc sub", "10 - 4 - 3", int64(3)},
+		{"left assoc mul mod", "2 * 3 % 4", int64(2)},
+		{"unary minus", "-2 * 3", int64(-6)},
+		{"double minus", "1 - -1", int64(2)},
+		{"arith before compare", "1 + 2 = 3", true},
+		{"and before or", "true or false and false", true},
+		{"not after compare", "not 1 = 2", true},
+		{"symbol operators", "!(price > 5) || qty == 2 && status != 'open'", true},
+		{"in list", "status in ('open', 'paid')", true},
+		{"not in list", "status not in ('open', 'paid')", false},
+		{"like", "status like 'pa%'", true},
+		{"not like", "status not like 'pa%'", false},
+		{"keywords any case", "1 = 1 AND NOT 2 = 3", true},
+
+		// types
+		{"int times int", "price * qty", int64(20)},
+		{"int times float", "price * rate", 5.0},
+		{"division is float", "7 / 2", 3.5},
+		{"exact division is float", "6 / 2", 3.0},
+		{"int modulo", "7 % 3", int64(1)},
+		{"text concatenation", "'a' + 1", "a1"},
+		{"numeric text", "'5' * 2", 10.0},
+		{"int equals float", "1 = 1.0", true},
+		{"string of float", "string(1.5)", "1.5"},
+		{"number of text", "number(zip)", int64(12345)},
+		{"number of bad text", "number('x')", nil},
+		{"round places", "round(new.price * 3, 1)", 37.5},
+		{"round to int", "round(2.5)", int64(3)},
+		{"nested value", "new.price > price", true},
+		{"escaped quote", "'it''s'", "it's"},
+		{"functions", "upper(trim(name)) + '-' + substr(zip, 2, 3)", "ALICE-234"},
+		{"if", "if(qty > 1, 'many', 'one')", "many"},
+		{"min max", "max(1, qty, price) - min(3, qty)", int64(8)},
+
+		// null
+		{"arith with null", "none + 1", nil},
+		{"missing column", "missing * 2", nil},
+		{"path through null", "new.tags.x", nil},
+		{"path through scalar", "name.x", nil},
+		{"is null", "none is null and missing is null", true},
+		{"is not null", "new.price is not null", true},
+		{"null equals null", "none = null", true},
+		{"null equals value", "none = 0", false},
+		{"null compares false", "none < 1 or none >= 1", false},
+		{"null like", "none like '%'", false},
+		{"not null", "not none", true},
+		{"in with null", "none in (1, null)", true},
+		{"coalesce", "coalesce(none, missing, 'd')", "d"},
+		{"function of null", "upper(none)", nil},
+		{"min skips null", "min(none, 3, 1)", int64(1)},
+		{"concat null", "concat('a', none, 'b')", "ab"},
+
+		// only the branch taken is evaluated
+		{"and short circuit", "false and 1 / 0", false},
+		{"or short circuit", "true or 1 / 0", true},
+		{"if branch", "if(true, 1, 1 / 0)", int64(1)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := EvalExpression(c.source, exprTestValues)
+			if err != nil {
+				t.Fatalf("%s: %v", c.source, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%s = %#v, want %#v", c.source, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEvalExpressionErrors(t *testing.T) {
+	cases := []struct {
+		source string
+		want   string // prefix of the error
+	}{
+		{"1 / 0", ErrExpressionEval.Message + ": division by zero"},
+		{"1 % 0", ErrExpressionEval.Message + ": division by zero"},
+		{"price / (qty - 2)", ErrExpressionEval.Message + ": division by zero"},
+		{"1.5 / 0.0", ErrExpressionEval.Message + ": division by zero"},
+		{"status - 1", ErrExpressionEval.Message},
+		{"abs('x')", ErrExpressionEval.Message},
+		{"matches(name, '(')", ErrExpressionEval.Message},
+
+		{"", ErrExpressionSyntax.Message},
+		{"1 +", ErrExpressionSyntax.Message},
+		{"(1", ErrExpressionSyntax.Message},
+		{"1)", ErrExpressionSyntax.Message},
+		{"1 2", ErrExpressionSyntax.Message},
+		{"'abc", ErrExpressionSyntax.Message},
+		{"1 # 2", ErrExpressionSyntax.Message},
+		{"1.2.3", ErrExpressionSyntax.Message},
+		{"a in 1", ErrExpressionSyntax.Message},
+		{"a in (1, 2", ErrExpressionSyntax.Message},
+		{"nope(1)", ErrExpressionSyntax.Message},
+		{"upper()", ErrExpressionSyntax.Message},
+		{"if(1, 2)", ErrExpressionSyntax.Message},
+		{"a is", ErrExpressionSyntax.Message},
+		{strings.Repeat("(", EXPR_MAX_DEPTH) + "1" + strings.Repeat(")", EXPR_MAX_DEPTH), ErrExpressionSyntax.Message},
+		{strings.Repeat("1+", EXPR_MAX_NODES) + "1", ErrExpressionSyntax.Message},
+		{strings.Repeat(" ", EXPR_MAX_LENGTH) + "1", ErrExpressionSyntax.Message},
+	}
+	for _, c := range cases {
+		_, err := EvalExpression(c.source, exprTestValues)
+		if err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%.40q: got error %v, want %q", c.source, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package suresql
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Fault injection for testing client retries and alerting: while enabled, a percentage of the driver
+// calls and connection acquisitions of API users (never the internal connection) are delayed or fail
+// with ErrFaultInjected. It is set through the internal API, kept in memory on this node only and
+// switches itself off after a while so it cannot be forgotten in production.
+
+const (
+	FAULT_TARGET_DRIVER     = "driver"     // calls on the user's DB connection
+	FAULT_TARGET_CONNECTION = "connection" // getting the connection of a token, and /connect
+
+	DEFAULT_FAULT_DURATION = 10 * time.Minute
+	MAX_FAULT_DELAY        = 60 * time.Second
+)
+
+var (
+	ErrFaultInjected = medaerror.MedaError{Message: "injected fault"}
+	ErrFaultInvalid  = medaerror.MedaError{Message: "invalid fault config, percentages are 0-100 and delay at most 60s"}
+
+	faultConfig atomic.Pointer[FaultConfig]
+	faultStats  FaultStats
+	faultRandMu sync.Mutex
+	faultRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// FaultConfig is what to inject, percentages are 0-100
+type FaultConfig struct {
+	FailPct     float64   `json:"fail_pct"`
+	DelayPct    float64   `json:"delay_pct"`
+	DelayMs     int       `json:"delay_ms"`          // a delayed call waits a random time up to this
+	Targets     []string  `json:"targets,omitempty"` // driver, connection; empty is both
+	DurationSec int       `json:"duration_sec"`      // switched off after this, 0 is 10 minutes
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// FaultStats counts the injected faults since the node started
+type FaultStats struct {
+	Delayed int64 `json:"delayed"`
+	Failed  int64 `json:"failed"`
+}
+
+// FaultStatus is the current config (nil when off) and the counters
+type FaultStatus struct {
+	Config *FaultConfig `json:"config"`
+	Stats  FaultStats   `json:"stats"`
+}
+
+// EnableFaults starts injecting faults, replacing the previous config
+func EnableFaults(c FaultConfig) (FaultConfig, error) {
+	if c.FailPct < 0 || c.FailPct > 100 || c.DelayPct < 0 || c.DelayPct > 100 ||
+		c.DelayMs < 0 || time.Duration(c.DelayMs)*time.Millisecond > MAX_FAULT_DELAY || c.DurationSec < 0 {
+		return c, ErrFaultInvalid
+	}
+	for _, t := range c.Targets {
+		if t != FAULT_TARGET_DRIVER && t != FAULT_TARGET_CONNECTION {
+			return c, medaerror.Errorf("%s: unknown target %s", ErrFaultInvalid.Message, t)
+		}
+	}
+	duration := time.Duration(c.DurationSec) * time.Second
+	if duration == 0 {
+		duration = DEFAULT_FAULT_DURATION
+	}
+	c.ExpiresAt = time.Now().Add(duration)
+	faultConfig.Store(&c)
+	simplelog.LogFormat("fault injection enabled until %s: fail %.1f%%, delay %.1f%% up to %dms, targets %v", c.ExpiresAt.Format(time.RFC3339), c.FailPct, c.DelayPct, c.DelayMs, c.Targets)
+	return c, nil
+}
+
+// DisableFaults stops injecting faults
+func DisableFaults() {
+	if faultConfig.Swap(nil) != nil {
+		simplelog.LogThis("fault injection disabled")
+	}
+}
+
+// GetFaultStatus returns the active config, if any, and the counters
+func GetFaultStatus() FaultStatus {
+	return FaultStatus{
+		Config: activeFaults(),
+		Stats: FaultStats{
+			Delayed: atomic.LoadInt64(&faultStats.Delayed),
+			Failed:  atomic.LoadInt64(&faultStats.Failed),
+		},
+	}
+}
+
+// activeFaults returns the config while it has not expired
+func activeFaults() *FaultConfig {
+	c := faultConfig.Load()
+	if c == nil {
+		return nil
+	}
+	if time.Now().After(c.ExpiresAt) {
+		if faultConfig.CompareAndSwap(c, nil) {
+			simplelog.LogThis("fault injection expired")
+		}
+		return nil
+	}
+	return c
+}
+
+func (c *FaultConfig) targets(target string) bool {
+	if len(c.Targets) == 0 {
+		return true
+	}
+	for _, t := range c.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func faultRoll() float64 {
+	faultRandMu.Lock()
+	defer faultRandMu.Unlock()
+	return faultRand.Float64() * 100
+}
+
+// InjectFault delays and/or fails the call according to the active config, nil when nothing is injected
+func InjectFault(target string) error {
+	c := activeFaults()
+	if c == nil || !c.targets(target) {
+		return nil
+	}
+	if c.DelayPct > 0 && c.DelayMs > 0 && faultRoll() < c.DelayPct {
+		atomic.AddInt64(&faultStats.Delayed, 1)
+		time.Sleep(time.Duration(faultRoll() / 100 * float64(c.DelayMs) * float64(time.Millisecond)))
+	}
+	if c.FailPct > 0 && faultRoll() < c.FailPct {
+		atomic.AddInt64(&faultStats.Failed, 1)
+		return ErrFaultInjected
+	}
+	return nil
+}
+
+// WithFaults wraps the connection of an API user so its calls go through InjectFault
+func WithFaults(db SureSQLDB) SureSQLDB {
+	if db == nil || activeFaults() == nil {
+		return db
+	}
+	if _, ok := db.(faultyDB); ok {
+		return db
+	}
+	return faultyDB{db}
+}
+
+// faultyDB injects faults before every driver call, the other methods are the connection's
+type faultyDB struct {
+	SureSQLDB
+}
+
+func (f faultyDB) Status() (orm.NodeStatusStruct, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.NodeStatusStruct{}, err
+	}
+	return f.SureSQLDB.Status()
+}
+
+func (f faultyDB) SelectOne(table string) (orm.DBRecord, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.DBRecord{}, err
+	}
+	return f.SureSQLDB.SelectOne(table)
+}
+
+func (f faultyDB) SelectMany(table string) (orm.DBRecords, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.SelectMany(table)
+}
+
+func (f faultyDB) SelectOneWithCondition(table string, c *orm.Condition) (orm.DBRecord, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.DBRecord{}, err
+	}
+	return f.SureSQLDB.SelectOneWithCondition(table, c)
+}
+
+func (f faultyDB) SelectManyWithCondition(table string, c *orm.Condition) ([]orm.DBRecord, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.SelectManyWithCondition(table, c)
+}
+
+func (f faultyDB) SelectOneSQL(sql string) (orm.DBRecords, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.SelectOneSQL(sql)
+}
+
+func (f faultyDB) SelectManySQL(sql []string) ([]orm.DBRecords, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.SelectManySQL(sql)
+}
+
+func (f faultyDB) SelectOnlyOneSQL(sql string) (orm.DBRecord, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.DBRecord{}, err
+	}
+	return f.SureSQLDB.SelectOnlyOneSQL(sql)
+}
+
+func (f faultyDB) SelectOneSQLParameterized(sql orm.ParametereizedSQL) (orm.DBRecords, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.SelectOneSQLParameterized(sql)
+}
+
+func (f faultyDB) SelectManySQLParameterized(sql []orm.ParametereizedSQL) ([]orm.DBRecords, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.SelectManySQLParameterized(sql)
+}
+
+func (f faultyDB) SelectOnlyOneSQLParameterized(sql orm.ParametereizedSQL) (orm.DBRecord, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.DBRecord{}, err
+	}
+	return f.SureSQLDB.SelectOnlyOneSQLParameterized(sql)
+}
+
+func (f faultyDB) ExecOneSQL(sql string) orm.BasicSQLResult {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return f.SureSQLDB.ExecOneSQL(sql)
+}
+
+func (f faultyDB) ExecOneSQLParameterized(sql orm.ParametereizedSQL) orm.BasicSQLResult {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return f.SureSQLDB.ExecOneSQLParameterized(sql)
+}
+
+func (f faultyDB) ExecManySQL(sql []string) ([]orm.BasicSQLResult, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.ExecManySQL(sql)
+}
+
+func (f faultyDB) ExecManySQLParameterized(sql []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.ExecManySQLParameterized(sql)
+}
+
+func (f faultyDB) InsertOneDBRecord(record orm.DBRecord, queue bool) orm.BasicSQLResult {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return f.SureSQLDB.InsertOneDBRecord(record, queue)
+}
+
+func (f faultyDB) InsertManyDBRecords(records []orm.DBRecord, queue bool) ([]orm.BasicSQLResult, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.InsertManyDBRecords(records, queue)
+}
+
+func (f faultyDB) InsertManyDBRecordsSameTable(records []orm.DBRecord, queue bool) ([]orm.BasicSQLResult, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.InsertManyDBRecordsSameTable(records, queue)
+}
+
+func (f faultyDB) InsertOneTableStruct(table orm.TableStruct, queue bool) orm.BasicSQLResult {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return f.SureSQLDB.InsertOneTableStruct(table, queue)
+}
+
+func (f faultyDB) InsertManyTableStructs(tables []orm.TableStruct, queue bool) ([]orm.BasicSQLResult, error) {
+	if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+		return nil, err
+	}
+	return f.SureSQLDB.InsertManyTableStructs(tables, queue)
+}
@@ -0,0 +1,161 @@
+package suresql
+
+import (
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/filesystem"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// First boot of a blank database: the internal tables are created in code and the config row is
+// written from the environment, so startup does not depend on the migration files being shipped
+// next to the binary. The tables have the shape of 00001_init_up.sql (CREATE TABLE IF NOT EXISTS
+// there is a no-op then), columns later migrations add are only created here when there are no
+// migration files at all. Setting defaults are written after the migrations, for keys they did not set.
+
+var coreTables = []struct {
+	Name string
+	DDL  string
+}{
+	{ConfigTable{}.TableName(), `CREATE TABLE IF NOT EXISTS _configs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  label TEXT,
+  ip TEXT,
+  host TEXT,
+  port TEXT,
+  ssl BOOLEAN,
+  dbms TEXT,
+  mode TEXT,
+  nodes INTEGER,
+  node_number INTEGER,
+  is_init_done BOOLEAN,
+  is_split_write BOOLEAN,
+  encryption_method TEXT
+)`},
+	{SettingTable{}.TableName(), `CREATE TABLE IF NOT EXISTS _settings (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  category TEXT,
+  data_type TEXT,
+  setting_key TEXT,
+  text_value TEXT,
+  float_value REAL,
+  int_value INTEGER
+)`},
+	{"_users", `CREATE TABLE IF NOT EXISTS _users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  username TEXT,
+  password TEXT,
+  role_name TEXT,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP
+)`},
+	{TokenTable{}.TableName(), `CREATE TABLE IF NOT EXISTS _tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id TEXT,
+  token TEXT,
+  refresh TEXT,
+  token_expired_at TEXT,
+  refresh_expired_at TEXT,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP
+)`},
+}
+
+// coreColumnsAddedLater are added by 00003 and 00021, run only without migration files
+var coreColumnsAddedLater = []string{
+	"ALTER TABLE _users ADD COLUMN tenant TEXT",
+	"ALTER TABLE _tokens ADD COLUMN username TEXT",
+	"ALTER TABLE _tokens ADD COLUMN tenant TEXT",
+}
+
+// MissingCoreTables lists the internal tables the database does not have, all of them on a blank one
+func MissingCoreTables() []string {
+	existing := map[string]bool{}
+	for _, s := range CurrentNode.GetInternalConnection().GetSchema(true, false) {
+		if s.ObjectType == "table" {
+			existing[s.TableName] = true
+		}
+	}
+	missing := []string{}
+	for _, t := range coreTables {
+		if !existing[t.Name] {
+			missing = append(missing, t.Name)
+		}
+	}
+	return missing
+}
+
+// FirstBoot creates the missing internal tables and the config row of this node, returns false when
+// the database had them already
+func FirstBoot() (bool, error) {
+	missing := MissingCoreTables()
+	if len(missing) == 0 {
+		return false, nil
+	}
+	simplelog.LogFormat("init: first boot, creating internal tables %v", missing)
+	for _, t := range coreTables {
+		if res := CurrentNode.GetInternalConnection().ExecOneSQL(t.DDL); res.Error != nil {
+			return true, res.Error
+		}
+	}
+	if len(filesystem.Dir(MIGRATION_DIRECTORY, MIGRATION_UP_FILES_SIGNATURE)) == 0 {
+		simplelog.LogFormat("init: no migration files in %s, creating the current internal schema", MIGRATION_DIRECTORY)
+		for _, ddl := range coreColumnsAddedLater {
+			if res := CurrentNode.GetInternalConnection().ExecOneSQL(ddl); res.Error != nil {
+				return true, res.Error
+			}
+		}
+	}
+	c := InitialConfigFromEnvironment()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + c.TableName() + " (id, label, ip, host, port, ssl, dbms, mode, nodes, node_number, is_init_done, is_split_write, encryption_method)" +
+			" VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, false, false, ?) ON CONFLICT(id) DO NOTHING",
+		Values: []interface{}{c.Label, c.IP, c.Host, c.Port, c.SSL, c.DBMS, c.Mode, c.Nodes, c.NodeNumber, c.EncryptionMethod},
+	})
+	return true, res.Error
+}
+
+// InitialConfigFromEnvironment is the config row of a new database: SURESQL_LABEL, SURESQL_IP,
+// SURESQL_HOST, SURESQL_PORT, SURESQL_SSL, DBMS_TYPE, SURESQL_MODE, SURESQL_NODES and SURESQL_NODE_NUMBER
+func InitialConfigFromEnvironment() ConfigTable {
+	return ConfigTable{
+		Label:            utils.GetEnvString("SURESQL_LABEL", APP_NAME),
+		IP:               utils.GetEnvString("SURESQL_IP", "127.0.0.1"),
+		Host:             utils.GetEnvString("SURESQL_HOST", ""),
+		Port:             utils.GetEnvString("SURESQL_PORT", ""),
+		SSL:              utils.GetEnvBool("SURESQL_SSL", false),
+		DBMS:             LoadDBMSConfigFromEnvironment().DBMS,
+		Mode:             utils.GetEnvString("SURESQL_MODE", "rw"),
+		Nodes:            utils.GetEnvInt("SURESQL_NODES", 1),
+		NodeNumber:       utils.GetEnvInt("SURESQL_NODE_NUMBER", 1),
+		EncryptionMethod: "none",
+	}
+}
+
+// seedDefaultSettings writes the token settings the migrations did not, from SURESQL_TOKEN_EXP,
+// SURESQL_REFRESH_EXP and SURESQL_TOKEN_TTL (durations, stored in minutes)
+func seedDefaultSettings() error {
+	defaults := []struct {
+		key string
+		env string
+		def time.Duration
+	}{
+		{SETTING_KEY_TOKEN_EXP, "SURESQL_TOKEN_EXP", 6 * time.Hour},
+		{SETTING_KEY_REFRESH_EXP, "SURESQL_REFRESH_EXP", 24 * time.Hour},
+		{SETTING_KEY_TOKEN_TTL, "SURESQL_TOKEN_TTL", 5 * time.Minute},
+	}
+	table := SettingTable{}.TableName()
+	for _, d := range defaults {
+		minutes := int(utils.GetEnvDuration(d.env, d.def) / time.Minute)
+		res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query: "INSERT INTO " + table + " (category, data_type, setting_key, int_value) SELECT ?, 'int', ?, ?" +
+				" WHERE NOT EXISTS (SELECT 1 FROM " + table + " WHERE category = ? AND setting_key = ?)",
+			Values: []interface{}{SETTING_CATEGORY_TOKEN, d.key, minutes, SETTING_CATEGORY_TOKEN, d.key},
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
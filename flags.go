@@ -0,0 +1,202 @@
+package suresql
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Feature flags switch optional subsystems in _feature_flags without a restart. A flag without a row is
+// on, the subsystems work as before until a flag turns them off. tenants and roles (comma separated)
+// narrow a flag to the requests of those tenants or roles, subsystems that do not run for a request
+// only look at enabled. The flags are cached for FEATURE_FLAG_CACHE_TTL, a change applies at once on
+// the node that got it and within the TTL on the others.
+
+const (
+	FEATURE_FLAG_CACHE_TTL = 30 * time.Second
+
+	FLAG_CDC         = "cdc"         // rules and derived tables follow the CDC log
+	FLAG_SPLIT_WRITE = "split_write" // replica lag is measured for split-write
+	FLAG_TX          = "tx"          // interactive transactions, per tenant and role
+)
+
+var (
+	ErrFeatureFlagInvalid = medaerror.MedaError{Message: "invalid feature flag, flag is required"}
+	ErrFeatureDisabled    = medaerror.MedaError{Message: "this feature is disabled"}
+
+	// KnownFeatureFlags are the flags checked by SureSQL, plugins may check flags of their own
+	KnownFeatureFlags = map[string]string{
+		FLAG_CDC:         "rule engine and derived tables follow the CDC log",
+		FLAG_SPLIT_WRITE: "replica lag is measured when split-write is configured",
+		FLAG_TX:          "interactive transactions (/db/api/tx), targets tenants and roles",
+	}
+
+	flagMu     sync.Mutex
+	flagCache  map[string]FeatureFlagTable
+	flagRoles  map[string]string // username -> role_name, for the flags that target roles
+	flagLoaded time.Time
+)
+
+// FeatureFlagTable is a flag, enabled for the tenants and roles listed (everyone when empty)
+type FeatureFlagTable struct {
+	ID          int       `json:"id,omitempty"          db:"id"`
+	Flag        string    `json:"flag"                  db:"flag"`
+	Enabled     bool      `json:"enabled"               db:"enabled"`
+	Tenants     string    `json:"tenants,omitempty"     db:"tenants"`
+	Roles       string    `json:"roles,omitempty"       db:"roles"`
+	Description string    `json:"description,omitempty" db:"description"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"  db:"updated_at"`
+}
+
+func (f FeatureFlagTable) TableName() string {
+	return "_feature_flags"
+}
+
+// targets tells if the flag applies to the tenant and role
+func (f FeatureFlagTable) targets(tenant, role string) bool {
+	return inCommaList(f.Tenants, tenant) && inCommaList(f.Roles, role)
+}
+
+// inCommaList is true for an empty list or when value is one of its items
+func inCommaList(list, value string) bool {
+	if strings.TrimSpace(list) == "" {
+		return true
+	}
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ListFeatureFlags returns the flags of the table and the known flags without a row (on, no id)
+func ListFeatureFlags() ([]FeatureFlagTable, error) {
+	condition := orm.Condition{OrderBy: []string{"flag ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(FeatureFlagTable{}.TableName(), &condition)
+	if err != nil && !IsNoRowsError(err) {
+		return nil, err
+	}
+	flags := make([]FeatureFlagTable, 0, len(records)+len(KnownFeatureFlags))
+	seen := map[string]bool{}
+	for _, rec := range records {
+		f := object.MapToStructSlowDB[FeatureFlagTable](rec.Data)
+		seen[f.Flag] = true
+		flags = append(flags, f)
+	}
+	for flag, description := range KnownFeatureFlags {
+		if !seen[flag] {
+			flags = append(flags, FeatureFlagTable{Flag: flag, Enabled: true, Description: description})
+		}
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Flag < flags[j].Flag })
+	return flags, nil
+}
+
+// SaveFeatureFlag creates or replaces the flag by its name
+func SaveFeatureFlag(f FeatureFlagTable) (FeatureFlagTable, error) {
+	f.Flag = strings.TrimSpace(f.Flag)
+	if f.Flag == "" {
+		return f, ErrFeatureFlagInvalid
+	}
+	if err := ValidateIdentifier(f.Flag); err != nil {
+		return f, err
+	}
+	if f.Description == "" {
+		f.Description = KnownFeatureFlags[f.Flag]
+	}
+	f.UpdatedAt = time.Now().UTC()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + f.TableName() + " (flag, enabled, tenants, roles, description, updated_at) VALUES (?, ?, ?, ?, ?, ?)" +
+			" ON CONFLICT(flag) DO UPDATE SET enabled = excluded.enabled, tenants = excluded.tenants, roles = excluded.roles," +
+			" description = excluded.description, updated_at = excluded.updated_at",
+		Values: []interface{}{f.Flag, f.Enabled, f.Tenants, f.Roles, f.Description, f.UpdatedAt},
+	})
+	invalidateFeatureFlags()
+	return f, res.Error
+}
+
+// DeleteFeatureFlag removes the row of the flag, a known flag is on again
+func DeleteFeatureFlag(flag string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + FeatureFlagTable{}.TableName() + " WHERE flag = ?",
+		Values: []interface{}{flag},
+	})
+	invalidateFeatureFlags()
+	return res.Error
+}
+
+func invalidateFeatureFlags() {
+	flagMu.Lock()
+	flagCache = nil
+	flagMu.Unlock()
+}
+
+// featureFlag returns the row of the flag from the cache, reloaded after FEATURE_FLAG_CACHE_TTL
+func featureFlag(flag string) (FeatureFlagTable, bool) {
+	flagMu.Lock()
+	defer flagMu.Unlock()
+	if flagCache == nil || time.Since(flagLoaded) >= FEATURE_FLAG_CACHE_TTL {
+		loaded := map[string]FeatureFlagTable{}
+		// the table may not exist yet, then every flag is on
+		if CurrentNode.GetInternalConnection() != nil {
+			if records, err := CurrentNode.GetInternalConnection().SelectMany(FeatureFlagTable{}.TableName()); err == nil {
+				for _, rec := range records {
+					f := object.MapToStructSlowDB[FeatureFlagTable](rec.Data)
+					loaded[f.Flag] = f
+				}
+			}
+		}
+		flagCache, flagRoles, flagLoaded = loaded, map[string]string{}, time.Now()
+	}
+	f, ok := flagCache[flag]
+	return f, ok
+}
+
+// FeatureEnabled tells if the subsystem of the flag is on, the targets are not looked at
+func FeatureEnabled(flag string) bool {
+	f, ok := featureFlag(flag)
+	return !ok || f.Enabled
+}
+
+// FeatureEnabledFor tells if the flag is on for a request of the user of the tenant
+func FeatureEnabledFor(flag, username, tenant string) bool {
+	f, ok := featureFlag(flag)
+	if !ok {
+		return true
+	}
+	if !f.Enabled {
+		return false
+	}
+	role := ""
+	if strings.TrimSpace(f.Roles) != "" {
+		role = userRole(username)
+	}
+	return f.targets(tenant, role)
+}
+
+// userRole is the role_name of the user, cached with the flags
+func userRole(username string) string {
+	flagMu.Lock()
+	role, ok := flagRoles[username]
+	flagMu.Unlock()
+	if ok {
+		return role
+	}
+	condition := orm.Condition{Field: "username", Operator: "=", Value: username}
+	if rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition("_users", &condition); err == nil {
+		role, _ = rec.Data["role_name"].(string)
+	}
+	flagMu.Lock()
+	if flagRoles != nil {
+		flagRoles[username] = role
+	}
+	flagMu.Unlock()
+	return role
+}
@@ -0,0 +1,217 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Fuzz targets of the code that turns API input into SQL. `go test` runs the seeds (below and in
+// testdata/fuzz), explore with ie: go test -run '^$' -fuzz FuzzBuildSelect -fuzztime 60s .
+
+var (
+	fuzzDialects    = []Dialect{DialectSQLite, DialectPostgres, DialectMySQL}
+	safeTableName   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,63}$`)
+	numberedParamRe = regexp.MustCompile(`\$(\d+)`)
+)
+
+func FuzzValidateTableName(f *testing.F) {
+	for _, seed := range []string{"users", "_users", "orders_2024", "", "1users", "users; DROP TABLE users", "users--", "us\"ers", "ünïcode", strings.Repeat("a", 65)} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(func(t *testing.T, name string, allowInternal bool) {
+		if ValidateTableName(name, allowInternal) != nil {
+			return
+		}
+		if !safeTableName.MatchString(name) {
+			t.Fatalf("accepted unsafe table name %q", name)
+		}
+		if !allowInternal && strings.HasPrefix(name, "_") {
+			t.Fatalf("accepted internal table %q", name)
+		}
+	})
+}
+
+func FuzzBuildSelect(f *testing.F) {
+	seeds := []string{
+		`{"field": "id", "operator": "=", "value": 1}`,
+		`{"field": "status", "operator": "in", "value": ["a", "b"], "order_by": ["id DESC NULLS LAST"], "limit": 10, "offset": 5}`,
+		`{"logic": "OR", "nested": [{"field": "a", "operator": "is null"}, {"field": "b", "operator": "any", "value": [1, 2]}]}`,
+		`{"field": "name", "operator": "like", "value": "x'; DROP TABLE users; --"}`,
+		`{"field": "name; DROP TABLE users", "operator": "="}`,
+		`{"field": "id", "operator": "= 1 OR 1=1 --"}`,
+		`{"field": "id", "order_by": ["id; DELETE FROM users"], "group_by": ["a", "b.c"]}`,
+		`{"nested": [{"nested": [{"field": "x", "operator": "!=", "value": []}]}]}`,
+	}
+	for _, seed := range seeds {
+		f.Add(seed, "users")
+	}
+	f.Add(`{}`, "users; --")
+	f.Fuzz(func(t *testing.T, condition, table string) {
+		var c orm.Condition
+		if json.Unmarshal([]byte(condition), &c) != nil {
+			return
+		}
+		for _, d := range fuzzDialects {
+			sql, err := BuildSelect(d, table, &c)
+			if err != nil {
+				continue
+			}
+			checkRenderedSQL(t, d, sql)
+		}
+	})
+}
+
+// checkRenderedSQL: only validated identifiers and keywords reach the SQL text, values are all
+// placeholders and there is one placeholder per value in the syntax of the dialect
+func checkRenderedSQL(t *testing.T, d Dialect, sql orm.ParametereizedSQL) {
+	t.Helper()
+	for _, bad := range []string{";", "'", "\"", "`", "--", "/*", "\\"} {
+		if strings.Contains(sql.Query, bad) {
+			t.Fatalf("%s: %q in query %q", d.Name, bad, sql.Query)
+		}
+	}
+	if d.NumberedParams {
+		if strings.Contains(sql.Query, "?") {
+			t.Fatalf("%s: ? placeholder in %q", d.Name, sql.Query)
+		}
+		matches := numberedParamRe.FindAllStringSubmatch(sql.Query, -1)
+		if len(matches) != len(sql.Values) {
+			t.Fatalf("%s: %d placeholders for %d values in %q", d.Name, len(matches), len(sql.Values), sql.Query)
+		}
+		for i, m := range matches {
+			if m[1] != strconv.Itoa(i+1) {
+				t.Fatalf("%s: placeholder $%s out of order in %q", d.Name, m[1], sql.Query)
+			}
+		}
+		return
+	}
+	if strings.Contains(sql.Query, "$") {
+		t.Fatalf("%s: numbered placeholder in %q", d.Name, sql.Query)
+	}
+	if n := strings.Count(sql.Query, "?"); n != len(sql.Values) {
+		t.Fatalf("%s: %d placeholders for %d values in %q", d.Name, n, len(sql.Values), sql.Query)
+	}
+}
+
+// FuzzRequestJSON decodes request bodies the way the handlers do and runs the validation that comes
+// before the DB: none of it may panic, and what passes must render safe SQL
+func FuzzRequestJSON(f *testing.F) {
+	seeds := []string{
+		`{"table": "orders", "condition": {"field": "total", "operator": ">", "value": 10}}`,
+		`{"table": "orders", "single_row": true, "transform": {"filter": "total > 1", "derive": [{"name": "x", "expression": "total * 2"}], "pivot": {"row": "a", "column": "b", "value": "x"}, "precision": {"*": 2}}}`,
+		`{"table": "orders", "transform": {"pivot": {"row": "a"}, "rename": {"": "b"}, "precision": {"a": 99}}}`,
+		`{"table": "_users", "as_of": "2024-01-31T18:00:00Z"}`,
+		`{"statements": ["SELECT 1"], "param_sql": [{"query": "SELECT ?", "values": [1]}]}`,
+		`{"records": [{"TableName": "orders", "Data": {"id": 1}}], "queue": true, "continue_on_error": true}`,
+		`[1, "x", null]`,
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	rows := []orm.DBRecord{
+		{TableName: "orders", Data: map[string]interface{}{"a": "x", "b": "y", "total": 12.5}},
+		{TableName: "orders", Data: map[string]interface{}{"a": "x", "b": nil, "total": int64(3)}},
+		{TableName: "orders"},
+	}
+	f.Fuzz(func(t *testing.T, body string) {
+		var sqlReq SQLRequest
+		_ = json.Unmarshal([]byte(body), &sqlReq)
+		var insertReq InsertRequest
+		_ = json.Unmarshal([]byte(body), &insertReq)
+
+		var queryReq QueryRequest
+		if json.Unmarshal([]byte(body), &queryReq) != nil {
+			return
+		}
+		if ValidateTableName(queryReq.Table, false) == nil && queryReq.Condition != nil {
+			for _, d := range fuzzDialects {
+				if sql, err := BuildSelect(d, queryReq.Table, queryReq.Condition); err == nil {
+					checkRenderedSQL(t, d, sql)
+				}
+			}
+		}
+		if queryReq.Transform != nil && queryReq.Transform.Validate() == nil {
+			records := make([]orm.DBRecord, len(rows))
+			for i, r := range rows {
+				records[i] = orm.DBRecord{TableName: r.TableName}
+				if r.Data != nil {
+					records[i].Data = map[string]interface{}{}
+					for k, v := range r.Data {
+						records[i].Data[k] = v
+					}
+				}
+			}
+			_, _ = queryReq.Transform.Apply(records)
+		}
+	})
+}
+
+func FuzzExpression(f *testing.F) {
+	for _, seed := range []string{
+		"price * qty", "status in ('open', 'paid') and total >= 0", "if(a is null, 'x', upper(a))",
+		"substr(name, 2, 3) + '-' + string(n)", "matches(name, '^(a+)+$')", "1 / 0", "((((((1))))))",
+		"not not not a", "coalesce(a, b, 'c') like 'c%'", "round(-n % 3, 2)", "'unterminated", "a.b.c = 1",
+	} {
+		f.Add(seed)
+	}
+	values := map[string]interface{}{"a": nil, "b": "text", "n": 3.5, "price": int64(10), "qty": int64(2), "name": "alice", "status": "open", "total": 1.5}
+	f.Fuzz(func(t *testing.T, source string) {
+		expr, err := CompileExpression(source)
+		if err != nil {
+			if !strings.HasPrefix(err.Error(), ErrExpressionSyntax.Message) {
+				t.Fatalf("compile error is not a syntax error: %v", err)
+			}
+			return
+		}
+		v, err := expr.Eval(values)
+		if err != nil {
+			if !strings.HasPrefix(err.Error(), ErrExpressionEval.Message) {
+				t.Fatalf("eval error is not an evaluation error: %v", err)
+			}
+			return
+		}
+		switch v.(type) {
+		case nil, bool, int64, float64, string:
+		default:
+			t.Fatalf("result %#v (%T) is not a value of the language", v, v)
+		}
+		if strings.Contains(strings.ToLower(source), "now") {
+			return
+		}
+		// the same input gives the same result, and EvalBool its truth
+		again, err := expr.Eval(values)
+		if err != nil || fmt.Sprint(again) != fmt.Sprint(v) {
+			t.Fatalf("second eval gave %v, %v, first %v", again, err, v)
+		}
+		if b, err := expr.EvalBool(values); err != nil || b != exprTruthy(v) {
+			t.Fatalf("EvalBool gave %v, %v for %v", b, err, v)
+		}
+	})
+}
+
+func FuzzBootstrapYAML(f *testing.F) {
+	for _, seed := range []string{
+		"schema:\n  - |\n    CREATE TABLE t (id INTEGER);\nsettings:\n- category: query\n  key: slow_ms\n  type: int\n  value: 500\n",
+		"users:\n  - username: admin\n    password: '${ADMIN_PASSWORD}'\n    role_name: admin # comment\n",
+		"a: [1, 'b', \"c\"]\nb: {}\nc: ~\n", "- - x\n  - y\n", "k: |-\n\n  x\n\ny: z", "---\n", "'q': \"\\x\"", "a:\n- b\n  c: d",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, doc string) {
+		v, err := ParseYAML([]byte(doc))
+		if err != nil {
+			return
+		}
+		if _, err := json.Marshal(v); err != nil {
+			t.Fatalf("parsed document cannot be encoded: %v", err)
+		}
+		_, _ = ParseBootstrap([]byte(doc))
+	})
+}
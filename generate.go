@@ -0,0 +1,326 @@
+package suresql
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Synthetic rows for development, load tests and demos: a value for every column of the table from
+// its type, or from a faker hint. Without a hint the column name is tried first (email, phone,
+// price, created_at, ...). The integer primary key and columns with a default are left to the DB
+// unless they have a hint. Rows go through the compute/validate expressions and the integrity
+// checksum like inserts from the API, rows failing a validate expression are skipped.
+
+const (
+	FAKE_EMAIL      = "email"
+	FAKE_NAME       = "name"
+	FAKE_FIRST_NAME = "first_name"
+	FAKE_LAST_NAME  = "last_name"
+	FAKE_PHONE      = "phone"
+	FAKE_CITY       = "city"
+	FAKE_COUNTRY    = "country"
+	FAKE_COMPANY    = "company"
+	FAKE_URL        = "url"
+	FAKE_UUID       = "uuid"
+	FAKE_PRICE      = "price"
+	FAKE_QUANTITY   = "quantity"
+	FAKE_INT        = "int"
+	FAKE_FLOAT      = "float"
+	FAKE_BOOL       = "bool"
+	FAKE_DATE       = "date"
+	FAKE_DATETIME   = "datetime"
+	FAKE_WORD       = "word"
+	FAKE_TEXT       = "text"
+	FAKE_IP         = "ip"
+	FAKE_NULL       = "null"
+
+	GENERATE_MAX_ROWS   = 100000
+	GENERATE_BATCH_SIZE = 500
+	GENERATE_SAMPLE     = 5 // rows returned in the result
+)
+
+var ErrGenerateInvalid = medaerror.MedaError{Message: "invalid generate request"}
+
+// fakeKinds are the hints, with what they produce
+var fakeKinds = map[string]string{
+	FAKE_EMAIL: "email address", FAKE_NAME: "full name", FAKE_FIRST_NAME: "first name", FAKE_LAST_NAME: "last name",
+	FAKE_PHONE: "phone number", FAKE_CITY: "city", FAKE_COUNTRY: "country", FAKE_COMPANY: "company name",
+	FAKE_URL: "https URL", FAKE_UUID: "UUID v4", FAKE_PRICE: "amount with 2 decimals", FAKE_QUANTITY: "integer 1-100",
+	FAKE_INT: "integer 0-1000", FAKE_FLOAT: "number 0-1000", FAKE_BOOL: "true or false", FAKE_DATE: "date in the last 2 years",
+	FAKE_DATETIME: "UTC timestamp in the last 2 years", FAKE_WORD: "word", FAKE_TEXT: "sentence", FAKE_IP: "IPv4 address",
+	FAKE_NULL: "null",
+}
+
+// GenerateRequest asks for rows of a table
+type GenerateRequest struct {
+	Table  string            `json:"table"`
+	Rows   int               `json:"rows"`
+	Hints  map[string]string `json:"hints,omitempty"`   // column: kind, ie: {"contact": "email"}
+	Seed   int64             `json:"seed,omitempty"`    // same seed, same rows, 0 is random
+	DryRun bool              `json:"dry_run,omitempty"` // only return the sample, insert nothing
+}
+
+// GenerateResult is what was inserted
+type GenerateResult struct {
+	Table    string                   `json:"table"`
+	Inserted int                      `json:"inserted"`
+	Skipped  int                      `json:"skipped"`          // failed a validate expression
+	Columns  map[string]string        `json:"columns"`          // column: kind used
+	Sample   []map[string]interface{} `json:"sample,omitempty"` // first rows
+}
+
+// Validate checks the table, the number of rows and the hints
+func (g GenerateRequest) Validate() error {
+	if err := ValidateTableName(g.Table, false); err != nil {
+		return err
+	}
+	if g.Rows < 1 || g.Rows > GENERATE_MAX_ROWS {
+		return medaerror.Errorf("%s: rows must be between 1 and %d", ErrGenerateInvalid.Message, GENERATE_MAX_ROWS)
+	}
+	for column, kind := range g.Hints {
+		if _, ok := fakeKinds[kind]; !ok {
+			return medaerror.Errorf("%s: unknown hint %q of %s", ErrGenerateInvalid.Message, kind, column)
+		}
+	}
+	return nil
+}
+
+// FakeKinds lists the hints
+func FakeKinds() map[string]string {
+	return fakeKinds
+}
+
+// Columns returns the kind of every generated column, checking the hints against the table
+func (g GenerateRequest) Columns() (map[string]string, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	columns, err := TableSchema(g.Table, true)
+	if err != nil {
+		return nil, err
+	}
+	for column := range g.Hints {
+		if findColumn(columns, column) == nil {
+			return nil, medaerror.Errorf("%s: column %s does not exist", ErrGenerateInvalid.Message, column)
+		}
+	}
+	kinds := map[string]string{}
+	for _, c := range columns {
+		if kind := fakeKindOf(c, g.Hints); kind != "" {
+			kinds[c.Name] = kind
+		}
+	}
+	return kinds, nil
+}
+
+// GenerateRows inserts fake rows into the table with the internal connection
+func GenerateRows(g GenerateRequest) (GenerateResult, error) {
+	result := GenerateResult{Table: g.Table}
+	columns, err := g.Columns()
+	if err != nil {
+		return result, err
+	}
+	result.Columns = columns
+
+	seed := g.Seed
+	if seed == 0 {
+		seed = CurrentClock.Now().UnixNano()
+	}
+	f := faker{rnd: rand.New(rand.NewSource(seed)), now: CurrentClock.Now().UTC()}
+	// in a fixed order, so the seed gives the same rows
+	names := make([]string, 0, len(columns))
+	for column := range columns {
+		names = append(names, column)
+	}
+	sort.Strings(names)
+	for done := 0; done < g.Rows; done += GENERATE_BATCH_SIZE {
+		n := g.Rows - done
+		if n > GENERATE_BATCH_SIZE {
+			n = GENERATE_BATCH_SIZE
+		}
+		records := make([]orm.DBRecord, n)
+		for i := range records {
+			data := make(map[string]interface{}, len(names))
+			for _, column := range names {
+				data[column] = f.value(columns[column])
+			}
+			records[i] = orm.DBRecord{TableName: g.Table, Data: data}
+		}
+
+		bad := map[int]bool{}
+		for _, e := range ApplyInsertExpressions(records) {
+			bad[e.Record] = true
+		}
+		if errs := ApplyRecordChecksums(records); len(errs) > 0 {
+			return result, errs[0]
+		}
+		good := make([]orm.DBRecord, 0, len(records))
+		for i, rec := range records {
+			if bad[i] {
+				result.Skipped++
+				continue
+			}
+			good = append(good, rec)
+			if len(result.Sample) < GENERATE_SAMPLE {
+				result.Sample = append(result.Sample, rec.Data)
+			}
+		}
+		if g.DryRun {
+			// the sample is enough
+			return result, nil
+		}
+		if len(good) == 0 {
+			continue
+		}
+		results, err := InsertManySameTable(CurrentNode.GetInternalConnection(), good)
+		ResultCache.InvalidateRecords(good)
+		if err != nil {
+			return result, err
+		}
+		for _, res := range results {
+			if res.Error != nil {
+				return result, res.Error
+			}
+		}
+		result.Inserted += len(good)
+	}
+	return result, nil
+}
+
+// fakeKindOf picks the kind of a column: the hint, the column name, then the type. Empty leaves the
+// column to the DB.
+func fakeKindOf(c TableColumn, hints map[string]string) string {
+	if kind, ok := hints[c.Name]; ok {
+		return kind
+	}
+	if c.Name == INTEGRITY_CHECKSUM_COLUMN || c.HasDefault || (c.PrimaryKey && c.Affinity == AFFINITY_INTEGER) {
+		return ""
+	}
+	name := strings.ToLower(c.Name)
+	byName := []struct {
+		part string
+		kind string
+	}{
+		{"email", FAKE_EMAIL}, {"first_name", FAKE_FIRST_NAME}, {"last_name", FAKE_LAST_NAME},
+		{"company", FAKE_COMPANY}, {"name", FAKE_NAME}, {"phone", FAKE_PHONE}, {"mobile", FAKE_PHONE},
+		{"city", FAKE_CITY}, {"country", FAKE_COUNTRY}, {"url", FAKE_URL}, {"website", FAKE_URL},
+		{"uuid", FAKE_UUID}, {"guid", FAKE_UUID}, {"price", FAKE_PRICE}, {"amount", FAKE_PRICE},
+		{"total", FAKE_PRICE}, {"cost", FAKE_PRICE}, {"qty", FAKE_QUANTITY}, {"quantity", FAKE_QUANTITY},
+		{"ip", FAKE_IP}, {"description", FAKE_TEXT}, {"note", FAKE_TEXT}, {"comment", FAKE_TEXT},
+	}
+	for _, b := range byName {
+		if name != b.part && !strings.HasPrefix(name, b.part+"_") && !strings.HasSuffix(name, "_"+b.part) {
+			continue
+		}
+		// ie: name_id is not a name
+		numeric := b.kind == FAKE_PRICE || b.kind == FAKE_QUANTITY
+		if c.Affinity == AFFINITY_ANY || (c.Affinity == AFFINITY_TEXT) != numeric {
+			return b.kind
+		}
+	}
+	declared := strings.ToUpper(c.Type)
+	switch {
+	case strings.HasSuffix(name, "_at") || strings.Contains(declared, "TIMESTAMP") || strings.Contains(declared, "DATETIME"):
+		return FAKE_DATETIME
+	case strings.HasSuffix(name, "_date") || name == "date" || declared == "DATE":
+		return FAKE_DATE
+	case strings.HasPrefix(name, "is_") || strings.HasPrefix(name, "has_"):
+		return FAKE_BOOL
+	}
+	switch c.Affinity {
+	case AFFINITY_BOOL:
+		return FAKE_BOOL
+	case AFFINITY_INTEGER:
+		return FAKE_INT
+	case AFFINITY_REAL:
+		return FAKE_FLOAT
+	case AFFINITY_BLOB:
+		return FAKE_NULL
+	}
+	return FAKE_WORD
+}
+
+type faker struct {
+	rnd *rand.Rand
+	now time.Time
+}
+
+var (
+	fakeWords     = []string{"alpha", "amber", "breeze", "cedar", "delta", "ember", "falcon", "garnet", "harbor", "indigo", "juniper", "kestrel", "lotus", "maple", "nimbus", "orchid", "pebble", "quartz", "raven", "saffron", "tundra", "umber", "violet", "willow"}
+	fakeCities    = []string{"Jakarta", "Bandung", "Surabaya", "Singapore", "Kuala Lumpur", "Bangkok", "Tokyo", "Sydney", "Berlin", "Lisbon", "Toronto", "Austin", "Nairobi", "Lima"}
+	fakeCountries = []string{"Indonesia", "Singapore", "Malaysia", "Thailand", "Japan", "Australia", "Germany", "Portugal", "Canada", "United States", "Kenya", "Peru"}
+	fakeCompany   = []string{"Labs", "Works", "Trading", "Logistics", "Digital", "Foods", "Systems", "Partners"}
+)
+
+func (f faker) pick(list []string) string {
+	return list[f.rnd.Intn(len(list))]
+}
+
+func (f faker) value(kind string) interface{} {
+	switch kind {
+	case FAKE_EMAIL:
+		return fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(f.pick(scrubFirstNames)), strings.ToLower(f.pick(scrubLastNames)), f.rnd.Intn(1000))
+	case FAKE_NAME:
+		return f.pick(scrubFirstNames) + " " + f.pick(scrubLastNames)
+	case FAKE_FIRST_NAME:
+		return f.pick(scrubFirstNames)
+	case FAKE_LAST_NAME:
+		return f.pick(scrubLastNames)
+	case FAKE_PHONE:
+		return fmt.Sprintf("+62 8%02d %04d %04d", f.rnd.Intn(100), f.rnd.Intn(10000), f.rnd.Intn(10000))
+	case FAKE_CITY:
+		return f.pick(fakeCities)
+	case FAKE_COUNTRY:
+		return f.pick(fakeCountries)
+	case FAKE_COMPANY:
+		return capitalize(f.pick(fakeWords)) + " " + f.pick(fakeCompany)
+	case FAKE_URL:
+		return fmt.Sprintf("https://%s.example.com/%s", f.pick(fakeWords), f.pick(fakeWords))
+	case FAKE_UUID:
+		b := make([]byte, 16)
+		f.rnd.Read(b)
+		b[6], b[8] = (b[6]&0x0f)|0x40, (b[8]&0x3f)|0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	case FAKE_PRICE:
+		return float64(f.rnd.Intn(100000)) / 100
+	case FAKE_QUANTITY:
+		return f.rnd.Intn(100) + 1
+	case FAKE_INT:
+		return f.rnd.Intn(1001)
+	case FAKE_FLOAT:
+		return f.rnd.Float64() * 1000
+	case FAKE_BOOL:
+		return f.rnd.Intn(2) == 1
+	case FAKE_DATE:
+		return f.past().Format("2006-01-02")
+	case FAKE_DATETIME:
+		return f.past().Format(time.RFC3339)
+	case FAKE_TEXT:
+		words := make([]string, 4+f.rnd.Intn(8))
+		for i := range words {
+			words[i] = f.pick(fakeWords)
+		}
+		return capitalize(strings.Join(words, " ")) + "."
+	case FAKE_IP:
+		return fmt.Sprintf("10.%d.%d.%d", f.rnd.Intn(256), f.rnd.Intn(256), f.rnd.Intn(254)+1)
+	case FAKE_NULL:
+		return nil
+	}
+	return f.pick(fakeWords)
+}
+
+// past is a random moment of the last 2 years
+func (f faker) past() time.Time {
+	return f.now.Add(-time.Duration(f.rnd.Int63n(int64(2 * 365 * 24 * time.Hour)))).Truncate(time.Second)
+}
+
+func capitalize(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,204 @@
+package suresql
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Translated user-facing messages. The messages in the code (the message of SetError, ie: "Invalid
+// request format") are the keys, translations are kept in _messages per locale. The locale of a
+// request is negotiated from Accept-Language against the locales that have translations, a message
+// without a translation is returned as it is.
+
+const (
+	DEFAULT_LOCALE        = "en"
+	MESSAGE_CACHE_TTL     = 30 * time.Second
+	ACCEPT_LANGUAGE_LIMIT = 16 // language ranges considered from one header
+)
+
+var (
+	ErrMessageInvalid = medaerror.MedaError{Message: "invalid message, locale, message_key and text are required"}
+
+	messageMu      sync.Mutex
+	messageCatalog map[string]map[string]string // locale -> message key -> text
+	messageLoaded  time.Time
+)
+
+// MessageTable is the translation of a message to a locale
+type MessageTable struct {
+	ID         int       `json:"id,omitempty"         db:"id"`
+	Locale     string    `json:"locale"               db:"locale"`
+	MessageKey string    `json:"message_key"          db:"message_key"`
+	Text       string    `json:"text"                 db:"text"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func (m MessageTable) TableName() string {
+	return "_messages"
+}
+
+// NormalizeLocale lowercases and uses - as separator, ie: pt_BR -> pt-br
+func NormalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// DefaultLocale is the locale of the messages in the code (setting i18n/default_locale)
+func DefaultLocale() string {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_I18N, SETTING_KEY_I18N_DEFAULT_LOCALE); ok && s.TextValue != "" {
+		return NormalizeLocale(s.TextValue)
+	}
+	return DEFAULT_LOCALE
+}
+
+// ListMessages returns the translations, of one locale when given
+func ListMessages(locale string) ([]MessageTable, error) {
+	condition := orm.Condition{OrderBy: []string{"locale ASC", "message_key ASC"}}
+	if locale != "" {
+		condition.Field, condition.Operator, condition.Value = "locale", "=", NormalizeLocale(locale)
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(MessageTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []MessageTable{}, nil
+		}
+		return nil, err
+	}
+	messages := make([]MessageTable, 0, len(records))
+	for _, rec := range records {
+		messages = append(messages, object.MapToStructSlowDB[MessageTable](rec.Data))
+	}
+	return messages, nil
+}
+
+// SaveMessages creates or replaces the translations
+func SaveMessages(messages []MessageTable) error {
+	now := time.Now().UTC()
+	statements := make([]orm.ParametereizedSQL, 0, len(messages))
+	for _, m := range messages {
+		if m.Locale == "" || m.MessageKey == "" || m.Text == "" {
+			return ErrMessageInvalid
+		}
+		statements = append(statements, orm.ParametereizedSQL{
+			Query: "INSERT INTO " + m.TableName() + " (locale, message_key, text, updated_at) VALUES (?, ?, ?, ?) " +
+				"ON CONFLICT(locale, message_key) DO UPDATE SET text = excluded.text, updated_at = excluded.updated_at",
+			Values: []interface{}{NormalizeLocale(m.Locale), m.MessageKey, m.Text, now},
+		})
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+	_, err := CurrentNode.GetInternalConnection().ExecManySQLParameterized(statements)
+	invalidateMessages()
+	return err
+}
+
+// DeleteMessages removes one translation, or every translation of the locale when key is empty
+func DeleteMessages(locale, key string) error {
+	query := "DELETE FROM " + MessageTable{}.TableName() + " WHERE locale = ?"
+	values := []interface{}{NormalizeLocale(locale)}
+	if key != "" {
+		query += " AND message_key = ?"
+		values = append(values, key)
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: values})
+	invalidateMessages()
+	return res.Error
+}
+
+func invalidateMessages() {
+	messageMu.Lock()
+	messageCatalog = nil
+	messageMu.Unlock()
+}
+
+// catalog returns the translations by locale, reloaded after MESSAGE_CACHE_TTL
+func catalog() map[string]map[string]string {
+	messageMu.Lock()
+	defer messageMu.Unlock()
+	if messageCatalog != nil && time.Since(messageLoaded) < MESSAGE_CACHE_TTL {
+		return messageCatalog
+	}
+	loaded := map[string]map[string]string{}
+	// the table may not exist yet, then there is nothing to translate
+	if messages, err := ListMessages(""); err == nil {
+		for _, m := range messages {
+			if loaded[m.Locale] == nil {
+				loaded[m.Locale] = map[string]string{}
+			}
+			loaded[m.Locale][m.MessageKey] = m.Text
+		}
+	}
+	messageCatalog, messageLoaded = loaded, time.Now()
+	return messageCatalog
+}
+
+// NegotiateLocale picks the locale for an Accept-Language header (ie: "pt-BR,pt;q=0.9,en;q=0.5"):
+// the preferred range that has translations or is the default locale, a region falls back to its
+// language (pt-br -> pt). Returns the default locale when none matches.
+func NegotiateLocale(acceptLanguage string) string {
+	def := DefaultLocale()
+	if acceptLanguage == "" {
+		return def
+	}
+	type langRange struct {
+		tag string
+		q   float64
+	}
+	var ranges []langRange
+	for i, part := range strings.Split(acceptLanguage, ",") {
+		if i >= ACCEPT_LANGUAGE_LIMIT {
+			break
+		}
+		tag, params, _ := strings.Cut(part, ";")
+		tag = NormalizeLocale(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, langRange{tag, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	locales := catalog()
+	for _, r := range ranges {
+		if r.tag == "*" {
+			return def
+		}
+		for _, tag := range []string{r.tag, strings.SplitN(r.tag, "-", 2)[0]} {
+			if tag == def || strings.SplitN(def, "-", 2)[0] == tag {
+				return def
+			}
+			if _, ok := locales[tag]; ok {
+				return tag
+			}
+		}
+	}
+	return def
+}
+
+// TranslateMessage returns the message in the locale, false when there is no translation
+func TranslateMessage(locale, message string) (string, bool) {
+	if message == "" {
+		return message, false
+	}
+	text, ok := catalog()[locale][message]
+	if !ok {
+		return message, false
+	}
+	return text, true
+}
@@ -2,10 +2,16 @@ package suresql
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	orm "github.com/medatechnology/simpleorm"
 
 	"github.com/medatechnology/goutil/filesystem"
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
 	"github.com/medatechnology/goutil/print"
 	"github.com/medatechnology/goutil/simplelog"
 )
@@ -13,11 +19,108 @@ import (
 const (
 	MIGRATION_DIRECTORY          = "migrations/"
 	MIGRATION_UP_FILES_SIGNATURE = "_up.sql"
+	MIGRATION_TABLE              = "_migrations"
 )
 
+// Init phases recorded in InitProgress, in the order ConnectInternal goes through them
+const (
+	INIT_PHASE_STARTING  = "starting"
+	INIT_PHASE_CONNECTED = "connected"
+	INIT_PHASE_MIGRATING = "migrating"
+	INIT_PHASE_CONFIG    = "config_loaded"
+	INIT_PHASE_SETTINGS  = "settings_loaded"
+	INIT_PHASE_READY     = "ready"
+	INIT_PHASE_FAILED    = "failed"
+)
+
+// The tracking table cannot live in MIGRATION_DIRECTORY, it has to exist before the first file runs
+const migrationTableDDL = "CREATE TABLE IF NOT EXISTS " + MIGRATION_TABLE + ` (
+	name TEXT PRIMARY KEY,
+	statements_done INTEGER NOT NULL DEFAULT 0,
+	is_done BOOLEAN NOT NULL DEFAULT false,
+	applied_at DATETIME
+)`
+
+var ErrMigrationFailed = medaerror.MedaError{Message: "migration failed"}
+
+// MigrationTable records how far each migration file got. Statements are applied one by one and
+// the count is saved after each, so a crash in the middle of a file continues from the next
+// statement instead of running the whole file again (duplicate inserts, ALTER TABLE errors).
+type MigrationTable struct {
+	Name           string    `json:"name"             db:"name"`
+	StatementsDone int       `json:"statements_done"  db:"statements_done"`
+	IsDone         bool      `json:"is_done"          db:"is_done"`
+	AppliedAt      time.Time `json:"applied_at"       db:"applied_at"`
+}
+
+func (m MigrationTable) TableName() string {
+	return MIGRATION_TABLE
+}
+
+// InitProgress is what ConnectInternal has done so far, the last failure is kept so a
+// node that could not start says why (logs and /monitoring/health).
+type InitProgress struct {
+	Phase             string    `json:"phase"`
+	Connected         bool      `json:"connected"`
+	ConfigLoaded      bool      `json:"config_loaded"`
+	SettingsLoaded    bool      `json:"settings_loaded"`
+	SchemaVersion     string    `json:"schema_version,omitempty"`
+	PendingMigrations []string  `json:"pending_migrations,omitempty"`
+	Resumed           bool      `json:"resumed,omitempty"`
+	LastError         string    `json:"last_error,omitempty"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+var (
+	initProgressMu sync.RWMutex
+	initProgress   = InitProgress{Phase: INIT_PHASE_STARTING}
+)
+
+// GetInitProgress returns a copy of the current init progress
+func GetInitProgress() InitProgress {
+	initProgressMu.RLock()
+	defer initProgressMu.RUnlock()
+	p := initProgress
+	p.PendingMigrations = append([]string(nil), initProgress.PendingMigrations...)
+	return p
+}
+
+func updateInitProgress(fn func(p *InitProgress)) {
+	initProgressMu.Lock()
+	fn(&initProgress)
+	initProgress.UpdatedAt = CurrentClock.Now()
+	initProgressMu.Unlock()
+}
+
+func setInitPhase(phase string) {
+	updateInitProgress(func(p *InitProgress) {
+		p.Phase = phase
+		switch phase {
+		case INIT_PHASE_CONNECTED:
+			p.Connected = true
+		case INIT_PHASE_CONFIG:
+			p.ConfigLoaded = true
+		case INIT_PHASE_SETTINGS:
+			p.SettingsLoaded = true
+		case INIT_PHASE_READY:
+			p.LastError = ""
+		}
+	})
+}
+
+// initFailed records the error and returns it, so callers can just `return initFailed(err)`
+func initFailed(err error) error {
+	updateInitProgress(func(p *InitProgress) {
+		p.Phase = INIT_PHASE_FAILED
+		p.LastError = err.Error()
+	})
+	return err
+}
+
 // This is more like migrating data from MIGRATION_DIRECTORY
-// TODO: fix the printout to use metrics package so we can have the time elapsed information.
 // Make sure to call this AFTER connect internal is called!! Because we need the DB connection already.
+// It is resumable: files (and statements inside a file) already recorded in _migrations are skipped,
+// so after a crash or an error it can simply be called again. With force all files are run again.
 func InitDB(force bool) error {
 	// If DB is already init, then do not run again
 	if CurrentNode.Config.IsInitDone && !force {
@@ -25,47 +128,206 @@ func InitDB(force bool) error {
 		return ErrDBInitializedAlready
 	}
 
+	// a blank database has no _configs yet, which the migrations (and the UPDATE below) expect
+	if _, err := FirstBoot(); err != nil {
+		simplelog.LogErr(err, "cannot create internal tables")
+		return err
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQL(migrationTableDDL)
+	if res.Error != nil {
+		simplelog.LogErr(res.Error, "cannot create migration table")
+		return res.Error
+	}
+	applied := map[string]MigrationTable{}
+	if !force {
+		var err error
+		if applied, err = LoadMigrations(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := applyMigrationFiles(applied); err != nil {
+		return err
+	}
+	if err := applyBootstrap(BootstrapFile(), applied); err != nil {
+		return err
+	}
+	if err := seedDefaultSettings(); err != nil {
+		return err
+	}
+	res = CurrentNode.GetInternalConnection().ExecOneSQL("UPDATE " + CurrentNode.Config.TableName() + " SET is_init_done=true")
+	if res.Error != nil {
+		// every file is recorded already, calling InitDB again only runs this update
+		simplelog.LogErr(res.Error, "cannot update settings table")
+		return res.Error
+	}
+	return nil
+}
+
+// MigratePending applies the migration files that are not in _migrations yet to a database that is
+// initialized already, ie: after an upgrade. Databases initialized before migrations were tracked are
+// left alone (which of the files they have is unknown), it returns how many files were applied.
+func MigratePending() (int, error) {
+	res := CurrentNode.GetInternalConnection().ExecOneSQL(migrationTableDDL)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	applied, err := LoadMigrations()
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applyMigrationFiles(applied)
+}
+
+// applyMigrationFiles runs every file of MIGRATION_DIRECTORY that is not done in applied
+func applyMigrationFiles(applied map[string]MigrationTable) (int, error) {
+	count := 0
 	simplelog.DEBUG_LEVEL = 1
 	allUpFiles := filesystem.Dir(MIGRATION_DIRECTORY, MIGRATION_UP_FILES_SIGNATURE)
 	fmt.Printf("\nMigration directory has %s files, proceed migration...",
 		print.Colored(fmt.Sprintf("%d", len(allUpFiles)), print.ColorGreen))
 	for _, ef := range allUpFiles {
+		done := applied[ef.Name()]
+		if done.IsDone {
+			continue
+		}
 		fContent := filesystem.More(MIGRATION_DIRECTORY + ef.Name())
 		sqlCommands := orm.ConvertSQLCommands(fContent)
 		fmt.Printf("Migrating file: %s - lines: %d - commands: %d",
 			print.Colored(ef.Name(), print.ColorBlue), len(fContent), len(sqlCommands))
-		// simplelog.LogFormat("Number of lines : %d", len(fContent))
-
-		// DEBUG: print all the commands
-		// for i, c := range sqlCommands {
-		// 	fmt.Printf("%d:%s\n", i+1, c)
-		// }
-		// res, err := db.ExecManySQL(sqlCommands)
-
-		res, err := CurrentNode.InternalConnection.ExecManySQL(sqlCommands)
-		if err != nil {
-			// NOTE: if one of the file has error, then cannot continue just return. Meaning could potentially initialized partially
-			// TODO: create rollback functionality here.
-			simplelog.LogErr(err, "cannot init migrate")
+		steps := make([]orm.ParametereizedSQL, len(sqlCommands))
+		for i, c := range sqlCommands {
+			steps[i] = orm.ParametereizedSQL{Query: c}
+		}
+		if err := applyMigrationSteps(ef.Name(), steps, done); err != nil {
+			return count, err
+		}
+		count++
+		updateInitProgress(func(p *InitProgress) { p.SchemaVersion = ef.Name() })
+	}
+	return count, nil
+}
+
+// applyMigrationSteps runs the statements one by one starting after the ones done already, the count is
+// saved after each statement so calling it again continues from the first statement that did not finish
+func applyMigrationSteps(name string, steps []orm.ParametereizedSQL, done MigrationTable) error {
+	if done.StatementsDone > 0 {
+		fmt.Printf(" - resuming at: %d", done.StatementsDone+1)
+		updateInitProgress(func(p *InitProgress) { p.Resumed = true })
+	}
+	start := CurrentClock.Now()
+	for i := done.StatementsDone; i < len(steps); i++ {
+		var res orm.BasicSQLResult
+		if len(steps[i].Values) == 0 {
+			res = CurrentNode.GetInternalConnection().ExecOneSQL(steps[i].Query)
+		} else {
+			res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(steps[i])
+		}
+		if res.Error != nil {
+			simplelog.LogErr(res.Error, "cannot init migrate")
+			return medaerror.Errorf("%s: %s statement %d: %v", ErrMigrationFailed.Message, name, i+1, res.Error)
+		}
+		if err := saveMigration(name, i+1, i+1 == len(steps)); err != nil {
+			return err
+		}
+	}
+	if len(steps) == 0 {
+		if err := saveMigration(name, 0, true); err != nil {
+			return err
+		}
+	}
+	fmt.Printf(" executed in : %s\n", CurrentClock.Since(start))
+	return nil
+}
+
+// applyBootstrap runs the bootstrap file (if there is one) after the migrations, it is recorded in
+// _migrations like a migration file so it is applied once and resumes the same way
+func applyBootstrap(path string, applied map[string]MigrationTable) error {
+	name := bootstrapMigrationName(path)
+	done := applied[name]
+	if done.IsDone {
+		return nil
+	}
+	b, ok, err := LoadBootstrap(path)
+	if err != nil {
+		simplelog.LogErr(err, "cannot load bootstrap file")
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if len(b.Users) > 0 {
+		// passwords are hashed with the API key and client ID of the node, the config row exists by now
+		internal := CurrentNode.GetInternalConnection()
+		if err := LoadConfigFromDB(&internal); err != nil {
 			return err
 		}
-		fmt.Printf("%d sql commands executed in : %sms\n", len(res), orm.SecondToMsString(orm.TotalTimeElapsedInSecond(res)))
+	}
+	steps, err := b.Steps()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Bootstrap file: %s - schema: %d - settings: %d - users: %d",
+		print.Colored(path, print.ColorBlue), len(b.Schema), len(b.Settings), len(b.Users))
+	return applyMigrationSteps(name, steps, done)
+}
 
-		// simplelog.LogInfoAny("", 1, commands)
-		// longSQL := strings.Join(fContent[:], "\n")
-		// simplelog.LogThis(longSQL)
+// LoadMigrations returns the _migrations records by file name
+func LoadMigrations() (map[string]MigrationTable, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectMany(MIGRATION_TABLE)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return map[string]MigrationTable{}, nil
+		}
+		return nil, err
+	}
+	applied := make(map[string]MigrationTable, len(records))
+	for _, r := range records {
+		m := object.MapToStructSlowDB[MigrationTable](r.Data)
+		applied[m.Name] = m
+	}
+	return applied, nil
+}
 
-		// simplelog.LogThis(fContent...) // print in 1 line
-		// for _, str := range fContent {
-		// simplelog.LogFormat("%s", str)
-		// }
+// PendingMigrations lists the files in MIGRATION_DIRECTORY that are not fully applied and the schema
+// version, which is the last fully applied file. Databases initialized before migrations were tracked
+// have no _migrations table, for those the version is empty and nothing is reported as pending.
+func PendingMigrations() (string, []string, error) {
+	applied, err := LoadMigrations()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(applied) == 0 {
+		return "", nil, nil
 	}
-	res := CurrentNode.InternalConnection.ExecOneSQL("UPDATE " + CurrentNode.Config.TableName() + " SET is_init_done=true")
+	version := ""
+	done := make([]string, 0, len(applied))
+	for name, m := range applied {
+		if m.IsDone && !strings.HasPrefix(name, BOOTSTRAP_MIGRATION_PREFIX) {
+			done = append(done, name)
+		}
+	}
+	sort.Strings(done)
+	if len(done) > 0 {
+		version = done[len(done)-1]
+	}
+	pending := []string{}
+	for _, ef := range filesystem.Dir(MIGRATION_DIRECTORY, MIGRATION_UP_FILES_SIGNATURE) {
+		if !applied[ef.Name()].IsDone {
+			pending = append(pending, ef.Name())
+		}
+	}
+	return version, pending, nil
+}
+
+func saveMigration(name string, statements int, isDone bool) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + MIGRATION_TABLE + " (name, statements_done, is_done, applied_at) VALUES (?, ?, ?, ?)" +
+			" ON CONFLICT(name) DO UPDATE SET statements_done=excluded.statements_done, is_done=excluded.is_done, applied_at=excluded.applied_at",
+		Values: []interface{}{name, statements, isDone, CurrentClock.Now().UTC()},
+	})
 	if res.Error != nil {
-		// NOTE: if one of the file has error, then cannot continue just return. Meaning could potentially initialized partially
-		// TODO: create rollback functionality here.
-		simplelog.LogErr(res.Error, "cannot update settings table")
-		return res.Error
+		simplelog.LogErr(res.Error, "cannot record migration progress")
 	}
-	return nil
+	return res.Error
 }
@@ -0,0 +1,121 @@
+package suresql
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Generated IDs: an insert with return_ids answers the primary key of every record, so a client can insert
+// the rows referencing it next. A key given in the record is returned as it is. Otherwise PostgreSQL and
+// CockroachDB return it with RETURNING, the others report the last_insert_id of the statement (the rowid
+// on rqlite, AUTO_INCREMENT on MySQL), that is why every record is inserted by a statement of its own.
+
+// InsertReturningIDs inserts the records one statement each and returns the results and the key of every
+// record in order, nil for a record whose key is not known. Records before a failed one stay inserted.
+func InsertReturningIDs(db SureSQLDB, records []orm.DBRecord) ([]orm.BasicSQLResult, []interface{}, error) {
+	ids := make([]interface{}, len(records))
+	keys := map[string][]string{}
+	for _, rec := range records {
+		if _, ok := keys[rec.TableName]; !ok {
+			keys[rec.TableName] = primaryKeyColumns(rec.TableName)
+		}
+	}
+
+	if CurrentDialect().Name == DialectPostgres.Name {
+		results := make([]orm.BasicSQLResult, 0, len(records))
+		for i, rec := range records {
+			result, id, err := insertReturning(db, rec, keys[rec.TableName])
+			results = append(results, result)
+			if err != nil {
+				return results, ids, err
+			}
+			ids[i] = id
+		}
+		return results, ids, nil
+	}
+
+	var results []orm.BasicSQLResult
+	if len(records) == 1 {
+		results = []orm.BasicSQLResult{db.InsertOneDBRecord(records[0], false)}
+	} else {
+		var err error
+		if results, err = db.InsertManyDBRecords(records, false); err != nil {
+			return results, ids, err
+		}
+	}
+	for i, rec := range records {
+		if i >= len(results) {
+			break
+		}
+		if results[i].Error != nil {
+			return results, ids, results[i].Error
+		}
+		if id, ok := recordKey(rec, keys[rec.TableName]); ok {
+			ids[i] = id
+		} else if results[i].LastInsertID > 0 {
+			ids[i] = results[i].LastInsertID
+		}
+	}
+	return results, ids, nil
+}
+
+// insertReturning inserts the record with RETURNING of its key columns
+func insertReturning(db SureSQLDB, rec orm.DBRecord, key []string) (orm.BasicSQLResult, interface{}, error) {
+	if id, ok := recordKey(rec, key); ok || len(key) == 0 {
+		result := db.InsertOneDBRecord(rec, false)
+		return result, id, result.Error
+	}
+	start := time.Now()
+	b := NewQueryBuilder(CurrentDialect())
+	columns := make([]string, 0, len(rec.Data))
+	for column := range rec.Data {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	query := "INSERT INTO " + rec.TableName + b.insertValues(rec, columns) + " RETURNING " + strings.Join(key, ", ")
+	rows, err := db.SelectOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: b.Args()})
+	result := orm.BasicSQLResult{Timing: time.Since(start).Seconds(), Error: err}
+	if err != nil || len(rows) == 0 {
+		return result, nil, err
+	}
+	result.RowsAffected = 1
+	id, _ := recordKey(rows[0], key)
+	return result, id, nil
+}
+
+// recordKey is the value of the key columns in the record, a map when the key has more than one column
+func recordKey(rec orm.DBRecord, key []string) (interface{}, bool) {
+	if len(key) == 0 {
+		return nil, false
+	}
+	values := make(map[string]interface{}, len(key))
+	for _, column := range key {
+		v, ok := rec.Data[column]
+		if !ok || v == nil {
+			return nil, false
+		}
+		values[column] = v
+	}
+	if len(key) == 1 {
+		return values[key[0]], true
+	}
+	return values, true
+}
+
+// primaryKeyColumns are the primary key columns of the table from the live schema, none when it is unknown
+func primaryKeyColumns(table string) []string {
+	columns, err := TableSchema(table, false)
+	if err != nil {
+		return nil
+	}
+	var key []string
+	for _, c := range columns {
+		if c.PrimaryKey {
+			key = append(key, c.Name)
+		}
+	}
+	return key
+}
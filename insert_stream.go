@@ -0,0 +1,231 @@
+package suresql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Streamed inserts: /db/api/insert takes an NDJSON body (one record per line) besides the JSON array.
+// The lines are decoded, validated and written insert_stream/chunk_records at a time, so the server holds
+// the records of one chunk and never the decoded array. A chunk is written when it is valid, a bad line
+// stops the request and the chunks before stay inserted. Loads larger than the request size limit are sent
+// as the parts of an upload: the server remembers how many records of every part were inserted, a part sent
+// again (ie: a retry after a timeout or a failed chunk) skips them and continues with the rest.
+
+const (
+	INSERT_STREAM_CONTENT_TYPE       = "application/x-ndjson"
+	INSERT_STREAM_DEFAULT_CHUNK      = 1000
+	INSERT_STREAM_MAX_CHUNK          = 10000
+	INSERT_STREAM_DEFAULT_UPLOAD_TTL = 3600
+	INSERT_STREAM_MAX_UPLOAD_ID      = 128
+)
+
+var (
+	ErrStreamRecord      = medaerror.MedaError{Message: "invalid record on line"}
+	ErrStreamUploadID    = medaerror.MedaError{Message: "upload id is 1 to 128 characters and needs a part number from 1"}
+	ErrStreamPartRunning = medaerror.MedaError{Message: "this part of the upload is being inserted by another request"}
+)
+
+// InsertStreamChunk reads insert_stream/chunk_records
+func InsertStreamChunk() int {
+	n := INSERT_STREAM_DEFAULT_CHUNK
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_INSERT_STREAM, SETTING_KEY_INSERT_STREAM_CHUNK); ok && s.IntValue > 0 {
+		n = s.IntValue
+	}
+	if n > INSERT_STREAM_MAX_CHUNK {
+		n = INSERT_STREAM_MAX_CHUNK
+	}
+	return n
+}
+
+// RecordStream decodes the records of an NDJSON body, a line is a record ({"TableName": ..., "Data": {...}})
+// or only its columns when the table is given. Blank lines are skipped.
+type RecordStream struct {
+	streamLines
+	r     *bufio.Reader
+	table string
+}
+
+// streamLines keeps the lines of the records of the last chunk, the streams of insert_stream.go and
+// csv_import.go embed it so a problem is reported with the line of its record
+type streamLines struct {
+	line  int
+	lines []int // line of every record of the last chunk
+}
+
+func NewRecordStream(r io.Reader, table string) *RecordStream {
+	return &RecordStream{r: bufio.NewReader(r), table: table}
+}
+
+// Next returns up to max records, io.EOF when the body has none left. A line that is not a record is
+// ErrStreamRecord, the records before it are returned with the error.
+func (s *RecordStream) Next(max int) ([]orm.DBRecord, error) {
+	records := make([]orm.DBRecord, 0, max)
+	s.lines = s.lines[:0]
+	for len(records) < max {
+		line, err := s.readLine()
+		if err != nil {
+			if err == io.EOF && len(records) > 0 {
+				return records, nil
+			}
+			return records, err
+		}
+		rec, err := s.decode(line)
+		if err != nil {
+			return records, medaerror.Errorf("%s %d: %s", ErrStreamRecord.Message, s.line, err.Error())
+		}
+		records = append(records, rec)
+		s.lines = append(s.lines, s.line)
+	}
+	return records, nil
+}
+
+// Skip passes over n records without decoding them, it returns how many were there
+func (s *RecordStream) Skip(n int) (int, error) {
+	for i := 0; i < n; i++ {
+		if _, err := s.readLine(); err != nil {
+			if err == io.EOF {
+				return i, nil
+			}
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// Line is the last line read, RecordLine the line of a record of the last chunk and RecordLines all of
+// them (until the next chunk is read)
+func (s *streamLines) Line() int {
+	return s.line
+}
+
+func (s *streamLines) RecordLine(i int) int {
+	if i < 0 || i >= len(s.lines) {
+		return s.line
+	}
+	return s.lines[i]
+}
+
+func (s *streamLines) RecordLines() []int {
+	return s.lines
+}
+
+// readLine returns the next line that is not blank
+func (s *RecordStream) readLine() ([]byte, error) {
+	for {
+		line, err := s.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return nil, err
+		}
+		s.line++
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *RecordStream) decode(line []byte) (orm.DBRecord, error) {
+	if s.table != "" {
+		var data map[string]interface{}
+		if err := json.Unmarshal(line, &data); err != nil {
+			return orm.DBRecord{}, err
+		}
+		if len(data) == 0 {
+			return orm.DBRecord{}, medaerror.NewString("a record needs at least one column")
+		}
+		return orm.DBRecord{TableName: s.table, Data: data}, nil
+	}
+	var rec orm.DBRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return orm.DBRecord{}, err
+	}
+	if rec.TableName == "" || len(rec.Data) == 0 {
+		return orm.DBRecord{}, medaerror.NewString("a record needs TableName and Data, or the table query parameter")
+	}
+	return rec, nil
+}
+
+// StreamUploadTracker remembers the records inserted of every part of the uploads, per user
+type StreamUploadTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*streamUpload
+}
+
+type streamUpload struct {
+	parts   map[int]int // part: records inserted
+	running map[int]bool
+	updated time.Time
+}
+
+var StreamUploads = &StreamUploadTracker{uploads: make(map[string]*streamUpload)}
+
+// ValidateUploadPart checks the upload id and part number of an upload request
+func ValidateUploadPart(upload string, part int) error {
+	if len(upload) == 0 || len(upload) > INSERT_STREAM_MAX_UPLOAD_ID || part < 1 {
+		return ErrStreamUploadID
+	}
+	return nil
+}
+
+// Begin claims the part, it returns the records of the part inserted by earlier requests
+func (t *StreamUploadTracker) Begin(username, upload string, part int) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+	key := username + "\x00" + upload
+	u, ok := t.uploads[key]
+	if !ok {
+		u = &streamUpload{parts: make(map[int]int), running: make(map[int]bool)}
+		t.uploads[key] = u
+	}
+	if u.running[part] {
+		return 0, ErrStreamPartRunning
+	}
+	u.running[part] = true
+	u.updated = time.Now()
+	return u.parts[part], nil
+}
+
+// Finish releases the part, inserted is the total of its records inserted so far. It returns the records
+// inserted by all parts of the upload.
+func (t *StreamUploadTracker) Finish(username, upload string, part, inserted int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.uploads[username+"\x00"+upload]
+	if !ok {
+		return inserted
+	}
+	delete(u.running, part)
+	u.parts[part] = inserted
+	u.updated = time.Now()
+	total := 0
+	for _, n := range u.parts {
+		total += n
+	}
+	return total
+}
+
+// expire forgets the uploads idle for insert_stream/upload_ttl_sec, caller holds the lock
+func (t *StreamUploadTracker) expire() {
+	ttl := INSERT_STREAM_DEFAULT_UPLOAD_TTL
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_INSERT_STREAM, SETTING_KEY_INSERT_STREAM_UPLOAD_TTL); ok && s.IntValue > 0 {
+		ttl = s.IntValue
+	}
+	cutoff := time.Now().Add(-time.Duration(ttl) * time.Second)
+	for key, u := range t.uploads {
+		if len(u.running) == 0 && u.updated.Before(cutoff) {
+			delete(t.uploads, key)
+		}
+	}
+}
@@ -0,0 +1,583 @@
+package suresql
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Record-level checksums, for tables listed in _integrity_tables: rows inserted through /db/api/insert
+// get an HMAC-SHA256 of their columns in _checksum, keyed with SURESQL_INTEGRITY_KEY (the master key
+// when not set). /suresql/verify recomputes it for every row, so a row changed outside SureSQL (or
+// corrupted on disk) shows up as a mismatch. Values are compared as text, 5, 5.0 and "5" are the same,
+// so the checksum survives the type conversions of the DBMS. Rows changed on purpose with raw SQL
+// are accepted again with /suresql/integrity/rehash.
+
+const (
+	INTEGRITY_CHECKSUM_COLUMN    = "_checksum"
+	INTEGRITY_KEY                = "SURESQL_INTEGRITY_KEY"
+	INTEGRITY_BATCH_SIZE         = 500
+	INTEGRITY_MAX_REPORTED       = 1000 // mismatched keys listed in a report, all are counted
+	INTEGRITY_CACHE_TTL          = 30 * time.Second
+	INTEGRITY_CHECK_INTERVAL     = 10 * time.Minute
+	INTEGRITY_REASON_MISMATCH    = "mismatch"
+	INTEGRITY_REASON_MISSING     = "missing"
+	DEFAULT_INTEGRITY_KEY_COLUMN = "id"
+)
+
+var (
+	ErrIntegrityInvalid    = medaerror.MedaError{Message: "invalid integrity table"}
+	ErrIntegrityNotFound   = medaerror.MedaError{Message: "table has no integrity checksums"}
+	ErrIntegrityKeyMissing = medaerror.MedaError{Message: "integrity checksums need SURESQL_INTEGRITY_KEY or SURESQL_MASTER_KEY"}
+)
+
+// IntegrityTable is a table whose rows carry a checksum
+type IntegrityTable struct {
+	ID           int       `json:"id,omitempty"          db:"id"`
+	TableName_   string    `json:"table_name"            db:"table_name"`
+	KeyColumn    string    `json:"key_column"            db:"key_column"` // identifies the rows in the reports
+	Columns      string    `json:"columns"               db:"columns"`    // comma separated, empty is the columns without a default
+	Enabled      bool      `json:"enabled"               db:"enabled"`
+	VerifiedAt   time.Time `json:"verified_at,omitempty" db:"verified_at"`
+	VerifiedRows int       `json:"verified_rows"         db:"verified_rows"`
+	Mismatches   int       `json:"mismatches"            db:"mismatches"`
+	UpdatedAt    time.Time `json:"updated_at,omitempty"  db:"updated_at"`
+}
+
+func (t IntegrityTable) TableName() string {
+	return "_integrity_tables"
+}
+
+// ColumnList returns the checksummed columns, sorted
+func (t IntegrityTable) ColumnList() []string {
+	columns := []string{}
+	for _, c := range strings.Split(t.Columns, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			columns = append(columns, c)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// Validate checks the table and column names
+func (t IntegrityTable) Validate() error {
+	if err := ValidateTableName(t.TableName_, false); err != nil {
+		return err
+	}
+	if err := ValidateIdentifier(t.KeyColumn); err != nil {
+		return err
+	}
+	for _, c := range t.ColumnList() {
+		if err := ValidateIdentifier(c); err != nil {
+			return err
+		}
+		if c == t.KeyColumn || c == INTEGRITY_CHECKSUM_COLUMN {
+			return medaerror.Errorf("%s: %s cannot be in columns", ErrIntegrityInvalid.Message, c)
+		}
+	}
+	return nil
+}
+
+// IntegrityMismatch is a row whose checksum is wrong or missing
+type IntegrityMismatch struct {
+	Key    interface{} `json:"key"`
+	Reason string      `json:"reason"`
+}
+
+// IntegrityReport is the result of verifying one table
+type IntegrityReport struct {
+	Table          string              `json:"table"`
+	Rows           int                 `json:"rows"`
+	Mismatches     int                 `json:"mismatches"` // wrong and missing checksums
+	MismatchedRows []IntegrityMismatch `json:"mismatched_rows,omitempty"`
+	Truncated      bool                `json:"truncated,omitempty"` // more than INTEGRITY_MAX_REPORTED mismatches
+	StartedAt      time.Time           `json:"started_at"`
+	DurationMs     int64               `json:"duration_ms"`
+	Error          string              `json:"error,omitempty"`
+}
+
+type integrityCacheEntry struct {
+	tables map[string]IntegrityTable
+	loaded time.Time
+}
+
+var (
+	integrityMu    sync.Mutex
+	integrityCache integrityCacheEntry
+)
+
+// ListIntegrityTables returns the tables with checksums
+func ListIntegrityTables() ([]IntegrityTable, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(IntegrityTable{}.TableName(), &orm.Condition{OrderBy: []string{"table_name ASC"}})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []IntegrityTable{}, nil
+		}
+		return nil, err
+	}
+	tables := make([]IntegrityTable, 0, len(records))
+	for _, rec := range records {
+		tables = append(tables, object.MapToStructSlowDB[IntegrityTable](rec.Data))
+	}
+	return tables, nil
+}
+
+// GetIntegrityTable returns the checksum settings of the table
+func GetIntegrityTable(table string) (IntegrityTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(IntegrityTable{}.TableName(), &orm.Condition{Field: "table_name", Operator: "=", Value: table})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return IntegrityTable{}, ErrIntegrityNotFound
+		}
+		return IntegrityTable{}, err
+	}
+	return object.MapToStructSlowDB[IntegrityTable](rec.Data), nil
+}
+
+// PrepareIntegrityTable fills the defaults (key column id, the columns without a default) and checks
+// the columns exist in the table
+func PrepareIntegrityTable(t IntegrityTable) (IntegrityTable, error) {
+	if t.KeyColumn == "" {
+		t.KeyColumn = DEFAULT_INTEGRITY_KEY_COLUMN
+	}
+	if err := t.Validate(); err != nil {
+		return t, err
+	}
+	columns, err := TableSchema(t.TableName_, true)
+	if err != nil {
+		return t, err
+	}
+	if findColumn(columns, t.KeyColumn) == nil {
+		return t, medaerror.Errorf("%s: key column %s does not exist", ErrIntegrityInvalid.Message, t.KeyColumn)
+	}
+	if t.Columns == "" {
+		names := []string{}
+		for _, c := range columns {
+			if c.Name != t.KeyColumn && c.Name != INTEGRITY_CHECKSUM_COLUMN && !c.HasDefault {
+				names = append(names, c.Name)
+			}
+		}
+		t.Columns = strings.Join(names, ",")
+	}
+	if len(t.ColumnList()) == 0 {
+		return t, medaerror.Errorf("%s: no columns to checksum", ErrIntegrityInvalid.Message)
+	}
+	for _, c := range t.ColumnList() {
+		if findColumn(columns, c) == nil {
+			return t, medaerror.Errorf("%s: column %s does not exist", ErrIntegrityInvalid.Message, c)
+		}
+	}
+	return t, nil
+}
+
+// SaveIntegrityTable adds the _checksum column to the table (when missing) and saves the settings.
+// Existing rows have no checksum yet, rehash them to start from the current content.
+func SaveIntegrityTable(t IntegrityTable) (IntegrityTable, error) {
+	t, err := PrepareIntegrityTable(t)
+	if err != nil {
+		return t, err
+	}
+	columns, err := TableSchema(t.TableName_, false)
+	if err != nil {
+		return t, err
+	}
+	if findColumn(columns, INTEGRITY_CHECKSUM_COLUMN) == nil {
+		res := CurrentNode.GetInternalConnection().ExecOneSQL("ALTER TABLE " + t.TableName_ + " ADD COLUMN " + INTEGRITY_CHECKSUM_COLUMN + " TEXT")
+		if res.Error != nil {
+			return t, res.Error
+		}
+		InvalidateTableSchema(t.TableName_)
+	}
+
+	t.UpdatedAt = CurrentClock.Now().UTC()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + t.TableName() + " (table_name, key_column, columns, enabled, updated_at) VALUES (?, ?, ?, ?, ?)" +
+			" ON CONFLICT(table_name) DO UPDATE SET key_column = excluded.key_column, columns = excluded.columns, enabled = excluded.enabled, updated_at = excluded.updated_at",
+		Values: []interface{}{t.TableName_, t.KeyColumn, t.Columns, t.Enabled, t.UpdatedAt},
+	})
+	invalidateIntegrityTables()
+	if res.Error != nil {
+		return t, res.Error
+	}
+	return GetIntegrityTable(t.TableName_)
+}
+
+// DeleteIntegrityTable stops maintaining the checksums of the table, the _checksum column is kept
+func DeleteIntegrityTable(table string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + IntegrityTable{}.TableName() + " WHERE table_name = ?",
+		Values: []interface{}{table},
+	})
+	invalidateIntegrityTables()
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrIntegrityNotFound
+	}
+	return res.Error
+}
+
+func invalidateIntegrityTables() {
+	integrityMu.Lock()
+	integrityCache = integrityCacheEntry{}
+	integrityMu.Unlock()
+}
+
+// integrityTable returns the enabled checksum settings of the table, cached for a short time
+func integrityTable(table string) (IntegrityTable, bool) {
+	integrityMu.Lock()
+	entry := integrityCache
+	integrityMu.Unlock()
+	if entry.tables == nil || CurrentClock.Since(entry.loaded) >= INTEGRITY_CACHE_TTL {
+		// the table of settings may not exist yet, nothing to maintain
+		tables, _ := ListIntegrityTables()
+		entry = integrityCacheEntry{tables: map[string]IntegrityTable{}, loaded: CurrentClock.Now()}
+		for _, t := range tables {
+			if t.Enabled {
+				entry.tables[strings.ToLower(t.TableName_)] = t
+			}
+		}
+		integrityMu.Lock()
+		integrityCache = entry
+		integrityMu.Unlock()
+	}
+	t, ok := entry.tables[strings.ToLower(table)]
+	return t, ok
+}
+
+// integrityKey is SURESQL_INTEGRITY_KEY, or the master key of the secrets
+func integrityKey() ([]byte, error) {
+	for _, name := range []string{INTEGRITY_KEY, SECRET_MASTER_KEY} {
+		key, err := GetSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		if key != "" {
+			return []byte(key), nil
+		}
+	}
+	return nil, ErrIntegrityKeyMissing
+}
+
+// RowChecksum is the hex HMAC-SHA256 of the columns of the row, a missing column counts as null
+func RowChecksum(key []byte, row map[string]interface{}, columns []string) string {
+	mac := hmac.New(sha256.New, key)
+	for _, c := range columns {
+		value, ok := checksumValue(row[c])
+		mac.Write([]byte(c))
+		if ok {
+			mac.Write([]byte{0x1f})
+			mac.Write([]byte(value))
+		}
+		mac.Write([]byte{0x1e})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checksumValue is the text of a value as the DBMS returns it, false for null. Numbers (and text that
+// is a number) are formatted the same way, booleans are 1 and 0.
+func checksumValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 64), true
+		}
+		return x, true
+	case []byte:
+		return string(x), true
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano), true
+	}
+	if f, ok := numericValue(v); ok {
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// ApplyRecordChecksums sets _checksum of the records of integrity tables (changing them), returning
+// the records that could not get one
+func ApplyRecordChecksums(records []orm.DBRecord) []RecordFieldError {
+	var errs []RecordFieldError
+	var key []byte
+	for i := range records {
+		rec := &records[i]
+		if rec.Data == nil {
+			continue
+		}
+		t, ok := integrityTable(rec.TableName)
+		if !ok {
+			continue
+		}
+		if key == nil {
+			var err error
+			if key, err = integrityKey(); err != nil {
+				errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Field: INTEGRITY_CHECKSUM_COLUMN, Message: err.Error()})
+				continue
+			}
+		}
+		rec.Data[INTEGRITY_CHECKSUM_COLUMN] = RowChecksum(key, rec.Data, t.ColumnList())
+	}
+	return errs
+}
+
+// scanIntegrityRows calls fn for every row of the table in key order, a page at a time
+func scanIntegrityRows(ctx context.Context, t IntegrityTable, fn func(row map[string]interface{}) error) error {
+	var last interface{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		condition := orm.Condition{OrderBy: []string{t.KeyColumn + " ASC"}, Limit: INTEGRITY_BATCH_SIZE}
+		if last != nil {
+			condition.Field, condition.Operator, condition.Value = t.KeyColumn, ">", last
+		}
+		query, err := BuildSelect(CurrentDialect(), t.TableName_, &condition)
+		if err != nil {
+			return err
+		}
+		records, err := CurrentNode.GetInternalConnection().SelectOneSQLParameterized(query)
+		if err != nil && !IsNoRowsError(err) {
+			return err
+		}
+		for _, rec := range records {
+			if err := fn(rec.Data); err != nil {
+				return err
+			}
+			last = rec.Data[t.KeyColumn]
+		}
+		if len(records) < INTEGRITY_BATCH_SIZE || last == nil {
+			return nil
+		}
+	}
+}
+
+// VerifyIntegrity recomputes the checksum of every row of the table, mismatches are recorded as a
+// security event and the counts are kept in _integrity_tables
+func VerifyIntegrity(ctx context.Context, table string) (IntegrityReport, error) {
+	report := IntegrityReport{Table: table, StartedAt: CurrentClock.Now().UTC()}
+	t, err := GetIntegrityTable(table)
+	if err != nil {
+		return report, err
+	}
+	key, err := integrityKey()
+	if err != nil {
+		return report, err
+	}
+	columns := t.ColumnList()
+	err = scanIntegrityRows(ctx, t, func(row map[string]interface{}) error {
+		report.Rows++
+		stored, _ := row[INTEGRITY_CHECKSUM_COLUMN].(string)
+		reason := ""
+		if stored == "" {
+			reason = INTEGRITY_REASON_MISSING
+		} else if !hmac.Equal([]byte(stored), []byte(RowChecksum(key, row, columns))) {
+			reason = INTEGRITY_REASON_MISMATCH
+		}
+		if reason != "" {
+			report.Mismatches++
+			if len(report.MismatchedRows) < INTEGRITY_MAX_REPORTED {
+				report.MismatchedRows = append(report.MismatchedRows, IntegrityMismatch{Key: row[t.KeyColumn], Reason: reason})
+			} else {
+				report.Truncated = true
+			}
+		}
+		return nil
+	})
+	report.DurationMs = CurrentClock.Since(report.StartedAt).Milliseconds()
+	if err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+
+	CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "UPDATE " + t.TableName() + " SET verified_at = ?, verified_rows = ?, mismatches = ? WHERE id = ?",
+		Values: []interface{}{report.StartedAt, report.Rows, report.Mismatches, t.ID},
+	})
+	if report.Mismatches > 0 {
+		RecordSecurityEvent(SecurityEventTable{
+			EventType: SECURITY_EVENT_INTEGRITY,
+			Severity:  SECURITY_SEVERITY_CRITICAL,
+			Message:   fmt.Sprintf("table %s: %d of %d rows failed the checksum", table, report.Mismatches, report.Rows),
+		})
+	}
+	return report, nil
+}
+
+// VerifyAllIntegrity verifies the enabled tables, a table that fails has the error in its report
+func VerifyAllIntegrity(ctx context.Context) ([]IntegrityReport, error) {
+	tables, err := ListIntegrityTables()
+	if err != nil {
+		return nil, err
+	}
+	reports := []IntegrityReport{}
+	for _, t := range tables {
+		if !t.Enabled {
+			continue
+		}
+		report, err := VerifyIntegrity(ctx, t.TableName_)
+		if err != nil {
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// RehashIntegrity writes the checksum of the current content of the rows with the keys, of all rows
+// when keys is empty. Returns the rows updated.
+func RehashIntegrity(ctx context.Context, table string, keys []interface{}) (int, error) {
+	t, err := GetIntegrityTable(table)
+	if err != nil {
+		return 0, err
+	}
+	key, err := integrityKey()
+	if err != nil {
+		return 0, err
+	}
+	wanted := map[string]bool{}
+	for _, k := range keys {
+		v, _ := checksumValue(k)
+		wanted[v] = true
+	}
+	columns := t.ColumnList()
+	updated := 0
+	err = scanIntegrityRows(ctx, t, func(row map[string]interface{}) error {
+		if len(wanted) > 0 {
+			if v, _ := checksumValue(row[t.KeyColumn]); !wanted[v] {
+				return nil
+			}
+		}
+		sum := RowChecksum(key, row, columns)
+		if stored, _ := row[INTEGRITY_CHECKSUM_COLUMN].(string); stored == sum {
+			return nil
+		}
+		b := NewQueryBuilder(CurrentDialect())
+		query := "UPDATE " + t.TableName_ + " SET " + INTEGRITY_CHECKSUM_COLUMN + " = " + b.Arg(sum) + " WHERE " + t.KeyColumn + " = " + b.Arg(row[t.KeyColumn])
+		res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: b.Args()})
+		if res.Error != nil {
+			return res.Error
+		}
+		updated++
+		return nil
+	})
+	return updated, err
+}
+
+// IntegrityVerifier verifies the tables on the leader every verify_hours (setting integrity/verify_hours)
+type IntegrityVerifier struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	cancel   context.CancelFunc
+}
+
+var (
+	IntegrityVerify   *IntegrityVerifier
+	integrityInitOnce sync.Once
+)
+
+// InitIntegrityVerifier initializes the global integrity verifier
+func InitIntegrityVerifier() {
+	integrityInitOnce.Do(func() {
+		IntegrityVerify = &IntegrityVerifier{stopChan: make(chan struct{})}
+	})
+}
+
+// StartIntegrityVerifier starts the periodic verification
+func StartIntegrityVerifier(ctx context.Context) {
+	if IntegrityVerify == nil {
+		InitIntegrityVerifier()
+	}
+	IntegrityVerify.Start(ctx)
+}
+
+// StopIntegrityVerifier stops the periodic verification, a running one is cancelled
+func StopIntegrityVerifier() {
+	if IntegrityVerify != nil {
+		IntegrityVerify.Stop()
+	}
+}
+
+// Start checks every INTEGRITY_CHECK_INTERVAL which tables are due
+func (v *IntegrityVerifier) Start(ctx context.Context) {
+	v.mu.Lock()
+	if v.running {
+		v.mu.Unlock()
+		return
+	}
+	v.running = true
+	v.ticker = CurrentClock.NewTicker(INTEGRITY_CHECK_INTERVAL)
+	ctx, v.cancel = context.WithCancel(ctx)
+	v.mu.Unlock()
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		for {
+			select {
+			case <-v.ticker.C():
+				v.Check(ctx)
+			case <-v.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the verifier
+func (v *IntegrityVerifier) Stop() {
+	v.mu.Lock()
+	if !v.running {
+		v.mu.Unlock()
+		return
+	}
+	v.running = false
+	v.ticker.Stop()
+	v.cancel()
+	close(v.stopChan)
+	v.mu.Unlock()
+	v.wg.Wait()
+}
+
+// Check verifies the enabled tables not verified for verify_hours, on the leader only
+func (v *IntegrityVerifier) Check(ctx context.Context) {
+	s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_INTEGRITY, SETTING_KEY_INTEGRITY_VERIFY_H)
+	if !ok || s.IntValue <= 0 || !IsSchedulerLeader() {
+		return
+	}
+	every := time.Duration(s.IntValue) * time.Hour
+	tables, err := ListIntegrityTables()
+	if err != nil {
+		simplelog.LogErrorAny("Integrity", err, "cannot list integrity tables")
+		return
+	}
+	for _, t := range tables {
+		if !t.Enabled || CurrentClock.Since(t.VerifiedAt) < every {
+			continue
+		}
+		report, err := VerifyIntegrity(ctx, t.TableName_)
+		if err != nil {
+			simplelog.LogErrorAny("Integrity", err, "verification of "+t.TableName_+" failed")
+			continue
+		}
+		simplelog.LogFormat("integrity: %s verified, %d rows, %d mismatches", t.TableName_, report.Rows, report.Mismatches)
+	}
+}
@@ -0,0 +1,125 @@
+package suresql
+
+import (
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Joins in structured queries: /db/api/query joins other tables with INNER or LEFT JOIN, the ON is an
+// orm.Condition whose values are the columns compared with. Every joined table is validated like the
+// queried one. The records hold the columns of the queried table as they are and the columns of a joined
+// table prefixed with its name or alias (customers.name), so same named columns do not overwrite each
+// other. Those are read from the live schema. Fields of the condition may name table.column.
+
+const (
+	JOIN_INNER     = "INNER"
+	JOIN_LEFT      = "LEFT"
+	QUERY_MAX_JOIN = 8
+)
+
+var (
+	ErrJoinType      = medaerror.MedaError{Message: "join type must be INNER or LEFT"}
+	ErrJoinNoOn      = medaerror.MedaError{Message: "join needs an on condition"}
+	ErrJoinDuplicate = medaerror.MedaError{Message: "table joined twice, give it an alias"}
+	ErrJoinTooMany   = medaerror.MedaError{Message: "too many joins"}
+)
+
+// BuildJoinedQuery renders the select of a QueryRequest with joins and without grouping
+func BuildJoinedQuery(req QueryRequest) (orm.ParametereizedSQL, error) {
+	b := NewQueryBuilder(CurrentDialect())
+	from, columns, err := b.joinedFrom(req.Table, req.Joins)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	if len(req.Fields) > 0 && ProjectInSQL(req) {
+		fields, err := ValidateFields(req)
+		if err != nil {
+			return orm.ParametereizedSQL{}, err
+		}
+		columns = fieldColumns(b.Dialect, req.Table, fields, true)
+	}
+	c := orm.Condition{}
+	if req.Condition != nil {
+		c = *req.Condition
+	}
+	if req.SingleRow {
+		c.Limit = 1
+	}
+	tail, err := b.tail(&c)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	selected := strings.Join(columns, ", ")
+	if req.Distinct {
+		selected = "DISTINCT " + selected
+	}
+	query := "SELECT " + selected + " FROM " + from + tail
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, nil
+}
+
+// joinedFrom renders the table and its joins for FROM, and the columns of the select: all of the table
+// and every column of a joined table aliased with the table prefix
+func (b *QueryBuilder) joinedFrom(table string, joins []QueryJoin) (string, []string, error) {
+	if err := ValidateTableName(table, false); err != nil {
+		return "", nil, err
+	}
+	if len(joins) > QUERY_MAX_JOIN {
+		return "", nil, medaerror.Errorf("%s: at most %d", ErrJoinTooMany.Message, QUERY_MAX_JOIN)
+	}
+	from := table
+	columns := []string{table + ".*"}
+	seen := map[string]bool{strings.ToLower(table): true}
+	for _, j := range joins {
+		if err := ValidateTableName(j.Table, false); err != nil {
+			return "", nil, err
+		}
+		name := j.Table
+		if j.Alias != "" {
+			if err := ValidateIdentifier(j.Alias); err != nil || strings.Contains(j.Alias, ".") {
+				return "", nil, medaerror.Errorf("%s: %q", ErrInvalidIdentifier.Message, j.Alias)
+			}
+			name = j.Alias
+		}
+		if seen[strings.ToLower(name)] {
+			return "", nil, medaerror.Errorf("%s: %s", ErrJoinDuplicate.Message, name)
+		}
+		seen[strings.ToLower(name)] = true
+
+		kind := strings.Join(strings.Fields(strings.ToUpper(j.Type)), " ")
+		switch kind {
+		case "", JOIN_INNER:
+			kind = JOIN_INNER
+		case JOIN_LEFT, "LEFT OUTER":
+			kind = JOIN_LEFT
+		default:
+			return "", nil, medaerror.Errorf("%s: %q", ErrJoinType.Message, j.Type)
+		}
+		if j.On == nil {
+			return "", nil, ErrJoinNoOn
+		}
+		on, err := b.On(j.On)
+		if err != nil {
+			return "", nil, err
+		}
+		if on == "" {
+			return "", nil, ErrJoinNoOn
+		}
+
+		schema, err := TableSchema(j.Table, false)
+		if err != nil {
+			return "", nil, medaerror.Errorf("%s: %s", err.Error(), j.Table)
+		}
+		for _, column := range schema {
+			columns = append(columns, name+"."+column.Name+" AS "+b.Dialect.Quote(name+"."+column.Name))
+		}
+		from += " " + kind + " JOIN " + j.Table
+		if j.Alias != "" {
+			from += " " + j.Alias
+		}
+		from += " ON " + on
+	}
+	return from, columns, nil
+}
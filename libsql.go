@@ -0,0 +1,102 @@
+package suresql
+
+import (
+	"database/sql"
+	"net"
+	"net/url"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// libSQL (sqld) and hosted Turso databases through SQLDatabase with the libsql driver
+// (github.com/tursodatabase/libsql-client-go/libsql), compiled into app/suresql with -tags libsql.
+// DBMS_HOST is the database host (ie: mydb-myorg.turso.io) or a full URL, DBMS_AUTH_TOKEN the
+// database token. The SQL is SQLite, the schema comes from sqlite_master like rqlite.
+
+const LIBSQL_SCHEMA_TABLE = "sqlite_master"
+
+var LibSQLFlavor = SQLFlavor{
+	Name:     "libsql",
+	Driver:   "libsql",
+	BuildTag: "libsql",
+	Schema:   libsqlSchema,
+	Status:   libsqlStatus,
+}
+
+// newLibSQLDatabase creates a new libSQL/Turso connection
+func newLibSQLDatabase(conf SureSQLDBMSConfig) (SureSQLDB, error) {
+	flavor := LibSQLFlavor
+	flavor.QueryTime = conf.HttpTimeout
+	dsn, address := libsqlDSN(conf)
+
+	db, err := OpenSQLDatabase(flavor, dsn, address)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// libsqlDSN is libsql://host?authToken=... with DBMS_SSL (Turso), http://host:port without (a local
+// sqld), the address for the status has no token
+func libsqlDSN(conf SureSQLDBMSConfig) (string, string) {
+	u, err := url.Parse(conf.Host)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		u = &url.URL{Scheme: "http", Host: conf.Host}
+		if conf.SSL {
+			u.Scheme = "libsql"
+		}
+		if conf.Port != "" {
+			u.Host = net.JoinHostPort(conf.Host, conf.Port)
+		}
+	}
+	params := []string{}
+	if conf.AuthToken != "" {
+		params = append(params, "authToken="+url.QueryEscape(conf.AuthToken))
+	}
+	if conf.Options != "" {
+		params = append(params, strings.TrimPrefix(conf.Options, "?"))
+	}
+	address := u.Host
+	u.RawQuery = strings.Join(params, "&")
+	return u.String(), address
+}
+
+// libsqlSchema lists the tables, views, indexes and triggers like the rqlite schema, without the
+// sqlite_ and libsql_ internal objects
+func libsqlSchema(db *sql.DB, hideSQL, hideSureSQL bool) []orm.SchemaStruct {
+	schemas := []orm.SchemaStruct{}
+	rows, err := db.Query("SELECT type, name, tbl_name, COALESCE(sql, '') FROM " + LIBSQL_SCHEMA_TABLE +
+		" WHERE name NOT LIKE 'sqlite_%' AND name NOT LIKE 'libsql_%' ORDER BY type, name")
+	if err != nil {
+		return schemas
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s orm.SchemaStruct
+		if rows.Scan(&s.ObjectType, &s.ObjectName, &s.TableName, &s.SQLCommand) != nil {
+			continue
+		}
+		if hideSureSQL && strings.HasPrefix(s.TableName, "_") {
+			continue
+		}
+		if hideSQL {
+			s.SQLCommand = ""
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas
+}
+
+// libsqlStatus reads the SQLite version, a hosted database tells nothing about its servers
+func libsqlStatus(db *sql.DB) (orm.StatusStruct, error) {
+	status := orm.StatusStruct{DBMS: "libsql"}
+	if err := db.QueryRow("SELECT sqlite_version()").Scan(&status.Version); err != nil {
+		return status, err
+	}
+	var pages, pageSize int64
+	if db.QueryRow("PRAGMA page_count").Scan(&pages) == nil && db.QueryRow("PRAGMA page_size").Scan(&pageSize) == nil {
+		status.DBSize = pages * pageSize
+	}
+	return status, nil
+}
@@ -0,0 +1,174 @@
+package suresql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// SMTP notifier, configured from the smtp settings category. Port 465 uses implicit TLS, other ports
+// use STARTTLS when the server offers it. Connections go through the smtp outbound proxy (proxy.go).
+
+var ErrSMTPNotConfigured = medaerror.MedaError{Message: "smtp is not configured (settings smtp/host and smtp/from)"}
+
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// MailAttachment is a file attached to an email
+type MailAttachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+// LoadSMTPConfig reads the smtp settings
+func LoadSMTPConfig() SMTPConfig {
+	get := func(key string) string {
+		if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SMTP, key); ok {
+			return tmp.TextValue
+		}
+		return ""
+	}
+	conf := SMTPConfig{
+		Host:     get(SETTING_KEY_SMTP_HOST),
+		Port:     get(SETTING_KEY_SMTP_PORT),
+		Username: get(SETTING_KEY_SMTP_USERNAME),
+		Password: get(SETTING_KEY_SMTP_PASSWORD),
+		From:     get(SETTING_KEY_SMTP_FROM),
+	}
+	if conf.Port == "" {
+		conf.Port = "587"
+	}
+	return conf
+}
+
+// SendMail sends a plain text email with optional attachments
+func SendMail(conf SMTPConfig, to []string, subject, body string, attachments ...MailAttachment) error {
+	if conf.Host == "" || conf.From == "" {
+		return ErrSMTPNotConfigured
+	}
+	if len(to) == 0 {
+		return medaerror.NewString("no recipients")
+	}
+	for _, addr := range append([]string{conf.From}, to...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return medaerror.Errorf("invalid email address %q", addr)
+		}
+	}
+
+	msg, err := buildMailMessage(conf.From, to, subject, body, attachments)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if conf.Username != "" {
+		auth = smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)
+	}
+	addr := net.JoinHostPort(conf.Host, conf.Port)
+	// through the smtp outbound proxy (CONNECT tunnel) when there is one
+	conn, err := DialIntegration(INTEGRATION_SMTP, addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: conf.Host}
+	if conf.Port == "465" {
+		// implicit TLS
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, conf.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if conf.Port != "465" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(conf.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func buildMailMessage(from string, to []string, subject, body string, attachments []MailAttachment) ([]byte, error) {
+	var buf bytes.Buffer
+	// no header injection through the subject
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		from, strings.Join(to, ", "), mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z))
+
+	if len(attachments) == 0 {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64Lines(&buf, []byte(body))
+		return buf.Bytes(), nil
+	}
+
+	var rnd [12]byte
+	if _, err := rand.Read(rnd[:]); err != nil {
+		return nil, err
+	}
+	boundary := "suresql-" + hex.EncodeToString(rnd[:])
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n", boundary)
+	writeBase64Lines(&buf, []byte(body))
+	for _, att := range attachments {
+		name := mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", "", "\n", "", "\"", "").Replace(att.FileName))
+		fmt.Fprintf(&buf, "--%s\r\nContent-Type: %s\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"%s\"\r\n\r\n",
+			boundary, att.ContentType, name)
+		writeBase64Lines(&buf, att.Data)
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines writes base64 wrapped at 76 characters as required by MIME
+func writeBase64Lines(buf *bytes.Buffer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		buf.WriteString(enc[:76])
+		buf.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	buf.WriteString(enc)
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,409 @@
+package suresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Scheduled maintenance of the backing database: every minute the leader runs the tasks whose cron
+// expression (settings maintenance/<task>_cron, UTC) matches, with the internal connection. What a task
+// does depends on the DBMS:
+//   analyze     ANALYZE (MySQL: ANALYZE TABLE of every table), refreshes the planner statistics
+//   vacuum      VACUUM (Postgres: VACUUM (ANALYZE)), rewrites the file to reclaim free pages
+//   optimize    PRAGMA optimize on the SQLite family (MySQL: OPTIMIZE TABLE)
+//   checkpoint  PRAGMA wal_checkpoint(TRUNCATE) on libSQL, CHECKPOINT on DuckDB
+// rqlite checkpoints its WAL itself, CockroachDB and ClickHouse keep their statistics and space by
+// themselves, tasks a DBMS does not have are skipped. Every run is kept in _maintenance_runs, a failed one raises an alert.
+// The statements run with the DBMS timeout (DBMS_HTTP_TIMEOUT) like any other.
+
+const (
+	MAINTENANCE_TASK_ANALYZE    = "analyze"
+	MAINTENANCE_TASK_VACUUM     = "vacuum"
+	MAINTENANCE_TASK_OPTIMIZE   = "optimize"
+	MAINTENANCE_TASK_CHECKPOINT = "checkpoint"
+
+	MAINTENANCE_STATUS_OK     = "ok"
+	MAINTENANCE_STATUS_FAILED = "failed"
+
+	DEFAULT_MAINTENANCE_HISTORY_DAYS = 30
+	DEFAULT_MAINTENANCE_RUN_LIMIT    = 100
+)
+
+var ErrMaintenanceTaskUnknown = medaerror.MedaError{Message: "maintenance task not available on this DBMS"}
+
+// MaintenanceTasks is the order the tasks run in when several are due in the same minute
+var MaintenanceTasks = []string{MAINTENANCE_TASK_ANALYZE, MAINTENANCE_TASK_OPTIMIZE, MAINTENANCE_TASK_VACUUM, MAINTENANCE_TASK_CHECKPOINT}
+
+// maintenanceStatements are the statements of a task by DBMS, nil is a task built from the table list
+var maintenanceStatements = map[string]map[string][]string{
+	"RQLITE": {
+		MAINTENANCE_TASK_ANALYZE:  {"ANALYZE"},
+		MAINTENANCE_TASK_VACUUM:   {"VACUUM"},
+		MAINTENANCE_TASK_OPTIMIZE: {"PRAGMA optimize"},
+	},
+	"LIBSQL": {
+		MAINTENANCE_TASK_ANALYZE:    {"ANALYZE"},
+		MAINTENANCE_TASK_VACUUM:     {"VACUUM"},
+		MAINTENANCE_TASK_OPTIMIZE:   {"PRAGMA optimize"},
+		MAINTENANCE_TASK_CHECKPOINT: {"PRAGMA wal_checkpoint(TRUNCATE)"},
+	},
+	"POSTGRES": {
+		MAINTENANCE_TASK_ANALYZE: {"ANALYZE"},
+		MAINTENANCE_TASK_VACUUM:  {"VACUUM (ANALYZE)"},
+	},
+	"MYSQL": {
+		MAINTENANCE_TASK_ANALYZE:  nil,
+		MAINTENANCE_TASK_OPTIMIZE: nil,
+	},
+	"DUCKDB": {
+		MAINTENANCE_TASK_ANALYZE:    {"ANALYZE"},
+		MAINTENANCE_TASK_CHECKPOINT: {"CHECKPOINT"},
+	},
+	"COCKROACH":  {},
+	"CLICKHOUSE": {},
+}
+
+// MaintenanceRunTable is one run of a maintenance task
+type MaintenanceRunTable struct {
+	ID         int       `json:"id,omitempty"     db:"id"`
+	Task       string    `json:"task"             db:"task"`
+	Statement  string    `json:"statement"        db:"statement"` // the statements, separated by ;
+	Status     string    `json:"status"           db:"status"`    // ok or failed
+	Error      string    `json:"error,omitempty"  db:"error"`
+	DurationMs int64     `json:"duration_ms"      db:"duration_ms"`
+	Manual     bool      `json:"manual"           db:"manual"` // started through /suresql/maintenance/run
+	NodeNumber int       `json:"node_number"      db:"node_number"`
+	StartedAt  time.Time `json:"started_at"       db:"started_at"`
+}
+
+func (m MaintenanceRunTable) TableName() string {
+	return "_maintenance_runs"
+}
+
+// MaintenanceTask is a task available on this DBMS and when it runs next
+type MaintenanceTask struct {
+	Task       string    `json:"task"`
+	Cron       string    `json:"cron,omitempty"` // empty is not scheduled
+	Statements []string  `json:"statements,omitempty"`
+	NextRun    time.Time `json:"next_run,omitempty"`
+	LastRun    time.Time `json:"last_run,omitempty"`
+	LastStatus string    `json:"last_status,omitempty"`
+}
+
+// maintenanceDBMS is the key of maintenanceStatements for the DBMS of this node
+func maintenanceDBMS() string {
+	switch dbms := strings.ToUpper(strings.TrimSpace(CurrentNode.GetInternalConfig().DBMS)); dbms {
+	case "", "RQLITE":
+		return "RQLITE"
+	case "POSTGRESQL", "POSTGRES":
+		return "POSTGRES"
+	case "MYSQL", "MARIADB":
+		return "MYSQL"
+	case "COCKROACH", "COCKROACHDB":
+		return "COCKROACH"
+	case "LIBSQL", "TURSO":
+		return "LIBSQL"
+	default:
+		return dbms
+	}
+}
+
+// maintenanceCron is the cron expression of the task, empty when it is not scheduled
+func maintenanceCron(task string) string {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_MAINTENANCE, task+SETTING_KEY_MAINTENANCE_CRON); ok {
+		return strings.TrimSpace(s.TextValue)
+	}
+	return ""
+}
+
+// MaintenanceStatements returns the statements of the task on this DBMS
+func MaintenanceStatements(task string) ([]string, error) {
+	statements, ok := maintenanceStatements[maintenanceDBMS()][task]
+	if !ok {
+		return nil, ErrMaintenanceTaskUnknown
+	}
+	if statements != nil {
+		return statements, nil
+	}
+	// MySQL has no database wide ANALYZE/OPTIMIZE, the tables are listed in one statement
+	tables, err := mysqlMaintenanceTables()
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	return []string{strings.ToUpper(task) + " TABLE " + strings.Join(tables, ", ")}, nil
+}
+
+// mysqlMaintenanceTables lists the base tables of the current database, quoted
+func mysqlMaintenanceTables() ([]string, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectOneSQL("SELECT table_name AS name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' ORDER BY table_name")
+	if err != nil {
+		if IsNoRowsError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tables := make([]string, 0, len(records))
+	for _, rec := range records {
+		if name, ok := rec.Data["name"].(string); ok && name != "" {
+			tables = append(tables, "`"+strings.ReplaceAll(name, "`", "``")+"`")
+		}
+	}
+	return tables, nil
+}
+
+// ListMaintenanceTasks lists the tasks of this DBMS with their schedule and last run
+func ListMaintenanceTasks() []MaintenanceTask {
+	available := maintenanceStatements[maintenanceDBMS()]
+	tasks := []MaintenanceTask{}
+	now := CurrentClock.Now().UTC()
+	for _, name := range MaintenanceTasks {
+		statements, ok := available[name]
+		if !ok {
+			continue
+		}
+		t := MaintenanceTask{Task: name, Cron: maintenanceCron(name), Statements: statements}
+		if cron, err := ParseCron(t.Cron); t.Cron != "" && err == nil {
+			t.NextRun = cron.Next(now)
+		}
+		if runs, err := ListMaintenanceRuns(name, 1); err == nil && len(runs) > 0 {
+			t.LastRun, t.LastStatus = runs[0].StartedAt, runs[0].Status
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+// ListMaintenanceRuns returns the latest runs, of one task when task is set
+func ListMaintenanceRuns(task string, limit int) ([]MaintenanceRunTable, error) {
+	if limit <= 0 {
+		limit = DEFAULT_MAINTENANCE_RUN_LIMIT
+	}
+	condition := orm.Condition{OrderBy: []string{"id DESC"}, Limit: limit}
+	if task != "" {
+		condition = orm.Condition{Field: "task", Operator: "=", Value: task, OrderBy: condition.OrderBy, Limit: limit}
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(MaintenanceRunTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []MaintenanceRunTable{}, nil
+		}
+		return nil, err
+	}
+	runs := make([]MaintenanceRunTable, 0, len(records))
+	for _, rec := range records {
+		runs = append(runs, object.MapToStructSlowDB[MaintenanceRunTable](rec.Data))
+	}
+	return runs, nil
+}
+
+// RunMaintenance runs one task now and records the run, the error is the one of the task
+func RunMaintenance(task string, manual bool) (MaintenanceRunTable, error) {
+	run := MaintenanceRunTable{
+		Task:       task,
+		Status:     MAINTENANCE_STATUS_OK,
+		Manual:     manual,
+		NodeNumber: CurrentNode.Config.NodeNumber,
+		StartedAt:  CurrentClock.Now().UTC(),
+	}
+	statements, err := MaintenanceStatements(task)
+	if err == ErrMaintenanceTaskUnknown {
+		return run, err
+	}
+	for _, stmt := range statements {
+		if err != nil {
+			break
+		}
+		err = CurrentNode.GetInternalConnection().ExecOneSQL(stmt).Error
+	}
+	run.Statement = strings.Join(statements, "; ")
+	run.DurationMs = CurrentClock.Since(run.StartedAt).Milliseconds()
+	if err != nil {
+		run.Status, run.Error = MAINTENANCE_STATUS_FAILED, err.Error()
+		maintenanceFailed(run)
+	}
+	if rerr := saveMaintenanceRun(run); rerr != nil {
+		simplelog.LogErrorAny("Maintenance", rerr, "cannot save the maintenance run of "+task)
+	}
+	return run, err
+}
+
+func saveMaintenanceRun(run MaintenanceRunTable) error {
+	return CurrentNode.GetInternalConnection().InsertOneDBRecord(orm.DBRecord{
+		TableName: run.TableName(),
+		Data: map[string]interface{}{
+			"task":        run.Task,
+			"statement":   run.Statement,
+			"status":      run.Status,
+			"error":       run.Error,
+			"duration_ms": run.DurationMs,
+			"manual":      run.Manual,
+			"node_number": run.NodeNumber,
+			"started_at":  run.StartedAt,
+		},
+	}, false).Error
+}
+
+func maintenanceFailed(run MaintenanceRunTable) {
+	simplelog.LogFormat("maintenance: %s failed after %dms: %s", run.Task, run.DurationMs, run.Error)
+	if AlertMgr == nil {
+		return
+	}
+	AlertMgr.CreateAlert(AlertLevelWarning,
+		"Maintenance Failed",
+		fmt.Sprintf("Maintenance task %s failed: %s", run.Task, run.Error),
+		map[string]interface{}{
+			"task":        run.Task,
+			"statement":   run.Statement,
+			"duration_ms": run.DurationMs,
+			"dbms":        maintenanceDBMS(),
+		})
+}
+
+// PruneMaintenanceRuns deletes the runs older than maintenance/history_days
+func PruneMaintenanceRuns() error {
+	days := DEFAULT_MAINTENANCE_HISTORY_DAYS
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_MAINTENANCE, SETTING_KEY_MAINTENANCE_HISTORY); ok && s.IntValue > 0 {
+		days = s.IntValue
+	}
+	qb := NewQueryBuilder(CurrentDialect())
+	query := "DELETE FROM " + MaintenanceRunTable{}.TableName() + " WHERE started_at < " + qb.Arg(CurrentClock.Now().UTC().AddDate(0, 0, -days))
+	return CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: qb.Args()}).Error
+}
+
+// MaintenanceScheduler checks the task schedules every minute
+type MaintenanceScheduler struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	busy     sync.Mutex // one run at a time, a task slower than a minute is not started twice
+}
+
+var (
+	MaintenanceSched     *MaintenanceScheduler
+	maintenanceSchedOnce sync.Once
+)
+
+// InitMaintenanceScheduler initializes the global maintenance scheduler
+func InitMaintenanceScheduler() {
+	maintenanceSchedOnce.Do(func() {
+		MaintenanceSched = &MaintenanceScheduler{stopChan: make(chan struct{})}
+	})
+}
+
+// StartMaintenanceScheduler starts the maintenance scheduler
+func StartMaintenanceScheduler(ctx context.Context) {
+	if MaintenanceSched == nil {
+		InitMaintenanceScheduler()
+	}
+	MaintenanceSched.Start(ctx)
+}
+
+// StopMaintenanceScheduler stops the maintenance scheduler
+func StopMaintenanceScheduler() {
+	if MaintenanceSched != nil {
+		MaintenanceSched.Stop()
+	}
+}
+
+// Start checks the schedules at the start of every minute
+func (ms *MaintenanceScheduler) Start(ctx context.Context) {
+	ms.mu.Lock()
+	if ms.running {
+		ms.mu.Unlock()
+		return
+	}
+	ms.running = true
+	ms.mu.Unlock()
+
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		simplelog.LogThis("MaintenanceScheduler", "Starting maintenance scheduler for "+maintenanceDBMS())
+
+		// align the ticker to the minute so cron minutes are not skipped
+		select {
+		case <-CurrentClock.After(CurrentClock.Now().Truncate(time.Minute).Add(time.Minute).Sub(CurrentClock.Now())):
+		case <-ctx.Done():
+			return
+		case <-ms.stopChan:
+			return
+		}
+		ms.ticker = CurrentClock.NewTicker(time.Minute)
+		ms.runDue(CurrentClock.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ms.stopChan:
+				return
+			case now := <-ms.ticker.C():
+				ms.runDue(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the maintenance scheduler, a running task finishes
+func (ms *MaintenanceScheduler) Stop() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.running {
+		return
+	}
+	close(ms.stopChan)
+	ms.wg.Wait()
+	if ms.ticker != nil {
+		ms.ticker.Stop()
+	}
+	ms.running = false
+	simplelog.LogThis("MaintenanceScheduler", "Maintenance scheduler stopped")
+}
+
+// runDue runs the due tasks on the leader, in the background so the ticks keep coming
+func (ms *MaintenanceScheduler) runDue(now time.Time) {
+	if !IsSchedulerLeader() {
+		return
+	}
+	now = now.UTC().Truncate(time.Minute)
+	due := []string{}
+	for _, task := range MaintenanceTasks {
+		if _, ok := maintenanceStatements[maintenanceDBMS()][task]; !ok {
+			continue
+		}
+		cron, err := ParseCron(maintenanceCron(task))
+		if err == nil && cron.Matches(now) {
+			due = append(due, task)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	if !ms.busy.TryLock() {
+		simplelog.LogFormat("maintenance: %s skipped, the previous run is not done", strings.Join(due, ","))
+		return
+	}
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		defer ms.busy.Unlock()
+		for _, task := range due {
+			if run, err := RunMaintenance(task, false); err == nil {
+				simplelog.LogFormat("maintenance: %s done in %dms", task, run.DurationMs)
+			}
+		}
+		if err := PruneMaintenanceRuns(); err != nil {
+			simplelog.LogErrorAny("Maintenance", err, "cannot prune maintenance runs")
+		}
+	}()
+}
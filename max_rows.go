@@ -0,0 +1,92 @@
+package suresql
+
+import (
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Row cap: connection/max_rows is the most rows a query answers. Structured queries select one row more than
+// the cap (their own limit when lower), raw selects stop reading after it, so a SELECT * of a large table is
+// not read into the node. A result over the cap is cut and flagged truncated, or refused with
+// connection/max_rows_reject. Streamed results are not capped, they hold one row at a time.
+
+var ErrMaxRows = medaerror.MedaError{Message: "the result has more rows than connection/max_rows, add a limit or page it"}
+
+// errRowLimit stops reading rows at the limit
+var errRowLimit = medaerror.MedaError{Message: "row limit reached"}
+
+// MaxRows reads connection/max_rows, 0 is no cap
+func MaxRows() int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CONNECTION, SETTING_KEY_MAX_ROWS); ok && s.IntValue > 0 {
+		return s.IntValue
+	}
+	return 0
+}
+
+// MaxRowsReject reads connection/max_rows_reject
+func MaxRowsReject() bool {
+	s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CONNECTION, SETTING_KEY_MAX_ROWS_REJECT)
+	return ok && s.IntValue != 0
+}
+
+// CapRows applies the cap to a result of n rows, it returns the rows to keep, below n when the result is
+// cut, or ErrMaxRows when it is refused
+func CapRows(n int) (int, error) {
+	max := MaxRows()
+	if max == 0 || n <= max {
+		return n, nil
+	}
+	if MaxRowsReject() {
+		return 0, ErrMaxRows
+	}
+	return max, nil
+}
+
+// SelectLimited returns at most limit records of the select, 0 is all, orm.ErrSQLNoRows when there are none
+// like the backends. Backends with row sets stop reading at the limit, the others read all records first.
+func SelectLimited(db SureSQLDB, p orm.ParametereizedSQL, limit int) ([]orm.DBRecord, error) {
+	backend, faulty := rowSetBackend(db)
+	if backend == nil || limit <= 0 {
+		records, err := db.SelectOneSQLParameterized(p)
+		if limit > 0 && len(records) > limit {
+			records = records[:limit]
+		}
+		return records, err
+	}
+	if faulty {
+		if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+			return nil, err
+		}
+	}
+	rows := &RowSet{Table: rowSetTable(backend, "", p.Query)}
+	err := eachRowOf(backend, p, func(columns []string, row []interface{}) error {
+		if rows.Columns == nil {
+			rows.Columns = append([]string{}, columns...)
+		}
+		rows.Rows = append(rows.Rows, append([]interface{}{}, row...))
+		if len(rows.Rows) >= limit {
+			return errRowLimit
+		}
+		return nil
+	})
+	if err != nil && err != errRowLimit {
+		return nil, err
+	}
+	if rows.Len() == 0 {
+		return nil, orm.ErrSQLNoRows
+	}
+	return rows.Records(), nil
+}
+
+// SelectStatement runs a raw select (raw) or a parameterized one. With connection/max_rows it stops reading
+// one row over the cap, so CapRows can tell the result was cut.
+func SelectStatement(db SureSQLDB, p orm.ParametereizedSQL, raw bool) ([]orm.DBRecord, error) {
+	if max := MaxRows(); max > 0 {
+		return SelectLimited(db, p, max+1)
+	}
+	if raw {
+		return db.SelectOneSQL(p.Query)
+	}
+	return db.SelectOneSQLParameterized(p)
+}
@@ -0,0 +1,329 @@
+package suresql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Usage metering for billing: requests, rows read/written and bytes transferred are aggregated per day,
+// per API key and per user. Counters are accumulated in memory and the deltas are flushed to _usage_meter
+// every METERING_FLUSH_INTERVAL. When the day rolls over, the finished day is pushed to the billing
+// webhook (setting metering/webhook_url) if configured.
+
+const (
+	METERING_FLUSH_INTERVAL  = time.Minute
+	METERING_DAY_FORMAT      = "2006-01-02"
+	METERING_WEBHOOK_TIMEOUT = 30 * time.Second
+	METERING_NO_API_KEY      = "-"
+)
+
+var (
+	ErrMeteringWebhookNotSet = medaerror.MedaError{Message: "billing webhook is not configured"}
+)
+
+// UsageMeterTable is one day of usage for an API key and user
+type UsageMeterTable struct {
+	ID          int       `json:"id,omitempty"           db:"id"`
+	Day         string    `json:"day"                    db:"day"`     // YYYY-MM-DD in UTC
+	APIKey      string    `json:"api_key"                db:"api_key"` // fingerprint of the API key, never the key itself
+	Username    string    `json:"username"               db:"username"`
+	Requests    int64     `json:"requests"               db:"requests"`
+	RowsRead    int64     `json:"rows_read"              db:"rows_read"`
+	RowsWritten int64     `json:"rows_written"           db:"rows_written"`
+	BytesIn     int64     `json:"bytes_in"               db:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"              db:"bytes_out"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"   db:"updated_at"`
+}
+
+func (u UsageMeterTable) TableName() string {
+	return "_usage_meter"
+}
+
+// MeterDelta is what one request adds to the meter
+type MeterDelta struct {
+	Requests    int64
+	RowsRead    int64
+	RowsWritten int64
+	BytesIn     int64
+	BytesOut    int64
+}
+
+// UsageMeter accumulates usage in memory until it is flushed
+type UsageMeter struct {
+	mu       sync.Mutex
+	pending  map[string]*UsageMeterTable // key: day|api_key|username
+	lastDay  string
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+}
+
+var (
+	Meter     *UsageMeter
+	meterOnce sync.Once
+)
+
+// InitMetering initializes the global usage meter
+func InitMetering() {
+	meterOnce.Do(func() {
+		Meter = &UsageMeter{
+			pending:  make(map[string]*UsageMeterTable),
+			lastDay:  CurrentClock.Now().UTC().Format(METERING_DAY_FORMAT),
+			stopChan: make(chan struct{}),
+		}
+	})
+}
+
+// StartMetering starts the flush routine
+func StartMetering(ctx context.Context) {
+	if Meter == nil {
+		InitMetering()
+	}
+	Meter.Start(ctx)
+}
+
+// StopMetering stops the flush routine and flushes what is left
+func StopMetering() {
+	if Meter != nil {
+		Meter.Stop()
+	}
+}
+
+// APIKeyFingerprint returns a short non reversible id of the API key, safe to store and export
+func APIKeyFingerprint(apiKey string) string {
+	if apiKey == "" {
+		return METERING_NO_API_KEY
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Record adds the delta to today's usage of the API key (fingerprint) and user
+func (m *UsageMeter) Record(apiKeyFingerprint, username string, d MeterDelta) {
+	day := CurrentClock.Now().UTC().Format(METERING_DAY_FORMAT)
+	key := day + "|" + apiKeyFingerprint + "|" + username
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.pending[key]
+	if !ok {
+		rec = &UsageMeterTable{Day: day, APIKey: apiKeyFingerprint, Username: username}
+		m.pending[key] = rec
+	}
+	rec.Requests += d.Requests
+	rec.RowsRead += d.RowsRead
+	rec.RowsWritten += d.RowsWritten
+	rec.BytesIn += d.BytesIn
+	rec.BytesOut += d.BytesOut
+}
+
+// Start starts the flush routine
+func (m *UsageMeter) Start(ctx context.Context) {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = true
+	m.mu.Unlock()
+
+	m.ticker = CurrentClock.NewTicker(METERING_FLUSH_INTERVAL)
+	m.wg.Add(1)
+
+	go func() {
+		defer m.wg.Done()
+		simplelog.LogThis("UsageMeter", "Starting usage metering")
+
+		for {
+			select {
+			case <-ctx.Done():
+				m.Flush()
+				return
+			case <-m.stopChan:
+				return
+			case <-m.ticker.C():
+				m.Flush()
+				m.checkDayRollover()
+			}
+		}
+	}()
+}
+
+// Stop stops the flush routine and flushes what is left
+func (m *UsageMeter) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	if m.ticker != nil {
+		m.ticker.Stop()
+	}
+	close(m.stopChan)
+	m.running = false
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	m.Flush()
+	simplelog.LogThis("UsageMeter", "Usage metering stopped")
+}
+
+// Flush persists the accumulated deltas, entries that fail are kept for the next flush
+func (m *UsageMeter) Flush() {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[string]*UsageMeterTable)
+	m.mu.Unlock()
+
+	for key, rec := range pending {
+		if err := persistMeterDelta(*rec); err != nil {
+			simplelog.LogErrorAny("UsageMeter", err, "cannot flush usage of "+key)
+			m.mu.Lock()
+			if cur, ok := m.pending[key]; ok {
+				cur.Requests += rec.Requests
+				cur.RowsRead += rec.RowsRead
+				cur.RowsWritten += rec.RowsWritten
+				cur.BytesIn += rec.BytesIn
+				cur.BytesOut += rec.BytesOut
+			} else {
+				m.pending[key] = rec
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// checkDayRollover pushes the finished day to the billing webhook once
+func (m *UsageMeter) checkDayRollover() {
+	today := CurrentClock.Now().UTC().Format(METERING_DAY_FORMAT)
+	m.mu.Lock()
+	finished := m.lastDay
+	m.lastDay = today
+	m.mu.Unlock()
+
+	url := MeteringWebhookURL()
+	if finished == today || url == "" {
+		return
+	}
+	body, _, err := usageWebhookBody(finished)
+	if err == nil {
+		if err = PostWebhook(url, body, METERING_WEBHOOK_TIMEOUT); err != nil {
+			// keep the delivery so it can be retried from the dead letters
+			AddDeadLetter(DEAD_LETTER_SOURCE_WEBHOOK, url, "", WebhookDelivery{URL: url, Body: body}, err)
+		}
+	}
+	if err != nil {
+		simplelog.LogErrorAny("UsageMeter", err, "cannot push usage of "+finished+" to billing webhook")
+	}
+}
+
+// MeteringWebhookURL returns the billing webhook from settings, empty if not configured
+func MeteringWebhookURL() string {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_METERING, SETTING_KEY_WEBHOOK_URL); ok {
+		return tmp.TextValue
+	}
+	return ""
+}
+
+// ListUsageMeter returns the daily usage records between from and to (inclusive, YYYY-MM-DD),
+// empty from/to means no bound.
+func ListUsageMeter(from, to string) ([]UsageMeterTable, error) {
+	condition := orm.Condition{OrderBy: []string{"day ASC", "api_key ASC", "username ASC"}}
+	var nested []orm.Condition
+	if from != "" {
+		nested = append(nested, orm.Condition{Field: "day", Operator: ">=", Value: from})
+	}
+	if to != "" {
+		nested = append(nested, orm.Condition{Field: "day", Operator: "<=", Value: to})
+	}
+	if len(nested) > 0 {
+		condition.Logic = "AND"
+		condition.Nested = nested
+	}
+
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(UsageMeterTable{}.TableName(), &condition)
+	if err != nil {
+		if err == orm.ErrSQLNoRows {
+			return []UsageMeterTable{}, nil
+		}
+		return nil, err
+	}
+	usage := make([]UsageMeterTable, 0, len(records))
+	for _, rec := range records {
+		usage = append(usage, object.MapToStructSlowDB[UsageMeterTable](rec.Data))
+	}
+	return usage, nil
+}
+
+// WriteUsageMeterCSV writes the records as CSV with a header row
+func WriteUsageMeterCSV(w io.Writer, usage []UsageMeterTable) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"day", "api_key", "username", "requests", "rows_read", "rows_written", "bytes_in", "bytes_out"}); err != nil {
+		return err
+	}
+	for _, u := range usage {
+		row := []string{u.Day, u.APIKey, u.Username,
+			strconv.FormatInt(u.Requests, 10), strconv.FormatInt(u.RowsRead, 10), strconv.FormatInt(u.RowsWritten, 10),
+			strconv.FormatInt(u.BytesIn, 10), strconv.FormatInt(u.BytesOut, 10)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// PushUsageToWebhook posts the usage of the day as JSON to the billing webhook, returns number of records sent
+func PushUsageToWebhook(day string) (int, error) {
+	url := MeteringWebhookURL()
+	if url == "" {
+		return 0, ErrMeteringWebhookNotSet
+	}
+	body, count, err := usageWebhookBody(day)
+	if err != nil {
+		return 0, err
+	}
+	if err := PostWebhook(url, body, METERING_WEBHOOK_TIMEOUT); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// usageWebhookBody is the JSON posted to the billing webhook for the day, with the number of records in it
+func usageWebhookBody(day string) ([]byte, int, error) {
+	usage, err := ListUsageMeter(day, day)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"node":    CurrentNode.Config.Label,
+		"day":     day,
+		"records": usage,
+	})
+	return body, len(usage), err
+}
+
+func persistMeterDelta(rec UsageMeterTable) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + rec.TableName() + " (day, api_key, username, requests, rows_read, rows_written, bytes_in, bytes_out, updated_at)" +
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(day, api_key, username) DO UPDATE SET" +
+			" requests=requests+excluded.requests, rows_read=rows_read+excluded.rows_read, rows_written=rows_written+excluded.rows_written," +
+			" bytes_in=bytes_in+excluded.bytes_in, bytes_out=bytes_out+excluded.bytes_out, updated_at=excluded.updated_at",
+		Values: []interface{}{rec.Day, rec.APIKey, rec.Username, rec.Requests, rec.RowsRead, rec.RowsWritten, rec.BytesIn, rec.BytesOut, CurrentClock.Now().UTC()},
+	})
+	return res.Error
+}
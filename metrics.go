@@ -1,15 +1,21 @@
 package suresql
 
 import (
+	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Upper bounds (in ms) of the query latency histogram buckets, the last bucket catches everything above.
+// Keep this sorted ascending, RecordQuery does a linear scan which is cheaper than binary search for this size.
+var queryLatencyBoundsMs = [...]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
 // NodeMetrics tracks runtime metrics for the SureSQL node
+// NOTE: all Record* functions are lock-free (atomic only) because they are called on every request/query.
+// Derived values (average, percentiles, usage) are aggregated when GetMetrics is called.
 type NodeMetrics struct {
-	mu sync.RWMutex
-
 	// Connection Pool Metrics
 	ConnectionsCreated      uint64    `json:"connections_created"`       // Total connections created
 	ConnectionsClosed       uint64    `json:"connections_closed"`        // Total connections closed
@@ -18,6 +24,8 @@ type NodeMetrics struct {
 	ConnectionPoolUsagePct  float64   `json:"connection_pool_usage_pct"` // Usage percentage
 	PoolExhaustionCount     uint64    `json:"pool_exhaustion_count"`     // Times pool was full
 	LastPoolExhaustion      time.Time `json:"last_pool_exhaustion"`      // Last time pool was full
+	ConnectionsReclaimed    uint64    `json:"connections_reclaimed"`     // Idle connections closed to free pool slots
+	ConnectionsReestablished uint64   `json:"connections_reestablished"` // Reclaimed connections re-created on next request
 
 	// Token Store Metrics
 	TokensActive            int       `json:"tokens_active"`             // Active tokens
@@ -36,11 +44,36 @@ type NodeMetrics struct {
 	QueriesExecuted         uint64    `json:"queries_executed"`          // Total queries
 	QueriesSuccess          uint64    `json:"queries_success"`           // Successful queries
 	QueriesFailed           uint64    `json:"queries_failed"`            // Failed queries
-	AverageQueryTime        float64   `json:"average_query_time_ms"`     // Average query time in ms
+	AverageQueryTime        float64   `json:"average_query_time_ms"`     // Exponential moving average of the query time in ms (alpha = 0.1)
+	LifetimeAverageQueryTime float64  `json:"lifetime_average_query_time_ms"` // Average query time in ms since start (computed on read)
+	QueryTimeP50            float64   `json:"query_time_p50_ms"`         // Estimated from latency buckets (computed on read)
+	QueryTimeP95            float64   `json:"query_time_p95_ms"`         // Estimated from latency buckets (computed on read)
+	QueryTimeP99            float64   `json:"query_time_p99_ms"`         // Estimated from latency buckets (computed on read)
+	QueryLatencyBuckets     map[string]uint64 `json:"query_latency_buckets_ms"` // Histogram, key is the bucket upper bound
+	QueryCacheHits          uint64    `json:"query_cache_hits"`          // querysql results served from the cache
+	QueryCacheMisses        uint64    `json:"query_cache_misses"`        // querysql requests the cache did not have
+	QueryCacheEntries       int       `json:"query_cache_entries"`       // Results kept now
+
+	// Replication Metrics (only when the replica lag is monitored)
+	ReplicaLagSeconds       float64   `json:"replica_lag_seconds,omitempty"` // Apply lag of this node behind the leader
+	ReplicaLagSeq           int64     `json:"replica_lag_seq,omitempty"`     // Heartbeats not applied yet
+	ReplicaReadsSuspended   bool      `json:"replica_reads_suspended,omitempty"` // Too far behind to serve reads
+
+	// Disk Metrics (only when the disk usage is sampled)
+	DiskUsedBytes           int64     `json:"disk_used_bytes,omitempty"`           // Size of the DBMS data
+	DiskGrowthPerDay        float64   `json:"disk_growth_bytes_per_day,omitempty"` // Fitted over disk/window_hours
+	DiskDaysUntilFull       float64   `json:"disk_days_until_full,omitempty"`      // Only with disk/capacity_mb and growth
+	DiskLevel               string    `json:"disk_level,omitempty"`                // ok, warning or critical
 
 	// System Metrics
 	StartTime               time.Time `json:"start_time"`                // Server start time
 	Uptime                  string    `json:"uptime"`                    // Human readable uptime
+
+	// Hot path internals, only touched with sync/atomic
+	queryTimeTotalMicros   uint64                                // sum of all query durations in microseconds
+	queryTimeAverageBits   uint64                                // math.Float64bits of AverageQueryTime
+	queryLatencyBuckets    [len(queryLatencyBoundsMs) + 1]uint64 // histogram counters, last one is +Inf
+	lastPoolExhaustionNano int64                                 // unix nano of LastPoolExhaustion
 }
 
 // Global metrics instance
@@ -53,22 +86,79 @@ var (
 func InitMetrics() {
 	metricsOnce.Do(func() {
 		Metrics = &NodeMetrics{
-			StartTime: time.Now(),
+			StartTime: CurrentClock.Now(),
 		}
 	})
 }
 
 // GetMetrics returns a snapshot of current metrics (thread-safe)
+// Every counter is loaded atomically, so the snapshot never blocks the writers.
 func GetMetrics() NodeMetrics {
 	if Metrics == nil {
 		InitMetrics()
 	}
+	m := Metrics
+
+	snapshot := NodeMetrics{
+		ConnectionsCreated:     atomic.LoadUint64(&m.ConnectionsCreated),
+		ConnectionsClosed:      atomic.LoadUint64(&m.ConnectionsClosed),
+		PoolExhaustionCount:    atomic.LoadUint64(&m.PoolExhaustionCount),
+		LastPoolExhaustion:     m.LastPoolExhaustionTime(),
+		ConnectionsReclaimed:   atomic.LoadUint64(&m.ConnectionsReclaimed),
+		ConnectionsReestablished: atomic.LoadUint64(&m.ConnectionsReestablished),
+		TokensActive:           m.TokensActive,
+		TokensCreated:          atomic.LoadUint64(&m.TokensCreated),
+		TokensExpired:          atomic.LoadUint64(&m.TokensExpired),
+		RefreshTokensActive:    m.RefreshTokensActive,
+		RefreshTokensUsed:      atomic.LoadUint64(&m.RefreshTokensUsed),
+		TotalRequests:          atomic.LoadUint64(&m.TotalRequests),
+		FailedRequests:         atomic.LoadUint64(&m.FailedRequests),
+		AuthenticationAttempts: atomic.LoadUint64(&m.AuthenticationAttempts),
+		AuthenticationFailures: atomic.LoadUint64(&m.AuthenticationFailures),
+		QueriesExecuted:        atomic.LoadUint64(&m.QueriesExecuted),
+		QueriesSuccess:         atomic.LoadUint64(&m.QueriesSuccess),
+		QueriesFailed:          atomic.LoadUint64(&m.QueriesFailed),
+		QueryCacheHits:         atomic.LoadUint64(&m.QueryCacheHits),
+		QueryCacheMisses:       atomic.LoadUint64(&m.QueryCacheMisses),
+		QueryCacheEntries:      ResultCache.Len(),
+		StartTime:              m.StartTime,
+		Uptime:                 CurrentClock.Since(m.StartTime).String(),
+	}
 
-	Metrics.mu.RLock()
-	defer Metrics.mu.RUnlock()
+	// Aggregate the latency histogram. The total and the buckets are loaded separately, so under load
+	// they can be off by a few in-flight queries, which is fine for monitoring purposes.
+	var buckets [len(queryLatencyBoundsMs) + 1]uint64
+	var bucketTotal uint64
+	for i := range buckets {
+		buckets[i] = atomic.LoadUint64(&m.queryLatencyBuckets[i])
+		bucketTotal += buckets[i]
+	}
+	snapshot.AverageQueryTime = math.Float64frombits(atomic.LoadUint64(&m.queryTimeAverageBits))
+	if bucketTotal > 0 {
+		totalMs := float64(atomic.LoadUint64(&m.queryTimeTotalMicros)) / 1000
+		snapshot.LifetimeAverageQueryTime = totalMs / float64(bucketTotal)
+		snapshot.QueryTimeP50 = latencyPercentile(buckets[:], bucketTotal, 0.50)
+		snapshot.QueryTimeP95 = latencyPercentile(buckets[:], bucketTotal, 0.95)
+		snapshot.QueryTimeP99 = latencyPercentile(buckets[:], bucketTotal, 0.99)
+	}
+	snapshot.QueryLatencyBuckets = make(map[string]uint64, len(buckets))
+	for i, count := range buckets {
+		snapshot.QueryLatencyBuckets[latencyBucketLabel(i)] = count
+	}
 
-	snapshot := *Metrics
-	snapshot.Uptime = time.Since(Metrics.StartTime).String()
+	if lag := CurrentReplicaLag(); lag != nil {
+		snapshot.ReplicaLagSeconds = lag.LagSeconds
+		snapshot.ReplicaLagSeq = lag.LagSeq
+		snapshot.ReplicaReadsSuspended = lag.ReadsSuspended
+	}
+	if disk := CurrentDiskUsage(); disk != nil {
+		snapshot.DiskUsedBytes = disk.UsedBytes
+		snapshot.DiskGrowthPerDay = disk.GrowthPerDay
+		snapshot.DiskLevel = disk.Level
+		if disk.DaysUntilFull != nil {
+			snapshot.DiskDaysUntilFull = *disk.DaysUntilFull
+		}
+	}
 
 	// Calculate current values from CurrentNode
 	if CurrentNode.DBConnections != nil {
@@ -82,6 +172,43 @@ func GetMetrics() NodeMetrics {
 	return snapshot
 }
 
+// Returns the upper bound of the bucket that contains the requested percentile (0-1).
+// For the +Inf bucket we return the last finite bound, meaning "at least this much".
+func latencyPercentile(buckets []uint64, total uint64, pct float64) float64 {
+	target := uint64(float64(total)*pct + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	var cumulative uint64
+	for i, count := range buckets {
+		cumulative += count
+		if cumulative >= target {
+			if i < len(queryLatencyBoundsMs) {
+				return queryLatencyBoundsMs[i]
+			}
+			break
+		}
+	}
+	return queryLatencyBoundsMs[len(queryLatencyBoundsMs)-1]
+}
+
+// Label for histogram bucket, ie: "le_25" or "gt_5000" for the last one
+func latencyBucketLabel(i int) string {
+	if i < len(queryLatencyBoundsMs) {
+		return fmt.Sprintf("le_%g", queryLatencyBoundsMs[i])
+	}
+	return fmt.Sprintf("gt_%g", queryLatencyBoundsMs[len(queryLatencyBoundsMs)-1])
+}
+
+// LastPoolExhaustionTime returns the last time the pool was full, zero time if never
+func (m *NodeMetrics) LastPoolExhaustionTime() time.Time {
+	nano := atomic.LoadInt64(&m.lastPoolExhaustionNano)
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
 // RecordConnectionCreated increments connection creation counter
 func (m *NodeMetrics) RecordConnectionCreated() {
 	atomic.AddUint64(&m.ConnectionsCreated, 1)
@@ -95,9 +222,17 @@ func (m *NodeMetrics) RecordConnectionClosed() {
 // RecordPoolExhaustion records when connection pool is full
 func (m *NodeMetrics) RecordPoolExhaustion() {
 	atomic.AddUint64(&m.PoolExhaustionCount, 1)
-	m.mu.Lock()
-	m.LastPoolExhaustion = time.Now()
-	m.mu.Unlock()
+	atomic.StoreInt64(&m.lastPoolExhaustionNano, CurrentClock.Now().UnixNano())
+}
+
+// RecordConnectionReclaimed increments the idle connection reclaimed counter
+func (m *NodeMetrics) RecordConnectionReclaimed() {
+	atomic.AddUint64(&m.ConnectionsReclaimed, 1)
+}
+
+// RecordConnectionReestablished increments the lazily re-created connection counter
+func (m *NodeMetrics) RecordConnectionReestablished() {
+	atomic.AddUint64(&m.ConnectionsReestablished, 1)
 }
 
 // RecordTokenCreated increments token creation counter
@@ -132,6 +267,8 @@ func (m *NodeMetrics) RecordAuthentication(success bool) {
 }
 
 // RecordQuery records query execution
+// This is the hot path, it only uses atomics: the duration updates the moving average with a compare-and-swap,
+// and goes into a running total (for the lifetime average) and a latency bucket (for the percentiles).
 func (m *NodeMetrics) RecordQuery(success bool, durationMs float64) {
 	atomic.AddUint64(&m.QueriesExecuted, 1)
 	if success {
@@ -140,15 +277,40 @@ func (m *NodeMetrics) RecordQuery(success bool, durationMs float64) {
 		atomic.AddUint64(&m.QueriesFailed, 1)
 	}
 
-	// Update average query time (simple moving average)
-	m.mu.Lock()
-	if m.AverageQueryTime == 0 {
-		m.AverageQueryTime = durationMs
+	if durationMs < 0 {
+		durationMs = 0
+	}
+	atomic.AddUint64(&m.queryTimeTotalMicros, uint64(durationMs*1000))
+
+	// Exponential moving average (alpha = 0.1), the first query sets it
+	for {
+		oldBits := atomic.LoadUint64(&m.queryTimeAverageBits)
+		avg := durationMs
+		if oldBits != 0 {
+			avg = 0.9*math.Float64frombits(oldBits) + 0.1*durationMs
+		}
+		if atomic.CompareAndSwapUint64(&m.queryTimeAverageBits, oldBits, math.Float64bits(avg)) {
+			break
+		}
+	}
+
+	bucket := len(queryLatencyBoundsMs)
+	for i, bound := range queryLatencyBoundsMs {
+		if durationMs <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&m.queryLatencyBuckets[bucket], 1)
+}
+
+// RecordCacheLookup counts a lookup of the query result cache
+func (m *NodeMetrics) RecordCacheLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.QueryCacheHits, 1)
 	} else {
-		// Exponential moving average (alpha = 0.1)
-		m.AverageQueryTime = 0.9*m.AverageQueryTime + 0.1*durationMs
+		atomic.AddUint64(&m.QueryCacheMisses, 1)
 	}
-	m.mu.Unlock()
 }
 
 // GetConnectionPoolStats returns connection pool statistics
@@ -176,7 +338,9 @@ func GetConnectionPoolStats() map[string]interface{} {
 		"total_created":          atomic.LoadUint64(&Metrics.ConnectionsCreated),
 		"total_closed":           atomic.LoadUint64(&Metrics.ConnectionsClosed),
 		"pool_exhaustion_count":  atomic.LoadUint64(&Metrics.PoolExhaustionCount),
-		"last_exhaustion":        Metrics.LastPoolExhaustion.Format(time.RFC3339),
+		"total_reclaimed":        atomic.LoadUint64(&Metrics.ConnectionsReclaimed),
+		"total_reestablished":    atomic.LoadUint64(&Metrics.ConnectionsReestablished),
+		"last_exhaustion":        Metrics.LastPoolExhaustionTime().Format(time.RFC3339),
 		"available_slots":        maxPool - active,
 	}
 }
@@ -240,8 +404,20 @@ func GetHealthStatus() map[string]interface{} {
 		}
 	}
 
+	// Check replica lag
+	if metrics.ReplicaReadsSuspended {
+		status = "degraded"
+		issues = append(issues, "replica lag above threshold, reads suspended")
+	}
+
+	// Check disk space
+	if metrics.DiskLevel == DISK_LEVEL_CRITICAL {
+		status = "degraded"
+		issues = append(issues, "disk projected to be full within disk/critical_days")
+	}
+
 	// Check if database is connected
-	if !CurrentNode.InternalConnection.IsConnected() {
+	if !CurrentNode.GetInternalConnection().IsConnected() {
 		status = "unhealthy"
 		issues = append(issues, "database not connected")
 	}
@@ -249,7 +425,8 @@ func GetHealthStatus() map[string]interface{} {
 	return map[string]interface{}{
 		"status":     status,
 		"issues":     issues,
-		"uptime":     time.Since(metrics.StartTime).String(),
+		"uptime":     CurrentClock.Since(metrics.StartTime).String(),
 		"start_time": metrics.StartTime.Format(time.RFC3339),
+		"init":       GetInitProgress(),
 	}
 }
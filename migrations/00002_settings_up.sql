@@ -38,6 +38,9 @@ INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES
 
 INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("connection", "int", "pool_on", true);
 INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("connection", "int", "max_pool", 25);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("connection", "int", "lease_timeout", 30);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("connection", "int", "reclaim_pct", 80);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("connection", "int", "max_inflight", 256);
 INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("token", "int", "token_exp", 360); -- 6 hours
 INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("token", "int", "refresh_exp", 1440); -- 2 days
 INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("token", "int", "token_ttl", 5); -- 5 minutes
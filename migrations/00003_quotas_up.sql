@@ -0,0 +1,24 @@
+-- Tenant of the user, used for per-tenant storage quotas (empty means no tenant)
+ALTER TABLE _users ADD COLUMN tenant TEXT;
+
+-- Storage quota per user or tenant, 0 means unlimited for that resource
+CREATE TABLE IF NOT EXISTS _storage_quotas (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  subject_type TEXT, -- user/tenant
+  subject TEXT,      -- username or tenant name
+  max_rows INTEGER DEFAULT 0,
+  max_bytes INTEGER DEFAULT 0,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(subject_type, subject)
+);
+
+-- Rows and bytes written through the insert endpoints per user or tenant
+CREATE TABLE IF NOT EXISTS _storage_usage (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  subject_type TEXT, -- user/tenant
+  subject TEXT,      -- username or tenant name
+  rows_written INTEGER DEFAULT 0,
+  bytes_written INTEGER DEFAULT 0,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(subject_type, subject)
+);
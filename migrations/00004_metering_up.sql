@@ -0,0 +1,17 @@
+-- Daily usage per API key (fingerprint) and user, for billing
+CREATE TABLE IF NOT EXISTS _usage_meter (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  day TEXT,          -- YYYY-MM-DD (UTC)
+  api_key TEXT,      -- sha256 fingerprint of the API key, never the key itself
+  username TEXT,
+  requests INTEGER DEFAULT 0,
+  rows_read INTEGER DEFAULT 0,
+  rows_written INTEGER DEFAULT 0,
+  bytes_in INTEGER DEFAULT 0,
+  bytes_out INTEGER DEFAULT 0,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(day, api_key, username)
+);
+
+-- Billing webhook, daily usage is POSTed here when the day rolls over. Empty means no push.
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("metering", "text", "webhook_url", "");
@@ -0,0 +1,13 @@
+-- Report template registry, used by /db/api/report
+CREATE TABLE IF NOT EXISTS _report_templates (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT UNIQUE,
+  title TEXT,
+  description TEXT,
+  query TEXT,          -- single SELECT with ? placeholders
+  params TEXT,         -- comma separated parameter names in placeholder order
+  columns TEXT,        -- comma separated output column order, empty means all sorted
+  format TEXT,         -- default format: csv/html/pdf/json
+  html_template TEXT,  -- optional Go html/template
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,22 @@
+-- Scheduled report delivery by email
+CREATE TABLE IF NOT EXISTS _report_schedules (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  report_name TEXT,    -- _report_templates.name
+  cron_expr TEXT,      -- minute hour day-of-month month day-of-week, in UTC
+  format TEXT,         -- csv/html/pdf, empty means the report format
+  params TEXT,         -- JSON object of report params
+  recipients TEXT,     -- comma separated email addresses
+  subject TEXT,
+  enabled BOOLEAN DEFAULT true,
+  last_run_at TEXT,
+  last_status TEXT,    -- ok/failed
+  last_error TEXT,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+-- SMTP server used for report delivery, fill these in before enabling schedules
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("smtp", "text", "host", "");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("smtp", "text", "port", "587");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("smtp", "text", "username", "");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("smtp", "text", "password", "");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("smtp", "text", "from", "");
@@ -0,0 +1,28 @@
+-- Binary attachments linked to rows
+CREATE TABLE IF NOT EXISTS _files (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  table_name TEXT,     -- table of the row the file belongs to
+  row_id TEXT,         -- id of that row
+  file_name TEXT,
+  content_type TEXT,
+  size INTEGER DEFAULT 0,
+  checksum TEXT,       -- sha256 hex of the content
+  store TEXT,          -- db: chunks in _file_chunks, dir: file in the files/dir directory
+  created_by TEXT,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_files_row ON _files(table_name, row_id);
+
+CREATE TABLE IF NOT EXISTS _file_chunks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  file_id INTEGER,
+  seq INTEGER,
+  data TEXT,           -- base64 of up to 256KB
+  UNIQUE(file_id, seq)
+);
+
+-- db or dir, dir is meant for a directory shared by all nodes (ie: mounted object storage)
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("files", "text", "store", "db");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("files", "text", "dir", "./files");
+-- keep this below the http max request size (32MB by default)
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("files", "int", "max_size", 10485760);
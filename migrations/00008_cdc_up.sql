@@ -0,0 +1,19 @@
+-- Change data capture, filled by triggers installed with /suresql/cdc
+CREATE TABLE IF NOT EXISTS _cdc_tables (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  table_name TEXT UNIQUE,
+  key_column TEXT,     -- identifies a row across changes, default id
+  columns TEXT,        -- comma separated columns captured by the triggers
+  enabled_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS _cdc_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  table_name TEXT,
+  row_key TEXT,
+  op TEXT,             -- insert/update/delete
+  old_data TEXT,       -- JSON of the row before, NULL for insert
+  new_data TEXT,       -- JSON of the row after, NULL for delete
+  changed_at TEXT      -- UTC, YYYY-MM-DDTHH:MM:SS.SSSZ
+);
+CREATE INDEX IF NOT EXISTS idx_cdc_log_table_time ON _cdc_log(table_name, changed_at);
@@ -0,0 +1,17 @@
+-- Trigger-like rules evaluated from the CDC log
+CREATE TABLE IF NOT EXISTS _rules (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT UNIQUE,
+  table_name TEXT,     -- must be covered by CDC
+  events TEXT,         -- comma separated: insert,update,delete
+  condition TEXT,      -- JSON condition on the new row (old row for delete), empty matches all
+  action TEXT,         -- sql or webhook
+  statement TEXT,      -- for sql, can use :new.column and :old.column
+  webhook_url TEXT,    -- for webhook, receives the change as JSON
+  enabled BOOLEAN DEFAULT true,
+  last_change_id INTEGER DEFAULT 0,  -- _cdc_log id processed so far
+  fired_count INTEGER DEFAULT 0,
+  last_fired_at TEXT,
+  last_error TEXT,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,12 @@
+-- Derived (aggregate) tables kept up to date from the CDC log of their source
+CREATE TABLE IF NOT EXISTS _derived_tables (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT UNIQUE,    -- the derived table
+  source_table TEXT,   -- must be covered by CDC
+  group_by TEXT,       -- ie: date(created_at) AS day, region
+  aggregates TEXT,     -- ie: SUM(total) AS total, COUNT(*) AS orders
+  last_change_id INTEGER DEFAULT 0,
+  last_refresh_at TEXT,
+  last_error TEXT,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
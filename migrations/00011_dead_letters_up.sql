@@ -0,0 +1,14 @@
+-- Failed operations kept for inspection and retry
+CREATE TABLE IF NOT EXISTS _dead_letters (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  source TEXT,         -- what failed: insert, queue or webhook
+  target TEXT,         -- table, url, ... depending on source
+  payload TEXT,        -- JSON
+  error TEXT,
+  retry_count INTEGER DEFAULT 0,
+  status TEXT,         -- pending or resolved
+  username TEXT,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+  last_retry_at TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_dead_letters_source ON _dead_letters(source, status);
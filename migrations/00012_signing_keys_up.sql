@@ -0,0 +1,13 @@
+-- HMAC signing keys of machine clients
+CREATE TABLE IF NOT EXISTS _signing_keys (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  key_id TEXT UNIQUE,
+  secret TEXT,
+  username TEXT,       -- the user signed requests act as
+  enabled BOOLEAN DEFAULT true,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 1 rejects unsigned requests to /db/api, max_skew is in seconds
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("signing", "bool", "required", 0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("signing", "int", "max_skew", 300);
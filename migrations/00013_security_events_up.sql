@@ -0,0 +1,16 @@
+-- security events: authentication failures, credential reuse, policy violations (kept apart from _access_logs)
+CREATE TABLE IF NOT EXISTS _security_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  event_type TEXT,     -- auth_failure, token_reuse, policy_violation, permission_denied, lockout
+  severity TEXT,       -- info, warning, critical
+  username TEXT,
+  client_ip TEXT,
+  path TEXT,
+  message TEXT,
+  node_number INTEGER,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_security_events_type ON _security_events(event_type, created_at);
+
+-- security events are posted to this URL in batches (JSON array), empty to disable
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("security", "text", "siem_url", "");
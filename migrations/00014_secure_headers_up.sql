@@ -0,0 +1,9 @@
+-- security headers added to every response, an empty text value removes that header
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("headers", "bool", "enabled", 1);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("headers", "int", "hsts_max_age", 31536000);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("headers", "bool", "hsts_subdomains", 1);
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("headers", "text", "frame_options", "DENY");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("headers", "text", "referrer_policy", "no-referrer");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("headers", "text", "content_security", "default-src 'none'; frame-ancestors 'none'");
+-- JSON object of extra headers, ie: {"Permissions-Policy": "geolocation=()"}
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("headers", "text", "custom", "");
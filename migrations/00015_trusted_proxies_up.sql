@@ -0,0 +1,2 @@
+-- comma separated IPs/CIDRs of the load balancers in front of SureSQL, their X-Forwarded-For/X-Real-IP is believed
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("proxy", "text", "trusted", "");
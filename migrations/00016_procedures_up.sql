@@ -0,0 +1,9 @@
+-- named server-side scripts, called with POST /db/api/procedures/<name>
+CREATE TABLE IF NOT EXISTS _procedures (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT UNIQUE,
+  description TEXT,
+  params TEXT,         -- comma separated parameter names
+  steps TEXT,          -- JSON array of steps
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
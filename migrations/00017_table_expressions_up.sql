@@ -0,0 +1,13 @@
+-- per-table expressions: compute (before insert), validate (before insert), transform (query results)
+CREATE TABLE IF NOT EXISTS _table_expressions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  table_name TEXT,
+  kind TEXT,           -- compute, validate, transform
+  column_name TEXT,    -- column set by compute/transform, reported by validate
+  expression TEXT,
+  message TEXT,        -- validate error message
+  position INTEGER DEFAULT 0,
+  enabled BOOLEAN DEFAULT true,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_table_expressions_table ON _table_expressions(table_name);
@@ -0,0 +1,19 @@
+-- translations of user-facing messages, the key is the message as written in the code
+CREATE TABLE IF NOT EXISTS _messages (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  locale TEXT,         -- lowercase, ie: id, pt-br
+  message_key TEXT,
+  text TEXT,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(locale, message_key)
+);
+
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("i18n","text","default_locale","en");
+
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Invalid request format","Format permintaan tidak valid");
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Cannot retrieve token from context","Token tidak ditemukan");
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Failed to execute query","Gagal menjalankan query");
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Invalid table name","Nama tabel tidak valid");
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Table name is required","Nama tabel wajib diisi");
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Invalid credentials","Kredensial tidak valid");
+INSERT INTO _messages(locale, message_key, text) VALUES ("id","Failed to create database connection","Gagal membuat koneksi database");
@@ -0,0 +1,3 @@
+-- warnings of slow requests and the row limit of queries without one (0 is none)
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("query","int","slow_ms",1000);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("query","int","default_limit",0);
@@ -0,0 +1,3 @@
+-- client SDK version policy, empty is no check. ie: 1.4.0 or suresql-go=1.4.0,suresql-js=0.9.0
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("client","text","min_version","");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("client","text","reject_below","");
@@ -0,0 +1,7 @@
+-- persisted tokens (setting token/persist), token and refresh hold SHA-256 hashes
+ALTER TABLE _tokens ADD COLUMN username TEXT;
+ALTER TABLE _tokens ADD COLUMN tenant TEXT;
+CREATE INDEX IF NOT EXISTS idx_tokens_token ON _tokens(token);
+CREATE INDEX IF NOT EXISTS idx_tokens_refresh ON _tokens(refresh);
+
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("token","bool","persist",0);
@@ -0,0 +1,8 @@
+-- server transport tuning, 0 timeouts keep the SIMPLEHTTP_* environment values
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","int","read_timeout_ms",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","int","write_timeout_ms",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","int","idle_timeout_ms",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","bool","keep_alive",1);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","bool","http2",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","int","max_concurrent_streams",250);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("http","int","concurrency",0);
@@ -0,0 +1,4 @@
+-- outbound proxy: empty uses HTTP_PROXY/HTTPS_PROXY/NO_PROXY, "direct" means no proxy
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("proxy","text","outbound","");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("proxy","text","outbound_webhook","");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("proxy","text","outbound_smtp","");
@@ -0,0 +1,23 @@
+-- peer mTLS: CAs managed by the leader (key encrypted with SURESQL_PEER_SECRET) and the node certificates
+CREATE TABLE IF NOT EXISTS _peer_cas (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  cert_pem TEXT,
+  key_enc TEXT,
+  not_before TEXT,
+  not_after TEXT,
+  created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS _peer_certs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  node_name TEXT UNIQUE,
+  csr_pem TEXT,
+  cert_pem TEXT,       -- empty until the leader signs the CSR
+  ca_id INTEGER DEFAULT 0,
+  not_after TEXT,
+  issued_at TEXT,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("peer","bool","mtls",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("peer","int","cert_days",30);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("peer","int","ca_days",365);
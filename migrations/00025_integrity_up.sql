@@ -0,0 +1,14 @@
+-- record-level checksums: tables whose rows carry an HMAC in _checksum, checked by /suresql/verify
+CREATE TABLE IF NOT EXISTS _integrity_tables (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  table_name TEXT UNIQUE,
+  key_column TEXT DEFAULT 'id',
+  columns TEXT,          -- comma separated, the columns covered by the checksum
+  enabled BOOLEAN DEFAULT true,
+  verified_at TEXT,
+  verified_rows INTEGER DEFAULT 0,
+  mismatches INTEGER DEFAULT 0,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("integrity","int","verify_hours",0);
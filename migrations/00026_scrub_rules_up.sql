@@ -0,0 +1,11 @@
+-- scrub profiles: how columns are anonymized in exports for staging, a profile is all rules with its name
+CREATE TABLE IF NOT EXISTS _scrub_rules (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  profile TEXT,
+  table_name TEXT,     -- * applies to every table with the column
+  column_name TEXT,
+  action TEXT,         -- hash, hash_email, randomize_name, null, mask, fixed
+  value TEXT,          -- hash_email: domain, mask: characters kept, fixed: the replacement
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_scrub_rules_column ON _scrub_rules(profile, table_name, column_name);
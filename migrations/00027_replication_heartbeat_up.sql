@@ -0,0 +1,11 @@
+-- replica lag: the leader bumps seq every heartbeat_sec, every node compares its local copy against the leader
+CREATE TABLE IF NOT EXISTS _replication_heartbeat (
+  id INTEGER PRIMARY KEY,
+  seq INTEGER DEFAULT 0,
+  written_at TEXT,       -- leader clock, RFC3339 with nanoseconds
+  node_number INTEGER DEFAULT 0
+);
+
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("replication","int","heartbeat_sec",5);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("replication","int","lag_warn_sec",10);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("replication","int","lag_max_sec",30);
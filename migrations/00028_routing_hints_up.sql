@@ -0,0 +1,2 @@
+-- X-SureSQL-Route hints clients may use, comma separated, "none" for no hints
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("routing","text","hints","prefer-leader,prefer-replica,node");
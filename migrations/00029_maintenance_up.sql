@@ -0,0 +1,20 @@
+-- scheduled database maintenance, one row per task run
+CREATE TABLE IF NOT EXISTS _maintenance_runs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  task TEXT,           -- analyze, vacuum, optimize, checkpoint
+  statement TEXT,
+  status TEXT,         -- ok, failed
+  error TEXT,
+  duration_ms INTEGER DEFAULT 0,
+  manual INTEGER DEFAULT 0,
+  node_number INTEGER DEFAULT 0,
+  started_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_maintenance_runs_task ON _maintenance_runs(task, started_at);
+
+-- when the tasks run, 5 field cron in UTC, empty disables. Tasks the DBMS does not have are skipped
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("maintenance","text","analyze_cron","30 3 * * *");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("maintenance","text","optimize_cron","0 * * * *");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("maintenance","text","vacuum_cron","");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("maintenance","text","checkpoint_cron","*/15 * * * *");
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("maintenance","int","history_days",30);
@@ -0,0 +1,17 @@
+-- disk usage samples of every node, the growth rate projects when the disk is full
+CREATE TABLE IF NOT EXISTS _disk_usage (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  node_number INTEGER,
+  dir_size INTEGER DEFAULT 0,
+  db_size INTEGER DEFAULT 0,
+  sampled_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_disk_usage_node ON _disk_usage(node_number, sampled_at);
+
+-- disk capacity of the DBMS data in MB, 0 samples the sizes without projecting
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("disk","int","capacity_mb",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("disk","int","sample_min",15);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("disk","int","window_hours",72);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("disk","int","warn_days",14);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("disk","int","critical_days",3);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("disk","int","history_days",30);
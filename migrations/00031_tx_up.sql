@@ -0,0 +1,4 @@
+-- interactive transactions: rolled back when idle or open too long, max_open 0 disables them
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("tx","int","idle_sec",30);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("tx","int","max_sec",300);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("tx","int","max_open",20);
@@ -0,0 +1,11 @@
+-- feature flags: optional subsystems switched at runtime, a flag without a row is on
+CREATE TABLE IF NOT EXISTS _feature_flags (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  flag TEXT,
+  enabled INTEGER DEFAULT 1,
+  tenants TEXT,        -- comma separated, empty is every tenant
+  roles TEXT,          -- comma separated role_name, empty is every role
+  description TEXT,
+  updated_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_feature_flags_flag ON _feature_flags(flag);
@@ -0,0 +1,4 @@
+-- A/B experiment: share of the querysql reads mirrored to the alternate backend (EXPERIMENT_DBMS_*), 0 is off
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("experiment","int","sample_pct",0);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("experiment","int","max_inflight",4);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("experiment","int","keep",100);
@@ -0,0 +1,5 @@
+-- Shadow traffic: share of the data API requests sent again to the staging node (SHADOW_URL), 0 is off
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("shadow","int","sample_pct",0);
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("shadow","text","mode","reads");
+INSERT INTO _settings(category, data_type, setting_key, text_value) VALUES ("shadow","text","redact","");
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("shadow","int","max_inflight",8);
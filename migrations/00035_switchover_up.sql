@@ -0,0 +1,3 @@
+-- Blue/green switchover: tables up to checksum_rows are compared row by row, a flip needs a verify this recent
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("switchover","int","checksum_rows",10000);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("switchover","int","verify_max_sec",300);
@@ -0,0 +1,3 @@
+-- Queued inserts: records waiting at once, how long the outcome of one is kept for /db/api/queue
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("write_queue","int","max_pending",10000);
+INSERT INTO _settings(category, data_type, setting_key, int_value) VALUES ("write_queue","int","keep_sec",3600);
@@ -0,0 +1,12 @@
+-- settings history: every change made through /suresql/settings, secrets are masked
+CREATE TABLE IF NOT EXISTS _settings_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  category TEXT,
+  setting_key TEXT,
+  action TEXT,         -- set or delete
+  old_value TEXT,
+  new_value TEXT,
+  changed_by TEXT,
+  changed_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_settings_history_key ON _settings_history(category, setting_key);
@@ -0,0 +1,8 @@
+-- nonces of signed requests, shared by all nodes so a captured request cannot be replayed on another one
+CREATE TABLE IF NOT EXISTS _signing_nonces (
+  key_id TEXT,
+  nonce TEXT,
+  expires_at TEXT,     -- the row is only kept while a request carrying the nonce could pass the timestamp check
+  PRIMARY KEY (key_id, nonce)
+);
+CREATE INDEX IF NOT EXISTS idx_signing_nonces_expires ON _signing_nonces(expires_at);
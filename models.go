@@ -25,6 +25,14 @@ const (
 	// Default Pool settings
 	DEFAULT_MAX_POOL     = 25
 	DEFAULT_POOL_ENABLED = true
+
+	// Default connection lease settings, idle connections are reclaimed only when pool usage >= reclaim pct
+	DEFAULT_LEASE_TIMEOUT = 30 * time.Minute
+	DEFAULT_RECLAIM_PCT   = 80.0
+
+	// Version of the request/response models, bump it on a breaking change of their JSON shape.
+	// The shapes are pinned by golden files in server/testdata/api/v<API_VERSION>
+	API_VERSION = 1
 )
 
 // GLOBAL VAR
@@ -35,6 +43,8 @@ var (
 	// Standard errors using medaerror for consistency
 	ErrNoDBConnection       = medaerror.MedaError{Message: "no db connection"}
 	ErrDBInitializedAlready = medaerror.MedaError{Message: "DB already initialized"}
+	ErrDBNotInitialized     = medaerror.MedaError{Message: "DB not initialized"}
+	ErrPoolExhausted        = medaerror.MedaError{Message: "db pool quota exceeded"}
 	SchemaTable string = ""
 	// EmptyConnection SureSQLDB = SureSQLDB{}
 )
@@ -43,9 +53,10 @@ type SureSQLDB orm.Database
 
 // StandardResponse is a structured response format for all API responses
 type StandardResponse struct {
-	Status  int         `json:"status"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data"`
+	Status   int         `json:"status"`
+	Message  string      `json:"message"`
+	Data     interface{} `json:"data"`
+	Warnings []string    `json:"warnings,omitempty"` // non-fatal notices, the request still succeeded
 }
 
 // ===== Used in handle_SQL endpoints
@@ -54,6 +65,13 @@ type SQLRequest struct {
 	Statements []string                `json:"statements,omitempty"` // Raw SQL statements to execute
 	ParamSQL   []orm.ParametereizedSQL `json:"param_sql,omitempty"`  // Parameterized SQL statements to execute
 	SingleRow  bool                    `json:"single_row,omitempty"` // If true, return only first row
+	Atomic     bool                    `json:"atomic,omitempty"`     // If true, all statements run in one transaction, rolled back at the first failure
+	Stream     bool                    `json:"stream,omitempty"`     // If true, one select answers NDJSON records written while they are read
+	Parallel   bool                    `json:"parallel,omitempty"`   // If true, independent statements run at once on the worker pool, results in order
+	DryRun     bool                    `json:"dry_run,omitempty"`    // If true, nothing runs, /sql answers the classification of every statement
+	// Optional rqlite read consistency of this call (none, weak, linearizable, strong) and the freshness of none, e.g. "1s"
+	Consistency string `json:"consistency,omitempty"`
+	Freshness   string `json:"freshness,omitempty"`
 }
 
 // SQLResponse represents the response structure for SQL execution results
@@ -61,6 +79,10 @@ type SQLResponse struct {
 	Results       []orm.BasicSQLResult `json:"results"`        // Results for each executed statement
 	ExecutionTime float64              `json:"execution_time"` // Total execution time in milliseconds
 	RowsAffected  int                  `json:"rows_affected"`  // Total number of rows affected
+	// Insert with return_ids: the primary key of every record in request order, a map for composite keys
+	InsertedIDs []interface{} `json:"inserted_ids,omitempty"`
+	// Dry run: what every statement is and if it can be run again, see retry_safety.go
+	Classification []StatementClass `json:"classification,omitempty"`
 }
 
 // ===== Used in handle_Query endpoints
@@ -69,6 +91,35 @@ type QueryRequest struct {
 	Table     string         `json:"table"`                // Table name for queries
 	Condition *orm.Condition `json:"condition,omitempty"`  // Optional condition for filtering
 	SingleRow bool           `json:"single_row,omitempty"` // If true, return only first row
+	AsOf      *time.Time     `json:"as_of,omitempty"`      // Rows as they were at this time, table must be covered by CDC
+	// Optional post-processing of the rows: filter, derived columns, pivot, rename, select, precision
+	Transform *ResultTransform `json:"transform,omitempty"`
+	// Optional rqlite read consistency of this call (none, weak, linearizable, strong) and the freshness of none, e.g. "1s"
+	Consistency string `json:"consistency,omitempty"`
+	Freshness   string `json:"freshness,omitempty"`
+	// With group_by in the condition the records are the group columns and these aggregates of every group,
+	// Having filters the groups, its fields are group columns or aggregate aliases
+	Aggregates []AggregateFunction `json:"aggregates,omitempty"`
+	Having     *orm.Condition      `json:"having,omitempty"`
+	// Tables joined to Table, their columns are in the records as table.column (alias.column)
+	Joins []QueryJoin `json:"joins,omitempty"`
+	// Columns the records have, all when empty, alias.column for a joined table
+	Fields []string `json:"fields,omitempty"`
+	// Only distinct records (of Fields, or whole rows), ie: the values of a dropdown
+	Distinct bool `json:"distinct,omitempty"`
+	// Page (from 1) of PageSize records, the response has the total count, not with a condition limit or offset
+	Page     int `json:"page,omitempty"`
+	PageSize int `json:"page_size,omitempty"`
+	// Next page of a page_size without page, the next_cursor of the previous response
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// QueryJoin is a table joined in /db/api/query, the values of On are the columns compared with
+type QueryJoin struct {
+	Table string         `json:"table"`
+	Alias string         `json:"alias,omitempty"` // needed to join a table twice
+	Type  string         `json:"type,omitempty"`  // INNER (default) or LEFT
+	On    *orm.Condition `json:"on"`              // ie: {"field": "orders.customer_id", "operator": "=", "value": "customers.id"}
 }
 
 // QueryResponse represents the response structure for query results
@@ -76,6 +127,10 @@ type QueryResponse struct {
 	Records       []orm.DBRecord `json:"records"` // Always returns as array, even for single record
 	ExecutionTime float64        `json:"execution_time"`
 	Count         int            `json:"count"`
+	TotalCount    *int           `json:"total_count,omitempty"` // Records of all pages, when paged
+	HasMore       bool           `json:"has_more,omitempty"`    // More pages follow
+	NextCursor    string         `json:"next_cursor,omitempty"` // Cursor of the next page, when paged by cursor
+	Truncated     bool           `json:"truncated,omitempty"`   // More rows matched than connection/max_rows, the records stop at it
 }
 
 // QueryRequest represents the simplified request structure for executing SELECT queries
@@ -89,6 +144,130 @@ type InsertRequest struct {
 	Records   []orm.DBRecord `json:"records"`              // Records to insert
 	Queue     bool           `json:"queue,omitempty"`      // Whether to use queue operations (optional)
 	SameTable bool           `json:"same_table,omitempty"` // Indicates if all records belong to the same table
+	// Insert the records one by one, a bad record does not abort the batch and the result of each record is returned
+	ContinueOnError bool `json:"continue_on_error,omitempty"`
+	DeadLetter      bool `json:"dead_letter,omitempty"` // With ContinueOnError, keep failed records in _dead_letters
+	ReturnIDs       bool `json:"return_ids,omitempty"`  // Return the primary key of every record, one statement per record
+}
+
+// InsertStreamResponse is the answer to an NDJSON insert. When it fails the chunks before the failed line
+// stay inserted, for a part of an upload sending the part again continues after them.
+type InsertStreamResponse struct {
+	Records       int                `json:"records"`           // inserted by this request
+	Skipped       int                `json:"skipped,omitempty"` // of the part, inserted by an earlier request
+	Chunks        int                `json:"chunks"`
+	RowsAffected  int                `json:"rows_affected"`
+	Upload        string             `json:"upload,omitempty"`
+	Part          int                `json:"part,omitempty"`
+	UploadRecords int                `json:"upload_records,omitempty"` // inserted by all parts of the upload
+	FailedLine    int                `json:"failed_line,omitempty"`    // line of the body that stopped the insert
+	Problems      []RecordFieldError `json:"problems,omitempty"`       // record is the line of the body
+	ExecutionTime float64            `json:"execution_time"`
+}
+
+// CSVImportResponse is the answer to /db/api/import/csv, the rows with problems were not inserted and the
+// others were. When a field the CSV cannot parse stops the import the chunks before stay inserted.
+type CSVImportResponse struct {
+	Table         string             `json:"table"`
+	Rows          int                `json:"rows"` // data rows read
+	Inserted      int                `json:"inserted"`
+	Failed        int                `json:"failed"`
+	Chunks        int                `json:"chunks"`
+	RowsAffected  int                `json:"rows_affected"`
+	FailedLine    int                `json:"failed_line,omitempty"` // line of the CSV that stopped the import
+	Problems      []RecordFieldError `json:"problems,omitempty"`    // record is the line of the CSV, the first CSV_IMPORT_MAX_ERRORS
+	ExecutionTime float64            `json:"execution_time"`
+}
+
+// UpdateRequest is the body of /db/api/update, the columns in Values are set on the rows of Table
+// matching Condition. A request without a condition is refused unless AllRows is set.
+type UpdateRequest struct {
+	Table     string                 `json:"table"`
+	Values    map[string]interface{} `json:"values"`              // column: new value
+	Condition *orm.Condition         `json:"condition,omitempty"` // fields only, no order, group, limit or offset
+	AllRows   bool                   `json:"all_rows,omitempty"`  // update every row of the table
+}
+
+// BatchUpdateRequest is the body of /db/api/update/batch, every record (of any table) holds the key of
+// its row and the columns to set on it
+type BatchUpdateRequest struct {
+	Records    []orm.DBRecord `json:"records"`
+	KeyColumns []string       `json:"key_columns,omitempty"` // the primary key of the table when empty
+	Atomic     bool           `json:"atomic,omitempty"`      // all records in one transaction, none applied on a failure
+}
+
+// BatchUpdateResponse is the response of /db/api/update/batch, NotFound are the records whose key matched
+// no row and Failed the ones whose statement failed (not atomic), by index in the request records
+type BatchUpdateResponse struct {
+	Results       []orm.BasicSQLResult `json:"results"`
+	ExecutionTime float64              `json:"execution_time"`
+	RowsAffected  int                  `json:"rows_affected"`
+	NotFound      []int                `json:"not_found,omitempty"`
+	Failed        []int                `json:"failed,omitempty"`
+}
+
+// DeleteRequest is the body of /db/api/delete, the rows of Table matching Condition are deleted. A request
+// without a condition is refused unless AllowFullDelete is set.
+type DeleteRequest struct {
+	Table           string         `json:"table"`
+	Condition       *orm.Condition `json:"condition,omitempty"`         // fields only, no order, group, limit or offset
+	AllowFullDelete bool           `json:"allow_full_delete,omitempty"` // delete every row of the table
+}
+
+// AggregateRequest is the body of /db/api/aggregate, the functions are computed over the rows of Table
+// matching Condition, one row per group of GroupBy (a single row without it)
+type AggregateRequest struct {
+	Table      string              `json:"table"`
+	Aggregates []AggregateFunction `json:"aggregates"`
+	GroupBy    []string            `json:"group_by,omitempty"`
+	Condition  *orm.Condition      `json:"condition,omitempty"` // fields, order by (group column or alias), limit and offset
+	Having     *orm.Condition      `json:"having,omitempty"`    // fields only, a group column or alias
+	// Optional rqlite read consistency of this call (none, weak, linearizable, strong) and the freshness of none, e.g. "1s"
+	Consistency string `json:"consistency,omitempty"`
+	Freshness   string `json:"freshness,omitempty"`
+}
+
+// AggregateFunction is one aggregate of the request, Alias is its column in the rows (ie: sum_amount)
+type AggregateFunction struct {
+	Function string `json:"function"`           // COUNT, SUM, AVG, MIN or MAX
+	Column   string `json:"column,omitempty"`   // empty or * for COUNT(*)
+	Alias    string `json:"alias,omitempty"`    // function_column by default, count for COUNT(*)
+	Distinct bool   `json:"distinct,omitempty"` // over the distinct values of the column
+}
+
+// AggregateResponse is the response of /db/api/aggregate, every row holds the group columns and the aliases
+type AggregateResponse struct {
+	Rows          []map[string]interface{} `json:"rows"`
+	Aggregates    []AggregateFunction      `json:"aggregates"` // the functions with their aliases
+	ExecutionTime float64                  `json:"execution_time"`
+	Count         int                      `json:"count"`
+}
+
+// UpsertRequest is the body of /db/api/upsert, the records (all of one table) are inserted and a record
+// conflicting with a row on ConflictColumns is resolved by Strategy: ignore, update or replace
+type UpsertRequest struct {
+	Records         []orm.DBRecord `json:"records"`
+	ConflictColumns []string       `json:"conflict_columns"`         // unique or primary key columns, in every record
+	Strategy        string         `json:"strategy,omitempty"`       // ignore, update (default) or replace
+	UpdateColumns   []string       `json:"update_columns,omitempty"` // update: columns set from the record, every non-conflict column when empty
+}
+
+// InsertRecordResult is the outcome of one record of a ContinueOnError insert
+type InsertRecordResult struct {
+	Index        int         `json:"index"` // index in the request records
+	Success      bool        `json:"success"`
+	Error        string      `json:"error,omitempty"`
+	LastInsertID int         `json:"last_insert_id,omitempty"`
+	ID           interface{} `json:"id,omitempty"`             // with return_ids, the primary key of the record
+	DeadLetterID int         `json:"dead_letter_id,omitempty"` // when the failure was kept in _dead_letters
+}
+
+// InsertResponse is the response of a ContinueOnError insert
+type InsertResponse struct {
+	Records       []InsertRecordResult `json:"records"`
+	ExecutionTime float64              `json:"execution_time"`
+	RowsAffected  int                  `json:"rows_affected"`
+	Failed        int                  `json:"failed"`
 }
 
 // Originally this was saved in DB as table, but maybe Redis or some auto-expire system is better
@@ -102,6 +281,7 @@ type TokenTable struct {
 	CreatedAt        time.Time `json:"created_at,omitempty"          db:"created_at"`
 	// additional members
 	UserName string
+	Tenant   string
 }
 
 func (t TokenTable) TableName() string {
@@ -205,11 +385,16 @@ type SureSQLNode struct {
 	Config             ConfigTable          `json:"settings,omitempty"             db:"settings"`            // Settings for this node, from DB table
 	Settings           Settings             `json:"configs,omitempty"              db:"configs"`             // Configs for this node, from DB table
 	Status             orm.NodeStatusStruct `json:"status,omitempty"               db:"status"`              // Status for SureSQL DB Node that is standard from orm
-	InternalConnection SureSQLDB            `json:"internal_connection,omitempty"  db:"internal_connection"` // master connection to InternalDB
+	InternalConnection SureSQLDB            `json:"internal_connection,omitempty"  db:"internal_connection"` // master connection to InternalDB, read it with GetInternalConnection
 	DBConnections      *medattlmap.TTLMap   `json:"db_connections,omitempty"       db:"db_connections"`      // another connection based on Token
 	MaxPool            int                  `json:"max_pool,omitempty"             db:"max_pool"`            // total nodes for this project
 	IsPoolEnabled      bool                 `json:"is_poolenabled,omitempty"       db:"is_poolenabled"`      // if this DB already initialized
+	LeaseTimeout       time.Duration        `json:"lease_timeout,omitempty"        db:"lease_timeout"`       // idle time before a pooled connection can be reclaimed
+	ReclaimPct         float64              `json:"reclaim_pct,omitempty"          db:"reclaim_pct"`         // pool usage (percent) from which idle connections are reclaimed
+	MaxInFlight        int64                `json:"max_inflight,omitempty"         db:"max_inflight"`        // concurrent API requests before backpressure rejects
 	IsEncrypted        bool                 `json:"is_encrypted,omitempty"         db:"is_encrypted"`        // none/AES/Bcrypt (already in Settings)
+	adminUsername      string               // basic auth of /suresql, /monitoring and impersonation, read it with GetAdminCredentials
+	adminPassword      string
 	// IP                 string               `json:"ip,omitempty"                   db:"ip"`                  // IP for this sureSQL node
 	// TokenExp           time.Duration        `json:"token_exp,omitempty"            db:"token_exp"`           // token expiration in minutes
 	// RefreshExp         time.Duration        `json:"refresh_exp,omitempty"          db:"refresh_exp"`         // refresh token expiration in minutes
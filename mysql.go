@@ -0,0 +1,148 @@
+package suresql
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// MySQL and MariaDB through SQLDatabase with the github.com/go-sql-driver/mysql driver, compiled
+// into app/suresql with -tags mysql. DBMS_OPTIONS are added to the DSN (ie: charset=utf8mb4).
+
+const (
+	MYSQL_DEFAULT_PORT = "3306"
+	MYSQL_SCHEMA_TABLE = "information_schema.tables"
+)
+
+var MySQLFlavor = SQLFlavor{
+	Name:     "mysql",
+	Driver:   "mysql",
+	BuildTag: "mysql",
+	Schema:   mysqlSchema,
+	Status:   mysqlStatus,
+}
+
+// newMySQLDatabase creates a new MySQL/MariaDB database connection
+func newMySQLDatabase(conf SureSQLDBMSConfig) (SureSQLDB, error) {
+	port := conf.Port
+	if port == "" {
+		port = MYSQL_DEFAULT_PORT
+	}
+	address := net.JoinHostPort(conf.Host, port)
+	flavor := MySQLFlavor
+	flavor.QueryTime = conf.HttpTimeout
+
+	db, err := OpenSQLDatabase(flavor, mysqlDSN(conf, address), address)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// mysqlDSN is user:password@tcp(host:port)/database?options in the go-sql-driver format
+func mysqlDSN(conf SureSQLDBMSConfig, address string) string {
+	params := []string{}
+	if conf.SSL {
+		params = append(params, "tls=true")
+	}
+	if conf.HttpTimeout > 0 {
+		params = append(params, "timeout="+conf.HttpTimeout.String())
+	}
+	if conf.Options != "" {
+		params = append(params, strings.TrimPrefix(conf.Options, "?"))
+	}
+	dsn := conf.Username
+	if conf.Password != "" {
+		dsn += ":" + conf.Password
+	}
+	dsn += "@tcp(" + address + ")/" + conf.Database
+	if len(params) > 0 {
+		dsn += "?" + strings.Join(params, "&")
+	}
+	return dsn
+}
+
+// mysqlSchema lists the tables, views and indexes of the current database
+func mysqlSchema(db *sql.DB, hideSQL, hideSureSQL bool) []orm.SchemaStruct {
+	schemas := []orm.SchemaStruct{}
+	rows, err := db.Query("SELECT TABLE_TYPE, TABLE_NAME FROM information_schema.tables WHERE table_schema = DATABASE() ORDER BY TABLE_TYPE, TABLE_NAME")
+	if err != nil {
+		return schemas
+	}
+	for rows.Next() {
+		var kind, name string
+		if rows.Scan(&kind, &name) != nil {
+			continue
+		}
+		if hideSureSQL && strings.HasPrefix(name, "_") {
+			continue
+		}
+		objectType := "table"
+		if kind == "VIEW" {
+			objectType = "view"
+		}
+		schemas = append(schemas, orm.SchemaStruct{ObjectType: objectType, ObjectName: name, TableName: name})
+	}
+	rows.Close()
+
+	if !hideSQL {
+		for i, s := range schemas {
+			var name, create string
+			// views return 4 columns, only the statement is needed
+			if r, err := db.Query("SHOW CREATE TABLE `" + s.TableName + "`"); err == nil {
+				if r.Next() {
+					cols, _ := r.Columns()
+					values := make([]interface{}, len(cols))
+					values[0], values[1] = &name, &create
+					for j := 2; j < len(cols); j++ {
+						values[j] = new(sql.RawBytes)
+					}
+					if r.Scan(values...) == nil {
+						schemas[i].SQLCommand = create
+					}
+				}
+				r.Close()
+			}
+		}
+	}
+
+	rows, err = db.Query("SELECT DISTINCT INDEX_NAME, TABLE_NAME FROM information_schema.statistics WHERE table_schema = DATABASE() AND INDEX_NAME <> 'PRIMARY' ORDER BY TABLE_NAME, INDEX_NAME")
+	if err != nil {
+		return schemas
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var index, table string
+		if rows.Scan(&index, &table) != nil || (hideSureSQL && strings.HasPrefix(table, "_")) {
+			continue
+		}
+		schemas = append(schemas, orm.SchemaStruct{ObjectType: "index", ObjectName: index, TableName: table})
+	}
+	return schemas
+}
+
+// mysqlStatus reads the version, uptime and size of the current database
+func mysqlStatus(db *sql.DB) (orm.StatusStruct, error) {
+	status := orm.StatusStruct{DBMS: "mysql"}
+	if err := db.QueryRow("SELECT VERSION()").Scan(&status.Version); err != nil {
+		return status, err
+	}
+	if strings.Contains(strings.ToLower(status.Version), "mariadb") {
+		status.DBMS = "mariadb"
+	}
+	// needs no privilege on MySQL and MariaDB, but do not fail the status on it
+	var name string
+	var uptime int64
+	if db.QueryRow("SHOW GLOBAL STATUS LIKE 'Uptime'").Scan(&name, &uptime) == nil {
+		status.Uptime = time.Duration(uptime) * time.Second
+		status.StartTime = time.Now().Add(-status.Uptime)
+	}
+	var size sql.NullInt64
+	if db.QueryRow("SELECT SUM(data_length + index_length) FROM information_schema.tables WHERE table_schema = DATABASE()").Scan(&size) == nil {
+		status.DBSize = size.Int64
+	}
+	return status, nil
+}
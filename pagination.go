@@ -0,0 +1,114 @@
+package suresql
+
+import (
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Pagination: page (from 1) and page_size of a QueryRequest become the limit and offset of its condition,
+// the response has the total count of the query and whether more pages follow. The total is a COUNT(*)
+// over the same query without order, limit and offset, so it counts the groups, the joined or the distinct
+// records the pages have. It runs only when the page does not tell it already: a page that is not full is
+// the last one. The transform of the request runs after, the total counts the records before it.
+
+const QUERY_MAX_PAGE_SIZE = 10000
+
+var (
+	ErrPageInvalid = medaerror.MedaError{Message: "page starts at 1 and page_size is between 1 and 10000"}
+	ErrPageLimit   = medaerror.MedaError{Message: "page cannot be combined with single_row or the limit and offset of the condition"}
+	ErrPageMaxRows = medaerror.MedaError{Message: "page_size is over connection/max_rows"}
+)
+
+// ApplyPage sets the limit and offset of the page on the condition of the request, it returns the page
+// size, 0 when the request is not paged or paged by cursor. Without page_size the page has query/default_limit
+// records.
+func ApplyPage(req *QueryRequest) (int, error) {
+	if (req.Page == 0 && req.PageSize == 0) || req.Cursored() {
+		return 0, nil
+	}
+	if req.Page < 1 || req.PageSize < 0 || req.PageSize > QUERY_MAX_PAGE_SIZE {
+		return 0, ErrPageInvalid
+	}
+	if req.SingleRow || (req.Condition != nil && (req.Condition.Limit != 0 || req.Condition.Offset != 0)) {
+		return 0, ErrPageLimit
+	}
+	size, err := pageSize(req.PageSize)
+	if err != nil {
+		return 0, err
+	}
+	c := orm.Condition{}
+	if req.Condition != nil {
+		c = *req.Condition
+	}
+	c.Limit = size
+	c.Offset = (req.Page - 1) * size
+	req.Condition = &c
+	return size, nil
+}
+
+// pageSize is the size of a page of page_size records (0 when not given: query/default_limit), a page is never
+// cut by connection/max_rows, a page_size over it is refused and the default is lowered to it
+func pageSize(requested int) (int, error) {
+	size, max := requested, MaxRows()
+	if size == 0 {
+		if size = DefaultQueryLimit(); size == 0 {
+			size = orm.DEFAULT_PAGINATION_LIMIT
+		}
+		if max > 0 && size > max {
+			size = max
+		}
+	}
+	if max > 0 && size > max {
+		return 0, ErrPageMaxRows
+	}
+	return size, nil
+}
+
+// BuildCountQuery renders the COUNT(*) of the records the paged request has over all pages, columns are
+// the selected ones as given to BuildSelectColumns
+func BuildCountQuery(req QueryRequest, columns []string) (orm.ParametereizedSQL, error) {
+	c := orm.Condition{}
+	if req.Condition != nil {
+		c = *req.Condition
+	}
+	c.OrderBy, c.Limit, c.Offset = nil, 0, 0
+	req.Condition, req.SingleRow = &c, false
+
+	var query orm.ParametereizedSQL
+	var err error
+	switch {
+	case req.Grouped():
+		query, _, err = BuildGroupedQuery(req)
+	case len(req.Joins) > 0:
+		query, err = BuildJoinedQuery(req)
+	case !req.Distinct:
+		// the rows of the table, no need to select them
+		b := NewQueryBuilder(CurrentDialect())
+		tail, err := b.tail(&c)
+		if err != nil {
+			return orm.ParametereizedSQL{}, err
+		}
+		return orm.ParametereizedSQL{Query: "SELECT COUNT(*) AS total FROM " + req.Table + tail, Values: b.Args()}, nil
+	default:
+		query, err = BuildSelectColumns(CurrentDialect(), req.Table, columns, true, &c)
+	}
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	return orm.ParametereizedSQL{Query: "SELECT COUNT(*) AS total FROM (" + query.Query + ") AS counted", Values: query.Values}, nil
+}
+
+// CountTotal runs the count query of BuildCountQuery
+func CountTotal(db SureSQLDB, query orm.ParametereizedSQL) (int, error) {
+	records, err := db.SelectOneSQLParameterized(query)
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	v, _ := lookupField(records[0].Data, "total")
+	total, _ := aggregateValue(AGGREGATE_COUNT, v).(int64)
+	return int(total), nil
+}
@@ -0,0 +1,111 @@
+package suresql
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Peer health: the peers of the nodes setting are probed on their public /health endpoint, at most every
+// PEER_HEALTH_MAX_AGE and in the background, so /db/api/status answers with the last known state right
+// away instead of waiting for a slow or dead peer. Until the first probe finished a peer is unknown.
+
+const (
+	PEER_HEALTH_UP      = "up"
+	PEER_HEALTH_DOWN    = "down"
+	PEER_HEALTH_UNKNOWN = "unknown"
+
+	PEER_HEALTH_MAX_AGE = 15 * time.Second
+	PEER_HEALTH_TIMEOUT = 2 * time.Second
+)
+
+// PeerHealth is the last known state of a peer
+type PeerHealth struct {
+	NodeNumber int       `json:"node_number"`
+	URL        string    `json:"url"`
+	Mode       string    `json:"mode,omitempty"`
+	Status     string    `json:"status"` // up, down or unknown
+	LatencyMs  float64   `json:"latency_ms,omitempty"`
+	CheckedAt  time.Time `json:"checked_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var peerHealth struct {
+	mu        sync.RWMutex
+	results   map[int]PeerHealth
+	checkedAt time.Time
+	probing   int32
+}
+
+// PeerHealthSnapshot returns the state of every peer by node number, a stale state starts a new probe
+func PeerHealthSnapshot() []PeerHealth {
+	peers := CurrentNode.GetStatus().Peers
+	peerHealth.mu.RLock()
+	stale := CurrentClock.Since(peerHealth.checkedAt) > PEER_HEALTH_MAX_AGE
+	list := make([]PeerHealth, 0, len(peers))
+	for number, peer := range peers {
+		h, ok := peerHealth.results[number]
+		if !ok || h.URL != PeerBaseURL(peer) {
+			h = PeerHealth{NodeNumber: number, URL: PeerBaseURL(peer), Status: PEER_HEALTH_UNKNOWN}
+			stale = true
+		}
+		h.Mode = peer.Mode
+		list = append(list, h)
+	}
+	peerHealth.mu.RUnlock()
+
+	if stale && len(peers) > 0 && atomic.CompareAndSwapInt32(&peerHealth.probing, 0, 1) {
+		go probePeers()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NodeNumber < list[j].NodeNumber })
+	return list
+}
+
+// probePeers checks all peers at once and stores the results
+func probePeers() {
+	defer atomic.StoreInt32(&peerHealth.probing, 0)
+	peers := CurrentNode.GetStatus().Peers
+	results := make(map[int]PeerHealth, len(peers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for number, peer := range peers {
+		wg.Add(1)
+		go func(number int, url string) {
+			defer wg.Done()
+			h := probePeer(number, url)
+			mu.Lock()
+			results[number] = h
+			mu.Unlock()
+		}(number, PeerBaseURL(peer))
+	}
+	wg.Wait()
+
+	peerHealth.mu.Lock()
+	peerHealth.results = results
+	peerHealth.checkedAt = CurrentClock.Now()
+	peerHealth.mu.Unlock()
+}
+
+func probePeer(number int, url string) PeerHealth {
+	h := PeerHealth{NodeNumber: number, URL: url, Status: PEER_HEALTH_DOWN, CheckedAt: CurrentClock.Now()}
+	if url == "" {
+		h.Status, h.Error = PEER_HEALTH_UNKNOWN, "no address in the nodes setting"
+		return h
+	}
+	start := time.Now()
+	resp, err := IntegrationHTTPClient(INTEGRATION_PEER, PEER_HEALTH_TIMEOUT).Get(url + "/health")
+	h.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		h.Error = resp.Status
+		return h
+	}
+	h.Status = PEER_HEALTH_UP
+	return h
+}
@@ -0,0 +1,727 @@
+package suresql
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Peer mTLS: node to node traffic uses certificates of an internal CA. Every node keeps its private
+// key on local disk (SURESQL_PEER_TLS_DIR) and registers a CSR in _peer_certs. The leader keeps the CA
+// in _peer_cas (the key encrypted with SURESQL_PEER_SECRET, so any node can take over as leader), signs
+// the CSRs and renews certificates when a third of their lifetime is left. The CA is rotated the same
+// way, certificates of every CA that is not expired are trusted so nodes keep talking during rotation.
+// Enabled with setting peer/mtls.
+
+const (
+	PEER_TLS_CHECK_INTERVAL = 10 * time.Minute
+	DEFAULT_PEER_CERT_DAYS  = 30
+	DEFAULT_PEER_CA_DAYS    = 365
+	DEFAULT_PEER_TLS_DIR    = "./peer-tls"
+	PEER_KEY_FILE           = "peer.key"
+)
+
+var (
+	ErrPeerTLSDisabled  = medaerror.MedaError{Message: "peer mTLS is not enabled (setting peer/mtls)"}
+	ErrPeerTLSSecret    = medaerror.MedaError{Message: "SURESQL_PEER_SECRET is required for peer mTLS"}
+	ErrPeerTLSNotReady  = medaerror.MedaError{Message: "peer certificate is not issued yet"}
+	ErrPeerTLSNotLeader = medaerror.MedaError{Message: "only the leader manages the peer CA"}
+	ErrPeerCertInvalid  = medaerror.MedaError{Message: "invalid peer certificate"}
+)
+
+// PeerCATable is a CA of the peer certificates, the key is AES-GCM encrypted
+type PeerCATable struct {
+	ID        int       `json:"id,omitempty"          db:"id"`
+	CertPEM   string    `json:"cert_pem"              db:"cert_pem"`
+	KeyEnc    string    `json:"-"                     db:"key_enc"`
+	NotBefore time.Time `json:"not_before"            db:"not_before"`
+	NotAfter  time.Time `json:"not_after"             db:"not_after"`
+	CreatedAt time.Time `json:"created_at,omitempty"  db:"created_at"`
+}
+
+func (c PeerCATable) TableName() string {
+	return "_peer_cas"
+}
+
+// PeerCertTable is the CSR of a node and the certificate the leader issued for it
+type PeerCertTable struct {
+	ID        int       `json:"id,omitempty"          db:"id"`
+	NodeName  string    `json:"node_name"             db:"node_name"`
+	CSRPEM    string    `json:"-"                     db:"csr_pem"`
+	CertPEM   string    `json:"-"                     db:"cert_pem"`
+	CAID      int       `json:"ca_id"                 db:"ca_id"`
+	NotAfter  time.Time `json:"not_after"             db:"not_after"`
+	IssuedAt  time.Time `json:"issued_at,omitempty"   db:"issued_at"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"  db:"updated_at"`
+}
+
+func (c PeerCertTable) TableName() string {
+	return "_peer_certs"
+}
+
+// PeerTLSStatus is returned by /suresql/peers/tls
+type PeerTLSStatus struct {
+	Enabled      bool            `json:"enabled"`
+	NodeName     string          `json:"node_name"`
+	IsLeader     bool            `json:"is_leader"`
+	CertNotAfter time.Time       `json:"cert_not_after,omitempty"`
+	CAs          []PeerCATable   `json:"cas"`
+	Certs        []PeerCertTable `json:"certs"`
+	LastCheck    time.Time       `json:"last_check,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+}
+
+// PeerTLSEnabled reads setting peer/mtls
+func PeerTLSEnabled() bool {
+	s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_PEER, SETTING_KEY_PEER_MTLS)
+	return ok && s.IntValue != 0
+}
+
+func peerDays(key string, def int) time.Duration {
+	days := def
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_PEER, key); ok && s.IntValue > 0 {
+		days = s.IntValue
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// PeerNodeName is the name of this node in _peer_certs and the CN of its certificate
+func PeerNodeName() string {
+	if CurrentNode.Config.Host != "" {
+		return CurrentNode.Config.Host
+	}
+	return fmt.Sprintf("node-%d", CurrentNode.Config.NodeNumber)
+}
+
+// PeerTLSManager keeps the certificate of this node and the trusted CAs up to date
+type PeerTLSManager struct {
+	mu        sync.RWMutex
+	key       *ecdsa.PrivateKey
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	lastCheck time.Time
+	lastError string
+
+	client   *http.Client
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+}
+
+var (
+	PeerTLS     *PeerTLSManager
+	peerTLSOnce sync.Once
+)
+
+// InitPeerTLS initializes the global peer TLS manager
+func InitPeerTLS() {
+	peerTLSOnce.Do(func() {
+		PeerTLS = &PeerTLSManager{stopChan: make(chan struct{}), pool: x509.NewCertPool()}
+	})
+}
+
+// StartPeerTLS starts the certificate checks
+func StartPeerTLS(ctx context.Context) {
+	if PeerTLS == nil {
+		InitPeerTLS()
+	}
+	PeerTLS.Start(ctx)
+}
+
+// StopPeerTLS stops the certificate checks
+func StopPeerTLS() {
+	if PeerTLS != nil {
+		PeerTLS.Stop()
+	}
+}
+
+// Start checks right away and then every PEER_TLS_CHECK_INTERVAL
+func (m *PeerTLSManager) Start(ctx context.Context) {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = true
+	m.ticker = CurrentClock.NewTicker(PEER_TLS_CHECK_INTERVAL)
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.Check()
+		for {
+			select {
+			case <-m.ticker.C():
+				m.Check()
+			case <-m.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the checks
+func (m *PeerTLSManager) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+	m.ticker.Stop()
+	close(m.stopChan)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// Check registers the CSR of this node, lets the leader issue and rotate, then reloads the certificate
+func (m *PeerTLSManager) Check() error {
+	if !PeerTLSEnabled() {
+		return nil
+	}
+	err := m.check()
+	m.mu.Lock()
+	m.lastCheck = CurrentClock.Now()
+	m.lastError = ""
+	if err != nil {
+		m.lastError = err.Error()
+	}
+	m.mu.Unlock()
+	if err != nil {
+		simplelog.LogErrorAny("PeerTLS", err, "peer certificate check failed")
+	}
+	return err
+}
+
+func (m *PeerTLSManager) check() error {
+	key, err := m.loadKey()
+	if err != nil {
+		return err
+	}
+	if err := registerPeerCSR(key); err != nil {
+		return err
+	}
+	if IsSchedulerLeader() {
+		if err := rotatePeerCerts(false); err != nil {
+			return err
+		}
+	}
+	return m.reload(key)
+}
+
+// loadKey reads the node key from SURESQL_PEER_TLS_DIR or creates it, it never leaves the node
+func (m *PeerTLSManager) loadKey() (*ecdsa.PrivateKey, error) {
+	m.mu.RLock()
+	key := m.key
+	m.mu.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+	dir := utils.GetEnvString("SURESQL_PEER_TLS_DIR", DEFAULT_PEER_TLS_DIR)
+	path := filepath.Join(dir, PEER_KEY_FILE)
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, medaerror.Errorf("%s: %s is not PEM", ErrPeerCertInvalid.Message, path)
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	} else {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+	}
+	m.mu.Lock()
+	m.key = key
+	m.mu.Unlock()
+	return key, nil
+}
+
+// registerPeerCSR stores a CSR for this node, only when the key changed (the issued certificate is dropped then)
+func registerPeerCSR(key *ecdsa.PrivateKey) error {
+	name := PeerNodeName()
+	if row, ok, err := getPeerCert(name); err != nil {
+		return err
+	} else if ok {
+		if csr, err := parseCSR(row.CSRPEM); err == nil && publicKeyEqual(csr.PublicKey, &key.PublicKey) {
+			return nil
+		}
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: name, Organization: []string{APP_NAME}}}
+	if ip := net.ParseIP(CurrentNode.Config.IP); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	if host := CurrentNode.Config.Host; host != "" && net.ParseIP(host) == nil {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return err
+	}
+	now := CurrentClock.Now().UTC()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + PeerCertTable{}.TableName() + " (node_name, csr_pem, cert_pem, ca_id, updated_at) VALUES (?, ?, '', 0, ?)" +
+			" ON CONFLICT(node_name) DO UPDATE SET csr_pem=excluded.csr_pem, cert_pem='', ca_id=0, updated_at=excluded.updated_at",
+		Values: []interface{}{name, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), now},
+	})
+	return res.Error
+}
+
+// RotatePeerCA makes a new CA now and reissues every certificate with it, leader only
+func RotatePeerCA() error {
+	if !PeerTLSEnabled() {
+		return ErrPeerTLSDisabled
+	}
+	if !IsSchedulerLeader() {
+		return ErrPeerTLSNotLeader
+	}
+	if err := rotatePeerCerts(true); err != nil {
+		return err
+	}
+	if PeerTLS != nil {
+		return PeerTLS.Check()
+	}
+	return nil
+}
+
+// rotatePeerCerts (leader) makes a CA when the current one is in the last third of its lifetime (or
+// force), and issues certificates that are missing, from an older CA or in the last third of theirs
+func rotatePeerCerts(force bool) error {
+	now := CurrentClock.Now()
+	cas, err := ListPeerCAs()
+	if err != nil {
+		return err
+	}
+	caLife := peerDays(SETTING_KEY_PEER_CA_DAYS, DEFAULT_PEER_CA_DAYS)
+	var current *PeerCATable
+	if len(cas) > 0 && cas[0].NotAfter.After(now) {
+		current = &cas[0]
+	}
+	if force || current == nil || current.NotAfter.Sub(now) < caLife/3 {
+		ca, err := createPeerCA(now, caLife)
+		if err != nil {
+			return err
+		}
+		simplelog.LogFormat("PeerTLS: new CA %d valid until %s", ca.ID, ca.NotAfter.Format(time.RFC3339))
+		current = &ca
+	}
+	caCert, caKey, err := current.open()
+	if err != nil {
+		return err
+	}
+
+	certs, err := ListPeerCerts()
+	if err != nil {
+		return err
+	}
+	certLife := peerDays(SETTING_KEY_PEER_CERT_DAYS, DEFAULT_PEER_CERT_DAYS)
+	for _, c := range certs {
+		if c.CertPEM != "" && c.CAID == current.ID && c.NotAfter.Sub(now) >= certLife/3 {
+			continue
+		}
+		if err := issuePeerCert(c, caCert, caKey, current.ID, now, certLife); err != nil {
+			// one bad CSR does not stop the other nodes from getting theirs
+			simplelog.LogErrorAny("PeerTLS", err, "cannot issue certificate for "+c.NodeName)
+		}
+	}
+	return nil
+}
+
+func createPeerCA(now time.Time, life time.Duration) (PeerCATable, error) {
+	secret, _ := GetSecret("SURESQL_PEER_SECRET")
+	if secret == "" {
+		return PeerCATable{}, ErrPeerTLSSecret
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return PeerCATable{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: APP_NAME + " peer CA " + now.UTC().Format("2006-01-02"), Organization: []string{APP_NAME}},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(life),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return PeerCATable{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return PeerCATable{}, err
+	}
+	keyEnc, err := sealPeerKey(secret, keyDER)
+	if err != nil {
+		return PeerCATable{}, err
+	}
+	ca := PeerCATable{
+		CertPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyEnc:    keyEnc,
+		NotBefore: template.NotBefore.UTC(),
+		NotAfter:  template.NotAfter.UTC(),
+		CreatedAt: now.UTC(),
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "INSERT INTO " + ca.TableName() + " (cert_pem, key_enc, not_before, not_after, created_at) VALUES (?, ?, ?, ?, ?)",
+		Values: []interface{}{ca.CertPEM, ca.KeyEnc, ca.NotBefore, ca.NotAfter, ca.CreatedAt},
+	})
+	if res.Error != nil {
+		return ca, res.Error
+	}
+	ca.ID = res.LastInsertID
+	return ca, nil
+}
+
+// open parses the certificate and decrypts the key of a CA
+func (c PeerCATable) open() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := parseCertPEM(c.CertPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, _ := GetSecret("SURESQL_PEER_SECRET")
+	if secret == "" {
+		return nil, nil, ErrPeerTLSSecret
+	}
+	keyDER, err := openPeerKey(secret, c.KeyEnc)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	return cert, key, err
+}
+
+func issuePeerCert(row PeerCertTable, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, caID int, now time.Time, life time.Duration) error {
+	csr, err := parseCSR(row.CSRPEM)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return medaerror.Errorf("%s: csr signature: %v", ErrPeerCertInvalid.Message, err)
+	}
+	notAfter := now.Add(life)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: row.NodeName, Organization: []string{APP_NAME}},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "UPDATE " + row.TableName() + " SET cert_pem = ?, ca_id = ?, not_after = ?, issued_at = ?, updated_at = ? WHERE node_name = ? AND csr_pem = ?",
+		Values: []interface{}{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), caID, notAfter.UTC(), now.UTC(), now.UTC(), row.NodeName, row.CSRPEM},
+	})
+	return res.Error
+}
+
+// reload loads the certificate of this node and the trusted CAs
+func (m *PeerTLSManager) reload(key *ecdsa.PrivateKey) error {
+	now := CurrentClock.Now()
+	cas, err := ListPeerCAs()
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		if ca.NotAfter.After(now) {
+			if cert, err := parseCertPEM(ca.CertPEM); err == nil {
+				pool.AddCert(cert)
+			}
+		}
+	}
+	row, ok, err := getPeerCert(PeerNodeName())
+	if err != nil {
+		return err
+	}
+	if !ok || row.CertPEM == "" {
+		return ErrPeerTLSNotReady
+	}
+	leaf, err := parseCertPEM(row.CertPEM)
+	if err != nil {
+		return err
+	}
+	if !publicKeyEqual(leaf.PublicKey, &key.PublicKey) {
+		return ErrPeerTLSNotReady
+	}
+	m.mu.Lock()
+	m.cert = &tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+	m.pool = pool
+	m.mu.Unlock()
+	return nil
+}
+
+// verify checks a peer certificate chain against the trusted CAs
+func (m *PeerTLSManager) verify(rawCerts [][]byte, usage x509.ExtKeyUsage) error {
+	if len(rawCerts) == 0 {
+		return medaerror.Errorf("%s: no certificate", ErrPeerCertInvalid.Message)
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	m.mu.RLock()
+	pool := m.pool
+	m.mu.RUnlock()
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		CurrentTime:   CurrentClock.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+func (m *PeerTLSManager) certificate() (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, ErrPeerTLSNotReady
+	}
+	return m.cert, nil
+}
+
+// ServerTLSConfig requires a client certificate from the peer CAs, certificates are picked up on rotation
+func (m *PeerTLSManager) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.certificate()
+		},
+		// verification is done against the current CAs below, the pool changes on rotation
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return m.verify(rawCerts, x509.ExtKeyUsageClientAuth)
+		},
+	}
+}
+
+// ClientTLSConfig presents the node certificate and accepts servers with a certificate of the peer CAs.
+// Peers are identified by the CA, not by host name, addresses of nodes change more often than the CA.
+func (m *PeerTLSManager) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return m.certificate()
+		},
+		InsecureSkipVerify: true, // replaced by VerifyPeerCertificate
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return m.verify(rawCerts, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// PeerHTTPClient is the client for requests to other nodes: mTLS and the peer outbound proxy
+func PeerHTTPClient(timeout time.Duration) (*http.Client, error) {
+	if !PeerTLSEnabled() {
+		return nil, ErrPeerTLSDisabled
+	}
+	if PeerTLS == nil {
+		InitPeerTLS()
+	}
+	PeerTLS.mu.Lock()
+	if PeerTLS.client == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = ProxyFunc(INTEGRATION_PEER)
+		t.TLSClientConfig = PeerTLS.ClientTLSConfig()
+		PeerTLS.client = &http.Client{Transport: t}
+	}
+	client := *PeerTLS.client
+	PeerTLS.mu.Unlock()
+	client.Timeout = timeout
+	return &client, nil
+}
+
+// GetPeerTLSStatus returns the CAs, certificates and the state of this node
+func GetPeerTLSStatus() (PeerTLSStatus, error) {
+	status := PeerTLSStatus{Enabled: PeerTLSEnabled(), NodeName: PeerNodeName(), IsLeader: IsSchedulerLeader()}
+	var err error
+	if status.CAs, err = ListPeerCAs(); err != nil {
+		return status, err
+	}
+	if status.Certs, err = ListPeerCerts(); err != nil {
+		return status, err
+	}
+	if PeerTLS != nil {
+		PeerTLS.mu.RLock()
+		if PeerTLS.cert != nil {
+			status.CertNotAfter = PeerTLS.cert.Leaf.NotAfter
+		}
+		status.LastCheck, status.LastError = PeerTLS.lastCheck, PeerTLS.lastError
+		PeerTLS.mu.RUnlock()
+	}
+	return status, nil
+}
+
+// ListPeerCAs returns the CAs, newest first
+func ListPeerCAs() ([]PeerCATable, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectMany(PeerCATable{}.TableName())
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []PeerCATable{}, nil
+		}
+		return nil, err
+	}
+	cas := make([]PeerCATable, 0, len(records))
+	for _, r := range records {
+		cas = append(cas, object.MapToStructSlowDB[PeerCATable](r.Data))
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i].NotAfter.After(cas[j].NotAfter) })
+	return cas, nil
+}
+
+// ListPeerCerts returns the registered nodes and their certificates
+func ListPeerCerts() ([]PeerCertTable, error) {
+	condition := orm.Condition{OrderBy: []string{"node_name ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(PeerCertTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []PeerCertTable{}, nil
+		}
+		return nil, err
+	}
+	certs := make([]PeerCertTable, 0, len(records))
+	for _, r := range records {
+		certs = append(certs, object.MapToStructSlowDB[PeerCertTable](r.Data))
+	}
+	return certs, nil
+}
+
+func getPeerCert(name string) (PeerCertTable, bool, error) {
+	condition := orm.Condition{Field: "node_name", Operator: "=", Value: name}
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(PeerCertTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return PeerCertTable{}, false, nil
+		}
+		return PeerCertTable{}, false, err
+	}
+	return object.MapToStructSlowDB[PeerCertTable](rec.Data), true, nil
+}
+
+func parseCertPEM(s string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, medaerror.Errorf("%s: not a PEM certificate", ErrPeerCertInvalid.Message)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseCSR(s string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, medaerror.Errorf("%s: not a PEM certificate request", ErrPeerCertInvalid.Message)
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
+
+func publicKeyEqual(a interface{}, b *ecdsa.PublicKey) bool {
+	k, ok := a.(*ecdsa.PublicKey)
+	return ok && k.Equal(b)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+// sealPeerKey encrypts with AES-256-GCM, the key is the SHA-256 of the secret. Output is PEM so it
+// stays readable text in the table.
+func sealPeerKey(secret string, plain []byte) (string, error) {
+	gcm, err := peerKeyCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED EC PRIVATE KEY", Bytes: gcm.Seal(nonce, nonce, plain, nil)})), nil
+}
+
+func openPeerKey(secret, sealed string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(sealed))
+	if block == nil {
+		return nil, medaerror.Errorf("%s: CA key is not PEM", ErrPeerCertInvalid.Message)
+	}
+	gcm, err := peerKeyCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < gcm.NonceSize() {
+		return nil, medaerror.Errorf("%s: CA key is too short", ErrPeerCertInvalid.Message)
+	}
+	plain, err := gcm.Open(nil, block.Bytes[:gcm.NonceSize()], block.Bytes[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, medaerror.Errorf("%s: cannot decrypt CA key, is SURESQL_PEER_SECRET the same on every node?", ErrPeerCertInvalid.Message)
+	}
+	return plain, nil
+}
+
+func peerKeyCipher(secret string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
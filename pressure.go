@@ -0,0 +1,119 @@
+package suresql
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Backpressure: the node saturation is computed from connection pool usage and the number of
+// requests currently being served. Clients get the same structure in 429/503 responses and from
+// /db/api/pressure so they can slow down before they are refused.
+
+const (
+	PRESSURE_LEVEL_OK       = "ok"
+	PRESSURE_LEVEL_ELEVATED = "elevated"
+	PRESSURE_LEVEL_HIGH     = "high"
+	PRESSURE_LEVEL_CRITICAL = "critical"
+
+	// Saturation thresholds (0..1) for the levels above
+	PRESSURE_ELEVATED_THRESHOLD = 0.7
+	PRESSURE_HIGH_THRESHOLD     = 0.9
+
+	DEFAULT_MAX_INFLIGHT      = 256
+	DEFAULT_PRESSURE_RETRY_MS = 250   // suggested retry delay when saturation reaches elevated
+	MAX_PRESSURE_RETRY_MS     = 10000 // cap of the suggested retry delay
+)
+
+// PressureStatus is the backpressure hint sent to clients
+type PressureStatus struct {
+	Level        string    `json:"level"`
+	Saturation   float64   `json:"saturation"` // highest of pool and in-flight saturation, 1 means full
+	PoolUsagePct float64   `json:"pool_usage_pct"`
+	PoolActive   int       `json:"pool_active"`
+	PoolMax      int       `json:"pool_max"`
+	InFlight     int64     `json:"in_flight"`
+	MaxInFlight  int64     `json:"max_in_flight"`
+	RetryAfterMs int64     `json:"retry_after_ms"` // suggested delay before the next request, 0 when level is ok
+	Timestamp    time.Time `json:"timestamp"`
+	// query slots and queues, only with connection/max_queries
+	Queries *QuerySchedulerStatus `json:"queries,omitempty"`
+}
+
+// Number of API requests currently being served, maintained by the server middleware
+var inFlightRequests int64
+
+// TryBeginRequest marks one more request in flight unless that goes over the in-flight limit, the check
+// and the count are one compare-and-swap so concurrent requests cannot both take the last slot
+func TryBeginRequest() bool {
+	max := maxInFlight()
+	for {
+		n := atomic.LoadInt64(&inFlightRequests)
+		if n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&inFlightRequests, n, n+1) {
+			return true
+		}
+	}
+}
+
+// EndRequest marks a request as finished
+func EndRequest() {
+	atomic.AddInt64(&inFlightRequests, -1)
+}
+
+// CurrentPressure returns the current saturation of this node with the suggested retry delay
+func CurrentPressure() PressureStatus {
+	p := PressureStatus{
+		InFlight:    atomic.LoadInt64(&inFlightRequests),
+		MaxInFlight: maxInFlight(),
+		PoolMax:     CurrentNode.MaxPool,
+		Timestamp:   time.Now(),
+	}
+	if MaxQueries() > 0 {
+		queries := Queries.Status()
+		p.Queries = &queries
+	}
+	if CurrentNode.IsPoolEnabled && CurrentNode.DBConnections != nil {
+		p.PoolActive = CurrentNode.DBConnections.Len()
+		if p.PoolMax > 0 {
+			p.PoolUsagePct = float64(p.PoolActive) / float64(p.PoolMax) * 100
+		}
+	}
+
+	p.Saturation = math.Max(p.PoolUsagePct/100, float64(p.InFlight)/float64(p.MaxInFlight))
+	switch {
+	case p.Saturation >= 1:
+		p.Level = PRESSURE_LEVEL_CRITICAL
+	case p.Saturation >= PRESSURE_HIGH_THRESHOLD:
+		p.Level = PRESSURE_LEVEL_HIGH
+	case p.Saturation >= PRESSURE_ELEVATED_THRESHOLD:
+		p.Level = PRESSURE_LEVEL_ELEVATED
+	default:
+		p.Level = PRESSURE_LEVEL_OK
+	}
+
+	// Grows linearly from DEFAULT_PRESSURE_RETRY_MS at elevated to 4x at full, then keeps growing past full
+	if p.Level != PRESSURE_LEVEL_OK {
+		factor := 1 + (p.Saturation-PRESSURE_ELEVATED_THRESHOLD)*10
+		p.RetryAfterMs = int64(math.Min(DEFAULT_PRESSURE_RETRY_MS*factor, MAX_PRESSURE_RETRY_MS))
+	}
+	return p
+}
+
+// maxInFlight is the in-flight limit of the node, DEFAULT_MAX_INFLIGHT when not set
+func maxInFlight() int64 {
+	if CurrentNode.MaxInFlight <= 0 {
+		return DEFAULT_MAX_INFLIGHT
+	}
+	return CurrentNode.MaxInFlight
+}
+
+// RetryAfterSeconds is the suggested delay rounded up to whole seconds, for the Retry-After header
+func (p PressureStatus) RetryAfterSeconds() int64 {
+	if p.RetryAfterMs <= 0 {
+		return 1
+	}
+	return (p.RetryAfterMs + 999) / 1000
+}
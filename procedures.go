@@ -0,0 +1,406 @@
+package suresql
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Stored procedures are named scripts kept in _procedures and run with POST /db/api/procedures/<name>.
+// A script is a list of steps:
+//
+//	{"sql": "SELECT balance FROM accounts WHERE id = :from", "into": "src"}
+//	{"when": {"field": ":src.balance", "operator": "<", "value": ":amount"}, "fail": "insufficient funds"}
+//	{"sql": "UPDATE accounts SET balance = balance - :amount WHERE id = :from"}
+//	{"return": "src"}
+//
+// :name is a parameter of the call, :var.column a column of the first row read into var by a SELECT step.
+// A step with "when" only runs when the check holds. Reads run right away, writes are collected and sent
+// together at the end as one atomic batch (ExecAtomic), so a failed step or a failed write writes nothing;
+// a SELECT does not see the writes of earlier steps. On a DBMS without atomic batches a procedure can
+// write with one statement only, more fail with ErrAtomicNotSupported.
+
+const (
+	PROCEDURE_MAX_STEPS = 100
+)
+
+var (
+	ErrProcedureNotFound = medaerror.MedaError{Message: "procedure not found"}
+	ErrProcedureInvalid  = medaerror.MedaError{Message: "invalid procedure"}
+	ErrProcedureParam    = medaerror.MedaError{Message: "missing procedure parameter"}
+
+	procedureRefRegex = regexp.MustCompile(`(^|[^:a-zA-Z0-9_]):([a-zA-Z_][a-zA-Z0-9_]*)(\.([a-zA-Z_][a-zA-Z0-9_]*))?`)
+	procedureNameRx   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// ProcedureTable is a named server-side script
+type ProcedureTable struct {
+	ID          int       `json:"id,omitempty"          db:"id"`
+	Name        string    `json:"name"                  db:"name"`
+	Description string    `json:"description,omitempty" db:"description"`
+	Params      string    `json:"params,omitempty"      db:"params"` // comma separated parameter names
+	Steps       string    `json:"steps"                 db:"steps"`  // JSON array of ProcedureStep
+	UpdatedAt   time.Time `json:"updated_at,omitempty"  db:"updated_at"`
+}
+
+func (p ProcedureTable) TableName() string {
+	return "_procedures"
+}
+
+// ProcedureStep is one step of a procedure, exactly one of SQL, Fail or Return is set
+type ProcedureStep struct {
+	When   *ProcedureCheck `json:"when,omitempty"`
+	SQL    string          `json:"sql,omitempty"`
+	Into   string          `json:"into,omitempty"`
+	Fail   string          `json:"fail,omitempty"`
+	Return string          `json:"return,omitempty"`
+}
+
+// ProcedureCheck compares a reference with a value (literal or reference). Operators: = != < <= > >=,
+// and empty / not empty for a variable (no rows read)
+type ProcedureCheck struct {
+	Field    string      `json:"field"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// ProcedureResult is what a call returns
+type ProcedureResult struct {
+	Return       interface{} `json:"return,omitempty"`
+	RowsAffected int         `json:"rows_affected"`
+	Statements   int         `json:"statements"`
+}
+
+// ProcedureFailure is a fail step that was reached, the message is for the caller
+type ProcedureFailure struct {
+	Step    int    `json:"step"`
+	Message string `json:"message"`
+}
+
+func (f ProcedureFailure) Error() string {
+	return f.Message
+}
+
+// ParamNames returns the declared parameters
+func (p ProcedureTable) ParamNames() []string {
+	var names []string
+	for _, name := range strings.Split(p.Params, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CheckArgs makes sure every declared parameter is given
+func (p ProcedureTable) CheckArgs(args map[string]interface{}) error {
+	for _, name := range p.ParamNames() {
+		if _, ok := args[name]; !ok {
+			return medaerror.Errorf("%s: %s", ErrProcedureParam.Message, name)
+		}
+	}
+	return nil
+}
+
+// ParseSteps decodes the steps
+func (p ProcedureTable) ParseSteps() ([]ProcedureStep, error) {
+	var steps []ProcedureStep
+	if err := json.Unmarshal([]byte(p.Steps), &steps); err != nil {
+		return nil, medaerror.Errorf("%s: steps: %v", ErrProcedureInvalid.Message, err)
+	}
+	return steps, nil
+}
+
+// Validate checks the name, the steps and that every reference is a parameter or an earlier variable
+func (p ProcedureTable) Validate() error {
+	if !procedureNameRx.MatchString(p.Name) {
+		return medaerror.Errorf("%s: name must be letters, digits and _", ErrProcedureInvalid.Message)
+	}
+	steps, err := p.ParseSteps()
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 || len(steps) > PROCEDURE_MAX_STEPS {
+		return medaerror.Errorf("%s: 1 to %d steps", ErrProcedureInvalid.Message, PROCEDURE_MAX_STEPS)
+	}
+	known := map[string]bool{}
+	for _, name := range p.ParamNames() {
+		known[name] = true
+	}
+	checkRef := func(i int, ref string) error {
+		if name, _, ok := procedureRef(ref); ok && !known[name] {
+			return medaerror.Errorf("%s: step %d: unknown :%s", ErrProcedureInvalid.Message, i+1, name)
+		}
+		return nil
+	}
+	for i, step := range steps {
+		actions := 0
+		for _, set := range []bool{step.SQL != "", step.Fail != "", step.Return != ""} {
+			if set {
+				actions++
+			}
+		}
+		if actions != 1 {
+			return medaerror.Errorf("%s: step %d needs one of sql, fail or return", ErrProcedureInvalid.Message, i+1)
+		}
+		if step.When != nil {
+			if err := checkRef(i, step.When.Field); err != nil {
+				return err
+			}
+			if s, ok := step.When.Value.(string); ok {
+				if err := checkRef(i, s); err != nil {
+					return err
+				}
+			}
+			if !isProcedureOperator(step.When.Operator) {
+				return medaerror.Errorf("%s: step %d: operator %s", ErrProcedureInvalid.Message, i+1, step.When.Operator)
+			}
+		}
+		for _, m := range procedureRefRegex.FindAllStringSubmatch(step.SQL, -1) {
+			if !known[m[2]] {
+				return medaerror.Errorf("%s: step %d: unknown :%s", ErrProcedureInvalid.Message, i+1, m[2])
+			}
+		}
+		if step.Into != "" {
+			if !isReadStatement(step.SQL) {
+				return medaerror.Errorf("%s: step %d: into needs a SELECT", ErrProcedureInvalid.Message, i+1)
+			}
+			known[step.Into] = true
+		}
+		if step.Return != "" && !known[step.Return] {
+			return medaerror.Errorf("%s: step %d: unknown return %s", ErrProcedureInvalid.Message, i+1, step.Return)
+		}
+	}
+	return nil
+}
+
+// GetProcedure returns the procedure by name
+func GetProcedure(name string) (ProcedureTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(ProcedureTable{}.TableName(), &orm.Condition{Field: "name", Operator: "=", Value: name})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return ProcedureTable{}, ErrProcedureNotFound
+		}
+		return ProcedureTable{}, err
+	}
+	return object.MapToStructSlowDB[ProcedureTable](rec.Data), nil
+}
+
+// ListProcedures returns all procedures
+func ListProcedures() ([]ProcedureTable, error) {
+	condition := orm.Condition{OrderBy: []string{"name ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(ProcedureTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []ProcedureTable{}, nil
+		}
+		return nil, err
+	}
+	procs := make([]ProcedureTable, 0, len(records))
+	for _, rec := range records {
+		procs = append(procs, object.MapToStructSlowDB[ProcedureTable](rec.Data))
+	}
+	return procs, nil
+}
+
+// SaveProcedure creates or replaces the procedure
+func SaveProcedure(p ProcedureTable) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + p.TableName() + " (name, description, params, steps, updated_at) VALUES (?, ?, ?, ?, ?) " +
+			"ON CONFLICT(name) DO UPDATE SET description = excluded.description, params = excluded.params, steps = excluded.steps, updated_at = excluded.updated_at",
+		Values: []interface{}{p.Name, p.Description, strings.Join(p.ParamNames(), ","), p.Steps, time.Now().UTC()},
+	})
+	return res.Error
+}
+
+// DeleteProcedure removes the procedure
+func DeleteProcedure(name string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + ProcedureTable{}.TableName() + " WHERE name = ?",
+		Values: []interface{}{name},
+	})
+	return res.Error
+}
+
+// RunProcedure runs the procedure on db with the call arguments
+func RunProcedure(db SureSQLDB, p ProcedureTable, args map[string]interface{}) (ProcedureResult, error) {
+	var result ProcedureResult
+	steps, err := p.ParseSteps()
+	if err != nil {
+		return result, err
+	}
+	if err := p.CheckArgs(args); err != nil {
+		return result, err
+	}
+
+	run := procedureRun{args: args, vars: map[string][]map[string]interface{}{}}
+	var writes []orm.ParametereizedSQL
+	for i, step := range steps {
+		if step.When != nil {
+			ok, err := run.check(*step.When)
+			if err != nil {
+				return result, medaerror.Errorf("step %d: %v", i+1, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		switch {
+		case step.Fail != "":
+			return result, ProcedureFailure{Step: i + 1, Message: step.Fail}
+		case step.Return != "":
+			result.Return = run.value(step.Return)
+		case isReadStatement(step.SQL):
+			records, err := db.SelectOneSQLParameterized(run.statement(step.SQL))
+			result.Statements++
+			if err != nil && !IsNoRowsError(err) {
+				return result, medaerror.Errorf("step %d: %v", i+1, err)
+			}
+			if step.Into != "" {
+				rows := make([]map[string]interface{}, 0, len(records))
+				for _, rec := range records {
+					rows = append(rows, rec.Data)
+				}
+				run.vars[step.Into] = rows
+			}
+		default:
+			writes = append(writes, run.statement(step.SQL))
+		}
+		if step.Return != "" {
+			break
+		}
+	}
+
+	if len(writes) > 0 {
+		results, err := ExecAtomic(db, writes)
+		if err == ErrAtomicNotSupported && len(writes) == 1 {
+			// one statement is atomic on its own
+			res := db.ExecOneSQLParameterized(writes[0])
+			results, err = []orm.BasicSQLResult{res}, res.Error
+		}
+		result.Statements += len(writes)
+		if err != nil {
+			return result, err
+		}
+		for _, res := range results {
+			result.RowsAffected += res.RowsAffected
+		}
+	}
+	return result, nil
+}
+
+// procedureRun holds the arguments and variables of one call
+type procedureRun struct {
+	args map[string]interface{}
+	vars map[string][]map[string]interface{}
+}
+
+// statement replaces :refs with placeholders
+func (r procedureRun) statement(sql string) orm.ParametereizedSQL {
+	var values []interface{}
+	query := procedureRefRegex.ReplaceAllStringFunc(sql, func(m string) string {
+		parts := procedureRefRegex.FindStringSubmatch(m)
+		values = append(values, r.lookup(parts[2], parts[4]))
+		return parts[1] + "?"
+	})
+	return orm.ParametereizedSQL{Query: query, Values: values}
+}
+
+// value resolves a variable name, a parameter, or a :ref
+func (r procedureRun) value(ref string) interface{} {
+	if name, column, ok := procedureRef(ref); ok {
+		return r.lookup(name, column)
+	}
+	if rows, ok := r.vars[ref]; ok {
+		return rows
+	}
+	return r.args[ref]
+}
+
+// lookup is a parameter, the rows of a variable, or a column of its first row
+func (r procedureRun) lookup(name, column string) interface{} {
+	if column == "" {
+		if v, ok := r.args[name]; ok {
+			return v
+		}
+		return r.vars[name]
+	}
+	rows := r.vars[name]
+	if len(rows) == 0 {
+		return nil
+	}
+	return rows[0][column]
+}
+
+func (r procedureRun) check(c ProcedureCheck) (bool, error) {
+	left := r.value(c.Field)
+	op := strings.ToLower(strings.TrimSpace(c.Operator))
+	if op == "empty" || op == "not empty" {
+		empty := left == nil
+		if rows, ok := left.([]map[string]interface{}); ok {
+			empty = len(rows) == 0
+		}
+		return empty == (op == "empty"), nil
+	}
+	right := c.Value
+	if s, ok := right.(string); ok {
+		if _, _, isRef := procedureRef(s); isRef {
+			right = r.value(s)
+		}
+	}
+	if left == nil || right == nil {
+		// like SQL, comparing with NULL is never true
+		return false, nil
+	}
+	cmp, ok := CompareValues(left, right)
+	if !ok {
+		return false, medaerror.Errorf("cannot compare %v with %v", left, right)
+	}
+	switch op {
+	case "=", "==":
+		return cmp == 0, nil
+	case "!=", "<>":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, medaerror.Errorf("unknown operator %s", c.Operator)
+}
+
+// procedureRef splits ":name" or ":name.column"
+func procedureRef(ref string) (string, string, bool) {
+	if !strings.HasPrefix(ref, ":") {
+		return "", "", false
+	}
+	name, column, _ := strings.Cut(ref[1:], ".")
+	return name, column, procedureNameRx.MatchString(name)
+}
+
+func isProcedureOperator(op string) bool {
+	switch strings.ToLower(strings.TrimSpace(op)) {
+	case "=", "==", "!=", "<>", "<", "<=", ">", ">=", "empty", "not empty":
+		return true
+	}
+	return false
+}
+
+// isReadStatement reports whether the statement only reads
+func isReadStatement(sql string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(sql))
+	return strings.HasPrefix(upper, "SELECT") || strings.HasPrefix(upper, "WITH")
+}
@@ -0,0 +1,154 @@
+package suresql
+
+import (
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Column projection: the fields of a QueryRequest are the columns its records have, all of them when
+// empty. A field is a column of the table (or table.column), a column added by a transform expression,
+// or alias.column of a joined table. They are selected in SQL so wide tables send less, unless the
+// table has transform expressions, which may use any column: then the rows are read whole and the
+// fields kept after the expressions ran. The result transform of the request works on the fields.
+// Distinct selects the distinct records in SQL, of the fields or of whole rows. They are the values as
+// stored, so it does not combine with columns of transform expressions and the expressions do not run.
+
+var (
+	ErrFieldUnknown = medaerror.MedaError{Message: "unknown field"}
+	ErrFieldsGroup  = medaerror.MedaError{Message: "fields cannot be combined with group_by or aggregates, the records are the group columns and aggregates"}
+	ErrDistinctAsOf = medaerror.MedaError{Message: "distinct is not supported with as_of"}
+)
+
+// ValidateFields checks the fields (and distinct) of the request against the live schema and returns
+// them as the keys of the records: plain for the queried table, alias.column for a joined one.
+// Duplicates are dropped.
+func ValidateFields(req QueryRequest) ([]string, error) {
+	if req.Distinct && req.AsOf != nil {
+		return nil, ErrDistinctAsOf
+	}
+	if len(req.Fields) == 0 {
+		return nil, nil
+	}
+	if req.Grouped() {
+		return nil, ErrFieldsGroup
+	}
+	tables := map[string]string{strings.ToLower(req.Table): req.Table} // name or alias to table
+	for _, j := range req.Joins {
+		name := j.Table
+		if j.Alias != "" {
+			name = j.Alias
+		}
+		tables[strings.ToLower(name)] = j.Table
+	}
+
+	keys := make([]string, 0, len(req.Fields))
+	seen := map[string]bool{}
+	for _, field := range req.Fields {
+		field = strings.TrimSpace(field)
+		if err := ValidateIdentifier(field); err != nil {
+			return nil, err
+		}
+		name, column := req.Table, field
+		if i := strings.Index(field, "."); i >= 0 {
+			name, column = field[:i], field[i+1:]
+		}
+		table, ok := tables[strings.ToLower(name)]
+		if !ok {
+			return nil, medaerror.Errorf("%s: %s", ErrFieldUnknown.Message, field)
+		}
+		joined := !strings.EqualFold(name, req.Table)
+		column, ok = tableColumn(table, column, !joined && !req.Distinct)
+		if !ok {
+			return nil, medaerror.Errorf("%s: %s", ErrFieldUnknown.Message, field)
+		}
+		key := column
+		if joined {
+			key = name + "." + column
+		}
+		if !seen[strings.ToLower(key)] {
+			seen[strings.ToLower(key)] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// tableColumn returns the name of the column as in the schema of the table, or as added by a transform
+// expression
+func tableColumn(table, column string, transforms bool) (string, bool) {
+	schema, err := TableSchema(table, false)
+	if err != nil {
+		return "", false
+	}
+	for _, c := range schema {
+		if strings.EqualFold(c.Name, column) {
+			return c.Name, true
+		}
+	}
+	if transforms {
+		for _, t := range tableExpressions(table, TABLE_EXPR_TRANSFORM) {
+			if strings.EqualFold(t.Column, column) {
+				return t.Column, true
+			}
+		}
+	}
+	return "", false
+}
+
+// fieldColumns are the select columns of the field keys, the queried table qualified when joined
+func fieldColumns(d Dialect, table string, fields []string, joined bool) []string {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		switch {
+		case strings.Contains(field, "."):
+			columns[i] = field + " AS " + d.Quote(field)
+		case joined:
+			columns[i] = table + "." + field
+		default:
+			columns[i] = field
+		}
+	}
+	return columns
+}
+
+// ProjectInSQL tells if the fields of the request are selected in SQL, not when transform expressions of
+// the table need the whole row, always when distinct
+func ProjectInSQL(req QueryRequest) bool {
+	return req.Distinct || len(tableExpressions(req.Table, TABLE_EXPR_TRANSFORM)) == 0
+}
+
+// ProjectRecords keeps only the fields (the keys of ValidateFields) in every record, fields missing in a
+// record stay missing
+func ProjectRecords(records []orm.DBRecord, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+	for i := range records {
+		if records[i].Data == nil {
+			continue
+		}
+		data := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if v, ok := lookupField(records[i].Data, field); ok {
+				data[field] = v
+			}
+		}
+		records[i].Data = data
+	}
+}
+
+// lookupField finds the field in the row, the DBMS may answer with another case
+func lookupField(data map[string]interface{}, field string) (interface{}, bool) {
+	if v, ok := data[field]; ok {
+		return v, true
+	}
+	for k, v := range data {
+		if strings.EqualFold(k, field) {
+			return v, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,166 @@
+package suresql
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Outbound proxy for integrations. By default outbound calls use HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY from the environment. Setting proxy/outbound overrides that for every integration and
+// proxy/outbound_<integration> (ie: outbound_smtp) for one, "direct" means no proxy. HTTP clients
+// use the proxy as usual, other protocols (SMTP) are tunneled with CONNECT through an http(s) proxy.
+
+const (
+	INTEGRATION_WEBHOOK = "webhook" // billing, SIEM and rule webhooks
+	INTEGRATION_SMTP    = "smtp"
+	INTEGRATION_S3      = "s3"
+	INTEGRATION_PEER    = "peer"   // node to node traffic
+	INTEGRATION_SHADOW  = "shadow" // shadow traffic to a staging node
+
+	PROXY_DIRECT = "direct"
+)
+
+var ErrProxyInvalid = medaerror.MedaError{Message: "invalid outbound proxy"}
+
+var (
+	proxyTransportsMu sync.Mutex
+	proxyTransports   = map[string]*http.Transport{}
+)
+
+// OutboundProxySetting is the configured proxy of an integration: a URL, PROXY_DIRECT, or empty for
+// the environment
+func OutboundProxySetting(integration string) string {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_PROXY, SETTING_KEY_PROXY_OUTBOUND+"_"+integration); ok && s.TextValue != "" {
+		return s.TextValue
+	}
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_PROXY, SETTING_KEY_PROXY_OUTBOUND); ok {
+		return s.TextValue
+	}
+	return ""
+}
+
+// ProxyFunc is the http.Transport Proxy of an integration
+func ProxyFunc(integration string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		switch setting := OutboundProxySetting(integration); setting {
+		case "":
+			return http.ProxyFromEnvironment(req)
+		case PROXY_DIRECT:
+			return nil, nil
+		default:
+			return parseProxyURL(setting)
+		}
+	}
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, medaerror.Errorf("%s: %q", ErrProxyInvalid.Message, raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, medaerror.Errorf("%s: scheme %q is not supported", ErrProxyInvalid.Message, u.Scheme)
+}
+
+// IntegrationHTTPClient is the HTTP client outbound calls of an integration use. The transport is
+// shared per integration so connections (and proxy tunnels) are reused.
+func IntegrationHTTPClient(integration string, timeout time.Duration) *http.Client {
+	proxyTransportsMu.Lock()
+	defer proxyTransportsMu.Unlock()
+	t, ok := proxyTransports[integration]
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = ProxyFunc(integration)
+		proxyTransports[integration] = t
+	}
+	return &http.Client{Timeout: timeout, Transport: t}
+}
+
+// DialIntegration opens a TCP connection to addr (host:port) for a non HTTP protocol, through the
+// proxy of the integration when there is one. The environment proxy is HTTPS_PROXY (and NO_PROXY).
+func DialIntegration(integration, addr string, timeout time.Duration) (net.Conn, error) {
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: addr}}
+	proxyURL, err := ProxyFunc(integration)(req)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if proxyURL == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, medaerror.Errorf("%s: %s cannot tunnel %s, use an http proxy", ErrProxyInvalid.Message, proxyURL.Scheme, integration)
+	}
+	return dialConnect(dialer, proxyURL, addr, timeout)
+}
+
+// dialConnect opens a CONNECT tunnel through an http proxy
+func dialConnect(dialer *net.Dialer, proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), map[string]string{"http": "80", "https": "443"}[proxyURL.Scheme])
+	}
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// the body of a successful CONNECT is the tunnel, only a refusal is read
+		resp.Body.Close()
+		conn.Close()
+		return nil, medaerror.Errorf("%s: proxy %s refused CONNECT %s: %s", ErrProxyInvalid.Message, proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// the server may talk first (SMTP greeting), keep what the reader buffered already
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
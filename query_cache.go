@@ -0,0 +1,278 @@
+package suresql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Query result cache: with cache/ttl_ms the results of /db/api/querysql are kept for that long, keyed by the
+// user, the statements with their whitespace normalized and the parameters. A write through the API (sql,
+// insert, update, delete, upsert, batch update, queued inserts, committed transactions), generated rows,
+// derived table refreshes and rule actions drop the results that read their tables, DDL and statements
+// whose tables are not known drop all. A read running while a table it reads is written is not kept.
+// Writes of other nodes, triggers, cascades and views are only seen after the TTL.
+
+const (
+	DEFAULT_CACHE_MAX_ENTRIES = 1000
+	CACHE_MAX_RECORDS         = 10000 // larger results are not kept
+)
+
+// QueryCache keeps results by key with the tables they read
+type QueryCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cachedResult
+	versions map[string]uint64 // by table, raised by every write of the table
+	cleared  uint64            // raised when all results are dropped
+}
+
+type cachedResult struct {
+	tables  []string
+	value   interface{}
+	expires time.Time
+}
+
+// CacheStamp is the state of the tables of a read when it started, a result is kept only if it did not change
+type CacheStamp uint64
+
+var ResultCache = &QueryCache{}
+
+var (
+	cacheTableRegex = regexp.MustCompile("(?i)\\b(?:from|join|into|update|table)\\s+((?:[a-z0-9_.]+|\"[^\"]+\"|`[^`]+`)(?:\\s*(?:as\\s+)?[a-z0-9_]*\\s*,\\s*(?:[a-z0-9_.]+|\"[^\"]+\"|`[^`]+`))*)")
+	cacheTableSplit = regexp.MustCompile(`\s*,\s*`)
+)
+
+// CacheTTL reads cache/ttl_ms, 0 when the cache is off
+func CacheTTL() time.Duration {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CACHE, SETTING_KEY_CACHE_TTL_MS); ok && s.IntValue > 0 {
+		return time.Duration(s.IntValue) * time.Millisecond
+	}
+	return 0
+}
+
+func cacheMaxEntries() int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CACHE, SETTING_KEY_CACHE_MAX_ENTRIES); ok && s.IntValue > 0 {
+		return s.IntValue
+	}
+	return DEFAULT_CACHE_MAX_ENTRIES
+}
+
+// QueryCacheKey is the key of the statements of a user read through route (see RouteRead), statements
+// differing only in whitespace outside their literals have the same key
+func QueryCacheKey(username, route string, req SQLRequest) string {
+	h := sha256.New()
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(route))
+	if req.SingleRow {
+		h.Write([]byte{0, 1})
+	}
+	for _, s := range req.Statements {
+		h.Write([]byte{0})
+		h.Write([]byte(normalizeSQLSpace(s)))
+	}
+	for _, p := range req.ParamSQL {
+		h.Write([]byte{0})
+		h.Write([]byte(normalizeSQLSpace(p.Query)))
+		values, _ := json.Marshal(p.Values)
+		h.Write([]byte{0})
+		h.Write(values)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeSQLSpace collapses the whitespace outside quotes and drops the final semicolon
+func normalizeSQLSpace(query string) string {
+	var sb strings.Builder
+	sb.Grow(len(query))
+	var quote rune
+	space := false
+	for _, r := range strings.TrimSpace(query) {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		sb.WriteRune(r)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(sb.String(), ";"))
+}
+
+// SQLTables are the tables a statement names after FROM, JOIN, INTO, UPDATE and TABLE, lower case
+func SQLTables(query string) []string {
+	var tables []string
+	for _, m := range cacheTableRegex.FindAllStringSubmatch(query, -1) {
+		for _, t := range cacheTableSplit.Split(m[1], -1) {
+			// the alias after the name
+			if fields := strings.Fields(t); len(fields) > 0 {
+				t = fields[0]
+			}
+			if t = strings.ToLower(strings.Trim(t, "`\"")); t != "" {
+				tables = append(tables, t)
+			}
+		}
+	}
+	return tables
+}
+
+// Get returns the result of the key when it has not expired
+func (c *QueryCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !CurrentClock.Now().Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if Metrics != nil {
+		Metrics.RecordCacheLookup(ok)
+	}
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Stamp is taken before the read of the tables
+func (c *QueryCache) Stamp(tables []string) CacheStamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stamp(tables)
+}
+
+// stamp only grows, every version does, under the lock
+func (c *QueryCache) stamp(tables []string) CacheStamp {
+	s := c.cleared
+	for _, t := range tables {
+		s += c.versions[t]
+	}
+	return CacheStamp(s)
+}
+
+// Put keeps the result of the tables when none of them was written since the stamp. The value is shared by
+// the callers of Get, they must not change it.
+func (c *QueryCache) Put(key string, tables []string, stamp CacheStamp, value interface{}) {
+	ttl := CacheTTL()
+	if ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stamp(tables) != stamp {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*cachedResult)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= cacheMaxEntries() {
+		c.evict()
+	}
+	c.entries[key] = &cachedResult{tables: tables, value: value, expires: CurrentClock.Now().Add(ttl)}
+}
+
+// evict drops the expired results, or the one expiring first when none has, under the lock
+func (c *QueryCache) evict() {
+	now := CurrentClock.Now()
+	first := ""
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		} else if first == "" || e.expires.Before(c.entries[first].expires) {
+			first = key
+		}
+	}
+	if len(c.entries) >= cacheMaxEntries() && first != "" {
+		delete(c.entries, first)
+	}
+}
+
+// InvalidateTables drops the results that read the tables
+func (c *QueryCache) InvalidateTables(tables ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versions == nil {
+		c.versions = make(map[string]uint64)
+	}
+	written := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		t = strings.ToLower(t)
+		c.versions[t]++
+		written[t] = true
+	}
+	for key, e := range c.entries {
+		for _, t := range e.tables {
+			if written[t] {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// InvalidateAll drops every result
+func (c *QueryCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cleared++
+	c.entries = nil
+}
+
+// InvalidateStatements drops the results that read the tables the statements write, all of them for DDL and
+// statements whose tables are not known
+func (c *QueryCache) InvalidateStatements(statements []string) {
+	var tables []string
+	for _, s := range statements {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "SELECT":
+			continue
+		case "INSERT", "REPLACE", "UPDATE", "DELETE", "UPSERT", "MERGE":
+			if t := SQLTables(s); len(t) > 0 {
+				tables = append(tables, t...)
+				continue
+			}
+		}
+		c.InvalidateAll()
+		return
+	}
+	if len(tables) > 0 {
+		c.InvalidateTables(tables...)
+	}
+}
+
+// InvalidateRecords drops the results that read the tables of the records
+func (c *QueryCache) InvalidateRecords(records []orm.DBRecord) {
+	tables := make([]string, 0, 1)
+	for _, r := range records {
+		if len(tables) == 0 || tables[len(tables)-1] != r.TableName {
+			tables = append(tables, r.TableName)
+		}
+	}
+	c.InvalidateTables(tables...)
+}
+
+// Len is the number of results kept
+func (c *QueryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,169 @@
+package suresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Fair query scheduling: connection/max_queries is the number of data API requests running at once on the
+// node, apart from the pool size (a token keeps its connection) and max_inflight (requests refused at once).
+// A request over it waits in the queue of its token, and a freed slot goes to the queues in turn, one request
+// of a token then one of the next, so a client with hundreds of requests waiting does not hold back the
+// others. A request waiting longer than connection/queue_timeout_ms is refused with 429.
+
+const DEFAULT_QUEUE_TIMEOUT = 10 * time.Second
+
+var ErrQueryQueueTimeout = medaerror.MedaError{Message: "waited too long for a query slot"}
+
+// QueryScheduler hands out the query slots of the node
+type QueryScheduler struct {
+	mu      sync.Mutex
+	running int
+	waiting int
+	queues  map[string][]*queuedQuery // by token, first in first out
+	turns   []string                  // tokens with requests waiting, the next slot goes to the first
+	// counted since the start
+	queued   int64
+	timedOut int64
+}
+
+type queuedQuery struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// QuerySchedulerStatus is the state of the query slots
+type QuerySchedulerStatus struct {
+	MaxQueries int   `json:"max_queries"` // 0 is no limit
+	Running    int   `json:"running"`
+	Waiting    int   `json:"waiting"`
+	Tokens     int   `json:"tokens_waiting"`
+	Queued     int64 `json:"queued_total"`
+	TimedOut   int64 `json:"timed_out_total"`
+}
+
+var Queries = &QueryScheduler{}
+
+// MaxQueries reads connection/max_queries, 0 is no limit
+func MaxQueries() int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CONNECTION, SETTING_KEY_MAX_QUERIES); ok && s.IntValue > 0 {
+		return s.IntValue
+	}
+	return 0
+}
+
+// QueueTimeout reads connection/queue_timeout_ms
+func QueueTimeout() time.Duration {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_CONNECTION, SETTING_KEY_QUEUE_TIMEOUT); ok && s.IntValue > 0 {
+		return time.Duration(s.IntValue) * time.Millisecond
+	}
+	return DEFAULT_QUEUE_TIMEOUT
+}
+
+// Acquire takes a slot for a request of the token, waiting its turn when all are taken. The returned release
+// frees it, ErrQueryQueueTimeout when no slot came within wait.
+func (s *QueryScheduler) Acquire(token string, wait time.Duration) (func(), error) {
+	limit := MaxQueries()
+	s.mu.Lock()
+	if limit == 0 || (s.running < limit && len(s.turns) == 0) {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	q := &queuedQuery{ready: make(chan struct{})}
+	if len(s.queues[token]) == 0 {
+		s.turns = append(s.turns, token)
+	}
+	if s.queues == nil {
+		s.queues = make(map[string][]*queuedQuery)
+	}
+	s.queues[token] = append(s.queues[token], q)
+	s.waiting++
+	s.queued++
+	// slots freed by a higher limit
+	s.grant()
+	s.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-q.ready:
+		return s.release, nil
+	case <-timer.C:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q.granted {
+		// the slot came with the timeout
+		return s.release, nil
+	}
+	s.remove(token, q)
+	s.timedOut++
+	return nil, ErrQueryQueueTimeout
+}
+
+func (s *QueryScheduler) release() {
+	s.mu.Lock()
+	s.running--
+	s.grant()
+	s.mu.Unlock()
+}
+
+// grant gives the free slots to the waiting requests, a token at a time, under the lock
+func (s *QueryScheduler) grant() {
+	limit := MaxQueries()
+	for len(s.turns) > 0 && (limit == 0 || s.running < limit) {
+		token := s.turns[0]
+		s.turns = s.turns[1:]
+		q := s.queues[token][0]
+		s.queues[token] = s.queues[token][1:]
+		if len(s.queues[token]) > 0 {
+			s.turns = append(s.turns, token)
+		} else {
+			delete(s.queues, token)
+		}
+		s.waiting--
+		s.running++
+		q.granted = true
+		close(q.ready)
+	}
+}
+
+// remove takes a request that stopped waiting out of its queue, under the lock
+func (s *QueryScheduler) remove(token string, q *queuedQuery) {
+	queue := s.queues[token]
+	for i, w := range queue {
+		if w == q {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	s.waiting--
+	if len(queue) > 0 {
+		s.queues[token] = queue
+		return
+	}
+	delete(s.queues, token)
+	for i, t := range s.turns {
+		if t == token {
+			s.turns = append(s.turns[:i], s.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// Status is the state of the slots and the queues
+func (s *QueryScheduler) Status() QuerySchedulerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return QuerySchedulerStatus{
+		MaxQueries: MaxQueries(),
+		Running:    s.running,
+		Waiting:    s.waiting,
+		Tokens:     len(s.turns),
+		Queued:     s.queued,
+		TimedOut:   s.timedOut,
+	}
+}
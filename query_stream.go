@@ -0,0 +1,258 @@
+package suresql
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"io"
+
+	orm "github.com/medatechnology/simpleorm"
+	"github.com/medatechnology/simpleorm/rqlite"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Streamed query results: with stream a querysql statement answers NDJSON, a line per record in the form of
+// the NDJSON insert ({"TableName": ..., "Data": {...}}), written while the rows are read. rqlite rows are
+// decoded one at a time from its answer, database/sql rows as they are scanned, so the server holds one row
+// and not the result. Other backends read the records first and stream them. An error after the first line
+// cannot change the status anymore, it ends the body with a line {"error": "..."}.
+
+const QUERY_STREAM_BUFFER = 32 << 10
+
+var ErrQueryStream = medaerror.MedaError{Message: "stream needs exactly one statement and no single_row"}
+
+// StreamRecords writes the records of the select to w as NDJSON, named table or as the backend names them
+// when empty. It returns the records written.
+func StreamRecords(db SureSQLDB, table string, p orm.ParametereizedSQL, w io.Writer) (int, error) {
+	bw := bufio.NewWriterSize(w, QUERY_STREAM_BUFFER)
+	written := 0
+	var err error
+	backend, faulty := rowSetBackend(db)
+	if faulty {
+		if err = InjectFault(FAULT_TARGET_DRIVER); err != nil {
+			return 0, err
+		}
+	}
+	if backend == nil {
+		// the backend reads records, they are streamed after
+		records, err := db.SelectOneSQLParameterized(p)
+		if err != nil && err != orm.ErrSQLNoRows {
+			return 0, err
+		}
+		enc := json.NewEncoder(bw)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return written, err
+			}
+			written++
+		}
+		return written, bw.Flush()
+	}
+
+	table = rowSetTable(backend, table, p.Query)
+	var e *rowEncoder
+	var line []byte
+	each := func(columns []string, row []interface{}) error {
+		if e == nil {
+			e = newRowEncoder(table, columns)
+		}
+		var err error
+		if line, err = e.appendRow(line[:0], row); err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err = bw.Write(line); err != nil {
+			return err
+		}
+		written++
+		return nil
+	}
+	if err = eachRowOf(backend, p, each); err != nil {
+		return written, err
+	}
+	return written, bw.Flush()
+}
+
+// eachRowOf calls fn with every row of the select on a backend of rowSetBackend
+func eachRowOf(backend SureSQLDB, p orm.ParametereizedSQL, fn func(columns []string, row []interface{}) error) error {
+	if r, ok := backend.(*rqlite.RQLiteDirectDB); ok {
+		return rqliteEachRow(r, p, fn)
+	}
+	return backend.(*SQLDatabase).eachRow(p.Query, p.Values, fn)
+}
+
+// rqliteEachRow calls fn with every row of the first result of the select, decoded from the answer one row at
+// a time. The row is only valid during the call.
+func rqliteEachRow(db *rqlite.RQLiteDirectDB, p orm.ParametereizedSQL, fn func(columns []string, row []interface{}) error) error {
+	resp, err := rqliteQuery(db, p)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeRQLiteRows(resp.Body, fn)
+}
+
+// decodeRQLiteRows walks {"results": [{"columns": [...], "values": [[...], ...]}, ...]} with the tokens of
+// the answer, the other keys and results are skipped
+func decodeRQLiteRows(r io.Reader, fn func(columns []string, row []interface{}) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	results := false
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "results":
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			if !dec.More() {
+				return medaerror.NewString("no results returned")
+			}
+			if err := decodeRQLiteResult(dec, fn); err != nil {
+				return err
+			}
+			for dec.More() {
+				if err := skipValue(dec); err != nil {
+					return err
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+			results = true
+		case "error":
+			var msg string
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			if msg != "" {
+				return medaerror.NewString(msg)
+			}
+		default:
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+		}
+	}
+	if !results {
+		return medaerror.NewString("no results returned")
+	}
+	return nil
+}
+
+func decodeRQLiteResult(dec *json.Decoder, fn func(columns []string, row []interface{}) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	var columns []string
+	var row []interface{}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "columns":
+			if err := dec.Decode(&columns); err != nil {
+				return err
+			}
+		case "error":
+			var msg string
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			if msg != "" {
+				return medaerror.Errorf("query error: %s", msg)
+			}
+		case "values":
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				// decoding into the same slice keeps its array
+				row = row[:0]
+				if err := dec.Decode(&row); err != nil {
+					return err
+				}
+				if err := fn(columns, row); err != nil {
+					return err
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+		default:
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return medaerror.Errorf("unexpected %v in the rqlite answer, want %v", t, delim)
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var skip json.RawMessage
+	return dec.Decode(&skip)
+}
+
+// eachRow calls fn with every row of the statement as it is scanned, converted like scanRowSet. The row is
+// only valid during the call. Only starting the query is retried, rows already passed to fn cannot be.
+func (s *SQLDatabase) eachRow(query string, args []interface{}, fn func(columns []string, row []interface{}) error) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	var rows *sql.Rows
+	err := s.retry(true, func() error {
+		var err error
+		rows, err = s.DB.QueryContext(ctx, s.sql(query), args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	kinds := make([]int, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name()
+		kinds[i] = sqlColumnKind(c.DatabaseTypeName())
+	}
+	scanned := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range scanned {
+		ptrs[i] = &scanned[i]
+	}
+	row := make([]interface{}, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range scanned {
+			row[i] = convertSQLValue(v, kinds[i])
+		}
+		if err := fn(names, row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
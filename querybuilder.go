@@ -0,0 +1,542 @@
+package suresql
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Query builder: renders orm.Condition into SQL with the placeholders of the DBMS in use. Compared to
+// orm.Condition.ToSelectString it validates identifiers and operators (the condition comes from the API),
+// and supports list values: IN, NOT IN and ANY, and "=" / "!=" with a slice value become IN / NOT IN.
+
+// Dialect is the SQL flavour of a DBMS
+type Dialect struct {
+	Name           string
+	NumberedParams bool // $1, $2, ... instead of ?
+	SupportsAny    bool // field = ANY(ARRAY[...])
+}
+
+var (
+	DialectSQLite   = Dialect{Name: "sqlite"} // rqlite
+	DialectPostgres = Dialect{Name: "postgres", NumberedParams: true, SupportsAny: true}
+	DialectMySQL    = Dialect{Name: "mysql"}
+)
+
+var (
+	ErrInvalidIdentifier = medaerror.MedaError{Message: "invalid column name"}
+	ErrInvalidOperator   = medaerror.MedaError{Message: "invalid condition operator"}
+	ErrInvalidOrderBy    = medaerror.MedaError{Message: "invalid order by"}
+	ErrInvalidLogic      = medaerror.MedaError{Message: "condition logic must be AND or OR"}
+	ErrListValueRequired = medaerror.MedaError{Message: "operator requires a list value"}
+	ErrUpdateNoValues    = medaerror.MedaError{Message: "update needs at least one column value"}
+	ErrUpdateCondition   = medaerror.MedaError{Message: "update condition takes fields only, no order, group, limit or offset"}
+	ErrDeleteCondition   = medaerror.MedaError{Message: "delete condition takes fields only, no order, group, limit or offset"}
+	ErrUpsertNoConflict  = medaerror.MedaError{Message: "upsert needs conflict columns, the record must have them"}
+	ErrUpsertStrategy    = medaerror.MedaError{Message: "upsert strategy must be ignore, update or replace"}
+	ErrUpsertColumn      = medaerror.MedaError{Message: "upsert update column is not in the record"}
+	ErrHavingCondition   = medaerror.MedaError{Message: "having takes fields only, no order, group, limit or offset"}
+	ErrHavingNoGroupBy   = medaerror.MedaError{Message: "having needs group by"}
+	ErrJoinOnColumn      = medaerror.MedaError{Message: "join on compares columns, the value must be a column name"}
+)
+
+var (
+	// column or table.column
+	identifierRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)?$`)
+	// column [ASC|DESC] [NULLS FIRST|LAST]
+	orderByRegex = regexp.MustCompile(`(?i)^[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)?(\s+(ASC|DESC))?(\s+NULLS\s+(FIRST|LAST))?$`)
+)
+
+// Operators allowed in a condition, value is false for operators without a value
+var conditionOperators = map[string]bool{
+	"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true,
+	"LIKE": true, "NOT LIKE": true,
+	"IN": true, "NOT IN": true, "ANY": true,
+	"IS NULL": false, "IS NOT NULL": false,
+}
+
+// DialectFor returns the dialect of the DBMS name (as in SureSQLDBMSConfig.DBMS)
+func DialectFor(dbms string) Dialect {
+	switch strings.ToUpper(strings.TrimSpace(dbms)) {
+	case "POSTGRESQL", "POSTGRES", "COCKROACH", "COCKROACHDB":
+		return DialectPostgres
+	case "MYSQL", "MARIADB":
+		return DialectMySQL
+	default:
+		return DialectSQLite
+	}
+}
+
+// CurrentDialect is the dialect of the DBMS this node is connected to
+func CurrentDialect() Dialect {
+	return DialectFor(CurrentNode.GetInternalConfig().DBMS)
+}
+
+// Quote quotes an identifier (a result column alias), backticks on MySQL and double quotes elsewhere
+func (d Dialect) Quote(name string) string {
+	if d.Name == DialectMySQL.Name {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// ValidateIdentifier checks a column (or table.column) name
+func ValidateIdentifier(name string) error {
+	if !identifierRegex.MatchString(name) {
+		return medaerror.Errorf("%s: %q", ErrInvalidIdentifier.Message, name)
+	}
+	return nil
+}
+
+// QueryBuilder collects the arguments while rendering so placeholders are numbered correctly
+type QueryBuilder struct {
+	Dialect Dialect
+	args    []interface{}
+	fields  map[string]string // condition field to expression, the aggregate aliases while rendering HAVING
+	columns bool              // condition values are columns, while rendering the ON of a join
+}
+
+func NewQueryBuilder(d Dialect) *QueryBuilder {
+	return &QueryBuilder{Dialect: d}
+}
+
+// Arg adds an argument and returns its placeholder
+func (b *QueryBuilder) Arg(v interface{}) string {
+	b.args = append(b.args, v)
+	if b.Dialect.NumberedParams {
+		return fmt.Sprintf("$%d", len(b.args))
+	}
+	return "?"
+}
+
+// Args returns the arguments in placeholder order
+func (b *QueryBuilder) Args() []interface{} {
+	return b.args
+}
+
+// Where renders the condition (without the WHERE keyword), empty string if there is nothing to filter
+func (b *QueryBuilder) Where(c *orm.Condition) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	if c.Field != "" {
+		return b.simpleCondition(c)
+	}
+	if len(c.Nested) == 0 {
+		return "", nil
+	}
+
+	logic := strings.ToUpper(strings.TrimSpace(c.Logic))
+	if logic == "" {
+		logic = "AND"
+	}
+	if logic != "AND" && logic != "OR" {
+		return "", ErrInvalidLogic
+	}
+	clauses := make([]string, 0, len(c.Nested))
+	for i := range c.Nested {
+		clause, err := b.Where(&c.Nested[i])
+		if err != nil {
+			return "", err
+		}
+		if clause != "" {
+			clauses = append(clauses, "("+clause+")")
+		}
+	}
+	return strings.Join(clauses, " "+logic+" "), nil
+}
+
+// Having renders the HAVING condition (without keyword), a field naming an aggregate alias is replaced by
+// the aggregate expression, PostgreSQL does not know the aliases there
+func (b *QueryBuilder) Having(c *orm.Condition, aggregates map[string]string) (string, error) {
+	b.fields = aggregates
+	defer func() { b.fields = nil }()
+	return b.Where(c)
+}
+
+// On renders the ON condition of a join (without keyword), the value of every comparison is the column
+// compared with, ie: {"field": "orders.customer_id", "operator": "=", "value": "customers.id"}
+func (b *QueryBuilder) On(c *orm.Condition) (string, error) {
+	b.columns = true
+	defer func() { b.columns = false }()
+	return b.Where(c)
+}
+
+func (b *QueryBuilder) simpleCondition(c *orm.Condition) (string, error) {
+	if err := ValidateIdentifier(c.Field); err != nil {
+		return "", err
+	}
+	field := c.Field
+	if expr, ok := b.fields[strings.ToLower(field)]; ok {
+		field = expr
+	}
+	op := strings.Join(strings.Fields(strings.ToUpper(c.Operator)), " ")
+	if op == "" {
+		op = "="
+	}
+	needsValue, ok := conditionOperators[op]
+	if !ok {
+		return "", medaerror.Errorf("%s: %q", ErrInvalidOperator.Message, c.Operator)
+	}
+	if !needsValue {
+		return field + " " + op, nil
+	}
+	if b.columns {
+		column, ok := c.Value.(string)
+		_, isList := listValue(c.Value)
+		if !ok || isList || op == "IN" || op == "NOT IN" || op == "ANY" || ValidateIdentifier(column) != nil {
+			return "", medaerror.Errorf("%s: %v", ErrJoinOnColumn.Message, c.Value)
+		}
+		return field + " " + op + " " + column, nil
+	}
+
+	list, isList := listValue(c.Value)
+	switch {
+	case isList && op == "=":
+		op = "IN"
+	case isList && (op == "!=" || op == "<>"):
+		op = "NOT IN"
+	}
+
+	switch op {
+	case "IN", "NOT IN", "ANY":
+		if !isList {
+			return "", medaerror.Errorf("%s: %s", ErrListValueRequired.Message, op)
+		}
+		if len(list) == 0 {
+			// empty list: nothing is IN it, everything is NOT IN it
+			if op == "NOT IN" {
+				return "1=1", nil
+			}
+			return "1=0", nil
+		}
+		placeholders := make([]string, len(list))
+		for i, v := range list {
+			placeholders[i] = b.Arg(v)
+		}
+		if op == "ANY" {
+			if b.Dialect.SupportsAny {
+				return field + " = ANY(ARRAY[" + strings.Join(placeholders, ", ") + "])", nil
+			}
+			op = "IN"
+		}
+		return field + " " + op + " (" + strings.Join(placeholders, ", ") + ")", nil
+	}
+
+	if isList {
+		return "", medaerror.Errorf("%s: operator %s does not take a list", ErrInvalidOperator.Message, op)
+	}
+	return field + " " + op + " " + b.Arg(c.Value), nil
+}
+
+// OrderBy renders the ORDER BY list (without keyword)
+func (b *QueryBuilder) OrderBy(orderBy []string) (string, error) {
+	for _, o := range orderBy {
+		if !orderByRegex.MatchString(strings.TrimSpace(o)) {
+			return "", medaerror.Errorf("%s: %q", ErrInvalidOrderBy.Message, o)
+		}
+	}
+	return strings.Join(orderBy, ", "), nil
+}
+
+// GroupBy renders the GROUP BY list (without keyword)
+func (b *QueryBuilder) GroupBy(groupBy []string) (string, error) {
+	for _, g := range groupBy {
+		if err := ValidateIdentifier(strings.TrimSpace(g)); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(groupBy, ", "), nil
+}
+
+// Select renders a complete SELECT * for the table with WHERE, GROUP BY, ORDER BY and LIMIT/OFFSET
+func (b *QueryBuilder) Select(table string, c *orm.Condition) (string, error) {
+	return b.SelectColumns(table, nil, false, c)
+}
+
+// SelectColumns renders SELECT (DISTINCT) of the columns (all when empty) of the rows matching the condition
+func (b *QueryBuilder) SelectColumns(table string, columns []string, distinct bool, c *orm.Condition) (string, error) {
+	if err := ValidateIdentifier(table); err != nil {
+		return "", err
+	}
+	selected := "*"
+	if len(columns) > 0 {
+		for _, column := range columns {
+			if err := ValidateIdentifier(column); err != nil {
+				return "", err
+			}
+		}
+		selected = strings.Join(columns, ", ")
+	}
+	if distinct {
+		selected = "DISTINCT " + selected
+	}
+	query := "SELECT " + selected + " FROM " + table
+	if c == nil {
+		return query, nil
+	}
+	tail, err := b.tail(c)
+	if err != nil {
+		return "", err
+	}
+	return query + tail, nil
+}
+
+// tail renders everything after FROM: WHERE, GROUP BY, ORDER BY, LIMIT and OFFSET
+func (b *QueryBuilder) tail(c *orm.Condition) (string, error) {
+	var sb strings.Builder
+	where, err := b.Where(c)
+	if err != nil {
+		return "", err
+	}
+	if where != "" {
+		sb.WriteString(" WHERE " + where)
+	}
+	if len(c.GroupBy) > 0 {
+		group, err := b.GroupBy(c.GroupBy)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(" GROUP BY " + group)
+	}
+	if len(c.OrderBy) > 0 {
+		order, err := b.OrderBy(c.OrderBy)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(" ORDER BY " + order)
+	}
+	limit := c.Limit
+	if c.Offset > 0 && limit < 1 {
+		limit = orm.DEFAULT_PAGINATION_LIMIT
+	}
+	if limit > 0 {
+		sb.WriteString(fmt.Sprintf(" LIMIT %d", limit))
+		if c.Offset > 0 {
+			sb.WriteString(fmt.Sprintf(" OFFSET %d", c.Offset))
+		}
+	}
+	return sb.String(), nil
+}
+
+// BuildSelect renders SELECT * for the table and condition in the dialect
+func BuildSelect(d Dialect, table string, c *orm.Condition) (orm.ParametereizedSQL, error) {
+	b := NewQueryBuilder(d)
+	query, err := b.Select(table, c)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, nil
+}
+
+// BuildSelectColumns renders the select (distinct) of the columns (all when empty) in the dialect
+func BuildSelectColumns(d Dialect, table string, columns []string, distinct bool, c *orm.Condition) (orm.ParametereizedSQL, error) {
+	b := NewQueryBuilder(d)
+	query, err := b.SelectColumns(table, columns, distinct, c)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, nil
+}
+
+// Update renders UPDATE of the columns (sorted, so the statement is stable) of the rows matching the condition
+func (b *QueryBuilder) Update(table string, values map[string]interface{}, c *orm.Condition) (string, error) {
+	if err := ValidateIdentifier(table); err != nil {
+		return "", err
+	}
+	if len(values) == 0 {
+		return "", ErrUpdateNoValues
+	}
+	if c != nil && (len(c.OrderBy) > 0 || len(c.GroupBy) > 0 || c.Limit != 0 || c.Offset != 0) {
+		return "", ErrUpdateCondition
+	}
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		if err := ValidateIdentifier(column); err != nil {
+			return "", err
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	sets := make([]string, len(columns))
+	for i, column := range columns {
+		sets[i] = column + " = " + b.Arg(values[column])
+	}
+	query := "UPDATE " + table + " SET " + strings.Join(sets, ", ")
+	where, err := b.Where(c)
+	if err != nil {
+		return "", err
+	}
+	if where != "" {
+		query += " WHERE " + where
+	}
+	return query, nil
+}
+
+// BuildUpdate renders UPDATE of the table for the values and condition in the dialect
+func BuildUpdate(d Dialect, table string, values map[string]interface{}, c *orm.Condition) (orm.ParametereizedSQL, error) {
+	b := NewQueryBuilder(d)
+	query, err := b.Update(table, values, c)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, nil
+}
+
+// Delete renders DELETE of the rows matching the condition
+func (b *QueryBuilder) Delete(table string, c *orm.Condition) (string, error) {
+	if err := ValidateIdentifier(table); err != nil {
+		return "", err
+	}
+	if c != nil && (len(c.OrderBy) > 0 || len(c.GroupBy) > 0 || c.Limit != 0 || c.Offset != 0) {
+		return "", ErrDeleteCondition
+	}
+	query := "DELETE FROM " + table
+	where, err := b.Where(c)
+	if err != nil {
+		return "", err
+	}
+	if where != "" {
+		query += " WHERE " + where
+	}
+	return query, nil
+}
+
+// BuildDelete renders DELETE of the table for the condition in the dialect
+func BuildDelete(d Dialect, table string, c *orm.Condition) (orm.ParametereizedSQL, error) {
+	b := NewQueryBuilder(d)
+	query, err := b.Delete(table, c)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, nil
+}
+
+// Upsert renders INSERT of the record (columns sorted) that resolves a conflict on the conflict columns
+// with the strategy: ignore keeps the row, update sets the update columns (every other column of the
+// record when empty) from the record, replace sets every column of the record. MySQL has no conflict
+// target, its unique keys decide, and replace is its REPLACE INTO (so is SQLite's, which drops the old row).
+func (b *QueryBuilder) Upsert(rec orm.DBRecord, conflict []string, strategy string, update []string) (string, error) {
+	if err := ValidateIdentifier(rec.TableName); err != nil {
+		return "", err
+	}
+	if len(rec.Data) == 0 {
+		return "", ErrUpdateNoValues
+	}
+	columns := make([]string, 0, len(rec.Data))
+	for column := range rec.Data {
+		if err := ValidateIdentifier(column); err != nil {
+			return "", err
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	if len(conflict) == 0 {
+		return "", ErrUpsertNoConflict
+	}
+	isConflict := map[string]bool{}
+	for _, column := range conflict {
+		if _, ok := rec.Data[column]; !ok {
+			return "", medaerror.Errorf("%s: %q", ErrUpsertNoConflict.Message, column)
+		}
+		isConflict[column] = true
+	}
+
+	var sets []string
+	switch strings.ToLower(strategy) {
+	case UPSERT_IGNORE:
+	case UPSERT_UPDATE:
+		sets = append([]string(nil), update...)
+		if len(sets) == 0 {
+			for _, column := range columns {
+				if !isConflict[column] {
+					sets = append(sets, column)
+				}
+			}
+		}
+		for _, column := range sets {
+			if _, ok := rec.Data[column]; !ok {
+				return "", medaerror.Errorf("%s: %q", ErrUpsertColumn.Message, column)
+			}
+		}
+	case UPSERT_REPLACE:
+		if b.Dialect.Name != DialectPostgres.Name {
+			return "REPLACE INTO " + rec.TableName + b.insertValues(rec, columns), nil
+		}
+		for _, column := range columns {
+			if !isConflict[column] {
+				sets = append(sets, column)
+			}
+		}
+	default:
+		return "", ErrUpsertStrategy
+	}
+
+	query := "INSERT INTO " + rec.TableName + b.insertValues(rec, columns)
+	if b.Dialect.Name == DialectMySQL.Name {
+		// a no-op update of a conflict column keeps the row without the errors INSERT IGNORE swallows
+		if len(sets) == 0 {
+			return query + " ON DUPLICATE KEY UPDATE " + conflict[0] + " = " + conflict[0], nil
+		}
+		for i, column := range sets {
+			sets[i] = column + " = VALUES(" + column + ")"
+		}
+		return query + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", "), nil
+	}
+	query += " ON CONFLICT (" + strings.Join(conflict, ", ") + ")"
+	if len(sets) == 0 {
+		return query + " DO NOTHING", nil
+	}
+	assigns := make([]string, len(sets))
+	for i, column := range sets {
+		assigns[i] = column + " = excluded." + column
+	}
+	return query + " DO UPDATE SET " + strings.Join(assigns, ", "), nil
+}
+
+// insertValues renders " (columns) VALUES (placeholders)" of the record
+func (b *QueryBuilder) insertValues(rec orm.DBRecord, columns []string) string {
+	params := make([]string, len(columns))
+	for i, column := range columns {
+		params[i] = b.Arg(rec.Data[column])
+	}
+	return " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(params, ", ") + ")"
+}
+
+// BuildUpsert renders the upsert of the record in the dialect
+func BuildUpsert(d Dialect, rec orm.DBRecord, conflict []string, strategy string, update []string) (orm.ParametereizedSQL, error) {
+	b := NewQueryBuilder(d)
+	query, err := b.Upsert(rec, conflict, strategy, update)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	return orm.ParametereizedSQL{Query: query, Values: b.Args()}, nil
+}
+
+// listValue returns the elements if v is a slice or array (but not []byte, which is a single blob value)
+func listValue(v interface{}) ([]interface{}, bool) {
+	if v == nil {
+		return nil, false
+	}
+	if list, ok := v.([]interface{}); ok {
+		return list, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	if rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, true
+}
@@ -0,0 +1,388 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Storage quotas: rows and bytes written through the insert endpoints are accounted per user and
+// per tenant (the tenant column of _users). Quotas are optional, a subject without a row in
+// _storage_quotas is unlimited. Usage is kept in memory and the deltas are persisted in _storage_usage,
+// cached usage is reloaded every QUOTA_CACHE_REFRESH so nodes in a cluster converge.
+
+const (
+	QUOTA_SUBJECT_USER   = "user"
+	QUOTA_SUBJECT_TENANT = "tenant"
+
+	QUOTA_RESOURCE_ROWS  = "rows"
+	QUOTA_RESOURCE_BYTES = "bytes"
+
+	QUOTA_CACHE_REFRESH = time.Minute
+)
+
+var (
+	ErrQuotaExceeded       = medaerror.MedaError{Message: "storage quota exceeded"}
+	ErrInvalidQuotaSubject = medaerror.MedaError{Message: "subject_type must be user or tenant"}
+)
+
+// StorageQuotaTable is the limit of a user or tenant, 0 means unlimited for that resource
+type StorageQuotaTable struct {
+	ID          int       `json:"id,omitempty"            db:"id"`
+	SubjectType string    `json:"subject_type"            db:"subject_type"`
+	Subject     string    `json:"subject"                 db:"subject"`
+	MaxRows     int64     `json:"max_rows"                db:"max_rows"`
+	MaxBytes    int64     `json:"max_bytes"               db:"max_bytes"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"    db:"updated_at"`
+}
+
+func (q StorageQuotaTable) TableName() string {
+	return "_storage_quotas"
+}
+
+// StorageUsageTable is the accumulated writes of a user or tenant
+type StorageUsageTable struct {
+	ID           int       `json:"id,omitempty"            db:"id"`
+	SubjectType  string    `json:"subject_type"            db:"subject_type"`
+	Subject      string    `json:"subject"                 db:"subject"`
+	RowsWritten  int64     `json:"rows_written"            db:"rows_written"`
+	BytesWritten int64     `json:"bytes_written"           db:"bytes_written"`
+	UpdatedAt    time.Time `json:"updated_at,omitempty"    db:"updated_at"`
+}
+
+func (u StorageUsageTable) TableName() string {
+	return "_storage_usage"
+}
+
+// StorageUsageReport is usage together with the quota, used for the usage endpoints
+type StorageUsageReport struct {
+	StorageUsageTable
+	MaxRows  int64 `json:"max_rows"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// QuotaViolation is returned (as response data) when a write would go over a quota
+type QuotaViolation struct {
+	SubjectType string `json:"subject_type"`
+	Subject     string `json:"subject"`
+	Resource    string `json:"resource"` // rows or bytes
+	Limit       int64  `json:"limit"`
+	Used        int64  `json:"used"`
+	Requested   int64  `json:"requested"`
+}
+
+func (v QuotaViolation) Error() string {
+	return fmt.Sprintf("%s %s %s quota exceeded: used %d + requested %d > limit %d",
+		v.SubjectType, v.Subject, v.Resource, v.Used, v.Requested, v.Limit)
+}
+
+type usageEntry struct {
+	rows, bytes               int64 // persisted usage (as of last load) plus local committed writes
+	pendingRows, pendingBytes int64 // reserved by in-flight inserts
+	loadedAt                  time.Time
+}
+
+// QuotaManager keeps quotas and usage in memory
+type QuotaManager struct {
+	mu             sync.Mutex
+	quotas         map[string]StorageQuotaTable
+	quotasLoadedAt time.Time
+	quotasVersion  int // changed by SetQuota and DeleteQuota, a load read before is not applied
+	usage          map[string]*usageEntry
+}
+
+var (
+	Quotas     *QuotaManager
+	quotasOnce sync.Once
+)
+
+// InitQuotaManager initializes the global quota manager
+func InitQuotaManager() {
+	quotasOnce.Do(func() {
+		Quotas = &QuotaManager{
+			quotas: make(map[string]StorageQuotaTable),
+			usage:  make(map[string]*usageEntry),
+		}
+	})
+}
+
+func quotaKey(subjectType, subject string) string {
+	return subjectType + ":" + subject
+}
+
+// IsValidQuotaSubject checks the subject type
+func IsValidQuotaSubject(subjectType string) bool {
+	return subjectType == QUOTA_SUBJECT_USER || subjectType == QUOTA_SUBJECT_TENANT
+}
+
+// RecordsSize estimates the stored size of the records, it is the size of the JSON encoded data
+func RecordsSize(records []orm.DBRecord) int64 {
+	var size int64
+	for _, rec := range records {
+		b, err := json.Marshal(rec.Data)
+		if err == nil {
+			size += int64(len(b))
+		}
+	}
+	return size
+}
+
+// Reserve checks the quotas of the user and its tenant (if any) and reserves rows and bytes for a write.
+// Returns the violation if the write is not allowed, in that case nothing is reserved. Every successful
+// Reserve must be followed by Commit or Release.
+func (q *QuotaManager) Reserve(user, tenant string, rows, bytes int64) *QuotaViolation {
+	subjects := q.subjects(user, tenant)
+	q.load(subjects)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := make([]*usageEntry, len(subjects))
+	for i, s := range subjects {
+		quota, limited := q.quotas[quotaKey(s[0], s[1])]
+		entries[i] = q.entryLocked(s[0], s[1])
+		if !limited {
+			continue
+		}
+		e := entries[i]
+		if quota.MaxRows > 0 && e.rows+e.pendingRows+rows > quota.MaxRows {
+			return &QuotaViolation{s[0], s[1], QUOTA_RESOURCE_ROWS, quota.MaxRows, e.rows + e.pendingRows, rows}
+		}
+		if quota.MaxBytes > 0 && e.bytes+e.pendingBytes+bytes > quota.MaxBytes {
+			return &QuotaViolation{s[0], s[1], QUOTA_RESOURCE_BYTES, quota.MaxBytes, e.bytes + e.pendingBytes, bytes}
+		}
+	}
+	for _, e := range entries {
+		e.pendingRows += rows
+		e.pendingBytes += bytes
+	}
+	return nil
+}
+
+// Release gives back a reservation, ie: when the insert failed
+func (q *QuotaManager) Release(user, tenant string, rows, bytes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range q.subjects(user, tenant) {
+		e := q.entryLocked(s[0], s[1])
+		e.pendingRows -= rows
+		e.pendingBytes -= bytes
+	}
+}
+
+// Commit turns a reservation into usage and persists the delta to _storage_usage
+func (q *QuotaManager) Commit(user, tenant string, rows, bytes int64) {
+	q.mu.Lock()
+	subjects := q.subjects(user, tenant)
+	for _, s := range subjects {
+		e := q.entryLocked(s[0], s[1])
+		e.pendingRows -= rows
+		e.pendingBytes -= bytes
+		e.rows += rows
+		e.bytes += bytes
+	}
+	q.mu.Unlock()
+
+	for _, s := range subjects {
+		if err := persistUsageDelta(s[0], s[1], rows, bytes); err != nil {
+			simplelog.LogErrorAny("quota", err, "cannot persist storage usage of "+quotaKey(s[0], s[1]))
+		}
+	}
+}
+
+// Usage returns the usage and quota of a subject
+func (q *QuotaManager) Usage(subjectType, subject string) StorageUsageReport {
+	q.load([][2]string{{subjectType, subject}})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e := q.entryLocked(subjectType, subject)
+	quota := q.quotas[quotaKey(subjectType, subject)]
+	return StorageUsageReport{
+		StorageUsageTable: StorageUsageTable{
+			SubjectType:  subjectType,
+			Subject:      subject,
+			RowsWritten:  e.rows,
+			BytesWritten: e.bytes,
+			UpdatedAt:    e.loadedAt,
+		},
+		MaxRows:  quota.MaxRows,
+		MaxBytes: quota.MaxBytes,
+	}
+}
+
+// ListQuotas returns all quotas
+func (q *QuotaManager) ListQuotas() []StorageQuotaTable {
+	q.load(nil)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := make([]StorageQuotaTable, 0, len(q.quotas))
+	for _, quota := range q.quotas {
+		res = append(res, quota)
+	}
+	return res
+}
+
+// SetQuota creates or replaces the quota of a subject
+func (q *QuotaManager) SetQuota(quota StorageQuotaTable) error {
+	if !IsValidQuotaSubject(quota.SubjectType) {
+		return ErrInvalidQuotaSubject
+	}
+	quota.UpdatedAt = time.Now().UTC()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + quota.TableName() + " (subject_type, subject, max_rows, max_bytes, updated_at) VALUES (?, ?, ?, ?, ?)" +
+			" ON CONFLICT(subject_type, subject) DO UPDATE SET max_rows=excluded.max_rows, max_bytes=excluded.max_bytes, updated_at=excluded.updated_at",
+		Values: []interface{}{quota.SubjectType, quota.Subject, quota.MaxRows, quota.MaxBytes, quota.UpdatedAt},
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	q.mu.Lock()
+	q.quotas[quotaKey(quota.SubjectType, quota.Subject)] = quota
+	q.quotasVersion++
+	q.mu.Unlock()
+	return nil
+}
+
+// DeleteQuota removes the quota of a subject, the subject becomes unlimited
+func (q *QuotaManager) DeleteQuota(subjectType, subject string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + StorageQuotaTable{}.TableName() + " WHERE subject_type = ? AND subject = ?",
+		Values: []interface{}{subjectType, subject},
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	q.mu.Lock()
+	delete(q.quotas, quotaKey(subjectType, subject))
+	q.quotasVersion++
+	q.mu.Unlock()
+	return nil
+}
+
+// ListUsage returns the persisted usage of all subjects
+func ListStorageUsage() ([]StorageUsageTable, error) {
+	condition := orm.Condition{OrderBy: []string{"subject_type ASC", "subject ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(StorageUsageTable{}.TableName(), &condition)
+	if err != nil {
+		if err == orm.ErrSQLNoRows {
+			return []StorageUsageTable{}, nil
+		}
+		return nil, err
+	}
+	usage := make([]StorageUsageTable, 0, len(records))
+	for _, rec := range records {
+		usage = append(usage, object.MapToStructSlowDB[StorageUsageTable](rec.Data))
+	}
+	return usage, nil
+}
+
+func (q *QuotaManager) subjects(user, tenant string) [][2]string {
+	subjects := [][2]string{{QUOTA_SUBJECT_USER, user}}
+	if tenant != "" {
+		subjects = append(subjects, [2]string{QUOTA_SUBJECT_TENANT, tenant})
+	}
+	return subjects
+}
+
+// entryLocked returns the usage entry, a new one has no usage until load reads it
+func (q *QuotaManager) entryLocked(subjectType, subject string) *usageEntry {
+	key := quotaKey(subjectType, subject)
+	e, ok := q.usage[key]
+	if !ok {
+		e = &usageEntry{}
+		q.usage[key] = e
+	}
+	return e
+}
+
+// load (re)reads the quotas and the usage of the subjects that are missing or stale. The DB is read
+// without q.mu so a slow read does not hold up the writes of every other subject, what was read is only
+// applied when no other request loaded it (or changed the quotas) in the meantime.
+func (q *QuotaManager) load(subjects [][2]string) {
+	q.mu.Lock()
+	quotasStale, version := time.Since(q.quotasLoadedAt) >= QUOTA_CACHE_REFRESH, q.quotasVersion
+	var stale [][2]string
+	for _, s := range subjects {
+		if e, ok := q.usage[quotaKey(s[0], s[1])]; !ok || time.Since(e.loadedAt) >= QUOTA_CACHE_REFRESH {
+			stale = append(stale, s)
+		}
+	}
+	q.mu.Unlock()
+
+	if quotasStale {
+		quotas, err := loadQuotas()
+		q.mu.Lock()
+		if time.Since(q.quotasLoadedAt) >= QUOTA_CACHE_REFRESH {
+			// on an error keep what we have in memory, try again on next refresh
+			if err == nil && q.quotasVersion == version {
+				q.quotas = quotas
+			}
+			q.quotasLoadedAt = time.Now()
+		}
+		q.mu.Unlock()
+	}
+	for _, s := range stale {
+		u, err := loadUsage(s[0], s[1])
+		q.mu.Lock()
+		if e := q.entryLocked(s[0], s[1]); time.Since(e.loadedAt) >= QUOTA_CACHE_REFRESH {
+			if err == nil {
+				e.rows, e.bytes = u.RowsWritten, u.BytesWritten
+			}
+			e.loadedAt = time.Now()
+		}
+		q.mu.Unlock()
+	}
+}
+
+// loadUsage reads the persisted usage of a subject, zero when it never wrote
+func loadUsage(subjectType, subject string) (StorageUsageTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(StorageUsageTable{}.TableName(), &orm.Condition{
+		Logic: "AND",
+		Nested: []orm.Condition{
+			{Field: "subject_type", Operator: "=", Value: subjectType},
+			{Field: "subject", Operator: "=", Value: subject},
+		},
+	})
+	if err == orm.ErrSQLNoRows {
+		return StorageUsageTable{}, nil
+	}
+	if err != nil {
+		simplelog.LogErrorAny("quota", err, "cannot load storage usage of "+quotaKey(subjectType, subject))
+		return StorageUsageTable{}, err
+	}
+	return object.MapToStructSlowDB[StorageUsageTable](rec.Data), nil
+}
+
+// loadQuotas reads every quota
+func loadQuotas() (map[string]StorageQuotaTable, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectMany(StorageQuotaTable{}.TableName())
+	if err != nil {
+		if err != orm.ErrSQLNoRows {
+			simplelog.LogErrorAny("quota", err, "cannot load storage quotas")
+			return nil, err
+		}
+		records = nil
+	}
+	quotas := make(map[string]StorageQuotaTable, len(records))
+	for _, rec := range records {
+		quota := object.MapToStructSlowDB[StorageQuotaTable](rec.Data)
+		quotas[quotaKey(quota.SubjectType, quota.Subject)] = quota
+	}
+	return quotas, nil
+}
+
+func persistUsageDelta(subjectType, subject string, rows, bytes int64) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + StorageUsageTable{}.TableName() + " (subject_type, subject, rows_written, bytes_written, updated_at) VALUES (?, ?, ?, ?, ?)" +
+			" ON CONFLICT(subject_type, subject) DO UPDATE SET rows_written=rows_written+excluded.rows_written," +
+			" bytes_written=bytes_written+excluded.bytes_written, updated_at=excluded.updated_at",
+		Values: []interface{}{subjectType, subject, rows, bytes, time.Now().UTC()},
+	})
+	return res.Error
+}
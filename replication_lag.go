@@ -0,0 +1,351 @@
+package suresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Replica lag is measured with a heartbeat row: the scheduler leader bumps its seq and written_at every
+// heartbeat_sec, every node reads the row twice, from the leader and from its own copy (rqlite
+// consistency none). The seq gap is how many heartbeats the node has not applied yet, the time lag is the
+// difference of the two written_at, both from the leader clock so the node clocks do not matter.
+// Above lag_max_sec the node suspends stale reads until it is back under lag_warn_sec. Only rqlite has
+// node local copies, on the other DBMS both reads go to the same database and the lag stays 0.
+
+const (
+	REPLICATION_HEARTBEAT_ID      = 1
+	REPLICATION_DEFAULT_HEARTBEAT = 5  // seconds
+	REPLICATION_DEFAULT_LAG_WARN  = 10 // seconds
+	REPLICATION_DEFAULT_LAG_MAX   = 30 // seconds
+	REPLICATION_LOCAL_CONSISTENCY = "none"
+	REPLICATION_LEADER_CONSIST    = "weak"
+)
+
+// Replica lag levels
+const (
+	REPLICA_LAG_OK        = "ok"
+	REPLICA_LAG_WARNING   = "warning"
+	REPLICA_LAG_SUSPENDED = "suspended"
+)
+
+// ReplicationHeartbeatTable is the single heartbeat row written by the leader
+type ReplicationHeartbeatTable struct {
+	ID         int    `json:"id"                    db:"id"`
+	Seq        int64  `json:"seq"                   db:"seq"`
+	WrittenAt  string `json:"written_at,omitempty"  db:"written_at"`
+	NodeNumber int    `json:"node_number,omitempty" db:"node_number"`
+}
+
+func (ReplicationHeartbeatTable) TableName() string {
+	return "_replication_heartbeat"
+}
+
+// writtenAt parses WrittenAt, zero when empty or invalid
+func (h ReplicationHeartbeatTable) writtenAt() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, h.WrittenAt)
+	return t
+}
+
+// ReplicaLag is the last measurement of this node, in /db/api/status and the metrics
+type ReplicaLag struct {
+	Level          string    `json:"level"`
+	LagSeconds     float64   `json:"lag_seconds"`
+	LagSeq         int64     `json:"lag_seq"`
+	LocalSeq       int64     `json:"local_seq"`
+	LeaderSeq      int64     `json:"leader_seq"`
+	WarnSeconds    int       `json:"warn_seconds"`
+	MaxSeconds     int       `json:"max_seconds"`
+	ReadsSuspended bool      `json:"reads_suspended"`
+	SuspendedAt    time.Time `json:"suspended_at,omitempty"`
+	MeasuredAt     time.Time `json:"measured_at"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// ReplicaLagMonitor writes the heartbeat on the leader and measures the lag of this node
+type ReplicaLagMonitor struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	every    time.Duration
+
+	lagMu  sync.RWMutex
+	lag    ReplicaLag
+	local  SureSQLDB // reads the copy of this node
+	leader SureSQLDB // reads what the leader has
+}
+
+var (
+	ReplicaMonitor     *ReplicaLagMonitor
+	replicaMonitorOnce sync.Once
+)
+
+// InitReplicaLagMonitor initializes the global replica lag monitor
+func InitReplicaLagMonitor() {
+	replicaMonitorOnce.Do(func() {
+		ReplicaMonitor = &ReplicaLagMonitor{stopChan: make(chan struct{})}
+	})
+}
+
+// StartReplicaLagMonitor starts the heartbeat and the lag measurement
+func StartReplicaLagMonitor(ctx context.Context) {
+	if ReplicaMonitor == nil {
+		InitReplicaLagMonitor()
+	}
+	ReplicaMonitor.Start(ctx)
+}
+
+// StopReplicaLagMonitor stops the heartbeat and the lag measurement
+func StopReplicaLagMonitor() {
+	if ReplicaMonitor != nil {
+		ReplicaMonitor.Stop()
+	}
+}
+
+// ReplicationEnabled tells if there are replicas to watch, split-write (unless its flag is off) or more
+// than one node
+func ReplicationEnabled() bool {
+	return (CurrentNode.Config.IsSplitWrite && FeatureEnabled(FLAG_SPLIT_WRITE)) || CurrentNode.Config.Nodes > 1
+}
+
+// CurrentReplicaLag returns the last measurement, nil when the lag is not monitored
+func CurrentReplicaLag() *ReplicaLag {
+	if ReplicaMonitor == nil {
+		return nil
+	}
+	ReplicaMonitor.lagMu.RLock()
+	defer ReplicaMonitor.lagMu.RUnlock()
+	if ReplicaMonitor.lag.MeasuredAt.IsZero() {
+		return nil
+	}
+	lag := ReplicaMonitor.lag
+	return &lag
+}
+
+// ReplicaReadsSuspended tells if this node is too far behind to serve reads from its own copy,
+// read routing should send them to the leader (or refuse) while this is true
+func ReplicaReadsSuspended() bool {
+	lag := CurrentReplicaLag()
+	return lag != nil && lag.ReadsSuspended
+}
+
+// replicationSetting reads an int setting of the replication category, def when not set
+func replicationSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_REPLICATION, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// Start ticks every heartbeat_sec, it does nothing when replication is off or the heartbeat is 0
+func (m *ReplicaLagMonitor) Start(ctx context.Context) {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return
+	}
+	sec := replicationSetting(SETTING_KEY_REPLICATION_HEARTBEAT, REPLICATION_DEFAULT_HEARTBEAT)
+	if !ReplicationEnabled() || sec <= 0 {
+		m.mu.Unlock()
+		return
+	}
+	if err := m.connect(); err != nil {
+		m.mu.Unlock()
+		simplelog.LogErrorAny("ReplicaLag", err, "cannot open the replica lag connections, lag is not monitored")
+		return
+	}
+	m.running = true
+	m.every = time.Duration(sec) * time.Second
+	m.ticker = CurrentClock.NewTicker(m.every)
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		simplelog.LogFormat("ReplicaLag: heartbeat every %s", m.every)
+		for {
+			select {
+			case <-m.ticker.C():
+				// the split_write flag can be turned off while running
+				if ReplicationEnabled() {
+					m.Check()
+				}
+			case <-m.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the monitor
+func (m *ReplicaLagMonitor) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+	m.ticker.Stop()
+	close(m.stopChan)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// connect takes the two rqlite read connections of the routing (routing.go), other DBMS use the internal one
+func (m *ReplicaLagMonitor) connect() error {
+	m.local = CurrentNode.GetInternalConnection()
+	m.leader = m.local
+	dbms := strings.ToUpper(strings.TrimSpace(CurrentNode.GetInternalConfig().DBMS))
+	if dbms != "" && dbms != "RQLITE" {
+		return nil
+	}
+	local, err := routeConnection(REPLICATION_LOCAL_CONSISTENCY)
+	if err != nil {
+		return err
+	}
+	leader, err := routeConnection(REPLICATION_LEADER_CONSIST)
+	if err != nil {
+		return err
+	}
+	m.local, m.leader = local, leader
+	return nil
+}
+
+// Check writes the heartbeat when this node is the leader, then measures and stores the lag
+func (m *ReplicaLagMonitor) Check() {
+	if IsSchedulerLeader() {
+		if err := writeHeartbeat(); err != nil {
+			simplelog.LogErrorAny("ReplicaLag", err, "cannot write the replication heartbeat")
+		}
+	}
+	m.store(m.measure())
+}
+
+// writeHeartbeat bumps the seq of the heartbeat row with the leader clock
+func writeHeartbeat() error {
+	sql := orm.ParametereizedSQL{
+		Query: "INSERT INTO " + ReplicationHeartbeatTable{}.TableName() + " (id, seq, written_at, node_number) VALUES (?, 1, ?, ?)" +
+			" ON CONFLICT(id) DO UPDATE SET seq = " + ReplicationHeartbeatTable{}.TableName() + ".seq + 1, written_at = excluded.written_at, node_number = excluded.node_number",
+		Values: []interface{}{REPLICATION_HEARTBEAT_ID, CurrentClock.Now().UTC().Format(time.RFC3339Nano), CurrentNode.Config.NodeNumber},
+	}
+	return CurrentNode.GetInternalConnection().ExecOneSQLParameterized(sql).Error
+}
+
+// readHeartbeat reads the heartbeat row through db, an empty row when the leader did not write it yet
+func readHeartbeat(db SureSQLDB) (ReplicationHeartbeatTable, error) {
+	rec, err := db.SelectOneWithCondition(ReplicationHeartbeatTable{}.TableName(), &orm.Condition{Field: "id", Operator: "=", Value: REPLICATION_HEARTBEAT_ID})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return ReplicationHeartbeatTable{}, nil
+		}
+		return ReplicationHeartbeatTable{}, err
+	}
+	return object.MapToStructSlowDB[ReplicationHeartbeatTable](rec.Data), nil
+}
+
+// measure compares the copy of this node with the leader, the thresholds are read every time so a
+// settings change applies on the next tick
+func (m *ReplicaLagMonitor) measure() ReplicaLag {
+	lag := ReplicaLag{
+		WarnSeconds: replicationSetting(SETTING_KEY_REPLICATION_LAG_WARN, REPLICATION_DEFAULT_LAG_WARN),
+		MaxSeconds:  replicationSetting(SETTING_KEY_REPLICATION_LAG_MAX, REPLICATION_DEFAULT_LAG_MAX),
+		MeasuredAt:  CurrentClock.Now(),
+	}
+	leader, err := readHeartbeat(m.leader)
+	if err != nil {
+		lag.Error = "leader: " + err.Error()
+		return lag
+	}
+	local, err := readHeartbeat(m.local)
+	if err != nil {
+		lag.Error = "local: " + err.Error()
+		return lag
+	}
+	lag.LeaderSeq, lag.LocalSeq = leader.Seq, local.Seq
+	if leader.Seq > local.Seq {
+		lag.LagSeq = leader.Seq - local.Seq
+		if local.Seq == 0 {
+			// the row itself has not arrived, count the heartbeats missed
+			lag.LagSeconds = float64(lag.LagSeq) * m.every.Seconds()
+		} else {
+			lag.LagSeconds = leader.writtenAt().Sub(local.writtenAt()).Seconds()
+		}
+	}
+	return lag
+}
+
+// store keeps the measurement, suspends reads above lag_max_sec and resumes them under lag_warn_sec,
+// the alerts are raised on the changes only
+func (m *ReplicaLagMonitor) store(lag ReplicaLag) {
+	m.lagMu.Lock()
+	prev := m.lag
+	lag.ReadsSuspended, lag.SuspendedAt = prev.ReadsSuspended, prev.SuspendedAt
+	if lag.Error == "" {
+		switch {
+		case lag.MaxSeconds > 0 && lag.LagSeconds > float64(lag.MaxSeconds):
+			if !lag.ReadsSuspended {
+				lag.SuspendedAt = lag.MeasuredAt
+			}
+			lag.ReadsSuspended = true
+		case lag.LagSeconds <= float64(lag.WarnSeconds):
+			lag.ReadsSuspended, lag.SuspendedAt = false, time.Time{}
+		}
+	}
+	switch {
+	case lag.ReadsSuspended:
+		lag.Level = REPLICA_LAG_SUSPENDED
+	case lag.WarnSeconds > 0 && lag.LagSeconds > float64(lag.WarnSeconds):
+		lag.Level = REPLICA_LAG_WARNING
+	default:
+		lag.Level = REPLICA_LAG_OK
+	}
+	if prev.Level == "" {
+		prev.Level = REPLICA_LAG_OK
+	}
+	m.lag = lag
+	m.lagMu.Unlock()
+
+	if prev.Level == lag.Level {
+		return
+	}
+	simplelog.LogFormat("ReplicaLag: %s -> %s, %.1fs behind (%d heartbeats)", prev.Level, lag.Level, lag.LagSeconds, lag.LagSeq)
+	if AlertMgr == nil {
+		return
+	}
+	metadata := map[string]interface{}{
+		"node_number": CurrentNode.Config.NodeNumber,
+		"lag_seconds": lag.LagSeconds,
+		"lag_seq":     lag.LagSeq,
+	}
+	switch lag.Level {
+	case REPLICA_LAG_SUSPENDED:
+		AlertMgr.CreateAlert(AlertLevelCritical,
+			"Replica Lag Critical",
+			fmt.Sprintf("Node %d is %.1fs behind the leader (max %ds), reads from this node are suspended.",
+				CurrentNode.Config.NodeNumber, lag.LagSeconds, lag.MaxSeconds),
+			metadata,
+		)
+	case REPLICA_LAG_WARNING:
+		AlertMgr.CreateAlert(AlertLevelWarning,
+			"Replica Lag High",
+			fmt.Sprintf("Node %d is %.1fs behind the leader (warn %ds).", CurrentNode.Config.NodeNumber, lag.LagSeconds, lag.WarnSeconds),
+			metadata,
+		)
+	default:
+		msg := fmt.Sprintf("Node %d is back to %.1fs behind the leader.", CurrentNode.Config.NodeNumber, lag.LagSeconds)
+		if prev.ReadsSuspended {
+			msg += " Reads from this node are resumed."
+		}
+		AlertMgr.CreateAlert(AlertLevelInfo, "Replica Lag Recovered", msg, metadata)
+	}
+}
@@ -0,0 +1,282 @@
+package suresql
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Reports: admin managed templates (_report_templates) that hold a named parameterized SELECT query and
+// how to render it. Clients run them by name with /db/api/report and get CSV, HTML or PDF back.
+
+const (
+	REPORT_FORMAT_CSV  = "csv"
+	REPORT_FORMAT_HTML = "html"
+	REPORT_FORMAT_PDF  = "pdf"
+	REPORT_FORMAT_JSON = "json"
+)
+
+var (
+	ErrReportNotFound       = medaerror.MedaError{Message: "report template not found"}
+	ErrReportNotSelect      = medaerror.MedaError{Message: "report query must be a single SELECT statement"}
+	ErrReportFormatUnknown  = medaerror.MedaError{Message: "report format must be csv, html, pdf or json"}
+	ErrReportMissingParam   = medaerror.MedaError{Message: "report parameter is missing"}
+	ErrReportTemplateSyntax = medaerror.MedaError{Message: "report html template cannot be parsed"}
+)
+
+// ReportTemplateTable is a named report in the registry
+type ReportTemplateTable struct {
+	ID           int       `json:"id,omitempty"             db:"id"`
+	Name         string    `json:"name"                     db:"name"`
+	Title        string    `json:"title,omitempty"          db:"title"`
+	Description  string    `json:"description,omitempty"    db:"description"`
+	Query        string    `json:"query"                    db:"query"`         // SELECT with ? placeholders
+	Params       string    `json:"params,omitempty"         db:"params"`        // comma separated parameter names, in placeholder order
+	Columns      string    `json:"columns,omitempty"        db:"columns"`       // comma separated column order, empty means all columns sorted
+	Format       string    `json:"format,omitempty"         db:"format"`        // default output format
+	HTMLTemplate string    `json:"html_template,omitempty"  db:"html_template"` // optional html/template, see ReportData
+	UpdatedAt    time.Time `json:"updated_at,omitempty"     db:"updated_at"`
+}
+
+func (r ReportTemplateTable) TableName() string {
+	return "_report_templates"
+}
+
+// ParamNames returns the parameter names in placeholder order
+func (r ReportTemplateTable) ParamNames() []string {
+	return splitList(r.Params)
+}
+
+// ReportData is what the templates (html/pdf/csv) render
+type ReportData struct {
+	Name        string
+	Title       string
+	Columns     []string
+	Rows        [][]string
+	GeneratedAt time.Time
+}
+
+// Default html rendering, custom templates get the same ReportData
+var defaultReportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}th,td{border:1px solid #999;padding:4px 8px}th{background:#eee}</style>
+</head><body>
+<h2>{{.Title}}</h2>
+<p>Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}, {{len .Rows}} rows</p>
+<table><thead><tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>{{end}}</tbody></table>
+</body></html>
+`))
+
+// parsed custom templates by report name, invalidated when the report is saved or deleted
+var (
+	reportHTMLCache   = make(map[string]*template.Template)
+	reportHTMLCacheMu sync.Mutex
+)
+
+// IsValidReportFormat checks the output format
+func IsValidReportFormat(format string) bool {
+	switch format {
+	case REPORT_FORMAT_CSV, REPORT_FORMAT_HTML, REPORT_FORMAT_PDF, REPORT_FORMAT_JSON:
+		return true
+	}
+	return false
+}
+
+// ValidateReportTemplate checks the template before it is saved
+func ValidateReportTemplate(r ReportTemplateTable) error {
+	if err := ValidateTableName(r.Name, false); err != nil {
+		return medaerror.Errorf("invalid report name: %s", err.Error())
+	}
+	q := strings.TrimSpace(r.Query)
+	q = strings.TrimSuffix(q, ";")
+	lower := strings.ToLower(q)
+	if !(strings.HasPrefix(lower, "select") || strings.HasPrefix(lower, "with")) || strings.Contains(q, ";") {
+		return ErrReportNotSelect
+	}
+	if strings.Count(q, "?") != len(r.ParamNames()) {
+		return medaerror.Errorf("report query has %d placeholders but %d params", strings.Count(q, "?"), len(r.ParamNames()))
+	}
+	if r.Format != "" && !IsValidReportFormat(r.Format) {
+		return ErrReportFormatUnknown
+	}
+	if r.HTMLTemplate != "" {
+		if _, err := template.New(r.Name).Parse(r.HTMLTemplate); err != nil {
+			return medaerror.Errorf("%s: %s", ErrReportTemplateSyntax.Message, err.Error())
+		}
+	}
+	return nil
+}
+
+// GetReportTemplate returns the report template by name
+func GetReportTemplate(name string) (ReportTemplateTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(ReportTemplateTable{}.TableName(),
+		&orm.Condition{Field: "name", Operator: "=", Value: name})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return ReportTemplateTable{}, ErrReportNotFound
+		}
+		return ReportTemplateTable{}, err
+	}
+	return object.MapToStructSlowDB[ReportTemplateTable](rec.Data), nil
+}
+
+// ListReportTemplates returns all report templates
+func ListReportTemplates() ([]ReportTemplateTable, error) {
+	condition := orm.Condition{OrderBy: []string{"name ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(ReportTemplateTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []ReportTemplateTable{}, nil
+		}
+		return nil, err
+	}
+	reports := make([]ReportTemplateTable, 0, len(records))
+	for _, rec := range records {
+		reports = append(reports, object.MapToStructSlowDB[ReportTemplateTable](rec.Data))
+	}
+	return reports, nil
+}
+
+// SaveReportTemplate creates or replaces a report template by name
+func SaveReportTemplate(r ReportTemplateTable) error {
+	if err := ValidateReportTemplate(r); err != nil {
+		return err
+	}
+	r.UpdatedAt = time.Now().UTC()
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + r.TableName() + " (name, title, description, query, params, columns, format, html_template, updated_at)" +
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(name) DO UPDATE SET title=excluded.title, description=excluded.description," +
+			" query=excluded.query, params=excluded.params, columns=excluded.columns, format=excluded.format," +
+			" html_template=excluded.html_template, updated_at=excluded.updated_at",
+		Values: []interface{}{r.Name, r.Title, r.Description, r.Query, r.Params, r.Columns, r.Format, r.HTMLTemplate, r.UpdatedAt},
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	forgetReportHTML(r.Name)
+	return nil
+}
+
+// DeleteReportTemplate removes a report template by name
+func DeleteReportTemplate(name string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + ReportTemplateTable{}.TableName() + " WHERE name = ?",
+		Values: []interface{}{name},
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	forgetReportHTML(name)
+	return nil
+}
+
+// RunReport executes the report query with the named params on db and returns the data ready to render
+func RunReport(db SureSQLDB, r ReportTemplateTable, params map[string]interface{}) (ReportData, error) {
+	data := ReportData{Name: r.Name, Title: r.Title, GeneratedAt: time.Now()}
+	if data.Title == "" {
+		data.Title = r.Name
+	}
+
+	names := r.ParamNames()
+	values := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		v, ok := params[name]
+		if !ok {
+			return data, medaerror.Errorf("%s: %s", ErrReportMissingParam.Message, name)
+		}
+		values = append(values, v)
+	}
+
+	records, err := db.SelectOneSQLParameterized(orm.ParametereizedSQL{Query: r.Query, Values: values})
+	if err != nil && !IsNoRowsError(err) {
+		return data, err
+	}
+
+	data.Columns = splitList(r.Columns)
+	if len(data.Columns) == 0 && len(records) > 0 {
+		for col := range records[0].Data {
+			data.Columns = append(data.Columns, col)
+		}
+		sort.Strings(data.Columns)
+	}
+	data.Rows = make([][]string, 0, len(records))
+	for _, rec := range records {
+		row := make([]string, len(data.Columns))
+		for i, col := range data.Columns {
+			if v, ok := rec.Data[col]; ok && v != nil {
+				row[i] = fmt.Sprintf("%v", v)
+			}
+		}
+		data.Rows = append(data.Rows, row)
+	}
+	return data, nil
+}
+
+// RenderReport writes the report in the format, returns the content type
+func RenderReport(w io.Writer, r ReportTemplateTable, data ReportData, format string) (string, error) {
+	switch format {
+	case REPORT_FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(data.Columns); err != nil {
+			return "", err
+		}
+		if err := cw.WriteAll(data.Rows); err != nil {
+			return "", err
+		}
+		return "text/csv", nil
+	case REPORT_FORMAT_HTML:
+		tmpl, err := reportHTML(r)
+		if err != nil {
+			return "", err
+		}
+		return "text/html; charset=utf-8", tmpl.Execute(w, data)
+	case REPORT_FORMAT_PDF:
+		return "application/pdf", writeReportPDF(w, data)
+	}
+	return "", ErrReportFormatUnknown
+}
+
+func reportHTML(r ReportTemplateTable) (*template.Template, error) {
+	if r.HTMLTemplate == "" {
+		return defaultReportHTML, nil
+	}
+	reportHTMLCacheMu.Lock()
+	defer reportHTMLCacheMu.Unlock()
+	if tmpl, ok := reportHTMLCache[r.Name]; ok {
+		return tmpl, nil
+	}
+	tmpl, err := template.New(r.Name).Parse(r.HTMLTemplate)
+	if err != nil {
+		return nil, err
+	}
+	reportHTMLCache[r.Name] = tmpl
+	return tmpl, nil
+}
+
+func forgetReportHTML(name string) {
+	reportHTMLCacheMu.Lock()
+	delete(reportHTMLCache, name)
+	reportHTMLCacheMu.Unlock()
+}
+
+// splitList splits a comma separated list, trimming spaces and dropping empty items
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
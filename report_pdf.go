@@ -0,0 +1,135 @@
+package suresql
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Minimal PDF writer for report tables: landscape A4, Courier (built-in font, no embedding) so columns
+// line up with plain padding. Enough for simple business reports without pulling a PDF library.
+
+const (
+	pdfPageWidth    = 842 // A4 landscape in points
+	pdfPageHeight   = 595
+	pdfMargin       = 36
+	pdfFontSize     = 8
+	pdfLineHeight   = 10
+	pdfMaxCellChars = 40
+)
+
+func writeReportPDF(w io.Writer, data ReportData) error {
+	// column widths in characters, capped so one wide column does not push the rest off the page
+	widths := make([]int, len(data.Columns))
+	for i, col := range data.Columns {
+		widths[i] = len(col)
+	}
+	for _, row := range data.Rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for i := range widths {
+		if widths[i] > pdfMaxCellChars {
+			widths[i] = pdfMaxCellChars
+		}
+	}
+	// Courier glyphs are 600/1000 em wide
+	maxChars := (pdfPageWidth - 2*pdfMargin) * 1000 / (600 * pdfFontSize)
+	formatRow := func(cells []string) string {
+		var sb strings.Builder
+		for i, cell := range cells {
+			if len(cell) > widths[i] {
+				cell = cell[:widths[i]-1] + "~"
+			}
+			sb.WriteString(cell)
+			sb.WriteString(strings.Repeat(" ", widths[i]-len(cell)+2))
+		}
+		line := strings.TrimRight(sb.String(), " ")
+		if len(line) > maxChars {
+			line = line[:maxChars]
+		}
+		return line
+	}
+
+	header := []string{data.Title, fmt.Sprintf("Generated %s, %d rows", data.GeneratedAt.Format("2006-01-02 15:04:05 MST"), len(data.Rows)), ""}
+	colLine := formatRow(data.Columns)
+	header = append(header, colLine, strings.Repeat("-", len(colLine)))
+
+	linesPerPage := (pdfPageHeight-2*pdfMargin)/pdfLineHeight - len(header)
+	var pages [][]string
+	for start := 0; start < len(data.Rows) || start == 0; start += linesPerPage {
+		end := start + linesPerPage
+		if end > len(data.Rows) {
+			end = len(data.Rows)
+		}
+		lines := append([]string{}, header...)
+		for _, row := range data.Rows[start:end] {
+			lines = append(lines, formatRow(row))
+		}
+		pages = append(pages, lines)
+		if end == len(data.Rows) {
+			break
+		}
+	}
+
+	// objects: 1 catalog, 2 pages, 3 font, then a page and its content stream for every page
+	var buf bytes.Buffer
+	var offsets []int
+	writeObj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	writeObj("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	writeObj("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+	for i, lines := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range lines {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		fmt.Fprintf(&content, "(Page %d of %d) Tj\nET", i+1, len(pages))
+
+		writeObj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 5+2*i))
+		writeObj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// pdfEscape escapes string literal delimiters, characters outside printable ASCII become '?'
+// because the built-in font uses a single byte encoding.
+func pdfEscape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 32 || r > 126:
+			sb.WriteByte('?')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
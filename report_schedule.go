@@ -0,0 +1,317 @@
+package suresql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Scheduled report delivery: every minute the scheduler runs the enabled _report_schedules whose cron
+// expression matches, renders the report with the internal connection and emails it to the recipients.
+// In a cluster only the leader node delivers so subscribers get one email.
+
+const (
+	REPORT_SCHEDULE_STATUS_OK     = "ok"
+	REPORT_SCHEDULE_STATUS_FAILED = "failed"
+)
+
+var ErrReportScheduleNotFound = medaerror.MedaError{Message: "report schedule not found"}
+
+// ReportScheduleTable is a subscription of a report, delivered by email on a cron schedule
+type ReportScheduleTable struct {
+	ID         int       `json:"id,omitempty"            db:"id"`
+	ReportName string    `json:"report_name"             db:"report_name"`
+	CronExpr   string    `json:"cron_expr"               db:"cron_expr"`  // 5 field cron, evaluated in UTC
+	Format     string    `json:"format,omitempty"        db:"format"`     // csv/html/pdf, default is the report format
+	Params     string    `json:"params,omitempty"        db:"params"`     // JSON object of report params
+	Recipients string    `json:"recipients"              db:"recipients"` // comma separated email addresses
+	Subject    string    `json:"subject,omitempty"       db:"subject"`
+	Enabled    bool      `json:"enabled"                 db:"enabled"`
+	LastRunAt  time.Time `json:"last_run_at,omitempty"   db:"last_run_at"`
+	LastStatus string    `json:"last_status,omitempty"   db:"last_status"`
+	LastError  string    `json:"last_error,omitempty"    db:"last_error"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"    db:"updated_at"`
+}
+
+func (r ReportScheduleTable) TableName() string {
+	return "_report_schedules"
+}
+
+// Validate checks the schedule before it is saved
+func (r ReportScheduleTable) Validate() error {
+	if _, err := ParseCron(r.CronExpr); err != nil {
+		return err
+	}
+	if len(splitList(r.Recipients)) == 0 {
+		return medaerror.NewString("recipients are required")
+	}
+	if r.Format != "" && (!IsValidReportFormat(r.Format) || r.Format == REPORT_FORMAT_JSON) {
+		return medaerror.NewString("format must be csv, html or pdf")
+	}
+	if r.Params != "" {
+		var params map[string]interface{}
+		if err := json.Unmarshal([]byte(r.Params), &params); err != nil {
+			return medaerror.Errorf("params must be a JSON object: %s", err.Error())
+		}
+	}
+	if _, err := GetReportTemplate(r.ReportName); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListReportSchedules returns all report schedules
+func ListReportSchedules() ([]ReportScheduleTable, error) {
+	condition := orm.Condition{OrderBy: []string{"id ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(ReportScheduleTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []ReportScheduleTable{}, nil
+		}
+		return nil, err
+	}
+	schedules := make([]ReportScheduleTable, 0, len(records))
+	for _, rec := range records {
+		schedules = append(schedules, object.MapToStructSlowDB[ReportScheduleTable](rec.Data))
+	}
+	return schedules, nil
+}
+
+// GetReportSchedule returns the schedule by id
+func GetReportSchedule(id int) (ReportScheduleTable, error) {
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(ReportScheduleTable{}.TableName(),
+		&orm.Condition{Field: "id", Operator: "=", Value: id})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return ReportScheduleTable{}, ErrReportScheduleNotFound
+		}
+		return ReportScheduleTable{}, err
+	}
+	return object.MapToStructSlowDB[ReportScheduleTable](rec.Data), nil
+}
+
+// SaveReportSchedule creates (id 0) or updates a schedule
+func SaveReportSchedule(r ReportScheduleTable) (ReportScheduleTable, error) {
+	if err := r.Validate(); err != nil {
+		return r, err
+	}
+	r.UpdatedAt = CurrentClock.Now().UTC()
+	var res orm.BasicSQLResult
+	if r.ID == 0 {
+		res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query: "INSERT INTO " + r.TableName() + " (report_name, cron_expr, format, params, recipients, subject, enabled, updated_at)" +
+				" VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			Values: []interface{}{r.ReportName, r.CronExpr, r.Format, r.Params, r.Recipients, r.Subject, r.Enabled, r.UpdatedAt},
+		})
+		r.ID = int(res.LastInsertID)
+	} else {
+		res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query: "UPDATE " + r.TableName() + " SET report_name = ?, cron_expr = ?, format = ?, params = ?, recipients = ?, subject = ?," +
+				" enabled = ?, updated_at = ? WHERE id = ?",
+			Values: []interface{}{r.ReportName, r.CronExpr, r.Format, r.Params, r.Recipients, r.Subject, r.Enabled, r.UpdatedAt, r.ID},
+		})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return r, ErrReportScheduleNotFound
+		}
+	}
+	return r, res.Error
+}
+
+// DeleteReportSchedule removes a schedule by id
+func DeleteReportSchedule(id int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + ReportScheduleTable{}.TableName() + " WHERE id = ?",
+		Values: []interface{}{id},
+	})
+	return res.Error
+}
+
+// DeliverScheduledReport runs the report of the schedule and emails it, the run is recorded in the schedule
+func DeliverScheduledReport(s ReportScheduleTable) error {
+	err := deliverReport(s)
+	status, errMsg := REPORT_SCHEDULE_STATUS_OK, ""
+	if err != nil {
+		status, errMsg = REPORT_SCHEDULE_STATUS_FAILED, err.Error()
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "UPDATE " + s.TableName() + " SET last_run_at = ?, last_status = ?, last_error = ? WHERE id = ?",
+		Values: []interface{}{CurrentClock.Now().UTC(), status, errMsg, s.ID},
+	})
+	if res.Error != nil {
+		simplelog.LogErrorAny("ReportScheduler", res.Error, fmt.Sprintf("cannot record run of schedule %d", s.ID))
+	}
+	return err
+}
+
+func deliverReport(s ReportScheduleTable) error {
+	report, err := GetReportTemplate(s.ReportName)
+	if err != nil {
+		return err
+	}
+	params := map[string]interface{}{}
+	if s.Params != "" {
+		if err := json.Unmarshal([]byte(s.Params), &params); err != nil {
+			return err
+		}
+	}
+	format := s.Format
+	if format == "" || format == REPORT_FORMAT_JSON {
+		format = report.Format
+	}
+	if format == "" || format == REPORT_FORMAT_JSON {
+		format = REPORT_FORMAT_CSV
+	}
+
+	data, err := RunReport(CurrentNode.GetInternalConnection(), report, params)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	contentType, err := RenderReport(&buf, report, data, format)
+	if err != nil {
+		return err
+	}
+
+	subject := s.Subject
+	if subject == "" {
+		subject = data.Title
+	}
+	body := fmt.Sprintf("%s\n\nGenerated %s, %d rows.\nThis report is scheduled (%s) by %s.\n",
+		data.Title, data.GeneratedAt.UTC().Format(time.RFC1123), len(data.Rows), s.CronExpr, APP_NAME)
+	attachment := MailAttachment{
+		FileName:    fmt.Sprintf("%s_%s.%s", report.Name, data.GeneratedAt.UTC().Format("20060102_1504"), format),
+		ContentType: contentType,
+		Data:        buf.Bytes(),
+	}
+	return SendMail(LoadSMTPConfig(), splitList(s.Recipients), subject, body, attachment)
+}
+
+// IsSchedulerLeader returns true if this node should run cluster wide scheduled jobs
+func IsSchedulerLeader() bool {
+	status := CurrentNode.GetStatus()
+	return status.IsLeader || status.Nodes <= 1
+}
+
+// ReportScheduler checks the schedules every minute
+type ReportScheduler struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+}
+
+var (
+	ReportSched     *ReportScheduler
+	reportSchedOnce sync.Once
+)
+
+// InitReportScheduler initializes the global report scheduler
+func InitReportScheduler() {
+	reportSchedOnce.Do(func() {
+		ReportSched = &ReportScheduler{stopChan: make(chan struct{})}
+	})
+}
+
+// StartReportScheduler starts the report scheduler
+func StartReportScheduler(ctx context.Context) {
+	if ReportSched == nil {
+		InitReportScheduler()
+	}
+	ReportSched.Start(ctx)
+}
+
+// StopReportScheduler stops the report scheduler
+func StopReportScheduler() {
+	if ReportSched != nil {
+		ReportSched.Stop()
+	}
+}
+
+// Start starts checking the schedules at the start of every minute
+func (rs *ReportScheduler) Start(ctx context.Context) {
+	rs.mu.Lock()
+	if rs.running {
+		rs.mu.Unlock()
+		return
+	}
+	rs.running = true
+	rs.mu.Unlock()
+
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		simplelog.LogThis("ReportScheduler", "Starting report scheduler")
+
+		// align the ticker to the minute so cron minutes are not skipped
+		select {
+		case <-CurrentClock.After(CurrentClock.Now().Truncate(time.Minute).Add(time.Minute).Sub(CurrentClock.Now())):
+		case <-ctx.Done():
+			return
+		case <-rs.stopChan:
+			return
+		}
+		rs.ticker = CurrentClock.NewTicker(time.Minute)
+		rs.runDue(CurrentClock.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-rs.stopChan:
+				return
+			case now := <-rs.ticker.C():
+				rs.runDue(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the report scheduler
+func (rs *ReportScheduler) Stop() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !rs.running {
+		return
+	}
+	close(rs.stopChan)
+	rs.wg.Wait()
+	if rs.ticker != nil {
+		rs.ticker.Stop()
+	}
+	rs.running = false
+	simplelog.LogThis("ReportScheduler", "Report scheduler stopped")
+}
+
+func (rs *ReportScheduler) runDue(now time.Time) {
+	if !IsSchedulerLeader() {
+		return
+	}
+	now = now.UTC().Truncate(time.Minute)
+	schedules, err := ListReportSchedules()
+	if err != nil {
+		simplelog.LogErrorAny("ReportScheduler", err, "cannot list report schedules")
+		return
+	}
+	for _, s := range schedules {
+		if !s.Enabled || !s.LastRunAt.Before(now) {
+			continue
+		}
+		cron, err := ParseCron(s.CronExpr)
+		if err != nil || !cron.Matches(now) {
+			continue
+		}
+		if err := DeliverScheduledReport(s); err != nil {
+			simplelog.LogErrorAny("ReportScheduler", err, fmt.Sprintf("report schedule %d (%s) to %s failed", s.ID, s.ReportName, strings.TrimSpace(s.Recipients)))
+		}
+	}
+}
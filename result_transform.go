@@ -0,0 +1,283 @@
+package suresql
+
+import (
+	"math"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Post-processing of query results declared in the request (QueryRequest.Transform), so dashboards
+// do not each rename, derive, pivot and round the same rows. The steps run in this order:
+// filter, derive, pivot, rename, select, precision. Expressions use the engine of expression.go.
+
+const (
+	PIVOT_SUM   = "sum"
+	PIVOT_COUNT = "count"
+	PIVOT_AVG   = "avg"
+	PIVOT_MIN   = "min"
+	PIVOT_MAX   = "max"
+	PIVOT_FIRST = "first"
+
+	RESULT_TRANSFORM_MAX_PIVOT_COLUMNS = 1000
+)
+
+var (
+	ErrResultTransformInvalid = medaerror.MedaError{Message: "invalid result transform"}
+	ErrPivotTooManyColumns    = medaerror.MedaError{Message: "pivot produces too many columns"}
+)
+
+// ResultTransform is the optional post-processing of the rows of a query
+type ResultTransform struct {
+	Filter    string            `json:"filter,omitempty"`    // expression, only rows where it is true are kept
+	Derive    []DerivedField    `json:"derive,omitempty"`    // computed columns, in order
+	Pivot     *PivotSpec        `json:"pivot,omitempty"`     // turn the values of a column into columns
+	Rename    map[string]string `json:"rename,omitempty"`    // old name -> new name
+	Select    []string          `json:"select,omitempty"`    // keep only these columns (after rename)
+	Precision map[string]int    `json:"precision,omitempty"` // decimals per column, "*" for every number
+}
+
+// DerivedField is a column computed from the row
+type DerivedField struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// PivotSpec groups the rows by Row and makes a column of every distinct value of Column, holding the
+// Aggregate of Value, ie: {row: region, column: month, value: total, aggregate: sum}
+type PivotSpec struct {
+	Row       string `json:"row"`
+	Column    string `json:"column"`
+	Value     string `json:"value"`
+	Aggregate string `json:"aggregate,omitempty"` // sum (default), count, avg, min, max, first
+}
+
+// Validate checks the names and compiles the expressions, before the query runs
+func (t *ResultTransform) Validate() error {
+	if t.Filter != "" {
+		if _, err := CompileExpression(t.Filter); err != nil {
+			return medaerror.Errorf("%s: filter: %v", ErrResultTransformInvalid.Message, err)
+		}
+	}
+	for _, d := range t.Derive {
+		if d.Name == "" {
+			return medaerror.Errorf("%s: derive needs a name", ErrResultTransformInvalid.Message)
+		}
+		if _, err := CompileExpression(d.Expression); err != nil {
+			return medaerror.Errorf("%s: derive %s: %v", ErrResultTransformInvalid.Message, d.Name, err)
+		}
+	}
+	if p := t.Pivot; p != nil {
+		if p.Row == "" || p.Column == "" || p.Value == "" {
+			return medaerror.Errorf("%s: pivot needs row, column and value", ErrResultTransformInvalid.Message)
+		}
+		switch strings.ToLower(p.Aggregate) {
+		case "", PIVOT_SUM, PIVOT_COUNT, PIVOT_AVG, PIVOT_MIN, PIVOT_MAX, PIVOT_FIRST:
+		default:
+			return medaerror.Errorf("%s: pivot aggregate %s", ErrResultTransformInvalid.Message, p.Aggregate)
+		}
+	}
+	for from, to := range t.Rename {
+		if from == "" || to == "" {
+			return medaerror.Errorf("%s: rename with an empty column name", ErrResultTransformInvalid.Message)
+		}
+	}
+	for col, digits := range t.Precision {
+		if digits < 0 || digits > 15 {
+			return medaerror.Errorf("%s: precision of %s must be 0 to 15", ErrResultTransformInvalid.Message, col)
+		}
+	}
+	return nil
+}
+
+// Apply runs the steps on the records and returns the new rows
+func (t *ResultTransform) Apply(records []orm.DBRecord) ([]orm.DBRecord, error) {
+	if t.Filter != "" {
+		expr, err := CompileExpression(t.Filter)
+		if err != nil {
+			return nil, err
+		}
+		kept := records[:0]
+		for _, rec := range records {
+			ok, err := expr.EvalBool(rec.Data)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				kept = append(kept, rec)
+			}
+		}
+		records = kept
+	}
+	for _, d := range t.Derive {
+		expr, err := CompileExpression(d.Expression)
+		if err != nil {
+			return nil, err
+		}
+		for i := range records {
+			if records[i].Data == nil {
+				records[i].Data = map[string]interface{}{}
+			}
+			value, err := expr.Eval(records[i].Data)
+			if err != nil {
+				return nil, err
+			}
+			records[i].Data[d.Name] = value
+		}
+	}
+	if t.Pivot != nil {
+		var err error
+		if records, err = t.Pivot.apply(records); err != nil {
+			return nil, err
+		}
+	}
+	if len(t.Rename) > 0 || len(t.Select) > 0 || len(t.Precision) > 0 {
+		for i := range records {
+			records[i].Data = t.reshape(records[i].Data)
+		}
+	}
+	return records, nil
+}
+
+// reshape renames, selects and rounds the columns of one row
+func (t *ResultTransform) reshape(data map[string]interface{}) map[string]interface{} {
+	if len(t.Rename) > 0 {
+		renamed := make(map[string]interface{}, len(data))
+		for k, v := range data {
+			if to, ok := t.Rename[k]; ok {
+				k = to
+			}
+			renamed[k] = v
+		}
+		data = renamed
+	}
+	if len(t.Select) > 0 {
+		selected := make(map[string]interface{}, len(t.Select))
+		for _, k := range t.Select {
+			if v, ok := data[k]; ok {
+				selected[k] = v
+			}
+		}
+		data = selected
+	}
+	if len(t.Precision) > 0 {
+		all, hasAll := t.Precision["*"]
+		for k, v := range data {
+			digits, ok := t.Precision[k]
+			if !ok {
+				if !hasAll {
+					continue
+				}
+				digits = all
+			}
+			data[k] = roundValue(v, digits)
+		}
+	}
+	return data
+}
+
+// roundValue rounds floats to digits decimals, other values are returned as is
+func roundValue(v interface{}, digits int) interface{} {
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case float32:
+		f = float64(n)
+	default:
+		return v
+	}
+	p := math.Pow(10, float64(digits))
+	return math.Round(f*p) / p
+}
+
+type pivotCell struct {
+	value interface{}
+	sum   float64
+	count int
+}
+
+// apply groups the rows by Row, keeping the order in which the row and column values first appear
+func (p *PivotSpec) apply(records []orm.DBRecord) ([]orm.DBRecord, error) {
+	agg := strings.ToLower(p.Aggregate)
+	if agg == "" {
+		agg = PIVOT_SUM
+	}
+	var rowKeys []string
+	rowValues := map[string]interface{}{}
+	cells := map[string]map[string]*pivotCell{}
+	columns := map[string]bool{}
+	table := ""
+	for _, rec := range records {
+		table = rec.TableName
+		rowKey := exprString(rec.Data[p.Row])
+		if _, ok := cells[rowKey]; !ok {
+			rowKeys = append(rowKeys, rowKey)
+			rowValues[rowKey] = rec.Data[p.Row]
+			cells[rowKey] = map[string]*pivotCell{}
+		}
+		col := exprString(rec.Data[p.Column])
+		if col == "" {
+			col = "null"
+		}
+		if !columns[col] {
+			if len(columns) >= RESULT_TRANSFORM_MAX_PIVOT_COLUMNS {
+				return nil, ErrPivotTooManyColumns
+			}
+			columns[col] = true
+		}
+		cell, ok := cells[rowKey][col]
+		if !ok {
+			cell = &pivotCell{}
+			cells[rowKey][col] = cell
+		}
+		value := rec.Data[p.Value]
+		if value == nil {
+			continue
+		}
+		cell.count++
+		f, isNum := numericValue(value)
+		switch agg {
+		case PIVOT_SUM, PIVOT_AVG:
+			if isNum {
+				cell.sum += f
+			}
+		case PIVOT_MIN, PIVOT_MAX:
+			if cell.value == nil {
+				cell.value = value
+			} else if cmp, ok := CompareValues(value, cell.value); ok && (agg == PIVOT_MIN && cmp < 0 || agg == PIVOT_MAX && cmp > 0) {
+				cell.value = value
+			}
+		case PIVOT_FIRST:
+			if cell.count == 1 {
+				cell.value = value
+			}
+		}
+	}
+
+	out := make([]orm.DBRecord, 0, len(rowKeys))
+	for _, rowKey := range rowKeys {
+		data := map[string]interface{}{p.Row: rowValues[rowKey]}
+		for col := range columns {
+			data[col] = nil
+		}
+		for col, cell := range cells[rowKey] {
+			switch agg {
+			case PIVOT_SUM:
+				data[col] = cell.sum
+			case PIVOT_COUNT:
+				data[col] = cell.count
+			case PIVOT_AVG:
+				if cell.count > 0 {
+					data[col] = cell.sum / float64(cell.count)
+				}
+			default:
+				data[col] = cell.value
+			}
+		}
+		out = append(out, orm.DBRecord{TableName: table, Data: data})
+	}
+	return out, nil
+}
@@ -0,0 +1,189 @@
+package suresql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+)
+
+// Retry safety: the SQLDatabase adapters run a statement again after an error the flavor calls retryable,
+// the DBMS then says it did not apply it (Cockroach SQLSTATE 40001). After an error whose outcome is not
+// known (the connection was lost while the statement ran) only idempotent statements are run again, a
+// repeat of the others could apply them twice. A statement is idempotent when running it twice leaves the
+// same rows as running it once: reads, DELETE and UPDATE with values that do not depend on the row,
+// INSERT with a conflict clause and DDL with IF [NOT] EXISTS. A plain INSERT is not, unless a unique key
+// refuses the second one, which is not checked.
+
+const (
+	STATEMENT_KIND_READ   = "read"
+	STATEMENT_KIND_INSERT = "insert"
+	STATEMENT_KIND_UPSERT = "upsert"
+	STATEMENT_KIND_UPDATE = "update"
+	STATEMENT_KIND_DELETE = "delete"
+	STATEMENT_KIND_DDL    = "ddl"
+	STATEMENT_KIND_OTHER  = "other"
+)
+
+// StatementClass is what a statement is and if it can be run again, Statement counts from 1 in request order
+type StatementClass struct {
+	Statement  int    `json:"statement"`
+	Kind       string `json:"kind"`
+	Idempotent bool   `json:"idempotent"`
+	Reason     string `json:"reason"`
+}
+
+var (
+	retryLiteralRegex  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	retryExcludedRegex = regexp.MustCompile(`(?i)\bexcluded\.[a-z0-9_"` + "`" + `]+|\bvalues\s*\(\s*[a-z0-9_"` + "`" + `]+\s*\)`)
+	retrySetRegex      = regexp.MustCompile(`(?is)\b(?:set|on\s+duplicate\s+key\s+update)\b(.*?)(?:\bwhere\b|\breturning\b|\bfrom\b|\blimit\b|\border\s+by\b|$)`)
+	retryLimitRegex    = regexp.MustCompile(`(?i)\blimit\b`)
+	retryConflictRegex = regexp.MustCompile(`(?i)^insert\s+or\s+(?:ignore|replace)\b|\bon\s+conflict\b|\bon\s+duplicate\s+key\b`)
+	retryWriteRegex    = regexp.MustCompile(`(?i)\b(?:insert|update|delete)\b`)
+	retryIfRegex       = regexp.MustCompile(`(?i)\bif\s+(?:not\s+)?exists\b`)
+	retryWordRegex     = regexp.MustCompile(`[a-z0-9_]+`)
+)
+
+// ClassifyStatement tells the kind of the statement and if running it twice is the same as once
+func ClassifyStatement(query string) StatementClass {
+	// literals may contain any word
+	q := strings.TrimSpace(retryLiteralRegex.ReplaceAllString(query, "''"))
+	fields := strings.Fields(q)
+	if len(fields) == 0 {
+		return StatementClass{Kind: STATEMENT_KIND_OTHER, Reason: "empty statement"}
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "SHOW", "EXPLAIN", "PRAGMA", "VALUES":
+		return StatementClass{Kind: STATEMENT_KIND_READ, Idempotent: true, Reason: "reads only"}
+	case "WITH":
+		if retryWriteRegex.MatchString(q) {
+			return StatementClass{Kind: STATEMENT_KIND_OTHER, Reason: "writes in a WITH query are not classified"}
+		}
+		return StatementClass{Kind: STATEMENT_KIND_READ, Idempotent: true, Reason: "reads only"}
+	case "REPLACE", "UPSERT":
+		return upsertClass(q)
+	case "INSERT":
+		if retryConflictRegex.MatchString(q) {
+			return upsertClass(q)
+		}
+		return StatementClass{Kind: STATEMENT_KIND_INSERT, Reason: "a repeat inserts the rows again unless a unique key refuses them"}
+	case "UPDATE":
+		if retryLimitRegex.MatchString(q) {
+			return StatementClass{Kind: STATEMENT_KIND_UPDATE, Reason: "with LIMIT a repeat may change other rows"}
+		}
+		if column := relativeAssignment(q); column != "" {
+			return StatementClass{Kind: STATEMENT_KIND_UPDATE, Reason: "the new value of " + column + " depends on its old value"}
+		}
+		return StatementClass{Kind: STATEMENT_KIND_UPDATE, Idempotent: true, Reason: "a repeat sets the same values"}
+	case "DELETE":
+		if retryLimitRegex.MatchString(q) {
+			return StatementClass{Kind: STATEMENT_KIND_DELETE, Reason: "with LIMIT a repeat may delete other rows"}
+		}
+		return StatementClass{Kind: STATEMENT_KIND_DELETE, Idempotent: true, Reason: "a repeat finds nothing more to delete"}
+	case "CREATE", "DROP":
+		if retryIfRegex.MatchString(q) {
+			return StatementClass{Kind: STATEMENT_KIND_DDL, Idempotent: true, Reason: "IF [NOT] EXISTS makes a repeat a no-op"}
+		}
+		return StatementClass{Kind: STATEMENT_KIND_DDL, Reason: "a repeat fails, the object was already created or dropped"}
+	case "ALTER", "TRUNCATE", "RENAME":
+		return StatementClass{Kind: STATEMENT_KIND_DDL, Reason: "a repeat fails or changes the schema again"}
+	}
+	return StatementClass{Kind: STATEMENT_KIND_OTHER, Reason: "unknown statement"}
+}
+
+// ClassifyStatements classifies the statements in request order
+func ClassifyStatements(statements []string) []StatementClass {
+	classes := make([]StatementClass, len(statements))
+	for i, s := range statements {
+		classes[i] = ClassifyStatement(s)
+		classes[i].Statement = i + 1
+	}
+	return classes
+}
+
+// upsertClass is the class of an insert with a conflict clause, idempotent unless its update is relative
+func upsertClass(q string) StatementClass {
+	if column := relativeAssignment(q); column != "" {
+		return StatementClass{Kind: STATEMENT_KIND_UPSERT, Reason: "the new value of " + column + " depends on its old value"}
+	}
+	return StatementClass{Kind: STATEMENT_KIND_UPSERT, Idempotent: true, Reason: "the conflict clause makes a repeat write the same row"}
+}
+
+// relativeAssignment is the first column of a SET (or ON DUPLICATE KEY UPDATE) whose value uses the column
+// itself, like count = count + 1. The new values of an upsert (excluded.x, VALUES(x)) are not the old one.
+func relativeAssignment(q string) string {
+	q = strings.ToLower(retryExcludedRegex.ReplaceAllString(q, "''"))
+	for _, m := range retrySetRegex.FindAllStringSubmatch(q, -1) {
+		for _, assignment := range splitTopLevel(m[1]) {
+			eq := strings.Index(assignment, "=")
+			if eq < 0 {
+				continue
+			}
+			used := make(map[string]bool)
+			for _, word := range retryWordRegex.FindAllString(assignment[eq+1:], -1) {
+				used[word] = true
+			}
+			// the column is the last word of t.column
+			columns := retryWordRegex.FindAllString(assignment[:eq], -1)
+			for i := len(columns) - 1; i >= 0; i-- {
+				if used[columns[i]] {
+					return columns[i]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// splitTopLevel splits at the commas outside parentheses
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// batchIdempotent tells if every statement of the batch is, a batch is run again as a whole
+func batchIdempotent(ps []orm.ParametereizedSQL) bool {
+	for _, p := range ps {
+		if !ClassifyStatement(p.Query).Idempotent {
+			return false
+		}
+	}
+	return true
+}
+
+// IsConnectionLost tells if the connection broke while the statement ran, the DBMS may or may not have
+// applied it: SQLSTATE 40003 (statement completion unknown), class 08 (connection exception), an
+// unexpected end of the stream or a network error
+func IsConnectionLost(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		code := state.SQLState()
+		return code == "40003" || strings.HasPrefix(code, "08")
+	}
+	var netErr *net.OpError
+	return errors.As(err, &netErr)
+}
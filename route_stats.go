@@ -0,0 +1,90 @@
+package suresql
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per-route statistics: requests, errors and latency of every route of the data API, recorded by the
+// server middleware and reported by /db/api/status. Like NodeMetrics recording is atomic only, a route
+// is added once. The routes are capped, requests to more distinct paths (ie: scanners) count as other.
+
+const (
+	ROUTE_STATS_MAX   = 256
+	ROUTE_STATS_OTHER = "other"
+)
+
+// RouteStat is what a route served since the start, errors are the responses with status 400 and up
+type RouteStat struct {
+	Route    string  `json:"route"` // method and path, ie: POST /db/api/query
+	Requests uint64  `json:"requests"`
+	Errors   uint64  `json:"errors"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+}
+
+type routeCounter struct {
+	requests    uint64
+	errors      uint64
+	totalMicros uint64
+	maxMicros   uint64
+}
+
+var (
+	routeCounters sync.Map // route: *routeCounter
+	routeCount    int64
+)
+
+// RecordRoute counts a request of the route with its response status and duration
+func RecordRoute(route string, status int, d time.Duration) {
+	c := routeCounterOf(route)
+	atomic.AddUint64(&c.requests, 1)
+	if status >= 400 {
+		atomic.AddUint64(&c.errors, 1)
+	}
+	micros := uint64(d.Microseconds())
+	atomic.AddUint64(&c.totalMicros, micros)
+	for {
+		max := atomic.LoadUint64(&c.maxMicros)
+		if micros <= max || atomic.CompareAndSwapUint64(&c.maxMicros, max, micros) {
+			break
+		}
+	}
+}
+
+func routeCounterOf(route string) *routeCounter {
+	if c, ok := routeCounters.Load(route); ok {
+		return c.(*routeCounter)
+	}
+	if atomic.LoadInt64(&routeCount) >= ROUTE_STATS_MAX {
+		route = ROUTE_STATS_OTHER
+	}
+	c, loaded := routeCounters.LoadOrStore(route, &routeCounter{})
+	if !loaded && route != ROUTE_STATS_OTHER {
+		atomic.AddInt64(&routeCount, 1)
+	}
+	return c.(*routeCounter)
+}
+
+// GetRouteStats returns the statistics of every route, sorted by route
+func GetRouteStats() []RouteStat {
+	stats := []RouteStat{}
+	routeCounters.Range(func(key, value interface{}) bool {
+		c := value.(*routeCounter)
+		stat := RouteStat{
+			Route:    key.(string),
+			Requests: atomic.LoadUint64(&c.requests),
+			Errors:   atomic.LoadUint64(&c.errors),
+			MaxMs:    float64(atomic.LoadUint64(&c.maxMicros)) / 1000,
+		}
+		if stat.Requests > 0 {
+			stat.AvgMs = float64(atomic.LoadUint64(&c.totalMicros)) / 1000 / float64(stat.Requests)
+		}
+		stats = append(stats, stat)
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Route < stats[j].Route })
+	return stats
+}
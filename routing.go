@@ -0,0 +1,167 @@
+package suresql
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Routing hints: a read can ask where it is served, header X-SureSQL-Route with one of
+//   prefer-leader   read what the leader has (rqlite consistency weak), no stale reads
+//   prefer-replica  read the copy of this node (consistency none), fast but can be behind. When the
+//                   replica lag suspended reads (replication_lag.go) it is served by the leader instead
+//   node=N          served by node N, the client is redirected there when N is a peer
+// The hints a client may use are set by routing/hints, they are preferences: a node that cannot follow
+// one serves the read the default way and tells which route it took.
+
+const (
+	ROUTE_LEADER  = "prefer-leader"
+	ROUTE_REPLICA = "prefer-replica"
+	ROUTE_NODE    = "node"
+	ROUTE_DEFAULT = "default"
+
+	ROUTE_ALL_HINTS = ROUTE_LEADER + "," + ROUTE_REPLICA + "," + ROUTE_NODE
+)
+
+var (
+	ErrRouteHintInvalid    = medaerror.MedaError{Message: "routing hint must be prefer-leader, prefer-replica or node=<number>"}
+	ErrRouteHintNotAllowed = medaerror.MedaError{Message: "routing hint not allowed by the routing policy"}
+)
+
+// RouteHint is the parsed X-SureSQL-Route of a request
+type RouteHint struct {
+	Kind string // ROUTE_LEADER, ROUTE_REPLICA or ROUTE_NODE, empty for no hint
+	Node int    // node number of ROUTE_NODE
+}
+
+// ParseRouteHint parses the header value, an empty value is no hint
+func ParseRouteHint(value string) (RouteHint, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch {
+	case value == "":
+		return RouteHint{}, nil
+	case value == ROUTE_LEADER, value == ROUTE_REPLICA:
+		return RouteHint{Kind: value}, nil
+	case strings.HasPrefix(value, ROUTE_NODE+"="):
+		n, err := strconv.Atoi(strings.TrimPrefix(value, ROUTE_NODE+"="))
+		if err != nil || n <= 0 {
+			return RouteHint{}, ErrRouteHintInvalid
+		}
+		return RouteHint{Kind: ROUTE_NODE, Node: n}, nil
+	}
+	return RouteHint{}, ErrRouteHintInvalid
+}
+
+// Allowed checks the hint against the policy, setting routing/hints (comma separated, default all,
+// "none" for no hints)
+func (h RouteHint) Allowed() error {
+	if h.Kind == "" {
+		return nil
+	}
+	allowed := ROUTE_ALL_HINTS
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_ROUTING, SETTING_KEY_ROUTING_HINTS); ok && strings.TrimSpace(s.TextValue) != "" {
+		allowed = s.TextValue
+	}
+	for _, a := range strings.Split(allowed, ",") {
+		if strings.EqualFold(strings.TrimSpace(a), h.Kind) {
+			return nil
+		}
+	}
+	return ErrRouteHintNotAllowed
+}
+
+// routeConnections are shared read connections with a fixed consistency, opened on first use. User
+// connections are made with the internal config too, so reading through these changes nothing else.
+var routeConnections = struct {
+	mu  sync.Mutex
+	dbs map[string]SureSQLDB
+}{dbs: map[string]SureSQLDB{}}
+
+// routeConnection returns the read connection of the rqlite consistency level
+func routeConnection(consistency string) (SureSQLDB, error) {
+	routeConnections.mu.Lock()
+	defer routeConnections.mu.Unlock()
+	if db, ok := routeConnections.dbs[consistency]; ok {
+		return db, nil
+	}
+	conf := CurrentNode.GetInternalConfig()
+	conf.Consistency = consistency
+	db, err := NewDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	routeConnections.dbs[consistency] = db
+	return db, nil
+}
+
+// resetRouteConnections drops the read connections, ie: after the node moved to another backend
+func resetRouteConnections() {
+	routeConnections.mu.Lock()
+	defer routeConnections.mu.Unlock()
+	for key, db := range routeConnections.dbs {
+		closeDB(db)
+		delete(routeConnections.dbs, key)
+	}
+}
+
+// RouteRead returns the connection a read with the hint is served by and the route taken. Only rqlite
+// reads at a consistency per connection, on the other DBMS db is returned with the default route.
+func RouteRead(db SureSQLDB, hint RouteHint) (SureSQLDB, string, error) {
+	dbms := strings.ToUpper(strings.TrimSpace(CurrentNode.GetInternalConfig().DBMS))
+	if dbms != "" && dbms != "RQLITE" {
+		return db, ROUTE_DEFAULT, nil
+	}
+	route := hint.Kind
+	switch route {
+	case ROUTE_REPLICA:
+		if ReplicaReadsSuspended() {
+			route = ROUTE_LEADER
+			break
+		}
+		local, err := routeConnection(REPLICATION_LOCAL_CONSISTENCY)
+		return WithFaults(local), route, err
+	case ROUTE_NODE:
+		// node=N reaching this node is served here the default way
+		return db, ROUTE_DEFAULT, nil
+	case "":
+		return db, ROUTE_DEFAULT, nil
+	}
+	leader, err := routeConnection(REPLICATION_LEADER_CONSIST)
+	return WithFaults(leader), route, err
+}
+
+// RouteNodeURL is the base URL of the peer a node=N hint goes to, empty when N is this node or not a peer.
+// Peers without a scheme or port in the nodes setting get the ones of this node.
+func RouteNodeURL(hint RouteHint) string {
+	if hint.Kind != ROUTE_NODE || hint.Node == CurrentNode.Config.NodeNumber {
+		return ""
+	}
+	peer, ok := CurrentNode.GetStatus().Peers[hint.Node]
+	if !ok {
+		return ""
+	}
+	return PeerBaseURL(peer)
+}
+
+// PeerBaseURL is the base URL of the SureSQL server of a peer in the nodes setting, empty without an address
+func PeerBaseURL(peer orm.StatusStruct) string {
+	if peer.URL == "" {
+		return ""
+	}
+	url := strings.TrimSuffix(peer.URL, "/")
+	if strings.Contains(url, "://") {
+		return url
+	}
+	if _, _, err := net.SplitHostPort(url); err != nil && CurrentNode.Config.Port != "" {
+		url = net.JoinHostPort(url, CurrentNode.Config.Port)
+	}
+	if CurrentNode.Config.SSL {
+		return "https://" + url
+	}
+	return "http://" + url
+}
@@ -0,0 +1,433 @@
+package suresql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	orm "github.com/medatechnology/simpleorm"
+	"github.com/medatechnology/simpleorm/rqlite"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Row sets: a large SELECT is kept as a RowSet, the column names once and a slice of values per row,
+// instead of a map per row. rqlite answers columnar already and its rows are kept as decoded, the
+// database/sql backends (SQLDatabase) scan into blocks of values with the conversion of every column chosen once. A row
+// set is written to JSON exactly as its records would be (so ETags do not change) without building them,
+// Records builds them for the code that works on maps. Other backends answer with records,
+// ErrRowSetUnsupported tells the caller to use them. See BenchmarkQueryRecords and BenchmarkQueryRowSet.
+
+// SCAN_BLOCK_ROWS rows of scanned values share one allocation
+const SCAN_BLOCK_ROWS = 256
+
+var ErrRowSetUnsupported = medaerror.MedaError{Message: "the backend has no row set reads"}
+
+// RowSet is the result of a select, Rows[i][j] is the value of Columns[j] in row i
+type RowSet struct {
+	Table   string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// Len is the number of rows
+func (r *RowSet) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.Rows)
+}
+
+// Records builds the records of the rows
+func (r *RowSet) Records() orm.DBRecords {
+	records := make(orm.DBRecords, r.Len())
+	for i, row := range r.Rows {
+		data := make(map[string]interface{}, len(r.Columns))
+		for j, column := range r.Columns {
+			if j < len(row) {
+				data[column] = row[j]
+			}
+		}
+		records[i] = orm.DBRecord{TableName: r.Table, Data: data}
+	}
+	return records
+}
+
+// RenameColumns gives the columns the names of the fields they match without case, the DBMS may answer
+// with another case than the request asked
+func (r *RowSet) RenameColumns(fields []string) {
+	for i, column := range r.Columns {
+		for _, field := range fields {
+			if column != field && equalFoldASCII(column, field) {
+				r.Columns[i] = field
+				break
+			}
+		}
+	}
+}
+
+func equalFoldASCII(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		ca, cb := a[i], b[i]
+		if 'A' <= ca && ca <= 'Z' {
+			ca += 'a' - 'A'
+		}
+		if 'A' <= cb && cb <= 'Z' {
+			cb += 'a' - 'A'
+		}
+		if ca != cb {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalJSON writes the rows as the JSON of their records: [{"TableName": ..., "Data": {...}}, ...], the
+// columns sorted like encoding/json sorts map keys
+func (r *RowSet) MarshalJSON() ([]byte, error) {
+	if r.Len() == 0 {
+		return []byte("[]"), nil
+	}
+	e := newRowEncoder(r.Table, r.Columns)
+	buf := make([]byte, 0, len(r.Rows)*(len(e.prefix)+len(e.keys)*24))
+	buf = append(buf, '[')
+	var err error
+	for i, row := range r.Rows {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if buf, err = e.appendRow(buf, row); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, ']'), nil
+}
+
+// rowEncoder writes rows of the columns as the JSON of their records
+type rowEncoder struct {
+	prefix  []byte
+	keys    [][]byte // "name": of every name
+	columns [][]int  // the columns of every name, a repeated name has the value of its last column in the row
+	order   []int    // the names sorted
+}
+
+func newRowEncoder(table string, columns []string) *rowEncoder {
+	e := &rowEncoder{prefix: append(append([]byte(`{"TableName":`), appendJSONString(nil, table)...), `,"Data":{`...)}
+	index := make(map[string]int, len(columns))
+	var names []string
+	for j, column := range columns {
+		k, ok := index[column]
+		if !ok {
+			k = len(names)
+			index[column] = k
+			names = append(names, column)
+			e.keys = append(e.keys, append(appendJSONString(nil, column), ':'))
+			e.columns = append(e.columns, nil)
+		}
+		e.columns[k] = append(e.columns[k], j)
+	}
+	e.order = make([]int, len(names))
+	for k := range e.order {
+		e.order[k] = k
+	}
+	sort.Slice(e.order, func(a, b int) bool { return names[e.order[a]] < names[e.order[b]] })
+	return e
+}
+
+// appendRow appends the record of the row
+func (e *rowEncoder) appendRow(buf []byte, row []interface{}) ([]byte, error) {
+	buf = append(buf, e.prefix...)
+	first := true
+	var err error
+	for _, k := range e.order {
+		j := -1
+		for _, c := range e.columns[k] {
+			if c < len(row) {
+				j = c
+			}
+		}
+		if j < 0 {
+			continue
+		}
+		if !first {
+			buf = append(buf, ',')
+		}
+		first = false
+		buf = append(buf, e.keys[k]...)
+		if buf, err = appendJSONValue(buf, row[j]); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, '}', '}'), nil
+}
+
+// appendJSONValue appends v as encoding/json writes it, the types the drivers return without reflection
+func appendJSONValue(buf []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case string:
+		return appendJSONString(buf, x), nil
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, medaerror.Errorf("json: unsupported value: %v", x)
+		}
+		// the format of encoding/json: exponent below 1e-6 and from 1e21, e-09 written as e-9
+		format := byte('f')
+		if abs := math.Abs(x); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+			format = 'e'
+		}
+		buf = strconv.AppendFloat(buf, x, format, -1, 64)
+		if format == 'e' {
+			if n := len(buf); n >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+				buf[n-2] = buf[n-1]
+				buf = buf[:n-1]
+			}
+		}
+		return buf, nil
+	case int64:
+		return strconv.AppendInt(buf, x, 10), nil
+	case int:
+		return strconv.AppendInt(buf, int64(x), 10), nil
+	case bool:
+		return strconv.AppendBool(buf, x), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, b...), nil
+}
+
+// appendJSONString appends s quoted as encoding/json does, with HTML characters escaped
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch c {
+			case '\\', '"':
+				buf = append(buf, '\\', c)
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+// HasRowSets tells if QueryRowSet reads from the backend of db
+func HasRowSets(db SureSQLDB) bool {
+	backend, _ := rowSetBackend(db)
+	return backend != nil
+}
+
+// rowSetBackend is the connection row sets are read from, *rqlite.RQLiteDirectDB or *SQLDatabase, nil when
+// db has none. faulty tells if the driver faults of db apply.
+func rowSetBackend(db SureSQLDB) (backend SureSQLDB, faulty bool) {
+	switch d := db.(type) {
+	case faultyDB:
+		backend, _ = rowSetBackend(d.SureSQLDB)
+		return backend, true
+	case serializedDB:
+		return d.RQLiteDirectDB, false
+	case *ClickHouseDatabase:
+		return d.SQLDatabase, false
+	case *rqlite.RQLiteDirectDB, *SQLDatabase:
+		return db, false
+	}
+	return nil, false
+}
+
+// rowSetTable names the records of a select with an empty table as the backend names the records of a
+// parameterized select: the table after FROM, upper case on rqlite
+func rowSetTable(backend SureSQLDB, table, query string) string {
+	if table != "" {
+		return table
+	}
+	if _, ok := backend.(*rqlite.RQLiteDirectDB); ok {
+		return strings.ToUpper(sqlTableName(query))
+	}
+	return sqlTableName(query)
+}
+
+// QueryRowSet runs the select on db into a row set, its records are named table, or as the backend names
+// them when empty. No rows is an empty row set, ErrRowSetUnsupported when the backend has no row set reads.
+func QueryRowSet(db SureSQLDB, table string, p orm.ParametereizedSQL) (*RowSet, error) {
+	backend, faulty := rowSetBackend(db)
+	if backend == nil {
+		return nil, ErrRowSetUnsupported
+	}
+	if faulty {
+		if err := InjectFault(FAULT_TARGET_DRIVER); err != nil {
+			return nil, err
+		}
+	}
+	table = rowSetTable(backend, table, p.Query)
+	if r, ok := backend.(*rqlite.RQLiteDirectDB); ok {
+		return rqliteQueryRowSet(r, table, p)
+	}
+	return backend.(*SQLDatabase).queryRowSet(table, p.Query, p.Values...)
+}
+
+// rqliteQueryRowSet sends the select to /db/query at the consistency of the connection, the values arrays
+// of the answer are the rows
+func rqliteQueryRowSet(db *rqlite.RQLiteDirectDB, table string, p orm.ParametereizedSQL) (*RowSet, error) {
+	resp, err := rqliteQuery(db, p)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Results []struct {
+			Columns []string        `json:"columns"`
+			Values  [][]interface{} `json:"values"`
+			Error   string          `json:"error"`
+		} `json:"results"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if out.Error != "" {
+		return nil, medaerror.NewString(out.Error)
+	}
+	if len(out.Results) == 0 {
+		return nil, medaerror.NewString("no results returned")
+	}
+	if out.Results[0].Error != "" {
+		return nil, medaerror.Errorf("query error: %s", out.Results[0].Error)
+	}
+	return &RowSet{Table: table, Columns: out.Results[0].Columns, Rows: out.Results[0].Values}, nil
+}
+
+// rqliteQuery posts the select to /db/query through the client of the connection, the caller closes the body
+func rqliteQuery(db *rqlite.RQLiteDirectDB, p orm.ParametereizedSQL) (*http.Response, error) {
+	body, err := json.Marshal([][]interface{}{append([]interface{}{p.Query}, p.Values...)})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := db.Config.URL + "/db/query"
+	if db.Config.Consistency != "" {
+		endpoint += "?level=" + url.QueryEscape(db.Config.Consistency)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if db.Config.Username != "" || db.Config.Password != "" {
+		req.SetBasicAuth(db.Config.Username, db.Config.Password)
+	}
+	resp, err := db.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, medaerror.Errorf("rqlite query returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// queryRowSet runs one statement into a row set, retried like query
+func (s *SQLDatabase) queryRowSet(table, query string, args ...interface{}) (*RowSet, error) {
+	var set *RowSet
+	err := s.retry(true, func() error {
+		ctx, cancel := s.context()
+		defer cancel()
+		rows, err := s.DB.QueryContext(ctx, s.sql(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		set, err = scanRowSet(rows, table)
+		return err
+	})
+	return set, err
+}
+
+// scanRowSet reads all rows, numbers become int64/float64 and text a string. The rows are scanned into one
+// buffer and copied into blocks of SCAN_BLOCK_ROWS rows.
+func scanRowSet(rows *sql.Rows, table string) (*RowSet, error) {
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	n := len(columns)
+	set := &RowSet{Table: table, Columns: make([]string, n)}
+	kinds := make([]int, n)
+	for i, c := range columns {
+		set.Columns[i] = c.Name()
+		kinds[i] = sqlColumnKind(c.DatabaseTypeName())
+	}
+	scanned := make([]interface{}, n)
+	ptrs := make([]interface{}, n)
+	for i := range scanned {
+		ptrs[i] = &scanned[i]
+	}
+	var block []interface{}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		if len(block) < n {
+			block = make([]interface{}, n*SCAN_BLOCK_ROWS)
+		}
+		row := block[:n:n]
+		block = block[n:]
+		for i, v := range scanned {
+			row[i] = convertSQLValue(v, kinds[i])
+			scanned[i] = nil
+		}
+		set.Rows = append(set.Rows, row)
+	}
+	return set, rows.Err()
+}
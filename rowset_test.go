@@ -0,0 +1,163 @@
+package suresql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	orm "github.com/medatechnology/simpleorm"
+	"github.com/medatechnology/simpleorm/rqlite"
+)
+
+// rqliteServer answers every /db/query with the rows
+func rqliteServer(columns []string, rows [][]interface{}) *httptest.Server {
+	body, _ := json.Marshal(map[string]interface{}{
+		"results": []map[string]interface{}{{"columns": columns, "values": rows}},
+	})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+}
+
+func TestRowSetJSON(t *testing.T) {
+	columns := []string{"id", "name", "score", "note", "name", "active"}
+	rows := [][]interface{}{
+		{1, "a<b>&c", 1e21, "line\nbreak\b\f\x01", "last", true},
+		{9007199254740993, "\xff ", 0.000001, nil, "x", false},
+		{-3, "ü", 1.5e-7, "\"q\"\\", "y", nil},
+		{4, "short"},
+	}
+	srv := rqliteServer(columns, rows)
+	defer srv.Close()
+	db, err := rqlite.NewDatabase(rqlite.RqliteDirectConfig{URL: srv.URL, RetryCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := orm.ParametereizedSQL{Query: "SELECT * FROM scores WHERE id > ?", Values: []interface{}{0}}
+
+	records, err := db.SelectOneSQLParameterized(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := QueryRowSet(db, "", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(records)
+	got, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("row set JSON\n%s\nrecords JSON\n%s", got, want)
+	}
+	if again, _ := json.Marshal(set.Records()); !bytes.Equal(again, want) {
+		t.Fatalf("records of the row set\n%s\nwant\n%s", again, want)
+	}
+	if empty, _ := json.Marshal(&RowSet{}); string(empty) != "[]" {
+		t.Fatalf("no rows gave %s", empty)
+	}
+}
+
+// Large selects read as records against row sets, from a canned rqlite answer of 10000 rows:
+// go test -run '^$' -bench 'Query(Records|RowSet)' -benchmem .
+
+func BenchmarkQueryRecords(b *testing.B) {
+	benchQuery(b, func(db *rqlite.RQLiteDirectDB, p orm.ParametereizedSQL) (interface{}, error) {
+		return db.SelectOneSQLParameterized(p)
+	})
+}
+
+func BenchmarkQueryRowSet(b *testing.B) {
+	benchQuery(b, func(db *rqlite.RQLiteDirectDB, p orm.ParametereizedSQL) (interface{}, error) {
+		return QueryRowSet(db, "", p)
+	})
+}
+
+func benchQuery(b *testing.B, query func(*rqlite.RQLiteDirectDB, orm.ParametereizedSQL) (interface{}, error)) {
+	rows := make([][]interface{}, 10000)
+	for i := range rows {
+		rows[i] = []interface{}{i, fmt.Sprint("user", i), fmt.Sprintf("user%d@example.com", i), i % 90, float64(i) / 7, i%2 == 0}
+	}
+	srv := rqliteServer([]string{"id", "name", "email", "age", "balance", "active"}, rows)
+	defer srv.Close()
+	db, err := rqlite.NewDatabase(rqlite.RqliteDirectConfig{URL: srv.URL, RetryCount: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := orm.ParametereizedSQL{Query: "SELECT * FROM users"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := query(db, p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := json.Marshal(result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStreamRecords(t *testing.T) {
+	columns := []string{"id", "name"}
+	rows := [][]interface{}{{1, "a<b"}, {2, nil}, {3, "c"}}
+	srv := rqliteServer(columns, rows)
+	defer srv.Close()
+	db, err := rqlite.NewDatabase(rqlite.RqliteDirectConfig{URL: srv.URL, RetryCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := orm.ParametereizedSQL{Query: "SELECT id, name FROM users"}
+	records, err := db.SelectOneSQLParameterized(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	for _, rec := range records {
+		json.NewEncoder(&want).Encode(rec)
+	}
+	var got bytes.Buffer
+	n, err := StreamRecords(db, "", p, &got)
+	if err != nil || n != len(rows) {
+		t.Fatalf("streamed %d records: %v", n, err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("streamed\n%s\nwant\n%s", got.String(), want.String())
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"error":"no such table: users"}]}`))
+	}))
+	defer failing.Close()
+	db.Config.URL = failing.URL
+	if _, err := StreamRecords(db, "", p, &got); err == nil {
+		t.Fatal("the error of the result was not returned")
+	}
+}
+
+func TestSelectLimited(t *testing.T) {
+	srv := rqliteServer([]string{"id"}, [][]interface{}{{1}, {2}, {3}})
+	defer srv.Close()
+	db, err := rqlite.NewDatabase(rqlite.RqliteDirectConfig{URL: srv.URL, RetryCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := orm.ParametereizedSQL{Query: "SELECT id FROM users"}
+	all, err := db.SelectOneSQLParameterized(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := SelectLimited(db, p, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(limited, []orm.DBRecord(all[:2])) {
+		t.Fatalf("got %v, want %v", limited, all[:2])
+	}
+}
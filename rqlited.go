@@ -0,0 +1,426 @@
+package suresql
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Embedded rqlite: with RQLITED_EMBED=true SureSQL runs rqlited itself, so one binary is a complete
+// single node deployment. The binary is RQLITED_BINARY, else rqlited in the PATH, else the one in
+// RQLITED_BIN_DIR, else release RQLITED_VERSION is downloaded there (RQLITED_SHA256 checks it). With
+// DBMS_USERNAME set an auth.json giving that user every permission is written to the data directory.
+// RQLITED_JOIN (and RQLITED_BOOTSTRAP_EXPECT) make it join or form a cluster. The process is restarted
+// when it exits, waiting twice as long each time up to a minute, and stopped with SureSQL. An rqlited
+// already answering on RQLITED_HTTP_ADDR is used as it is, ie: left over from a SureSQL that was killed.
+
+const (
+	RQLITED_ENV_PREFIX       = "RQLITED_"
+	RQLITED_DEFAULT_HTTP     = "127.0.0.1:4001"
+	RQLITED_DEFAULT_RAFT     = "127.0.0.1:4002"
+	RQLITED_DEFAULT_DATA_DIR = "rqlite-data"
+	RQLITED_DEFAULT_BIN_DIR  = "rqlite-bin"
+	RQLITED_DEFAULT_VERSION  = "8.36.5"
+	RQLITED_RELEASE_URL      = "https://github.com/rqlite/rqlite/releases/download/v%s/rqlite-v%s-%s-%s.tar.gz"
+	RQLITED_AUTH_FILE        = "auth.json"
+
+	RQLITED_READY_TIMEOUT = time.Minute
+	RQLITED_MIN_BACKOFF   = time.Second
+	RQLITED_MAX_BACKOFF   = time.Minute
+	RQLITED_STOP_GRACE    = 10 * time.Second
+
+	INTEGRATION_RQLITED = "rqlited" // release download
+)
+
+var (
+	ErrRqlitedNotFound = medaerror.MedaError{Message: "rqlited binary not found and cannot be downloaded"}
+	ErrRqlitedNotReady = medaerror.MedaError{Message: "embedded rqlited did not become ready"}
+)
+
+// EmbeddedRqliteConfig is read from RQLITED_*
+type EmbeddedRqliteConfig struct {
+	Enabled         bool
+	Binary          string
+	BinDir          string
+	Version         string
+	SHA256          string
+	DataDir         string
+	HTTPAddr        string
+	RaftAddr        string
+	NodeID          string
+	Join            string
+	BootstrapExpect int
+	Args            string // more flags, space separated
+}
+
+// EmbeddedRqliteStatus is the state of the supervised process
+type EmbeddedRqliteStatus struct {
+	Enabled   bool       `json:"enabled"`
+	Adopted   bool       `json:"adopted,omitempty"` // an rqlited was already running, not supervised
+	Binary    string     `json:"binary,omitempty"`
+	HTTPAddr  string     `json:"http_addr,omitempty"`
+	PID       int        `json:"pid,omitempty"`
+	Running   bool       `json:"running"`
+	Restarts  int        `json:"restarts"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	LastExit  string     `json:"last_exit,omitempty"`
+}
+
+// EmbeddedRqlite supervises the rqlited process
+type EmbeddedRqlite struct {
+	mu       sync.Mutex
+	conf     EmbeddedRqliteConfig
+	cmd      *exec.Cmd
+	status   EmbeddedRqliteStatus
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+}
+
+var (
+	Rqlited         *EmbeddedRqlite
+	rqlitedInitOnce sync.Once
+)
+
+// LoadEmbeddedRqliteConfig reads RQLITED_*
+func LoadEmbeddedRqliteConfig() EmbeddedRqliteConfig {
+	return EmbeddedRqliteConfig{
+		Enabled:         utils.GetEnvBool(RQLITED_ENV_PREFIX+"EMBED", false),
+		Binary:          utils.GetEnvString(RQLITED_ENV_PREFIX+"BINARY", ""),
+		BinDir:          utils.GetEnvString(RQLITED_ENV_PREFIX+"BIN_DIR", RQLITED_DEFAULT_BIN_DIR),
+		Version:         strings.TrimPrefix(utils.GetEnvString(RQLITED_ENV_PREFIX+"VERSION", RQLITED_DEFAULT_VERSION), "v"),
+		SHA256:          utils.GetEnvString(RQLITED_ENV_PREFIX+"SHA256", ""),
+		DataDir:         utils.GetEnvString(RQLITED_ENV_PREFIX+"DATA_DIR", RQLITED_DEFAULT_DATA_DIR),
+		HTTPAddr:        utils.GetEnvString(RQLITED_ENV_PREFIX+"HTTP_ADDR", RQLITED_DEFAULT_HTTP),
+		RaftAddr:        utils.GetEnvString(RQLITED_ENV_PREFIX+"RAFT_ADDR", RQLITED_DEFAULT_RAFT),
+		NodeID:          utils.GetEnvString(RQLITED_ENV_PREFIX+"NODE_ID", ""),
+		Join:            utils.GetEnvString(RQLITED_ENV_PREFIX+"JOIN", ""),
+		BootstrapExpect: utils.GetEnvInt(RQLITED_ENV_PREFIX+"BOOTSTRAP_EXPECT", 0),
+		Args:            utils.GetEnvString(RQLITED_ENV_PREFIX+"ARGS", ""),
+	}
+}
+
+// InitEmbeddedRqlite initializes the global supervisor from the environment
+func InitEmbeddedRqlite() {
+	rqlitedInitOnce.Do(func() {
+		conf := LoadEmbeddedRqliteConfig()
+		Rqlited = &EmbeddedRqlite{conf: conf, stopChan: make(chan struct{})}
+		Rqlited.status.Enabled, Rqlited.status.HTTPAddr = conf.Enabled, conf.HTTPAddr
+	})
+}
+
+// StartEmbeddedRqlite starts rqlited when RQLITED_EMBED is set and waits until it is ready
+func StartEmbeddedRqlite(ctx context.Context) error {
+	if Rqlited == nil {
+		InitEmbeddedRqlite()
+	}
+	return Rqlited.Start(ctx)
+}
+
+// StopEmbeddedRqlite stops the supervised rqlited
+func StopEmbeddedRqlite() {
+	if Rqlited != nil {
+		Rqlited.Stop()
+	}
+}
+
+// EmbeddedDBMSConfig points the DBMS config at the embedded rqlited when DBMS_HOST is not set
+func EmbeddedDBMSConfig(conf SureSQLDBMSConfig) SureSQLDBMSConfig {
+	if Rqlited == nil || !Rqlited.conf.Enabled || conf.Host != "" {
+		return conf
+	}
+	conf.DBMS = "RQLITE"
+	host, port, _ := strings.Cut(Rqlited.conf.HTTPAddr, ":")
+	conf.Host, conf.Port = host, port
+	return conf
+}
+
+// Start prepares the binary and the auth file, starts the process and waits until it answers /readyz
+func (e *EmbeddedRqlite) Start(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.conf.Enabled || e.running {
+		e.mu.Unlock()
+		return nil
+	}
+	e.running = true
+	e.mu.Unlock()
+
+	if rqlitedReady(e.conf.HTTPAddr) {
+		simplelog.LogFormat("rqlited: already running on %s, using it as it is", e.conf.HTTPAddr)
+		e.mu.Lock()
+		e.status.Adopted, e.status.Running = true, true
+		e.mu.Unlock()
+		return nil
+	}
+	binary, err := e.locateBinary()
+	if err != nil {
+		return err
+	}
+	args, err := e.arguments()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.status.Binary = binary
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go e.supervise(ctx, binary, args)
+
+	deadline := time.Now().Add(RQLITED_READY_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if rqlitedReady(e.conf.HTTPAddr) {
+			simplelog.LogFormat("rqlited: ready on %s", e.conf.HTTPAddr)
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return ErrRqlitedNotReady
+}
+
+// supervise runs the process and starts it again when it exits, until Stop
+func (e *EmbeddedRqlite) supervise(ctx context.Context, binary string, args []string) {
+	defer e.wg.Done()
+	backoff := RQLITED_MIN_BACKOFF
+	for {
+		started := time.Now()
+		cmd := exec.Command(binary, args...)
+		cmd.Stdout, cmd.Stderr = rqlitedLog{}, rqlitedLog{}
+		err := cmd.Start()
+		if err == nil {
+			now := started.UTC()
+			e.mu.Lock()
+			e.cmd = cmd
+			e.status.PID, e.status.Running, e.status.StartedAt = cmd.Process.Pid, true, &now
+			e.mu.Unlock()
+			err = cmd.Wait()
+		}
+
+		e.mu.Lock()
+		e.cmd = nil
+		exit := "exited"
+		if err != nil {
+			exit = err.Error()
+		}
+		e.status.PID, e.status.Running, e.status.LastExit = 0, false, exit
+		e.mu.Unlock()
+
+		select {
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		// a process that ran a while was healthy, start over from the shortest wait
+		if time.Since(started) > RQLITED_MAX_BACKOFF {
+			backoff = RQLITED_MIN_BACKOFF
+		}
+		simplelog.LogFormat("rqlited: %s, restarting in %s", exit, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-e.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > RQLITED_MAX_BACKOFF {
+			backoff = RQLITED_MAX_BACKOFF
+		}
+		e.mu.Lock()
+		e.status.Restarts++
+		e.mu.Unlock()
+	}
+}
+
+// Stop asks rqlited to shut down and kills it after RQLITED_STOP_GRACE
+func (e *EmbeddedRqlite) Stop() {
+	e.mu.Lock()
+	if !e.running {
+		e.mu.Unlock()
+		return
+	}
+	e.running = false
+	close(e.stopChan)
+	cmd := e.cmd
+	e.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() {
+			e.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(RQLITED_STOP_GRACE):
+			cmd.Process.Kill()
+		}
+	}
+	e.wg.Wait()
+}
+
+// Status returns the state of the process
+func (e *EmbeddedRqlite) Status() EmbeddedRqliteStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+// arguments are the flags of rqlited, the auth file is written first
+func (e *EmbeddedRqlite) arguments() ([]string, error) {
+	c := e.conf
+	if err := os.MkdirAll(c.DataDir, 0700); err != nil {
+		return nil, err
+	}
+	args := []string{"-http-addr", c.HTTPAddr, "-raft-addr", c.RaftAddr}
+	if c.NodeID != "" {
+		args = append(args, "-node-id", c.NodeID)
+	}
+	dbms := LoadDBMSConfigFromEnvironment()
+	if dbms.Username != "" {
+		auth := filepath.Join(c.DataDir, RQLITED_AUTH_FILE)
+		body, _ := json.Marshal([]map[string]interface{}{{"username": dbms.Username, "password": dbms.Password, "perms": []string{"all"}}})
+		if err := os.WriteFile(auth, body, 0600); err != nil {
+			return nil, err
+		}
+		args = append(args, "-auth", auth)
+	}
+	if c.Join != "" {
+		args = append(args, "-join", c.Join)
+		if dbms.Username != "" {
+			args = append(args, "-join-as", dbms.Username)
+		}
+	}
+	if c.BootstrapExpect > 0 {
+		args = append(args, "-bootstrap-expect", fmt.Sprint(c.BootstrapExpect))
+	}
+	args = append(args, strings.Fields(c.Args)...)
+	return append(args, c.DataDir), nil
+}
+
+// locateBinary finds rqlited, downloading the release when it is nowhere
+func (e *EmbeddedRqlite) locateBinary() (string, error) {
+	if e.conf.Binary != "" {
+		return e.conf.Binary, nil
+	}
+	if path, err := exec.LookPath("rqlited"); err == nil {
+		return path, nil
+	}
+	local := filepath.Join(e.conf.BinDir, "rqlited")
+	if _, err := os.Stat(local); err == nil {
+		return local, nil
+	}
+	if err := downloadRqlited(e.conf, local); err != nil {
+		simplelog.LogErrorAny("rqlited", err, "cannot download rqlited "+e.conf.Version)
+		return "", ErrRqlitedNotFound
+	}
+	return local, nil
+}
+
+// downloadRqlited fetches the release archive of this platform and extracts rqlited to target
+func downloadRqlited(c EmbeddedRqliteConfig, target string) error {
+	url := fmt.Sprintf(RQLITED_RELEASE_URL, c.Version, c.Version, runtime.GOOS, runtime.GOARCH)
+	simplelog.LogFormat("rqlited: downloading %s", url)
+	resp, err := IntegrationHTTPClient(INTEGRATION_RQLITED, 5*time.Minute).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return medaerror.Errorf("download %s returned %s", url, resp.Status)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if c.SHA256 != "" {
+		sum := sha256.Sum256(archive)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), c.SHA256) {
+			return medaerror.Errorf("download %s does not match RQLITED_SHA256", url)
+		}
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return medaerror.Errorf("no rqlited in %s", url)
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg || filepath.Base(h.Name) != "rqlited" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		tmp := target + ".tmp"
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, target)
+	}
+}
+
+// rqlitedReady tells if rqlited answers /readyz on addr
+func rqlitedReady(addr string) bool {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/readyz", nil)
+	if err != nil {
+		return false
+	}
+	if dbms := LoadDBMSConfigFromEnvironment(); dbms.Username != "" {
+		req.SetBasicAuth(dbms.Username, dbms.Password)
+	}
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// rqlitedLog writes the output of rqlited to the log, line by line
+type rqlitedLog struct{}
+
+func (rqlitedLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			simplelog.LogFormat("rqlited: %s", line)
+		}
+	}
+	return len(p), nil
+}
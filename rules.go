@@ -0,0 +1,412 @@
+package suresql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Trigger-like rules: "when <table> <event> matches <condition> then run <statement> / call <webhook>".
+// Rules are evaluated by SureSQL from the CDC log, so the table must be covered by CDC and every write
+// counts, whether it came from /insert or raw SQL. Rules run after the change is committed (like an
+// AFTER trigger) on the leader node only, each rule keeps its own position in the log.
+//
+// A sql statement can use the changed row as parameters: :new.column and :old.column.
+
+const (
+	RULE_ACTION_SQL     = "sql"
+	RULE_ACTION_WEBHOOK = "webhook"
+
+	RULES_POLL_INTERVAL   = 2 * time.Second
+	RULES_BATCH_SIZE      = 500
+	RULES_WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+var (
+	ErrRuleNotFound = medaerror.MedaError{Message: "rule not found"}
+
+	ruleParamRegex = regexp.MustCompile(`:(new|old)\.([a-zA-Z_][a-zA-Z0-9_]*)`)
+)
+
+// RuleTable is a declarative rule
+type RuleTable struct {
+	ID           int       `json:"id,omitempty"             db:"id"`
+	Name         string    `json:"name"                     db:"name"`
+	TableName_   string    `json:"table_name"               db:"table_name"`
+	Events       string    `json:"events"                   db:"events"`    // comma separated: insert,update,delete
+	Condition    string    `json:"condition,omitempty"      db:"condition"` // JSON orm.Condition on the new row (old row for delete)
+	Action       string    `json:"action"                   db:"action"`    // sql or webhook
+	Statement    string    `json:"statement,omitempty"      db:"statement"`
+	WebhookURL   string    `json:"webhook_url,omitempty"    db:"webhook_url"`
+	Enabled      bool      `json:"enabled"                  db:"enabled"`
+	LastChangeID int       `json:"last_change_id,omitempty" db:"last_change_id"` // last _cdc_log id this rule has seen
+	FiredCount   int       `json:"fired_count,omitempty"    db:"fired_count"`
+	LastFiredAt  time.Time `json:"last_fired_at,omitempty"  db:"last_fired_at"`
+	LastError    string    `json:"last_error,omitempty"     db:"last_error"`
+	UpdatedAt    time.Time `json:"updated_at,omitempty"     db:"updated_at"`
+}
+
+func (r RuleTable) TableName() string {
+	return "_rules"
+}
+
+// RuleEvent is what a webhook rule posts
+type RuleEvent struct {
+	Rule      string                 `json:"rule"`
+	Table     string                 `json:"table"`
+	Op        string                 `json:"op"`
+	Old       map[string]interface{} `json:"old,omitempty"`
+	New       map[string]interface{} `json:"new,omitempty"`
+	ChangedAt string                 `json:"changed_at"`
+}
+
+// Validate checks the rule before it is saved
+func (r RuleTable) Validate() error {
+	if r.Name == "" {
+		return medaerror.NewString("rule name is required")
+	}
+	if _, err := GetCDCTable(r.TableName_); err != nil {
+		return err
+	}
+	events := splitList(r.Events)
+	if len(events) == 0 {
+		return medaerror.NewString("events are required: insert, update and/or delete")
+	}
+	for _, e := range events {
+		e = strings.ToLower(e)
+		if e != CDC_OP_INSERT && e != CDC_OP_UPDATE && e != CDC_OP_DELETE {
+			return medaerror.Errorf("unknown event %q, must be insert, update or delete", e)
+		}
+	}
+	if _, err := r.condition(); err != nil {
+		return err
+	}
+	switch r.Action {
+	case RULE_ACTION_SQL:
+		if strings.TrimSpace(r.Statement) == "" {
+			return medaerror.NewString("statement is required for sql action")
+		}
+	case RULE_ACTION_WEBHOOK:
+		if !strings.HasPrefix(r.WebhookURL, "http://") && !strings.HasPrefix(r.WebhookURL, "https://") {
+			return medaerror.NewString("webhook_url must be an http(s) URL")
+		}
+	default:
+		return medaerror.NewString("action must be sql or webhook")
+	}
+	return nil
+}
+
+// condition parses and validates the rule condition, nil when there is none
+func (r RuleTable) condition() (*orm.Condition, error) {
+	if strings.TrimSpace(r.Condition) == "" {
+		return nil, nil
+	}
+	var c orm.Condition
+	if err := json.Unmarshal([]byte(r.Condition), &c); err != nil {
+		return nil, medaerror.Errorf("condition must be a JSON condition: %s", err.Error())
+	}
+	// same validation as the query endpoint
+	if _, err := BuildSelect(CurrentDialect(), r.TableName_, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r RuleTable) hasEvent(op string) bool {
+	for _, e := range splitList(r.Events) {
+		if strings.ToLower(e) == op {
+			return true
+		}
+	}
+	return false
+}
+
+// ListRules returns all rules
+func ListRules() ([]RuleTable, error) {
+	condition := orm.Condition{OrderBy: []string{"id ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(RuleTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []RuleTable{}, nil
+		}
+		return nil, err
+	}
+	rules := make([]RuleTable, 0, len(records))
+	for _, rec := range records {
+		rules = append(rules, object.MapToStructSlowDB[RuleTable](rec.Data))
+	}
+	return rules, nil
+}
+
+// SaveRule creates (id 0) or updates a rule. A new rule starts at the end of the CDC log, it does not
+// fire for changes made before it existed.
+func SaveRule(r RuleTable) (RuleTable, error) {
+	if err := r.Validate(); err != nil {
+		return r, err
+	}
+	r.UpdatedAt = CurrentClock.Now().UTC()
+	var res orm.BasicSQLResult
+	if r.ID == 0 {
+		last, err := lastCDCChangeID()
+		if err != nil {
+			return r, err
+		}
+		r.LastChangeID = last
+		res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query: "INSERT INTO " + r.TableName() + " (name, table_name, events, condition, action, statement, webhook_url, enabled, last_change_id, updated_at)" +
+				" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			Values: []interface{}{r.Name, r.TableName_, r.Events, r.Condition, r.Action, r.Statement, r.WebhookURL, r.Enabled, r.LastChangeID, r.UpdatedAt},
+		})
+		r.ID = int(res.LastInsertID)
+	} else {
+		res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query: "UPDATE " + r.TableName() + " SET name = ?, table_name = ?, events = ?, condition = ?, action = ?, statement = ?, webhook_url = ?," +
+				" enabled = ?, updated_at = ? WHERE id = ?",
+			Values: []interface{}{r.Name, r.TableName_, r.Events, r.Condition, r.Action, r.Statement, r.WebhookURL, r.Enabled, r.UpdatedAt, r.ID},
+		})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return r, ErrRuleNotFound
+		}
+	}
+	return r, res.Error
+}
+
+// DeleteRule removes a rule by id
+func DeleteRule(id int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + RuleTable{}.TableName() + " WHERE id = ?",
+		Values: []interface{}{id},
+	})
+	return res.Error
+}
+
+func lastCDCChangeID() (int, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectOneSQL("SELECT COALESCE(MAX(id), 0) AS last_id FROM " + CDCChange{}.TableName())
+	if err != nil {
+		if IsNoRowsError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	last, _ := numericValue(records[0].Data["last_id"])
+	return int(last), nil
+}
+
+// changesAfter returns the next changes of the table after the log id, oldest first
+func changesAfter(table string, afterID, limit int) ([]CDCChange, error) {
+	records, err := CurrentNode.GetInternalConnection().SelectOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  fmt.Sprintf("SELECT * FROM %s WHERE table_name = ? AND id > ? ORDER BY id ASC LIMIT %d", CDCChange{}.TableName(), limit),
+		Values: []interface{}{table, afterID},
+	})
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []CDCChange{}, nil
+		}
+		return nil, err
+	}
+	changes := make([]CDCChange, 0, len(records))
+	for _, rec := range records {
+		changes = append(changes, object.MapToStructSlowDB[CDCChange](rec.Data))
+	}
+	return changes, nil
+}
+
+// RunRule evaluates the rule against its pending changes and fires the action for every match.
+// A failing action is recorded in last_error and the rule moves on, rules fire at most once per change.
+func RunRule(r RuleTable) error {
+	cond, err := r.condition()
+	if err != nil {
+		return err
+	}
+	changes, err := changesAfter(r.TableName_, r.LastChangeID, RULES_BATCH_SIZE)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	fired := 0
+	lastErr := ""
+	for _, ch := range changes {
+		if !r.hasEvent(ch.Op) {
+			continue
+		}
+		oldRow, newRow, err := ch.decode()
+		if err != nil {
+			lastErr = err.Error()
+			continue
+		}
+		row := newRow
+		if ch.Op == CDC_OP_DELETE {
+			row = oldRow
+		}
+		ok, err := MatchCondition(cond, row)
+		if err != nil {
+			lastErr = err.Error()
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := r.fire(ch, oldRow, newRow); err != nil {
+			lastErr = fmt.Sprintf("change %d: %s", ch.ID, err.Error())
+			simplelog.LogErrorAny("RuleEngine", err, fmt.Sprintf("rule %s failed on change %d", r.Name, ch.ID))
+			continue
+		}
+		fired++
+	}
+
+	query := "UPDATE " + r.TableName() + " SET last_change_id = ?, fired_count = fired_count + ?, last_error = ?"
+	values := []interface{}{changes[len(changes)-1].ID, fired, lastErr}
+	if fired > 0 {
+		query += ", last_fired_at = ?"
+		values = append(values, CurrentClock.Now().UTC())
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  query + " WHERE id = ?",
+		Values: append(values, r.ID),
+	})
+	return res.Error
+}
+
+func (r RuleTable) fire(ch CDCChange, oldRow, newRow map[string]interface{}) error {
+	if r.Action == RULE_ACTION_WEBHOOK {
+		body, err := json.Marshal(RuleEvent{Rule: r.Name, Table: r.TableName_, Op: ch.Op, Old: oldRow, New: newRow, ChangedAt: ch.ChangedAt})
+		if err != nil {
+			return err
+		}
+		if err := PostWebhook(r.WebhookURL, body, RULES_WEBHOOK_TIMEOUT); err != nil {
+			AddDeadLetter(DEAD_LETTER_SOURCE_WEBHOOK, r.WebhookURL, "", WebhookDelivery{URL: r.WebhookURL, Body: body}, err)
+			return err
+		}
+		return nil
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(RuleStatement(r.Statement, oldRow, newRow))
+	ResultCache.InvalidateStatements([]string{r.Statement})
+	return res.Error
+}
+
+// RuleStatement turns :new.column / :old.column into placeholders with the row values
+func RuleStatement(statement string, oldRow, newRow map[string]interface{}) orm.ParametereizedSQL {
+	var values []interface{}
+	query := ruleParamRegex.ReplaceAllStringFunc(statement, func(m string) string {
+		parts := ruleParamRegex.FindStringSubmatch(m)
+		row := newRow
+		if parts[1] == "old" {
+			row = oldRow
+		}
+		values = append(values, row[parts[2]])
+		return "?"
+	})
+	return orm.ParametereizedSQL{Query: query, Values: values}
+}
+
+// RuleEngine polls the CDC log, runs the enabled rules and refreshes the derived tables
+type RuleEngine struct {
+	mu       sync.Mutex
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+}
+
+var (
+	Rules     *RuleEngine
+	rulesOnce sync.Once
+)
+
+// InitRuleEngine initializes the global rule engine
+func InitRuleEngine() {
+	rulesOnce.Do(func() {
+		Rules = &RuleEngine{stopChan: make(chan struct{})}
+	})
+}
+
+// StartRuleEngine starts the rule engine
+func StartRuleEngine(ctx context.Context) {
+	if Rules == nil {
+		InitRuleEngine()
+	}
+	Rules.Start(ctx)
+}
+
+// StopRuleEngine stops the rule engine
+func StopRuleEngine() {
+	if Rules != nil {
+		Rules.Stop()
+	}
+}
+
+// Start starts polling the CDC log
+func (re *RuleEngine) Start(ctx context.Context) {
+	re.mu.Lock()
+	if re.running {
+		re.mu.Unlock()
+		return
+	}
+	re.running = true
+	re.ticker = CurrentClock.NewTicker(RULES_POLL_INTERVAL)
+	re.mu.Unlock()
+
+	re.wg.Add(1)
+	go func() {
+		defer re.wg.Done()
+		simplelog.LogThis("RuleEngine", "Starting rule engine")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-re.stopChan:
+				return
+			case <-re.ticker.C():
+				re.runAll()
+			}
+		}
+	}()
+}
+
+// Stop stops the rule engine
+func (re *RuleEngine) Stop() {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if !re.running {
+		return
+	}
+	close(re.stopChan)
+	re.wg.Wait()
+	re.ticker.Stop()
+	re.running = false
+	simplelog.LogThis("RuleEngine", "Rule engine stopped")
+}
+
+func (re *RuleEngine) runAll() {
+	if !IsSchedulerLeader() || !FeatureEnabled(FLAG_CDC) {
+		return
+	}
+	rules, err := ListRules()
+	if err != nil {
+		simplelog.LogErrorAny("RuleEngine", err, "cannot list rules")
+		return
+	}
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		if err := RunRule(r); err != nil {
+			simplelog.LogErrorAny("RuleEngine", err, "cannot run rule "+r.Name)
+		}
+	}
+	// derived tables follow the same CDC log
+	RefreshAllDerivedTables()
+}
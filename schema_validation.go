@@ -0,0 +1,332 @@
+package suresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Validation of insert payloads against the live schema, so a bad record is reported with its index and
+// field before anything is written instead of an opaque driver error half way through a batch.
+// Table columns are read from the DBMS (PRAGMA table_info or information_schema) and cached for a short
+// time, a column that is not in the cache is re-checked against a fresh read to follow ALTER TABLE.
+
+const SCHEMA_CACHE_TTL = 30 * time.Second
+
+// Type affinity of a column, from its declared type with the SQLite rules (also fits postgres/mysql names)
+const (
+	AFFINITY_INTEGER = "integer"
+	AFFINITY_REAL    = "real"
+	AFFINITY_TEXT    = "text"
+	AFFINITY_BLOB    = "blob"
+	AFFINITY_BOOL    = "bool"
+	AFFINITY_ANY     = "any"
+)
+
+var ErrTableNotExist = medaerror.MedaError{Message: "table does not exist"}
+
+// TableColumn is a column of the live schema
+type TableColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Affinity   string `json:"affinity"`
+	NotNull    bool   `json:"not_null"`
+	HasDefault bool   `json:"has_default"`
+	PrimaryKey bool   `json:"primary_key"`
+}
+
+// RecordFieldError is a validation error of one field of one record of the request
+type RecordFieldError struct {
+	Record  int    `json:"record"` // index in the request records
+	Table   string `json:"table"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e RecordFieldError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("record %d (%s): %s", e.Record, e.Table, e.Message)
+	}
+	return fmt.Sprintf("record %d (%s.%s): %s", e.Record, e.Table, e.Field, e.Message)
+}
+
+type schemaCacheEntry struct {
+	columns []TableColumn
+	loaded  time.Time
+}
+
+var (
+	schemaCacheMu sync.Mutex
+	schemaCache   = map[string]schemaCacheEntry{}
+)
+
+// TableSchema returns the columns of the table, from cache unless fresh is set
+func TableSchema(table string, fresh bool) ([]TableColumn, error) {
+	if !fresh {
+		schemaCacheMu.Lock()
+		entry, ok := schemaCache[table]
+		schemaCacheMu.Unlock()
+		if ok && time.Since(entry.loaded) < SCHEMA_CACHE_TTL {
+			return entry.columns, nil
+		}
+	}
+	columns, err := loadTableSchema(table)
+	if err != nil {
+		return nil, err
+	}
+	schemaCacheMu.Lock()
+	schemaCache[table] = schemaCacheEntry{columns: columns, loaded: time.Now()}
+	schemaCacheMu.Unlock()
+	return columns, nil
+}
+
+// InvalidateTableSchema drops the cached schema of the table, all tables if empty
+func InvalidateTableSchema(table string) {
+	schemaCacheMu.Lock()
+	defer schemaCacheMu.Unlock()
+	if table == "" {
+		schemaCache = map[string]schemaCacheEntry{}
+		return
+	}
+	delete(schemaCache, table)
+}
+
+func loadTableSchema(table string) ([]TableColumn, error) {
+	if err := ValidateTableName(table, true); err != nil {
+		return nil, err
+	}
+	var query orm.ParametereizedSQL
+	if CurrentDialect().Name == DialectSQLite.Name {
+		query = orm.ParametereizedSQL{Query: "PRAGMA table_info(" + table + ")"}
+	} else {
+		b := NewQueryBuilder(CurrentDialect())
+		query = orm.ParametereizedSQL{
+			Query: "SELECT c.column_name AS name, c.data_type AS type, CASE WHEN c.is_nullable = 'NO' THEN 1 ELSE 0 END AS notnull," +
+				" c.column_default AS dflt_value, CASE WHEN EXISTS (SELECT 1 FROM information_schema.table_constraints tc" +
+				" JOIN information_schema.key_column_usage k ON k.constraint_name = tc.constraint_name AND k.table_schema = tc.table_schema" +
+				" AND k.table_name = tc.table_name WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = c.table_schema" +
+				" AND tc.table_name = c.table_name AND k.column_name = c.column_name) THEN 1 ELSE 0 END AS pk" +
+				" FROM information_schema.columns c WHERE c.table_name = " + b.Arg(table) +
+				" AND c.table_schema = " + schemaFunction() + " ORDER BY c.ordinal_position",
+			Values: b.Args(),
+		}
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectOneSQLParameterized(query)
+	if err != nil && !IsNoRowsError(err) {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrTableNotExist
+	}
+	columns := make([]TableColumn, 0, len(records))
+	for _, rec := range records {
+		name, _ := rec.Data["name"].(string)
+		typ, _ := rec.Data["type"].(string)
+		notNull, _ := numericValue(rec.Data["notnull"])
+		pk, _ := numericValue(rec.Data["pk"])
+		columns = append(columns, TableColumn{
+			Name:       name,
+			Type:       typ,
+			Affinity:   TypeAffinity(typ),
+			NotNull:    notNull != 0,
+			HasDefault: rec.Data["dflt_value"] != nil,
+			PrimaryKey: pk != 0,
+		})
+	}
+	return columns, nil
+}
+
+func schemaFunction() string {
+	if CurrentDialect().Name == DialectMySQL.Name {
+		return "DATABASE()"
+	}
+	return "current_schema()"
+}
+
+// TypeAffinity maps a declared column type to its affinity
+func TypeAffinity(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "BOOL"):
+		return AFFINITY_BOOL
+	case strings.Contains(t, "INT"):
+		return AFFINITY_INTEGER
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return AFFINITY_TEXT
+	case strings.Contains(t, "BLOB"), strings.Contains(t, "BYTEA"):
+		return AFFINITY_BLOB
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"),
+		strings.Contains(t, "NUMERIC"), strings.Contains(t, "DECIMAL"):
+		return AFFINITY_REAL
+	}
+	// dates, json, uuid, ... and untyped columns take anything the driver can convert
+	return AFFINITY_ANY
+}
+
+// ValidateInsertRecords checks every record against the schema of its table and returns all the problems found
+func ValidateInsertRecords(records []orm.DBRecord) []RecordFieldError {
+	var errs []RecordFieldError
+	for i, rec := range records {
+		if err := ValidateTableName(rec.TableName, false); err != nil {
+			errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Message: err.Error()})
+			continue
+		}
+		columns, err := TableSchema(rec.TableName, false)
+		if err != nil {
+			errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Message: err.Error()})
+			continue
+		}
+		if len(rec.Data) == 0 {
+			errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Message: "record has no fields"})
+			continue
+		}
+		// a field we do not know may be a column added since the schema was cached
+		for field := range rec.Data {
+			if findColumn(columns, field) == nil {
+				if fresh, err := TableSchema(rec.TableName, true); err == nil {
+					columns = fresh
+				}
+				break
+			}
+		}
+		errs = append(errs, validateRecord(i, rec, columns, true)...)
+	}
+	return errs
+}
+
+// ValidateUpdateValues checks the new values of an update against the schema of the table, the columns
+// not set keep their value so nothing is required
+func ValidateUpdateValues(table string, values map[string]interface{}) []RecordFieldError {
+	columns, err := TableSchema(table, false)
+	if err != nil {
+		return []RecordFieldError{{Table: table, Message: err.Error()}}
+	}
+	for field := range values {
+		if findColumn(columns, field) == nil {
+			if fresh, err := TableSchema(table, true); err == nil {
+				columns = fresh
+			}
+			break
+		}
+	}
+	return validateRecord(0, orm.DBRecord{TableName: table, Data: values}, columns, false)
+}
+
+func findColumn(columns []TableColumn, name string) *TableColumn {
+	for i := range columns {
+		if strings.EqualFold(columns[i].Name, name) {
+			return &columns[i]
+		}
+	}
+	return nil
+}
+
+// validateRecord checks the fields of the record, with required the NOT NULL columns without default too
+func validateRecord(index int, rec orm.DBRecord, columns []TableColumn, required bool) []RecordFieldError {
+	var errs []RecordFieldError
+	fieldErr := func(field, msg string) {
+		errs = append(errs, RecordFieldError{Record: index, Table: rec.TableName, Field: field, Message: msg})
+	}
+	for field, value := range rec.Data {
+		col := findColumn(columns, field)
+		if col == nil {
+			fieldErr(field, "unknown column")
+			continue
+		}
+		if value == nil {
+			if col.NotNull && !col.PrimaryKey {
+				fieldErr(field, "cannot be null")
+			}
+			continue
+		}
+		if msg := checkAffinity(col, value); msg != "" {
+			fieldErr(field, msg)
+		}
+	}
+	for _, col := range columns {
+		if !required || !col.NotNull || col.HasDefault || col.PrimaryKey {
+			continue
+		}
+		found := false
+		for field := range rec.Data {
+			found = found || strings.EqualFold(field, col.Name)
+		}
+		if !found {
+			fieldErr(col.Name, "is required (NOT NULL without default)")
+		}
+	}
+	// map order is random, keep the response stable
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// checkAffinity returns why the value does not fit the column, empty if it does
+func checkAffinity(col *TableColumn, value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		if col.Affinity != AFFINITY_TEXT && col.Affinity != AFFINITY_ANY {
+			return fmt.Sprintf("expected %s, got object/array", col.Type)
+		}
+		return ""
+	}
+	switch col.Affinity {
+	case AFFINITY_INTEGER:
+		if f, ok := numericValue(value); ok {
+			if f != math.Trunc(f) {
+				return fmt.Sprintf("expected integer (%s), got %v", col.Type, value)
+			}
+			return ""
+		}
+		if s, ok := value.(string); ok {
+			if _, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+				return ""
+			}
+		}
+		return fmt.Sprintf("expected integer (%s), got %s", col.Type, jsonKind(value))
+	case AFFINITY_REAL:
+		if _, ok := numericValue(value); ok {
+			return ""
+		}
+		if _, ok := numericString(value); ok {
+			return ""
+		}
+		return fmt.Sprintf("expected number (%s), got %s", col.Type, jsonKind(value))
+	case AFFINITY_BOOL:
+		switch v := value.(type) {
+		case bool:
+			return ""
+		case float64, int, int64, json.Number:
+			if f, _ := numericValue(v); f == 0 || f == 1 {
+				return ""
+			}
+		case string:
+			if _, err := strconv.ParseBool(v); err == nil {
+				return ""
+			}
+		}
+		return fmt.Sprintf("expected boolean (%s), got %v", col.Type, value)
+	}
+	return ""
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	}
+	if _, ok := numericValue(v); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,410 @@
+package suresql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Scrub profiles anonymize datasets that leave production, ie: a copy of a table for staging. A
+// profile is the rules of _scrub_rules with its name, a rule changes one column of one table (or of
+// every table having the column, with table_name *). Hashing is keyed with SURESQL_SCRUB_SALT and
+// deterministic, the same email becomes the same value in every table so joins keep working, names
+// are picked from a list by the same hash. Exports always go through a profile, columns without a
+// rule are copied as they are.
+
+const (
+	SCRUB_HASH           = "hash"
+	SCRUB_HASH_EMAIL     = "hash_email"
+	SCRUB_RANDOMIZE_NAME = "randomize_name"
+	SCRUB_NULL           = "null"
+	SCRUB_MASK           = "mask"
+	SCRUB_FIXED          = "fixed"
+
+	SCRUB_ANY_TABLE      = "*"
+	SCRUB_SALT           = "SURESQL_SCRUB_SALT"
+	SCRUB_DEFAULT_DOMAIN = "example.com"
+	SCRUB_DEFAULT_KEEP   = 4 // characters mask keeps at the end
+	SCRUB_HASH_LENGTH    = 16
+
+	EXPORT_BATCH_SIZE    = 1000
+	EXPORT_FORMAT_NDJSON = "ndjson"
+	EXPORT_FORMAT_CSV    = "csv"
+)
+
+var (
+	ErrScrubRuleInvalid     = medaerror.MedaError{Message: "invalid scrub rule"}
+	ErrScrubRuleNotFound    = medaerror.MedaError{Message: "scrub rule not found"}
+	ErrScrubProfileNotFound = medaerror.MedaError{Message: "scrub profile not found"}
+	ErrExportFormat         = medaerror.MedaError{Message: "export format must be ndjson or csv"}
+)
+
+// ScrubRuleTable changes one column in the datasets of a profile
+type ScrubRuleTable struct {
+	ID         int    `json:"id,omitempty"         db:"id"`
+	Profile    string `json:"profile"              db:"profile"`
+	TableName_ string `json:"table_name"           db:"table_name"` // * is every table with the column
+	Column     string `json:"column_name"          db:"column_name"`
+	Action     string `json:"action"               db:"action"`
+	Value      string `json:"value,omitempty"      db:"value"` // hash_email: domain, mask: characters kept, fixed: replacement, randomize_name: first, last or empty for both
+	UpdatedAt  string `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func (s ScrubRuleTable) TableName() string {
+	return "_scrub_rules"
+}
+
+// Validate checks the names and the action
+func (s ScrubRuleTable) Validate() error {
+	if strings.TrimSpace(s.Profile) == "" {
+		return medaerror.Errorf("%s: profile is required", ErrScrubRuleInvalid.Message)
+	}
+	if s.TableName_ != SCRUB_ANY_TABLE {
+		if err := ValidateTableName(s.TableName_, false); err != nil {
+			return err
+		}
+	}
+	if err := ValidateIdentifier(s.Column); err != nil {
+		return err
+	}
+	switch s.Action {
+	case SCRUB_HASH, SCRUB_HASH_EMAIL, SCRUB_NULL, SCRUB_FIXED:
+	case SCRUB_MASK:
+		if _, err := strconv.Atoi(s.Value); s.Value != "" && err != nil {
+			return medaerror.Errorf("%s: value of mask is the number of characters kept", ErrScrubRuleInvalid.Message)
+		}
+	case SCRUB_RANDOMIZE_NAME:
+		if s.Value != "" && s.Value != "first" && s.Value != "last" {
+			return medaerror.Errorf("%s: value of randomize_name is first, last or empty", ErrScrubRuleInvalid.Message)
+		}
+	default:
+		return medaerror.Errorf("%s: action must be hash, hash_email, randomize_name, null, mask or fixed", ErrScrubRuleInvalid.Message)
+	}
+	return nil
+}
+
+// ListScrubRules returns the rules of the profile, or of all profiles when profile is empty
+func ListScrubRules(profile string) ([]ScrubRuleTable, error) {
+	condition := orm.Condition{OrderBy: []string{"profile ASC", "table_name ASC", "column_name ASC"}}
+	if profile != "" {
+		condition.Field, condition.Operator, condition.Value = "profile", "=", profile
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(ScrubRuleTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []ScrubRuleTable{}, nil
+		}
+		return nil, err
+	}
+	rules := make([]ScrubRuleTable, 0, len(records))
+	for _, rec := range records {
+		rules = append(rules, object.MapToStructSlowDB[ScrubRuleTable](rec.Data))
+	}
+	return rules, nil
+}
+
+// SaveScrubRules creates or replaces the rules, by profile, table and column
+func SaveScrubRules(rules []ScrubRuleTable) error {
+	queries := make([]orm.ParametereizedSQL, 0, len(rules))
+	for _, s := range rules {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		queries = append(queries, orm.ParametereizedSQL{
+			Query: "INSERT INTO " + s.TableName() + " (profile, table_name, column_name, action, value, updated_at) VALUES (?, ?, ?, ?, ?, ?)" +
+				" ON CONFLICT(profile, table_name, column_name) DO UPDATE SET action = excluded.action, value = excluded.value, updated_at = excluded.updated_at",
+			Values: []interface{}{s.Profile, s.TableName_, s.Column, s.Action, s.Value, CurrentClock.Now().UTC()},
+		})
+	}
+	results, err := CurrentNode.GetInternalConnection().ExecManySQLParameterized(queries)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
+
+// DeleteScrubRule removes the rule
+func DeleteScrubRule(id int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + ScrubRuleTable{}.TableName() + " WHERE id = ?",
+		Values: []interface{}{id},
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrScrubRuleNotFound
+	}
+	return res.Error
+}
+
+// ScrubProfile is the rules of a profile by table and column
+type ScrubProfile struct {
+	Name  string
+	rules map[string]map[string]ScrubRuleTable
+	salt  []byte
+}
+
+// LoadScrubProfile reads the rules of the profile, a profile without rules does not exist
+func LoadScrubProfile(name string) (*ScrubProfile, error) {
+	rules, err := ListScrubRules(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || len(rules) == 0 {
+		return nil, ErrScrubProfileNotFound
+	}
+	p := &ScrubProfile{Name: name, rules: map[string]map[string]ScrubRuleTable{}, salt: scrubSalt()}
+	for _, r := range rules {
+		table := strings.ToLower(r.TableName_)
+		if p.rules[table] == nil {
+			p.rules[table] = map[string]ScrubRuleTable{}
+		}
+		p.rules[table][r.Column] = r
+	}
+	return p, nil
+}
+
+// Rules returns the rules of the table by column, a rule of the table wins over one of *
+func (p *ScrubProfile) Rules(table string) map[string]ScrubRuleTable {
+	rules := map[string]ScrubRuleTable{}
+	for c, r := range p.rules[SCRUB_ANY_TABLE] {
+		rules[c] = r
+	}
+	for c, r := range p.rules[strings.ToLower(table)] {
+		rules[c] = r
+	}
+	return rules
+}
+
+// ScrubRecords applies the rules of the table to the records (changing them)
+func (p *ScrubProfile) ScrubRecords(table string, records []orm.DBRecord) {
+	rules := p.Rules(table)
+	if len(rules) == 0 {
+		return
+	}
+	for i := range records {
+		for c, r := range rules {
+			if v, ok := records[i].Data[c]; ok {
+				records[i].Data[c] = p.scrubValue(r, v)
+			}
+		}
+	}
+}
+
+// scrubValue is the anonymized value, null stays null (except fixed)
+func (p *ScrubProfile) scrubValue(r ScrubRuleTable, v interface{}) interface{} {
+	if r.Action == SCRUB_FIXED {
+		return r.Value
+	}
+	if v == nil || r.Action == SCRUB_NULL {
+		return nil
+	}
+	text := fmt.Sprint(v)
+	if b, ok := v.([]byte); ok {
+		text = string(b)
+	}
+	switch r.Action {
+	case SCRUB_HASH:
+		return p.hash(text)
+	case SCRUB_HASH_EMAIL:
+		domain := r.Value
+		if domain == "" {
+			domain = SCRUB_DEFAULT_DOMAIN
+		}
+		// case does not matter in emails, the same address hashes the same
+		return p.hash(strings.ToLower(strings.TrimSpace(text))) + "@" + domain
+	case SCRUB_MASK:
+		keep := SCRUB_DEFAULT_KEEP
+		if n, err := strconv.Atoi(r.Value); err == nil {
+			keep = n
+		}
+		runes := []rune(text)
+		if keep > len(runes) {
+			keep = len(runes)
+		}
+		return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+	case SCRUB_RANDOMIZE_NAME:
+		sum := sha256.Sum256(append(p.salt, text...))
+		first := scrubFirstNames[binary.BigEndian.Uint32(sum[0:4])%uint32(len(scrubFirstNames))]
+		last := scrubLastNames[binary.BigEndian.Uint32(sum[4:8])%uint32(len(scrubLastNames))]
+		switch r.Value {
+		case "first":
+			return first
+		case "last":
+			return last
+		}
+		return first + " " + last
+	}
+	return v
+}
+
+func (p *ScrubProfile) hash(text string) string {
+	sum := sha256.Sum256(append(p.salt, text...))
+	return hex.EncodeToString(sum[:])[:SCRUB_HASH_LENGTH]
+}
+
+var (
+	scrubSaltOnce sync.Once
+	scrubRandSalt []byte
+)
+
+// scrubSalt is SURESQL_SCRUB_SALT or the master key, without either a random one of this process
+// (hashes then differ between restarts)
+func scrubSalt() []byte {
+	for _, name := range []string{SCRUB_SALT, SECRET_MASTER_KEY} {
+		if s, _ := GetSecret(name); s != "" {
+			return []byte(s)
+		}
+	}
+	scrubSaltOnce.Do(func() {
+		scrubRandSalt = make([]byte, 32)
+		rand.Read(scrubRandSalt)
+		simplelog.LogFormat("scrub: no %s or %s, hashes are only stable until the restart", SCRUB_SALT, SECRET_MASTER_KEY)
+	})
+	return scrubRandSalt
+}
+
+var scrubFirstNames = []string{
+	"Alex", "Ana", "Budi", "Carla", "Dewi", "Eric", "Fatima", "Hana",
+	"Ivan", "Joko", "Kim", "Lina", "Mei", "Nadia", "Omar", "Putri",
+	"Rafael", "Sari", "Tomas", "Wulan",
+}
+
+var scrubLastNames = []string{
+	"Anderson", "Basuki", "Chen", "Dubois", "Evans", "Gunawan", "Hartono", "Ito",
+	"Kowalski", "Lestari", "Martin", "Novak", "Okafor", "Pratama", "Rossi", "Santoso",
+	"Tan", "Wijaya", "Yamada", "Zimmer",
+}
+
+// TableExport writes a table through a scrub profile
+type TableExport struct {
+	Table   string
+	Format  string
+	Profile *ScrubProfile
+	columns []TableColumn
+	orderBy string
+}
+
+// PrepareExport checks the table, profile and format before anything is written
+func PrepareExport(table, profile, format string) (*TableExport, error) {
+	if format == "" {
+		format = EXPORT_FORMAT_NDJSON
+	}
+	if format != EXPORT_FORMAT_NDJSON && format != EXPORT_FORMAT_CSV {
+		return nil, ErrExportFormat
+	}
+	if err := ValidateTableName(table, false); err != nil {
+		return nil, err
+	}
+	columns, err := TableSchema(table, true)
+	if err != nil {
+		return nil, err
+	}
+	p, err := LoadScrubProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	// pages need a stable order, the primary key when there is one
+	orderBy := columns[0].Name
+	for _, c := range columns {
+		if c.PrimaryKey {
+			orderBy = c.Name
+			break
+		}
+	}
+	return &TableExport{Table: table, Format: format, Profile: p, columns: columns, orderBy: orderBy}, nil
+}
+
+// ContentType of the export format
+func (e *TableExport) ContentType() string {
+	if e.Format == EXPORT_FORMAT_CSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// WriteTo writes every row of the table, scrubbed, a page at a time. Returns the rows written.
+func (e *TableExport) WriteTo(ctx context.Context, w io.Writer) (int, error) {
+	var cw *csv.Writer
+	enc := json.NewEncoder(w)
+	if e.Format == EXPORT_FORMAT_CSV {
+		cw = csv.NewWriter(w)
+		header := make([]string, len(e.columns))
+		for i, c := range e.columns {
+			header[i] = c.Name
+		}
+		if err := cw.Write(header); err != nil {
+			return 0, err
+		}
+	}
+
+	written := 0
+	for offset := 0; ; offset += EXPORT_BATCH_SIZE {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		query, err := BuildSelect(CurrentDialect(), e.Table, &orm.Condition{OrderBy: []string{e.orderBy + " ASC"}, Limit: EXPORT_BATCH_SIZE, Offset: offset})
+		if err != nil {
+			return written, err
+		}
+		records, err := CurrentNode.GetInternalConnection().SelectOneSQLParameterized(query)
+		if err != nil && !IsNoRowsError(err) {
+			return written, err
+		}
+		e.Profile.ScrubRecords(e.Table, records)
+		for _, rec := range records {
+			if cw != nil {
+				row := make([]string, len(e.columns))
+				for i, c := range e.columns {
+					row[i] = csvValue(rec.Data[c.Name])
+				}
+				err = cw.Write(row)
+			} else {
+				err = enc.Encode(rec.Data)
+			}
+			if err != nil {
+				return written, err
+			}
+			written++
+		}
+		if cw != nil {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return written, err
+			}
+		}
+		if len(records) < EXPORT_BATCH_SIZE {
+			return written, nil
+		}
+	}
+}
+
+func csvValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,317 @@
+package suresql
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// At-rest encryption of the secrets in _settings and _configs (SMTP password, webhook URLs, tokens
+// and keys). Values are sealed with AES-256-GCM under the master key SURESQL_MASTER_KEY from the
+// secrets provider and decrypted when loaded, a copy of the database alone does not leak them. The
+// row (category/key) is authenticated too, so a sealed value cannot be moved to another setting.
+// Plaintext secrets are sealed on start once a master key is set. To change the key set the old one
+// in SURESQL_MASTER_KEY_PREVIOUS for one start, the values are sealed again with the new key.
+
+const (
+	SECRET_PREFIX              = "enc:v1:"
+	SECRET_MASTER_KEY          = "SURESQL_MASTER_KEY"
+	SECRET_MASTER_KEY_PREVIOUS = "SURESQL_MASTER_KEY_PREVIOUS"
+	secretConfigCategory       = "_configs" // associated data of the _configs columns
+)
+
+var (
+	ErrMasterKeyMissing = medaerror.MedaError{Message: "encrypted secrets found but SURESQL_MASTER_KEY is not set"}
+	ErrSecretDecrypt    = medaerror.MedaError{Message: "cannot decrypt secret, wrong SURESQL_MASTER_KEY?"}
+)
+
+// SecretSettings are the settings holding credentials, by category. A key ending with * is a prefix.
+var SecretSettings = map[string][]string{
+	SETTING_CATEGORY_SMTP:          {SETTING_KEY_SMTP_PASSWORD},
+	SETTING_CATEGORY_METERING:      {SETTING_KEY_WEBHOOK_URL},
+	SETTING_CATEGORY_SECURITY:      {SETTING_KEY_SECURITY_SIEM_URL},
+	SETTING_CATEGORY_PROXY:         {SETTING_KEY_PROXY_OUTBOUND + "*"}, // proxy URLs carry user:password
+	SETTING_CATEGORY_CONFIG_EVENTS: {SETTING_KEY_CONFIG_EVENTS_WEBHOOK},
+}
+
+// SecretsProvider returns a secret by name, empty when it is not set
+type SecretsProvider interface {
+	Secret(name string) (string, error)
+}
+
+// EnvSecretsProvider reads NAME from the environment, or the file in NAME_FILE (Docker and
+// Kubernetes secrets mounted as files)
+type EnvSecretsProvider struct{}
+
+func (EnvSecretsProvider) Secret(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+var (
+	secretsMu       sync.RWMutex
+	secretsProvider SecretsProvider = EnvSecretsProvider{}
+)
+
+// SetSecretsProvider replaces the environment provider, ie: with a vault client. Call it before
+// ConnectInternal.
+func SetSecretsProvider(p SecretsProvider) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secretsProvider = p
+}
+
+// GetSecret reads a secret from the provider
+func GetSecret(name string) (string, error) {
+	secretsMu.RLock()
+	p := secretsProvider
+	secretsMu.RUnlock()
+	return p.Secret(name)
+}
+
+// IsSecretSetting tells if category/key holds a credential
+func IsSecretSetting(category, key string) bool {
+	for _, k := range SecretSettings[category] {
+		if k == key || (strings.HasSuffix(k, "*") && strings.HasPrefix(key, strings.TrimSuffix(k, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSealed tells if a stored value is encrypted
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, SECRET_PREFIX)
+}
+
+// SealSetting encrypts the value of a secret setting for storing, other settings and empty values
+// are returned as they are, and so is everything when there is no master key
+func SealSetting(category, key, value string) (string, error) {
+	if value == "" || IsSealed(value) || !IsSecretSetting(category, key) {
+		return value, nil
+	}
+	master, err := GetSecret(SECRET_MASTER_KEY)
+	if err != nil || master == "" {
+		return value, err
+	}
+	return sealSecret(master, category+"/"+key, value)
+}
+
+// OpenSetting decrypts a stored value, plaintext is returned as it is
+func OpenSetting(category, key, value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	master, err := GetSecret(SECRET_MASTER_KEY)
+	if err != nil {
+		return "", err
+	}
+	if master == "" {
+		return "", ErrMasterKeyMissing
+	}
+	plain, err := openSecret(master, category+"/"+key, value)
+	if err == nil {
+		return plain, nil
+	}
+	if previous, _ := GetSecret(SECRET_MASTER_KEY_PREVIOUS); previous != "" {
+		if plain, err := openSecret(previous, category+"/"+key, value); err == nil {
+			return plain, nil
+		}
+	}
+	simplelog.LogFormat("secrets: cannot decrypt %s/%s", category, key)
+	return "", ErrSecretDecrypt
+}
+
+// IsSecretError tells if loading failed because the secrets cannot be decrypted, the DB is fine then
+func IsSecretError(err error) bool {
+	return err == ErrMasterKeyMissing || err == ErrSecretDecrypt
+}
+
+// openSecretSettings decrypts the loaded settings in place
+func openSecretSettings(settings Settings) error {
+	for category, m := range settings {
+		for key, s := range m {
+			if !IsSealed(s.TextValue) {
+				continue
+			}
+			plain, err := OpenSetting(category, key, s.TextValue)
+			if err != nil {
+				return err
+			}
+			s.TextValue = plain
+			m[key] = s
+		}
+	}
+	return nil
+}
+
+// configSecrets are the secret columns of _configs
+func configSecrets(c *EnvConfig) map[string]*string {
+	return map[string]*string{
+		"token":         &c.Token,
+		"refresh_token": &c.RefreshToken,
+		"jwe_key":       &c.JWEKey,
+		"jwt_key":       &c.JWTKey,
+		"api_key":       &c.APIKey,
+	}
+}
+
+// openConfigSecrets decrypts the secret columns of the loaded config in place
+func openConfigSecrets(c *EnvConfig) error {
+	for column, v := range configSecrets(c) {
+		plain, err := OpenSetting(secretConfigCategory, column, *v)
+		if err != nil {
+			return err
+		}
+		*v = plain
+	}
+	return nil
+}
+
+// SealStoredSecrets encrypts the secrets still stored in plaintext (or with the previous master key),
+// does nothing without a master key. Returns the number of values sealed.
+func SealStoredSecrets() (int, error) {
+	master, err := GetSecret(SECRET_MASTER_KEY)
+	if err != nil || master == "" {
+		return 0, err
+	}
+	count := 0
+	records, err := CurrentNode.GetInternalConnection().SelectMany(SettingTable{}.TableName())
+	if err != nil && !IsNoRowsError(err) {
+		return 0, err
+	}
+	for _, r := range records {
+		s := object.MapToStructSlowDB[SettingTable](r.Data)
+		sealed, changed, err := resealSecret(master, s.Category, s.SettingKey, s.TextValue)
+		if err != nil {
+			return count, err
+		}
+		if !changed {
+			continue
+		}
+		// the old value in the condition keeps another node from sealing twice
+		res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query:  "UPDATE " + s.TableName() + " SET text_value = ? WHERE id = ? AND text_value = ?",
+			Values: []interface{}{sealed, s.ID, s.TextValue},
+		})
+		if res.Error != nil {
+			return count, res.Error
+		}
+		count++
+	}
+
+	record, err := CurrentNode.GetInternalConnection().SelectOne(ConfigTable{}.TableName())
+	if err != nil {
+		if IsNoRowsError(err) {
+			return count, nil
+		}
+		return count, err
+	}
+	config := object.MapToStructSlow[ConfigTable](record.Data)
+	for column, v := range configSecrets(&config.EnvConfig) {
+		sealed, changed, err := resealSecret(master, secretConfigCategory, column, *v)
+		if err != nil {
+			return count, err
+		}
+		if !changed {
+			continue
+		}
+		res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query:  "UPDATE " + config.TableName() + " SET " + column + " = ? WHERE id = ? AND " + column + " = ?",
+			Values: []interface{}{sealed, config.ID, *v},
+		})
+		if res.Error != nil {
+			return count, res.Error
+		}
+		count++
+	}
+	if count > 0 {
+		simplelog.LogFormat("secrets: sealed %d stored secret(s) with the master key", count)
+	}
+	return count, nil
+}
+
+// resealSecret returns the value sealed with master when it is a plaintext secret or sealed with the
+// previous key, changed is false when it is fine as it is
+func resealSecret(master, category, key, value string) (string, bool, error) {
+	if value == "" {
+		return value, false, nil
+	}
+	if !IsSealed(value) {
+		if category != secretConfigCategory && !IsSecretSetting(category, key) {
+			return value, false, nil
+		}
+		sealed, err := sealSecret(master, category+"/"+key, value)
+		return sealed, err == nil, err
+	}
+	if _, err := openSecret(master, category+"/"+key, value); err == nil {
+		return value, false, nil
+	}
+	plain, err := OpenSetting(category, key, value)
+	if err != nil {
+		return value, false, err
+	}
+	sealed, err := sealSecret(master, category+"/"+key, plain)
+	return sealed, err == nil, err
+}
+
+func sealSecret(master, associated, plain string) (string, error) {
+	gcm, err := secretCipher(master)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return SECRET_PREFIX + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plain), []byte(associated))), nil
+}
+
+func openSecret(master, associated, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, SECRET_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := secretCipher(master)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", ErrSecretDecrypt
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(associated))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// secretCipher is AES-256-GCM keyed with the SHA-256 of the master key
+func secretCipher(master string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(master))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
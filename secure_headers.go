@@ -0,0 +1,69 @@
+package suresql
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Security headers added to every response. Each one can be changed in the settings (category headers),
+// a setting with an empty value removes that header. Extra headers can be added with setting
+// headers/custom, a JSON object of header name to value.
+
+const (
+	DEFAULT_HSTS_MAX_AGE    = 31536000 // one year
+	DEFAULT_FRAME_OPTIONS   = "DENY"
+	DEFAULT_REFERRER_POLICY = "no-referrer"
+	DEFAULT_CSP             = "default-src 'none'; frame-ancestors 'none'"
+)
+
+// SecureHeader is one response header
+type SecureHeader struct {
+	Name  string
+	Value string
+}
+
+// SecureHeaders returns the security headers from the current settings, nil when disabled
+func SecureHeaders() []SecureHeader {
+	settings := CurrentNode.Settings
+	if tmp, ok := settings.SettingExist(SETTING_CATEGORY_HEADERS, SETTING_KEY_HEADERS_ENABLED); ok && tmp.IntValue == 0 {
+		return nil
+	}
+
+	headers := []SecureHeader{{Name: "X-Content-Type-Options", Value: "nosniff"}}
+
+	maxAge := DEFAULT_HSTS_MAX_AGE
+	if tmp, ok := settings.SettingExist(SETTING_CATEGORY_HEADERS, SETTING_KEY_HEADERS_HSTS_MAX_AGE); ok {
+		maxAge = tmp.IntValue
+	}
+	if maxAge > 0 {
+		hsts := "max-age=" + strconv.Itoa(maxAge)
+		if tmp, ok := settings.SettingExist(SETTING_CATEGORY_HEADERS, SETTING_KEY_HEADERS_HSTS_SUBDOMAINS); !ok || tmp.IntValue != 0 {
+			hsts += "; includeSubDomains"
+		}
+		headers = append(headers, SecureHeader{Name: "Strict-Transport-Security", Value: hsts})
+	}
+
+	for _, h := range []struct{ key, name, def string }{
+		{SETTING_KEY_HEADERS_FRAME_OPTIONS, "X-Frame-Options", DEFAULT_FRAME_OPTIONS},
+		{SETTING_KEY_HEADERS_REFERRER_POLICY, "Referrer-Policy", DEFAULT_REFERRER_POLICY},
+		{SETTING_KEY_HEADERS_CSP, "Content-Security-Policy", DEFAULT_CSP},
+	} {
+		value := h.def
+		if tmp, ok := settings.SettingExist(SETTING_CATEGORY_HEADERS, h.key); ok {
+			value = tmp.TextValue
+		}
+		if value != "" {
+			headers = append(headers, SecureHeader{Name: h.name, Value: value})
+		}
+	}
+
+	if tmp, ok := settings.SettingExist(SETTING_CATEGORY_HEADERS, SETTING_KEY_HEADERS_CUSTOM); ok && tmp.TextValue != "" {
+		var custom map[string]string
+		if err := json.Unmarshal([]byte(tmp.TextValue), &custom); err == nil {
+			for name, value := range custom {
+				headers = append(headers, SecureHeader{Name: name, Value: value})
+			}
+		}
+	}
+	return headers
+}
@@ -0,0 +1,295 @@
+package suresql
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Security events are kept apart from the access log (_access_logs), which records what users did. Here
+// only what a security review or a SIEM cares about is recorded: failed authentication, replayed or
+// reused credentials, policy violations, denied permissions and admins acting as a user. Events are
+// queued and written in batches so a brute force attack cannot turn into a write storm on the DB, each
+// event is also written as one JSON line to the console log (for log shippers) and, when setting
+// security/siem_url is set, posted in batches to that URL.
+
+const (
+	SECURITY_EVENT_AUTH_FAILURE      = "auth_failure"
+	SECURITY_EVENT_TOKEN_REUSE       = "token_reuse"
+	SECURITY_EVENT_POLICY_VIOLATION  = "policy_violation"
+	SECURITY_EVENT_PERMISSION_DENIED = "permission_denied"
+	SECURITY_EVENT_LOCKOUT           = "lockout"
+	SECURITY_EVENT_INTEGRITY         = "integrity_mismatch"
+	SECURITY_EVENT_IMPERSONATION     = "impersonation"
+	SECURITY_EVENT_CREDENTIALS       = "credential_rotation"
+
+	SECURITY_SEVERITY_INFO     = "info"
+	SECURITY_SEVERITY_WARNING  = "warning"
+	SECURITY_SEVERITY_CRITICAL = "critical"
+
+	SECURITY_EVENT_QUEUE_SIZE     = 1024
+	SECURITY_EVENT_BATCH_SIZE     = 100
+	SECURITY_EVENT_FLUSH_INTERVAL = 2 * time.Second
+	SECURITY_SIEM_TIMEOUT         = 10 * time.Second
+	DEFAULT_SECURITY_EVENT_LIMIT  = 100
+)
+
+// SecurityEventTable is one security relevant event
+type SecurityEventTable struct {
+	ID         int       `json:"id,omitempty"         db:"id"`
+	EventType  string    `json:"event_type"           db:"event_type"`
+	Severity   string    `json:"severity"             db:"severity"`
+	Username   string    `json:"username,omitempty"   db:"username"`
+	ClientIP   string    `json:"client_ip,omitempty"  db:"client_ip"`
+	Path       string    `json:"path,omitempty"       db:"path"`
+	Message    string    `json:"message"              db:"message"`
+	NodeNumber int       `json:"node_number"          db:"node_number"`
+	CreatedAt  time.Time `json:"created_at"           db:"created_at"`
+}
+
+func (s SecurityEventTable) TableName() string {
+	return "_security_events"
+}
+
+// SecurityEventLog writes queued security events to the DB and the SIEM
+type SecurityEventLog struct {
+	mu       sync.Mutex
+	queue    chan SecurityEventTable
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	dropped  int64
+}
+
+var (
+	SecurityEvents     *SecurityEventLog
+	securityEventsOnce sync.Once
+)
+
+// InitSecurityEvents initializes the global security event log
+func InitSecurityEvents() {
+	securityEventsOnce.Do(func() {
+		SecurityEvents = &SecurityEventLog{
+			queue:    make(chan SecurityEventTable, SECURITY_EVENT_QUEUE_SIZE),
+			stopChan: make(chan struct{}),
+		}
+	})
+}
+
+// StartSecurityEvents starts writing the queued events
+func StartSecurityEvents(ctx context.Context) {
+	if SecurityEvents == nil {
+		InitSecurityEvents()
+	}
+	SecurityEvents.Start(ctx)
+}
+
+// StopSecurityEvents writes what is still queued and stops
+func StopSecurityEvents() {
+	if SecurityEvents != nil {
+		SecurityEvents.Stop()
+	}
+}
+
+// RecordSecurityEvent queues an event, it never blocks: when the queue is full the event is only
+// written to the console log and counted as dropped
+func RecordSecurityEvent(event SecurityEventTable) {
+	if event.Severity == "" {
+		event.Severity = SECURITY_SEVERITY_WARNING
+	}
+	event.NodeNumber = CurrentNode.Config.NodeNumber
+	event.CreatedAt = CurrentClock.Now().UTC()
+
+	line, _ := json.Marshal(event)
+	simplelog.LogThis("SECURITY", string(line))
+
+	if SecurityEvents == nil {
+		return
+	}
+	select {
+	case SecurityEvents.queue <- event:
+	default:
+		atomic.AddInt64(&SecurityEvents.dropped, 1)
+	}
+}
+
+// Dropped is the number of events that did not fit in the queue
+func (sl *SecurityEventLog) Dropped() int64 {
+	return atomic.LoadInt64(&sl.dropped)
+}
+
+// Start starts the writer
+func (sl *SecurityEventLog) Start(ctx context.Context) {
+	sl.mu.Lock()
+	if sl.running {
+		sl.mu.Unlock()
+		return
+	}
+	sl.running = true
+	sl.mu.Unlock()
+
+	sl.wg.Add(1)
+	go func() {
+		defer sl.wg.Done()
+		simplelog.LogThis("SecurityEvents", "Starting security event log")
+		ticker := CurrentClock.NewTicker(SECURITY_EVENT_FLUSH_INTERVAL)
+		defer ticker.Stop()
+		batch := make([]SecurityEventTable, 0, SECURITY_EVENT_BATCH_SIZE)
+		for {
+			select {
+			case <-ctx.Done():
+				sl.flush(sl.drain(batch))
+				return
+			case <-sl.stopChan:
+				sl.flush(sl.drain(batch))
+				return
+			case event := <-sl.queue:
+				batch = append(batch, event)
+				if len(batch) >= SECURITY_EVENT_BATCH_SIZE {
+					sl.flush(batch)
+					batch = batch[:0]
+				}
+			case <-ticker.C():
+				if len(batch) > 0 {
+					sl.flush(batch)
+					batch = batch[:0]
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the writer after writing the queued events
+func (sl *SecurityEventLog) Stop() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if !sl.running {
+		return
+	}
+	close(sl.stopChan)
+	sl.wg.Wait()
+	sl.running = false
+	simplelog.LogThis("SecurityEvents", "Security event log stopped")
+}
+
+// drain appends whatever is still in the queue
+func (sl *SecurityEventLog) drain(batch []SecurityEventTable) []SecurityEventTable {
+	for {
+		select {
+		case event := <-sl.queue:
+			batch = append(batch, event)
+		default:
+			return batch
+		}
+	}
+}
+
+// flush writes the batch to _security_events and posts it to the SIEM
+func (sl *SecurityEventLog) flush(batch []SecurityEventTable) {
+	if len(batch) == 0 {
+		return
+	}
+	records := make([]orm.DBRecord, 0, len(batch))
+	for _, event := range batch {
+		records = append(records, orm.DBRecord{
+			TableName: event.TableName(),
+			Data: map[string]interface{}{
+				"event_type":  event.EventType,
+				"severity":    event.Severity,
+				"username":    event.Username,
+				"client_ip":   event.ClientIP,
+				"path":        event.Path,
+				"message":     event.Message,
+				"node_number": event.NodeNumber,
+				"created_at":  event.CreatedAt,
+			},
+		})
+	}
+	if _, err := CurrentNode.GetInternalConnection().InsertManyDBRecords(records, false); err != nil {
+		simplelog.LogErrorAny("SecurityEvents", err, "cannot save security events")
+	}
+
+	url := securitySIEMURL()
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err == nil {
+		if err = PostWebhook(url, body, SECURITY_SIEM_TIMEOUT); err != nil {
+			AddDeadLetter(DEAD_LETTER_SOURCE_WEBHOOK, url, "", WebhookDelivery{URL: url, Body: body}, err)
+		}
+	}
+	if err != nil {
+		simplelog.LogErrorAny("SecurityEvents", err, "cannot export security events to SIEM")
+	}
+}
+
+func securitySIEMURL() string {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SECURITY, SETTING_KEY_SECURITY_SIEM_URL); ok {
+		return tmp.TextValue
+	}
+	return ""
+}
+
+// ListSecurityEvents returns the newest events, filtered by type, minimum severity and since (all optional)
+func ListSecurityEvents(eventType, severity string, since time.Time, limit int) ([]SecurityEventTable, error) {
+	if limit <= 0 {
+		limit = DEFAULT_SECURITY_EVENT_LIMIT
+	}
+	condition := orm.Condition{OrderBy: []string{"id DESC"}, Limit: limit}
+	var nested []orm.Condition
+	if eventType != "" {
+		nested = append(nested, orm.Condition{Field: "event_type", Operator: "=", Value: eventType})
+	}
+	if levels := severityAtLeast(severity); len(levels) > 0 {
+		nested = append(nested, orm.Condition{Field: "severity", Operator: "IN", Value: levels})
+	}
+	if !since.IsZero() {
+		nested = append(nested, orm.Condition{Field: "created_at", Operator: ">=", Value: since.UTC()})
+	}
+	if len(nested) > 0 {
+		condition.Logic = "AND"
+		condition.Nested = nested
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(SecurityEventTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []SecurityEventTable{}, nil
+		}
+		return nil, err
+	}
+	events := make([]SecurityEventTable, 0, len(records))
+	for _, rec := range records {
+		events = append(events, object.MapToStructSlowDB[SecurityEventTable](rec.Data))
+	}
+	return events, nil
+}
+
+// PurgeSecurityEvents deletes the events older than before
+func PurgeSecurityEvents(before time.Time) (int, error) {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + SecurityEventTable{}.TableName() + " WHERE created_at < ?",
+		Values: []interface{}{before.UTC()},
+	})
+	return res.RowsAffected, res.Error
+}
+
+// severityAtLeast returns the severities at or above the given one, nil for any
+func severityAtLeast(severity string) []interface{} {
+	switch severity {
+	case SECURITY_SEVERITY_INFO:
+		return []interface{}{SECURITY_SEVERITY_INFO, SECURITY_SEVERITY_WARNING, SECURITY_SEVERITY_CRITICAL}
+	case SECURITY_SEVERITY_WARNING:
+		return []interface{}{SECURITY_SEVERITY_WARNING, SECURITY_SEVERITY_CRITICAL}
+	case SECURITY_SEVERITY_CRITICAL:
+		return []interface{}{SECURITY_SEVERITY_CRITICAL}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medatechnology/suresql"
+)
+
+// The JSON shape of every request/response model is pinned in testdata/api/v<API_VERSION>. A change of
+// a shape fails the test: bump suresql.API_VERSION for breaking changes, then regenerate with
+//
+//	go test ./server -run TestAPIShapes -update
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the current API version")
+
+// apiModels are the models clients send or receive, by golden file name
+var apiModels = map[string]interface{}{
+	"standard_response":       suresql.StandardResponse{},
+	"sql_request":             suresql.SQLRequest{},
+	"sql_response":            suresql.SQLResponse{},
+	"query_request":           suresql.QueryRequest{},
+	"query_response":          suresql.QueryResponse{},
+	"aggregate_request":       suresql.AggregateRequest{},
+	"aggregate_response":      suresql.AggregateResponse{},
+	"insert_request":          suresql.InsertRequest{},
+	"upsert_request":          suresql.UpsertRequest{},
+	"update_request":          suresql.UpdateRequest{},
+	"batch_update_request":    suresql.BatchUpdateRequest{},
+	"batch_update_response":   suresql.BatchUpdateResponse{},
+	"delete_request":          suresql.DeleteRequest{},
+	"insert_response":         suresql.InsertResponse{},
+	"insert_stream_response":  suresql.InsertStreamResponse{},
+	"csv_import_response":     suresql.CSVImportResponse{},
+	"token":                   suresql.TokenTable{},
+	"connect_request":         UserTable{},
+	"user_update_request":     UserUpdateRequest{},
+	"cdc_request":             CDCRequest{},
+	"report_request":          ReportRequest{},
+	"procedure_request":       procedureRequest{},
+	"procedure_result":        suresql.ProcedureResult{},
+	"pressure":                suresql.PressureStatus{},
+	"expression_test":         expressionTestRequest{},
+	"table_expression":        suresql.TableExpressionTable{},
+	"message":                 suresql.MessageTable{},
+	"security_event":          suresql.SecurityEventTable{},
+	"signing_key":             suresql.SigningKeyTable{},
+	"plugin_info":             PluginInfo{},
+	"insert_record_result":    suresql.InsertRecordResult{},
+	"fault_status":            suresql.FaultStatus{},
+	"peer_tls_status":         suresql.PeerTLSStatus{},
+	"integrity_table":         suresql.IntegrityTable{},
+	"integrity_report":        suresql.IntegrityReport{},
+	"replica_lag":             suresql.ReplicaLag{},
+	"index_recommendation":    suresql.IndexRecommendation{},
+	"slow_statement":          suresql.SlowStatement{},
+	"maintenance_status":      MaintenanceStatus{},
+	"maintenance_run":         suresql.MaintenanceRunTable{},
+	"disk_usage":              suresql.DiskUsage{},
+	"disk_usage_sample":       suresql.DiskUsageTable{},
+	"tx_request":              suresql.TxRequest{},
+	"tx_begin_response":       suresql.TxBeginResponse{},
+	"tx_exec_response":        suresql.TxExecResponse{},
+	"node_info":               suresql.NodeInfo{},
+	"feature_flag":            suresql.FeatureFlagTable{},
+	"setting_request":         suresql.SettingRequest{},
+	"setting_history":         suresql.SettingHistoryTable{},
+	"config_event":            suresql.ConfigEvent{},
+	"experiment_status":       suresql.ExperimentStatus{},
+	"shadow_status":           suresql.ShadowStatus{},
+	"embedded_rqlite_status":  suresql.EmbeddedRqliteStatus{},
+	"switchover_status":       suresql.SwitchoverStatus{},
+	"queued_write":            suresql.QueuedWrite{},
+	"write_queue_status":      suresql.WriteQueueStatus{},
+	"write_serializer_status": suresql.WriteSerializerStatus{},
+}
+
+func TestAPIShapes(t *testing.T) {
+	dir := filepath.Join("testdata", "api", fmt.Sprintf("v%d", suresql.API_VERSION))
+	if *updateGolden {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, model := range apiModels {
+		t.Run(name, func(t *testing.T) {
+			got, err := json.MarshalIndent(jsonShape(reflect.TypeOf(model), map[reflect.Type]bool{}), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			path := filepath.Join(dir, name+".json")
+			if *updateGolden {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("no golden file for API v%d, run with -update: %v", suresql.API_VERSION, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("JSON shape of %s changed without bumping API_VERSION (%d).\nwant:\n%s\ngot:\n%s", name, suresql.API_VERSION, want, got)
+			}
+		})
+	}
+}
+
+// jsonShape describes how encoding/json renders the type: objects map their JSON names to the shape
+// of the value (",omitempty" is kept in the name), maps use "*" for any key, arrays hold the element shape
+func jsonShape(t reflect.Type, seen map[reflect.Type]bool) interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "time"
+	}
+	if t.Implements(reflect.TypeOf((*json.Marshaler)(nil)).Elem()) {
+		return "json:" + t.String()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if seen[t] {
+			return "ref:" + t.String()
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		shape := map[string]interface{}{}
+		structShape(t, seen, shape)
+		return shape
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "base64"
+		}
+		return []interface{}{jsonShape(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"*": jsonShape(t.Elem(), seen)}
+	case reflect.Interface:
+		return "any"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return t.Kind().String()
+}
+
+// structShape adds the exported fields, embedded structs without a JSON name are flattened like encoding/json does
+func structShape(t reflect.Type, seen map[reflect.Type]bool, shape map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				structShape(ft, seen, shape)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(opts, "omitempty") {
+			name += ",omitempty"
+		}
+		shape[name] = jsonShape(f.Type, seen)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/medatechnology/goutil/medaerror"
 	"github.com/medatechnology/goutil/medattlmap"
 	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
 )
 
 // Constant for auth related like token settings
@@ -30,8 +31,11 @@ var (
 
 // Mini Redis like Key-Value storage based on MedaTTLMap
 type TokenStoreStruct struct {
-	TokenMap        *medattlmap.TTLMap // For access tokens
-	RefreshTokenMap *medattlmap.TTLMap // For refresh tokens
+	TokenMap            *medattlmap.TTLMap // For access tokens
+	RefreshTokenMap     *medattlmap.TTLMap // For refresh tokens
+	UsedRefreshTokenMap *medattlmap.TTLMap // Refresh tokens already exchanged, to detect reuse
+	TokenExp            time.Duration      // lifetime of access tokens
+	RefreshExp          time.Duration      // lifetime of refresh tokens
 }
 
 // InitTokenMaps initializes the token maps with configured TTLs from the node
@@ -42,8 +46,11 @@ func InitTokenMaps(tokenExp, refreshExp, ttlTicker time.Duration) {
 
 func NewTokenStore(exp, rexp, ttlTicker time.Duration) TokenStoreStruct {
 	return TokenStoreStruct{
-		TokenMap:        medattlmap.NewTTLMap(exp, ttlTicker),
-		RefreshTokenMap: medattlmap.NewTTLMap(rexp, ttlTicker),
+		TokenMap:            medattlmap.NewTTLMap(exp, ttlTicker),
+		RefreshTokenMap:     medattlmap.NewTTLMap(rexp, ttlTicker),
+		UsedRefreshTokenMap: medattlmap.NewTTLMap(rexp, ttlTicker),
+		TokenExp:            exp,
+		RefreshExp:          rexp,
 	}
 }
 
@@ -55,6 +62,11 @@ func (t TokenStoreStruct) GetAll() (map[string]interface{}, map[string]interface
 func (t TokenStoreStruct) SaveToken(token suresql.TokenTable) {
 	t.TokenMap.Put(token.Token, 0, token)
 	t.RefreshTokenMap.Put(token.Refresh, 0, token)
+	if suresql.TokenPersistenceEnabled() {
+		if err := suresql.PersistToken(token); err != nil {
+			simplelog.LogErrorAny("token", err, "failed to persist token")
+		}
+	}
 }
 
 // Check if tokenExist, if it is, return the value of the TokenMap[token] - which is interface{} type
@@ -62,9 +74,14 @@ func (t TokenStoreStruct) TokenExist(token string) (*suresql.TokenTable, bool) {
 	val, ok := t.TokenMap.Get(token)
 	// fmt.Println("All TokenMap:", t.TokenMap.Map())
 	if !ok {
-		return nil, false
+		return t.restoreToken(token)
 	}
 	tok := val.(suresql.TokenTable)
+	// The TTL map drops expired tokens on its own ticker, the expiry is checked against the clock here
+	if expired(tok.TokenExpiresAt) {
+		t.TokenMap.Delete(token)
+		return nil, false
+	}
 	return &tok, true
 }
 
@@ -72,12 +89,51 @@ func (t TokenStoreStruct) TokenExist(token string) (*suresql.TokenTable, bool) {
 func (t TokenStoreStruct) RefreshTokenExist(token string) (*suresql.TokenTable, bool) {
 	val, ok := t.RefreshTokenMap.Get(token)
 	if !ok {
-		return nil, false
+		return t.restoreRefreshToken(token)
 	}
 	tok := val.(suresql.TokenTable)
+	if expired(tok.RefreshExpiresAt) {
+		t.RefreshTokenMap.Delete(token)
+		return nil, false
+	}
+	return &tok, true
+}
+
+// restoreToken loads a persisted access token that is not in memory (ie: issued before a restart), its
+// DB connection is re-established on the first request like a reclaimed one
+func (t TokenStoreStruct) restoreToken(token string) (*suresql.TokenTable, bool) {
+	if !suresql.TokenPersistenceEnabled() {
+		return nil, false
+	}
+	tok, ok := suresql.LoadPersistedToken(token)
+	if !ok || expired(tok.TokenExpiresAt) {
+		return nil, false
+	}
+	t.TokenMap.Put(token, tok.TokenExpiresAt.Sub(suresql.CurrentClock.Now()), tok)
+	if suresql.ConnectionMgr != nil {
+		suresql.ConnectionMgr.MarkReclaimed(token)
+	}
 	return &tok, true
 }
 
+// restoreRefreshToken loads a persisted refresh token that is not in memory
+func (t TokenStoreStruct) restoreRefreshToken(refresh string) (*suresql.TokenTable, bool) {
+	if !suresql.TokenPersistenceEnabled() {
+		return nil, false
+	}
+	tok, ok := suresql.LoadPersistedRefresh(refresh)
+	if !ok || expired(tok.RefreshExpiresAt) {
+		return nil, false
+	}
+	t.RefreshTokenMap.Put(refresh, tok.RefreshExpiresAt.Sub(suresql.CurrentClock.Now()), tok)
+	return &tok, true
+}
+
+// expired reports whether the expiry time has passed on the clock, zero is no expiry
+func expired(at time.Time) bool {
+	return !at.IsZero() && !suresql.CurrentClock.Now().Before(at)
+}
+
 // This read from default _user table which is internal suresql table for username
 // NOTE: Password is NOT cleared in this function - caller must clear it after use
 func userNameExist(username string) (UserTable, error) {
@@ -89,7 +145,7 @@ func userNameExist(username string) (UserTable, error) {
 	}
 
 	var user UserTable
-	userRecord, err := suresql.CurrentNode.InternalConnection.SelectOneWithCondition(user.TableName(), &condition)
+	userRecord, err := suresql.CurrentNode.GetInternalConnection().SelectOneWithCondition(user.TableName(), &condition)
 	if err != nil {
 		return user, err
 	}
@@ -120,8 +176,17 @@ func createNewTokenResponse(user UserTable) suresql.TokenTable {
 	token.Refresh = encryption.NewRandomTokenIterate(TOKEN_LENGTH_MULTIPLIER)
 	token.UserID = fmt.Sprintf("%d", user.ID)
 	token.UserName = user.Username
-	token.TokenExpiresAt = time.Now().Add(suresql.DEFAULT_TOKEN_EXPIRES_MINUTES)
-	token.RefreshExpiresAt = time.Now().Add(suresql.DEFAULT_REFRESH_EXPIRES_MINUTES)
+	token.Tenant = user.Tenant
+	tokenExp, refreshExp := TokenStore.TokenExp, TokenStore.RefreshExp
+	if tokenExp <= 0 {
+		tokenExp = suresql.DEFAULT_TOKEN_EXPIRES_MINUTES
+	}
+	if refreshExp <= 0 {
+		refreshExp = suresql.DEFAULT_REFRESH_EXPIRES_MINUTES
+	}
+	now := suresql.CurrentClock.Now()
+	token.TokenExpiresAt = now.Add(tokenExp)
+	token.RefreshExpiresAt = now.Add(refreshExp)
 
 	// Store tokens in TTL maps with appropriate expiration times
 	TokenStore.SaveToken(token)
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/medatechnology/suresql"
+)
+
+func TestTokenExpiryFollowsClock(t *testing.T) {
+	clock := suresql.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	suresql.SetClock(clock)
+	defer suresql.SetClock(nil)
+	suresql.InitMetrics()
+
+	saved := TokenStore
+	defer func() { TokenStore = saved }()
+	// long TTLs so only the clock decides
+	TokenStore = NewTokenStore(time.Hour, 2*time.Hour, time.Hour)
+
+	token := createNewTokenResponse(UserTable{ID: 1, Username: "alice"})
+	if !token.TokenExpiresAt.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("token expires at %v, want an hour from now", token.TokenExpiresAt)
+	}
+
+	clock.Advance(59 * time.Minute)
+	if _, ok := TokenStore.TokenExist(token.Token); !ok {
+		t.Fatal("token expired early")
+	}
+	clock.Advance(time.Minute)
+	if _, ok := TokenStore.TokenExist(token.Token); ok {
+		t.Fatal("token still valid after its expiry")
+	}
+	if _, ok := TokenStore.RefreshTokenExist(token.Refresh); !ok {
+		t.Fatal("refresh token expired with the access token")
+	}
+	clock.Advance(time.Hour)
+	if _, ok := TokenStore.RefreshTokenExist(token.Refresh); ok {
+		t.Fatal("refresh token still valid after its expiry")
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/simplehttp"
+)
+
+const CLIENT_HEADER = "X-SureSQL-Client" // <sdk>/<version>, ie: suresql-go/1.4.2
+
+var ErrClientTooOld = medaerror.MedaError{Message: "client version is no longer supported"}
+
+// MiddlewareClientVersion warns clients below client/min_version and refuses the ones below
+// client/reject_below with 426 Upgrade Required
+func MiddlewareClientVersion() simplehttp.Middleware {
+	return simplehttp.WithName("client version", ClientVersionPolicy())
+}
+
+func ClientVersionPolicy() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			header := ctx.GetHeader(CLIENT_HEADER)
+			status, minimum := suresql.CheckClientVersion(header)
+			switch status {
+			case suresql.CLIENT_VERSION_REJECTED:
+				state := NewMiddlewareState(ctx, "client version")
+				return state.SetError("Client version is no longer supported", ErrClientTooOld, http.StatusUpgradeRequired).LogAndResponse("client "+header+" is no longer supported, upgrade to "+minimum+" or later", nil, true)
+			case suresql.CLIENT_VERSION_OUTDATED:
+				ctx.SetHeader("Deprecation", "true")
+				AddWarning(ctx, "client "+header+" is deprecated, upgrade to "+minimum+" or later")
+			}
+			return next(ctx)
+		}
+	}
+}
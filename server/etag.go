@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ETag support for reads. The tag is a hash of the content only (never execution time or other per-request
+// fields) so a client polling unchanged data can send If-None-Match and get a 304 without a body.
+
+const (
+	HEADER_ETAG          = "ETag"
+	HEADER_IF_NONE_MATCH = "If-None-Match"
+)
+
+// ContentETag returns a strong ETag of the JSON form of v, empty if it cannot be marshalled
+func ContentETag(v interface{}) string {
+	buf := getResponseBuffer()
+	defer buf.release()
+	b, err := buf.encode(v, responseCount(v))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ChecksumETag turns a stored hex checksum (ie: file sha256) into an ETag
+func ChecksumETag(checksum string) string {
+	if checksum == "" {
+		return ""
+	}
+	return `"` + checksum + `"`
+}
+
+// MatchETag reports whether the If-None-Match header value matches etag, per RFC 7232 weak comparison
+func MatchETag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified sets the ETag response header and, if the request If-None-Match matches it, logs and
+// responds 304. When it returns true the response is already written, return err from the handler.
+func (h *HandlerState) NotModified(etag string) (bool, error) {
+	if etag == "" {
+		return false, nil
+	}
+	h.Context.SetResponseHeader(HEADER_ETAG, etag)
+	if !MatchETag(h.Context.GetHeader(HEADER_IF_NONE_MATCH), etag) {
+		return false, nil
+	}
+	h.SaveStopTimer()
+	h.Status = http.StatusNotModified
+	h.OnlyLog("not modified, etag "+etag, nil, false)
+	return true, h.Context.String(http.StatusNotModified, "")
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// Extension points for programs embedding SureSQL, so they can add their own middleware and routes
+// without changing this package. Register everything before CreateServer, ie:
+//
+//	server.UseGlobal(companyAuth)
+//	server.AddRouteGroup("/reports", func(r simplehttp.Router) { r.GET("/daily", handleDaily) })
+//	srv := server.CreateServer(suresql.CurrentNode)
+//
+// Order of execution: built-in global middleware, then the ones from UseGlobal; for /db/api the built-in
+// signature/token/metering/backpressure checks, then the ones from UseAPI, so they see the token.
+
+var ErrServerCreated = medaerror.MedaError{Message: "server already created, register extensions before CreateServer"}
+
+// RouteGroup is a custom group of routes with its own middleware
+type RouteGroup struct {
+	Prefix     string
+	Middleware []simplehttp.Middleware
+	Setup      func(simplehttp.Router)
+}
+
+type extensionRegistry struct {
+	mu        sync.Mutex
+	created   bool
+	global    []simplehttp.Middleware
+	api       []simplehttp.Middleware
+	internal  []simplehttp.Middleware
+	apiRoutes []func(simplehttp.Router)
+	groups    []RouteGroup
+	onCreated []func(simplehttp.Server)
+}
+
+var extensions extensionRegistry
+
+func (e *extensionRegistry) add(fn func()) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.created {
+		simplelog.LogErrorAny("extension", ErrServerCreated, "extension ignored")
+		return ErrServerCreated
+	}
+	fn()
+	return nil
+}
+
+// UseGlobal adds middleware that runs for every request
+func UseGlobal(middleware ...simplehttp.Middleware) error {
+	return extensions.add(func() { extensions.global = append(extensions.global, middleware...) })
+}
+
+// UseAPI adds middleware to /db/api, it runs after the token is validated
+func UseAPI(middleware ...simplehttp.Middleware) error {
+	return extensions.add(func() { extensions.api = append(extensions.api, middleware...) })
+}
+
+// UseInternal adds middleware to the internal API (/suresql), it runs after basic auth
+func UseInternal(middleware ...simplehttp.Middleware) error {
+	return extensions.add(func() { extensions.internal = append(extensions.internal, middleware...) })
+}
+
+// AddAPIRoutes adds routes to /db/api, they get the same API key, token and metering checks as the
+// built-in ones (use NewHandlerTokenState in the handlers)
+func AddAPIRoutes(setup func(simplehttp.Router)) error {
+	return extensions.add(func() { extensions.apiRoutes = append(extensions.apiRoutes, setup) })
+}
+
+// AddRouteGroup adds a custom group of routes at prefix, only the global middleware applies to it
+func AddRouteGroup(prefix string, setup func(simplehttp.Router), middleware ...simplehttp.Middleware) error {
+	return extensions.add(func() {
+		extensions.groups = append(extensions.groups, RouteGroup{Prefix: prefix, Middleware: middleware, Setup: setup})
+	})
+}
+
+// OnServerCreated registers a function called at the end of CreateServer, before the server starts
+func OnServerCreated(fn func(simplehttp.Server)) error {
+	return extensions.add(func() { extensions.onCreated = append(extensions.onCreated, fn) })
+}
+
+// freeze stops accepting registrations, called by CreateServer
+func (e *extensionRegistry) freeze() {
+	e.mu.Lock()
+	e.created = true
+	e.mu.Unlock()
+}
+
+// registerGroups adds the custom route groups to the server
+func (e *extensionRegistry) registerGroups(server simplehttp.Server) {
+	for _, g := range e.groups {
+		group := server.Group(g.Prefix)
+		if len(g.Middleware) > 0 {
+			group.Use(g.Middleware...)
+		}
+		g.Setup(group)
+	}
+}
@@ -3,18 +3,19 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/medatechnology/suresql"
 
 	utils "github.com/medatechnology/goutil"
-	"github.com/medatechnology/goutil/medaerror"
 	"github.com/medatechnology/goutil/metrics"
 	"github.com/medatechnology/goutil/object"
 	"github.com/medatechnology/goutil/simplelog"
 	"github.com/medatechnology/simplehttp"
 	"github.com/medatechnology/simplehttp/framework/fiber"
+	orm "github.com/medatechnology/simpleorm"
 )
 
 // Define constants for token expiration and generation
@@ -48,6 +49,31 @@ func CreateServer(cnode suresql.SureSQLNode) simplehttp.Server {
 	// that is specific to simplehttp. While we want to use SureSQL setting.
 	config := simplehttp.LoadConfig()
 	CopySettingsFromSureSQL(cnode, config)
+	// Unix socket and systemd socket activation, forwarded to the TCP listener. An error is returned
+	// by Start, so a sidecar is never exposed on TCP because of a typo.
+	listen, listenErr := LoadListenConfig()
+	listenTarget := ""
+	// Transport settings first, with the front end fiber moves to loopback and the sockets follow it
+	var front *frontEnd
+	var reserved net.Listener // the loopback port fiber moved to, held until it starts
+	if listenErr == nil {
+		front, reserved, listenErr = LoadTransportConfig(config).apply(config, listen.TCP)
+	}
+	if listenErr == nil {
+		var socketPort net.Listener
+		// only without TCP, there is no front end then
+		if listenTarget, socketPort, listenErr = listen.apply(config); socketPort != nil {
+			reserved = socketPort
+		}
+	}
+	var services []frontService
+	if front != nil {
+		services = append(services, front)
+	}
+	// Peer mTLS listener, proxies to wherever the HTTP server ended up
+	if peer := loadPeerListener(config); peer != nil {
+		services = append(services, peer)
+	}
 	metrics.StopTimeItPrint(el, "Done")
 
 	el = metrics.StartTimeIt("Creating http server...", 0)
@@ -67,12 +93,62 @@ func CreateServer(cnode suresql.SureSQLNode) simplehttp.Server {
 	go suresql.StartConnectionCleanup(context.Background())
 	metrics.StopTimeItPrint(el, "Done")
 
+	// Initialize storage quota accounting
+	suresql.InitQuotaManager()
+
+	// Initialize usage metering for billing
+	suresql.InitMetering()
+	go suresql.StartMetering(context.Background())
+
+	// Initialize scheduled report delivery
+	suresql.InitReportScheduler()
+	go suresql.StartReportScheduler(context.Background())
+
+	// Initialize peer certificates (issued and rotated by the leader)
+	suresql.InitPeerTLS()
+	go suresql.StartPeerTLS(context.Background())
+
+	// Initialize the security event log (written in batches, exported to the SIEM)
+	suresql.InitSecurityEvents()
+	go suresql.StartSecurityEvents(context.Background())
+
+	// Initialize the periodic verification of row checksums
+	suresql.InitIntegrityVerifier()
+	go suresql.StartIntegrityVerifier(context.Background())
+
+	// Initialize the replica lag monitor (heartbeat on the leader, stale reads suspended when too far behind)
+	suresql.InitReplicaLagMonitor()
+	go suresql.StartReplicaLagMonitor(context.Background())
+
+	// Initialize the disk usage sampling (growth projected against disk/capacity_mb)
+	suresql.InitDiskUsageMonitor()
+	go suresql.StartDiskUsageMonitor(context.Background())
+
+	// Initialize the scheduled database maintenance (ANALYZE/VACUUM and the like, on the leader)
+	suresql.InitMaintenanceScheduler()
+	go suresql.StartMaintenanceScheduler(context.Background())
+
+	// Initialize the writer of queued inserts
+	suresql.InitWriteQueue()
+	go suresql.StartWriteQueue(context.Background())
+
+	// Initialize the write serializer (rqlite writes sent in batches when write_serializer/enabled)
+	suresql.InitWriteSerializer()
+	go suresql.StartWriteSerializer(context.Background())
+
+	// Initialize the rules engine (runs rules from the CDC log)
+	suresql.InitRuleEngine()
+	go suresql.StartRuleEngine(context.Background())
+
 	// Initialize and start alert monitoring
 	el = metrics.StartTimeIt("Starting alert monitoring system...", 0)
 	suresql.InitAlertManager()
 	go suresql.StartAlerting(context.Background())
 	metrics.StopTimeItPrint(el, "Done")
 
+	// Extensions registered by the embedding program are fixed from here on
+	extensions.freeze()
+
 	el = metrics.StartTimeIt("Registring endpoints ...", 0)
 	RegisterRoutes(server)
 	metrics.StopTimeItPrint(el, "Done")
@@ -88,7 +164,13 @@ func CreateServer(cnode suresql.SureSQLNode) simplehttp.Server {
 	RegisterMonitoringRoutes(server)
 	metrics.StopTimeItPrint(el, "Done")
 
-	return server
+	// Custom route groups from extensions
+	extensions.registerGroups(server)
+	for _, fn := range extensions.onCreated {
+		fn(server)
+	}
+
+	return withListeners(server, listen, listenTarget, services, reserved, listenErr)
 }
 
 // RegisterRoutes sets up all the routes for the SureSQL API
@@ -96,7 +178,7 @@ func RegisterRoutes(server simplehttp.Server) {
 	CORSConfig := &simplehttp.CORSConfig{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", CLIENT_HEADER, HEADER_ROUTE},
 		AllowCredentials: false,
 		MaxAge:           24 * time.Hour,
 	}
@@ -104,15 +186,19 @@ func RegisterRoutes(server simplehttp.Server) {
 	// Register global middleware
 	server.Use(
 		simplehttp.MiddlewareRecover(),
+		MiddlewareSecureHeaders(),
 		simplehttp.MiddlewareCORS(CORSConfig),
 		simplehttp.MiddlewareHeaderParser(), // use ctx.Get(simplehttp.REQUEST_HEADER_PARSED_STRING).(*RequestHeader) to get header
 		simplehttp.MiddlewareLogger(simplehttp.NewDefaultLogger()),
 	)
+	if len(extensions.global) > 0 {
+		server.Use(extensions.global...)
+	}
 	// server.UseMiddleware(LoggingMiddleware)
 
 	db := server.Group("/db")
 	// All API need API_KEY, later all queries need TOKEN
-	db.Use(MiddlewareAPIKeyHeader())
+	db.Use(MiddlewareAPIKeyHeader(), MiddlewareClientVersion(), MiddlewareMetering())
 	{
 		db.POST("/connect", HandleConnect)
 		db.POST("/refresh", HandleRefresh)
@@ -122,15 +208,43 @@ func RegisterRoutes(server simplehttp.Server) {
 		})
 	}
 
+	// a group starts without the middleware of its parent, the API key is checked again
 	api := db.Group("/api")
-	api.Use(MiddlwareTokenCheck())
+	api.Use(MiddlewareRouteStats(), MiddlewareAPIKeyHeader(), MiddlewareClientVersion(), MiddlewareSignature(), MiddlewareImpersonation(), MiddlwareTokenCheck(), MiddlewareMetering(), MiddlewareBackpressure(), MiddlewareQueryQueue(), MiddlewareShadow())
+	if len(extensions.api) > 0 {
+		api.Use(extensions.api...)
+	}
 	{
+		api.GET(PRESSURE_PATH, HandlePressure)
 		api.GET("/status", HandleDBStatus)
-		api.GET("/getschema", HandleGetSchema) // this is actually not working, because it should be used only for SaaS
+		api.GET("/getschema", deprecatedEndpoint("the schema is not exposed to the API, use /suresql/schema", HandleGetSchema)) // this is actually not working, because it should be used only for SaaS
 		api.POST("/sql", HandleSQLExecution)
 		api.POST("/query", HandleQuery)
 		api.POST("/querysql", HandleSQLQuery)
+		api.POST("/aggregate", HandleAggregate)
 		api.POST("/insert", HandleInsert)
+		api.POST("/import/csv", HandleImportCSV)
+		api.GET("/queue", HandleWriteQueue)
+		api.POST("/upsert", HandleUpsert)
+		api.POST("/update", HandleUpdate)
+		api.POST("/update/batch", HandleBatchUpdate)
+		api.POST("/delete", HandleDelete)
+		api.GET("/usage", HandleStorageUsage)
+		api.POST("/report", HandleReport)
+		api.POST("/files", HandleUploadFile)
+		api.GET("/files", HandleDownloadFile)
+		api.GET("/files/list", HandleListFiles)
+		api.DELETE("/files", HandleDeleteFile)
+		api.POST("/procedures/:name", HandleCallProcedure)
+		api.POST("/tx/begin", HandleTxBegin)
+		api.POST("/tx/exec", HandleTxExec)
+		api.POST("/tx/commit", HandleTxCommit)
+		api.POST("/tx/rollback", HandleTxRollback)
+
+		for _, setup := range extensions.apiRoutes {
+			setup(api)
+		}
+		registerPlugins(api)
 	}
 
 }
@@ -155,11 +269,13 @@ func HandleConnect(ctx simplehttp.Context) error {
 	// Check by username, NOTE: do we need to change this to user.ID instead?
 	user, err := userNameExist(connectReq.Username)
 	if err != nil {
+		state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, connectReq.Username, "connect with unknown username")
 		return state.SetError("Invalid credentials", nil, http.StatusUnauthorized).LogAndResponse("user not found", err, true)
 	}
 
 	// Verify password - in a real system, use proper password hashing
 	if passwordMatch(user, connectReq.Password) != nil {
+		state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, connectReq.Username, "connect with wrong password")
 		return state.SetError("Invalid credentials", nil, http.StatusUnauthorized).
 			LogAndResponse("password missmatch for user:"+connectReq.Username, err, true)
 	}
@@ -168,10 +284,14 @@ func HandleConnect(ctx simplehttp.Context) error {
 	user.Password = ""
 
 	// Copy the configuration from internal connection
-	configCopy := suresql.CurrentNode.InternalConfig
+	configCopy := suresql.CurrentNode.GetInternalConfig()
 	// configCopy.Username = user.Username
 	state.User = user.Username
 
+	if err := suresql.InjectFault(suresql.FAULT_TARGET_CONNECTION); err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+
 	// Create a new database connection with the copied config
 	newDB, err := suresql.NewDatabase(configCopy)
 	if err != nil {
@@ -185,20 +305,26 @@ func HandleConnect(ctx simplehttp.Context) error {
 	tokenResponse := createNewTokenResponse(user)
 	// state.OnlyLog("Generated tokens for user: "+user.Username, nil, true)
 
+	// Pool is full, try to free the slots held by idle connections before refusing
+	if !suresql.CurrentNode.IsPoolAvailable() && suresql.ConnectionMgr != nil {
+		suresql.ConnectionMgr.ReclaimIdleConnections()
+	}
+
 	// Add to connection pool if enabled
 	if suresql.CurrentNode.IsPoolAvailable() {
 		suresql.CurrentNode.DBConnections.Put(tokenResponse.Token, 0, newDB)
+		if suresql.ConnectionMgr != nil {
+			suresql.ConnectionMgr.TouchConnection(tokenResponse.Token)
+		}
 		// Record successful connection creation
 		suresql.Metrics.RecordConnectionCreated()
 		suresql.Metrics.RecordAuthentication(true)
 		// state.OnlyLog(fmt.Sprintf("Added new connection to pool, current size: %d/%d", suresql.suresql.CurrentNode.DBConnections.Len(), suresql.CurrentNode.MaxPool), nil, true)
 	} else {
-		err := medaerror.NewString("db pool quota exceeded")
 		// Record pool exhaustion
 		suresql.Metrics.RecordPoolExhaustion()
 		suresql.Metrics.RecordAuthentication(false)
-		return state.SetError("Failed to create database connection, quota exceeded", err, http.StatusNotAcceptable).
-			LogAndResponse("cannot create database connection, quota exceeded", nil, true)
+		return respondBackpressure(&state, suresql.CurrentPressure(), "Failed to create database connection, quota exceeded", http.StatusServiceUnavailable)
 	}
 
 	// Return tokens in response
@@ -209,7 +335,7 @@ func HandleConnect(ctx simplehttp.Context) error {
 
 // HandleRefresh refreshes an existing token
 func HandleRefresh(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/refresh", "cache/ttlmap")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/refresh", "cache/ttlmap")
 
 	// Parse request body
 	// var refreshReq RefreshRequest
@@ -222,6 +348,12 @@ func HandleRefresh(ctx simplehttp.Context) error {
 	// username, ok := RefreshTokenMap.Get(refreshReq.RefreshToken)
 	tokmap, ok := TokenStore.RefreshTokenExist(refreshReq.Refresh)
 	if !ok {
+		// a refresh token is single use, presenting it again means it was copied by someone
+		if used, reused := TokenStore.UsedRefreshTokenMap.Get(refreshReq.Refresh); reused {
+			state.SecurityEvent(suresql.SECURITY_EVENT_TOKEN_REUSE, suresql.SECURITY_SEVERITY_CRITICAL, used.(string), "refresh token used again")
+		} else {
+			state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_INFO, "", "invalid or expired refresh token")
+		}
 		return state.SetError("Invalid or expired refresh token", nil, http.StatusUnauthorized).
 			LogAndResponse("Invalid or expired refresh token:"+refreshReq.Refresh, nil, true)
 	}
@@ -246,6 +378,9 @@ func HandleRefresh(ctx simplehttp.Context) error {
 
 	// Remove old connection from pool
 	suresql.CurrentNode.DBConnections.Delete(tokmap.Token)
+	if suresql.ConnectionMgr != nil {
+		suresql.ConnectionMgr.ForgetConnection(tokmap.Token)
+	}
 
 	// Create new database connection
 	configCopy := suresql.CurrentNode.GetInternalConfig()
@@ -256,29 +391,57 @@ func HandleRefresh(ctx simplehttp.Context) error {
 	}
 
 	// Generate new tokens
-	tokenResponse := createNewTokenResponse(UserTable{Username: tokmap.UserName, ID: object.Int(tokmap.UserID, false)})
+	tokenResponse := createNewTokenResponse(UserTable{Username: tokmap.UserName, ID: object.Int(tokmap.UserID, false), Tenant: tokmap.Tenant})
 
 	// Add new connection to pool with new token
+	if !suresql.CurrentNode.IsPoolAvailable() && suresql.ConnectionMgr != nil {
+		suresql.ConnectionMgr.ReclaimIdleConnections()
+	}
 	if suresql.CurrentNode.IsPoolAvailable() {
 		suresql.CurrentNode.DBConnections.Put(tokenResponse.Token, 0, newDB)
+		if suresql.ConnectionMgr != nil {
+			suresql.ConnectionMgr.TouchConnection(tokenResponse.Token)
+		}
 		// Record successful connection creation and refresh token usage
 		suresql.Metrics.RecordConnectionCreated()
 		suresql.Metrics.RecordRefreshTokenUsed()
 	} else {
 		// Record pool exhaustion
 		suresql.Metrics.RecordPoolExhaustion()
-		return state.SetError("Connection pool full", medaerror.NewString("pool quota exceeded"), http.StatusServiceUnavailable).
-			LogAndResponse("cannot create new connection, pool full", nil, true)
+		return respondBackpressure(&state, suresql.CurrentPressure(), "Connection pool full", http.StatusServiceUnavailable)
 	}
 
 	// Remove old refresh token from store
 	TokenStore.RefreshTokenMap.Delete(refreshReq.Refresh)
+	TokenStore.UsedRefreshTokenMap.Put(refreshReq.Refresh, 0, tokmap.UserName)
+	if suresql.TokenPersistenceEnabled() {
+		if err := suresql.DeletePersistedRefresh(refreshReq.Refresh); err != nil {
+			simplelog.LogErrorAny("refresh", err, "failed to delete persisted refresh token")
+		}
+	}
 
 	return state.SetSuccess("Token refreshed successfully", tokenResponse).
 		LogAndResponse("refreshed tokens for user: "+tokmap.UserName, nil, true)
 
 }
 
+// nodeStatusSnapshot is the status response, the status fields stay flat and the operational snapshot
+// (lag, routes, pool, tokens, peers and write batching) is added next to them so one call replaces the monitoring ones
+type nodeStatusSnapshot struct {
+	orm.NodeStatusStruct
+	ReplicaLag *suresql.ReplicaLag    `json:"replica_lag,omitempty"`
+	Routes     []suresql.RouteStat    `json:"routes"`
+	Pool       map[string]interface{} `json:"pool"`
+	Tokens     map[string]interface{} `json:"tokens"`
+	PeerHealth []suresql.PeerHealth   `json:"peer_health"`
+	// status and schema calls answered by the DBMS call of another caller
+	CoalescedCalls int64 `json:"coalesced_calls"`
+	// querysql selects answered by the execution of an identical select
+	SharedQueries int64 `json:"shared_queries"`
+	// only when write_serializer/enabled
+	WriteSerializer *suresql.WriteSerializerStatus `json:"write_serializer,omitempty"`
+}
+
 // HandleDBStatus returns the current database status
 func HandleDBStatus(ctx simplehttp.Context) error {
 	state := NewHandlerTokenState(ctx, "db_status", "ttlmap/db")
@@ -289,9 +452,9 @@ func HandleDBStatus(ctx simplehttp.Context) error {
 	}
 
 	// Find the user's database connection from TTL map
-	userDB, err := suresql.CurrentNode.GetDBConnectionByToken(state.Token.Token)
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
 	if err != nil {
-		return state.SetError("Cannot get DB connection", err, http.StatusInternalServerError).LogAndResponse("cannot get DB connection, maybe disconnected", nil, true)
+		return respondDBConnectionError(&state, err)
 		// returnErrorResponse(ctx, http.StatusUnauthorized, "Cannot get DB connection", err)
 	}
 
@@ -304,17 +467,33 @@ func HandleDBStatus(ctx simplehttp.Context) error {
 	}
 	msg := "Status peers vs config mismatched"
 	// TODO: check which one is valid, from the RQLIte status vs SureSQLNode.Config which we put to status
-	if len(suresql.CurrentNode.Status.Peers) == len(status.Peers) {
-		msg = "Status peers vs config matched"
-	}
-
 	// NOTE: should we return the uptime of the DBMS behind SureSQL or just the uptime of SureSQL service server instead?
 	// Now we are returning the server uptime, not the DBMS. If want the DBMS then set this to: status.Uptime.
-	suresql.CurrentNode.Status.Uptime = time.Since(suresql.ServerStartTime) // this is refreshed when Status handler is called
+	suresql.CurrentNode.UpdateStatus(func(s *orm.NodeStatusStruct) {
+		s.Uptime = time.Since(suresql.ServerStartTime) // this is refreshed when Status handler is called
+	})
+	nodeStatus := suresql.CurrentNode.GetStatus()
+	if len(nodeStatus.Peers) == len(status.Peers) {
+		msg = "Status peers vs config matched"
+	}
 
 	// return state.SetSuccess(msg, suresql.CurrentNode.Status).LogAndResponse(fmt.Sprintf("user: %s, db status: %s", state.User, status), suresql.CurrentNode.Settings, true)
 	// Decided not to log the data for success
-	return state.SetSuccess(msg, suresql.CurrentNode.Status).LogAndResponse(fmt.Sprintf("client user: %s", state.User), nil, true)
+	snapshot := nodeStatusSnapshot{
+		NodeStatusStruct: nodeStatus,
+		ReplicaLag:       suresql.CurrentReplicaLag(), // only when replicas are monitored
+		Routes:           suresql.GetRouteStats(),
+		Pool:             suresql.GetConnectionPoolStats(),
+		Tokens:           tokenCounts(),
+		PeerHealth:       suresql.PeerHealthSnapshot(),
+		CoalescedCalls:   suresql.CoalescedBackendCalls(),
+		SharedQueries:    suresql.SharedQueries(),
+	}
+	if suresql.WriteS != nil && suresql.WriteSerializerEnabled() {
+		status := suresql.WriteS.Status()
+		snapshot.WriteSerializer = &status
+	}
+	return state.SetSuccess(msg, snapshot).LogAndResponse(fmt.Sprintf("client user: %s", state.User), nil, true)
 	// return state.SetSuccess(msg, map[string]interface{}{
 	// 	"status":       suresql.CurrentNode.Status,
 	// 	"node_info":    suresql.CurrentNode.Settings,
@@ -328,3 +507,15 @@ func HandleDBStatus(ctx simplehttp.Context) error {
 	// 	"connected_as": token.UserName,
 	// })
 }
+
+// tokenCounts are the token metrics with the live tokens of the token store
+func tokenCounts() map[string]interface{} {
+	counts := suresql.GetTokenStats()
+	if TokenStore.TokenMap != nil {
+		counts["tokens_active"] = TokenStore.TokenMap.Len()
+	}
+	if TokenStore.RefreshTokenMap != nil {
+		counts["refresh_tokens_active"] = TokenStore.RefreshTokenMap.Len()
+	}
+	return counts
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// requestStatements are the raw and parameterized statements of a SQL request
+func requestStatements(req suresql.SQLRequest) []string {
+	statements := make([]string, 0, len(req.Statements)+len(req.ParamSQL))
+	statements = append(statements, req.Statements...)
+	for _, p := range req.ParamSQL {
+		statements = append(statements, p.Query)
+	}
+	return statements
+}
+
+// HandleAdvisor returns the recommended indexes and the slow statements they come from, ?ddl=true adds
+// the CREATE INDEX statements for review
+func HandleAdvisor(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/advisor", "advisor")
+
+	recommendations, err := suresql.Advise(ctx.GetQueryParam("ddl") == "true")
+	if err != nil {
+		return state.SetError("Failed to analyze the slow statements", err, http.StatusInternalServerError).LogAndResponse("index advisor failed", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Index recommendations: %d", len(recommendations)), map[string]interface{}{
+		"recommendations": recommendations,
+		"slow_statements": suresql.ListSlowStatements(),
+		"slow_ms":         suresql.SlowRequestThreshold().Milliseconds(),
+	}).LogAndResponse("index advisor", nil, false)
+}
+
+// HandleClearAdvisor empties the slow statement log
+func HandleClearAdvisor(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/advisor", "advisor")
+
+	suresql.ClearSlowStatements()
+	return state.SetSuccess("Slow statement log cleared", nil).LogAndResponse("slow statement log cleared", nil, true)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleAggregate processes aggregate requests: COUNT, SUM, AVG, MIN and MAX of the rows matching the
+// condition, per group of the group_by columns
+func HandleAggregate(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/aggregate/", "request")
+
+	// Get username from context (set by TokenValidationFromTTL)
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	// Parse request body
+	var aggregateReq suresql.AggregateRequest
+	if err := ctx.BindJSON(&aggregateReq); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+
+	// Validate that table name is provided
+	if aggregateReq.Table == "" {
+		return state.SetError("Table name is required", nil, http.StatusBadRequest).LogAndResponse("no table name in request body", nil, true)
+	}
+
+	// Reject bad names, functions and operators before going to the DB
+	paramSQL, functions, err := suresql.BuildAggregateRequest(aggregateReq)
+	if err != nil {
+		return state.SetError("Invalid aggregate", err, http.StatusBadRequest).LogAndResponse("aggregate validation failed", err, true)
+	}
+	state.Statements = []string{paramSQL.Query}
+
+	// Find the user's database connection from TTL map
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+	userDB, done, err := state.RouteRead(userDB)
+	if done {
+		return err
+	}
+	userDB, done, err = state.ConsistentRead(userDB, aggregateReq.Consistency, aggregateReq.Freshness)
+	if done {
+		return err
+	}
+
+	state.Label += "Aggregate"
+	rows, err := suresql.AggregateRows(userDB, paramSQL, functions)
+	if err != nil {
+		return state.SetError("Failed to execute aggregate", err, http.StatusInternalServerError).LogAndResponse("failed to execute aggregate", aggregateReq, true)
+	}
+
+	response := suresql.AggregateResponse{
+		Rows:       rows,
+		Aggregates: functions,
+		Count:      len(rows),
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, response.Count, 0)
+	if done, err := state.NotModified(ContentETag(response.Rows)); done {
+		return err
+	}
+	return state.SetSuccess("Aggregate executed successfully", response).LogAndResponse("aggregate executed successfully", response, true)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleBatchUpdate processes batch update requests: every record updates the row of its key, in one round trip
+func HandleBatchUpdate(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/update/batch/", "request")
+
+	// Get username from context (set by TokenValidationFromTTL)
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	// Parse request body
+	var batchReq suresql.BatchUpdateRequest
+	if err := ctx.BindJSON(&batchReq); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+
+	// Validate that records are provided, and not too many
+	numRecs := len(batchReq.Records)
+	if numRecs == 0 {
+		return state.SetError("No records provided", nil, http.StatusBadRequest).LogAndResponse("no records in request body", nil, true)
+	}
+	if numRecs > suresql.BATCH_UPDATE_MAX_RECORDS {
+		return state.SetError(fmt.Sprintf("Too many records, at most %d per batch", suresql.BATCH_UPDATE_MAX_RECORDS), nil, http.StatusBadRequest).LogAndResponse("batch update too large", numRecs, true)
+	}
+
+	// Keys, names and values of every record are checked before going to the DB, all problems at once
+	statements, fieldErrs := suresql.BuildBatchUpdate(batchReq)
+	if len(fieldErrs) > 0 {
+		return state.SetError(fmt.Sprintf("Invalid records: %d problems found", len(fieldErrs)), nil, http.StatusBadRequest).LogAndResponse("batch update validation failed", fieldErrs, true)
+	}
+	for _, s := range statements {
+		state.Statements = append(state.Statements, s.Query)
+	}
+
+	// ClickHouse tables are append-only
+	if err := suresql.CheckAppendOnly(state.Statements); err != nil {
+		return state.SetError("Tables of this DBMS are append-only", err, http.StatusForbidden).LogAndResponse("batch update refused", nil, true)
+	}
+
+	// Find the user's database connection from TTL map
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+	defer suresql.ResultCache.InvalidateRecords(batchReq.Records)
+
+	if batchReq.Atomic {
+		state.Label += "BatchUpdateAtomic"
+	} else {
+		state.Label += "BatchUpdate"
+	}
+	results, err := suresql.BatchUpdateRows(userDB, batchReq, statements)
+	if err == suresql.ErrAtomicNotSupported {
+		return state.SetError("Atomic batches are not supported by this DBMS", err, http.StatusNotImplemented).LogAndResponse("atomic batch not supported", nil, true)
+	}
+	if err != nil {
+		msg := "Failed to update records"
+		if batchReq.Atomic {
+			msg = "Batch update failed and was rolled back"
+		}
+		return state.SetError(msg, err, http.StatusInternalServerError).LogAndResponse("failed to batch update records", numRecs, true)
+	}
+
+	response := suresql.BatchUpdateResponse{Results: results}
+	for i, r := range results {
+		switch {
+		case r.Error != nil:
+			response.Failed = append(response.Failed, i)
+		case r.RowsAffected == 0:
+			response.NotFound = append(response.NotFound, i)
+		}
+		response.RowsAffected += r.RowsAffected
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, 0, response.RowsAffected)
+	msg := fmt.Sprintf("Updated %d of %d records, %d not found, %d failed", numRecs-len(response.NotFound)-len(response.Failed), numRecs, len(response.NotFound), len(response.Failed))
+	return state.SetSuccess(msg, response).LogAndResponse("batch update done", response, true)
+}
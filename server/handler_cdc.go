@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// CDCRequest enables change capture on a table
+type CDCRequest struct {
+	Table     string `json:"table"`
+	KeyColumn string `json:"key_column,omitempty"` // default id
+}
+
+// HandleListCDCTables lists the tables covered by CDC (internal)
+func HandleListCDCTables(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_cdc", suresql.CDCTable{}.TableName())
+
+	tables, err := suresql.ListCDCTables()
+	if err != nil {
+		return state.SetError("Failed to list cdc tables", err, http.StatusInternalServerError).LogAndResponse("failed to list cdc tables", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("CDC tables retrieved successfully: %d", len(tables)), tables).LogAndResponse(fmt.Sprintf("success count:%d", len(tables)), nil, true)
+}
+
+// HandleEnableCDC installs the capture triggers on a table, calling it again refreshes the column list (internal)
+func HandleEnableCDC(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "enable_cdc", suresql.CDCTable{}.TableName())
+
+	var req CDCRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	cfg, err := suresql.EnableCDC(req.Table, req.KeyColumn)
+	if err != nil {
+		switch err {
+		case suresql.ErrCDCUnsupported, suresql.ErrCDCNoKeyColumn, suresql.ErrCDCTableColumns:
+			return state.SetError(err.Error(), err, http.StatusBadRequest).LogAndResponse("cannot enable cdc on "+req.Table, nil, true)
+		}
+		return state.SetError("Failed to enable cdc", err, http.StatusInternalServerError).LogAndResponse("failed to enable cdc on "+req.Table, nil, true)
+	}
+	return state.SetSuccess("CDC enabled successfully", cfg).LogAndResponse("cdc enabled on "+req.Table, nil, true)
+}
+
+// HandleDisableCDC drops the capture triggers of ?table=, the log is kept (internal)
+func HandleDisableCDC(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "disable_cdc", suresql.CDCTable{}.TableName())
+
+	table := ctx.GetQueryParam("table")
+	if err := suresql.ValidateTableName(table, false); err != nil {
+		return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
+	}
+	if err := suresql.DisableCDC(table); err != nil {
+		return state.SetError("Failed to disable cdc", err, http.StatusInternalServerError).LogAndResponse("failed to disable cdc on "+table, nil, true)
+	}
+	return state.SetSuccess("CDC disabled successfully", nil).LogAndResponse("cdc disabled on "+table, nil, true)
+}
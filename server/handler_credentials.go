@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// CredentialsRequest is the body of /suresql/dbms/rotate-credentials
+type CredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// HandleCredentialRotationStatus returns the step of the last DBMS credential rotation (internal)
+func HandleCredentialRotationStatus(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/dbms/credentials", "credentials")
+
+	status := suresql.Credentials.Status()
+	return state.SetSuccess("Credential rotation "+status.Phase, status).LogAndResponse("credential rotation status", nil, false)
+}
+
+// HandleRotateCredentials verifies new DBMS credentials and moves the node to them without a restart, the
+// pool is re-keyed in the background (internal)
+func HandleRotateCredentials(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/dbms/rotate-credentials", "credentials")
+
+	// the body has a password, it is never logged
+	var req CredentialsRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	status, err := suresql.Credentials.Rotate(req.Username, req.Password)
+	if err != nil {
+		code := http.StatusUnprocessableEntity
+		switch err {
+		case suresql.ErrRotationMissing:
+			code = http.StatusBadRequest
+		case suresql.ErrRotationRunning:
+			code = http.StatusConflict
+		default:
+			state.SecurityEvent(suresql.SECURITY_EVENT_CREDENTIALS, suresql.SECURITY_SEVERITY_WARNING, req.Username, "new DBMS credentials failed the test connection")
+		}
+		return state.SetError("Credential rotation failed", err, code).LogAndResponse("credential rotation failed", nil, true)
+	}
+	state.SecurityEvent(suresql.SECURITY_EVENT_CREDENTIALS, suresql.SECURITY_SEVERITY_INFO, req.Username, "DBMS credentials rotated")
+	return state.SetSuccess("DBMS credentials rotated, re-keying the pool", status).LogAndResponse("credentials rotated", nil, true)
+}
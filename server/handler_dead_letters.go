@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListDeadLetters lists the newest dead letters, filters ?source= ?status= ?limit= (internal)
+func HandleListDeadLetters(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_dead_letters", suresql.DeadLetterTable{}.TableName())
+
+	limit, _ := strconv.Atoi(ctx.GetQueryParam("limit"))
+	letters, err := suresql.ListDeadLetters(ctx.GetQueryParam("source"), ctx.GetQueryParam("status"), limit)
+	if err != nil {
+		return state.SetError("Failed to list dead letters", err, http.StatusInternalServerError).LogAndResponse("failed to list dead letters", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Dead letters retrieved successfully: %d", len(letters)), letters).LogAndResponse(fmt.Sprintf("success count:%d", len(letters)), nil, true)
+}
+
+// HandleRetryDeadLetter retries ?id=, or every pending dead letter of ?source= (internal)
+func HandleRetryDeadLetter(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "retry_dead_letter", suresql.DeadLetterTable{}.TableName())
+
+	if idParam := ctx.GetQueryParam("id"); idParam != "" {
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			return state.SetError("Invalid dead letter id", err, http.StatusBadRequest).LogAndResponse("invalid dead letter id", nil, true)
+		}
+		letter, err := suresql.GetDeadLetter(id)
+		if err != nil {
+			if err == suresql.ErrDeadLetterNotFound {
+				return state.SetError("Dead letter not found", err, http.StatusNotFound).LogAndResponse("dead letter not found", id, true)
+			}
+			return state.SetError("Failed to get dead letter", err, http.StatusInternalServerError).LogAndResponse("failed to get dead letter", id, true)
+		}
+		if err := suresql.RetryDeadLetter(letter); err != nil {
+			return state.SetError("Retry failed", err, http.StatusBadGateway).LogAndResponse(fmt.Sprintf("dead letter %d retry failed", id), nil, true)
+		}
+		return state.SetSuccess("Dead letter retried successfully", nil).LogAndResponse(fmt.Sprintf("dead letter %d resolved", id), nil, true)
+	}
+
+	source := ctx.GetQueryParam("source")
+	if source == "" {
+		return state.SetError("id or source is required", nil, http.StatusBadRequest).LogAndResponse("missing id or source", nil, true)
+	}
+	letters, err := suresql.ListDeadLetters(source, suresql.DEAD_LETTER_STATUS_PENDING, 0)
+	if err != nil {
+		return state.SetError("Failed to list dead letters", err, http.StatusInternalServerError).LogAndResponse("failed to list dead letters", nil, true)
+	}
+	resolved := 0
+	for _, letter := range letters {
+		if suresql.RetryDeadLetter(letter) == nil {
+			resolved++
+		}
+	}
+	result := map[string]int{"retried": len(letters), "resolved": resolved}
+	return state.SetSuccess(fmt.Sprintf("Retried %d dead letters, %d resolved", len(letters), resolved), result).LogAndResponse("dead letters of "+source+" retried", result, true)
+}
+
+// HandlePurgeDeadLetters deletes ?id=, or by ?source= ?status= ?before=YYYY-MM-DD (internal)
+func HandlePurgeDeadLetters(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "purge_dead_letters", suresql.DeadLetterTable{}.TableName())
+
+	if idParam := ctx.GetQueryParam("id"); idParam != "" {
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			return state.SetError("Invalid dead letter id", err, http.StatusBadRequest).LogAndResponse("invalid dead letter id", nil, true)
+		}
+		if err := suresql.DeleteDeadLetter(id); err != nil {
+			return state.SetError("Failed to delete dead letter", err, http.StatusInternalServerError).LogAndResponse("failed to delete dead letter", id, true)
+		}
+		return state.SetSuccess("Dead letter deleted successfully", nil).LogAndResponse(fmt.Sprintf("dead letter %d deleted", id), nil, true)
+	}
+
+	source, status := ctx.GetQueryParam("source"), ctx.GetQueryParam("status")
+	var before time.Time
+	if b := ctx.GetQueryParam("before"); b != "" {
+		var err error
+		if before, err = time.Parse("2006-01-02", b); err != nil {
+			return state.SetError("before must be YYYY-MM-DD", err, http.StatusBadRequest).LogAndResponse("invalid before date", nil, true)
+		}
+	}
+	if source == "" && status == "" && before.IsZero() {
+		return state.SetError("id, source, status or before is required", nil, http.StatusBadRequest).LogAndResponse("refusing to purge all dead letters", nil, true)
+	}
+	deleted, err := suresql.PurgeDeadLetters(source, status, before)
+	if err != nil {
+		return state.SetError("Failed to purge dead letters", err, http.StatusInternalServerError).LogAndResponse("failed to purge dead letters", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Purged %d dead letters", deleted), nil).LogAndResponse(fmt.Sprintf("purged %d dead letters", deleted), nil, true)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleDelete processes delete requests: the rows of the table matching the condition are deleted
+func HandleDelete(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/delete/", "request")
+
+	// Get username from context (set by TokenValidationFromTTL)
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	// Parse request body
+	var deleteReq suresql.DeleteRequest
+	if err := ctx.BindJSON(&deleteReq); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+
+	// Validate that table name is provided
+	if deleteReq.Table == "" {
+		return state.SetError("Table name is required", nil, http.StatusBadRequest).LogAndResponse("no table name in request body", nil, true)
+	}
+
+	// Reject bad names, operators and a condition-less delete before going to the DB
+	paramSQL, err := suresql.BuildDeleteRequest(deleteReq)
+	if err != nil {
+		return state.SetError("Invalid delete", err, http.StatusBadRequest).LogAndResponse("delete validation failed", err, true)
+	}
+	state.Statements = []string{paramSQL.Query}
+
+	// ClickHouse tables are append-only
+	if err := suresql.CheckAppendOnly(state.Statements); err != nil {
+		return state.SetError("Tables of this DBMS are append-only", err, http.StatusForbidden).LogAndResponse("delete refused", deleteReq.Table, true)
+	}
+
+	// Find the user's database connection from TTL map
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+	defer suresql.ResultCache.InvalidateTables(deleteReq.Table)
+
+	if deleteReq.AllowFullDelete {
+		state.Label += "DeleteAllRows"
+	} else {
+		state.Label += "DeleteWithCondition"
+	}
+	result := userDB.ExecOneSQLParameterized(paramSQL)
+	if result.Error != nil {
+		return state.SetError("Failed to delete records", result.Error, http.StatusInternalServerError).LogAndResponse("failed to delete records", deleteReq, true)
+	}
+
+	response := suresql.SQLResponse{
+		Results:      []orm.BasicSQLResult{result},
+		RowsAffected: result.RowsAffected,
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, 0, response.RowsAffected)
+	return state.SetSuccess(fmt.Sprintf("Successfully deleted %d records", response.RowsAffected), response).LogAndResponse("delete successfully", response, true)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListDerivedTables lists the derived table definitions with their refresh status (internal)
+func HandleListDerivedTables(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_derived", suresql.DerivedTable{}.TableName())
+
+	tables, err := suresql.ListDerivedTables()
+	if err != nil {
+		return state.SetError("Failed to list derived tables", err, http.StatusInternalServerError).LogAndResponse("failed to list derived tables", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Derived tables retrieved successfully: %d", len(tables)), tables).LogAndResponse(fmt.Sprintf("success count:%d", len(tables)), nil, true)
+}
+
+// HandleSaveDerivedTable creates or replaces a derived table definition and builds the table (internal)
+func HandleSaveDerivedTable(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_derived", suresql.DerivedTable{}.TableName())
+
+	var derived suresql.DerivedTable
+	if err := ctx.BindJSON(&derived); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if err := derived.Validate(); err != nil {
+		return state.SetError("Invalid derived table", err, http.StatusBadRequest).LogAndResponse("derived table validation failed", nil, true)
+	}
+	derived, err := suresql.SaveDerivedTable(derived)
+	if err != nil {
+		return state.SetError("Failed to build derived table", err, http.StatusBadRequest).LogAndResponse("failed to save derived table "+derived.Name, nil, true)
+	}
+	return state.SetSuccess("Derived table saved successfully", derived).LogAndResponse("derived table "+derived.Name+" saved", nil, true)
+}
+
+// HandleRebuildDerivedTable recomputes the whole derived table ?name= (internal)
+func HandleRebuildDerivedTable(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "rebuild_derived", suresql.DerivedTable{}.TableName())
+
+	derived, err := suresql.GetDerivedTable(ctx.GetQueryParam("name"))
+	if err != nil {
+		if err == suresql.ErrDerivedTableNotFound {
+			return state.SetError("Derived table not found", err, http.StatusNotFound).LogAndResponse("derived table not found", nil, true)
+		}
+		return state.SetError("Failed to get derived table", err, http.StatusInternalServerError).LogAndResponse("failed to get derived table", nil, true)
+	}
+	if derived, err = suresql.RebuildDerivedTable(derived); err != nil {
+		return state.SetError("Failed to rebuild derived table", err, http.StatusInternalServerError).LogAndResponse("failed to rebuild derived table "+derived.Name, nil, true)
+	}
+	return state.SetSuccess("Derived table rebuilt successfully", derived).LogAndResponse("derived table "+derived.Name+" rebuilt", nil, true)
+}
+
+// HandleDeleteDerivedTable removes the definition ?name=, the table and its data are kept (internal)
+func HandleDeleteDerivedTable(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_derived", suresql.DerivedTable{}.TableName())
+
+	name := ctx.GetQueryParam("name")
+	if name == "" {
+		return state.SetError("Derived table name is required", nil, http.StatusBadRequest).LogAndResponse("missing derived table name", nil, true)
+	}
+	if err := suresql.DeleteDerivedTable(name); err != nil {
+		return state.SetError("Failed to delete derived table", err, http.StatusInternalServerError).LogAndResponse("failed to delete derived table", nil, true)
+	}
+	return state.SetSuccess("Derived table deleted successfully", nil).LogAndResponse("derived table "+name+" deleted", nil, true)
+}
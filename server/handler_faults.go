@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleFaultStatus returns the active fault injection, if any, and the injected counts (internal)
+func HandleFaultStatus(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "fault_status", "faults")
+	return state.SetSuccess("Fault injection status", suresql.GetFaultStatus()).LogAndResponse("fault injection status", nil, true)
+}
+
+// HandleEnableFaults starts injecting faults on this node (internal)
+func HandleEnableFaults(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "enable_faults", "faults")
+
+	var config suresql.FaultConfig
+	if err := ctx.BindJSON(&config); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	config, err := suresql.EnableFaults(config)
+	if err != nil {
+		return state.SetError("Invalid fault config", err, http.StatusBadRequest).LogAndResponse("fault config validation failed", config, true)
+	}
+	return state.SetSuccess("Fault injection enabled", config).LogAndResponse("fault injection enabled until "+config.ExpiresAt.String(), config, true)
+}
+
+// HandleDisableFaults stops injecting faults (internal)
+func HandleDisableFaults(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "disable_faults", "faults")
+	suresql.DisableFaults()
+	return state.SetSuccess("Fault injection disabled", suresql.GetFaultStatus()).LogAndResponse("fault injection disabled", nil, true)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// Upload, download, list and delete binary attachments linked to rows. Upload is multipart with the
+// content in the "file" field, the row is given as query params table and row_id.
+
+// HandleUploadFile stores the uploaded file and links it to table/row_id
+func HandleUploadFile(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/files/", suresql.FileTable{}.TableName())
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	table := ctx.GetQueryParam("table")
+	rowID := ctx.GetQueryParam("row_id")
+	if table == "" || rowID == "" {
+		return state.SetError("table and row_id are required", nil, http.StatusBadRequest).LogAndResponse("no table or row_id", nil, true)
+	}
+	if err := suresql.ValidateTableName(table, false); err != nil {
+		return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
+	}
+
+	header, err := ctx.GetFile("file")
+	if err != nil {
+		return state.SetError("Multipart field file is required", err, http.StatusBadRequest).LogAndResponse("no file in request", nil, true)
+	}
+	if header.Size > suresql.MaxBlobSize() {
+		return state.SetError(fmt.Sprintf("File is larger than %d bytes", suresql.MaxBlobSize()), suresql.ErrFileTooLarge, http.StatusRequestEntityTooLarge).LogAndResponse("file too large", header.Filename, true)
+	}
+	src, err := header.Open()
+	if err != nil {
+		return state.SetError("Failed to read uploaded file", err, http.StatusBadRequest).LogAndResponse("cannot open multipart file", nil, true)
+	}
+	defer src.Close()
+
+	meta, err := suresql.SaveFile(suresql.FileTable{
+		TableName_:  table,
+		RowID:       rowID,
+		FileName:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		CreatedBy:   state.Token.UserName,
+	}, src)
+	if err != nil {
+		if err == suresql.ErrFileTooLarge {
+			return state.SetError(fmt.Sprintf("File is larger than %d bytes", suresql.MaxBlobSize()), err, http.StatusRequestEntityTooLarge).LogAndResponse("file too large", header.Filename, true)
+		}
+		return state.SetError("Failed to save file", err, http.StatusInternalServerError).LogAndResponse("failed to save file", header.Filename, true)
+	}
+	meterRows(ctx, 0, 1)
+	return state.SetSuccess("File uploaded successfully", meta).LogAndResponse(fmt.Sprintf("file %d uploaded for %s/%s, size:%d", meta.ID, table, rowID, meta.Size), nil, true)
+}
+
+// HandleDownloadFile streams the content of file ?id= with its content type
+func HandleDownloadFile(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/files/", suresql.FileTable{}.TableName())
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	meta, ok, err := fileFromQuery(ctx, &state)
+	if !ok {
+		return err
+	}
+	if done, err := state.NotModified(ChecksumETag(meta.Checksum)); done {
+		return err
+	}
+	content, err := suresql.OpenFile(meta)
+	if err != nil {
+		if err == suresql.ErrFileNotFound {
+			return state.SetError("File content not found", err, http.StatusNotFound).LogAndResponse("file content missing", meta.ID, true)
+		}
+		return state.SetError("Failed to open file", err, http.StatusInternalServerError).LogAndResponse("failed to open file", meta.ID, true)
+	}
+	meterRows(ctx, 1, 0)
+	state.OnlyLog(fmt.Sprintf("file %d downloaded, size:%d", meta.ID, meta.Size), nil, false)
+	ctx.SetResponseHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meta.FileName))
+	ctx.SetResponseHeader("Content-Length", strconv.FormatInt(meta.Size, 10))
+	ctx.SetResponseHeader("X-Checksum-Sha256", meta.Checksum)
+	return ctx.Stream(http.StatusOK, meta.ContentType, content)
+}
+
+// HandleListFiles lists the files of ?table= and optionally ?row_id=
+func HandleListFiles(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/files/", suresql.FileTable{}.TableName())
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	table := ctx.GetQueryParam("table")
+	if err := suresql.ValidateTableName(table, false); err != nil {
+		return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
+	}
+	files, err := suresql.ListFiles(table, ctx.GetQueryParam("row_id"))
+	if err != nil {
+		return state.SetError("Failed to list files", err, http.StatusInternalServerError).LogAndResponse("failed to list files", nil, true)
+	}
+	meterRows(ctx, len(files), 0)
+	if done, err := state.NotModified(ContentETag(files)); done {
+		return err
+	}
+	return state.SetSuccess(fmt.Sprintf("Files retrieved successfully: %d", len(files)), files).LogAndResponse(fmt.Sprintf("success count:%d", len(files)), nil, true)
+}
+
+// HandleDeleteFile removes file ?id= and its content
+func HandleDeleteFile(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/files/", suresql.FileTable{}.TableName())
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	meta, ok, err := fileFromQuery(ctx, &state)
+	if !ok {
+		return err
+	}
+	if err := suresql.DeleteFile(meta); err != nil {
+		return state.SetError("Failed to delete file", err, http.StatusInternalServerError).LogAndResponse("failed to delete file", meta.ID, true)
+	}
+	meterRows(ctx, 0, 1)
+	return state.SetSuccess("File deleted successfully", nil).LogAndResponse(fmt.Sprintf("file %d deleted", meta.ID), nil, true)
+}
+
+// fileFromQuery loads the metadata of ?id=, when it fails the error response is already written
+func fileFromQuery(ctx simplehttp.Context, state *HandlerState) (suresql.FileTable, bool, error) {
+	id, err := strconv.Atoi(ctx.GetQueryParam("id"))
+	if err != nil || id <= 0 {
+		return suresql.FileTable{}, false, state.SetError("Valid file id is required", nil, http.StatusBadRequest).LogAndResponse("invalid file id", nil, true)
+	}
+	meta, err := suresql.GetFileMeta(id)
+	if err != nil {
+		if err == suresql.ErrFileNotFound {
+			return meta, false, state.SetError("File not found", err, http.StatusNotFound).LogAndResponse("file not found", id, true)
+		}
+		return meta, false, state.SetError("Failed to get file", err, http.StatusInternalServerError).LogAndResponse("failed to get file metadata", id, true)
+	}
+	return meta, true, nil
+}
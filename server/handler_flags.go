@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListFeatureFlags lists the feature flags, the known flags without a row are listed as on (internal)
+func HandleListFeatureFlags(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_feature_flags", suresql.FeatureFlagTable{}.TableName())
+
+	flags, err := suresql.ListFeatureFlags()
+	if err != nil {
+		return state.SetError("Failed to list feature flags", err, http.StatusInternalServerError).LogAndResponse("failed to list feature flags", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Feature flags retrieved successfully: %d", len(flags)), flags).LogAndResponse(fmt.Sprintf("success count:%d", len(flags)), nil, true)
+}
+
+// HandleSaveFeatureFlag creates or replaces a flag by its name, it applies without a restart (internal)
+func HandleSaveFeatureFlag(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_feature_flag", suresql.FeatureFlagTable{}.TableName())
+
+	var flag suresql.FeatureFlagTable
+	if err := ctx.BindJSON(&flag); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	saved, err := suresql.SaveFeatureFlag(flag)
+	if err != nil {
+		if err == suresql.ErrFeatureFlagInvalid {
+			return state.SetError("Invalid feature flag", err, http.StatusBadRequest).LogAndResponse("feature flag validation failed", nil, true)
+		}
+		return state.SetError("Failed to save feature flag", err, http.StatusInternalServerError).LogAndResponse("failed to save feature flag", nil, true)
+	}
+	return state.SetSuccess("Feature flag saved successfully", saved).LogAndResponse(fmt.Sprintf("feature flag %s enabled:%t", saved.Flag, saved.Enabled), nil, true)
+}
+
+// HandleDeleteFeatureFlag removes ?flag=, a known flag is on again (internal)
+func HandleDeleteFeatureFlag(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_feature_flag", suresql.FeatureFlagTable{}.TableName())
+
+	flag := ctx.GetQueryParam("flag")
+	if flag == "" {
+		return state.SetError("Flag is required", nil, http.StatusBadRequest).LogAndResponse("missing flag", nil, true)
+	}
+	if err := suresql.DeleteFeatureFlag(flag); err != nil {
+		return state.SetError("Failed to delete feature flag", err, http.StatusInternalServerError).LogAndResponse("failed to delete feature flag", nil, true)
+	}
+	return state.SetSuccess("Feature flag deleted successfully", nil).LogAndResponse("feature flag deleted: "+flag, nil, true)
+}
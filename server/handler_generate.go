@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleGenerate inserts fake rows into a table for development and load tests (internal)
+func HandleGenerate(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "generate", "generate")
+
+	var req suresql.GenerateRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	state.TableNames = req.Table
+	if _, err := req.Columns(); err != nil {
+		if err == suresql.ErrTableNotExist {
+			return state.SetError("Table does not exist", err, http.StatusNotFound).LogAndResponse("table "+req.Table+" does not exist", nil, true)
+		}
+		return state.SetError("Invalid generate request", err, http.StatusBadRequest).LogAndResponse("generate validation failed", nil, true)
+	}
+
+	result, err := suresql.GenerateRows(req)
+	if err != nil {
+		return state.SetError("Failed to generate rows", err, http.StatusInternalServerError).LogAndResponse(fmt.Sprintf("failed to generate rows, %d inserted", result.Inserted), nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Generated %d rows", result.Inserted), result).LogAndResponse(fmt.Sprintf("%s: %d rows generated, %d skipped", req.Table, result.Inserted, result.Skipped), nil, true)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleImportCSV inserts the rows of a CSV upload (multipart field file) into a table chunk by chunk, see
+// csv_import.go. The query parameters are table, mapping (header:column,...) and delimiter.
+func HandleImportCSV(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/import/csv/", "request")
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	table := ctx.GetQueryParam("table")
+	if table == "" {
+		return state.SetError("table is required", nil, http.StatusBadRequest).LogAndResponse("no table", nil, true)
+	}
+	if err := suresql.ValidateTableName(table, false); err != nil {
+		return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
+	}
+	delimiter, err := suresql.ParseCSVDelimiter(ctx.GetQueryParam("delimiter"))
+	if err != nil {
+		return state.SetError("Invalid delimiter", err, http.StatusBadRequest).LogAndResponse("delimiter validation failed", err, true)
+	}
+
+	header, err := ctx.GetFile("file")
+	if err != nil {
+		return state.SetError("Multipart field file is required", err, http.StatusBadRequest).LogAndResponse("no file in request", nil, true)
+	}
+	src, err := header.Open()
+	if err != nil {
+		return state.SetError("Failed to read uploaded file", err, http.StatusBadRequest).LogAndResponse("cannot open multipart file", nil, true)
+	}
+	defer src.Close()
+
+	stream, err := suresql.NewCSVStream(src, table, ctx.GetQueryParam("mapping"), delimiter)
+	if err != nil {
+		return state.SetError("Invalid CSV", err, http.StatusBadRequest).LogAndResponse("csv header or mapping rejected", err, true)
+	}
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+
+	response := suresql.CSVImportResponse{Table: table}
+	status, msg := importCSVChunks(ctx, &state, userDB, stream, &response)
+	if status == http.StatusOK && response.Rows == 0 {
+		status, msg = http.StatusBadRequest, "No rows in the CSV"
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	if status != http.StatusOK {
+		return state.SetError(msg, nil, status).LogAndResponse("csv import stopped", response, true)
+	}
+	msg = fmt.Sprintf("Imported %d of %d rows, %d failed", response.Inserted, response.Rows, response.Failed)
+	if response.Inserted == 0 {
+		return state.SetError(msg, nil, http.StatusBadRequest).LogAndResponse("no row imported", response, true)
+	}
+	return state.SetSuccess(msg, response).LogAndResponse("csv import done", response, true)
+}
+
+// importCSVChunks reads, validates and inserts the chunks of the CSV into the response, bad rows are skipped.
+// It returns the status and message of the response, an error one when the CSV or the quota stopped it.
+func importCSVChunks(ctx simplehttp.Context, state *HandlerState, userDB suresql.SureSQLDB, stream *suresql.CSVStream, response *suresql.CSVImportResponse) (int, string) {
+	chunk := stream.Chunk()
+	for {
+		records, bad, readErr := stream.Next(chunk)
+		response.Rows += len(records) + len(bad)
+		response.Failed += len(bad)
+		addCSVProblems(response, bad)
+		if readErr != nil && readErr != io.EOF {
+			response.FailedLine = stream.Line()
+		}
+		if len(records) > 0 {
+			// the same checks as the JSON insert, a bad row is left out of its chunk
+			fieldErrs := suresql.ApplyInsertExpressions(records)
+			fieldErrs = append(fieldErrs, suresql.ValidateInsertRecords(records)...)
+			fieldErrs = append(fieldErrs, suresql.ApplyRecordChecksums(records)...)
+			invalid := make(map[int]bool)
+			for i := range fieldErrs {
+				invalid[fieldErrs[i].Record] = true
+				fieldErrs[i].Record = stream.RecordLine(fieldErrs[i].Record)
+			}
+			response.Failed += len(invalid)
+			addCSVProblems(response, fieldErrs)
+
+			valid := make([]orm.DBRecord, 0, len(records)-len(invalid))
+			lines := make([]int, 0, len(records)-len(invalid))
+			for i, rec := range records {
+				if !invalid[i] {
+					valid = append(valid, rec)
+					lines = append(lines, stream.RecordLine(i))
+				}
+			}
+			if len(valid) > 0 {
+				// one by one when the statement fails, the rows the DBMS refuses come back in failed
+				written, violation, _ := writeChunk(ctx, state, userDB, valid, lines, true)
+				if violation != nil {
+					response.FailedLine = lines[0]
+					return http.StatusForbidden, fmt.Sprintf("Storage quota exceeded: %s, %d rows imported before", violation.Error(), response.Inserted)
+				}
+				response.Inserted += written.inserted
+				response.Failed += len(written.failed)
+				response.Chunks++
+				response.RowsAffected += written.rowsAffected
+				addCSVProblems(response, written.failed)
+			}
+		}
+		if readErr == io.EOF {
+			return http.StatusOK, ""
+		}
+		if readErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("%s, %d rows imported before", readErr.Error(), response.Inserted)
+		}
+	}
+}
+
+// addCSVProblems keeps the first CSV_IMPORT_MAX_ERRORS problems of the import
+func addCSVProblems(response *suresql.CSVImportResponse, problems []suresql.RecordFieldError) {
+	for _, p := range problems {
+		if len(response.Problems) >= suresql.CSV_IMPORT_MAX_ERRORS {
+			return
+		}
+		response.Problems = append(response.Problems, p)
+	}
+}
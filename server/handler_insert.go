@@ -8,6 +8,7 @@ import (
 
 	orm "github.com/medatechnology/simpleorm"
 
+	"github.com/medatechnology/goutil/medaerror"
 	"github.com/medatechnology/simplehttp"
 )
 
@@ -20,6 +21,11 @@ func HandleInsert(ctx simplehttp.Context) error {
 		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
 	}
 
+	// An NDJSON body is inserted chunk by chunk
+	if isNDJSON(ctx) {
+		return handleInsertStream(ctx, &state)
+	}
+
 	// Parse request body
 	var insertReq suresql.InsertRequest
 	if err := ctx.BindJSON(&insertReq); err != nil {
@@ -32,10 +38,86 @@ func HandleInsert(ctx simplehttp.Context) error {
 		return state.SetError("No records provided", nil, http.StatusBadRequest).LogAndResponse("no records in request body", nil, true)
 	}
 
+	// Check the records against the live schema, so nothing is written when one of them is bad.
+	// With continue_on_error the bad records are reported as failed and the others are inserted.
+	// Computed columns and validation expressions of the tables run first, then the schema check,
+	// the checksum of integrity tables is last so it covers the computed columns.
+	fieldErrs := suresql.ApplyInsertExpressions(insertReq.Records)
+	fieldErrs = append(fieldErrs, suresql.ValidateInsertRecords(insertReq.Records)...)
+	fieldErrs = append(fieldErrs, suresql.ApplyRecordChecksums(insertReq.Records)...)
+	if len(fieldErrs) > 0 && !insertReq.ContinueOnError {
+		return state.SetError(fmt.Sprintf("Invalid records: %d problems found", len(fieldErrs)), nil, http.StatusBadRequest).LogAndResponse("insert validation failed", fieldErrs, true)
+	}
+
 	// Find the user's database connection from TTL map
-	userDB, err := suresql.CurrentNode.GetDBConnectionByToken(state.Token.Token)
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
 	if err != nil {
-		return state.SetError("Cannot get DB connection", err, http.StatusInternalServerError).LogAndResponse("cannot get DB connection, maybe disconnected", nil, true)
+		return respondDBConnectionError(&state, err)
+	}
+	// Cached reads of the tables are dropped once the insert ran, queued inserts when they are written
+	if !insertReq.Queue {
+		defer suresql.ResultCache.InvalidateRecords(insertReq.Records)
+	}
+
+	// Reserve storage quota of the user and tenant, released if the insert fails
+	quotaRows, quotaBytes := int64(numRecs), suresql.RecordsSize(insertReq.Records)
+	if violation := suresql.Quotas.Reserve(state.Token.UserName, state.Token.Tenant, quotaRows, quotaBytes); violation != nil {
+		return state.SetError("Storage quota exceeded", nil, http.StatusForbidden).LogAndResponse(violation.Error(), violation, true)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			suresql.Quotas.Release(state.Token.UserName, state.Token.Tenant, quotaRows, quotaBytes)
+		}
+	}()
+
+	if insertReq.ContinueOnError {
+		state.Label += "InsertEachRecord"
+		response := insertEachRecord(userDB, state.Token.UserName, insertReq, fieldErrs)
+
+		// only the inserted records count against the quota
+		var okRecords []orm.DBRecord
+		for _, r := range response.Records {
+			if r.Success {
+				okRecords = append(okRecords, insertReq.Records[r.Index])
+			}
+		}
+		okRows, okBytes := int64(len(okRecords)), suresql.RecordsSize(okRecords)
+		suresql.Quotas.Commit(state.Token.UserName, state.Token.Tenant, okRows, okBytes)
+		suresql.Quotas.Release(state.Token.UserName, state.Token.Tenant, quotaRows-okRows, quotaBytes-okBytes)
+		committed = true
+		meterRows(ctx, 0, response.RowsAffected)
+
+		response.ExecutionTime = state.SaveStopTimer()
+		msg := fmt.Sprintf("Inserted %d of %d records, %d failed", response.RowsAffected, numRecs, response.Failed)
+		if response.RowsAffected == 0 {
+			return state.SetError(msg, nil, http.StatusBadRequest).LogAndResponse("no record inserted", response, true)
+		}
+		return state.SetSuccess(msg, response).LogAndResponse("insert with continue_on_error done", response, true)
+	}
+
+	// Queued: answered with the sequence now, written in the background, the quota settles when it is
+	if insertReq.Queue {
+		username, tenant := state.Token.UserName, state.Token.Tenant
+		apiKey := suresql.APIKeyFingerprint(ctx.GetHeader(API_KEY_STRING))
+		queued, err := suresql.WriteQ.Enqueue(userDB, username, insertReq.Records, insertReq.SameTable, func(w suresql.QueuedWrite) {
+			if w.Status != suresql.QUEUED_WRITE_DONE {
+				suresql.Quotas.Release(username, tenant, quotaRows, quotaBytes)
+				return
+			}
+			suresql.Quotas.Commit(username, tenant, quotaRows, quotaBytes)
+			if suresql.Meter != nil {
+				suresql.Meter.Record(apiKey, username, suresql.MeterDelta{RowsWritten: int64(w.RowsAffected)})
+			}
+		})
+		if err != nil {
+			return state.SetError("Write queue is full", err, http.StatusServiceUnavailable).LogAndResponse("write queue full", nil, true)
+		}
+		committed = true
+		state.Label += "Queued"
+		state.SetSuccess(fmt.Sprintf("Queued %d records, sequence %d", numRecs, queued.Sequence), queued)
+		state.Status = http.StatusAccepted
+		return state.LogAndResponse("insert queued", queued, true)
 	}
 
 	// Prepare response
@@ -46,7 +128,18 @@ func HandleInsert(ctx simplehttp.Context) error {
 	}
 
 	// Execute the appropriate type of insert operation
-	if numRecs == 1 {
+	if insertReq.ReturnIDs {
+		// One statement per record, so every record gets its key back
+		state.Label += "InsertReturningIDs"
+
+		results, ids, err := suresql.InsertReturningIDs(userDB, insertReq.Records)
+		if err != nil {
+			return state.SetError("Failed to insert records", err, http.StatusInternalServerError).LogAndResponse("failed to insert records returning ids", insertReq, true)
+		}
+		response.Results = results
+		response.InsertedIDs = ids
+		response.RowsAffected = numRecs
+	} else if numRecs == 1 {
 		// Single record insert
 		state.Label += "InsertOneDBRecord"
 
@@ -58,10 +151,10 @@ func HandleInsert(ctx simplehttp.Context) error {
 		response.Results = append(response.Results, result)
 		response.RowsAffected = numRecs
 	} else if insertReq.SameTable {
-		// Multiple records for the same table
-		state.Label += "InsertManyDBRecordsSameTable"
+		// Multiple records for the same table, in multi-row statements
+		state.Label += "InsertManySameTable"
 
-		results, err := userDB.InsertManyDBRecordsSameTable(insertReq.Records, insertReq.Queue)
+		results, err := suresql.InsertManySameTable(userDB, insertReq.Records)
 		if err != nil {
 			return state.SetError("Failed to insert multiple records of same table", err, http.StatusInternalServerError).LogAndResponse("failed to insert multiple multiple records of same table", insertReq, true)
 		}
@@ -79,8 +172,61 @@ func HandleInsert(ctx simplehttp.Context) error {
 		response.RowsAffected = len(results)
 	}
 
+	suresql.Quotas.Commit(state.Token.UserName, state.Token.Tenant, quotaRows, quotaBytes)
+	committed = true
+	meterRows(ctx, 0, response.RowsAffected)
+
 	// Calculate total execution time
 	response.ExecutionTime = state.SaveStopTimer()
 	return state.SetSuccess(fmt.Sprintf("Successfully inserted %d records", response.RowsAffected), response).LogAndResponse("insert successfully", response, true)
 }
 
+
+// insertEachRecord inserts the records one at a time so a failure only affects its own record. Records that
+// failed validation are not sent to the DB. Failures go to the dead letters when the request asks for it.
+func insertEachRecord(userDB suresql.SureSQLDB, username string, req suresql.InsertRequest, fieldErrs []suresql.RecordFieldError) suresql.InsertResponse {
+	invalid := make(map[int]string)
+	for _, fe := range fieldErrs {
+		if msg, ok := invalid[fe.Record]; ok {
+			invalid[fe.Record] = msg + "; " + fe.Error()
+		} else {
+			invalid[fe.Record] = fe.Error()
+		}
+	}
+
+	response := suresql.InsertResponse{Records: make([]suresql.InsertRecordResult, 0, len(req.Records))}
+	for i, rec := range req.Records {
+		result := suresql.InsertRecordResult{Index: i}
+		var err error
+		if msg, bad := invalid[i]; bad {
+			err = medaerror.NewString(msg)
+		} else {
+			if req.ReturnIDs {
+				var results []orm.BasicSQLResult
+				var ids []interface{}
+				results, ids, err = suresql.InsertReturningIDs(userDB, []orm.DBRecord{rec})
+				if len(results) > 0 {
+					result.LastInsertID = results[0].LastInsertID
+				}
+				result.ID = ids[0]
+			} else {
+				res := userDB.InsertOneDBRecord(rec, req.Queue)
+				err = res.Error
+				result.LastInsertID = res.LastInsertID
+			}
+		}
+
+		if err == nil {
+			result.Success = true
+			response.RowsAffected++
+		} else {
+			result.Error = err.Error()
+			response.Failed++
+			if req.DeadLetter {
+				result.DeadLetterID, _ = suresql.AddDeadLetter(suresql.DEAD_LETTER_SOURCE_INSERT, rec.TableName, username, rec, err)
+			}
+		}
+		response.Records = append(response.Records, result)
+	}
+	return response
+}
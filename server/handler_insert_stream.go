@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// isNDJSON tells if the body of the request is NDJSON, one record per line
+func isNDJSON(ctx simplehttp.Context) bool {
+	mediaType, _, err := mime.ParseMediaType(ctx.GetHeader("Content-Type"))
+	return err == nil && (mediaType == suresql.INSERT_STREAM_CONTENT_TYPE || mediaType == "application/jsonl")
+}
+
+// handleInsertStream inserts the records of an NDJSON body chunk by chunk, see insert_stream.go. The query
+// parameters are table (the lines are the columns of its records) and upload with part, to send a large
+// load in several requests.
+func handleInsertStream(ctx simplehttp.Context, state *HandlerState) error {
+	state.Label += "InsertStream"
+	table := ctx.GetQueryParam("table")
+	if table != "" {
+		if err := suresql.ValidateTableName(table, false); err != nil {
+			return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
+		}
+	}
+	response := suresql.InsertStreamResponse{Upload: ctx.GetQueryParam("upload")}
+	if response.Upload != "" || ctx.GetQueryParam("part") != "" {
+		response.Part, _ = strconv.Atoi(ctx.GetQueryParam("part"))
+		if err := suresql.ValidateUploadPart(response.Upload, response.Part); err != nil {
+			return state.SetError("Invalid upload", err, http.StatusBadRequest).LogAndResponse("upload validation failed", err, true)
+		}
+	}
+
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(state, err)
+	}
+
+	stream := suresql.NewRecordStream(bytes.NewReader(ctx.GetBody()), table)
+	var status int
+	var msg string
+	if response.Upload != "" {
+		// a retried part continues after the records inserted by the requests before
+		done, err := suresql.StreamUploads.Begin(state.Token.UserName, response.Upload, response.Part)
+		if err != nil {
+			return state.SetError(err.Error(), err, http.StatusConflict).LogAndResponse("upload part already running", response, true)
+		}
+		finished := false
+		defer func() {
+			if !finished {
+				suresql.StreamUploads.Finish(state.Token.UserName, response.Upload, response.Part, response.Skipped+response.Records)
+			}
+		}()
+		response.Skipped, _ = stream.Skip(done)
+		status, msg = insertStreamChunks(ctx, state, userDB, stream, &response)
+		response.UploadRecords = suresql.StreamUploads.Finish(state.Token.UserName, response.Upload, response.Part, response.Skipped+response.Records)
+		finished = true
+	} else {
+		status, msg = insertStreamChunks(ctx, state, userDB, stream, &response)
+	}
+
+	if status == http.StatusOK && response.Records+response.Skipped == 0 {
+		status, msg = http.StatusBadRequest, "No records provided"
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	if status != http.StatusOK {
+		return state.SetError(msg, nil, status).LogAndResponse("streamed insert stopped", response, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Successfully inserted %d records", response.Records), response).LogAndResponse("streamed insert successfully", response, true)
+}
+
+// insertStreamChunks reads, validates and inserts the chunks of the stream into the response, it returns the
+// status and message of the response, an error one when a chunk stopped the insert
+func insertStreamChunks(ctx simplehttp.Context, state *HandlerState, userDB suresql.SureSQLDB, stream *suresql.RecordStream, response *suresql.InsertStreamResponse) (int, string) {
+	chunk := suresql.InsertStreamChunk()
+	for {
+		records, readErr := stream.Next(chunk)
+		if readErr != nil && readErr != io.EOF {
+			response.FailedLine = stream.Line()
+		}
+		if len(records) > 0 {
+			// the same checks as the JSON insert, nothing of the chunk is written when one record is bad
+			fieldErrs := suresql.ApplyInsertExpressions(records)
+			fieldErrs = append(fieldErrs, suresql.ValidateInsertRecords(records)...)
+			fieldErrs = append(fieldErrs, suresql.ApplyRecordChecksums(records)...)
+			if len(fieldErrs) > 0 {
+				for i := range fieldErrs {
+					fieldErrs[i].Record = stream.RecordLine(fieldErrs[i].Record)
+				}
+				response.Problems, response.FailedLine = fieldErrs, fieldErrs[0].Record
+				return http.StatusBadRequest, fmt.Sprintf("Invalid records: %d problems found, %d records inserted before", len(fieldErrs), response.Records)
+			}
+
+			written, violation, err := writeChunk(ctx, state, userDB, records, stream.RecordLines(), false)
+			if violation != nil {
+				response.FailedLine = stream.RecordLine(0)
+				return http.StatusForbidden, fmt.Sprintf("Storage quota exceeded: %s, %d records inserted before", violation.Error(), response.Records)
+			}
+			// on a DBMS without atomic batches part of a failed chunk can be written, it is counted
+			response.Records += written.inserted
+			response.RowsAffected += written.rowsAffected
+			if err != nil {
+				response.FailedLine = stream.RecordLine(written.inserted)
+				return http.StatusInternalServerError, fmt.Sprintf("Failed to insert records: %s, %d records inserted before", err.Error(), response.Records)
+			}
+			response.Chunks++
+		}
+		if readErr == io.EOF {
+			return http.StatusOK, ""
+		}
+		if readErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("%s, %d records inserted before", readErr.Error(), response.Records)
+		}
+	}
+}
+
+// chunkWrite is what writeChunk inserted of a chunk
+type chunkWrite struct {
+	inserted     int
+	rowsAffected int
+	failed       []suresql.RecordFieldError // records the DBMS refused one by one, Record is their line
+}
+
+// writeChunk inserts the records of a chunk with suresql.InsertChunk after reserving their quota, a
+// violation is returned and nothing is written. lines are the lines of the records in the body. The chunk
+// is one atomic batch where the DBMS has them, elsewhere the statements that went through stay written.
+// When records fail and oneByOne is set they are inserted again one by one so only the rows the DBMS
+// refuses fail, otherwise the error is returned with what was written. Only the inserted rows count
+// against the quota.
+func writeChunk(ctx simplehttp.Context, state *HandlerState, userDB suresql.SureSQLDB, records []orm.DBRecord, lines []int, oneByOne bool) (chunkWrite, *suresql.QuotaViolation, error) {
+	var written chunkWrite
+	rows, size := int64(len(records)), suresql.RecordsSize(records)
+	if violation := suresql.Quotas.Reserve(state.Token.UserName, state.Token.Tenant, rows, size); violation != nil {
+		return written, violation, nil
+	}
+	results, failed, err := suresql.InsertChunk(userDB, records)
+	suresql.ResultCache.InvalidateRecords(records)
+	inserted := records
+	if len(failed) > 0 {
+		skip := make(map[int]bool, len(failed))
+		for _, i := range failed {
+			skip[i] = true
+		}
+		inserted = make([]orm.DBRecord, 0, len(records)-len(failed))
+		for i, rec := range records {
+			if !skip[i] {
+				inserted = append(inserted, rec)
+			}
+		}
+		if oneByOne {
+			for _, i := range failed {
+				res := userDB.InsertOneDBRecord(records[i], false)
+				if res.Error != nil {
+					written.failed = append(written.failed, suresql.RecordFieldError{Record: lines[i], Table: records[i].TableName, Message: res.Error.Error()})
+					continue
+				}
+				inserted, results = append(inserted, records[i]), append(results, res)
+			}
+			suresql.ResultCache.InvalidateRecords(records)
+			err = nil
+		}
+	}
+
+	okRows, okSize := int64(len(inserted)), suresql.RecordsSize(inserted)
+	suresql.Quotas.Commit(state.Token.UserName, state.Token.Tenant, okRows, okSize)
+	suresql.Quotas.Release(state.Token.UserName, state.Token.Tenant, rows-okRows, size-okSize)
+	meterRows(ctx, 0, len(inserted))
+	written.inserted = len(inserted)
+	for _, r := range results {
+		written.rowsAffected += r.RowsAffected
+	}
+	return written, nil, err
+}
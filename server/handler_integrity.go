@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// IntegrityRequest names the table of /suresql/verify and /suresql/integrity/rehash
+type IntegrityRequest struct {
+	Table string        `json:"table,omitempty"` // verify: empty is all tables
+	Keys  []interface{} `json:"keys,omitempty"`  // rehash: only these rows, empty is all
+}
+
+// HandleListIntegrityTables lists the tables with row checksums and their last verification (internal)
+func HandleListIntegrityTables(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_integrity", suresql.IntegrityTable{}.TableName())
+
+	tables, err := suresql.ListIntegrityTables()
+	if err != nil {
+		return state.SetError("Failed to list integrity tables", err, http.StatusInternalServerError).LogAndResponse("failed to list integrity tables", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Integrity tables retrieved successfully: %d", len(tables)), tables).LogAndResponse(fmt.Sprintf("success count:%d", len(tables)), nil, true)
+}
+
+// HandleSaveIntegrityTable adds the checksum column to a table and starts maintaining it, calling it
+// again changes the columns (internal)
+func HandleSaveIntegrityTable(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_integrity", suresql.IntegrityTable{}.TableName())
+
+	var t suresql.IntegrityTable
+	if err := ctx.BindJSON(&t); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	t, err := suresql.PrepareIntegrityTable(t)
+	if err != nil {
+		return state.SetError("Invalid integrity table", err, http.StatusBadRequest).LogAndResponse("integrity table validation failed", nil, true)
+	}
+	if t, err = suresql.SaveIntegrityTable(t); err != nil {
+		return state.SetError("Failed to save integrity table", err, http.StatusInternalServerError).LogAndResponse("failed to save integrity table "+t.TableName_, nil, true)
+	}
+	return state.SetSuccess("Integrity table saved successfully", t).LogAndResponse("integrity on "+t.TableName_+" saved", nil, true)
+}
+
+// HandleDeleteIntegrityTable stops maintaining the checksums of ?table=, the column is kept (internal)
+func HandleDeleteIntegrityTable(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_integrity", suresql.IntegrityTable{}.TableName())
+
+	table := ctx.GetQueryParam("table")
+	if err := suresql.ValidateTableName(table, false); err != nil {
+		return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
+	}
+	if err := suresql.DeleteIntegrityTable(table); err != nil {
+		if err == suresql.ErrIntegrityNotFound {
+			return state.SetError("Integrity table not found", err, http.StatusNotFound).LogAndResponse("integrity table not found", nil, true)
+		}
+		return state.SetError("Failed to delete integrity table", err, http.StatusInternalServerError).LogAndResponse("failed to delete integrity table "+table, nil, true)
+	}
+	return state.SetSuccess("Integrity table deleted successfully", nil).LogAndResponse("integrity on "+table+" deleted", nil, true)
+}
+
+// HandleRehashIntegrity accepts the current content of rows changed on purpose outside SureSQL (internal)
+func HandleRehashIntegrity(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "rehash_integrity", suresql.IntegrityTable{}.TableName())
+
+	var req IntegrityRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	updated, err := suresql.RehashIntegrity(context.Background(), req.Table, req.Keys)
+	if err != nil {
+		return integrityError(&state, "Failed to rehash rows", err).LogAndResponse("failed to rehash "+req.Table, nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Rehashed %d rows", updated), updated).LogAndResponse(fmt.Sprintf("%s rehashed, %d rows", req.Table, updated), nil, true)
+}
+
+// HandleVerifyIntegrity recomputes the checksums of the table, or of all tables, and reports the rows
+// that do not match (internal)
+func HandleVerifyIntegrity(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "verify_integrity", suresql.IntegrityTable{}.TableName())
+
+	var req IntegrityRequest
+	if len(ctx.GetBody()) > 0 {
+		if err := ctx.BindJSON(&req); err != nil {
+			return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+		}
+	}
+	if req.Table == "" {
+		req.Table = ctx.GetQueryParam("table")
+	}
+
+	var reports []suresql.IntegrityReport
+	if req.Table == "" {
+		var err error
+		if reports, err = suresql.VerifyAllIntegrity(context.Background()); err != nil {
+			return state.SetError("Failed to verify integrity", err, http.StatusInternalServerError).LogAndResponse("failed to verify integrity", nil, true)
+		}
+	} else {
+		report, err := suresql.VerifyIntegrity(context.Background(), req.Table)
+		if err != nil {
+			return integrityError(&state, "Failed to verify integrity", err).LogAndResponse("failed to verify "+req.Table, nil, true)
+		}
+		reports = append(reports, report)
+	}
+
+	mismatches := 0
+	for _, r := range reports {
+		mismatches += r.Mismatches
+	}
+	return state.SetSuccess(fmt.Sprintf("Verified %d tables, %d mismatched rows", len(reports), mismatches), reports).LogAndResponse(fmt.Sprintf("integrity verified, %d mismatches", mismatches), nil, true)
+}
+
+func integrityError(state *HandlerState, msg string, err error) *HandlerState {
+	switch err {
+	case suresql.ErrIntegrityNotFound:
+		return state.SetError(err.Error(), err, http.StatusNotFound)
+	case suresql.ErrIntegrityKeyMissing:
+		return state.SetError(err.Error(), err, http.StatusConflict)
+	}
+	return state.SetError(msg, err, http.StatusInternalServerError)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// MaintenanceStatus is the response of GET /suresql/maintenance
+type MaintenanceStatus struct {
+	Tasks []suresql.MaintenanceTask     `json:"tasks"`
+	Runs  []suresql.MaintenanceRunTable `json:"runs"`
+}
+
+// MaintenanceRequest names the tasks of /suresql/maintenance/run
+type MaintenanceRequest struct {
+	Tasks []string `json:"tasks,omitempty"` // empty is all tasks of the DBMS
+}
+
+// HandleListMaintenance lists the maintenance tasks of the DBMS with their schedule and the latest runs,
+// ?task= and ?limit= filter the runs (internal)
+func HandleListMaintenance(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_maintenance", suresql.MaintenanceRunTable{}.TableName())
+
+	limit, _ := strconv.Atoi(ctx.GetQueryParam("limit"))
+	runs, err := suresql.ListMaintenanceRuns(ctx.GetQueryParam("task"), limit)
+	if err != nil {
+		return state.SetError("Failed to list maintenance runs", err, http.StatusInternalServerError).LogAndResponse("failed to list maintenance runs", nil, true)
+	}
+	status := MaintenanceStatus{Tasks: suresql.ListMaintenanceTasks(), Runs: runs}
+	return state.SetSuccess(fmt.Sprintf("Maintenance runs retrieved successfully: %d", len(runs)), status).LogAndResponse(fmt.Sprintf("success count:%d", len(runs)), nil, true)
+}
+
+// HandleRunMaintenance runs maintenance tasks now, one after the other, a failed task does not stop the
+// next ones (internal)
+func HandleRunMaintenance(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "run_maintenance", suresql.MaintenanceRunTable{}.TableName())
+
+	var req MaintenanceRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if len(req.Tasks) == 0 {
+		for _, t := range suresql.ListMaintenanceTasks() {
+			req.Tasks = append(req.Tasks, t.Task)
+		}
+	}
+	for _, task := range req.Tasks {
+		if _, err := suresql.MaintenanceStatements(task); err == suresql.ErrMaintenanceTaskUnknown {
+			return state.SetError("Unknown maintenance task "+task, err, http.StatusBadRequest).LogAndResponse("unknown maintenance task "+task, nil, true)
+		}
+	}
+
+	runs := make([]suresql.MaintenanceRunTable, 0, len(req.Tasks))
+	failed := 0
+	for _, task := range req.Tasks {
+		run, err := suresql.RunMaintenance(task, true)
+		if err != nil {
+			failed++
+		}
+		runs = append(runs, run)
+	}
+	if failed > 0 {
+		return state.SetError(fmt.Sprintf("%d of %d maintenance tasks failed", failed, len(runs)), nil, http.StatusBadGateway).LogAndResponse("maintenance failed", runs, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Maintenance done: %d tasks", len(runs)), runs).LogAndResponse(fmt.Sprintf("maintenance done, %d tasks", len(runs)), nil, true)
+}
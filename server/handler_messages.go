@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListMessages lists the translated messages, of ?locale= when given (internal)
+func HandleListMessages(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_messages", suresql.MessageTable{}.TableName())
+
+	messages, err := suresql.ListMessages(ctx.GetQueryParam("locale"))
+	if err != nil {
+		return state.SetError("Failed to list messages", err, http.StatusInternalServerError).LogAndResponse("failed to list messages", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Messages retrieved successfully: %d", len(messages)), messages).LogAndResponse(fmt.Sprintf("success count:%d", len(messages)), nil, true)
+}
+
+// HandleSaveMessages creates or replaces translations, the body is an array of {locale, message_key, text} (internal)
+func HandleSaveMessages(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_messages", suresql.MessageTable{}.TableName())
+
+	var messages []suresql.MessageTable
+	if err := ctx.BindJSON(&messages); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if err := suresql.SaveMessages(messages); err != nil {
+		if err == suresql.ErrMessageInvalid {
+			return state.SetError("Invalid message", err, http.StatusBadRequest).LogAndResponse("message validation failed", nil, true)
+		}
+		return state.SetError("Failed to save messages", err, http.StatusInternalServerError).LogAndResponse("failed to save messages", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Messages saved successfully: %d", len(messages)), nil).LogAndResponse(fmt.Sprintf("messages saved:%d", len(messages)), nil, true)
+}
+
+// HandleDeleteMessages removes ?locale= and ?key=, or the whole locale without key (internal)
+func HandleDeleteMessages(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_messages", suresql.MessageTable{}.TableName())
+
+	locale := ctx.GetQueryParam("locale")
+	if locale == "" {
+		return state.SetError("Locale is required", nil, http.StatusBadRequest).LogAndResponse("missing locale", nil, true)
+	}
+	key := ctx.GetQueryParam("key")
+	if err := suresql.DeleteMessages(locale, key); err != nil {
+		return state.SetError("Failed to delete messages", err, http.StatusInternalServerError).LogAndResponse("failed to delete messages", nil, true)
+	}
+	return state.SetSuccess("Messages deleted successfully", nil).LogAndResponse(fmt.Sprintf("messages of %s deleted, key:%s", locale, key), nil, true)
+}
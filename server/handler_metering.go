@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleExportMetering exports daily usage records (internal).
+// Query params: from, to (YYYY-MM-DD, inclusive, optional) and format=json|csv (default json)
+func HandleExportMetering(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "export_metering", suresql.UsageMeterTable{}.TableName())
+
+	from := ctx.GetQueryParam("from")
+	to := ctx.GetQueryParam("to")
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse(suresql.METERING_DAY_FORMAT, day); day != "" && err != nil {
+			return state.SetError("from/to must be YYYY-MM-DD", err, http.StatusBadRequest).LogAndResponse("invalid day "+day, nil, true)
+		}
+	}
+
+	// Make sure what is in memory is included in the export
+	suresql.Meter.Flush()
+	usage, err := suresql.ListUsageMeter(from, to)
+	if err != nil {
+		return state.SetError("Failed to list usage", err, http.StatusInternalServerError).LogAndResponse("failed to list usage meter", nil, true)
+	}
+
+	switch ctx.GetQueryParam("format") {
+	case "", "json":
+		return state.SetSuccess(fmt.Sprintf("Usage retrieved successfully: %d", len(usage)), usage).LogAndResponse(fmt.Sprintf("success count:%d", len(usage)), nil, true)
+	case "csv":
+		var buf bytes.Buffer
+		if err := suresql.WriteUsageMeterCSV(&buf, usage); err != nil {
+			return state.SetError("Failed to write CSV", err, http.StatusInternalServerError).LogAndResponse("failed to write usage csv", nil, true)
+		}
+		state.OnlyLog(fmt.Sprintf("usage exported as csv, count:%d", len(usage)), nil, false)
+		ctx.SetResponseHeader("Content-Disposition", fmt.Sprintf("attachment; filename=usage_%s_%s.csv", from, to))
+		return ctx.Stream(http.StatusOK, "text/csv", &buf)
+	default:
+		return state.SetError("format must be json or csv", nil, http.StatusBadRequest).LogAndResponse("invalid export format", nil, true)
+	}
+}
+
+// HandlePushMetering pushes the usage of a day (query param day, default yesterday) to the billing webhook (internal)
+func HandlePushMetering(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "push_metering", suresql.UsageMeterTable{}.TableName())
+
+	day := ctx.GetQueryParam("day")
+	if day == "" {
+		day = time.Now().UTC().AddDate(0, 0, -1).Format(suresql.METERING_DAY_FORMAT)
+	} else if _, err := time.Parse(suresql.METERING_DAY_FORMAT, day); err != nil {
+		return state.SetError("day must be YYYY-MM-DD", err, http.StatusBadRequest).LogAndResponse("invalid day "+day, nil, true)
+	}
+
+	suresql.Meter.Flush()
+	count, err := suresql.PushUsageToWebhook(day)
+	if err != nil {
+		status := http.StatusBadGateway
+		if err == suresql.ErrMeteringWebhookNotSet {
+			status = http.StatusPreconditionFailed
+		}
+		return state.SetError("Failed to push usage to billing webhook", err, status).LogAndResponse("failed to push usage of "+day, nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Usage of %s pushed: %d records", day, count), nil).LogAndResponse("usage pushed to billing webhook", day, true)
+}
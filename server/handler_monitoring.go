@@ -1,8 +1,10 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/medatechnology/suresql"
 	"github.com/medatechnology/simplehttp"
@@ -16,10 +18,7 @@ func RegisterMonitoringRoutes(server simplehttp.Server) {
 
 	// Protected monitoring endpoints (basic auth required)
 	monitoring := server.Group("/monitoring")
-	monitoring.Use(simplehttp.MiddlewareBasicAuth(
-		suresql.CurrentNode.InternalConfig.Username,
-		suresql.CurrentNode.InternalConfig.Password,
-	))
+	monitoring.Use(MiddlewareInternalAuth())
 	{
 		monitoring.GET("/metrics", HandleMetrics)
 		monitoring.GET("/metrics/pool", HandlePoolMetrics)
@@ -28,6 +27,13 @@ func RegisterMonitoringRoutes(server simplehttp.Server) {
 		monitoring.GET("/alerts/stats", HandleAlertStats)
 		monitoring.DELETE("/alerts", HandleClearAlerts)
 		monitoring.GET("/health/detailed", HandleDetailedHealth)
+		monitoring.GET("/advisor", HandleAdvisor)
+		monitoring.DELETE("/advisor", HandleClearAdvisor)
+		monitoring.GET("/disk", HandleDiskUsage)
+		monitoring.GET("/experiment", HandleExperiment)
+		monitoring.DELETE("/experiment", HandleResetExperiment)
+		monitoring.GET("/shadow", HandleShadow)
+		monitoring.DELETE("/shadow", HandleResetShadow)
 	}
 }
 
@@ -42,8 +48,17 @@ func HandleHealth(ctx simplehttp.Context) error {
 
 // HandleReadiness returns readiness status (readiness probe)
 func HandleReadiness(ctx simplehttp.Context) error {
+	// Not ready until ConnectInternal finished (schema and settings loaded)
+	if init := suresql.GetInitProgress(); init.Phase != suresql.INIT_PHASE_READY {
+		return ctx.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "not ready",
+			"reason": "initialization not complete",
+			"init":   init,
+		})
+	}
+
 	// Check if database is connected
-	if !suresql.CurrentNode.InternalConnection.IsConnected() {
+	if !suresql.CurrentNode.GetInternalConnection().IsConnected() {
 		return ctx.JSON(http.StatusServiceUnavailable, map[string]interface{}{
 			"status": "not ready",
 			"reason": "database connection failed",
@@ -62,6 +77,15 @@ func HandleReadiness(ctx simplehttp.Context) error {
 		}
 	}
 
+	// A read-only node too far behind the leader should not get reads routed to it
+	if suresql.CurrentNode.Config.Mode == "r" && suresql.ReplicaReadsSuspended() {
+		return ctx.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+			"status":      "not ready",
+			"reason":      "replica lag above threshold",
+			"replica_lag": suresql.CurrentReplicaLag(),
+		})
+	}
+
 	return ctx.JSON(http.StatusOK, map[string]interface{}{
 		"status":  "ready",
 		"version": suresql.APP_VERSION,
@@ -70,7 +94,7 @@ func HandleReadiness(ctx simplehttp.Context) error {
 
 // HandleMetrics returns comprehensive metrics
 func HandleMetrics(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/monitoring/metrics", "metrics")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/metrics", "metrics")
 
 	metrics := suresql.GetMetrics()
 
@@ -80,7 +104,7 @@ func HandleMetrics(ctx simplehttp.Context) error {
 
 // HandlePoolMetrics returns connection pool specific metrics
 func HandlePoolMetrics(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/monitoring/metrics/pool", "pool_metrics")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/metrics/pool", "pool_metrics")
 
 	poolStats := suresql.GetConnectionPoolStats()
 
@@ -90,7 +114,7 @@ func HandlePoolMetrics(ctx simplehttp.Context) error {
 
 // HandleTokenMetrics returns token specific metrics
 func HandleTokenMetrics(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/monitoring/metrics/tokens", "token_metrics")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/metrics/tokens", "token_metrics")
 
 	tokenStats := suresql.GetTokenStats()
 
@@ -100,7 +124,7 @@ func HandleTokenMetrics(ctx simplehttp.Context) error {
 
 // HandleAlerts returns recent alerts
 func HandleAlerts(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/monitoring/alerts", "alerts")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/alerts", "alerts")
 
 	// Get limit from query parameter (default 20)
 	limit := 20
@@ -132,7 +156,7 @@ func HandleAlerts(ctx simplehttp.Context) error {
 
 // HandleAlertStats returns alert statistics
 func HandleAlertStats(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/monitoring/alerts/stats", "alert_stats")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/alerts/stats", "alert_stats")
 
 	stats := suresql.AlertMgr.GetAlertStats()
 
@@ -142,7 +166,7 @@ func HandleAlertStats(ctx simplehttp.Context) error {
 
 // HandleClearAlerts clears all alerts
 func HandleClearAlerts(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "/monitoring/alerts", "clear_alerts")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/alerts", "clear_alerts")
 
 	suresql.AlertMgr.ClearAlerts()
 
@@ -150,6 +174,61 @@ func HandleClearAlerts(ctx simplehttp.Context) error {
 		LogAndResponse("alerts cleared", nil, true)
 }
 
+// HandleDiskUsage returns the disk usage projection of this node and its samples, of the projection
+// window or ?hours=
+func HandleDiskUsage(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/disk", suresql.DiskUsageTable{}.TableName())
+
+	hours, _ := strconv.Atoi(ctx.GetQueryParam("hours"))
+	usage := suresql.CurrentDiskUsage()
+	if hours <= 0 {
+		hours = suresql.DISK_DEFAULT_WINDOW_HOURS
+		if usage != nil && usage.WindowHours > 0 {
+			hours = usage.WindowHours
+		}
+	}
+	samples, err := suresql.ListDiskUsage(suresql.CurrentNode.Config.NodeNumber, suresql.CurrentClock.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		return state.SetError("Failed to list disk usage samples", err, http.StatusInternalServerError).LogAndResponse("failed to list disk usage samples", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Disk usage samples: %d", len(samples)), map[string]interface{}{
+		"usage":   usage,
+		"samples": samples,
+	}).LogAndResponse("disk usage", nil, false)
+}
+
+// HandleExperiment returns the latency and divergence of the reads mirrored to the alternate backend
+func HandleExperiment(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/experiment", "experiment")
+
+	status := suresql.CurrentExperiment().Status()
+	return state.SetSuccess(fmt.Sprintf("Experiment mirrored %d, divergent %d", status.Mirrored, status.Divergent), status).LogAndResponse("experiment status", nil, false)
+}
+
+// HandleResetExperiment clears the counters and divergences of the experiment
+func HandleResetExperiment(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/experiment", "experiment")
+
+	suresql.CurrentExperiment().Reset()
+	return state.SetSuccess("Experiment reset", nil).LogAndResponse("experiment reset", nil, true)
+}
+
+// HandleShadow returns what was sent to the staging node
+func HandleShadow(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/shadow", "shadow")
+
+	status := suresql.CurrentShadow().Status()
+	return state.SetSuccess(fmt.Sprintf("Shadow sent %d, errors %d", status.Sent, status.Errors), status).LogAndResponse("shadow status", nil, false)
+}
+
+// HandleResetShadow clears the counters of the shadow traffic
+func HandleResetShadow(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/monitoring/shadow", "shadow")
+
+	suresql.CurrentShadow().Reset()
+	return state.SetSuccess("Shadow traffic reset", nil).LogAndResponse("shadow reset", nil, true)
+}
+
 // HandleDetailedHealth returns detailed health status
 func HandleDetailedHealth(ctx simplehttp.Context) error {
 	health := suresql.GetHealthStatus()
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandlePeerTLSStatus lists the peer CAs and node certificates with their expiry (internal)
+func HandlePeerTLSStatus(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "peer_tls_status", suresql.PeerCertTable{}.TableName())
+
+	status, err := suresql.GetPeerTLSStatus()
+	if err != nil {
+		return state.SetError("Failed to get peer TLS status", err, http.StatusInternalServerError).LogAndResponse("failed to get peer TLS status", nil, true)
+	}
+	return state.SetSuccess("Peer TLS status retrieved successfully", status).LogAndResponse("peer TLS status", nil, true)
+}
+
+// HandleRotatePeerCA makes a new peer CA and reissues every node certificate, leader only (internal)
+func HandleRotatePeerCA(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "rotate_peer_ca", suresql.PeerCATable{}.TableName())
+
+	if err := suresql.RotatePeerCA(); err != nil {
+		code := http.StatusInternalServerError
+		switch err {
+		case suresql.ErrPeerTLSDisabled:
+			code = http.StatusBadRequest
+		case suresql.ErrPeerTLSNotLeader:
+			code = http.StatusConflict
+		}
+		return state.SetError("Failed to rotate peer CA", err, code).LogAndResponse("failed to rotate peer CA", nil, true)
+	}
+	status, err := suresql.GetPeerTLSStatus()
+	if err != nil {
+		return state.SetError("Failed to get peer TLS status", err, http.StatusInternalServerError).LogAndResponse("failed to get peer TLS status", nil, true)
+	}
+	return state.SetSuccess("Peer CA rotated successfully", status).LogAndResponse("peer CA rotated", nil, true)
+}
+
+// HandlePeerPing answers another node over mTLS, used to check the peer certificates work
+func HandlePeerPing(ctx simplehttp.Context) error {
+	return ctx.JSON(http.StatusOK, map[string]string{
+		"node": suresql.PeerNodeName(),
+		"peer": PeerName(ctx),
+	})
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListPlugins lists the compiled in plugins and their routes (internal)
+func HandleListPlugins(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_plugins", "plugins")
+
+	infos := ListPlugins()
+	return state.SetSuccess(fmt.Sprintf("Plugins retrieved successfully: %d", len(infos)), infos).LogAndResponse(fmt.Sprintf("success count:%d", len(infos)), nil, true)
+}
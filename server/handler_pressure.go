@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+const PRESSURE_PATH = "/pressure"
+
+// Backpressure middleware, counts the requests in flight and refuses new ones with 429 and
+// backpressure hints when the node is saturated. The /pressure endpoint itself is never refused.
+func MiddlewareBackpressure() simplehttp.Middleware {
+	return simplehttp.WithName("backpressure", BackpressureInFlight())
+}
+
+func BackpressureInFlight() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			if strings.HasSuffix(ctx.GetPath(), PRESSURE_PATH) {
+				return next(ctx)
+			}
+
+			// the limit check and the count are one atomic step
+			if !suresql.TryBeginRequest() {
+				state := NewMiddlewareState(ctx, "backpressure")
+				return respondBackpressure(&state, suresql.CurrentPressure(), "Too many requests, retry later", http.StatusTooManyRequests)
+			}
+			defer suresql.EndRequest()
+			return next(ctx)
+		}
+	}
+}
+
+// Query queue middleware, with connection/max_queries the requests over it wait for a slot in the queue of
+// their token, turn by turn between the tokens, see query_scheduler.go. Use it after the token middleware.
+func MiddlewareQueryQueue() simplehttp.Middleware {
+	return simplehttp.WithName("query_queue", QueryQueue())
+}
+
+func QueryQueue() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			if strings.HasSuffix(ctx.GetPath(), PRESSURE_PATH) {
+				return next(ctx)
+			}
+			token := ""
+			if tok, ok := ctx.Get(TOKEN_TABLE_STRING).(*suresql.TokenTable); ok && tok != nil {
+				token = tok.Token
+			}
+			release, err := suresql.Queries.Acquire(token, suresql.QueueTimeout())
+			if err != nil {
+				state := NewMiddlewareState(ctx, "query_queue")
+				return respondBackpressure(&state, suresql.CurrentPressure(), "Too many queries waiting, retry later", http.StatusTooManyRequests)
+			}
+			defer release()
+			return next(ctx)
+		}
+	}
+}
+
+// HandlePressure returns the current saturation of this node so clients can self-throttle
+func HandlePressure(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/pressure/", "pressure")
+	// polled often, do not fill up the access log
+	state.DBLogging = false
+	state.ConsoleLogging = false
+	return state.SetSuccess("Current backpressure", suresql.CurrentPressure()).LogAndResponse("pressure polled", nil, false)
+}
+
+// respondBackpressure sends 429/503 with Retry-After header and the pressure status as data
+func respondBackpressure(state *HandlerState, pressure suresql.PressureStatus, msg string, status int) error {
+	state.Context.SetResponseHeader("Retry-After", strconv.FormatInt(pressure.RetryAfterSeconds(), 10))
+	return state.SetError(msg, nil, status).LogAndResponse(msg+", level "+pressure.Level, pressure, true)
+}
+
+// respondDBConnectionError is used by handlers when they cannot get the DB connection for the token.
+// Pool exhaustion (ie: when a reclaimed connection cannot be re-established) is reported as 503 with hints.
+func respondDBConnectionError(state *HandlerState, err error) error {
+	if err == suresql.ErrPoolExhausted {
+		return respondBackpressure(state, suresql.CurrentPressure(), "Connection pool full, retry later", http.StatusServiceUnavailable)
+	}
+	if err == suresql.ErrFaultInjected {
+		return respondBackpressure(state, suresql.CurrentPressure(), "Injected fault, retry later", http.StatusServiceUnavailable)
+	}
+	return state.SetError("Cannot get DB connection", err, http.StatusInternalServerError).LogAndResponse("cannot get DB connection, maybe disconnected", nil, true)
+}
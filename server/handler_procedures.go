@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// procedureRequest is a procedure as posted, steps can be the JSON array itself or a string of it
+type procedureRequest struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      string          `json:"params,omitempty"`
+	Steps       json.RawMessage `json:"steps"`
+}
+
+// HandleCallProcedure runs /db/api/procedures/<name>, the body is a JSON object of the parameters
+func HandleCallProcedure(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/procedures/", suresql.ProcedureTable{}.TableName())
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	path := ctx.GetPath()
+	name := path[strings.LastIndex(path, "/")+1:]
+	state.Label += name
+	proc, err := suresql.GetProcedure(name)
+	if err != nil {
+		if err == suresql.ErrProcedureNotFound {
+			return state.SetError("Procedure not found", err, http.StatusNotFound).LogAndResponse("procedure not found", name, true)
+		}
+		return state.SetError("Failed to get procedure", err, http.StatusInternalServerError).LogAndResponse("failed to get procedure", name, true)
+	}
+
+	args := map[string]interface{}{}
+	if len(ctx.GetBody()) > 0 {
+		if err := ctx.BindJSON(&args); err != nil {
+			return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+		}
+	}
+
+	if err := proc.CheckArgs(args); err != nil {
+		return state.SetError("Invalid procedure call", err, http.StatusBadRequest).LogAndResponse("missing procedure parameter", nil, true)
+	}
+
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+	// the statements of a procedure are not known here
+	defer suresql.ResultCache.InvalidateAll()
+
+	result, err := suresql.RunProcedure(userDB, proc, args)
+	if err != nil {
+		if failure, ok := err.(suresql.ProcedureFailure); ok {
+			return state.SetError(failure.Message, nil, http.StatusUnprocessableEntity).LogAndResponse(fmt.Sprintf("procedure failed at step %d", failure.Step), failure, true)
+		}
+		if err == suresql.ErrAtomicNotSupported {
+			return state.SetError("Procedures writing more than one statement are not supported by this DBMS", err, http.StatusNotImplemented).LogAndResponse("atomic batch not supported", nil, true)
+		}
+		return state.SetError("Procedure failed", err, http.StatusInternalServerError).LogAndResponse("procedure failed", nil, true)
+	}
+	meterRows(ctx, 0, result.RowsAffected)
+	return state.SetSuccess("Procedure executed successfully", result).LogAndResponse(fmt.Sprintf("procedure %s, statements:%d", name, result.Statements), nil, true)
+}
+
+// HandleListProcedures lists the procedures (internal)
+func HandleListProcedures(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_procedures", suresql.ProcedureTable{}.TableName())
+
+	procs, err := suresql.ListProcedures()
+	if err != nil {
+		return state.SetError("Failed to list procedures", err, http.StatusInternalServerError).LogAndResponse("failed to list procedures", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Procedures retrieved successfully: %d", len(procs)), procs).LogAndResponse(fmt.Sprintf("success count:%d", len(procs)), nil, true)
+}
+
+// HandleSaveProcedure creates or replaces a procedure by name (internal)
+func HandleSaveProcedure(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_procedure", suresql.ProcedureTable{}.TableName())
+
+	var req procedureRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	proc := suresql.ProcedureTable{Name: req.Name, Description: req.Description, Params: req.Params, Steps: string(req.Steps)}
+	var steps string
+	if json.Unmarshal(req.Steps, &steps) == nil {
+		proc.Steps = steps
+	}
+	if err := proc.Validate(); err != nil {
+		return state.SetError("Invalid procedure", err, http.StatusBadRequest).LogAndResponse("procedure validation failed", nil, true)
+	}
+	if err := suresql.SaveProcedure(proc); err != nil {
+		return state.SetError("Failed to save procedure", err, http.StatusInternalServerError).LogAndResponse("failed to save procedure", nil, true)
+	}
+	return state.SetSuccess("Procedure saved successfully", proc).LogAndResponse("procedure saved: "+proc.Name, nil, true)
+}
+
+// HandleDeleteProcedure removes ?name= (internal)
+func HandleDeleteProcedure(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_procedure", suresql.ProcedureTable{}.TableName())
+
+	name := ctx.GetQueryParam("name")
+	if name == "" {
+		return state.SetError("name is required", nil, http.StatusBadRequest).LogAndResponse("missing procedure name", nil, true)
+	}
+	if err := suresql.DeleteProcedure(name); err != nil {
+		return state.SetError("Failed to delete procedure", err, http.StatusInternalServerError).LogAndResponse("failed to delete procedure", name, true)
+	}
+	return state.SetSuccess("Procedure deleted successfully", nil).LogAndResponse("procedure deleted: "+name, nil, true)
+}
@@ -7,6 +7,7 @@ import (
 
 	orm "github.com/medatechnology/simpleorm"
 
+	"github.com/medatechnology/goutil/medaerror"
 	"github.com/medatechnology/simplehttp"
 )
 
@@ -40,10 +41,35 @@ func HandleQuery(ctx simplehttp.Context) error {
 		return state.SetError("Invalid table name", err, http.StatusBadRequest).LogAndResponse("table name validation failed", err, true)
 	}
 
+	// Reject a bad transform before going to the DB
+	if queryReq.Transform != nil {
+		if err := queryReq.Transform.Validate(); err != nil {
+			return state.SetError("Invalid transform", err, http.StatusBadRequest).LogAndResponse("transform validation failed", err, true)
+		}
+	}
+
+	// Fields are checked against the live schema, selected in SQL unless transform expressions need whole rows
+	fields, err := suresql.ValidateFields(queryReq)
+	if err != nil {
+		return state.SetError("Invalid fields", err, http.StatusBadRequest).LogAndResponse("fields validation failed", err, true)
+	}
+	var columns []string
+	if len(fields) > 0 && queryReq.AsOf == nil && suresql.ProjectInSQL(queryReq) {
+		columns = fields
+	}
+
 	// Find the user's database connection from TTL map
-	userDB, err := suresql.CurrentNode.GetDBConnectionByToken(state.Token.Token)
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
 	if err != nil {
-		return state.SetError("Cannot get DB connection", err, http.StatusInternalServerError).LogAndResponse("cannot get DB connection, maybe disconnected", nil, true)
+		return respondDBConnectionError(&state, err)
+	}
+	userDB, done, err := state.RouteRead(userDB)
+	if done {
+		return err
+	}
+	userDB, done, err = state.ConsistentRead(userDB, queryReq.Consistency, queryReq.Freshness)
+	if done {
+		return err
 	}
 
 	// Prepare response
@@ -53,15 +79,124 @@ func HandleQuery(ctx simplehttp.Context) error {
 		Count:         0,
 	}
 
-	// Check if we have a condition
+	// A page is the limit and offset of the condition
+	pageSize, err := suresql.ApplyPage(&queryReq)
+	if err != nil {
+		return state.SetError("Invalid page", err, http.StatusBadRequest).LogAndResponse("page validation failed", err, true)
+	}
+	// Or the page after a cursor, the sort keys are selected too as the next cursor is made of them
+	cursor, err := suresql.ApplyCursor(&queryReq)
+	if err != nil {
+		return state.SetError("Invalid cursor", err, http.StatusBadRequest).LogAndResponse("cursor validation failed", err, true)
+	}
+	if cursor != nil {
+		columns = suresql.CursorColumns(columns, cursor.Keys)
+	}
+
+	// Without a limit the rows are capped at query/default_limit (when set), the response warns when it applied
+	implicitLimit := 0
+	if limit := suresql.DefaultQueryLimit(); limit > 0 && !queryReq.SingleRow && (queryReq.Condition == nil || queryReq.Condition.Limit == 0) {
+		condition := orm.Condition{}
+		if queryReq.Condition != nil {
+			condition = *queryReq.Condition
+		}
+		condition.Limit = limit
+		queryReq.Condition = &condition
+		implicitLimit = limit
+	}
+	// Over connection/max_rows (when set) one row more is selected, it tells the result is cut, pages are not
+	maxRows := 0
+	if max := suresql.MaxRows(); max > 0 && !queryReq.SingleRow && pageSize == 0 && cursor == nil &&
+		(queryReq.Condition == nil || queryReq.Condition.Limit == 0 || queryReq.Condition.Limit > max) {
+		condition := orm.Condition{}
+		if queryReq.Condition != nil {
+			condition = *queryReq.Condition
+		}
+		condition.Limit = max + 1
+		queryReq.Condition = &condition
+		maxRows = max
+	}
+
+	// Check if we have a condition, selected fields go through the query builder too
 	hasCondition := queryReq.Condition != nil && !isEmptyCondition(queryReq.Condition)
+	useBuilder := hasCondition || len(columns) > 0 || queryReq.Distinct
+	var rendered orm.ParametereizedSQL
+	var aggregates []suresql.AggregateFunction
+	if queryReq.Grouped() {
+		// Group columns and aggregates instead of SELECT *, filtered by having
+		rendered, aggregates, err = suresql.BuildGroupedQuery(queryReq)
+		if err != nil {
+			return state.SetError("Invalid condition", err, http.StatusBadRequest).LogAndResponse("condition validation failed", err, true)
+		}
+		state.Statements = []string{rendered.Query}
+	} else if len(queryReq.Joins) > 0 {
+		// Joined tables are validated like the queried one
+		rendered, err = suresql.BuildJoinedQuery(queryReq)
+		if err != nil {
+			return state.SetError("Invalid join", err, http.StatusBadRequest).LogAndResponse("join validation failed", err, true)
+		}
+		state.Statements = []string{rendered.Query}
+	} else if useBuilder {
+		// Reject bad column names/operators before going to the DB
+		built, err := suresql.BuildSelectColumns(suresql.CurrentDialect(), queryReq.Table, columns, queryReq.Distinct, queryReq.Condition)
+		if err != nil {
+			return state.SetError("Invalid condition", err, http.StatusBadRequest).LogAndResponse("condition validation failed", err, true)
+		}
+		state.Statements = []string{built.Query}
+	} else {
+		state.Statements = []string{"SELECT * FROM " + queryReq.Table}
+	}
 
-	// Use the appropriate query function based on SingleRow and Condition
-	if queryReq.SingleRow {
-		if hasCondition {
-			// SelectOneWithCondition
+	// Use the appropriate query function based on AsOf, SingleRow and Condition
+	asOfTotal := 0
+	if queryReq.AsOf != nil {
+		state.Label += "AsOf"
+		records, total, err := queryAsOf(userDB, queryReq)
+		if err != nil {
+			switch err {
+			case suresql.ErrCDCNotEnabled, suresql.ErrAsOfBeforeCDC, errAsOfGroupBy:
+				return state.SetError(err.Error(), err, http.StatusBadRequest).LogAndResponse("time-travel query rejected", queryReq, true)
+			}
+			return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to reconstruct rows as of "+queryReq.AsOf.String(), queryReq, true)
+		}
+		response.Records = records
+		response.Count = len(records)
+		asOfTotal = total
+		state.LogMessage = "executed successfully"
+	} else if queryReq.Grouped() {
+		state.Label += "SelectGrouped"
+		rows, err := suresql.AggregateRows(userDB, rendered, aggregates)
+		if err != nil {
+			return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute SelectGrouped", queryReq, true)
+		}
+		response.Records = make([]orm.DBRecord, 0, len(rows))
+		for _, row := range rows {
+			response.Records = append(response.Records, orm.DBRecord{TableName: queryReq.Table, Data: row})
+		}
+		response.Count = len(response.Records)
+		state.LogMessage = "executed successfully"
+	} else if len(queryReq.Joins) > 0 {
+		state.Label += "SelectJoined"
+		records, err := userDB.SelectOneSQLParameterized(rendered)
+		if err != nil && err != orm.ErrSQLNoRows {
+			return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute SelectJoined", queryReq, true)
+		}
+		response.Records = make([]orm.DBRecord, 0, len(records))
+		for _, rec := range records {
+			response.Records = append(response.Records, orm.DBRecord{TableName: queryReq.Table, Data: rec.Data})
+		}
+		response.Count = len(response.Records)
+		state.LogMessage = "executed successfully"
+	} else if queryReq.SingleRow {
+		if useBuilder {
+			// SelectOneWithCondition, rendered by our builder so list values (IN/NOT IN/ANY) work on every DBMS
 			state.Label += "SelectOneWithCondition"
-			record, err := userDB.SelectOneWithCondition(queryReq.Table, queryReq.Condition)
+			single := orm.Condition{}
+			if queryReq.Condition != nil {
+				single = *queryReq.Condition
+			}
+			single.Limit = 1
+			records, err := selectWithCondition(userDB, queryReq.Table, columns, queryReq.Distinct, &single)
 			if err != nil {
 				if err == orm.ErrSQLNoRows {
 					// No results found - return empty result
@@ -69,9 +204,11 @@ func HandleQuery(ctx simplehttp.Context) error {
 				} else {
 					return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute SelectOneWithCondition", queryReq, true)
 				}
+			} else if len(records) == 0 {
+				state.LogMessage = "executed with no results"
 			} else {
 				// Add single record to response
-				response.Records = append(response.Records, record)
+				response.Records = append(response.Records, records[0])
 				response.Count = 1
 				state.LogMessage = "executed successfully"
 			}
@@ -93,11 +230,41 @@ func HandleQuery(ctx simplehttp.Context) error {
 				state.LogMessage = "executed successfully"
 			}
 		}
+	} else if rows, done, err := queryRowSet(&state, userDB, queryReq, cursor, columns, useBuilder); done || rows != nil {
+		// Large results are written from the row set, no records are built
+		if done {
+			return err
+		}
+		rows.RenameColumns(fields)
+		if maxRows > 0 {
+			keep, done, err := capRows(&state, rows.Len())
+			if done {
+				return err
+			}
+			response.Truncated = keep < rows.Len()
+			rows.Rows = rows.Rows[:keep]
+		}
+		response.Count = rows.Len()
+		response.ExecutionTime = state.SaveStopTimer()
+		meterRows(ctx, response.Count, 0)
+		if implicitLimit > 0 && response.Count >= implicitLimit {
+			state.Warn("no limit given, the result was capped at %d rows", implicitLimit)
+		}
+		if pageSize > 0 {
+			if done, err := setPageTotal(&state, userDB, queryReq, columns, pageSize, 0, &response); done {
+				return err
+			}
+		}
+		if done, err := state.NotModified(ContentETag(rows)); done {
+			return err
+		}
+		full := rowSetResponse{Records: rows, QueryResponse: response}
+		return state.SetSuccess("Query executed successfully", full).LogAndResponse("query executed successfully", full, true)
 	} else {
-		if hasCondition {
+		if useBuilder {
 			// SelectManyWithCondition
 			state.Label += "SelectManyWithCondition"
-			records, err := userDB.SelectManyWithCondition(queryReq.Table, queryReq.Condition)
+			records, err := selectWithCondition(userDB, queryReq.Table, columns, queryReq.Distinct, queryReq.Condition)
 			if err != nil {
 				if err == orm.ErrSQLNoRows {
 					// No results found - return empty result
@@ -129,14 +296,169 @@ func HandleQuery(ctx simplehttp.Context) error {
 		}
 	}
 
+	if maxRows > 0 {
+		keep, done, err := capRows(&state, response.Count)
+		if done {
+			return err
+		}
+		response.Truncated = keep < response.Count
+		response.Records, response.Count = response.Records[:keep], keep
+	}
+
+	// The total of a paged query, counted unless the page is the last one
+	if pageSize > 0 {
+		if done, err := setPageTotal(&state, userDB, queryReq, columns, pageSize, asOfTotal, &response); done {
+			return err
+		}
+	}
+	if cursor != nil {
+		next, err := cursor.Next(response.Records)
+		if err != nil {
+			state.Warn("%s", err.Error())
+		}
+		response.NextCursor, response.HasMore = next, next != ""
+	}
+
 	// Calculate total execution time
 	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, response.Count, 0)
+	if implicitLimit > 0 && response.Count >= implicitLimit {
+		state.Warn("no limit given, the result was capped at %d rows", implicitLimit)
+	}
+	if !queryReq.Distinct {
+		suresql.ApplyTransformExpressions(queryReq.Table, response.Records)
+	}
+	suresql.ProjectRecords(response.Records, fields)
+	if queryReq.Transform != nil {
+		records, err := queryReq.Transform.Apply(response.Records)
+		if err != nil {
+			return state.SetError("Failed to transform the result", err, http.StatusBadRequest).LogAndResponse("failed to apply transform", queryReq.Transform, true)
+		}
+		response.Records = records
+		response.Count = len(records)
+	}
+	if done, err := state.NotModified(ContentETag(response.Records)); done {
+		return err
+	}
 	return state.SetSuccess("Query executed successfully", response).LogAndResponse("query executed successfully", response, true)
 }
 
+// setPageTotal sets the total of the page in the response, asOfTotal is the total of a time-travel query
+func setPageTotal(state *HandlerState, userDB suresql.SureSQLDB, queryReq suresql.QueryRequest, columns []string, pageSize, asOfTotal int, response *suresql.QueryResponse) (bool, error) {
+	offset := queryReq.Condition.Offset
+	total := offset + response.Count
+	if queryReq.AsOf != nil {
+		total = asOfTotal
+	} else if response.Count == pageSize || (response.Count == 0 && offset > 0) {
+		countSQL, err := suresql.BuildCountQuery(queryReq, columns)
+		if err == nil {
+			state.Statements = append(state.Statements, countSQL.Query)
+			total, err = suresql.CountTotal(userDB, countSQL)
+		}
+		if err != nil {
+			return true, state.SetError("Failed to count the records", err, http.StatusInternalServerError).LogAndResponse("failed to execute the count of the page", queryReq, true)
+		}
+	}
+	response.TotalCount = &total
+	response.HasMore = offset+response.Count < total
+	return false, nil
+}
+
+// capRows applies connection/max_rows to a result of n rows, it returns the rows to keep, done when the
+// result was refused
+func capRows(state *HandlerState, n int) (int, bool, error) {
+	keep, err := suresql.CapRows(n)
+	if err != nil {
+		return 0, true, state.SetError(err.Error(), err, http.StatusUnprocessableEntity).LogAndResponse("result over max_rows refused", n, true)
+	}
+	if keep < n {
+		state.Warn("the result was cut at %d rows (connection/max_rows)", keep)
+	}
+	return keep, false, nil
+}
+
+// rowSetResponse is a QueryResponse with the records of a row set
+type rowSetResponse struct {
+	Records *suresql.RowSet `json:"records"`
+	suresql.QueryResponse
+}
+
+// queryRowSet reads the rows of a many-row select as a row set, when nothing after the query needs them as
+// records (transforms, transform expressions, cursors). No row set and not done when the records path has
+// to run, done when the error was responded.
+func queryRowSet(state *HandlerState, userDB suresql.SureSQLDB, queryReq suresql.QueryRequest, cursor *suresql.CursorPage, columns []string, useBuilder bool) (*suresql.RowSet, bool, error) {
+	if queryReq.Transform != nil || cursor != nil || !suresql.ProjectInSQL(queryReq) || !suresql.HasRowSets(userDB) {
+		return nil, false, nil
+	}
+	// named like the records of the select: the parameterized one after the table in the SQL
+	table := queryReq.Table
+	p := orm.ParametereizedSQL{Query: "SELECT * FROM " + queryReq.Table}
+	if useBuilder {
+		built, err := suresql.BuildSelectColumns(suresql.CurrentDialect(), queryReq.Table, columns, queryReq.Distinct, queryReq.Condition)
+		if err != nil {
+			return nil, false, nil
+		}
+		table, p = "", built
+	}
+	state.Label += "RowSet"
+	rows, err := suresql.QueryRowSet(userDB, table, p)
+	if err != nil {
+		return nil, true, state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute the row set query", queryReq, true)
+	}
+	state.LogMessage = "executed successfully"
+	return rows, false, nil
+}
+
 // Helper function to check if a condition is empty
 func isEmptyCondition(c *orm.Condition) bool {
 	return c.Field == "" && len(c.Nested) == 0 &&
 		len(c.OrderBy) == 0 && len(c.GroupBy) == 0 &&
 		c.Limit == 0 && c.Offset == 0
 }
+
+var errAsOfGroupBy = medaerror.MedaError{Message: "group_by, aggregates, having and joins are not supported with as_of"}
+
+// queryAsOf reconstructs the table at the AsOf time from the CDC log, then filters, sorts and pages
+// in memory with the same semantics as the SQL condition, total is the number of records before paging
+func queryAsOf(db suresql.SureSQLDB, req suresql.QueryRequest) ([]orm.DBRecord, int, error) {
+	c := req.Condition
+	if req.Grouped() || len(req.Joins) > 0 {
+		return nil, 0, errAsOfGroupBy
+	}
+	rows, err := suresql.ReconstructAsOf(db, req.Table, *req.AsOf)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]orm.DBRecord, 0, len(rows))
+	for _, rec := range rows {
+		ok, err := suresql.MatchCondition(c, rec.Data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			records = append(records, rec)
+		}
+	}
+	if c == nil {
+		c = &orm.Condition{}
+	}
+	if err := suresql.SortRecords(records, c.OrderBy); err != nil {
+		return nil, 0, err
+	}
+	limit := c.Limit
+	if req.SingleRow {
+		limit = 1
+	}
+	return suresql.PageRecords(records, limit, c.Offset), len(records), nil
+}
+
+// selectWithCondition renders the condition with the query builder (dialect placeholders, list values)
+// and runs it as a parameterized select (distinct) of the columns, all when empty
+func selectWithCondition(db suresql.SureSQLDB, table string, columns []string, distinct bool, c *orm.Condition) ([]orm.DBRecord, error) {
+	paramSQL, err := suresql.BuildSelectColumns(suresql.CurrentDialect(), table, columns, distinct, c)
+	if err != nil {
+		return nil, err
+	}
+	records, err := db.SelectOneSQLParameterized(paramSQL)
+	return []orm.DBRecord(records), err
+}
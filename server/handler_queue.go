@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleWriteQueue returns the queued insert of ?sequence= of the user, ?wait= (ie: 5s) waits while it is
+// still queued. Without a sequence it returns the depth of the queue of the node.
+func HandleWriteQueue(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/queue", "request")
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	raw := ctx.GetQueryParam("sequence")
+	if raw == "" {
+		status := suresql.WriteQ.Status()
+		return state.SetSuccess(fmt.Sprintf("Write queue pending %d, last done %d", status.Pending, status.LastDone), status).LogAndResponse("write queue status", nil, false)
+	}
+	sequence, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return state.SetError("Invalid sequence", err, http.StatusBadRequest).LogAndResponse("invalid sequence "+raw, nil, true)
+	}
+	var wait time.Duration
+	if w := ctx.GetQueryParam("wait"); w != "" {
+		if wait, err = time.ParseDuration(w); err != nil {
+			return state.SetError("Invalid wait, use a duration like 5s", err, http.StatusBadRequest).LogAndResponse("invalid wait "+w, nil, true)
+		}
+	}
+
+	queued, err := suresql.WriteQ.Get(sequence, state.Token.UserName, wait)
+	if err != nil {
+		return state.SetError("Queued write not found", err, http.StatusNotFound).LogAndResponse("queued write not found", nil, true)
+	}
+	return state.SetSuccess("Queued write "+queued.Status, queued).LogAndResponse(fmt.Sprintf("queued write %d %s", sequence, queued.Status), nil, false)
+}
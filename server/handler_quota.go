@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleStorageUsage returns the storage usage and quota of the token's user and tenant
+func HandleStorageUsage(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/usage/", suresql.StorageUsageTable{}.TableName())
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	usage := []suresql.StorageUsageReport{suresql.Quotas.Usage(suresql.QUOTA_SUBJECT_USER, state.Token.UserName)}
+	if state.Token.Tenant != "" {
+		usage = append(usage, suresql.Quotas.Usage(suresql.QUOTA_SUBJECT_TENANT, state.Token.Tenant))
+	}
+	return state.SetSuccess("Storage usage retrieved successfully", usage).LogAndResponse("storage usage", nil, true)
+}
+
+// HandleListQuotas lists all storage quotas (internal)
+func HandleListQuotas(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_quotas", suresql.StorageQuotaTable{}.TableName())
+
+	quotas := suresql.Quotas.ListQuotas()
+	return state.SetSuccess(fmt.Sprintf("Quotas retrieved successfully: %d", len(quotas)), quotas).LogAndResponse(fmt.Sprintf("success count:%d", len(quotas)), nil, true)
+}
+
+// HandleSetQuota creates or replaces the quota of a user or tenant (internal)
+func HandleSetQuota(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "set_quota", suresql.StorageQuotaTable{}.TableName())
+
+	var quota suresql.StorageQuotaTable
+	if err := ctx.BindJSON(&quota); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if quota.Subject == "" || !suresql.IsValidQuotaSubject(quota.SubjectType) {
+		return state.SetError("subject and subject_type (user/tenant) are required", suresql.ErrInvalidQuotaSubject, http.StatusBadRequest).LogAndResponse("invalid quota subject", nil, true)
+	}
+	if quota.MaxRows < 0 || quota.MaxBytes < 0 {
+		return state.SetError("max_rows and max_bytes cannot be negative", nil, http.StatusBadRequest).LogAndResponse("negative quota", nil, true)
+	}
+
+	if err := suresql.Quotas.SetQuota(quota); err != nil {
+		return state.SetError("Failed to set quota", err, http.StatusInternalServerError).LogAndResponse("failed to upsert quota", nil, true)
+	}
+	return state.SetSuccess("Quota set successfully", quota).LogAndResponse(fmt.Sprintf("quota for %s %s set", quota.SubjectType, quota.Subject), nil, true)
+}
+
+// HandleDeleteQuota removes the quota of a user or tenant (internal)
+func HandleDeleteQuota(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_quota", suresql.StorageQuotaTable{}.TableName())
+
+	subjectType := ctx.GetQueryParam("subject_type")
+	subject := ctx.GetQueryParam("subject")
+	if subject == "" || !suresql.IsValidQuotaSubject(subjectType) {
+		return state.SetError("subject and subject_type (user/tenant) are required", suresql.ErrInvalidQuotaSubject, http.StatusBadRequest).LogAndResponse("invalid quota subject", nil, true)
+	}
+
+	if err := suresql.Quotas.DeleteQuota(subjectType, subject); err != nil {
+		return state.SetError("Failed to delete quota", err, http.StatusInternalServerError).LogAndResponse("failed to delete quota", nil, true)
+	}
+	return state.SetSuccess("Quota deleted successfully", nil).LogAndResponse(fmt.Sprintf("quota for %s %s deleted", subjectType, subject), nil, true)
+}
+
+// HandleListUsage lists the storage usage of all users and tenants (internal)
+func HandleListUsage(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_usage", suresql.StorageUsageTable{}.TableName())
+
+	usage, err := suresql.ListStorageUsage()
+	if err != nil {
+		return state.SetError("Failed to list storage usage", err, http.StatusInternalServerError).LogAndResponse("failed to list storage usage", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Storage usage retrieved successfully: %d", len(usage)), usage).LogAndResponse(fmt.Sprintf("success count:%d", len(usage)), nil, true)
+}
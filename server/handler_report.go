@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// ReportRequest runs a named report from the registry
+type ReportRequest struct {
+	Name   string                 `json:"name"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Format string                 `json:"format,omitempty"` // csv, html, pdf or json, default is the template format
+}
+
+// HandleReport runs a report template with the user's connection and returns the rendered file
+func HandleReport(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/report/", suresql.ReportTemplateTable{}.TableName())
+
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	var req ReportRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+
+	report, err := suresql.GetReportTemplate(req.Name)
+	if err != nil {
+		if err == suresql.ErrReportNotFound {
+			return state.SetError("Report not found", err, http.StatusNotFound).LogAndResponse("report not found: "+req.Name, nil, true)
+		}
+		return state.SetError("Failed to get report", err, http.StatusInternalServerError).LogAndResponse("failed to get report template", nil, true)
+	}
+
+	format := req.Format
+	if format == "" {
+		format = report.Format
+	}
+	if format == "" {
+		format = suresql.REPORT_FORMAT_CSV
+	}
+	if !suresql.IsValidReportFormat(format) {
+		return state.SetError("Invalid report format", suresql.ErrReportFormatUnknown, http.StatusBadRequest).LogAndResponse("invalid report format "+format, nil, true)
+	}
+
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+
+	data, err := suresql.RunReport(userDB, report, req.Params)
+	if err != nil {
+		return state.SetError("Failed to run report", err, http.StatusBadRequest).LogAndResponse("failed to run report "+req.Name, nil, true)
+	}
+	meterRows(ctx, len(data.Rows), 0)
+	// the etag covers the template, the format and the rows, not the time of generation, a 304 is not rendered
+	if done, err := state.NotModified(ContentETag([]interface{}{report, format, data.Columns, data.Rows})); done {
+		return err
+	}
+
+	if format == suresql.REPORT_FORMAT_JSON {
+		return state.SetSuccess(fmt.Sprintf("Report %s generated: %d rows", req.Name, len(data.Rows)), data).LogAndResponse("report generated", req.Name, true)
+	}
+
+	var buf bytes.Buffer
+	contentType, err := suresql.RenderReport(&buf, report, data, format)
+	if err != nil {
+		return state.SetError("Failed to render report", err, http.StatusInternalServerError).LogAndResponse("failed to render report "+req.Name, nil, true)
+	}
+	state.OnlyLog(fmt.Sprintf("report %s rendered as %s, rows:%d", req.Name, format, len(data.Rows)), nil, false)
+	ctx.SetResponseHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", req.Name, format))
+	return ctx.Stream(http.StatusOK, contentType, &buf)
+}
+
+// HandleListReports lists the report templates (internal)
+func HandleListReports(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_reports", suresql.ReportTemplateTable{}.TableName())
+
+	reports, err := suresql.ListReportTemplates()
+	if err != nil {
+		return state.SetError("Failed to list reports", err, http.StatusInternalServerError).LogAndResponse("failed to list reports", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Reports retrieved successfully: %d", len(reports)), reports).LogAndResponse(fmt.Sprintf("success count:%d", len(reports)), nil, true)
+}
+
+// HandleSaveReport creates or replaces a report template (internal)
+func HandleSaveReport(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_report", suresql.ReportTemplateTable{}.TableName())
+
+	var report suresql.ReportTemplateTable
+	if err := ctx.BindJSON(&report); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if err := suresql.ValidateReportTemplate(report); err != nil {
+		return state.SetError("Invalid report template", err, http.StatusBadRequest).LogAndResponse("report validation failed", nil, true)
+	}
+	if err := suresql.SaveReportTemplate(report); err != nil {
+		return state.SetError("Failed to save report", err, http.StatusInternalServerError).LogAndResponse("failed to save report", nil, true)
+	}
+	return state.SetSuccess("Report saved successfully", report).LogAndResponse("report "+report.Name+" saved", nil, true)
+}
+
+// HandleDeleteReport removes a report template (internal)
+func HandleDeleteReport(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_report", suresql.ReportTemplateTable{}.TableName())
+
+	name := ctx.GetQueryParam("name")
+	if name == "" {
+		return state.SetError("Report name is required", nil, http.StatusBadRequest).LogAndResponse("missing report name", nil, true)
+	}
+	if err := suresql.DeleteReportTemplate(name); err != nil {
+		return state.SetError("Failed to delete report", err, http.StatusInternalServerError).LogAndResponse("failed to delete report", nil, true)
+	}
+	return state.SetSuccess("Report deleted successfully", nil).LogAndResponse("report "+name+" deleted", nil, true)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListReportSchedules lists the report schedules (internal)
+func HandleListReportSchedules(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_report_schedules", suresql.ReportScheduleTable{}.TableName())
+
+	schedules, err := suresql.ListReportSchedules()
+	if err != nil {
+		return state.SetError("Failed to list report schedules", err, http.StatusInternalServerError).LogAndResponse("failed to list report schedules", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Report schedules retrieved successfully: %d", len(schedules)), schedules).LogAndResponse(fmt.Sprintf("success count:%d", len(schedules)), nil, true)
+}
+
+// HandleSaveReportSchedule creates (POST, no id) or updates (PUT, with id) a report schedule (internal)
+func HandleSaveReportSchedule(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_report_schedule", suresql.ReportScheduleTable{}.TableName())
+
+	var schedule suresql.ReportScheduleTable
+	if err := ctx.BindJSON(&schedule); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if ctx.GetMethod() == http.MethodPost {
+		schedule.ID = 0
+	} else if schedule.ID == 0 {
+		return state.SetError("Schedule id is required", nil, http.StatusBadRequest).LogAndResponse("missing schedule id", nil, true)
+	}
+	if err := schedule.Validate(); err != nil {
+		return state.SetError("Invalid report schedule", err, http.StatusBadRequest).LogAndResponse("report schedule validation failed", nil, true)
+	}
+
+	schedule, err := suresql.SaveReportSchedule(schedule)
+	if err != nil {
+		if err == suresql.ErrReportScheduleNotFound {
+			return state.SetError("Report schedule not found", err, http.StatusNotFound).LogAndResponse("report schedule not found", nil, true)
+		}
+		return state.SetError("Failed to save report schedule", err, http.StatusInternalServerError).LogAndResponse("failed to save report schedule", nil, true)
+	}
+	return state.SetSuccess("Report schedule saved successfully", schedule).LogAndResponse(fmt.Sprintf("report schedule %d saved", schedule.ID), nil, true)
+}
+
+// HandleDeleteReportSchedule removes a report schedule (internal)
+func HandleDeleteReportSchedule(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_report_schedule", suresql.ReportScheduleTable{}.TableName())
+
+	id, err := strconv.Atoi(ctx.GetQueryParam("id"))
+	if err != nil {
+		return state.SetError("Schedule id is required", err, http.StatusBadRequest).LogAndResponse("missing or invalid schedule id", nil, true)
+	}
+	if err := suresql.DeleteReportSchedule(id); err != nil {
+		return state.SetError("Failed to delete report schedule", err, http.StatusInternalServerError).LogAndResponse("failed to delete report schedule", nil, true)
+	}
+	return state.SetSuccess("Report schedule deleted successfully", nil).LogAndResponse(fmt.Sprintf("report schedule %d deleted", id), nil, true)
+}
+
+// HandleRunReportSchedule delivers a scheduled report now, ie: to test the schedule and smtp settings (internal)
+func HandleRunReportSchedule(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "run_report_schedule", suresql.ReportScheduleTable{}.TableName())
+
+	id, err := strconv.Atoi(ctx.GetQueryParam("id"))
+	if err != nil {
+		return state.SetError("Schedule id is required", err, http.StatusBadRequest).LogAndResponse("missing or invalid schedule id", nil, true)
+	}
+	schedule, err := suresql.GetReportSchedule(id)
+	if err != nil {
+		if err == suresql.ErrReportScheduleNotFound {
+			return state.SetError("Report schedule not found", err, http.StatusNotFound).LogAndResponse("report schedule not found", nil, true)
+		}
+		return state.SetError("Failed to get report schedule", err, http.StatusInternalServerError).LogAndResponse("failed to get report schedule", nil, true)
+	}
+	if err := suresql.DeliverScheduledReport(schedule); err != nil {
+		return state.SetError("Failed to deliver report", err, http.StatusBadGateway).LogAndResponse(fmt.Sprintf("report schedule %d delivery failed", id), nil, true)
+	}
+	return state.SetSuccess("Report delivered", nil).LogAndResponse(fmt.Sprintf("report schedule %d delivered to %s", id, schedule.Recipients), nil, true)
+}
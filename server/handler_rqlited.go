@@ -0,0 +1,17 @@
+package server
+
+import (
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleEmbeddedRqlite returns the state of the rqlited run by this node (internal)
+func HandleEmbeddedRqlite(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/rqlited", "rqlited")
+
+	if suresql.Rqlited == nil {
+		suresql.InitEmbeddedRqlite()
+	}
+	return state.SetSuccess("Embedded rqlited", suresql.Rqlited.Status()).LogAndResponse("embedded rqlited status", nil, false)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListRules lists the rules with their last run status (internal)
+func HandleListRules(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_rules", suresql.RuleTable{}.TableName())
+
+	rules, err := suresql.ListRules()
+	if err != nil {
+		return state.SetError("Failed to list rules", err, http.StatusInternalServerError).LogAndResponse("failed to list rules", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Rules retrieved successfully: %d", len(rules)), rules).LogAndResponse(fmt.Sprintf("success count:%d", len(rules)), nil, true)
+}
+
+// HandleSaveRule creates (POST, no id) or updates (PUT, with id) a rule (internal)
+func HandleSaveRule(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_rule", suresql.RuleTable{}.TableName())
+
+	var rule suresql.RuleTable
+	if err := ctx.BindJSON(&rule); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if ctx.GetMethod() == http.MethodPost {
+		rule.ID = 0
+	} else if rule.ID == 0 {
+		return state.SetError("Rule id is required", nil, http.StatusBadRequest).LogAndResponse("missing rule id", nil, true)
+	}
+	if err := rule.Validate(); err != nil {
+		return state.SetError("Invalid rule", err, http.StatusBadRequest).LogAndResponse("rule validation failed", nil, true)
+	}
+
+	rule, err := suresql.SaveRule(rule)
+	if err != nil {
+		if err == suresql.ErrRuleNotFound {
+			return state.SetError("Rule not found", err, http.StatusNotFound).LogAndResponse("rule not found", nil, true)
+		}
+		return state.SetError("Failed to save rule", err, http.StatusInternalServerError).LogAndResponse("failed to save rule", nil, true)
+	}
+	return state.SetSuccess("Rule saved successfully", rule).LogAndResponse(fmt.Sprintf("rule %d %s saved", rule.ID, rule.Name), nil, true)
+}
+
+// HandleDeleteRule removes a rule (internal)
+func HandleDeleteRule(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_rule", suresql.RuleTable{}.TableName())
+
+	id, err := strconv.Atoi(ctx.GetQueryParam("id"))
+	if err != nil {
+		return state.SetError("Rule id is required", err, http.StatusBadRequest).LogAndResponse("missing or invalid rule id", nil, true)
+	}
+	if err := suresql.DeleteRule(id); err != nil {
+		return state.SetError("Failed to delete rule", err, http.StatusInternalServerError).LogAndResponse("failed to delete rule", nil, true)
+	}
+	return state.SetSuccess("Rule deleted successfully", nil).LogAndResponse(fmt.Sprintf("rule %d deleted", id), nil, true)
+}
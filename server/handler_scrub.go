@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListScrubRules lists the scrub rules, of ?profile= when given (internal)
+func HandleListScrubRules(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_scrub_rules", suresql.ScrubRuleTable{}.TableName())
+
+	rules, err := suresql.ListScrubRules(ctx.GetQueryParam("profile"))
+	if err != nil {
+		return state.SetError("Failed to list scrub rules", err, http.StatusInternalServerError).LogAndResponse("failed to list scrub rules", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Scrub rules retrieved successfully: %d", len(rules)), rules).LogAndResponse(fmt.Sprintf("success count:%d", len(rules)), nil, true)
+}
+
+// HandleSaveScrubRules creates or replaces an array of scrub rules (internal)
+func HandleSaveScrubRules(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_scrub_rules", suresql.ScrubRuleTable{}.TableName())
+
+	var rules []suresql.ScrubRuleTable
+	if err := ctx.BindJSON(&rules); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if len(rules) == 0 {
+		return state.SetError("No scrub rules provided", nil, http.StatusBadRequest).LogAndResponse("no scrub rules in request body", nil, true)
+	}
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return state.SetError("Invalid scrub rule", err, http.StatusBadRequest).LogAndResponse("scrub rule validation failed", r, true)
+		}
+	}
+	if err := suresql.SaveScrubRules(rules); err != nil {
+		return state.SetError("Failed to save scrub rules", err, http.StatusInternalServerError).LogAndResponse("failed to save scrub rules", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Scrub rules saved successfully: %d", len(rules)), nil).LogAndResponse(fmt.Sprintf("%d scrub rules saved", len(rules)), nil, true)
+}
+
+// HandleDeleteScrubRule removes ?id= (internal)
+func HandleDeleteScrubRule(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_scrub_rule", suresql.ScrubRuleTable{}.TableName())
+
+	id, err := strconv.Atoi(ctx.GetQueryParam("id"))
+	if err != nil {
+		return state.SetError("Scrub rule id is required", err, http.StatusBadRequest).LogAndResponse("missing or invalid scrub rule id", nil, true)
+	}
+	if err := suresql.DeleteScrubRule(id); err != nil {
+		if err == suresql.ErrScrubRuleNotFound {
+			return state.SetError("Scrub rule not found", err, http.StatusNotFound).LogAndResponse("scrub rule not found", nil, true)
+		}
+		return state.SetError("Failed to delete scrub rule", err, http.StatusInternalServerError).LogAndResponse("failed to delete scrub rule", nil, true)
+	}
+	return state.SetSuccess("Scrub rule deleted successfully", nil).LogAndResponse(fmt.Sprintf("scrub rule %d deleted", id), nil, true)
+}
+
+// HandleExportTable streams ?table= scrubbed with ?profile= as ndjson (default) or csv (?format=), for
+// staging datasets (internal)
+func HandleExportTable(ctx simplehttp.Context) error {
+	table := ctx.GetQueryParam("table")
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "export_table", table)
+
+	export, err := suresql.PrepareExport(table, ctx.GetQueryParam("profile"), ctx.GetQueryParam("format"))
+	if err != nil {
+		switch err {
+		case suresql.ErrScrubProfileNotFound, suresql.ErrTableNotExist:
+			return state.SetError(err.Error(), err, http.StatusNotFound).LogAndResponse("cannot export "+table, nil, true)
+		}
+		return state.SetError("Invalid export", err, http.StatusBadRequest).LogAndResponse("cannot export "+table, nil, true)
+	}
+
+	// rows are written while the response is sent, an error half way ends the body early
+	pr, pw := io.Pipe()
+	go func() {
+		rows, err := export.WriteTo(context.Background(), pw)
+		if err != nil {
+			simplelog.LogErrorAny("export_table", err, fmt.Sprintf("export of %s stopped after %d rows", table, rows))
+		}
+		pw.CloseWithError(err)
+	}()
+	state.OnlyLog(fmt.Sprintf("%s exported with profile %s as %s", table, export.Profile.Name, export.Format), nil, false)
+	ctx.SetResponseHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", table, export.Format))
+	return ctx.Stream(http.StatusOK, export.ContentType(), pr)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListSecurityEvents lists the newest security events, filters ?type= ?severity= (minimum) ?since= ?limit= (internal)
+func HandleListSecurityEvents(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_security_events", suresql.SecurityEventTable{}.TableName())
+
+	var since time.Time
+	if sinceParam := ctx.GetQueryParam("since"); sinceParam != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, sinceParam); err != nil {
+			return state.SetError("Invalid since, use RFC 3339", err, http.StatusBadRequest).LogAndResponse("invalid since", sinceParam, true)
+		}
+	}
+	limit, _ := strconv.Atoi(ctx.GetQueryParam("limit"))
+	events, err := suresql.ListSecurityEvents(ctx.GetQueryParam("type"), ctx.GetQueryParam("severity"), since, limit)
+	if err != nil {
+		return state.SetError("Failed to list security events", err, http.StatusInternalServerError).LogAndResponse("failed to list security events", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Security events retrieved successfully: %d", len(events)), events).LogAndResponse(fmt.Sprintf("success count:%d", len(events)), nil, true)
+}
+
+// HandlePurgeSecurityEvents deletes the security events older than ?before=YYYY-MM-DD (internal)
+func HandlePurgeSecurityEvents(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "purge_security_events", suresql.SecurityEventTable{}.TableName())
+
+	before, err := time.Parse("2006-01-02", ctx.GetQueryParam("before"))
+	if err != nil {
+		return state.SetError("before is required (YYYY-MM-DD)", err, http.StatusBadRequest).LogAndResponse("invalid before", nil, true)
+	}
+	count, err := suresql.PurgeSecurityEvents(before)
+	if err != nil {
+		return state.SetError("Failed to purge security events", err, http.StatusInternalServerError).LogAndResponse("failed to purge security events", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Security events purged successfully: %d", count), count).LogAndResponse(fmt.Sprintf("purged count:%d", count), nil, true)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+const SETTINGS_EVENTS_PING = 15 * time.Second
+
+// HandleListSettings lists the settings of ?category= (every category when empty), secrets are masked (internal)
+func HandleListSettings(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_settings", suresql.SettingTable{}.TableName())
+
+	settings, err := suresql.ListSettings(ctx.GetQueryParam("category"))
+	if err != nil {
+		return state.SetError("Failed to list settings", err, http.StatusInternalServerError).LogAndResponse("failed to list settings", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Settings retrieved successfully: %d", len(settings)), settings).LogAndResponse(fmt.Sprintf("success count:%d", len(settings)), nil, true)
+}
+
+// HandleSaveSetting creates or replaces a setting, the value is checked against the type of a known key (internal)
+func HandleSaveSetting(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_setting", suresql.SettingTable{}.TableName())
+
+	var req suresql.SettingRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	// Reject unknown keys and values of the wrong type before going to the DB
+	if _, err := suresql.ValidateSetting(req); err != nil {
+		return state.SetError("Invalid setting", err, http.StatusBadRequest).LogAndResponse("setting validation failed", err, true)
+	}
+	saved, err := suresql.SaveSetting(req, state.User)
+	if err != nil {
+		return state.SetError("Failed to save setting", err, http.StatusInternalServerError).LogAndResponse("failed to save setting", nil, true)
+	}
+	return state.SetSuccess("Setting saved successfully", saved).LogAndResponse(fmt.Sprintf("setting %s/%s saved", saved.Category, saved.SettingKey), nil, true)
+}
+
+// HandleDeleteSetting removes ?category=&key=, the default of the code applies again (internal)
+func HandleDeleteSetting(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_setting", suresql.SettingTable{}.TableName())
+
+	category, key := ctx.GetQueryParam("category"), ctx.GetQueryParam("key")
+	if category == "" || key == "" {
+		return state.SetError("Category and key are required", nil, http.StatusBadRequest).LogAndResponse("missing category or key", nil, true)
+	}
+	if err := suresql.DeleteSetting(category, key, state.User); err != nil {
+		if err == suresql.ErrSettingNotFound {
+			return state.SetError("Setting not found", err, http.StatusNotFound).LogAndResponse("setting not found: "+category+"/"+key, nil, true)
+		}
+		return state.SetError("Failed to delete setting", err, http.StatusInternalServerError).LogAndResponse("failed to delete setting", nil, true)
+	}
+	return state.SetSuccess("Setting deleted successfully", nil).LogAndResponse("setting deleted: "+category+"/"+key, nil, true)
+}
+
+// HandleListSettingsHistory lists the newest changes of the settings, filters ?category= ?limit= (internal)
+func HandleListSettingsHistory(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_settings_history", suresql.SettingHistoryTable{}.TableName())
+
+	limit, _ := strconv.Atoi(ctx.GetQueryParam("limit"))
+	changes, err := suresql.ListSettingsHistory(ctx.GetQueryParam("category"), limit)
+	if err != nil {
+		return state.SetError("Failed to list settings history", err, http.StatusInternalServerError).LogAndResponse("failed to list settings history", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Settings history retrieved successfully: %d", len(changes)), changes).LogAndResponse(fmt.Sprintf("success count:%d", len(changes)), nil, true)
+}
+
+// HandleSettingsEvents streams the settings changes applied by this node as server-sent events, a comment
+// line every SETTINGS_EVENTS_PING keeps proxies from closing an idle stream (internal)
+func HandleSettingsEvents(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "settings_events", suresql.SettingTable{}.TableName())
+
+	events, unsubscribe := suresql.ConfigEvents.Subscribe()
+	// the stream ends when the client goes away: the pipe is closed and the next write fails
+	pr, pw := io.Pipe()
+	go func() {
+		defer unsubscribe()
+		ping := time.NewTicker(SETTINGS_EVENTS_PING)
+		defer ping.Stop()
+		var err error
+		for err == nil {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					pw.Close()
+					return
+				}
+				data, _ := json.Marshal(e)
+				_, err = fmt.Fprintf(pw, "id: %d\nevent: setting\ndata: %s\n\n", e.ID, data)
+			case <-ping.C:
+				_, err = io.WriteString(pw, ": ping\n\n")
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	state.OnlyLog("settings events stream opened", nil, false)
+	ctx.SetResponseHeader("Cache-Control", "no-cache")
+	ctx.SetResponseHeader("X-Accel-Buffering", "no")
+	return ctx.Stream(http.StatusOK, "text/event-stream", pr)
+}
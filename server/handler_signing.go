@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleListSigningKeys lists the HMAC signing keys, secrets are never returned (internal)
+func HandleListSigningKeys(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_signing_keys", suresql.SigningKeyTable{}.TableName())
+
+	keys, err := suresql.ListSigningKeys()
+	if err != nil {
+		return state.SetError("Failed to list signing keys", err, http.StatusInternalServerError).LogAndResponse("failed to list signing keys", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Signing keys retrieved successfully: %d", len(keys)), keys).LogAndResponse(fmt.Sprintf("success count:%d", len(keys)), nil, true)
+}
+
+// HandleCreateSigningKey creates a signing key for ?username=, the secret is only shown in this response (internal)
+func HandleCreateSigningKey(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "create_signing_key", suresql.SigningKeyTable{}.TableName())
+
+	username := ctx.GetQueryParam("username")
+	if username == "" {
+		return state.SetError("username is required", nil, http.StatusBadRequest).LogAndResponse("missing username", nil, true)
+	}
+	if _, err := userNameExist(username); err != nil {
+		return state.SetError("User not found", err, http.StatusNotFound).LogAndResponse("user not found", username, true)
+	}
+	key, err := suresql.CreateSigningKey(username)
+	if err != nil {
+		return state.SetError("Failed to create signing key", err, http.StatusInternalServerError).LogAndResponse("failed to create signing key", nil, true)
+	}
+	return state.SetSuccess("Signing key created successfully", key).LogAndResponse("signing key created for user:"+username, key.KeyID, true)
+}
+
+// HandleDeleteSigningKey revokes ?key_id= and closes the session its requests were using (internal)
+func HandleDeleteSigningKey(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_signing_key", suresql.SigningKeyTable{}.TableName())
+
+	keyID := ctx.GetQueryParam("key_id")
+	if keyID == "" {
+		return state.SetError("key_id is required", nil, http.StatusBadRequest).LogAndResponse("missing key_id", nil, true)
+	}
+	if err := suresql.DeleteSigningKey(keyID); err != nil {
+		return state.SetError("Failed to delete signing key", err, http.StatusInternalServerError).LogAndResponse("failed to delete signing key", keyID, true)
+	}
+	if val, ok := signedSessions.LoadAndDelete(keyID); ok {
+		TokenStore.TokenMap.Delete(val.(string))
+		suresql.CurrentNode.CloseDBConnection(val.(string))
+	}
+	return state.SetSuccess("Signing key deleted successfully", nil).LogAndResponse("signing key deleted", keyID, true)
+}
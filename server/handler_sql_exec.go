@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/medatechnology/suresql"
 
@@ -34,11 +35,28 @@ func HandleSQLExecution(ctx simplehttp.Context) error {
 		return state.SetError("No SQL statements provided", nil, http.StatusBadRequest).LogAndResponse("no sql statement in request body", nil, true)
 	}
 
+	state.Statements = requestStatements(sqlReq)
+
+	// ClickHouse tables are append-only, nothing of the request runs when one statement changes rows
+	if err := suresql.CheckAppendOnly(state.Statements); err != nil {
+		return state.SetError("Tables of this DBMS are append-only", err, http.StatusForbidden).LogAndResponse("update or delete refused", sqlReq.Statements, true)
+	}
+
+	// Dry run: the classification of the statements, none of them runs
+	if sqlReq.DryRun {
+		state.Label += "DryRun"
+		response := suresql.SQLResponse{Results: []orm.BasicSQLResult{}, Classification: suresql.ClassifyStatements(state.Statements)}
+		response.ExecutionTime = state.SaveStopTimer()
+		return state.SetSuccess("SQL classified, nothing was executed", response).LogAndResponse("dry run of sql", nil, true)
+	}
+
 	// Find the user's database connection from TTL map
-	userDB, err := suresql.CurrentNode.GetDBConnectionByToken(state.Token.Token)
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
 	if err != nil {
-		return state.SetError("Cannot get DB connection", err, http.StatusInternalServerError).LogAndResponse("cannot get DB connection, maybe disconnected", nil, true)
+		return respondDBConnectionError(&state, err)
 	}
+	// cached reads of the written tables are dropped once the statements ran, even the ones of a failed batch
+	defer suresql.ResultCache.InvalidateStatements(state.Statements)
 
 	// Prepare response
 	response := suresql.SQLResponse{
@@ -50,8 +68,38 @@ func HandleSQLExecution(ctx simplehttp.Context) error {
 	// var executionType string
 	// var err error
 
-	// Execute the appropriate type of SQL statements
-	if len(sqlReq.Statements) > 0 {
+	// Atomic: raw statements then parameterized ones in one transaction, nothing applied on a failure
+	if sqlReq.Atomic {
+		state.Label += "ExecAtomic"
+		statements := make([]orm.ParametereizedSQL, 0, len(sqlReq.Statements)+len(sqlReq.ParamSQL))
+		for _, q := range sqlReq.Statements {
+			statements = append(statements, orm.ParametereizedSQL{Query: q})
+		}
+		statements = append(statements, sqlReq.ParamSQL...)
+		results, err := suresql.ExecAtomic(userDB, statements)
+		if err == suresql.ErrAtomicNotSupported {
+			return state.SetError("Atomic batches are not supported by this DBMS", err, http.StatusNotImplemented).LogAndResponse("atomic batch not supported", nil, true)
+		}
+		if err != nil {
+			return state.SetError("Atomic batch failed and was rolled back", err, http.StatusInternalServerError).LogAndResponse("failed to execute atomic batch", summarizeSQLForLog(sqlReq), true)
+		}
+		response.Results = results
+		for _, result := range results {
+			response.RowsAffected += result.RowsAffected
+		}
+	} else if sqlReq.Parallel && len(sqlReq.Statements)+len(sqlReq.ParamSQL) > 1 {
+		// Parallel: independent statements run at once on the worker pool, a failure does not stop the others
+		state.Label += "ExecParallel"
+		results, err := suresql.ExecParallel(userDB, sqlReq.Statements, sqlReq.ParamSQL)
+		if err != nil {
+			return state.SetError("Statement failed, the other statements were executed", err, http.StatusInternalServerError).LogAndResponse("failed to execute parallel statements", summarizeSQLForLog(sqlReq), true)
+		}
+		response.Results = results
+		for _, result := range results {
+			response.RowsAffected += result.RowsAffected
+		}
+	} else if len(sqlReq.Statements) > 0 {
+		// Execute the appropriate type of SQL statements
 		// Raw SQL statements
 		if len(sqlReq.Statements) == 1 {
 			// Single raw SQL statement
@@ -101,11 +149,36 @@ func HandleSQLExecution(ctx simplehttp.Context) error {
 		}
 	}
 
+	// DDL changes the columns the insert validation checks against
+	if isSchemaChange(sqlReq) {
+		suresql.InvalidateTableSchema("")
+	}
+
 	// Calculate total execution time
 	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, 0, response.RowsAffected)
 	return state.SetSuccess("SQL executed successfully", response).LogAndResponse("raw sql executed successfully", response, true)
 }
 
+// isSchemaChange reports whether any statement is DDL (CREATE, ALTER or DROP)
+func isSchemaChange(req suresql.SQLRequest) bool {
+	statements := append([]string{}, req.Statements...)
+	for _, p := range req.ParamSQL {
+		statements = append(statements, p.Query)
+	}
+	for _, s := range statements {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CREATE", "ALTER", "DROP":
+			return true
+		}
+	}
+	return false
+}
+
 // Helper function to create a summary of the SQL statements for logging
 func summarizeSQLForLog(req suresql.SQLRequest) string {
 	if !LOG_RAW_QUERY {
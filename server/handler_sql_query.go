@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/medatechnology/suresql"
 
@@ -10,6 +11,9 @@ import (
 	"github.com/medatechnology/simplehttp"
 )
 
+// HEADER_CACHE tells whether the result came from the query cache, hit or miss
+const HEADER_CACHE = "X-SureSQL-Cache"
+
 // Note: Route registration is now handled in the main RegisterRoutes function
 
 // HandleSQLExecution processes SQL execution requests
@@ -31,18 +35,154 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 	if len(queryReqSQL.Statements) == 0 && len(queryReqSQL.ParamSQL) == 0 {
 		return state.SetError("No SQL statements provided", nil, http.StatusBadRequest).LogAndResponse("no sql statement in request body", nil, true)
 	}
+	if queryReqSQL.Stream && (len(queryReqSQL.Statements)+len(queryReqSQL.ParamSQL) != 1 || queryReqSQL.SingleRow) {
+		return state.SetError(suresql.ErrQueryStream.Message, suresql.ErrQueryStream, http.StatusBadRequest).LogAndResponse("stream validation failed", nil, true)
+	}
+
+	state.Statements = requestStatements(queryReqSQL)
 
 	// Find the user's database connection from TTL map
-	userDB, err := suresql.CurrentNode.GetDBConnectionByToken(state.Token.Token)
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
 	if err != nil {
-		return state.SetError("Cannot get DB connection", err, http.StatusInternalServerError).LogAndResponse("cannot get DB connection, maybe disconnected", nil, true)
+		return respondDBConnectionError(&state, err)
+	}
+	userDB, done, err := state.RouteRead(userDB)
+	if done {
+		return err
+	}
+	userDB, done, err = state.ConsistentRead(userDB, queryReqSQL.Consistency, queryReqSQL.Freshness)
+	if done {
+		return err
+	}
+	// Large selects can be streamed, the records are written while they are read
+	if queryReqSQL.Stream {
+		return streamSQLQuery(ctx, &state, userDB, queryReqSQL)
 	}
 
 	// Prepare response
 	var reponseMulti suresql.QueryResponseSQL
 
+	// the tables the selects read, for the cache and the shared selects
+	var tables []string
+	for _, q := range state.Statements {
+		tables = append(tables, suresql.SQLTables(q)...)
+	}
+
+	// With cache/ttl_ms the same statements of the user are answered from the cache until their tables are
+	// written, a request asking for a consistency level or for the leader always reads. The route is part of
+	// the key, a replica read does not answer a default one.
+	cacheKey, cached, shared := "", false, false
+	var cacheStamp suresql.CacheStamp
+	if suresql.CacheTTL() > 0 && queryReqSQL.Consistency == "" && queryReqSQL.Freshness == "" && state.Route != suresql.ROUTE_LEADER {
+		cacheKey = suresql.QueryCacheKey(state.Token.UserName, state.Route, queryReqSQL)
+		var v interface{}
+		if v, cached = suresql.ResultCache.Get(cacheKey); cached {
+			reponseMulti = append(suresql.QueryResponseSQL{}, v.(suresql.QueryResponseSQL)...)
+		} else {
+			cacheStamp = suresql.ResultCache.Stamp(tables)
+		}
+	}
+
 	// Execute the appropriate type of SQL statements
+	if cached {
+		state.Label += "Cached"
+		ctx.SetResponseHeader(HEADER_CACHE, "hit")
+		timing := state.SaveStopTimer()
+		for i := range reponseMulti {
+			reponseMulti[i].ExecutionTime = timing
+		}
+		state.LogMessage = "answered from the cache"
+	} else {
+		// Identical selects running at once share one execution, every request gets its own copy
+		var v interface{}
+		v, err, shared = suresql.ShareQuery(state.Token.UserName, state.Route, queryReqSQL, tables, func() (interface{}, error) {
+			return selectSQL(&state, userDB, queryReqSQL)
+		})
+		if err != nil {
+			return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+		}
+		results, _ := v.(suresql.QueryResponseSQL)
+		reponseMulti = append(reponseMulti, results...)
+		if shared {
+			state.Label += "Shared"
+			timing := state.SaveStopTimer()
+			for i := range reponseMulti {
+				reponseMulti[i].ExecutionTime = timing
+			}
+			state.LogMessage = "answered by an identical select running at once"
+		}
+	}
+
+	// Every result is cut at connection/max_rows, or the request refused
+	for i, r := range reponseMulti {
+		keep, done, err := capRows(&state, r.Count)
+		if done {
+			return err
+		}
+		if keep < r.Count {
+			reponseMulti[i].Records, reponseMulti[i].Count, reponseMulti[i].Truncated = r.Records[:keep], keep, true
+		}
+	}
+
+	// Kept for the next requests, large results are not, nor the shared ones which may have started before the stamp
+	if cacheKey != "" && !cached {
+		ctx.SetResponseHeader(HEADER_CACHE, "miss")
+		if !shared && responseCount(reponseMulti) <= suresql.CACHE_MAX_RECORDS {
+			suresql.ResultCache.Put(cacheKey, tables, cacheStamp, append(suresql.QueryResponseSQL{}, reponseMulti...))
+		}
+	}
+
+	rowsRead := 0
+	for _, r := range reponseMulti {
+		rowsRead += r.Count
+	}
+	meterRows(ctx, rowsRead, 0)
+
+	// the etag only covers the records, execution time changes on every call
+	resultSets := make([][]orm.DBRecord, len(reponseMulti))
+	for i, r := range reponseMulti {
+		resultSets[i] = r.Records
+	}
+	// A/B experiment: a sample is run again on the alternate backend, off the request path, cached and shared results were not run
+	mirrored := queryReqSQL.ParamSQL
 	if len(queryReqSQL.Statements) > 0 {
+		mirrored = make([]orm.ParametereizedSQL, len(queryReqSQL.Statements))
+		for i, q := range queryReqSQL.Statements {
+			mirrored[i] = orm.ParametereizedSQL{Query: q}
+		}
+	}
+	if !cached && !shared {
+		suresql.CurrentExperiment().Mirror(mirrored, queryReqSQL.SingleRow, resultSets, time.Duration(state.SaveStopTimer()))
+	}
+
+	if done, err := state.NotModified(ContentETag(resultSets)); done {
+		return err
+	}
+
+	// Calculate total execution time
+	return state.SetSuccess("SQL executed successfully", reponseMulti).LogAndResponse("raw sql query executed successfully", reponseMulti, true)
+}
+
+// selectSQL runs the selects of the request, a select without rows has no result
+func selectSQL(state *HandlerState, userDB suresql.SureSQLDB, queryReqSQL suresql.SQLRequest) (suresql.QueryResponseSQL, error) {
+	var reponseMulti suresql.QueryResponseSQL
+	if queryReqSQL.Parallel && len(queryReqSQL.Statements)+len(queryReqSQL.ParamSQL) > 1 {
+		// Independent selects run at once on the worker pool, each with its own execution time
+		state.Label += "SelectParallel"
+		records, times, err := suresql.SelectParallel(userDB, queryReqSQL.Statements, queryReqSQL.ParamSQL)
+		if err != nil {
+			return nil, err
+		}
+		reponseMulti = make(suresql.QueryResponseSQL, len(records))
+		for i, rs := range records {
+			reponseMulti[i] = suresql.QueryResponse{
+				Records:       rs,
+				Count:         len(rs),
+				ExecutionTime: times[i],
+			}
+		}
+		state.LogMessage = "executed successfully"
+	} else if len(queryReqSQL.Statements) > 0 {
 		// Raw SQL statements
 		if len(queryReqSQL.Statements) == 1 {
 			if queryReqSQL.SingleRow {
@@ -55,7 +195,7 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 						// No results found - return empty result
 						state.LogMessage = "executed with no results"
 					} else {
-						return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+						return nil, err
 					}
 				} else {
 					// Add single record to response
@@ -71,13 +211,13 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 				// Single raw SQL statement
 				state.Label += "SelectOneSQL"
 				// result := userDB.SelectOneSQL(sqlReq.Statements[0])
-				records, err := userDB.SelectOneSQL(queryReqSQL.Statements[0])
+				records, err := suresql.SelectStatement(userDB, orm.ParametereizedSQL{Query: queryReqSQL.Statements[0]}, true)
 				if err != nil {
 					if err == orm.ErrSQLNoRows {
 						// No results found - return empty result
 						state.LogMessage = "executed with no results"
 					} else {
-						return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+						return nil, err
 					}
 				} else {
 					// Add single record to response
@@ -99,7 +239,7 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 					// No results found - return empty result
 					state.LogMessage = "executed with no results"
 				} else {
-					return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+					return nil, err
 				}
 			} else {
 				timing := state.SaveStopTimer()
@@ -128,7 +268,7 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 						// No results found - return empty result
 						state.LogMessage = "executed with no results"
 					} else {
-						return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+						return nil, err
 					}
 				} else {
 					// Add single record to response
@@ -143,13 +283,13 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 			} else {
 				// Single parameterized SQL statement
 				state.Label += "SelectOneSQLParameterized"
-				records, err := userDB.SelectOneSQLParameterized(queryReqSQL.ParamSQL[0])
+				records, err := suresql.SelectStatement(userDB, queryReqSQL.ParamSQL[0], false)
 				if err != nil {
 					if err == orm.ErrSQLNoRows {
 						// No results found - return empty result
 						state.LogMessage = "executed with no results"
 					} else {
-						return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+						return nil, err
 					}
 				} else {
 					// Add single record to response
@@ -171,7 +311,7 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 					// No results found - return empty result
 					state.LogMessage = "executed with no results"
 				} else {
-					return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, queryReqSQL, true)
+					return nil, err
 				}
 			} else {
 				timing := state.SaveStopTimer()
@@ -188,7 +328,5 @@ func HandleSQLQuery(ctx simplehttp.Context) error {
 			}
 		}
 	}
-
-	// Calculate total execution time
-	return state.SetSuccess("SQL executed successfully", reponseMulti).LogAndResponse("raw sql query executed successfully", reponseMulti, true)
+	return reponseMulti, nil
 }
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// queryStream is the body of a streamed query, started is closed at the first write
+type queryStream struct {
+	pw      *io.PipeWriter
+	bytes   int64
+	started chan struct{}
+	once    sync.Once
+}
+
+func (s *queryStream) Write(b []byte) (int, error) {
+	s.once.Do(func() { close(s.started) })
+	n, err := s.pw.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// streamSQLQuery answers the select of the request with NDJSON records written while they are read, see
+// query_stream.go. A select failing before its first record is answered as an error, after it the body ends
+// with an error line. Rows and bytes are metered when the stream ends, after the request was.
+func streamSQLQuery(ctx simplehttp.Context, state *HandlerState, userDB suresql.SureSQLDB, req suresql.SQLRequest) error {
+	state.Label += "Stream"
+	p := orm.ParametereizedSQL{}
+	if len(req.ParamSQL) > 0 {
+		p = req.ParamSQL[0]
+	} else {
+		p.Query = req.Statements[0]
+	}
+	// the context is not used after the handler returned
+	apiKey := suresql.APIKeyFingerprint(ctx.GetHeader(API_KEY_STRING))
+	username, label := state.Token.UserName, state.Label
+
+	pr, pw := io.Pipe()
+	out := &queryStream{pw: pw, started: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		rows, err := suresql.StreamRecords(userDB, "", p, out)
+		select {
+		case <-out.started:
+			if err != nil {
+				simplelog.LogErrorAny(label, err, fmt.Sprintf("query stream stopped after %d records", rows))
+				json.NewEncoder(out).Encode(map[string]string{"error": err.Error()})
+			}
+		default:
+		}
+		if suresql.Meter != nil {
+			suresql.Meter.Record(apiKey, username, suresql.MeterDelta{RowsRead: int64(rows), BytesOut: out.bytes})
+		}
+		pw.Close()
+		done <- err
+	}()
+
+	select {
+	case <-out.started:
+	case err := <-done:
+		if err != nil {
+			return state.SetError("Failed to execute query", err, http.StatusInternalServerError).LogAndResponse("failed to execute "+state.Label, req, true)
+		}
+	}
+	state.SaveStopTimer()
+	state.OnlyLog("query stream started", nil, false)
+	return ctx.Stream(http.StatusOK, suresql.INSERT_STREAM_CONTENT_TYPE, pr)
+}
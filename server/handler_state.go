@@ -43,6 +43,9 @@ type HandlerState struct {
 	TimerID             int64               // if using timer, ie from Meda metrics
 	Duration            float64             // if using timer, ie from Meda metrics
 	Token               *suresql.TokenTable // for specific handlers that requires token
+	Impersonator        string              // internal admin running the request as User, see X-Impersonate-User
+	Statements          []string            // SQL the request ran, slow ones go to the index advisor
+	Route               string              // route a read took, set by RouteRead
 	LogTable            AccessLogTable      // TODO: put them here but somewhat abstract?
 }
 
@@ -50,7 +53,7 @@ type HandlerState struct {
 // This is state status for basic handlers that do not require status
 func NewHandlerState(ctx simplehttp.Context, user, label, table string) HandlerState {
 	if user == "" {
-		user = suresql.CurrentNode.InternalConfig.Username
+		user = suresql.CurrentNode.GetInternalConfig().Username
 	}
 	// This is the default setting, make sure the HeaderParser middleware is in used!
 	return HandlerState{
@@ -69,24 +72,30 @@ func NewHandlerState(ctx simplehttp.Context, user, label, table string) HandlerS
 
 // This is the state status for handlers that requires token.
 func NewHandlerTokenState(ctx simplehttp.Context, label, table string) HandlerState {
+	// a route without the token check has no token, the handlers answer 401 for it
+	token, _ := ctx.Get(TOKEN_TABLE_STRING).(*suresql.TokenTable)
 	// This is the default setting, make sure the HeaderParser middleware is in used!
 	state := HandlerState{
 		Context:             ctx,
 		Label:               label,
-		User:                suresql.CurrentNode.InternalConfig.Username,
+		User:                suresql.CurrentNode.GetInternalConfig().Username,
 		DBLogging:           true,
 		ConsoleLogging:      true,
 		TableNames:          table,
 		DBLoggingEvent:      SUCCESS_EVENT,
 		ConsoleLoggingEvent: ERROR_EVENT + ", " + SUCCESS_EVENT,
 		Header:              ctx.Get(simplehttp.REQUEST_HEADER_PARSED_STRING).(*simplehttp.RequestHeader),
-		Token:               ctx.Get(TOKEN_TABLE_STRING).(*suresql.TokenTable),
+		Token:               token,
 		TimerID:             metrics.StartTimeIt("", 0),
 	}
 	// This is important, if not it will get the real username used to connect to DBMS
 	if state.Token != nil {
 		state.User = state.Token.UserName
 	}
+	// Impersonated requests are audited, errors are logged in DB as well
+	if state.Impersonator = impersonator(ctx); state.Impersonator != "" {
+		state.DBLoggingEvent = ERROR_EVENT + ", " + SUCCESS_EVENT
+	}
 	return state
 }
 
@@ -95,7 +104,7 @@ func NewMiddlewareState(ctx simplehttp.Context, name string) HandlerState {
 	// This is the default setting, make sure the HeaderParser middleware is in used!
 	return HandlerState{
 		Context:             ctx,
-		User:                suresql.CurrentNode.InternalConfig.Username,
+		User:                suresql.CurrentNode.GetInternalConfig().Username,
 		Label:               "middleware",
 		TableNames:          name,
 		DBLogging:           false,                              // no DB logging
@@ -106,6 +115,14 @@ func NewMiddlewareState(ctx simplehttp.Context, name string) HandlerState {
 	}
 }
 
+// ClientIP is the real client IP, proxy headers are only believed from trusted proxies (setting proxy/trusted)
+func (h *HandlerState) ClientIP() string {
+	if h.Header == nil {
+		return ""
+	}
+	return suresql.ClientIP(h.Header.RemoteIP, h.Header.ForwardedFor, h.Header.RealIP)
+}
+
 // Readibility for the state logging configuration
 func (h *HandlerState) IsErrorLoggedInConsole() bool {
 	return strings.Contains(h.ConsoleLoggingEvent, ERROR_EVENT) && h.ConsoleLogging
@@ -152,13 +169,16 @@ func (h *HandlerState) OnlyLog(message string, data interface{}, restartTimer bo
 		// Result:      result,
 		// ResultStatus:  ERROR_EVENT,
 		Method:        h.Context.Request().Method,
-		ClientIP:      h.Header.RemoteIP, // NOTE: is this accurate??
+		ClientIP:      h.ClientIP(),
 		ClientBrowser: h.Header.UserAgent,
 		ClientDevice:  h.Header.Device,
 		NodeNumber:    suresql.CurrentNode.Config.NodeNumber,
 		// Error:         h.ErrorMessage,
 		// RawQuery: ,
 	}
+	if h.Impersonator != "" {
+		logEntry.Note = "impersonated by " + h.Impersonator
+	}
 	// if data is passed, use this is for the RAW_QUERY_LOG. NOTE: this is a bit ambiguous
 	if data != nil && LOG_RAW_QUERY {
 		logEntry.RawQuery = fmt.Sprintf("%v", data)
@@ -180,7 +200,8 @@ func (h *HandlerState) OnlyLog(message string, data interface{}, restartTimer bo
 		logEntry.Error = h.Err.Error()
 		if h.IsErrorLoggedInDB() {
 			// fmt.Println("error logged in DB")
-			err = logEntry.DBLogging(&suresql.CurrentNode.InternalConnection)
+			internal := suresql.CurrentNode.GetInternalConnection()
+			err = logEntry.DBLogging(&internal)
 		}
 		if h.IsErrorLoggedInConsole() {
 			// fmt.Println("error logged in Console")
@@ -196,7 +217,8 @@ func (h *HandlerState) OnlyLog(message string, data interface{}, restartTimer bo
 		logEntry.Result = h.LogMessage
 		if h.IsSuccessLoggedInDB() {
 			// fmt.Println("success logged in DB")
-			err = logEntry.DBLogging(&suresql.CurrentNode.InternalConnection)
+			internal := suresql.CurrentNode.GetInternalConnection()
+			err = logEntry.DBLogging(&internal)
 		}
 		if h.IsSuccessLoggedInConsole() {
 			// fmt.Println("success logged in Console")
@@ -244,10 +266,12 @@ func (h *HandlerState) LogAndResponse(message string, data interface{}, logAgain
 	if h.Data == nil {
 		h.Data = data
 	}
+	h.warnSlowRequest()
 	resp := suresql.StandardResponse{
-		Status:  h.Status,
-		Message: h.ResponseMessage,
-		Data:    h.Data,
+		Status:   h.Status,
+		Message:  h.ResponseMessage,
+		Data:     h.Data,
+		Warnings: warnings(h.Context),
 	}
 	if h.Err != nil {
 		// Error Event
@@ -256,5 +280,14 @@ func (h *HandlerState) LogAndResponse(message string, data interface{}, logAgain
 		}
 		resp.Data = h.Err
 	}
-	return h.Context.JSON(resp.Status, resp)
+	// Translated error message for the caller's Accept-Language, when the catalog has one
+	if h.ErrorMessage != "" && resp.Status >= http.StatusBadRequest {
+		if locale := suresql.NegotiateLocale(h.Context.GetHeader("Accept-Language")); locale != suresql.DefaultLocale() {
+			if text, ok := suresql.TranslateMessage(locale, h.ErrorMessage); ok {
+				resp.Message = text
+				h.Context.SetHeader("Content-Language", locale)
+			}
+		}
+	}
+	return writeJSON(h.Context, resp.Status, resp)
 }
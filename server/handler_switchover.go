@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// SwitchoverRequest is the body of /suresql/switchover/flip
+type SwitchoverRequest struct {
+	Force bool `json:"force,omitempty"` // flip without a passed verify
+}
+
+// switchoverError answers the error of a switchover step
+func switchoverError(state *HandlerState, step string, err error) error {
+	code := http.StatusInternalServerError
+	switch err {
+	case suresql.ErrSwitchoverNoTarget, suresql.ErrSwitchoverNotReady, suresql.ErrSwitchoverNotVerified, suresql.ErrSwitchoverNoPrevious:
+		code = http.StatusConflict
+	}
+	return state.SetError("Switchover "+step+" failed", err, code).LogAndResponse("switchover "+step+" failed", nil, true)
+}
+
+// HandleSwitchoverStatus returns the step of the switchover and the last verify (internal)
+func HandleSwitchoverStatus(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/switchover", "switchover")
+
+	status := suresql.CurrentSwitchover().Status()
+	return state.SetSuccess("Switchover "+status.Phase, status).LogAndResponse("switchover status", nil, false)
+}
+
+// HandleSwitchoverPrepare opens the new backend next to the current one (internal)
+func HandleSwitchoverPrepare(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/switchover/prepare", "switchover")
+
+	status, err := suresql.CurrentSwitchover().Prepare()
+	if err != nil {
+		return switchoverError(&state, "prepare", err)
+	}
+	return state.SetSuccess("Switchover target prepared", status).LogAndResponse("switchover prepared "+status.Target, nil, true)
+}
+
+// HandleSwitchoverVerify compares the current and the new backend, the parity is in the response (internal)
+func HandleSwitchoverVerify(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/switchover/verify", "switchover")
+
+	status, err := suresql.CurrentSwitchover().Verify()
+	if err != nil {
+		return switchoverError(&state, "verify", err)
+	}
+	if !status.Parity {
+		return state.SetSuccess("Switchover target differs", status).LogAndResponse("switchover verify found differences", nil, true)
+	}
+	return state.SetSuccess("Switchover target matches", status).LogAndResponse("switchover verified", nil, true)
+}
+
+// HandleSwitchoverFlip moves the node to the new backend (internal)
+func HandleSwitchoverFlip(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/switchover/flip", "switchover")
+
+	var req SwitchoverRequest
+	if len(ctx.GetBody()) > 0 {
+		if err := ctx.BindJSON(&req); err != nil {
+			return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+		}
+	}
+	status, err := suresql.CurrentSwitchover().Flip(req.Force)
+	if err != nil {
+		return switchoverError(&state, "flip", err)
+	}
+	return state.SetSuccess("Switched to the new backend", status).LogAndResponse("switchover flipped", nil, true)
+}
+
+// HandleSwitchoverRollback moves the node back to the backend it was on before the flip (internal)
+func HandleSwitchoverRollback(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "/switchover/rollback", "switchover")
+
+	status, err := suresql.CurrentSwitchover().Rollback()
+	if err != nil {
+		return switchoverError(&state, "rollback", err)
+	}
+	return state.SetSuccess("Switched back to the previous backend", status).LogAndResponse("switchover rolled back", nil, true)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// expressionTestRequest evaluates an expression against sample values
+type expressionTestRequest struct {
+	Expression string                 `json:"expression"`
+	Values     map[string]interface{} `json:"values"`
+}
+
+// HandleListTableExpressions lists the expressions, of ?table= when given (internal)
+func HandleListTableExpressions(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_table_expressions", suresql.TableExpressionTable{}.TableName())
+
+	exprs, err := suresql.ListTableExpressions(ctx.GetQueryParam("table"))
+	if err != nil {
+		return state.SetError("Failed to list table expressions", err, http.StatusInternalServerError).LogAndResponse("failed to list table expressions", nil, true)
+	}
+	return state.SetSuccess(fmt.Sprintf("Table expressions retrieved successfully: %d", len(exprs)), exprs).LogAndResponse(fmt.Sprintf("success count:%d", len(exprs)), nil, true)
+}
+
+// HandleSaveTableExpression creates (POST, no id) or updates (PUT, with id) a table expression (internal)
+func HandleSaveTableExpression(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "save_table_expression", suresql.TableExpressionTable{}.TableName())
+
+	var expr suresql.TableExpressionTable
+	if err := ctx.BindJSON(&expr); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	if ctx.GetMethod() == http.MethodPost {
+		expr.ID = 0
+	} else if expr.ID == 0 {
+		return state.SetError("Table expression id is required", nil, http.StatusBadRequest).LogAndResponse("missing table expression id", nil, true)
+	}
+	if err := expr.Validate(); err != nil {
+		return state.SetError("Invalid table expression", err, http.StatusBadRequest).LogAndResponse("table expression validation failed", nil, true)
+	}
+
+	expr, err := suresql.SaveTableExpression(expr)
+	if err != nil {
+		if err == suresql.ErrTableExprNotFound {
+			return state.SetError("Table expression not found", err, http.StatusNotFound).LogAndResponse("table expression not found", nil, true)
+		}
+		return state.SetError("Failed to save table expression", err, http.StatusInternalServerError).LogAndResponse("failed to save table expression", nil, true)
+	}
+	return state.SetSuccess("Table expression saved successfully", expr).LogAndResponse(fmt.Sprintf("table expression %d %s/%s saved", expr.ID, expr.TableName_, expr.Kind), nil, true)
+}
+
+// HandleDeleteTableExpression removes ?id= (internal)
+func HandleDeleteTableExpression(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_table_expression", suresql.TableExpressionTable{}.TableName())
+
+	id, err := strconv.Atoi(ctx.GetQueryParam("id"))
+	if err != nil {
+		return state.SetError("Table expression id is required", err, http.StatusBadRequest).LogAndResponse("missing or invalid table expression id", nil, true)
+	}
+	if err := suresql.DeleteTableExpression(id); err != nil {
+		return state.SetError("Failed to delete table expression", err, http.StatusInternalServerError).LogAndResponse("failed to delete table expression", nil, true)
+	}
+	return state.SetSuccess("Table expression deleted successfully", nil).LogAndResponse(fmt.Sprintf("table expression %d deleted", id), nil, true)
+}
+
+// HandleTestExpression evaluates an expression with sample values, to try it before saving (internal)
+func HandleTestExpression(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "test_expression", "expression")
+
+	var req expressionTestRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("failed to parse request body", nil, true)
+	}
+	value, err := suresql.EvalExpression(req.Expression, req.Values)
+	if err != nil {
+		return state.SetError("Expression failed", err, http.StatusBadRequest).LogAndResponse("expression failed", req.Expression, true)
+	}
+	return state.SetSuccess("Expression evaluated successfully", value).LogAndResponse("expression evaluated", req.Expression, true)
+}
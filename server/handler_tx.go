@@ -0,0 +1,275 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/encryption"
+	"github.com/medatechnology/goutil/medattlmap"
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// TxSession is an open interactive transaction, kept in the TTL map by its transaction token. Only the
+// access token that began it can use it.
+type TxSession struct {
+	mu       sync.Mutex
+	ID       string
+	Tx       *suresql.SQLTx
+	Token    string
+	UserName string
+	Schema   bool // a statement changed the schema, the cached schema is invalidated on commit
+	lastUsed time.Time
+	idle     time.Duration
+	stop     chan struct{} // closed when the session ends
+	ended    bool
+}
+
+var (
+	txSessions     *medattlmap.TTLMap
+	txSessionsOnce sync.Once
+	txOpen         int64 // open transactions, counted by reserveTx before they begin
+)
+
+// txStore returns the map of the open transactions, the entries live as long as they are idle
+func txStore() *medattlmap.TTLMap {
+	txSessionsOnce.Do(func() {
+		txSessions = medattlmap.NewTTLMap(suresql.TX_DEFAULT_IDLE_SEC*time.Second, time.Second)
+	})
+	return txSessions
+}
+
+// reserveTx counts one more open transaction unless maxOpen are open, the check and the count are one
+// compare-and-swap so concurrent begins cannot both take the last one. releaseTx when it ends.
+func reserveTx(maxOpen int) bool {
+	for {
+		n := atomic.LoadInt64(&txOpen)
+		if n >= int64(maxOpen) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&txOpen, n, n+1) {
+			return true
+		}
+	}
+}
+
+func releaseTx() {
+	atomic.AddInt64(&txOpen, -1)
+}
+
+// watchIdle checks the session on CurrentClock every time it could have been idle for too long, until it ends
+func (s *TxSession) watchIdle() {
+	wait := s.idle
+	for wait > 0 {
+		select {
+		case <-s.stop:
+			return
+		case <-suresql.CurrentClock.After(wait):
+		}
+		wait = s.expire()
+	}
+}
+
+// expire rolls the transaction back when it was idle too long, a statement running now pushes it back.
+// It returns how long the session can still be idle, 0 when it ended.
+func (s *TxSession) expire() time.Duration {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return 0
+	}
+	if idle := suresql.CurrentClock.Since(s.lastUsed); idle < s.idle {
+		s.mu.Unlock()
+		return s.idle - idle
+	}
+	s.finish()
+	s.mu.Unlock()
+	s.Tx.Rollback()
+	simplelog.LogFormat("tx: transaction of %s rolled back after %s idle", s.UserName, s.idle)
+	return 0
+}
+
+// finish ends the session, locked: it is forgotten and its slot of tx/max_open is free. The caller
+// commits or rolls back the transaction.
+func (s *TxSession) finish() {
+	s.ended = true
+	close(s.stop)
+	releaseTx()
+	txStore().Delete(s.ID)
+}
+
+// txSession looks up the transaction of the request, locked, the caller unlocks it
+func txSession(state *HandlerState, id string) (*TxSession, error) {
+	val, ok := txStore().Get(id)
+	if !ok || id == "" {
+		return nil, suresql.ErrTxNotFound
+	}
+	s := val.(*TxSession)
+	if s.Token != state.Token.Token {
+		return nil, suresql.ErrTxNotFound
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return nil, suresql.ErrTxNotFound
+	}
+	return s, nil
+}
+
+// HandleTxBegin opens an interactive transaction on a connection of its own and returns its token
+func HandleTxBegin(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/tx/begin", "request")
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	if !suresql.FeatureEnabledFor(suresql.FLAG_TX, state.Token.UserName, state.Token.Tenant) {
+		return state.SetError("Interactive transactions are disabled", suresql.ErrFeatureDisabled, http.StatusForbidden).LogAndResponse("interactive transactions disabled by feature flag", nil, true)
+	}
+	idle, lifetime, maxOpen := suresql.TxSettings()
+	if maxOpen <= 0 {
+		return state.SetError("Interactive transactions are disabled", suresql.ErrTxNotSupported, http.StatusNotImplemented).LogAndResponse("interactive transactions disabled by tx/max_open", nil, true)
+	}
+	if !reserveTx(maxOpen) {
+		return state.SetError("Too many open transactions", suresql.ErrTxLimit, http.StatusTooManyRequests).LogAndResponse(fmt.Sprintf("open transactions at tx/max_open %d", maxOpen), nil, true)
+	}
+
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		releaseTx()
+		return respondDBConnectionError(&state, err)
+	}
+	tx, err := suresql.BeginInteractiveTx(userDB, lifetime)
+	if err != nil {
+		releaseTx()
+		if err == suresql.ErrTxNotSupported {
+			return state.SetError("Interactive transactions are not supported by this DBMS", err, http.StatusNotImplemented).LogAndResponse("interactive transaction not supported", nil, true)
+		}
+		return state.SetError("Failed to begin transaction", err, http.StatusInternalServerError).LogAndResponse("failed to begin transaction", nil, true)
+	}
+
+	s := &TxSession{
+		ID:       encryption.NewRandomTokenIterate(TOKEN_LENGTH_MULTIPLIER),
+		Tx:       tx,
+		Token:    state.Token.Token,
+		UserName: state.Token.UserName,
+		lastUsed: suresql.CurrentClock.Now(),
+		idle:     idle,
+		stop:     make(chan struct{}),
+	}
+	txStore().Put(s.ID, idle, s)
+	go s.watchIdle()
+
+	response := suresql.TxBeginResponse{Tx: s.ID, IdleSec: int(idle.Seconds()), ExpiresAt: suresql.CurrentClock.Now().Add(lifetime).UTC()}
+	return state.SetSuccess("Transaction started", response).LogAndResponse("transaction started", nil, true)
+}
+
+// HandleTxExec runs statements in the transaction, reads return their rows. A failed statement leaves
+// the transaction open, the client decides to roll back or go on (the DBMS may refuse to go on).
+func HandleTxExec(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/tx/exec", "request")
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	var req suresql.TxRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+	if len(req.Statements) == 0 && len(req.ParamSQL) == 0 {
+		return state.SetError("No SQL statements provided", nil, http.StatusBadRequest).LogAndResponse("no sql statement in request body", nil, true)
+	}
+	sqlReq := suresql.SQLRequest{Statements: req.Statements, ParamSQL: req.ParamSQL}
+	state.Statements = requestStatements(sqlReq)
+
+	s, err := txSession(&state, req.Tx)
+	if err != nil {
+		return state.SetError("Transaction not found", err, http.StatusNotFound).LogAndResponse("transaction not found", nil, true)
+	}
+	defer s.mu.Unlock()
+
+	statements := make([]orm.ParametereizedSQL, 0, len(req.Statements)+len(req.ParamSQL))
+	for _, q := range req.Statements {
+		statements = append(statements, orm.ParametereizedSQL{Query: q})
+	}
+	statements = append(statements, req.ParamSQL...)
+
+	start := time.Now()
+	response := suresql.TxExecResponse{Results: make([]suresql.TxResult, 0, len(statements))}
+	for i, p := range statements {
+		result, err := s.Tx.Run(p)
+		if err != nil {
+			if err == suresql.ErrTxNotFound {
+				// open for tx/max_sec, the transaction was rolled back
+				s.finish()
+				s.Tx.Rollback()
+				return state.SetError("Transaction expired", err, http.StatusNotFound).LogAndResponse("transaction expired", nil, true)
+			}
+			s.lastUsed = suresql.CurrentClock.Now()
+			txStore().Put(s.ID, s.idle, s)
+			return state.SetError(fmt.Sprintf("Statement %d failed, the transaction is still open", i+1), err, http.StatusInternalServerError).LogAndResponse("failed to execute sql statement in transaction", response, true)
+		}
+		response.Results = append(response.Results, result)
+		response.RowsAffected += result.RowsAffected
+	}
+	response.ExecutionTime = float64(time.Since(start).Microseconds()) / 1000
+	s.Schema = s.Schema || isSchemaChange(sqlReq)
+	s.lastUsed = suresql.CurrentClock.Now()
+	txStore().Put(s.ID, s.idle, s)
+
+	return state.SetSuccess("Statements executed in transaction", response).LogAndResponse(fmt.Sprintf("success count:%d", len(response.Results)), nil, false)
+}
+
+// endTx commits or rolls back the transaction of the request and forgets it
+func endTx(ctx simplehttp.Context, label string, commit bool) error {
+	state := NewHandlerTokenState(ctx, label, "request")
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	var req suresql.TxRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+	s, err := txSession(&state, req.Tx)
+	if err != nil {
+		return state.SetError("Transaction not found", err, http.StatusNotFound).LogAndResponse("transaction not found", nil, true)
+	}
+	s.finish()
+	s.mu.Unlock()
+
+	if !commit {
+		if err := s.Tx.Rollback(); err != nil && err != suresql.ErrTxNotFound {
+			return state.SetError("Failed to roll back transaction", err, http.StatusInternalServerError).LogAndResponse("failed to roll back transaction", nil, true)
+		}
+		return state.SetSuccess("Transaction rolled back", nil).LogAndResponse("transaction rolled back", nil, true)
+	}
+	if err := s.Tx.Commit(); err != nil {
+		if err == suresql.ErrTxNotFound {
+			return state.SetError("Transaction expired", err, http.StatusNotFound).LogAndResponse("transaction expired before commit", nil, true)
+		}
+		return state.SetError("Failed to commit transaction", err, http.StatusConflict).LogAndResponse("failed to commit transaction", nil, true)
+	}
+	if s.Schema {
+		suresql.InvalidateTableSchema("")
+	}
+	suresql.ResultCache.InvalidateAll()
+	return state.SetSuccess("Transaction committed", nil).LogAndResponse("transaction committed", nil, true)
+}
+
+// HandleTxCommit commits the transaction
+func HandleTxCommit(ctx simplehttp.Context) error {
+	return endTx(ctx, "/tx/commit", true)
+}
+
+// HandleTxRollback rolls the transaction back
+func HandleTxRollback(ctx simplehttp.Context) error {
+	return endTx(ctx, "/tx/rollback", false)
+}
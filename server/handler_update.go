@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleUpdate processes update requests: the values are set on the rows of the table matching the condition
+func HandleUpdate(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/update/", "request")
+
+	// Get username from context (set by TokenValidationFromTTL)
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	// Parse request body
+	var updateReq suresql.UpdateRequest
+	if err := ctx.BindJSON(&updateReq); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+
+	// Validate that table name is provided
+	if updateReq.Table == "" {
+		return state.SetError("Table name is required", nil, http.StatusBadRequest).LogAndResponse("no table name in request body", nil, true)
+	}
+
+	// Reject bad names, operators and a condition-less update before going to the DB
+	paramSQL, err := suresql.BuildUpdateRequest(updateReq)
+	if err != nil {
+		return state.SetError("Invalid update", err, http.StatusBadRequest).LogAndResponse("update validation failed", err, true)
+	}
+	state.Statements = []string{paramSQL.Query}
+
+	// ClickHouse tables are append-only
+	if err := suresql.CheckAppendOnly(state.Statements); err != nil {
+		return state.SetError("Tables of this DBMS are append-only", err, http.StatusForbidden).LogAndResponse("update refused", updateReq.Table, true)
+	}
+
+	// Check the new values against the live schema like the records of /insert
+	if fieldErrs := suresql.ValidateUpdateValues(updateReq.Table, updateReq.Values); len(fieldErrs) > 0 {
+		return state.SetError(fmt.Sprintf("Invalid values: %d problems found", len(fieldErrs)), nil, http.StatusBadRequest).LogAndResponse("update validation failed", fieldErrs, true)
+	}
+
+	// Find the user's database connection from TTL map
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+	defer suresql.ResultCache.InvalidateTables(updateReq.Table)
+
+	state.Label += "UpdateWithCondition"
+	result, err := suresql.UpdateRows(userDB, updateReq, paramSQL)
+	if err != nil {
+		return state.SetError("Failed to update records", err, http.StatusInternalServerError).LogAndResponse("failed to update records", updateReq, true)
+	}
+
+	response := suresql.SQLResponse{
+		Results:      []orm.BasicSQLResult{result},
+		RowsAffected: result.RowsAffected,
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, 0, response.RowsAffected)
+	return state.SetSuccess(fmt.Sprintf("Successfully updated %d records", response.RowsAffected), response).LogAndResponse("update successfully", response, true)
+}
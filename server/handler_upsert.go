@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// HandleUpsert processes upsert requests: the records are inserted, a conflict on the conflict columns is
+// resolved by the strategy of the request
+func HandleUpsert(ctx simplehttp.Context) error {
+	state := NewHandlerTokenState(ctx, "/upsert/", "request")
+
+	// Get username from context (set by TokenValidationFromTTL)
+	if state.Token == nil {
+		return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+	}
+
+	// Parse request body
+	var upsertReq suresql.UpsertRequest
+	if err := ctx.BindJSON(&upsertReq); err != nil {
+		return state.SetError("Invalid request format", err, http.StatusBadRequest).LogAndResponse("Failed to parse request body", nil, true)
+	}
+
+	// Validate that records are provided
+	numRecs := len(upsertReq.Records)
+	if numRecs == 0 {
+		return state.SetError("No records provided", nil, http.StatusBadRequest).LogAndResponse("no records in request body", nil, true)
+	}
+
+	// Computed columns, the schema check and checksums run like for /insert, before the statements are rendered
+	fieldErrs := suresql.ApplyInsertExpressions(upsertReq.Records)
+	fieldErrs = append(fieldErrs, suresql.ValidateInsertRecords(upsertReq.Records)...)
+	fieldErrs = append(fieldErrs, suresql.ApplyRecordChecksums(upsertReq.Records)...)
+	if len(fieldErrs) > 0 {
+		return state.SetError(fmt.Sprintf("Invalid records: %d problems found", len(fieldErrs)), nil, http.StatusBadRequest).LogAndResponse("upsert validation failed", fieldErrs, true)
+	}
+
+	// Reject bad names, conflict columns and strategies before going to the DB
+	statements, err := suresql.BuildUpsertRequest(upsertReq)
+	if err != nil {
+		if err == suresql.ErrClickHouseAppendOnly {
+			return state.SetError("Tables of this DBMS are append-only", err, http.StatusForbidden).LogAndResponse("upsert refused", upsertReq.Records[0].TableName, true)
+		}
+		return state.SetError("Invalid upsert", err, http.StatusBadRequest).LogAndResponse("upsert validation failed", err, true)
+	}
+	for _, s := range statements {
+		state.Statements = append(state.Statements, s.Query)
+	}
+
+	// Find the user's database connection from TTL map
+	userDB, err := suresql.CurrentNode.GetOrReconnectDBConnection(state.Token.Token)
+	if err != nil {
+		return respondDBConnectionError(&state, err)
+	}
+	defer suresql.ResultCache.InvalidateRecords(upsertReq.Records)
+
+	// Reserve storage quota like an insert, the quota cannot tell which records update a row instead
+	quotaRows, quotaBytes := int64(numRecs), suresql.RecordsSize(upsertReq.Records)
+	if violation := suresql.Quotas.Reserve(state.Token.UserName, state.Token.Tenant, quotaRows, quotaBytes); violation != nil {
+		return state.SetError("Storage quota exceeded", nil, http.StatusForbidden).LogAndResponse(violation.Error(), violation, true)
+	}
+
+	state.Label += "Upsert"
+	results, err := suresql.UpsertRecords(userDB, upsertReq, statements)
+	if err != nil {
+		suresql.Quotas.Release(state.Token.UserName, state.Token.Tenant, quotaRows, quotaBytes)
+		return state.SetError("Failed to upsert records", err, http.StatusInternalServerError).LogAndResponse("failed to upsert records", upsertReq, true)
+	}
+	suresql.Quotas.Commit(state.Token.UserName, state.Token.Tenant, quotaRows, quotaBytes)
+
+	response := suresql.SQLResponse{Results: results}
+	for _, r := range results {
+		response.RowsAffected += r.RowsAffected
+	}
+	response.ExecutionTime = state.SaveStopTimer()
+	meterRows(ctx, 0, response.RowsAffected)
+	return state.SetSuccess(fmt.Sprintf("Successfully upserted %d records", numRecs), response).LogAndResponse("upsert successfully", response, true)
+}
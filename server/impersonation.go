@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/goutil/encryption"
+	"github.com/medatechnology/simplehttp"
+)
+
+// Impersonation: a /db/api request authenticated with the basic auth of the internal API (the admin of
+// /suresql) and the X-Impersonate-User header runs as that user, with the user's connection, tenant,
+// quota and permissions, so support staff see exactly what the user sees. Every such request is audited:
+// an impersonation security event and an access log entry (errors too) noting the admin.
+
+const (
+	HEADER_IMPERSONATE_USER = "X-Impersonate-User"
+	IMPERSONATOR_STRING     = "impersonator" // context key of the admin behind an impersonated request
+)
+
+// impersonatedSessions maps an impersonated username to the session token its requests run under, so
+// they reuse one pooled connection like signed requests do
+var impersonatedSessions sync.Map
+
+// MiddlewareImpersonation lets the internal admin run a data API request as another user
+func MiddlewareImpersonation() simplehttp.Middleware {
+	return simplehttp.WithName("impersonation", ImpersonationValidation())
+}
+
+func ImpersonationValidation() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			username := ctx.GetHeader(HEADER_IMPERSONATE_USER)
+			if username == "" {
+				return next(ctx)
+			}
+			state := NewMiddlewareState(ctx, "impersonation")
+
+			// Only the internal admin may impersonate, a user token cannot
+			authType, token := encryption.GetAuthorizationFromHeader(ctx.GetHeader("Authorization"))
+			if authType != "Basic" {
+				state.SecurityEvent(suresql.SECURITY_EVENT_POLICY_VIOLATION, suresql.SECURITY_SEVERITY_WARNING, username, "impersonation without internal credentials")
+				return state.SetError("Impersonation requires the internal credentials", nil, http.StatusForbidden).LogAndResponse("impersonation refused", username, true)
+			}
+			admin, pass, err := encryption.GetClientIDSecretFromTokenString(token)
+			if err != nil || !isAdminCredentials(admin, pass) {
+				state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, admin, "impersonation basic auth failed")
+				return state.SetError("Invalid credentials", nil, http.StatusUnauthorized).LogAndResponse("impersonation refused", username, true)
+			}
+
+			tok, err := impersonatedSession(username)
+			if err != nil {
+				if err == suresql.ErrPoolExhausted {
+					return respondBackpressure(&state, suresql.CurrentPressure(), "Failed to create database connection, quota exceeded", http.StatusServiceUnavailable)
+				}
+				state.SecurityEvent(suresql.SECURITY_EVENT_IMPERSONATION, suresql.SECURITY_SEVERITY_WARNING, username, "impersonation by "+admin+" failed")
+				return state.SetError("Cannot impersonate the user", err, http.StatusBadRequest).LogAndResponse("impersonation failed for user:"+username, err, true)
+			}
+			state.SecurityEvent(suresql.SECURITY_EVENT_IMPERSONATION, suresql.SECURITY_SEVERITY_INFO, username, "impersonated by "+admin)
+			ctx.Set(TOKEN_TABLE_STRING, tok)
+			ctx.Set(IMPERSONATOR_STRING, admin)
+			return next(ctx)
+		}
+	}
+}
+
+// impersonatedSession returns the live session of the impersonated user, or connects a new one
+func impersonatedSession(username string) (*suresql.TokenTable, error) {
+	if err := suresql.ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if val, ok := impersonatedSessions.Load(username); ok {
+		if tok, valid := TokenStore.TokenExist(val.(string)); valid {
+			if _, err := suresql.CurrentNode.GetDBConnectionByToken(tok.Token); err == nil {
+				return tok, nil
+			}
+		}
+	}
+	tok, err := connectSession(username)
+	if err != nil {
+		return nil, err
+	}
+	impersonatedSessions.Store(username, tok.Token)
+	return tok, nil
+}
+
+// impersonator is the admin behind the request, empty when it is not impersonated
+func impersonator(ctx simplehttp.Context) string {
+	admin, _ := ctx.Get(IMPERSONATOR_STRING).(string)
+	return admin
+}
@@ -17,6 +17,7 @@ import (
 
 const (
 	DEFAULT_INTERNAL_API = "/suresql"
+	DEFAULT_PEER_API     = "/peer"
 )
 
 // UserTable struct representing a user from the database
@@ -25,6 +26,7 @@ type UserTable struct {
 	Username  string    `json:"username,omitempty"     db:"username"`
 	Password  string    `json:"password,omitempty"     db:"password"` // hashed
 	RoleName  string    `json:"role_name,omitempty"    db:"role_name"`
+	Tenant    string    `json:"tenant,omitempty"       db:"tenant"`
 	CreatedAt time.Time `json:"created_at,omitempty"   db:"created_at"`
 }
 
@@ -40,16 +42,17 @@ type UserUpdateRequest struct {
 	NewUsername string `json:"new_username,omitempty"`  // Optional new username
 	NewPassword string `json:"new_password,omitempty"`  // Optional new password
 	NewRoleName string `json:"new_role_name,omitempty"` // Optional new role
+	NewTenant   string `json:"new_tenant,omitempty"`    // Optional new tenant
 }
 
 // Add these functions to your RegisterRoutes function in handler.go
 func RegisterInternalRoutes(server simplehttp.Server) {
 	// Create an internal group with Basic Auth protection
 	internalAPI := server.Group(DEFAULT_INTERNAL_API)
-	internalAPI.Use(simplehttp.MiddlewareBasicAuth(
-		suresql.CurrentNode.InternalConfig.Username,
-		suresql.CurrentNode.InternalConfig.Password,
-	))
+	internalAPI.Use(MiddlewareInternalAuth())
+	if len(extensions.internal) > 0 {
+		internalAPI.Use(extensions.internal...)
+	}
 	// fmt.Println("Using user:", suresql.CurrentNode.InternalConnection.Config.Username, " pass:", suresql.CurrentNode.InternalConnection.Config.Password)
 
 	// Register internal routes
@@ -60,11 +63,97 @@ func RegisterInternalRoutes(server simplehttp.Server) {
 	internalAPI.DELETE("/iusers", HandleDeleteUser)
 	internalAPI.GET("/schema", HandleGetSchema)
 	internalAPI.GET("/dbms_status", HandleDBMSStatus)
+	internalAPI.GET("/info", HandleNodeInfo)
+	internalAPI.GET("/feature_flags", HandleListFeatureFlags)
+	internalAPI.POST("/feature_flags", HandleSaveFeatureFlag)
+	internalAPI.PUT("/feature_flags", HandleSaveFeatureFlag)
+	internalAPI.DELETE("/feature_flags", HandleDeleteFeatureFlag)
+	internalAPI.GET("/settings", HandleListSettings)
+	internalAPI.POST("/settings", HandleSaveSetting)
+	internalAPI.PUT("/settings", HandleSaveSetting)
+	internalAPI.DELETE("/settings", HandleDeleteSetting)
+	internalAPI.GET("/settings/history", HandleListSettingsHistory)
+	internalAPI.GET("/settings/events", HandleSettingsEvents)
+	internalAPI.GET("/switchover", HandleSwitchoverStatus)
+	internalAPI.POST("/switchover/prepare", HandleSwitchoverPrepare)
+	internalAPI.POST("/switchover/verify", HandleSwitchoverVerify)
+	internalAPI.POST("/switchover/flip", HandleSwitchoverFlip)
+	internalAPI.POST("/switchover/rollback", HandleSwitchoverRollback)
+	internalAPI.GET("/dbms/credentials", HandleCredentialRotationStatus)
+	internalAPI.POST("/dbms/rotate-credentials", HandleRotateCredentials)
+	internalAPI.GET("/rqlited", HandleEmbeddedRqlite)
+	internalAPI.GET("/quotas", HandleListQuotas)
+	internalAPI.POST("/quotas", HandleSetQuota)
+	internalAPI.DELETE("/quotas", HandleDeleteQuota)
+	internalAPI.GET("/usage", HandleListUsage)
+	internalAPI.GET("/metering", HandleExportMetering)
+	internalAPI.POST("/metering/push", HandlePushMetering)
+	internalAPI.GET("/reports", HandleListReports)
+	internalAPI.POST("/reports", HandleSaveReport)
+	internalAPI.DELETE("/reports", HandleDeleteReport)
+	internalAPI.GET("/report_schedules", HandleListReportSchedules)
+	internalAPI.POST("/report_schedules", HandleSaveReportSchedule)
+	internalAPI.PUT("/report_schedules", HandleSaveReportSchedule)
+	internalAPI.DELETE("/report_schedules", HandleDeleteReportSchedule)
+	internalAPI.POST("/report_schedules/run", HandleRunReportSchedule)
+	internalAPI.GET("/dead_letters", HandleListDeadLetters)
+	internalAPI.POST("/dead_letters/retry", HandleRetryDeadLetter)
+	internalAPI.DELETE("/dead_letters", HandlePurgeDeadLetters)
+	internalAPI.GET("/signing_keys", HandleListSigningKeys)
+	internalAPI.POST("/signing_keys", HandleCreateSigningKey)
+	internalAPI.DELETE("/signing_keys", HandleDeleteSigningKey)
+	internalAPI.GET("/peers/tls", HandlePeerTLSStatus)
+	internalAPI.POST("/peers/tls/rotate", HandleRotatePeerCA)
+	internalAPI.GET("/faults", HandleFaultStatus)
+	internalAPI.POST("/faults", HandleEnableFaults)
+	internalAPI.DELETE("/faults", HandleDisableFaults)
+	internalAPI.GET("/messages", HandleListMessages)
+	internalAPI.POST("/messages", HandleSaveMessages)
+	internalAPI.DELETE("/messages", HandleDeleteMessages)
+	internalAPI.GET("/table_expressions", HandleListTableExpressions)
+	internalAPI.POST("/table_expressions", HandleSaveTableExpression)
+	internalAPI.PUT("/table_expressions", HandleSaveTableExpression)
+	internalAPI.DELETE("/table_expressions", HandleDeleteTableExpression)
+	internalAPI.POST("/expressions/test", HandleTestExpression)
+	internalAPI.GET("/procedures", HandleListProcedures)
+	internalAPI.POST("/procedures", HandleSaveProcedure)
+	internalAPI.DELETE("/procedures", HandleDeleteProcedure)
+	internalAPI.GET("/plugins", HandleListPlugins)
+	internalAPI.GET("/security_events", HandleListSecurityEvents)
+	internalAPI.DELETE("/security_events", HandlePurgeSecurityEvents)
+	internalAPI.GET("/cdc", HandleListCDCTables)
+	internalAPI.POST("/cdc", HandleEnableCDC)
+	internalAPI.DELETE("/cdc", HandleDisableCDC)
+	internalAPI.GET("/integrity", HandleListIntegrityTables)
+	internalAPI.POST("/integrity", HandleSaveIntegrityTable)
+	internalAPI.DELETE("/integrity", HandleDeleteIntegrityTable)
+	internalAPI.POST("/integrity/rehash", HandleRehashIntegrity)
+	internalAPI.POST("/verify", HandleVerifyIntegrity)
+	internalAPI.GET("/maintenance", HandleListMaintenance)
+	internalAPI.POST("/maintenance/run", HandleRunMaintenance)
+	internalAPI.GET("/scrub_rules", HandleListScrubRules)
+	internalAPI.POST("/scrub_rules", HandleSaveScrubRules)
+	internalAPI.DELETE("/scrub_rules", HandleDeleteScrubRule)
+	internalAPI.GET("/export", HandleExportTable)
+	internalAPI.POST("/generate", HandleGenerate)
+	internalAPI.GET("/rules", HandleListRules)
+	internalAPI.POST("/rules", HandleSaveRule)
+	internalAPI.PUT("/rules", HandleSaveRule)
+	internalAPI.DELETE("/rules", HandleDeleteRule)
+	internalAPI.GET("/derived", HandleListDerivedTables)
+	internalAPI.POST("/derived", HandleSaveDerivedTable)
+	internalAPI.DELETE("/derived", HandleDeleteDerivedTable)
+	internalAPI.POST("/derived/rebuild", HandleRebuildDerivedTable)
+
+	// Node to node endpoints, only through the peer mTLS listener (peer.go)
+	peerAPI := server.Group(DEFAULT_PEER_API)
+	peerAPI.Use(MiddlewarePeerOnly())
+	peerAPI.GET("/ping", HandlePeerPing)
 }
 
 // HandleListUsers retrieves all users from the system (or filtered by username)
 func HandleListUsers(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "list_users", UserTable{}.TableName())
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "list_users", UserTable{}.TableName())
 
 	// Get optional filter parameter
 	usernameFilter := ctx.GetQueryParam("username")
@@ -84,7 +173,7 @@ func HandleListUsers(ctx simplehttp.Context) error {
 
 	// Execute query
 	var users []UserTable
-	records, err := suresql.CurrentNode.InternalConnection.SelectManyWithCondition(UserTable{}.TableName(), &condition)
+	records, err := suresql.CurrentNode.GetInternalConnection().SelectManyWithCondition(UserTable{}.TableName(), &condition)
 
 	if err != nil {
 		// Check if it's a "no rows" error, which isn't actually an error for listing
@@ -108,7 +197,7 @@ func HandleListUsers(ctx simplehttp.Context) error {
 
 // HandleCreateUser creates a new user in the system
 func HandleCreateUser(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "create_user", UserTable{}.TableName())
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "create_user", UserTable{}.TableName())
 
 	// Parse request body
 	var createReq UserTable
@@ -154,7 +243,7 @@ func HandleCreateUser(ctx simplehttp.Context) error {
 	delete(userRec.Data, "id")
 
 	// Insert into database
-	res := suresql.CurrentNode.InternalConnection.InsertOneDBRecord(userRec, false)
+	res := suresql.CurrentNode.GetInternalConnection().InsertOneDBRecord(userRec, false)
 	err = res.Error
 	if err != nil {
 		return state.SetError("Failed to create user", err, http.StatusInternalServerError).LogAndResponse("failed to insert db", nil, true)
@@ -164,6 +253,7 @@ func HandleCreateUser(ctx simplehttp.Context) error {
 		"id":       fmt.Sprintf("%d", userRec.Data["id"]),
 		"username": createReq.Username,
 		"role":     createReq.RoleName,
+		"tenant":   createReq.Tenant,
 	}).LogAndResponse(fmt.Sprintf("user %s created", createReq.Username), "InsertOneTableStruct", true)
 
 	// return returnResponse(ctx, "User created successfully", map[string]string{
@@ -175,7 +265,7 @@ func HandleCreateUser(ctx simplehttp.Context) error {
 
 // HandleUpdateUser updates an existing user
 func HandleUpdateUser(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "update_user", UserTable{}.TableName())
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "update_user", UserTable{}.TableName())
 
 	// Parse request body
 	var updateReq UserUpdateRequest
@@ -189,7 +279,7 @@ func HandleUpdateUser(ctx simplehttp.Context) error {
 	}
 
 	// Verify at least one update field is provided
-	if updateReq.NewUsername == "" && updateReq.NewPassword == "" && updateReq.NewRoleName == "" {
+	if updateReq.NewUsername == "" && updateReq.NewPassword == "" && updateReq.NewRoleName == "" && updateReq.NewTenant == "" {
 		return state.SetError("No update fields provided", nil, http.StatusBadRequest).LogAndResponse("no update fields provided", nil, true)
 	}
 
@@ -238,6 +328,12 @@ func HandleUpdateUser(ctx simplehttp.Context) error {
 		updateValues = append(updateValues, updateReq.NewRoleName)
 	}
 
+	// Update tenant if provided
+	if updateReq.NewTenant != "" && updateReq.NewTenant != user.Tenant {
+		updateFields = append(updateFields, "tenant = ?")
+		updateValues = append(updateValues, updateReq.NewTenant)
+	}
+
 	// If no fields need updating, return success
 	if len(updateFields) == 0 {
 		return state.SetSuccess("No changes provided", nil).LogAndResponse("no changes", nil, false)
@@ -252,7 +348,7 @@ func HandleUpdateUser(ctx simplehttp.Context) error {
 		Values: updateValues,
 	}
 
-	result := suresql.CurrentNode.InternalConnection.ExecOneSQLParameterized(paramSQL)
+	result := suresql.CurrentNode.GetInternalConnection().ExecOneSQLParameterized(paramSQL)
 	if result.Error != nil {
 		return state.SetError("Failed to update user", result.Error, http.StatusInternalServerError).LogAndResponse("failed to update db", nil, true)
 	}
@@ -264,7 +360,7 @@ func HandleUpdateUser(ctx simplehttp.Context) error {
 
 // HandleDeleteUser deletes a user from the system
 func HandleDeleteUser(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "delete_user", UserTable{}.TableName())
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "delete_user", UserTable{}.TableName())
 
 	// Get username from URL parameter
 	username := ctx.GetQueryParam("username")
@@ -287,7 +383,7 @@ func HandleDeleteUser(ctx simplehttp.Context) error {
 		Values: []interface{}{username},
 	}
 
-	result := suresql.CurrentNode.InternalConnection.ExecOneSQLParameterized(paramSQL)
+	result := suresql.CurrentNode.GetInternalConnection().ExecOneSQLParameterized(paramSQL)
 	if result.Error != nil {
 		return state.SetError("Failed to delete user", result.Error, http.StatusInternalServerError).LogAndResponse("failed to delete from db", nil, true)
 	}
@@ -297,22 +393,25 @@ func HandleDeleteUser(ctx simplehttp.Context) error {
 
 // HandleGetSchema only for internal
 func HandleGetSchema(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "handle_schema", suresql.SchemaTable)
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "handle_schema", suresql.CurrentNode.GetSchemaTable())
 
 	if strings.Contains(ctx.GetPath(), "getschema") {
 		return state.SetError("schema is not exposed to API", nil, http.StatusUnauthorized).LogAndResponse("schema is not exposed to API", nil, true)
 	}
-	result := suresql.CurrentNode.InternalConnection.GetSchema(false, false)
+	result := suresql.CoalescedSchema(suresql.CurrentNode.GetInternalConnection(), false, false)
+	if done, err := state.NotModified(ContentETag(result)); done {
+		return err
+	}
 
 	return state.SetSuccess("Schema get successfully", result).LogAndResponse("schema get successfully (should be internal)", "GetSchema", true)
 }
 
 // HandleGetSchema only for internal
 func HandleDBMSStatus(ctx simplehttp.Context) error {
-	state := NewHandlerState(ctx, suresql.CurrentNode.InternalConfig.Username, "dbms_status", suresql.SchemaTable)
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "dbms_status", suresql.CurrentNode.GetSchemaTable())
 
 	if strings.Contains(ctx.GetPath(), "dbms_status") {
-		result, err := suresql.GetStatusInternal(suresql.CurrentNode.InternalConnection, suresql.INTERNAL_MODE)
+		result, err := suresql.GetStatusInternal(suresql.CurrentNode.GetInternalConnection(), suresql.INTERNAL_MODE)
 		if err != nil {
 			return state.SetError("DBMS status returns error", err, http.StatusInternalServerError).LogAndResponse("DBMS status returns error", err, true)
 		}
@@ -321,3 +420,11 @@ func HandleDBMSStatus(ctx simplehttp.Context) error {
 
 	return state.SetError("DBMS status is not exposed to API", nil, http.StatusUnauthorized).LogAndResponse("DBMS status is not exposed to API", nil, true)
 }
+
+// HandleNodeInfo returns the effective configuration of the node, the startup banner as JSON (internal)
+func HandleNodeInfo(ctx simplehttp.Context) error {
+	state := NewHandlerState(ctx, suresql.CurrentNode.GetInternalConfig().Username, "node_info", "info")
+
+	info := suresql.CurrentNode.Info()
+	return state.SetSuccess("Node info retrieved successfully", info).LogAndResponse("node info retrieved", nil, false)
+}
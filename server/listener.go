@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// Extra listeners besides TCP: a Unix domain socket (SURESQL_UNIX_SOCKET) and the sockets passed by
+// systemd socket activation (LISTEN_FDS). simplehttp only listens on TCP, so connections accepted on
+// the extra listeners are forwarded to it over loopback. With SURESQL_TCP=false the TCP listener is
+// bound to a random loopback port only the forwarder uses, for sidecars that must not be reachable
+// from the network at all. Requests that come through a socket have 127.0.0.1 as client IP.
+
+const (
+	SD_LISTEN_FDS_START      = 3 // first file descriptor passed by systemd
+	DEFAULT_UNIX_SOCKET_MODE = 0660
+	FORWARD_DIAL_TIMEOUT     = 5 * time.Second
+)
+
+var ErrListenerInvalid = medaerror.MedaError{Message: "invalid listener configuration"}
+
+type ListenConfig struct {
+	UnixSocket  string      // path of the socket, empty for none
+	SocketMode  os.FileMode // permissions of the socket file
+	SocketGroup string      // group owning the socket file, empty keeps the process group
+	Systemd     bool        // LISTEN_FDS is set for this process
+	TCP         bool        // listen on the configured host:port, otherwise on a loopback port only
+}
+
+// LoadListenConfig reads SURESQL_UNIX_SOCKET, SURESQL_UNIX_SOCKET_MODE (octal), SURESQL_UNIX_SOCKET_GROUP,
+// SURESQL_TCP and the systemd LISTEN_PID/LISTEN_FDS variables
+func LoadListenConfig() (ListenConfig, error) {
+	lc := ListenConfig{
+		UnixSocket:  utils.GetEnvString("SURESQL_UNIX_SOCKET", ""),
+		SocketMode:  DEFAULT_UNIX_SOCKET_MODE,
+		SocketGroup: utils.GetEnvString("SURESQL_UNIX_SOCKET_GROUP", ""),
+		Systemd:     os.Getenv("LISTEN_FDS") != "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()),
+		TCP:         utils.GetEnvBool("SURESQL_TCP", true),
+	}
+	if mode := utils.GetEnvString("SURESQL_UNIX_SOCKET_MODE", ""); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return lc, medaerror.Errorf("%s: SURESQL_UNIX_SOCKET_MODE %q is not an octal file mode", ErrListenerInvalid.Message, mode)
+		}
+		lc.SocketMode = os.FileMode(m)
+	}
+	if !lc.TCP && lc.UnixSocket == "" && !lc.Systemd {
+		return lc, medaerror.Errorf("%s: SURESQL_TCP=false needs SURESQL_UNIX_SOCKET or systemd socket activation", ErrListenerInvalid.Message)
+	}
+	return lc, nil
+}
+
+// apply changes the address of the HTTP server when TCP is disabled and returns where the extra
+// listeners forward to, empty when there are none, with the listener reserving the loopback port
+func (lc ListenConfig) apply(config *simplehttp.Config) (string, net.Listener, error) {
+	if lc.UnixSocket == "" && !lc.Systemd {
+		return "", nil, nil
+	}
+	var reserved net.Listener
+	if !lc.TCP {
+		l, port, err := reserveLoopbackPort()
+		if err != nil {
+			return "", nil, err
+		}
+		reserved = l
+		config.Hostname, config.Port = "127.0.0.1", port
+	}
+	return loopbackAddress(config), reserved, nil
+}
+
+// loopbackAddress is where the HTTP server is reached from this host
+func loopbackAddress(config *simplehttp.Config) string {
+	host := config.Hostname
+	if host == "" || host == "0.0.0.0" || host == "::" || host == "[::]" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, config.Port)
+}
+
+// reserveLoopbackPort listens on a free loopback port for the HTTP server. simplehttp only starts on an
+// address, so the listener is handed to listeningServer which holds the port until the moment the HTTP
+// server binds it, nothing else on the host can take it while SureSQL starts.
+func reserveLoopbackPort() (net.Listener, string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	return l, strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// open creates the Unix socket and takes over the systemd sockets
+func (lc ListenConfig) open() ([]net.Listener, error) {
+	var listeners []net.Listener
+	if lc.Systemd {
+		sd, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, sd...)
+	}
+	if lc.UnixSocket != "" {
+		l, err := listenUnix(lc.UnixSocket, lc.SocketMode, lc.SocketGroup)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix removes a stale socket file (left by a crash) but not one another process still serves
+func listenUnix(path string, mode os.FileMode, group string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, medaerror.Errorf("%s: %s exists and is not a socket", ErrListenerInvalid.Message, path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, medaerror.Errorf("%s: %s is in use", ErrListenerInvalid.Message, path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err == nil {
+			var gid int
+			if gid, err = strconv.Atoi(g.Gid); err == nil {
+				err = os.Chown(path, -1, gid)
+			}
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// systemdListeners follows sd_listen_fds(3), the variables are removed so child processes do not use them
+func systemdListeners() ([]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n < 1 {
+		return nil, medaerror.Errorf("%s: LISTEN_FDS is not a positive number", ErrListenerInvalid.Message)
+	}
+	listeners := make([]net.Listener, 0, n)
+	for fd := SD_LISTEN_FDS_START; fd < SD_LISTEN_FDS_START+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, medaerror.Errorf("%s: fd %d: %v", ErrListenerInvalid.Message, fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// forwardConnections copies every accepted connection to target until the listener is closed
+func forwardConnections(l net.Listener, target string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go func() {
+			defer c.Close()
+			up, err := net.DialTimeout("tcp", target, FORWARD_DIAL_TIMEOUT)
+			if err != nil {
+				simplelog.LogErrorAny("listener", err, "cannot forward connection from "+l.Addr().String())
+				return
+			}
+			defer up.Close()
+			pipeConnections(c, up)
+		}()
+	}
+}
+
+// pipeConnections copies both ways, a finished direction is half closed so the other can drain
+func pipeConnections(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
+
+// frontService is a server in front of the HTTP server: the transport front end (transport.go) and
+// the peer listener (peer.go)
+type frontService interface {
+	start() error
+	shutdown(ctx context.Context) error
+}
+
+// listeningServer opens the extra listeners and the front services when the HTTP server starts and
+// closes them on shutdown
+type listeningServer struct {
+	simplehttp.Server
+	listen    ListenConfig
+	target    string
+	services  []frontService
+	reserved  net.Listener // holds the loopback port of the HTTP server until it starts, see reserveLoopbackPort
+	err       error        // invalid configuration, returned by Start
+	mu        sync.Mutex
+	listeners []net.Listener
+}
+
+func withListeners(server simplehttp.Server, listen ListenConfig, target string, services []frontService, reserved net.Listener, err error) simplehttp.Server {
+	if target == "" && len(services) == 0 && reserved == nil && err == nil {
+		return server
+	}
+	return &listeningServer{Server: server, listen: listen, target: target, services: services, reserved: reserved, err: err}
+}
+
+func (s *listeningServer) Start(address string) error {
+	if s.err != nil {
+		s.release()
+		return s.err
+	}
+	for _, svc := range s.services {
+		if err := svc.start(); err != nil {
+			s.release()
+			return err
+		}
+	}
+	listeners, err := s.listen.open()
+	if err != nil {
+		s.release()
+		return err
+	}
+	s.mu.Lock()
+	s.listeners = listeners
+	s.mu.Unlock()
+	for _, l := range listeners {
+		simplelog.LogFormat("listening on %s %s, forwarded to %s", l.Addr().Network(), l.Addr().String(), s.target)
+		go forwardConnections(l, s.target)
+	}
+	// the last moment before the HTTP server binds the port
+	s.release()
+	return s.Server.Start(address)
+}
+
+// release closes the reservation of the loopback port
+func (s *listeningServer) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reserved != nil {
+		s.reserved.Close()
+		s.reserved = nil
+	}
+}
+
+func (s *listeningServer) Shutdown(ctx context.Context) error {
+	s.release()
+	s.mu.Lock()
+	closeListeners(s.listeners)
+	s.listeners = nil
+	s.mu.Unlock()
+	for _, svc := range s.services {
+		svc.shutdown(ctx)
+	}
+	return s.Server.Shutdown(ctx)
+}
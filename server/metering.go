@@ -0,0 +1,64 @@
+package server
+
+import (
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+const METER_STRING = "meter"
+
+// Usage metering middleware, records one request with bytes in/out for the API key and user.
+// Rows read/written are added by the handlers with meterRows. Use it after the token middleware
+// so the user is known.
+func MiddlewareMetering() simplehttp.Middleware {
+	return simplehttp.WithName("metering", UsageMetering())
+}
+
+func UsageMetering() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			if suresql.Meter == nil {
+				return next(ctx)
+			}
+
+			delta := &suresql.MeterDelta{Requests: 1, BytesIn: int64(len(ctx.GetBody()))}
+			ctx.Set(METER_STRING, delta)
+			err := next(&meteredContext{httpContext: ctx, delta: delta})
+
+			username := ""
+			if tok, ok := ctx.Get(TOKEN_TABLE_STRING).(*suresql.TokenTable); ok && tok != nil {
+				username = tok.UserName
+			}
+			suresql.Meter.Record(suresql.APIKeyFingerprint(ctx.GetHeader(API_KEY_STRING)), username, *delta)
+			return err
+		}
+	}
+}
+
+// meterRows adds rows read/written by the handler to the current request meter
+func meterRows(ctx simplehttp.Context, read, written int) {
+	if delta, ok := ctx.Get(METER_STRING).(*suresql.MeterDelta); ok && delta != nil {
+		delta.RowsRead += int64(read)
+		delta.RowsWritten += int64(written)
+	}
+}
+
+// alias so the embedded field does not clash with the Context() method
+type httpContext = simplehttp.Context
+
+// meteredContext counts the bytes of JSON responses
+type meteredContext struct {
+	httpContext
+	delta *suresql.MeterDelta
+}
+
+// JSON is counted by String
+func (c *meteredContext) JSON(code int, data interface{}) error {
+	return writeJSON(c, code, data)
+}
+
+func (c *meteredContext) String(code int, data string) error {
+	c.delta.BytesOut += int64(len(data))
+	return c.httpContext.String(code, data)
+}
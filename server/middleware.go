@@ -33,6 +33,7 @@ func APIKeyClientIDHeader() simplehttp.MiddlewareFunc {
 			}
 
 			if suresql.CurrentNode.Config.APIKey != apiKey {
+				state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, "", "invalid API key")
 				return state.SetError("Invalid API key", nil, http.StatusUnauthorized).LogAndResponse("Invalid API key", nil, true)
 			}
 
@@ -43,6 +44,7 @@ func APIKeyClientIDHeader() simplehttp.MiddlewareFunc {
 			}
 
 			if suresql.CurrentNode.Config.ClientID != clientID {
+				state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, "", "invalid client ID")
 				return state.SetError("Invalid Client ID", nil, http.StatusUnauthorized).LogAndResponse("Invalid Client ID", nil, true)
 			}
 
@@ -63,6 +65,11 @@ func TokenValidationFromTTL() simplehttp.MiddlewareFunc {
 			// Get headers, make sure you already have MiddlewareHeaderParser before invoking this middleware
 			state := NewMiddlewareState(ctx, "token")
 
+			// Already authenticated by a request signature
+			if tok, ok := ctx.Get(TOKEN_TABLE_STRING).(*suresql.TokenTable); ok && tok != nil {
+				return next(ctx)
+			}
+
 			// Get token from Authorization header
 			header := state.Header
 			token := header.Authorization.Token
@@ -79,6 +86,7 @@ func TokenValidationFromTTL() simplehttp.MiddlewareFunc {
 			// Validate token
 			tok, valid := TokenStore.TokenExist(token)
 			if !valid {
+				state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_INFO, "", "invalid or expired token")
 				return state.SetError("Invalid or expired token", nil, http.StatusUnauthorized).LogAndResponse("no token", nil, true)
 			}
 
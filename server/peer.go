@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// Peer listener: with setting peer/mtls and SURESQL_PEER_PORT other nodes connect over mutual TLS
+// (peer_tls.go) on that port. Requests are proxied to the HTTP server with the CN of the verified
+// client certificate in X-SureSQL-Peer and a token only this process knows, so a client on the
+// public port cannot pretend to be a peer. Routes under /peer only accept such requests.
+
+const (
+	PEER_HEADER       = "X-SureSQL-Peer"
+	PEER_TOKEN_HEADER = "X-SureSQL-Peer-Token"
+)
+
+// peerToken proves a request came through the peer listener, new on every start
+var peerToken = func() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// peerListener is the mTLS server for other nodes in front of the HTTP server
+type peerListener struct {
+	address string
+	backend *url.URL
+	server  *http.Server
+}
+
+// loadPeerListener returns the peer listener for SURESQL_PEER_PORT, nil when peer mTLS is off. Call
+// it after the transport and listen configs changed the address of the HTTP server.
+func loadPeerListener(config *simplehttp.Config) *peerListener {
+	port := utils.GetEnvString("SURESQL_PEER_PORT", "")
+	if port == "" || !suresql.PeerTLSEnabled() {
+		return nil
+	}
+	scheme := "http"
+	if config.TLSCert != "" {
+		scheme = "https"
+	}
+	return &peerListener{
+		address: net.JoinHostPort(config.Hostname, port),
+		backend: &url.URL{Scheme: scheme, Host: loopbackAddress(config)},
+	}
+}
+
+func (p *peerListener) start() error {
+	proxy := httputil.NewSingleHostReverseProxy(p.backend)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Del(PEER_HEADER)
+		r.Header.Del(PEER_TOKEN_HEADER)
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			r.Header.Set(PEER_HEADER, r.TLS.PeerCertificates[0].Subject.CommonName)
+			r.Header.Set(PEER_TOKEN_HEADER, peerToken)
+		}
+	}
+	proxy.Transport = &http.Transport{
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: FORWARD_DIAL_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext,
+		// the loopback hop to our own HTTP server, its certificate is for the public name
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	suresql.InitPeerTLS()
+	p.server = &http.Server{Handler: proxy, TLSConfig: suresql.PeerTLS.ServerTLSConfig()}
+	l, err := net.Listen("tcp", p.address)
+	if err != nil {
+		return err
+	}
+	simplelog.LogFormat("peer: mTLS listener on %s proxying to %s", p.address, p.backend.Host)
+	go func() {
+		// certificates come from the TLS config, they change on rotation
+		if err := p.server.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+			simplelog.LogErrorAny("peer", err, "peer listener stopped")
+		}
+	}()
+	return nil
+}
+
+func (p *peerListener) shutdown(ctx context.Context) error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Shutdown(ctx)
+}
+
+// PeerName is the node name of a request that came through the peer listener, empty otherwise
+func PeerName(ctx simplehttp.Context) string {
+	token := ctx.GetHeader(PEER_TOKEN_HEADER)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(peerToken)) != 1 {
+		return ""
+	}
+	return ctx.GetHeader(PEER_HEADER)
+}
+
+// MiddlewarePeerOnly rejects requests that did not come from another node over mTLS
+func MiddlewarePeerOnly() simplehttp.Middleware {
+	return simplehttp.WithName("peer only", func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			if PeerName(ctx) == "" {
+				return ctx.JSON(http.StatusForbidden, map[string]string{
+					"error": "peer certificate required",
+				})
+			}
+			return next(ctx)
+		}
+	})
+}
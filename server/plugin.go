@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/simplehttp"
+)
+
+// Endpoint plugins are Go packages compiled into the binary (no fork of this package needed). A plugin
+// registers itself in init() and is included by a blank import in the main package, usually in a file
+// with a build tag so each build picks its plugins:
+//
+//	//go:build plugin_billing
+//	package main
+//	import _ "example.com/team/suresql-billing"
+//
+// and `go build -tags plugin_billing ./app/suresql`. The routes of a plugin are mounted at
+// /db/api/plugins/<name>/ behind the API key, token and metering checks, its handlers get the caller's
+// DB connection, token and the same logging as the built-in endpoints through PluginContext.
+
+const PLUGIN_PATH = "/plugins/"
+
+var (
+	ErrPluginDuplicate = medaerror.MedaError{Message: "plugin already registered"}
+	ErrPluginName      = medaerror.MedaError{Message: "plugin name is required"}
+)
+
+// Plugin is a set of custom endpoints
+type Plugin interface {
+	Name() string
+	Version() string
+	Routes(r PluginRouter)
+}
+
+// PluginInfo describes a registered plugin
+type PluginInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Routes  []string `json:"routes"`
+}
+
+// PluginHandler handles a plugin endpoint
+type PluginHandler func(p *PluginContext) error
+
+// PluginRouter registers the endpoints of a plugin, paths are relative to /db/api/plugins/<name>
+type PluginRouter interface {
+	GET(path string, handler PluginHandler)
+	POST(path string, handler PluginHandler)
+	PUT(path string, handler PluginHandler)
+	DELETE(path string, handler PluginHandler)
+}
+
+// PluginContext is what a plugin handler gets: the request, the caller's token and DB connection, and
+// the response/logging helpers of HandlerState
+type PluginContext struct {
+	simplehttp.Context
+	State *HandlerState
+}
+
+// Token of the caller, set by the token check
+func (p *PluginContext) Token() *suresql.TokenTable {
+	return p.State.Token
+}
+
+// DB is the caller's pooled connection, reconnected if it was reclaimed
+func (p *PluginContext) DB() (suresql.SureSQLDB, error) {
+	return suresql.CurrentNode.GetOrReconnectDBConnection(p.State.Token.Token)
+}
+
+// InternalDB is the node's own connection, for SureSQL internal tables
+func (p *PluginContext) InternalDB() suresql.SureSQLDB {
+	return suresql.CurrentNode.GetInternalConnection()
+}
+
+// Success responds 200 with data and logs it like the built-in endpoints
+func (p *PluginContext) Success(msg string, data interface{}) error {
+	return p.State.SetSuccess(msg, data).LogAndResponse(msg, nil, true)
+}
+
+// Error responds with the status and logs the error
+func (p *PluginContext) Error(msg string, err error, status int) error {
+	return p.State.SetError(msg, err, status).LogAndResponse(msg, nil, true)
+}
+
+var (
+	pluginsMu sync.Mutex
+	plugins   = map[string]Plugin{}
+	// routes of each plugin, filled when they are mounted
+	pluginRoutes = map[string][]string{}
+)
+
+// RegisterPlugin adds a plugin, call it from the plugin's init()
+func RegisterPlugin(p Plugin) error {
+	if p.Name() == "" {
+		return ErrPluginName
+	}
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, exist := plugins[p.Name()]; exist {
+		return ErrPluginDuplicate
+	}
+	return extensions.add(func() { plugins[p.Name()] = p })
+}
+
+// ListPlugins returns the registered plugins with their routes
+func ListPlugins() []PluginInfo {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	infos := make([]PluginInfo, 0, len(plugins))
+	for name, p := range plugins {
+		infos = append(infos, PluginInfo{Name: name, Version: p.Version(), Routes: pluginRoutes[name]})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// registerPlugins mounts every plugin on the api group, with the full path: a sub-group would start without
+// the middleware of api
+func registerPlugins(api simplehttp.Router) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	for name, p := range plugins {
+		r := &pluginRouter{name: name, prefix: PLUGIN_PATH + name, router: api}
+		p.Routes(r)
+		pluginRoutes[name] = r.routes
+	}
+}
+
+// pluginRouter wraps the plugin handlers into simplehttp handlers
+type pluginRouter struct {
+	name   string
+	prefix string
+	router simplehttp.Router
+	routes []string
+}
+
+func (r *pluginRouter) wrap(method, path string, handler PluginHandler) simplehttp.HandlerFunc {
+	r.routes = append(r.routes, method+" "+r.prefix+path)
+	label := "plugin:" + r.name + path
+	return func(ctx simplehttp.Context) error {
+		state := NewHandlerTokenState(ctx, label, r.name)
+		if state.Token == nil {
+			return state.SetError("Cannot retrieve token from context", nil, http.StatusUnauthorized).LogAndResponse("cannot retrieve token from context, should not happen because of middleware", nil, true)
+		}
+		return handler(&PluginContext{Context: ctx, State: &state})
+	}
+}
+
+func (r *pluginRouter) GET(path string, handler PluginHandler) {
+	r.router.GET(r.prefix+path, r.wrap(http.MethodGet, path, handler))
+}
+func (r *pluginRouter) POST(path string, handler PluginHandler) {
+	r.router.POST(r.prefix+path, r.wrap(http.MethodPost, path, handler))
+}
+func (r *pluginRouter) PUT(path string, handler PluginHandler) {
+	r.router.PUT(r.prefix+path, r.wrap(http.MethodPut, path, handler))
+}
+func (r *pluginRouter) DELETE(path string, handler PluginHandler) {
+	r.router.DELETE(r.prefix+path, r.wrap(http.MethodDelete, path, handler))
+}
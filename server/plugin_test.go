@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+	"github.com/medatechnology/simplehttp/framework/fiber"
+)
+
+type echoPlugin struct{}
+
+func (echoPlugin) Name() string    { return "echo" }
+func (echoPlugin) Version() string { return "1.0.0" }
+func (echoPlugin) Routes(r PluginRouter) {
+	r.GET("/whoami", func(p *PluginContext) error {
+		p.State.DBLogging = false
+		return p.Success("hello "+p.Token().UserName, nil)
+	})
+}
+
+func TestPluginRoutesRunAPIMiddleware(t *testing.T) {
+	suresql.InitMetrics()
+	saved := TokenStore
+	defer func() { TokenStore = saved }()
+	TokenStore = NewTokenStore(time.Hour, 2*time.Hour, time.Hour)
+	token := createNewTokenResponse(UserTable{ID: 1, Username: "alice"})
+
+	pluginsMu.Lock()
+	plugins["echo"] = echoPlugin{}
+	pluginsMu.Unlock()
+	defer func() {
+		pluginsMu.Lock()
+		delete(plugins, "echo")
+		delete(pluginRoutes, "echo")
+		pluginsMu.Unlock()
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := fiber.NewServer(simplehttp.DefaultConfig)
+	srv.Use(simplehttp.MiddlewareRecover(), simplehttp.MiddlewareHeaderParser())
+	api := srv.Group("/db/api")
+	api.Use(MiddlwareTokenCheck())
+	registerPlugins(api)
+	go srv.Start(addr)
+	defer srv.Shutdown(context.Background())
+
+	get := func(bearer string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/db/api"+PLUGIN_PATH+"echo/whoami", nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get(""); status != http.StatusUnauthorized {
+		t.Fatalf("without a token got %d %s, want 401 from the token check", status, body)
+	}
+	if status, body := get(token.Token); status != http.StatusOK || !strings.Contains(body, "hello alice") {
+		t.Fatalf("with a token got %d %s, want 200 for alice", status, body)
+	}
+}
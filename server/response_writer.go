@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/medatechnology/suresql"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// JSON responses are encoded into pooled buffers, each with its encoder, and handed to the framework which
+// copies them into its own (pooled) response body, so a response does not allocate its body. The buffer is
+// sized before encoding from the count of records in the response and the bytes per record of the responses
+// before. Buffers grown past RESPONSE_BUFFER_MAX_POOLED are dropped, one large export does not pin its memory.
+
+const (
+	RESPONSE_BUFFER_MAX_POOLED = 4 << 20
+	RESPONSE_BUFFER_HEADROOM   = 512 // bytes of the envelope around the records
+)
+
+type responseBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var responseBuffers = sync.Pool{New: func() interface{} {
+	b := &responseBuffer{}
+	b.enc = json.NewEncoder(&b.buf)
+	return b
+}}
+
+// recordBytes is the running average of the encoded bytes of a record
+var recordBytes atomic.Int64
+
+func getResponseBuffer() *responseBuffer {
+	return responseBuffers.Get().(*responseBuffer)
+}
+
+func (b *responseBuffer) release() {
+	if b.buf.Cap() > RESPONSE_BUFFER_MAX_POOLED {
+		return
+	}
+	b.buf.Reset()
+	responseBuffers.Put(b)
+}
+
+// encode returns v as json.Marshal does, valid until the buffer is released. records is the number of
+// records in v, 0 when unknown.
+func (b *responseBuffer) encode(v interface{}, records int) ([]byte, error) {
+	b.buf.Reset()
+	if avg := recordBytes.Load(); records > 0 && avg > 0 {
+		b.buf.Grow(records*int(avg) + RESPONSE_BUFFER_HEADROOM)
+	}
+	if err := b.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	body := b.buf.Bytes()
+	body = body[:len(body)-1] // the newline of Encode
+	if records > 0 {
+		per := int64(len(body) / records)
+		if avg := recordBytes.Load(); avg > 0 {
+			per = (avg*7 + per) / 8
+		}
+		recordBytes.Store(per)
+	}
+	return body, nil
+}
+
+// writeJSON responds with v as JSON through the context, so the wrapping contexts (metering, route stats) see
+// the response
+func writeJSON(ctx simplehttp.Context, code int, v interface{}) error {
+	b := getResponseBuffer()
+	defer b.release()
+	body, err := b.encode(v, responseCount(v))
+	if err != nil {
+		return err
+	}
+	ctx.SetResponseHeader("Content-Type", "application/json")
+	// the framework copies the body before String returns, the buffer is reused after
+	return ctx.String(code, unsafe.String(unsafe.SliceData(body), len(body)))
+}
+
+// responseCount is the number of records in a response, 0 when it has none or they are not counted
+func responseCount(v interface{}) int {
+	switch r := v.(type) {
+	case suresql.StandardResponse:
+		return responseCount(r.Data)
+	case suresql.QueryResponse:
+		return r.Count
+	case rowSetResponse:
+		return r.Count
+	case []orm.DBRecord:
+		return len(r)
+	case *suresql.RowSet:
+		return r.Len()
+	case suresql.QueryResponseSQL:
+		n := 0
+		for _, q := range r {
+			n += q.Count
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// routeParams are the routes with a path parameter, counted as one route
+var routeParams = map[string]string{
+	"/db/api/procedures/": ":name",
+}
+
+// MiddlewareRouteStats counts the requests, errors and latency of every route for /db/api/status. Use it
+// first so requests refused by the other middlewares are counted too.
+func MiddlewareRouteStats() simplehttp.Middleware {
+	return simplehttp.WithName("route stats", RouteStatistics())
+}
+
+func RouteStatistics() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			start := time.Now()
+			sc := &statusContext{httpContext: ctx, status: http.StatusOK}
+			err := next(sc)
+			if err != nil && sc.status < 400 {
+				sc.status = http.StatusInternalServerError
+			}
+			suresql.RecordRoute(ctx.GetMethod()+" "+routeName(ctx.GetPath()), sc.status, time.Since(start))
+			return err
+		}
+	}
+}
+
+// routeName is the path with its parameter replaced by the name, ie: /db/api/procedures/:name
+func routeName(path string) string {
+	for prefix, param := range routeParams {
+		if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+			return prefix + param
+		}
+	}
+	return path
+}
+
+// statusContext remembers the status of the response
+type statusContext struct {
+	httpContext
+	status int
+}
+
+func (c *statusContext) JSON(code int, data interface{}) error {
+	c.status = code
+	return c.httpContext.JSON(code, data)
+}
+
+func (c *statusContext) String(code int, data string) error {
+	c.status = code
+	return c.httpContext.String(code, data)
+}
+
+func (c *statusContext) Stream(code int, contentType string, reader io.Reader) error {
+	c.status = code
+	return c.httpContext.Stream(code, contentType, reader)
+}
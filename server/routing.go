@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/medatechnology/suresql"
+)
+
+// Routing hints of reads, see routing.go of suresql. The route taken is in X-SureSQL-Routed.
+
+const (
+	HEADER_ROUTE       = "X-SureSQL-Route"
+	HEADER_ROUTED      = "X-SureSQL-Routed"
+	HEADER_CONSISTENCY = "X-SureSQL-Consistency"
+)
+
+// RouteRead applies the X-SureSQL-Route hint of a read to the user connection db. When it returns true the
+// response is already written (a rejected hint or a redirect to another node), return err from the handler.
+func (h *HandlerState) RouteRead(db suresql.SureSQLDB) (suresql.SureSQLDB, bool, error) {
+	hint, err := suresql.ParseRouteHint(h.Context.GetHeader(HEADER_ROUTE))
+	if err != nil {
+		return db, true, h.SetError("Invalid routing hint", err, http.StatusBadRequest).LogAndResponse("invalid routing hint "+h.Context.GetHeader(HEADER_ROUTE), nil, true)
+	}
+	if hint.Kind == "" {
+		return db, false, nil
+	}
+	if err := hint.Allowed(); err != nil {
+		return db, true, h.SetError("Routing hint not allowed", err, http.StatusForbidden).LogAndResponse("routing hint "+hint.Kind+" not allowed", nil, true)
+	}
+
+	// node=N of a peer: the client repeats the request there, 307 keeps the method and the body
+	if base := suresql.RouteNodeURL(hint); base != "" {
+		location := base + h.Context.GetPath()
+		if params := url.Values(h.Context.GetQueryParams()); len(params) > 0 {
+			location += "?" + params.Encode()
+		}
+		h.Context.SetResponseHeader("Location", location)
+		h.Context.SetResponseHeader(HEADER_ROUTED, hint.Kind)
+		h.SaveStopTimer()
+		h.Status = http.StatusTemporaryRedirect
+		h.OnlyLog("routed to "+location, nil, false)
+		return db, true, h.Context.String(http.StatusTemporaryRedirect, "")
+	}
+
+	routed, route, err := suresql.RouteRead(db, hint)
+	if err != nil {
+		return db, true, respondDBConnectionError(h, err)
+	}
+	h.Route = route
+	h.Context.SetResponseHeader(HEADER_ROUTED, route)
+	return routed, false, nil
+}
+
+// ConsistentRead applies the consistency of the request body to db, after RouteRead so the body overrides
+// the hint. The level taken is in X-SureSQL-Consistency. When it returns true the response is written.
+func (h *HandlerState) ConsistentRead(db suresql.SureSQLDB, level, freshness string) (suresql.SureSQLDB, bool, error) {
+	if level == "" && freshness == "" {
+		return db, false, nil
+	}
+	c, err := suresql.ParseConsistency(level, freshness)
+	if err != nil {
+		return db, true, h.SetError("Invalid consistency", err, http.StatusBadRequest).LogAndResponse("invalid consistency "+level+" "+freshness, nil, true)
+	}
+	read, taken, err := suresql.ConsistentRead(db, c)
+	if err != nil {
+		return db, true, respondDBConnectionError(h, err)
+	}
+	if taken != "" {
+		h.Context.SetResponseHeader(HEADER_CONSISTENCY, taken)
+	}
+	return read, false, nil
+}
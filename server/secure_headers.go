@@ -0,0 +1,25 @@
+package server
+
+import (
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// MiddlewareSecureHeaders adds the security headers (HSTS, nosniff, frame options, CSP ...) to every
+// response, configured by the settings of category headers
+func MiddlewareSecureHeaders() simplehttp.Middleware {
+	return simplehttp.WithName("secure headers", SecureHeaders())
+}
+
+func SecureHeaders() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			// set before the handler runs so error responses from later middlewares get them too
+			for _, h := range suresql.SecureHeaders() {
+				ctx.SetResponseHeader(h.Name, h.Value)
+			}
+			return next(ctx)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/goutil/encryption"
+	"github.com/medatechnology/simplehttp"
+)
+
+// SecurityEvent records a security event about the current request
+func (h *HandlerState) SecurityEvent(eventType, severity, username, message string) {
+	event := suresql.SecurityEventTable{
+		EventType: eventType,
+		Severity:  severity,
+		Username:  username,
+		Message:   message,
+		Path:      h.Context.GetMethod() + " " + h.Context.GetPath(),
+	}
+	event.ClientIP = h.ClientIP()
+	suresql.RecordSecurityEvent(event)
+}
+
+// MiddlewareInternalAuth is the basic auth of the internal API, like simplehttp.MiddlewareBasicAuth
+// but failed attempts are recorded as security events. The admin credentials are read on every request.
+func MiddlewareInternalAuth() simplehttp.Middleware {
+	return simplehttp.WithName("internal basic auth", InternalBasicAuth())
+}
+
+func InternalBasicAuth() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			authType, token := encryption.GetAuthorizationFromHeader(ctx.GetHeader("Authorization"))
+			if authType == "Basic" {
+				user, pass, err := encryption.GetClientIDSecretFromTokenString(token)
+				if err == nil && isAdminCredentials(user, pass) {
+					return next(ctx)
+				}
+				state := NewMiddlewareState(ctx, "internal")
+				state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, user, "internal API basic auth failed")
+			}
+			return ctx.JSON(http.StatusUnauthorized, map[string]string{
+				"error": "unauthorized",
+			})
+		}
+	}
+}
+
+// isAdminCredentials checks basic auth against the admin credentials of the node
+func isAdminCredentials(username, password string) bool {
+	adminUser, adminPass := suresql.CurrentNode.GetAdminCredentials()
+	return username == adminUser && password == adminPass
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+// MiddlewareShadow sends a sample of the data API requests to the staging node after they are served,
+// see shadow.go of suresql. Use it after the token middleware, requests that fail authentication are
+// not sent.
+func MiddlewareShadow() simplehttp.Middleware {
+	return simplehttp.WithName("shadow traffic", ShadowTraffic())
+}
+
+func ShadowTraffic() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			err := next(ctx)
+			rawQuery := ""
+			if req := ctx.Request(); req != nil && req.URL != nil {
+				rawQuery = req.URL.RawQuery
+			}
+			suresql.CurrentShadow().Send(ctx.GetMethod(), ctx.GetPath(), rawQuery, ctx.GetBody())
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+const (
+	HEADER_SIGNATURE_KEY       = "X-SureSQL-Key"
+	HEADER_SIGNATURE_TIMESTAMP = "X-SureSQL-Timestamp"
+	HEADER_SIGNATURE_NONCE     = "X-SureSQL-Nonce"
+	HEADER_SIGNATURE           = "X-SureSQL-Signature"
+)
+
+// signedSessions maps a signing key id to the session token its requests run under, so signed
+// requests reuse one pooled connection instead of connecting on every call
+var signedSessions sync.Map
+
+// MiddlewareSignature verifies HMAC signed requests. A signed request without a bearer token is
+// authenticated by its signature alone, with a bearer token the signature is an extra check.
+func MiddlewareSignature() simplehttp.Middleware {
+	return simplehttp.WithName("request signature", SignatureValidation())
+}
+
+func SignatureValidation() simplehttp.MiddlewareFunc {
+	return func(next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+		return func(ctx simplehttp.Context) error {
+			state := NewMiddlewareState(ctx, "signature")
+
+			keyID := ctx.GetHeader(HEADER_SIGNATURE_KEY)
+			signature := ctx.GetHeader(HEADER_SIGNATURE)
+			if keyID == "" && signature == "" {
+				if suresql.SigningRequired() {
+					state.SecurityEvent(suresql.SECURITY_EVENT_POLICY_VIOLATION, suresql.SECURITY_SEVERITY_WARNING, "", "unsigned request while signing is required")
+					return state.SetError("Request signature required", nil, http.StatusUnauthorized).LogAndResponse("unsigned request", nil, true)
+				}
+				return next(ctx)
+			}
+
+			rawQuery := ""
+			if req := ctx.Request(); req != nil && req.URL != nil {
+				rawQuery = req.URL.RawQuery
+			}
+			key, err := suresql.VerifySignature(keyID, ctx.GetHeader(HEADER_SIGNATURE_TIMESTAMP), ctx.GetHeader(HEADER_SIGNATURE_NONCE), signature, ctx.GetMethod(), ctx.GetPath(), rawQuery, ctx.GetBody())
+			if err != nil {
+				suresql.Metrics.RecordAuthentication(false)
+				if err == suresql.ErrNonceReused {
+					state.SecurityEvent(suresql.SECURITY_EVENT_TOKEN_REUSE, suresql.SECURITY_SEVERITY_CRITICAL, "", "replayed signed request, key:"+keyID)
+				} else {
+					state.SecurityEvent(suresql.SECURITY_EVENT_AUTH_FAILURE, suresql.SECURITY_SEVERITY_WARNING, "", err.Error()+", key:"+keyID)
+				}
+				return state.SetError("Invalid request signature", err, http.StatusUnauthorized).LogAndResponse("signature rejected for key:"+keyID, err, true)
+			}
+
+			// bearer token is present, the token checker still validates it
+			if state.Header.Authorization.Token != "" {
+				return next(ctx)
+			}
+
+			tok, err := signedSession(key)
+			if err != nil {
+				if err == suresql.ErrPoolExhausted {
+					return respondBackpressure(&state, suresql.CurrentPressure(), "Failed to create database connection, quota exceeded", http.StatusServiceUnavailable)
+				}
+				return state.SetError("Failed to create database connection", err, http.StatusInternalServerError).LogAndResponse("failed to create signed session", err, true)
+			}
+			ctx.Set(TOKEN_TABLE_STRING, tok)
+			return next(ctx)
+		}
+	}
+}
+
+// signedSession returns the live session of the signing key, or connects a new one like /connect does
+func signedSession(key suresql.SigningKeyTable) (*suresql.TokenTable, error) {
+	if val, ok := signedSessions.Load(key.KeyID); ok {
+		if tok, valid := TokenStore.TokenExist(val.(string)); valid {
+			if _, err := suresql.CurrentNode.GetDBConnectionByToken(tok.Token); err == nil {
+				return tok, nil
+			}
+		}
+	}
+
+	tok, err := connectSession(key.Username)
+	if err != nil {
+		return nil, err
+	}
+	signedSessions.Store(key.KeyID, tok.Token)
+	return tok, nil
+}
+
+// connectSession opens a pooled DB connection and a token for the user like /connect does, without the password
+func connectSession(username string) (*suresql.TokenTable, error) {
+	user, err := userNameExist(username)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = ""
+
+	newDB, err := suresql.NewDatabase(suresql.CurrentNode.GetInternalConfig())
+	if err != nil {
+		return nil, err
+	}
+	if !suresql.CurrentNode.IsPoolAvailable() && suresql.ConnectionMgr != nil {
+		suresql.ConnectionMgr.ReclaimIdleConnections()
+	}
+	if !suresql.CurrentNode.IsPoolAvailable() {
+		suresql.Metrics.RecordPoolExhaustion()
+		return nil, suresql.ErrPoolExhausted
+	}
+
+	tok := createNewTokenResponse(user)
+	suresql.CurrentNode.DBConnections.Put(tok.Token, 0, newDB)
+	if suresql.ConnectionMgr != nil {
+		suresql.ConnectionMgr.TouchConnection(tok.Token)
+	}
+	suresql.Metrics.RecordConnectionCreated()
+	suresql.Metrics.RecordAuthentication(true)
+	return &tok, nil
+}
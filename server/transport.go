@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/goutil/simplelog"
+	"github.com/medatechnology/simplehttp"
+)
+
+// Transport tuning from the settings in category http. Timeouts and concurrency are passed to the
+// fiber server. Fiber (fasthttp) does not speak HTTP/2 and always keeps connections alive, so with
+// http2 on or keep_alive off a net/http front end listens on the configured address and proxies to
+// fiber on a loopback port. Loopback is then a trusted proxy, so the client IPs stay the real ones.
+
+const DEFAULT_HTTP2_MAX_STREAMS = 250
+
+type TransportConfig struct {
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	KeepAlive            bool
+	HTTP2                bool
+	MaxConcurrentStreams int
+	Concurrency          int
+}
+
+// LoadTransportConfig reads the http settings, timeouts that are not set keep the values of config
+func LoadTransportConfig(config *simplehttp.Config) TransportConfig {
+	tc := TransportConfig{KeepAlive: true, MaxConcurrentStreams: DEFAULT_HTTP2_MAX_STREAMS}
+	if config.ConfigTimeOut != nil {
+		tc.ReadTimeout = config.ConfigTimeOut.ReadTimeout
+		tc.WriteTimeout = config.ConfigTimeOut.WriteTimeout
+		tc.IdleTimeout = config.ConfigTimeOut.IdleTimeout
+	}
+	settings := suresql.CurrentNode.Settings
+	for key, d := range map[string]*time.Duration{
+		suresql.SETTING_KEY_HTTP_READ_TIMEOUT:  &tc.ReadTimeout,
+		suresql.SETTING_KEY_HTTP_WRITE_TIMEOUT: &tc.WriteTimeout,
+		suresql.SETTING_KEY_HTTP_IDLE_TIMEOUT:  &tc.IdleTimeout,
+	} {
+		if s, ok := settings.SettingExist(suresql.SETTING_CATEGORY_HTTP, key); ok && s.IntValue > 0 {
+			*d = time.Duration(s.IntValue) * time.Millisecond
+		}
+	}
+	if s, ok := settings.SettingExist(suresql.SETTING_CATEGORY_HTTP, suresql.SETTING_KEY_HTTP_KEEP_ALIVE); ok {
+		tc.KeepAlive = s.IntValue != 0
+	}
+	if s, ok := settings.SettingExist(suresql.SETTING_CATEGORY_HTTP, suresql.SETTING_KEY_HTTP_HTTP2); ok {
+		tc.HTTP2 = s.IntValue != 0
+	}
+	if s, ok := settings.SettingExist(suresql.SETTING_CATEGORY_HTTP, suresql.SETTING_KEY_HTTP_MAX_STREAMS); ok && s.IntValue > 0 {
+		tc.MaxConcurrentStreams = s.IntValue
+	}
+	if s, ok := settings.SettingExist(suresql.SETTING_CATEGORY_HTTP, suresql.SETTING_KEY_HTTP_CONCURRENCY); ok && s.IntValue > 0 {
+		tc.Concurrency = s.IntValue
+	}
+	return tc
+}
+
+// apply sets the fiber timeouts and concurrency, and when the front end is needed moves fiber to a
+// loopback port and returns the front end for the configured address (nil when it is not needed) with
+// the listener reserving that port
+func (tc TransportConfig) apply(config *simplehttp.Config, tcp bool) (*frontEnd, net.Listener, error) {
+	if config.ConfigTimeOut == nil {
+		config.ConfigTimeOut = &simplehttp.TimeOutConfig{}
+	}
+	config.ConfigTimeOut.ReadTimeout = tc.ReadTimeout
+	config.ConfigTimeOut.WriteTimeout = tc.WriteTimeout
+	config.ConfigTimeOut.IdleTimeout = tc.IdleTimeout
+	if tc.Concurrency > 0 {
+		config.Concurrency = tc.Concurrency
+	}
+	if !tc.HTTP2 && tc.KeepAlive {
+		return nil, nil, nil
+	}
+	if !tcp {
+		// only reachable through the Unix socket, there is no public listener to put in front
+		simplelog.LogFormat("transport: http2/keep_alive settings ignored, TCP is disabled")
+		return nil, nil, nil
+	}
+	reserved, port, err := reserveLoopbackPort()
+	if err != nil {
+		return nil, nil, err
+	}
+	front := &frontEnd{
+		address:  net.JoinHostPort(config.Hostname, config.Port),
+		certFile: config.TLSCert,
+		keyFile:  config.TLSKey,
+		backend:  &url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", port)},
+		config:   tc,
+	}
+	// fiber is behind the front end now, TLS ends at the front end
+	config.Hostname, config.Port = "127.0.0.1", port
+	config.TLSCert, config.TLSKey = "", ""
+	return front, reserved, nil
+}
+
+// frontEnd is the net/http server in front of fiber
+type frontEnd struct {
+	address  string
+	certFile string
+	keyFile  string
+	backend  *url.URL
+	config   TransportConfig
+	server   *http.Server
+}
+
+func (f *frontEnd) start() error {
+	proxy := httputil.NewSingleHostReverseProxy(f.backend)
+	proxy.Transport = &http.Transport{
+		Proxy:               nil, // never send the loopback hop through an outbound proxy
+		DialContext:         (&net.Dialer{Timeout: FORWARD_DIAL_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        1024,
+		MaxIdleConnsPerHost: 1024,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(f.config.HTTP2)
+	protocols.SetUnencryptedHTTP2(f.config.HTTP2 && f.certFile == "")
+	f.server = &http.Server{
+		Handler:      proxy,
+		ReadTimeout:  f.config.ReadTimeout,
+		WriteTimeout: f.config.WriteTimeout,
+		IdleTimeout:  f.config.IdleTimeout,
+		Protocols:    protocols,
+		HTTP2:        &http.HTTP2Config{MaxConcurrentStreams: f.config.MaxConcurrentStreams},
+	}
+	f.server.SetKeepAlivesEnabled(f.config.KeepAlive)
+	if f.certFile != "" {
+		// fail at start instead of in the serving goroutine, ServeTLS offers h2 by ALPN when HTTP/2 is on
+		if _, err := tls.LoadX509KeyPair(f.certFile, f.keyFile); err != nil {
+			return err
+		}
+		f.server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	l, err := net.Listen("tcp", f.address)
+	if err != nil {
+		return err
+	}
+	// every request reaches fiber from loopback now, its X-Forwarded-For is the one of the front end
+	suresql.TrustLoopbackProxy(true)
+	simplelog.LogFormat("transport: front end on %s (http2:%v keep-alive:%v) proxying to %s", f.address, f.config.HTTP2, f.config.KeepAlive, f.backend.Host)
+	go func() {
+		var err error
+		if f.certFile != "" {
+			err = f.server.ServeTLS(l, f.certFile, f.keyFile)
+		} else {
+			err = f.server.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			simplelog.LogErrorAny("transport", err, "front end stopped")
+		}
+	}()
+	return nil
+}
+
+func (f *frontEnd) shutdown(ctx context.Context) error {
+	if f.server == nil {
+		return nil
+	}
+	return f.server.Shutdown(ctx)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/medatechnology/suresql"
+
+	"github.com/medatechnology/simplehttp"
+)
+
+const WARNINGS_STRING = "warnings"
+
+// AddWarning adds a non-fatal notice to the response of the request, for middlewares and handlers
+func AddWarning(ctx simplehttp.Context, message string) {
+	if list, ok := ctx.Get(WARNINGS_STRING).(*[]string); ok && list != nil {
+		*list = append(*list, message)
+		return
+	}
+	ctx.Set(WARNINGS_STRING, &[]string{message})
+}
+
+// Warn adds a warning to the response
+func (h *HandlerState) Warn(format string, a ...interface{}) *HandlerState {
+	AddWarning(h.Context, fmt.Sprintf(format, a...))
+	return h
+}
+
+// warnings of the request, nil when there are none
+func warnings(ctx simplehttp.Context) []string {
+	if list, ok := ctx.Get(WARNINGS_STRING).(*[]string); ok && list != nil && len(*list) > 0 {
+		return *list
+	}
+	return nil
+}
+
+// warnSlowRequest warns token requests (the data API) that took longer than the slow threshold, their
+// statements go to the slow statement log of the index advisor
+func (h *HandlerState) warnSlowRequest() {
+	threshold := suresql.SlowRequestThreshold()
+	took := time.Duration(h.Duration)
+	if h.Token == nil || threshold == 0 || took < threshold {
+		return
+	}
+	suresql.RecordSlowStatements(h.Statements, took)
+	h.Warn("slow request: took %dms, the threshold is %dms", took.Milliseconds(), threshold.Milliseconds())
+}
+
+// deprecatedEndpoint wraps the handler of an endpoint that will be removed, the response gets a
+// Deprecation header and a warning with the message
+func deprecatedEndpoint(message string, next simplehttp.HandlerFunc) simplehttp.HandlerFunc {
+	return func(ctx simplehttp.Context) error {
+		ctx.SetHeader("Deprecation", "true")
+		AddWarning(ctx, "deprecated endpoint: "+message)
+		return next(ctx)
+	}
+}
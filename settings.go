@@ -0,0 +1,414 @@
+package suresql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Settings without SQL: /suresql/settings lists, saves and deletes the rows of _settings. A known key only
+// takes a value of its type and an unknown key of a known category is refused (a typo would be a setting
+// nobody reads), other categories are for plugins and need data_type. Every change is kept in
+// _settings_history with secrets masked. A change applies at once on the node that got it, the settings
+// applied at run-time (token, connection) are applied again, the other nodes read it when they restart.
+
+const (
+	SETTING_ACTION_SET    = "set"
+	SETTING_ACTION_DELETE = "delete"
+	SETTING_MASKED        = "***"
+
+	SETTING_HISTORY_LIST_LIMIT = 100
+)
+
+var (
+	ErrSettingInvalid    = medaerror.MedaError{Message: "invalid setting, category, key and a value of its type are required"}
+	ErrSettingUnknownKey = medaerror.MedaError{Message: "unknown setting key for this category"}
+	ErrSettingNotFound   = medaerror.MedaError{Message: "setting not found"}
+
+	// KnownSettings are the types of the settings read by SureSQL by category and key, a key ending or
+	// starting with * matches the keys with that suffix or prefix
+	KnownSettings = map[string]map[string]string{
+		SETTING_CATEGORY_TOKEN: {
+			SETTING_KEY_TOKEN_EXP: "int", SETTING_KEY_REFRESH_EXP: "int", SETTING_KEY_TOKEN_TTL: "int", SETTING_KEY_TOKEN_PERSIST: "bool",
+		},
+		SETTING_CATEGORY_CONNECTION: {
+			SETTING_KEY_MAX_POOL: "int", SETTING_KEY_ENABLE_POOL: "bool", SETTING_KEY_LEASE_TIMEOUT: "int",
+			SETTING_KEY_RECLAIM_PCT: "int", SETTING_KEY_MAX_INFLIGHT: "int", SETTING_KEY_MAX_ROWS: "int", SETTING_KEY_MAX_ROWS_REJECT: "bool",
+			SETTING_KEY_MAX_QUERIES: "int", SETTING_KEY_QUEUE_TIMEOUT: "int",
+		},
+		SETTING_CATEGORY_METERING: {SETTING_KEY_WEBHOOK_URL: "text"},
+		SETTING_CATEGORY_SMTP: {
+			SETTING_KEY_SMTP_HOST: "text", SETTING_KEY_SMTP_PORT: "text", SETTING_KEY_SMTP_USERNAME: "text",
+			SETTING_KEY_SMTP_PASSWORD: "text", SETTING_KEY_SMTP_FROM: "text",
+		},
+		SETTING_CATEGORY_FILES: {SETTING_KEY_FILES_STORE: "text", SETTING_KEY_FILES_DIR: "text", SETTING_KEY_FILES_MAX_SIZE: "int"},
+		SETTING_CATEGORY_HEADERS: {
+			SETTING_KEY_HEADERS_ENABLED: "bool", SETTING_KEY_HEADERS_HSTS_MAX_AGE: "int", SETTING_KEY_HEADERS_HSTS_SUBDOMAINS: "bool",
+			SETTING_KEY_HEADERS_FRAME_OPTIONS: "text", SETTING_KEY_HEADERS_REFERRER_POLICY: "text",
+			SETTING_KEY_HEADERS_CSP: "text", SETTING_KEY_HEADERS_CUSTOM: "text",
+		},
+		SETTING_CATEGORY_PROXY:    {SETTING_KEY_PROXY_TRUSTED: "text", SETTING_KEY_PROXY_OUTBOUND + "*": "text"},
+		SETTING_CATEGORY_SECURITY: {SETTING_KEY_SECURITY_SIEM_URL: "text"},
+		SETTING_CATEGORY_SIGNING:  {SETTING_KEY_SIGNING_REQUIRED: "bool", SETTING_KEY_SIGNING_MAX_SKEW: "int"},
+		SETTING_CATEGORY_CLIENT:   {SETTING_KEY_CLIENT_MIN_VERSION: "text", SETTING_KEY_CLIENT_REJECT_BELOW: "text"},
+		SETTING_CATEGORY_QUERY:    {SETTING_KEY_QUERY_SLOW_MS: "int", SETTING_KEY_QUERY_DEFAULT_LIMIT: "int", SETTING_KEY_QUERY_WORKERS: "int", SETTING_KEY_QUERY_SHARE: "bool"},
+		SETTING_CATEGORY_CACHE:    {SETTING_KEY_CACHE_TTL_MS: "int", SETTING_KEY_CACHE_MAX_ENTRIES: "int"},
+		SETTING_CATEGORY_I18N:     {SETTING_KEY_I18N_DEFAULT_LOCALE: "text"},
+		SETTING_CATEGORY_HTTP: {
+			SETTING_KEY_HTTP_READ_TIMEOUT: "int", SETTING_KEY_HTTP_WRITE_TIMEOUT: "int", SETTING_KEY_HTTP_IDLE_TIMEOUT: "int",
+			SETTING_KEY_HTTP_KEEP_ALIVE: "bool", SETTING_KEY_HTTP_HTTP2: "bool", SETTING_KEY_HTTP_MAX_STREAMS: "int",
+			SETTING_KEY_HTTP_CONCURRENCY: "int",
+		},
+		SETTING_CATEGORY_PEER:      {SETTING_KEY_PEER_MTLS: "bool", SETTING_KEY_PEER_CERT_DAYS: "int", SETTING_KEY_PEER_CA_DAYS: "int"},
+		SETTING_CATEGORY_INTEGRITY: {SETTING_KEY_INTEGRITY_VERIFY_H: "int"},
+		SETTING_CATEGORY_REPLICATION: {
+			SETTING_KEY_REPLICATION_HEARTBEAT: "int", SETTING_KEY_REPLICATION_LAG_WARN: "int", SETTING_KEY_REPLICATION_LAG_MAX: "int",
+		},
+		SETTING_CATEGORY_ROUTING:     {SETTING_KEY_ROUTING_HINTS: "text"},
+		SETTING_CATEGORY_MAINTENANCE: {"*" + SETTING_KEY_MAINTENANCE_CRON: "text", SETTING_KEY_MAINTENANCE_HISTORY: "int"},
+		SETTING_CATEGORY_DISK: {
+			SETTING_KEY_DISK_CAPACITY_MB: "int", SETTING_KEY_DISK_SAMPLE_MIN: "int", SETTING_KEY_DISK_WINDOW_HOURS: "int",
+			SETTING_KEY_DISK_WARN_DAYS: "int", SETTING_KEY_DISK_CRITICAL_DAYS: "int", SETTING_KEY_DISK_HISTORY_DAYS: "int",
+		},
+		SETTING_CATEGORY_TX: {SETTING_KEY_TX_IDLE_SEC: "int", SETTING_KEY_TX_MAX_SEC: "int", SETTING_KEY_TX_MAX_OPEN: "int"},
+		SETTING_CATEGORY_EXPERIMENT: {
+			SETTING_KEY_EXPERIMENT_SAMPLE_PCT: "int", SETTING_KEY_EXPERIMENT_MAX_INFLIGHT: "int", SETTING_KEY_EXPERIMENT_KEEP: "int",
+		},
+		SETTING_CATEGORY_SHADOW: {
+			SETTING_KEY_SHADOW_SAMPLE_PCT: "int", SETTING_KEY_SHADOW_MODE: "text", SETTING_KEY_SHADOW_REDACT: "text",
+			SETTING_KEY_SHADOW_MAX_INFLIGHT: "int",
+		},
+		SETTING_CATEGORY_SWITCHOVER: {
+			SETTING_KEY_SWITCHOVER_CHECKSUM_ROWS: "int", SETTING_KEY_SWITCHOVER_VERIFY_MAX_SEC: "int",
+		},
+		SETTING_CATEGORY_WRITE_QUEUE: {SETTING_KEY_WRITE_QUEUE_MAX_PENDING: "int", SETTING_KEY_WRITE_QUEUE_KEEP_SEC: "int"},
+		SETTING_CATEGORY_WRITE_SERIALIZER: {
+			SETTING_KEY_WRITE_SERIALIZER_ENABLED: "bool", SETTING_KEY_WRITE_SERIALIZER_FLUSH_MS: "int",
+			SETTING_KEY_WRITE_SERIALIZER_MAX_STMTS: "int",
+		},
+		SETTING_CATEGORY_COPY: {SETTING_KEY_COPY_MIN_ROWS: "int"},
+		SETTING_CATEGORY_INSERT_STREAM: {
+			SETTING_KEY_INSERT_STREAM_CHUNK: "int", SETTING_KEY_INSERT_STREAM_UPLOAD_TTL: "int",
+		},
+		SETTING_CATEGORY_CONFIG_EVENTS: {SETTING_KEY_CONFIG_EVENTS_WEBHOOK: "text"},
+		SETTING_CATEGORY_NODES:         {"*": "text"},
+		SETTING_CATEGORY_SYSTEM: {
+			SETTING_KEY_LABEL: "text", SETTING_KEY_IP: "text", SETTING_KEY_HOST: "text", SETTING_KEY_PORT: "text",
+			SETTING_KEY_SSL: "bool", SETTING_KEY_DBMS: "text", SETTING_KEY_MODE: "text", SETTING_KEY_NODES: "int",
+			SETTING_KEY_NODE_NUMBER: "int", SETTING_KEY_IS_INIT_DONE: "bool", SETTING_KEY_IS_SPLIT_WRITE: "bool",
+			SETTING_KEY_ENCRYPTION_METHOD: "text",
+		},
+	}
+)
+
+// SettingRequest is the body of POST/PUT /suresql/settings, value is a JSON number, bool or string
+type SettingRequest struct {
+	Category string      `json:"category"`
+	Key      string      `json:"key"`
+	DataType string      `json:"data_type,omitempty"`
+	Value    interface{} `json:"value"`
+}
+
+// SettingHistoryTable is a change of _settings, the values are text and secrets are masked
+type SettingHistoryTable struct {
+	ID         int       `json:"id,omitempty"         db:"id"`
+	Category   string    `json:"category"             db:"category"`
+	SettingKey string    `json:"setting_key"          db:"setting_key"`
+	Action     string    `json:"action"               db:"action"`
+	OldValue   string    `json:"old_value,omitempty"  db:"old_value"`
+	NewValue   string    `json:"new_value,omitempty"  db:"new_value"`
+	ChangedBy  string    `json:"changed_by,omitempty" db:"changed_by"`
+	ChangedAt  time.Time `json:"changed_at"           db:"changed_at"`
+}
+
+func (h SettingHistoryTable) TableName() string {
+	return "_settings_history"
+}
+
+// KnownSettingType is the type of a known key, known tells if the category is one of SureSQL
+func KnownSettingType(category, key string) (typ string, known bool) {
+	keys, known := KnownSettings[category]
+	if !known {
+		return "", false
+	}
+	if typ, ok := keys[key]; ok {
+		return typ, true
+	}
+	for k, typ := range keys {
+		if (strings.HasSuffix(k, "*") && strings.HasPrefix(key, strings.TrimSuffix(k, "*"))) ||
+			(strings.HasPrefix(k, "*") && strings.HasSuffix(key, strings.TrimPrefix(k, "*"))) {
+			return typ, true
+		}
+	}
+	return "", true
+}
+
+// settingRecord converts the value to the column of its type, the same way the migrations store settings
+func settingRecord(category, key, typ, value string) (SettingTable, error) {
+	rec := SettingTable{Category: category, SettingKey: key, DataType: typ}
+	switch typ {
+	case "int", "integer":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return rec, medaerror.Errorf("value %q is not an int", value)
+		}
+		rec.IntValue = n
+	case "bool", "boolean":
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return rec, medaerror.Errorf("value %q is not a bool", value)
+		}
+		if v {
+			rec.IntValue = 1
+		}
+	case "float", "double":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return rec, medaerror.Errorf("value %q is not a float", value)
+		}
+		rec.FloatValue = f
+	case "", "text", "string":
+		rec.DataType = "text"
+		rec.TextValue = value
+	default:
+		return rec, medaerror.Errorf("unknown type %q", typ)
+	}
+	return rec, nil
+}
+
+// settingText is the value of the setting as text for the history, secrets are masked
+func settingText(s SettingTable) string {
+	switch s.DataType {
+	case "int", "integer":
+		return strconv.Itoa(s.IntValue)
+	case "bool", "boolean":
+		return strconv.FormatBool(s.IntValue == 1)
+	case "float", "double":
+		return strconv.FormatFloat(s.FloatValue, 'f', -1, 64)
+	}
+	if s.TextValue != "" && IsSecretSetting(s.Category, s.SettingKey) {
+		return SETTING_MASKED
+	}
+	return s.TextValue
+}
+
+// ValidateSetting checks the request against the known settings and converts its value
+func ValidateSetting(r SettingRequest) (SettingTable, error) {
+	r.Category, r.Key = strings.TrimSpace(r.Category), strings.TrimSpace(r.Key)
+	if r.Category == "" || r.Key == "" || r.Value == nil {
+		return SettingTable{}, ErrSettingInvalid
+	}
+	typ, known := KnownSettingType(r.Category, r.Key)
+	switch {
+	case known && typ == "":
+		return SettingTable{}, medaerror.Errorf("%s: %s/%s", ErrSettingUnknownKey.Message, r.Category, r.Key)
+	case typ == "" && r.DataType == "":
+		return SettingTable{}, medaerror.Errorf("%s: data_type is required for %s/%s", ErrSettingInvalid.Message, r.Category, r.Key)
+	case typ == "":
+		typ = r.DataType
+	case r.DataType != "" && r.DataType != typ:
+		return SettingTable{}, medaerror.Errorf("%s: %s/%s is %s", ErrSettingInvalid.Message, r.Category, r.Key, typ)
+	}
+	var value string
+	switch v := r.Value.(type) {
+	case string:
+		value = v
+	case bool:
+		value = strconv.FormatBool(v)
+	case float64:
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return SettingTable{}, medaerror.Errorf("%s: value of %s/%s must be a number, bool or string", ErrSettingInvalid.Message, r.Category, r.Key)
+	}
+	rec, err := settingRecord(r.Category, r.Key, typ, value)
+	if err != nil {
+		return rec, medaerror.Errorf("%s: %s/%s: %v", ErrSettingInvalid.Message, r.Category, r.Key, err)
+	}
+	return rec, nil
+}
+
+// ListSettings returns the settings of the category (every category when empty), secrets are masked
+func ListSettings(category string) ([]SettingTable, error) {
+	condition := orm.Condition{OrderBy: []string{"category ASC", "setting_key ASC"}}
+	if category != "" {
+		condition.Field, condition.Operator, condition.Value = "category", "=", category
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(SettingTable{}.TableName(), &condition)
+	if err != nil && !IsNoRowsError(err) {
+		return nil, err
+	}
+	settings := make([]SettingTable, 0, len(records))
+	for _, rec := range records {
+		s := object.MapToStruct[SettingTable](rec.Data)
+		if s.TextValue != "" && IsSecretSetting(s.Category, s.SettingKey) {
+			s.TextValue = SETTING_MASKED
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+// SaveSetting creates or replaces the setting by its category and key, the change is recorded for username
+func SaveSetting(req SettingRequest, username string) (SettingTable, error) {
+	rec, err := ValidateSetting(req)
+	if err != nil {
+		return rec, err
+	}
+	old, existed := storedSetting(rec.Category, rec.SettingKey)
+	stored := rec
+	if stored.TextValue, err = SealSetting(rec.Category, rec.SettingKey, rec.TextValue); err != nil {
+		return rec, err
+	}
+	settingsTable := SettingTable{}.TableName()
+	change := SettingHistoryTable{Category: rec.Category, SettingKey: rec.SettingKey, Action: SETTING_ACTION_SET, NewValue: settingText(rec), ChangedBy: username}
+	if existed {
+		change.OldValue = settingText(old)
+	}
+	remove := orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + settingsTable + " WHERE category = ? AND setting_key = ?",
+		Values: []interface{}{rec.Category, rec.SettingKey},
+	}
+	insert := orm.ParametereizedSQL{
+		Query:  "INSERT INTO " + settingsTable + " (category, data_type, setting_key, text_value, float_value, int_value) VALUES (?, ?, ?, ?, ?, ?)",
+		Values: []interface{}{stored.Category, stored.DataType, stored.SettingKey, stored.TextValue, stored.FloatValue, stored.IntValue},
+	}
+	// without atomic batches the row is updated in place, a failure never leaves the setting deleted
+	replace := insert
+	if existed {
+		replace = orm.ParametereizedSQL{
+			Query:  "UPDATE " + settingsTable + " SET data_type = ?, text_value = ?, float_value = ?, int_value = ? WHERE category = ? AND setting_key = ?",
+			Values: []interface{}{stored.DataType, stored.TextValue, stored.FloatValue, stored.IntValue, stored.Category, stored.SettingKey},
+		}
+	}
+	err = execSettingChange([]orm.ParametereizedSQL{remove, insert, change.insert()}, []orm.ParametereizedSQL{replace, change.insert()})
+	if err != nil {
+		return rec, err
+	}
+	publishSettingChange(change, applySetting(rec.Category, rec.SettingKey, &rec))
+	if IsSecretSetting(rec.Category, rec.SettingKey) && rec.TextValue != "" {
+		rec.TextValue = SETTING_MASKED
+	}
+	return rec, nil
+}
+
+// DeleteSetting removes the setting, the code default applies again
+func DeleteSetting(category, key, username string) error {
+	old, existed := storedSetting(category, key)
+	if !existed {
+		return ErrSettingNotFound
+	}
+	change := SettingHistoryTable{Category: category, SettingKey: key, Action: SETTING_ACTION_DELETE, OldValue: settingText(old), ChangedBy: username}
+	statements := []orm.ParametereizedSQL{
+		{
+			Query:  "DELETE FROM " + SettingTable{}.TableName() + " WHERE category = ? AND setting_key = ?",
+			Values: []interface{}{category, key},
+		},
+		change.insert(),
+	}
+	if err := execSettingChange(statements, statements); err != nil {
+		return err
+	}
+	publishSettingChange(change, applySetting(category, key, nil))
+	return nil
+}
+
+// execSettingChange runs the statements of a change and its history row in one transaction (ExecAtomic).
+// On a DBMS without atomic batches fallback runs instead, one statement at a time up to the first failure,
+// so the history is only written when the setting changed.
+func execSettingChange(statements, fallback []orm.ParametereizedSQL) error {
+	db := CurrentNode.GetInternalConnection()
+	_, err := ExecAtomic(db, statements)
+	if err != ErrAtomicNotSupported {
+		return err
+	}
+	for _, statement := range fallback {
+		if res := db.ExecOneSQLParameterized(statement); res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
+
+// ListSettingsHistory returns the latest changes first, of the category when it is not empty
+func ListSettingsHistory(category string, limit int) ([]SettingHistoryTable, error) {
+	if limit <= 0 {
+		limit = SETTING_HISTORY_LIST_LIMIT
+	}
+	condition := orm.Condition{OrderBy: []string{"id DESC"}, Limit: limit}
+	if category != "" {
+		condition.Field, condition.Operator, condition.Value = "category", "=", category
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(SettingHistoryTable{}.TableName(), &condition)
+	if err != nil && !IsNoRowsError(err) {
+		return nil, err
+	}
+	changes := make([]SettingHistoryTable, 0, len(records))
+	for _, rec := range records {
+		changes = append(changes, object.MapToStructSlowDB[SettingHistoryTable](rec.Data))
+	}
+	return changes, nil
+}
+
+func (h SettingHistoryTable) insert() orm.ParametereizedSQL {
+	return orm.ParametereizedSQL{
+		Query:  "INSERT INTO " + h.TableName() + " (category, setting_key, action, old_value, new_value, changed_by, changed_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		Values: []interface{}{h.Category, h.SettingKey, h.Action, h.OldValue, h.NewValue, h.ChangedBy, time.Now().UTC()},
+	}
+}
+
+// storedSetting reads the row of the setting, secrets stay sealed (they are masked in the history)
+func storedSetting(category, key string) (SettingTable, bool) {
+	condition := orm.Condition{Nested: []orm.Condition{
+		{Field: "category", Operator: "=", Value: category},
+		{Field: "setting_key", Operator: "=", Value: key},
+	}, Logic: "AND"}
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(SettingTable{}.TableName(), &condition)
+	if err != nil {
+		return SettingTable{}, false
+	}
+	return object.MapToStruct[SettingTable](rec.Data), true
+}
+
+// applySetting swaps the settings of the node for a copy with the change (removed when rec is nil),
+// readers keep the map they have, then applies the setting if it is applied at run-time (true then)
+func applySetting(category, key string, rec *SettingTable) bool {
+	CurrentNode.mu.Lock()
+	settings := make(Settings, len(CurrentNode.Settings)+1)
+	for c, m := range CurrentNode.Settings {
+		settings[c] = m
+	}
+	m := make(SettingsMap, len(settings[category])+1)
+	for k, s := range settings[category] {
+		m[k] = s
+	}
+	if rec != nil {
+		m[key] = *rec
+	} else {
+		delete(m, key)
+	}
+	settings[category] = m
+	CurrentNode.Settings = settings
+	applied := CurrentNode.ApplySettings(category, key)
+	CurrentNode.mu.Unlock()
+	return applied
+}
+
+// publishSettingChange sends the change recorded in the history to the subscribers of ConfigEvents
+func publishSettingChange(h SettingHistoryTable, applied bool) {
+	ConfigEvents.Publish(ConfigEvent{
+		Category:   h.Category,
+		SettingKey: h.SettingKey,
+		Action:     h.Action,
+		OldValue:   h.OldValue,
+		NewValue:   h.NewValue,
+		ChangedBy:  h.ChangedBy,
+		NodeNumber: CurrentNode.Config.NodeNumber,
+		Applied:    applied,
+		ChangedAt:  time.Now().UTC(),
+	})
+}
@@ -0,0 +1,352 @@
+package suresql
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/medatechnology/goutil"
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Shadow traffic: shadow/sample_pct percent of the data API requests are sent again to a staging SureSQL
+// (SHADOW_URL), after the response and off the request path, for load tests with real traffic. In mode
+// reads only the reads go (/query, /querysql), in mode all the writes too (/sql, /insert, /update,
+// /delete), the staging node must then hold a sandbox copy. The staging node is logged in with its own
+// user (SHADOW_USERNAME), the tokens of production never leave. Before a request goes, the values of the
+// JSON keys in shadow/redact are masked: record columns, condition fields and param_sql values
+// ("values"), raw SQL statements are sent as they are. What staging answers is only counted, nothing is
+// compared.
+
+const (
+	SHADOW_ENV_PREFIX           = "SHADOW_"
+	SHADOW_MODE_READS           = "reads"
+	SHADOW_MODE_ALL             = "all"
+	SHADOW_DEFAULT_MAX_INFLIGHT = 8
+	SHADOW_REDACTED             = "***"
+
+	// headers of the data API, the same as the server package
+	shadowHeaderAPIKey   = "API_KEY"
+	shadowHeaderClientID = "CLIENT_ID"
+)
+
+var (
+	ErrShadowLogin = medaerror.MedaError{Message: "cannot log in to the shadow target"}
+
+	// the paths mirrored in each mode
+	shadowReadPaths  = []string{"/db/api/query", "/db/api/querysql", "/db/api/aggregate"}
+	shadowWritePaths = []string{"/db/api/sql", "/db/api/insert", "/db/api/upsert", "/db/api/update", "/db/api/update/batch", "/db/api/delete"}
+)
+
+// ShadowStatus is what was sent to the staging node since the start or the last reset
+type ShadowStatus struct {
+	Enabled   bool      `json:"enabled"`
+	Target    string    `json:"target,omitempty"`
+	Mode      string    `json:"mode"`
+	SamplePct int       `json:"sample_pct"`
+	Sent      int64     `json:"sent"`
+	Skipped   int64     `json:"skipped"`  // sampled but the senders were busy
+	Rejected  int64     `json:"rejected"` // answered 4xx
+	Errors    int64     `json:"errors"`   // not sent, or answered 5xx
+	AvgMs     float64   `json:"avg_ms"`
+	MaxMs     float64   `json:"max_ms"`
+	Since     time.Time `json:"since"`
+}
+
+// ShadowConfig is the staging node and the user requests are sent as
+type ShadowConfig struct {
+	URL      string
+	APIKey   string
+	ClientID string
+	Username string
+	Password string
+}
+
+// ShadowTraffic holds the staging session and the counters
+type ShadowTraffic struct {
+	mu       sync.Mutex
+	conf     ShadowConfig
+	client   *http.Client
+	tokenMu  sync.Mutex // held while logging in, apart from mu so the counters do not wait on staging
+	token    string
+	inflight int
+	status   ShadowStatus
+	totalMs  float64
+}
+
+var (
+	Shadow     *ShadowTraffic
+	shadowOnce sync.Once
+)
+
+// CurrentShadow returns the shadow traffic, set up from the environment on first use
+func CurrentShadow() *ShadowTraffic {
+	shadowOnce.Do(func() {
+		Shadow = &ShadowTraffic{conf: ShadowConfig{
+			URL:      strings.TrimRight(utils.GetEnvString(SHADOW_ENV_PREFIX+"URL", ""), "/"),
+			APIKey:   utils.GetEnvString(SHADOW_ENV_PREFIX+"API_KEY", ""),
+			ClientID: utils.GetEnvString(SHADOW_ENV_PREFIX+"CLIENT_ID", ""),
+			Username: utils.GetEnvString(SHADOW_ENV_PREFIX+"USERNAME", ""),
+			Password: utils.GetEnvString(SHADOW_ENV_PREFIX+"PASSWORD", ""),
+		}}
+		Shadow.client = IntegrationHTTPClient(INTEGRATION_SHADOW, LoadDBMSConfigFromEnvironment().HttpTimeout)
+		Shadow.status.Since = time.Now().UTC()
+	})
+	return Shadow
+}
+
+// shadowSetting reads shadow/<key>
+func shadowSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SHADOW, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// shadowMode is shadow/mode, reads unless set to all
+func shadowMode() string {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SHADOW, SETTING_KEY_SHADOW_MODE); ok && strings.EqualFold(strings.TrimSpace(s.TextValue), SHADOW_MODE_ALL) {
+		return SHADOW_MODE_ALL
+	}
+	return SHADOW_MODE_READS
+}
+
+// shadowRedactKeys are the keys of shadow/redact, lower case
+func shadowRedactKeys() map[string]bool {
+	keys := map[string]bool{}
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SHADOW, SETTING_KEY_SHADOW_REDACT); ok {
+		for _, k := range strings.Split(s.TextValue, ",") {
+			if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+				keys[k] = true
+			}
+		}
+	}
+	return keys
+}
+
+// Enabled tells if there is a staging node and a sample to send it
+func (s *ShadowTraffic) Enabled() bool {
+	return s.conf.URL != "" && shadowSetting(SETTING_KEY_SHADOW_SAMPLE_PCT, 0) > 0
+}
+
+// Mirrored tells if a request to the path is mirrored in the current mode
+func (s *ShadowTraffic) Mirrored(path string) bool {
+	path = strings.TrimRight(path, "/")
+	for _, p := range shadowReadPaths {
+		if path == p {
+			return true
+		}
+	}
+	if shadowMode() != SHADOW_MODE_ALL {
+		return false
+	}
+	for _, p := range shadowWritePaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Send mirrors the request to the staging node when it is sampled, body is the JSON body as received
+func (s *ShadowTraffic) Send(method, path, rawQuery string, body []byte) {
+	pct := shadowSetting(SETTING_KEY_SHADOW_SAMPLE_PCT, 0)
+	if s.conf.URL == "" || pct <= 0 || !s.Mirrored(path) || rand.Intn(100) >= pct {
+		return
+	}
+	s.mu.Lock()
+	if s.inflight >= shadowSetting(SETTING_KEY_SHADOW_MAX_INFLIGHT, SHADOW_DEFAULT_MAX_INFLIGHT) {
+		s.status.Skipped++
+		s.mu.Unlock()
+		return
+	}
+	s.inflight++
+	s.mu.Unlock()
+
+	// the body of the request is reused by the server, the redacted copy is made now
+	body = RedactJSON(body, shadowRedactKeys())
+	target := s.conf.URL + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.inflight--
+			s.mu.Unlock()
+		}()
+		start := time.Now()
+		code, err := s.send(method, target, body, true)
+		s.record(code, err, float64(time.Since(start).Microseconds())/1000)
+	}()
+}
+
+// send posts the request with the staging token, a 401 logs in again once
+func (s *ShadowTraffic) send(method, target string, body []byte, retry bool) (int, error) {
+	token, err := s.login(false)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	s.headers(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && retry {
+		if _, err := s.login(true); err != nil {
+			return 0, err
+		}
+		return s.send(method, target, body, false)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *ShadowTraffic) headers(req *http.Request) {
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(shadowHeaderAPIKey, s.conf.APIKey)
+	req.Header.Set(shadowHeaderClientID, s.conf.ClientID)
+}
+
+// login returns the staging token, connecting when there is none or renew is set
+func (s *ShadowTraffic) login(renew bool) (string, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if s.token != "" && !renew {
+		return s.token, nil
+	}
+	s.token = ""
+	body, _ := json.Marshal(map[string]string{"username": s.conf.Username, "password": s.conf.Password})
+	req, err := http.NewRequest(http.MethodPost, s.conf.URL+"/db/connect", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	s.headers(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&out) != nil || out.Data.Token == "" {
+		simplelog.LogFormat("shadow: cannot log in to %s as %s, status %s", s.conf.URL, s.conf.Username, resp.Status)
+		return "", ErrShadowLogin
+	}
+	s.token = out.Data.Token
+	return s.token, nil
+}
+
+func (s *ShadowTraffic) record(code int, err error, ms float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Sent++
+	switch {
+	case err != nil || code >= http.StatusInternalServerError:
+		s.status.Errors++
+		return
+	case code >= http.StatusBadRequest:
+		s.status.Rejected++
+	}
+	s.totalMs += ms
+	if ms > s.status.MaxMs {
+		s.status.MaxMs = ms
+	}
+}
+
+// Status returns the counters
+func (s *ShadowTraffic) Status() ShadowStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Enabled = s.Enabled()
+	status.Target = s.conf.URL
+	status.Mode = shadowMode()
+	status.SamplePct = shadowSetting(SETTING_KEY_SHADOW_SAMPLE_PCT, 0)
+	if answered := status.Sent - status.Errors; answered > 0 {
+		status.AvgMs = s.totalMs / float64(answered)
+	}
+	return status
+}
+
+// Reset clears the counters, ie: before a new load test
+func (s *ShadowTraffic) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = ShadowStatus{Since: time.Now().UTC()}
+	s.totalMs = 0
+}
+
+// RedactJSON masks the values of the keys (lower case) anywhere in the JSON body, and the value of a
+// condition whose field is one of them. A body that is not JSON is returned as it is.
+func RedactJSON(body []byte, keys map[string]bool) []byte {
+	if len(keys) == 0 || len(body) == 0 {
+		return append([]byte{}, body...)
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return append([]byte{}, body...)
+	}
+	out, err := json.Marshal(redactValue(v, keys))
+	if err != nil {
+		return append([]byte{}, body...)
+	}
+	return out
+}
+
+func redactValue(v interface{}, keys map[string]bool) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		field, _ := x["field"].(string)
+		for k, val := range x {
+			if keys[strings.ToLower(k)] || (k == "value" && keys[strings.ToLower(field)]) {
+				x[k] = maskValue(val)
+			} else {
+				x[k] = redactValue(val, keys)
+			}
+		}
+		return x
+	case []interface{}:
+		for i := range x {
+			x[i] = redactValue(x[i], keys)
+		}
+		return x
+	}
+	return v
+}
+
+// maskValue keeps the JSON type so the staging node gets a value of the same kind
+func maskValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		return SHADOW_REDACTED
+	case float64:
+		return 0
+	case bool:
+		return false
+	case []interface{}:
+		for i := range x {
+			x[i] = maskValue(x[i])
+		}
+		return x
+	case map[string]interface{}:
+		for k := range x {
+			x[k] = maskValue(x[k])
+		}
+		return x
+	}
+	return v
+}
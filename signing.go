@@ -0,0 +1,274 @@
+package suresql
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// HMAC request signing for machine clients. A signing key (key id + secret) belongs to a user, the client
+// signs every request with the secret:
+//
+//	signature = hex(HMAC-SHA256(secret, METHOD \n PATH \n RAW_QUERY \n TIMESTAMP \n NONCE \n hex(SHA256(body))))
+//
+// and sends the key id, the unix timestamp, a unique nonce and the signature in headers. The server
+// recomputes it, rejects timestamps outside the allowed clock skew and nonces already seen within that
+// window, so a captured request cannot be replayed, neither later nor right away. Nonces are kept in
+// _signing_nonces, which is replicated, so a replay is rejected on every node and not only the one that saw it.
+
+const (
+	DEFAULT_SIGNING_MAX_SKEW = 5 * time.Minute
+	SIGNING_KEY_CACHE_TTL    = 30 * time.Second
+	SIGNING_NONCE_MIN_LENGTH = 8
+	SIGNING_NONCE_MAX_LENGTH = 128
+	SIGNING_NONCE_TABLE      = "_signing_nonces"
+	SIGNING_NONCE_PURGE      = 10 * time.Minute
+)
+
+var (
+	ErrSignatureInvalid   = medaerror.MedaError{Message: "invalid request signature"}
+	ErrSignatureExpired   = medaerror.MedaError{Message: "request timestamp outside the allowed window"}
+	ErrSigningKeyUnknown  = medaerror.MedaError{Message: "unknown or disabled signing key"}
+	ErrSignatureMalformed = medaerror.MedaError{Message: "signature headers are incomplete"}
+	ErrNonceInvalid       = medaerror.MedaError{Message: "nonce must be 8 to 128 characters"}
+	ErrNonceReused        = medaerror.MedaError{Message: "nonce already used"}
+)
+
+// SigningKeyTable is an HMAC key of a user
+type SigningKeyTable struct {
+	ID        int       `json:"id,omitempty"         db:"id"`
+	KeyID     string    `json:"key_id"               db:"key_id"`
+	Secret    string    `json:"secret,omitempty"     db:"secret"` // only returned when the key is created
+	Username  string    `json:"username"             db:"username"`
+	Enabled   bool      `json:"enabled"              db:"enabled"`
+	CreatedAt time.Time `json:"created_at,omitempty" db:"created_at"`
+}
+
+func (s SigningKeyTable) TableName() string {
+	return "_signing_keys"
+}
+
+type signingKeyCacheEntry struct {
+	key    SigningKeyTable
+	loaded time.Time
+}
+
+var (
+	signingKeyMu    sync.Mutex
+	signingKeyCache = map[string]signingKeyCacheEntry{}
+
+	signingNoncePurgeMu   sync.Mutex
+	signingNonceLastPurge time.Time
+)
+
+// SigningCanonicalString is the string the signature is computed on
+func SigningCanonicalString(method, path, rawQuery, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.ToUpper(method) + "\n" + path + "\n" + rawQuery + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+}
+
+// SignRequest returns the hex signature of the request, for clients and tests
+func SignRequest(secret, method, path, rawQuery, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(SigningCanonicalString(method, path, rawQuery, timestamp, nonce, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SigningRequired reports whether unsigned requests to the API are rejected (setting signing/required)
+func SigningRequired() bool {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SIGNING, SETTING_KEY_SIGNING_REQUIRED); ok {
+		return tmp.IntValue != 0
+	}
+	return false
+}
+
+// SigningMaxSkew is how far the request timestamp can be from the server clock (setting signing/max_skew in seconds)
+func SigningMaxSkew() time.Duration {
+	if tmp, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SIGNING, SETTING_KEY_SIGNING_MAX_SKEW); ok && tmp.IntValue > 0 {
+		return time.Duration(tmp.IntValue) * time.Second
+	}
+	return DEFAULT_SIGNING_MAX_SKEW
+}
+
+// VerifySignature checks a signed request and returns the signing key it was signed with. The nonce is
+// only remembered once the signature is valid, so forged requests cannot burn nonces of real clients.
+func VerifySignature(keyID, timestamp, nonce, signature, method, path, rawQuery string, body []byte) (SigningKeyTable, error) {
+	if keyID == "" || timestamp == "" || signature == "" || nonce == "" {
+		return SigningKeyTable{}, ErrSignatureMalformed
+	}
+	if len(nonce) < SIGNING_NONCE_MIN_LENGTH || len(nonce) > SIGNING_NONCE_MAX_LENGTH {
+		return SigningKeyTable{}, ErrNonceInvalid
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return SigningKeyTable{}, ErrSignatureMalformed
+	}
+	skew := CurrentClock.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	maxSkew := SigningMaxSkew()
+	if skew > maxSkew {
+		return SigningKeyTable{}, ErrSignatureExpired
+	}
+
+	key, err := signingKey(keyID)
+	if err != nil {
+		return SigningKeyTable{}, err
+	}
+	expected := SignRequest(key.Secret, method, path, rawQuery, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return SigningKeyTable{}, ErrSignatureInvalid
+	}
+	// a timestamp can be up to maxSkew in the future or the past, so the nonce must be kept for both sides
+	fresh, err := useNonce(keyID, nonce, 2*maxSkew)
+	if err != nil {
+		return SigningKeyTable{}, err
+	}
+	if !fresh {
+		return SigningKeyTable{}, ErrNonceReused
+	}
+	key.Secret = ""
+	return key, nil
+}
+
+// useNonce records the nonce of the key in _signing_nonces for ttl, false when it was already used.
+// One statement inserts the row or takes over an expired one, a live row is left alone and affects
+// no rows, so two nodes racing on the same nonce cannot both accept it. MySQL has no conditional
+// ON CONFLICT, there the update keeps a live row as it is, which counts as no affected rows too.
+func useNonce(keyID, nonce string, ttl time.Duration) (bool, error) {
+	now := CurrentClock.Now().UTC()
+	query := "INSERT INTO " + SIGNING_NONCE_TABLE + " (key_id, nonce, expires_at) VALUES (?, ?, ?)"
+	if CurrentDialect().Name == DialectMySQL.Name {
+		query += " ON DUPLICATE KEY UPDATE expires_at = IF(expires_at <= ?, VALUES(expires_at), expires_at)"
+	} else {
+		query += " ON CONFLICT (key_id, nonce) DO UPDATE SET expires_at = excluded.expires_at WHERE " + SIGNING_NONCE_TABLE + ".expires_at <= ?"
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  query,
+		Values: []interface{}{keyID, nonce, now.Add(ttl), now},
+	})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	go purgeExpiredNonces()
+	return res.RowsAffected > 0, nil
+}
+
+// purgeExpiredNonces deletes the nonces no request can carry anymore, at most every SIGNING_NONCE_PURGE
+func purgeExpiredNonces() {
+	signingNoncePurgeMu.Lock()
+	if CurrentClock.Since(signingNonceLastPurge) < SIGNING_NONCE_PURGE {
+		signingNoncePurgeMu.Unlock()
+		return
+	}
+	signingNonceLastPurge = CurrentClock.Now()
+	signingNoncePurgeMu.Unlock()
+
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + SIGNING_NONCE_TABLE + " WHERE expires_at <= ?",
+		Values: []interface{}{CurrentClock.Now().UTC()},
+	})
+	if res.Error != nil {
+		simplelog.LogErrorAny("signing", res.Error, "failed to purge expired nonces")
+	}
+}
+
+// signingKey returns the enabled key by key id, cached for a short time
+func signingKey(keyID string) (SigningKeyTable, error) {
+	signingKeyMu.Lock()
+	entry, ok := signingKeyCache[keyID]
+	signingKeyMu.Unlock()
+	if ok && CurrentClock.Since(entry.loaded) < SIGNING_KEY_CACHE_TTL {
+		if !entry.key.Enabled {
+			return SigningKeyTable{}, ErrSigningKeyUnknown
+		}
+		return entry.key, nil
+	}
+
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(SigningKeyTable{}.TableName(), &orm.Condition{Field: "key_id", Operator: "=", Value: keyID})
+	var key SigningKeyTable
+	if err != nil {
+		if !IsNoRowsError(err) {
+			return SigningKeyTable{}, err
+		}
+	} else {
+		key = object.MapToStructSlowDB[SigningKeyTable](rec.Data)
+	}
+	// unknown keys are cached too (as disabled) so a flood of bad key ids does not hit the DB
+	signingKeyMu.Lock()
+	signingKeyCache[keyID] = signingKeyCacheEntry{key: key, loaded: CurrentClock.Now()}
+	signingKeyMu.Unlock()
+	if !key.Enabled {
+		return SigningKeyTable{}, ErrSigningKeyUnknown
+	}
+	return key, nil
+}
+
+// CreateSigningKey generates a key for the user, the secret is only available in the returned value
+func CreateSigningKey(username string) (SigningKeyTable, error) {
+	key := SigningKeyTable{Username: username, Enabled: true, CreatedAt: CurrentClock.Now().UTC()}
+	var err error
+	if key.KeyID, err = randomHex(12); err != nil {
+		return key, err
+	}
+	if key.Secret, err = randomHex(32); err != nil {
+		return key, err
+	}
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "INSERT INTO " + key.TableName() + " (key_id, secret, username, enabled, created_at) VALUES (?, ?, ?, ?, ?)",
+		Values: []interface{}{key.KeyID, key.Secret, key.Username, key.Enabled, key.CreatedAt},
+	})
+	key.ID = res.LastInsertID
+	return key, res.Error
+}
+
+// ListSigningKeys returns the keys without their secrets
+func ListSigningKeys() ([]SigningKeyTable, error) {
+	condition := orm.Condition{OrderBy: []string{"id ASC"}}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(SigningKeyTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []SigningKeyTable{}, nil
+		}
+		return nil, err
+	}
+	keys := make([]SigningKeyTable, 0, len(records))
+	for _, rec := range records {
+		key := object.MapToStructSlowDB[SigningKeyTable](rec.Data)
+		key.Secret = ""
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// DeleteSigningKey revokes a key
+func DeleteSigningKey(keyID string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + SigningKeyTable{}.TableName() + " WHERE key_id = ?",
+		Values: []interface{}{keyID},
+	})
+	signingKeyMu.Lock()
+	delete(signingKeyCache, keyID)
+	signingKeyMu.Unlock()
+	return res.Error
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,468 @@
+package suresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// SQLDatabase implements SureSQLDB on database/sql for the DBMSs simpleorm has no package for. The
+// driver is registered by the program (a blank import, see app/suresql/driver_*.go), the
+// differences between DBMSs are in SQLFlavor. Results have the shape of the rqlite implementation:
+// no rows is orm.ErrSQLNoRows and batches return a result per statement.
+
+var ErrSQLDriverMissing = medaerror.MedaError{Message: "database/sql driver is not registered, build with its tag"}
+
+// SQLFlavor is what differs between the database/sql backends
+type SQLFlavor struct {
+	Name       string // reported as DBMSDriver
+	Driver     string // database/sql driver name
+	BuildTag   string // tag that compiles the driver into app/suresql
+	Schema     func(db *sql.DB, hideSQL, hideSureSQL bool) []orm.SchemaStruct
+	Status     func(db *sql.DB) (orm.StatusStruct, error)
+	QueryTime  time.Duration        // timeout of every statement, 0 is none
+	Rebind     bool                 // ? placeholders become $1, $2, ... (Postgres wire protocol)
+	BatchInTx  bool                 // ExecMany runs in one transaction, retried as a whole
+	Retryable  func(err error) bool // the statement (or batch transaction) was not applied, it is run again after these errors
+	Unknown    func(err error) bool // the outcome is not known, only idempotent statements are run again, see retry_safety.go
+	MaxRetries int
+}
+
+const (
+	SQL_RETRY_BACKOFF     = 20 * time.Millisecond // doubled every attempt
+	SQL_RETRY_MAX_BACKOFF = time.Second
+)
+
+type SQLDatabase struct {
+	DB     *sql.DB
+	Flavor SQLFlavor
+	URL    string // host:port for the status, without credentials
+}
+
+// OpenSQLDatabase opens and pings the database, dsn is in the format of the driver
+func OpenSQLDatabase(flavor SQLFlavor, dsn, url string) (*SQLDatabase, error) {
+	registered := false
+	for _, d := range sql.Drivers() {
+		registered = registered || d == flavor.Driver
+	}
+	if !registered {
+		return nil, medaerror.Errorf("%s: %s (go build -tags %s)", ErrSQLDriverMissing.Message, flavor.Driver, flavor.BuildTag)
+	}
+	db, err := sql.Open(flavor.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLDatabase{DB: db, Flavor: flavor, URL: url}, nil
+}
+
+func (s *SQLDatabase) context() (context.Context, context.CancelFunc) {
+	if s.Flavor.QueryTime > 0 {
+		return context.WithTimeout(context.Background(), s.Flavor.QueryTime)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (s *SQLDatabase) Close() error {
+	return s.DB.Close()
+}
+
+func (s *SQLDatabase) IsConnected() bool {
+	return s.DB != nil
+}
+
+func (s *SQLDatabase) GetSchema(hideSQL, hideSureSQL bool) []orm.SchemaStruct {
+	return s.Flavor.Schema(s.DB, hideSQL, hideSureSQL)
+}
+
+func (s *SQLDatabase) Status() (orm.NodeStatusStruct, error) {
+	status, err := s.Flavor.Status(s.DB)
+	if err != nil {
+		return orm.NodeStatusStruct{}, err
+	}
+	status.URL = s.URL
+	status.DBMSDriver = s.Flavor.Name
+	// a single server, it is its own leader
+	status.IsLeader, status.Leader, status.Mode = true, s.URL, "rw"
+	if status.Nodes == 0 {
+		status.Nodes = 1
+	}
+	return orm.NodeStatusStruct{StatusStruct: status, Peers: map[int]orm.StatusStruct{0: status}}, nil
+}
+
+func (s *SQLDatabase) Leader() (string, error) {
+	return s.URL, nil
+}
+
+func (s *SQLDatabase) Peers() ([]string, error) {
+	return []string{s.URL}, nil
+}
+
+// sql converts the placeholders for the driver
+func (s *SQLDatabase) sql(query string) string {
+	if s.Flavor.Rebind {
+		return rebindQuery(query)
+	}
+	return query
+}
+
+// retry runs fn again while it fails with an error the flavor calls retryable, or one with an unknown
+// outcome when fn is idempotent, with a growing pause and a bit of jitter so conflicting clients do not
+// collide again
+func (s *SQLDatabase) retry(idempotent bool, fn func() error) error {
+	err := fn()
+	backoff := SQL_RETRY_BACKOFF
+	for attempt := 0; err != nil && s.retryable(err, idempotent) && attempt < s.Flavor.MaxRetries; attempt++ {
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		if backoff *= 2; backoff > SQL_RETRY_MAX_BACKOFF {
+			backoff = SQL_RETRY_MAX_BACKOFF
+		}
+		err = fn()
+	}
+	return err
+}
+
+func (s *SQLDatabase) retryable(err error, idempotent bool) bool {
+	if s.Flavor.Retryable != nil && s.Flavor.Retryable(err) {
+		return true
+	}
+	return idempotent && s.Flavor.Unknown != nil && s.Flavor.Unknown(err)
+}
+
+// query runs one statement and converts the rows, table is only the name in the records
+func (s *SQLDatabase) query(table, query string, args ...interface{}) (orm.DBRecords, error) {
+	var records orm.DBRecords
+	err := s.retry(true, func() error {
+		ctx, cancel := s.context()
+		defer cancel()
+		rows, err := s.DB.QueryContext(ctx, s.sql(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		records, err = scanSQLRows(rows, table)
+		return err
+	})
+	return records, err
+}
+
+// scanSQLRows reads all rows into records, numbers become int64/float64 and text a string
+func scanSQLRows(rows *sql.Rows, table string) (orm.DBRecords, error) {
+	set, err := scanRowSet(rows, table)
+	if err != nil {
+		return nil, err
+	}
+	return set.Records(), nil
+}
+
+// the conversions of the columns of text protocols
+const (
+	sqlKindText = iota
+	sqlKindInt
+	sqlKindFloat
+	sqlKindBlob
+)
+
+// sqlColumnKind is the conversion of a column by its type, chosen once per result
+func sqlColumnKind(dbType string) int {
+	switch t := strings.ToUpper(dbType); {
+	case strings.Contains(t, "INT") && !strings.Contains(t, "INTERVAL"):
+		return sqlKindInt
+	case strings.Contains(t, "DECIMAL"), strings.Contains(t, "NUMERIC"), strings.Contains(t, "FLOAT"),
+		strings.Contains(t, "DOUBLE"), strings.Contains(t, "REAL"):
+		return sqlKindFloat
+	case strings.Contains(t, "BLOB"), strings.Contains(t, "BINARY"):
+		return sqlKindBlob
+	}
+	return sqlKindText
+}
+
+// convertSQLValue converts what text protocols return as bytes by the column kind
+func convertSQLValue(v interface{}, kind int) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	switch kind {
+	case sqlKindInt:
+		if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			return n
+		}
+	case sqlKindFloat:
+		if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return f
+		}
+	case sqlKindBlob:
+		return b
+	}
+	return string(b)
+}
+
+func (s *SQLDatabase) exec(query string, args ...interface{}) orm.BasicSQLResult {
+	start := time.Now()
+	var result orm.BasicSQLResult
+	err := s.retry(ClassifyStatement(query).Idempotent, func() error {
+		ctx, cancel := s.context()
+		defer cancel()
+		res, err := s.DB.ExecContext(ctx, s.sql(query), args...)
+		if err == nil {
+			result = sqlResult(res, start)
+		}
+		return err
+	})
+	if err != nil {
+		return orm.BasicSQLResult{Timing: time.Since(start).Seconds(), Error: err}
+	}
+	return result
+}
+
+// execTx runs the statements in one transaction, all of them again when it has to be retried. The
+// error is the one of the statement that failed, its result carries it too.
+func (s *SQLDatabase) execTx(ps []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	var results []orm.BasicSQLResult
+	err := s.retry(batchIdempotent(ps), func() error {
+		results = make([]orm.BasicSQLResult, len(ps))
+		ctx, cancel := s.context()
+		defer cancel()
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for i, p := range ps {
+			start := time.Now()
+			res, err := tx.ExecContext(ctx, s.sql(p.Query), p.Values...)
+			if err != nil {
+				tx.Rollback()
+				results[i] = orm.BasicSQLResult{Timing: time.Since(start).Seconds(), Error: err}
+				return err
+			}
+			results[i] = sqlResult(res, start)
+		}
+		return tx.Commit()
+	})
+	return results, err
+}
+
+func sqlResult(res sql.Result, start time.Time) orm.BasicSQLResult {
+	result := orm.BasicSQLResult{Timing: time.Since(start).Seconds()}
+	if n, err := res.RowsAffected(); err == nil {
+		result.RowsAffected = int(n)
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		result.LastInsertID = int(id)
+	}
+	return result
+}
+
+func (s *SQLDatabase) SelectOne(table string) (orm.DBRecord, error) {
+	return firstRecord(s.query(table, fmt.Sprintf("SELECT * FROM %s LIMIT 1", table)))
+}
+
+func (s *SQLDatabase) SelectMany(table string) (orm.DBRecords, error) {
+	return nonEmpty(s.query(table, fmt.Sprintf("SELECT * FROM %s", table)))
+}
+
+func (s *SQLDatabase) SelectOneWithCondition(table string, condition *orm.Condition) (orm.DBRecord, error) {
+	if condition == nil {
+		return s.SelectOne(table)
+	}
+	query, args := condition.ToSelectString(table)
+	if !strings.Contains(strings.ToUpper(query), "LIMIT") {
+		query += " LIMIT 1"
+	}
+	return firstRecord(s.query(table, query, args...))
+}
+
+func (s *SQLDatabase) SelectManyWithCondition(table string, condition *orm.Condition) ([]orm.DBRecord, error) {
+	if condition == nil {
+		return s.SelectMany(table)
+	}
+	query, args := condition.ToSelectString(table)
+	return nonEmpty(s.query(table, query, args...))
+}
+
+func (s *SQLDatabase) SelectOneSQL(query string) (orm.DBRecords, error) {
+	return s.query(sqlTableName(query), query)
+}
+
+func (s *SQLDatabase) SelectManySQL(queries []string) ([]orm.DBRecords, error) {
+	results := make([]orm.DBRecords, 0, len(queries))
+	for _, q := range queries {
+		records, err := s.SelectOneSQL(q)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, records)
+	}
+	return results, nil
+}
+
+func (s *SQLDatabase) SelectOnlyOneSQL(query string) (orm.DBRecord, error) {
+	return onlyOne(s.SelectOneSQL(query))
+}
+
+func (s *SQLDatabase) SelectOneSQLParameterized(p orm.ParametereizedSQL) (orm.DBRecords, error) {
+	return s.query(sqlTableName(p.Query), p.Query, p.Values...)
+}
+
+func (s *SQLDatabase) SelectManySQLParameterized(ps []orm.ParametereizedSQL) ([]orm.DBRecords, error) {
+	results := make([]orm.DBRecords, 0, len(ps))
+	for _, p := range ps {
+		records, err := s.SelectOneSQLParameterized(p)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, records)
+	}
+	return results, nil
+}
+
+func (s *SQLDatabase) SelectOnlyOneSQLParameterized(p orm.ParametereizedSQL) (orm.DBRecord, error) {
+	return onlyOne(s.SelectOneSQLParameterized(p))
+}
+
+func (s *SQLDatabase) ExecOneSQL(query string) orm.BasicSQLResult {
+	return s.exec(query)
+}
+
+func (s *SQLDatabase) ExecOneSQLParameterized(p orm.ParametereizedSQL) orm.BasicSQLResult {
+	return s.exec(p.Query, p.Values...)
+}
+
+func (s *SQLDatabase) ExecManySQL(queries []string) ([]orm.BasicSQLResult, error) {
+	if s.Flavor.BatchInTx {
+		ps := make([]orm.ParametereizedSQL, len(queries))
+		for i, q := range queries {
+			ps[i] = orm.ParametereizedSQL{Query: q}
+		}
+		return s.execTx(ps)
+	}
+	results := make([]orm.BasicSQLResult, len(queries))
+	for i, q := range queries {
+		results[i] = s.exec(q)
+	}
+	return results, nil
+}
+
+func (s *SQLDatabase) ExecManySQLParameterized(ps []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	if s.Flavor.BatchInTx {
+		return s.execTx(ps)
+	}
+	results := make([]orm.BasicSQLResult, len(ps))
+	for i, p := range ps {
+		results[i] = s.exec(p.Query, p.Values...)
+	}
+	return results, nil
+}
+
+func (s *SQLDatabase) InsertOneDBRecord(record orm.DBRecord, queue bool) orm.BasicSQLResult {
+	query, values := record.ToInsertSQLParameterized()
+	return s.exec(query, values...)
+}
+
+func (s *SQLDatabase) InsertManyDBRecords(records []orm.DBRecord, queue bool) ([]orm.BasicSQLResult, error) {
+	return s.ExecManySQLParameterized(orm.ToInsertSQLParameterizedFromSlice(records))
+}
+
+func (s *SQLDatabase) InsertManyDBRecordsSameTable(records []orm.DBRecord, queue bool) ([]orm.BasicSQLResult, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no records to insert")
+	}
+	// ? placeholders, s.sql numbers them where the DBMS needs it
+	return s.ExecManySQLParameterized(BuildBulkInsert(Dialect{Name: s.Flavor.Name}, records, BulkInsertMaxParams(s.Flavor.Name)))
+}
+
+func (s *SQLDatabase) InsertOneTableStruct(obj orm.TableStruct, queue bool) orm.BasicSQLResult {
+	record, err := orm.TableStructToDBRecord(obj)
+	if err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return s.InsertOneDBRecord(record, queue)
+}
+
+func (s *SQLDatabase) InsertManyTableStructs(objs []orm.TableStruct, queue bool) ([]orm.BasicSQLResult, error) {
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("no objects to insert")
+	}
+	records := make([]orm.DBRecord, len(objs))
+	for i, obj := range objs {
+		record, err := orm.TableStructToDBRecord(obj)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = record
+	}
+	return s.InsertManyDBRecords(records, queue)
+}
+
+func firstRecord(records orm.DBRecords, err error) (orm.DBRecord, error) {
+	if err != nil {
+		return orm.DBRecord{}, err
+	}
+	if len(records) == 0 {
+		return orm.DBRecord{}, orm.ErrSQLNoRows
+	}
+	return records[0], nil
+}
+
+func nonEmpty(records orm.DBRecords, err error) (orm.DBRecords, error) {
+	if err == nil && len(records) == 0 {
+		return nil, orm.ErrSQLNoRows
+	}
+	return records, err
+}
+
+func onlyOne(records orm.DBRecords, err error) (orm.DBRecord, error) {
+	if err == nil && len(records) > 1 {
+		return orm.DBRecord{}, orm.ErrSQLMoreThanOneRow
+	}
+	return firstRecord(records, err)
+}
+
+// rebindQuery numbers the ? placeholders, those in quoted strings and identifiers are left alone
+func rebindQuery(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var sb strings.Builder
+	var quote rune
+	n := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// sqlTableName is the table after FROM, for the records of raw queries
+func sqlTableName(query string) string {
+	fields := strings.Fields(query)
+	for i, f := range fields {
+		if strings.EqualFold(f, "FROM") && i+1 < len(fields) {
+			return strings.Trim(fields[i+1], "`\";,()")
+		}
+	}
+	return "unknown"
+}
@@ -17,19 +17,54 @@ var (
 // This is where implementation selection happens based on DBMS configuration
 func NewDatabase(conf SureSQLDBMSConfig) (SureSQLDB, error) {
 	// Determine which database driver to use based on DBMS configuration
-	// Default to RQLite if not specified
-	dbmsType := strings.ToUpper(strings.TrimSpace(conf.DBMS))
-	if dbmsType == "" {
-		dbmsType = "RQLITE"
-	}
-
-	switch dbmsType {
+	switch dbmsType(conf) {
 	case "POSTGRESQL", "POSTGRES":
 		return newPostgreSQLDatabase(conf)
+	case "MYSQL", "MARIADB":
+		return newMySQLDatabase(conf)
+	case "COCKROACH", "COCKROACHDB":
+		return newCockroachDatabase(conf)
+	case "LIBSQL", "TURSO":
+		return newLibSQLDatabase(conf)
+	case "DUCKDB":
+		return newDuckDBDatabase(conf)
+	case "CLICKHOUSE":
+		return newClickHouseDatabase(conf)
 	case "RQLITE":
 		return newRQLiteDatabase(conf)
 	default:
-		return nil, fmt.Errorf("unsupported DBMS type: %s (supported: RQLITE, POSTGRESQL)", conf.DBMS)
+		return nil, fmt.Errorf("unsupported DBMS type: %s (supported: RQLITE, POSTGRESQL, MYSQL, MARIADB, COCKROACH, LIBSQL, DUCKDB, CLICKHOUSE)", conf.DBMS)
+	}
+}
+
+// dbmsType is the DBMS of the config in upper case, RQLite when it is not specified
+func dbmsType(conf SureSQLDBMSConfig) string {
+	dbms := strings.ToUpper(strings.TrimSpace(conf.DBMS))
+	if dbms == "" {
+		return "RQLITE"
+	}
+	return dbms
+}
+
+// backendOf returns the schema table and the driver name of the DBMS of the config. Opening a connection
+// does not change them on the node, they are set with the internal connection (SwapInternalConnection,
+// the switchover) so /connect and the alternate backends do not race with the readers.
+func backendOf(conf SureSQLDBMSConfig) (schemaTable, driver string) {
+	switch dbmsType(conf) {
+	case "POSTGRESQL", "POSTGRES":
+		return "information_schema.tables", "postgres"
+	case "MYSQL", "MARIADB":
+		return MYSQL_SCHEMA_TABLE, MySQLFlavor.Name
+	case "COCKROACH", "COCKROACHDB":
+		return "information_schema.tables", CockroachFlavor.Name
+	case "LIBSQL", "TURSO":
+		return LIBSQL_SCHEMA_TABLE, LibSQLFlavor.Name
+	case "DUCKDB":
+		return DUCKDB_SCHEMA_TABLE, DuckDBFlavor.Name
+	case "CLICKHOUSE":
+		return CLICKHOUSE_SCHEMA_TABLE, ClickHouseFlavor.Name
+	default:
+		return rqlite.SCHEMA_TABLE, "direct-rqlite"
 	}
 }
 
@@ -53,9 +88,6 @@ func newPostgreSQLDatabase(conf SureSQLDBMSConfig) (SureSQLDB, error) {
 		config.SSLMode = "require"
 	}
 
-	// PostgreSQL uses standard schema tables
-	SchemaTable = "information_schema.tables"
-	CurrentNode.Status.DBMSDriver = "postgres"
 	return postgres.NewDatabase(config)
 }
 
@@ -71,7 +103,5 @@ func newRQLiteDatabase(conf SureSQLDBMSConfig) (SureSQLDB, error) {
 		Timeout:     conf.HttpTimeout,
 		RetryCount:  conf.MaxRetries,
 	}
-	SchemaTable = rqlite.SCHEMA_TABLE
-	CurrentNode.Status.DBMSDriver = "direct-rqlite"
 	return rqlite.NewDatabase(config)
 }
@@ -0,0 +1,352 @@
+package suresql
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Blue/green switchover: the node moves to a new backend (SWITCHOVER_DBMS_*, same keys as DBMS_*) in
+// steps. Prepare opens the new backend next to the current one, verify compares them (tables, row
+// counts, and the rows of tables up to switchover/checksum_rows as a multiset), flip swaps the internal
+// connection, the config and every pooled user connection at once, the tokens stay valid. Flip needs a
+// verify that passed within switchover/verify_max_sec, stop the writes before the last verify so nothing
+// is written in between. The previous backend is kept open for rollback until the next prepare. A flip
+// applies to the node it is called on and to the running process only, set DBMS_* to the new backend
+// before the next restart.
+
+const (
+	SWITCHOVER_ENV_PREFIX            = "SWITCHOVER_DBMS_"
+	SWITCHOVER_DEFAULT_CHECKSUM_ROWS = 10000
+	SWITCHOVER_DEFAULT_VERIFY_MAX    = 300 // seconds
+
+	SWITCHOVER_IDLE     = "idle"
+	SWITCHOVER_PREPARED = "prepared"
+	SWITCHOVER_VERIFIED = "verified"
+	SWITCHOVER_SWITCHED = "switched"
+
+	// parity of a table
+	PARITY_MATCH   = "match"
+	PARITY_COUNTED = "counted" // same count, too many rows to compare them
+	PARITY_MISSING = "missing" // not on the new backend
+	PARITY_EXTRA   = "extra"   // only on the new backend
+	PARITY_COUNT   = "count"
+	PARITY_VALUES  = "values"
+	PARITY_ERROR   = "error"
+)
+
+var (
+	ErrSwitchoverNoTarget    = medaerror.MedaError{Message: "no switchover target, set SWITCHOVER_DBMS_TYPE"}
+	ErrSwitchoverNotReady    = medaerror.MedaError{Message: "switchover target is not prepared"}
+	ErrSwitchoverNotVerified = medaerror.MedaError{Message: "switchover needs a passed verify first"}
+	ErrSwitchoverNoPrevious  = medaerror.MedaError{Message: "no previous backend to roll back to"}
+)
+
+// SwitchoverTable is the parity of one table between the current and the new backend
+type SwitchoverTable struct {
+	Table      string `json:"table"`
+	Parity     string `json:"parity"`
+	SourceRows int    `json:"source_rows"`
+	TargetRows int    `json:"target_rows"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SwitchoverStatus is the step the switchover is at and the last verify
+type SwitchoverStatus struct {
+	Phase      string            `json:"phase"`
+	Source     string            `json:"source"`
+	Target     string            `json:"target,omitempty"`
+	Parity     bool              `json:"parity"`
+	VerifiedAt *time.Time        `json:"verified_at,omitempty"`
+	SwitchedAt *time.Time        `json:"switched_at,omitempty"`
+	Tables     []SwitchoverTable `json:"tables,omitempty"`
+}
+
+// switchBackend is a backend with what opening it set on the node
+type switchBackend struct {
+	conf        SureSQLDBMSConfig
+	db          SureSQLDB
+	schemaTable string
+	driver      string
+}
+
+// Switchover holds the new backend, and the previous one after a flip
+type Switchover struct {
+	mu       sync.Mutex
+	target   *switchBackend
+	previous *switchBackend
+	status   SwitchoverStatus
+}
+
+var (
+	BlueGreen     *Switchover
+	blueGreenOnce sync.Once
+)
+
+// CurrentSwitchover returns the switchover of the node
+func CurrentSwitchover() *Switchover {
+	blueGreenOnce.Do(func() {
+		BlueGreen = &Switchover{status: SwitchoverStatus{Phase: SWITCHOVER_IDLE}}
+	})
+	return BlueGreen
+}
+
+func switchoverSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_SWITCHOVER, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// backendName is the DBMS and host of a config, no credentials
+func backendName(conf SureSQLDBMSConfig) string {
+	name := strings.ToUpper(conf.DBMS) + " " + conf.Host
+	if conf.Port != "" {
+		name += ":" + conf.Port
+	}
+	if conf.Database != "" {
+		name += "/" + conf.Database
+	}
+	return name
+}
+
+// Status returns the step and the last verify
+func (s *Switchover) Status() SwitchoverStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Source = backendName(CurrentNode.GetInternalConfig())
+	status.Tables = append([]SwitchoverTable{}, s.status.Tables...)
+	return status
+}
+
+// Prepare opens the new backend from SWITCHOVER_DBMS_*, a previous backend kept for rollback is closed
+func (s *Switchover) Prepare() (SwitchoverStatus, error) {
+	conf := alternateDBMSConfig(SWITCHOVER_ENV_PREFIX)
+	if conf.DBMS == "" {
+		return s.Status(), ErrSwitchoverNoTarget
+	}
+	db, schemaTable, driver, err := openAlternate(conf)
+	if err != nil {
+		return s.Status(), err
+	}
+	s.mu.Lock()
+	closeBackend(s.target)
+	closeBackend(s.previous)
+	s.target = &switchBackend{conf: conf, db: db, schemaTable: schemaTable, driver: driver}
+	s.previous = nil
+	s.status = SwitchoverStatus{Phase: SWITCHOVER_PREPARED, Target: backendName(conf)}
+	s.mu.Unlock()
+	simplelog.LogFormat("switchover: prepared %s", backendName(conf))
+	return s.Status(), nil
+}
+
+// Verify compares the tables of the current and the new backend, the internal tables included
+func (s *Switchover) Verify() (SwitchoverStatus, error) {
+	s.mu.Lock()
+	target := s.target
+	s.mu.Unlock()
+	if target == nil {
+		return s.Status(), ErrSwitchoverNotReady
+	}
+	source := CurrentNode.GetInternalConnection()
+	maxRows := switchoverSetting(SETTING_KEY_SWITCHOVER_CHECKSUM_ROWS, SWITCHOVER_DEFAULT_CHECKSUM_ROWS)
+
+	sourceTables, targetTables := schemaTables(source), schemaTables(target.db)
+	tables := []SwitchoverTable{}
+	parity := true
+	for _, name := range sortedKeys(sourceTables) {
+		t := SwitchoverTable{Table: name}
+		if !targetTables[name] {
+			t.Parity = PARITY_MISSING
+		} else {
+			t = compareTable(source, target.db, name, maxRows)
+		}
+		parity = parity && (t.Parity == PARITY_MATCH || t.Parity == PARITY_COUNTED)
+		tables = append(tables, t)
+	}
+	for _, name := range sortedKeys(targetTables) {
+		if !sourceTables[name] {
+			tables = append(tables, SwitchoverTable{Table: name, Parity: PARITY_EXTRA})
+		}
+	}
+
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.target != target {
+		return s.status, ErrSwitchoverNotReady // prepared again meanwhile
+	}
+	s.status.Phase, s.status.Parity, s.status.VerifiedAt, s.status.Tables = SWITCHOVER_PREPARED, parity, &now, tables
+	if parity {
+		s.status.Phase = SWITCHOVER_VERIFIED
+	}
+	return s.status, nil
+}
+
+// schemaTables are the table names of the backend
+func schemaTables(db SureSQLDB) map[string]bool {
+	tables := map[string]bool{}
+	for _, s := range db.GetSchema(true, false) {
+		if s.ObjectType == "table" {
+			tables[s.TableName] = true
+		}
+	}
+	return tables
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compareTable counts the rows of the table on both backends, and compares them when there are few
+func compareTable(source, target SureSQLDB, table string, maxRows int) SwitchoverTable {
+	t := SwitchoverTable{Table: table}
+	var err error
+	if t.SourceRows, err = countRows(source, table); err == nil {
+		t.TargetRows, err = countRows(target, table)
+	}
+	switch {
+	case err != nil:
+		t.Parity, t.Error = PARITY_ERROR, err.Error()
+		return t
+	case t.SourceRows != t.TargetRows:
+		t.Parity = PARITY_COUNT
+		return t
+	case t.SourceRows > maxRows:
+		t.Parity = PARITY_COUNTED
+		return t
+	}
+	sourceRows, err := source.SelectMany(table)
+	if err != nil && !IsNoRowsError(err) {
+		t.Parity, t.Error = PARITY_ERROR, err.Error()
+		return t
+	}
+	targetRows, err := target.SelectMany(table)
+	if err != nil && !IsNoRowsError(err) {
+		t.Parity, t.Error = PARITY_ERROR, err.Error()
+		return t
+	}
+	t.Parity = PARITY_MATCH
+	if len(sourceRows) != len(targetRows) {
+		t.Parity = PARITY_COUNT
+	} else if !sameRows(sourceRows, targetRows) {
+		t.Parity = PARITY_VALUES
+	}
+	return t
+}
+
+func countRows(db SureSQLDB, table string) (int, error) {
+	rec, err := db.SelectOnlyOneSQL("SELECT COUNT(*) AS n FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := normalizeValue(rec.Data["n"]).(float64)
+	return int(n), nil
+}
+
+// Flip moves the node to the new backend. Without force it needs a verify that passed recently.
+func (s *Switchover) Flip(force bool) (SwitchoverStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.target == nil {
+		return s.status, ErrSwitchoverNotReady
+	}
+	maxAge := time.Duration(switchoverSetting(SETTING_KEY_SWITCHOVER_VERIFY_MAX_SEC, SWITCHOVER_DEFAULT_VERIFY_MAX)) * time.Second
+	if !force && (s.status.Phase != SWITCHOVER_VERIFIED || s.status.VerifiedAt == nil || time.Since(*s.status.VerifiedAt) > maxAge) {
+		return s.status, ErrSwitchoverNotVerified
+	}
+	previous, err := swapBackend(s.target)
+	if err != nil {
+		return s.status, err
+	}
+	simplelog.LogFormat("switchover: %s -> %s", backendName(previous.conf), backendName(s.target.conf))
+	now := time.Now().UTC()
+	s.previous, s.target = previous, nil
+	s.status.Phase, s.status.SwitchedAt = SWITCHOVER_SWITCHED, &now
+	return s.status, nil
+}
+
+// Rollback moves the node back to the backend it was on before the flip
+func (s *Switchover) Rollback() (SwitchoverStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.previous == nil {
+		return s.status, ErrSwitchoverNoPrevious
+	}
+	replaced, err := swapBackend(s.previous)
+	if err != nil {
+		return s.status, err
+	}
+	simplelog.LogFormat("switchover: rolled back %s -> %s", backendName(replaced.conf), backendName(s.previous.conf))
+	drainDB(replaced.db)
+	s.previous = nil
+	s.status = SwitchoverStatus{Phase: SWITCHOVER_IDLE}
+	return s.status, nil
+}
+
+// swapBackend opens a new connection on to for every pooled token first, then swaps the internal
+// connection, the config and the pool under the node lock, and returns the backend that was replaced.
+// The replaced user connections are closed CREDENTIAL_DRAIN later (credential_rotation.go) so the statements
+// running on them finish, its internal connection is kept.
+func swapBackend(to *switchBackend) (*switchBackend, error) {
+	pooled := map[string]SureSQLDB{}
+	if CurrentNode.DBConnections != nil {
+		for token := range CurrentNode.DBConnections.Map() {
+			db, _, _, err := openAlternate(to.conf)
+			if err != nil {
+				for _, opened := range pooled {
+					closeDB(opened)
+				}
+				return nil, err
+			}
+			pooled[token] = db
+		}
+	}
+
+	CurrentNode.mu.Lock()
+	replaced := &switchBackend{conf: CurrentNode.InternalConfig, db: CurrentNode.InternalConnection, schemaTable: SchemaTable, driver: CurrentNode.Status.DBMSDriver}
+	old := []SureSQLDB{}
+	for token, db := range pooled {
+		if val, ok := CurrentNode.DBConnections.Get(token); ok {
+			if conn, ok := val.(SureSQLDB); ok {
+				old = append(old, conn)
+			}
+		}
+		CurrentNode.DBConnections.Put(token, 0, db)
+	}
+	// under the node lock, readers go through GetInternalConnection
+	CurrentNode.InternalConnection, CurrentNode.InternalConfig = to.db, to.conf
+	SchemaTable, CurrentNode.Status.DBMSDriver = to.schemaTable, to.driver
+	CurrentNode.mu.Unlock()
+
+	resetRouteConnections()
+	resetCopyConnection()
+	InvalidateTableSchema("")
+	for _, db := range old {
+		drainDB(db)
+	}
+	return replaced, nil
+}
+
+func closeBackend(b *switchBackend) {
+	if b != nil {
+		closeDB(b.db)
+	}
+}
+
+// closeDB closes the connection when its driver can, best effort
+func closeDB(db SureSQLDB) {
+	if closer, ok := interface{}(db).(interface{ Close() error }); ok {
+		closer.Close()
+	}
+}
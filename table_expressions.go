@@ -0,0 +1,227 @@
+package suresql
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/object"
+)
+
+// Per-table expressions (see expression.go), kept in _table_expressions:
+//   - compute:   before insert, column = expression of the record (defaults, normalizing, derived values)
+//   - validate:  before insert, the expression must be true or the record is rejected with message
+//   - transform: on /db/api/query results, column = expression of the row (added or replaced in the response)
+// Expressions of a table run in position order, so a compute can use the column of an earlier one.
+
+const (
+	TABLE_EXPR_COMPUTE   = "compute"
+	TABLE_EXPR_VALIDATE  = "validate"
+	TABLE_EXPR_TRANSFORM = "transform"
+
+	TABLE_EXPR_CACHE_TTL = 30 * time.Second
+)
+
+var (
+	ErrTableExprInvalid  = medaerror.MedaError{Message: "invalid table expression"}
+	ErrTableExprNotFound = medaerror.MedaError{Message: "table expression not found"}
+)
+
+// TableExpressionTable is an expression attached to a table
+type TableExpressionTable struct {
+	ID         int       `json:"id,omitempty"         db:"id"`
+	TableName_ string    `json:"table_name"           db:"table_name"`
+	Kind       string    `json:"kind"                 db:"kind"`
+	Column     string    `json:"column_name"          db:"column_name"` // set by compute/transform, reported by validate
+	Expression string    `json:"expression"           db:"expression"`
+	Message    string    `json:"message,omitempty"    db:"message"` // validate error message
+	Position   int       `json:"position"             db:"position"`
+	Enabled    bool      `json:"enabled"              db:"enabled"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func (t TableExpressionTable) TableName() string {
+	return "_table_expressions"
+}
+
+// Validate checks the kind, the column and compiles the expression
+func (t TableExpressionTable) Validate() error {
+	if err := ValidateTableName(t.TableName_, false); err != nil {
+		return err
+	}
+	switch t.Kind {
+	case TABLE_EXPR_COMPUTE, TABLE_EXPR_TRANSFORM:
+		if t.Column == "" {
+			return medaerror.Errorf("%s: %s needs column_name", ErrTableExprInvalid.Message, t.Kind)
+		}
+	case TABLE_EXPR_VALIDATE:
+	default:
+		return medaerror.Errorf("%s: kind must be compute, validate or transform", ErrTableExprInvalid.Message)
+	}
+	if _, err := CompileExpression(t.Expression); err != nil {
+		return err
+	}
+	return nil
+}
+
+type tableExprCacheEntry struct {
+	exprs  []TableExpressionTable
+	loaded time.Time
+}
+
+var (
+	tableExprMu    sync.Mutex
+	tableExprCache = map[string]tableExprCacheEntry{}
+)
+
+// ListTableExpressions returns the expressions of the table, or of all tables when table is empty
+func ListTableExpressions(table string) ([]TableExpressionTable, error) {
+	condition := orm.Condition{OrderBy: []string{"table_name ASC", "position ASC", "id ASC"}}
+	if table != "" {
+		condition.Field, condition.Operator, condition.Value = "table_name", "=", table
+	}
+	records, err := CurrentNode.GetInternalConnection().SelectManyWithCondition(TableExpressionTable{}.TableName(), &condition)
+	if err != nil {
+		if IsNoRowsError(err) {
+			return []TableExpressionTable{}, nil
+		}
+		return nil, err
+	}
+	exprs := make([]TableExpressionTable, 0, len(records))
+	for _, rec := range records {
+		exprs = append(exprs, object.MapToStructSlowDB[TableExpressionTable](rec.Data))
+	}
+	return exprs, nil
+}
+
+// SaveTableExpression creates (no id) or updates the expression
+func SaveTableExpression(t TableExpressionTable) (TableExpressionTable, error) {
+	if err := t.Validate(); err != nil {
+		return t, err
+	}
+	t.UpdatedAt = time.Now().UTC()
+	var res orm.BasicSQLResult
+	if t.ID == 0 {
+		res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query:  "INSERT INTO " + t.TableName() + " (table_name, kind, column_name, expression, message, position, enabled, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			Values: []interface{}{t.TableName_, t.Kind, t.Column, t.Expression, t.Message, t.Position, t.Enabled, t.UpdatedAt},
+		})
+		t.ID = res.LastInsertID
+	} else {
+		res = CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+			Query:  "UPDATE " + t.TableName() + " SET table_name = ?, kind = ?, column_name = ?, expression = ?, message = ?, position = ?, enabled = ?, updated_at = ? WHERE id = ?",
+			Values: []interface{}{t.TableName_, t.Kind, t.Column, t.Expression, t.Message, t.Position, t.Enabled, t.UpdatedAt, t.ID},
+		})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return t, ErrTableExprNotFound
+		}
+	}
+	invalidateTableExpressions()
+	return t, res.Error
+}
+
+// DeleteTableExpression removes the expression
+func DeleteTableExpression(id int) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + TableExpressionTable{}.TableName() + " WHERE id = ?",
+		Values: []interface{}{id},
+	})
+	invalidateTableExpressions()
+	return res.Error
+}
+
+func invalidateTableExpressions() {
+	tableExprMu.Lock()
+	tableExprCache = map[string]tableExprCacheEntry{}
+	tableExprMu.Unlock()
+}
+
+// tableExpressions returns the enabled expressions of the table and kind, cached for a short time
+func tableExpressions(table, kind string) []TableExpressionTable {
+	key := strings.ToLower(table)
+	tableExprMu.Lock()
+	entry, ok := tableExprCache[key]
+	tableExprMu.Unlock()
+	if !ok || time.Since(entry.loaded) >= TABLE_EXPR_CACHE_TTL {
+		exprs, err := ListTableExpressions(table)
+		if err != nil {
+			// the table of expressions may not exist yet, nothing to apply
+			exprs = nil
+		}
+		sort.SliceStable(exprs, func(i, j int) bool { return exprs[i].Position < exprs[j].Position })
+		entry = tableExprCacheEntry{exprs: exprs, loaded: time.Now()}
+		tableExprMu.Lock()
+		tableExprCache[key] = entry
+		tableExprMu.Unlock()
+	}
+	var result []TableExpressionTable
+	for _, e := range entry.exprs {
+		if e.Enabled && e.Kind == kind {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// ApplyInsertExpressions runs the compute expressions on the records (changing them) and then the
+// validate expressions, returning the records that failed
+func ApplyInsertExpressions(records []orm.DBRecord) []RecordFieldError {
+	var errs []RecordFieldError
+	for i := range records {
+		rec := &records[i]
+		if rec.Data == nil {
+			continue
+		}
+		for _, t := range tableExpressions(rec.TableName, TABLE_EXPR_COMPUTE) {
+			value, err := EvalExpression(t.Expression, rec.Data)
+			if err != nil {
+				errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Field: t.Column, Message: err.Error()})
+				continue
+			}
+			rec.Data[t.Column] = value
+		}
+		for _, t := range tableExpressions(rec.TableName, TABLE_EXPR_VALIDATE) {
+			expr, err := CompileExpression(t.Expression)
+			ok := false
+			if err == nil {
+				ok, err = expr.EvalBool(rec.Data)
+			}
+			if err != nil || !ok {
+				msg := t.Message
+				if msg == "" {
+					msg = "must satisfy: " + t.Expression
+				}
+				if err != nil {
+					msg = err.Error()
+				}
+				errs = append(errs, RecordFieldError{Record: i, Table: rec.TableName, Field: t.Column, Message: msg})
+			}
+		}
+	}
+	return errs
+}
+
+// ApplyTransformExpressions sets the transform columns of the rows read from table, a row where the
+// expression fails (ie: division by zero) gets null
+func ApplyTransformExpressions(table string, records []orm.DBRecord) {
+	exprs := tableExpressions(table, TABLE_EXPR_TRANSFORM)
+	if len(exprs) == 0 {
+		return
+	}
+	for i := range records {
+		if records[i].Data == nil {
+			continue
+		}
+		for _, t := range exprs {
+			value, err := EvalExpression(t.Expression, records[i].Data)
+			if err != nil {
+				value = nil
+			}
+			records[i].Data[t.Column] = value
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package suresql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/object"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Token persistence (setting token/persist): issued tokens are also written to _tokens, only as SHA-256
+// hashes, and a token that is not in memory (ie: after a restart) is looked up there on validation.
+// Clients keep working across deploys instead of all calling /connect at once.
+
+const TOKEN_PURGE_INTERVAL = 10 * time.Minute
+
+var (
+	tokenPurgeMu   sync.Mutex
+	tokenLastPurge time.Time
+)
+
+// TokenPersistenceEnabled reads the setting token/persist
+func TokenPersistenceEnabled() bool {
+	s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_TOKEN, SETTING_KEY_TOKEN_PERSIST)
+	return ok && s.IntValue != 0
+}
+
+// HashToken is how tokens are stored, never in plain text
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// PersistToken saves the hashes of the access and refresh token with their expiry and owner
+func PersistToken(tok TokenTable) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query: "INSERT INTO " + tok.TableName() + " (user_id, username, tenant, token, refresh, token_expired_at, refresh_expired_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		Values: []interface{}{tok.UserID, tok.UserName, tok.Tenant, HashToken(tok.Token), HashToken(tok.Refresh),
+			tok.TokenExpiresAt.UTC(), tok.RefreshExpiresAt.UTC(), CurrentClock.Now().UTC()},
+	})
+	go purgeExpiredTokens()
+	return res.Error
+}
+
+// LoadPersistedToken finds an unexpired access token, the refresh token of the result is empty
+func LoadPersistedToken(token string) (TokenTable, bool) {
+	tok, ok := loadPersisted("token", token, "token_expired_at")
+	if ok {
+		tok.Token, tok.Refresh = token, ""
+	}
+	return tok, ok
+}
+
+// LoadPersistedRefresh finds an unexpired refresh token, the access token of the result is empty
+func LoadPersistedRefresh(refresh string) (TokenTable, bool) {
+	tok, ok := loadPersisted("refresh", refresh, "refresh_expired_at")
+	if ok {
+		tok.Token, tok.Refresh = "", refresh
+	}
+	return tok, ok
+}
+
+func loadPersisted(column, value, expiryColumn string) (TokenTable, bool) {
+	condition := orm.Condition{
+		Logic: "AND",
+		Nested: []orm.Condition{
+			{Field: column, Operator: "=", Value: HashToken(value)},
+			{Field: expiryColumn, Operator: ">", Value: CurrentClock.Now().UTC()},
+		},
+	}
+	rec, err := CurrentNode.GetInternalConnection().SelectOneWithCondition(TokenTable{}.TableName(), &condition)
+	if err != nil {
+		if !IsNoRowsError(err) {
+			simplelog.LogErrorAny("token", err, "failed to load persisted token")
+		}
+		return TokenTable{}, false
+	}
+	row := object.MapToStructSlowDB[persistedToken](rec.Data)
+	return TokenTable{
+		UserID:           row.UserID,
+		UserName:         row.Username,
+		Tenant:           row.Tenant,
+		TokenExpiresAt:   row.TokenExpiresAt,
+		RefreshExpiresAt: row.RefreshExpiresAt,
+		CreatedAt:        row.CreatedAt,
+	}, true
+}
+
+// persistedToken is a row of _tokens, the token columns hold hashes
+type persistedToken struct {
+	UserID           string    `db:"user_id"`
+	Username         string    `db:"username"`
+	Tenant           string    `db:"tenant"`
+	TokenExpiresAt   time.Time `db:"token_expired_at"`
+	RefreshExpiresAt time.Time `db:"refresh_expired_at"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+// DeletePersistedRefresh removes the row of a refresh token once it was exchanged
+func DeletePersistedRefresh(refresh string) error {
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + TokenTable{}.TableName() + " WHERE refresh = ?",
+		Values: []interface{}{HashToken(refresh)},
+	})
+	return res.Error
+}
+
+// purgeExpiredTokens deletes the rows whose refresh token expired, at most every TOKEN_PURGE_INTERVAL
+func purgeExpiredTokens() {
+	tokenPurgeMu.Lock()
+	if CurrentClock.Since(tokenLastPurge) < TOKEN_PURGE_INTERVAL {
+		tokenPurgeMu.Unlock()
+		return
+	}
+	tokenLastPurge = CurrentClock.Now()
+	tokenPurgeMu.Unlock()
+
+	res := CurrentNode.GetInternalConnection().ExecOneSQLParameterized(orm.ParametereizedSQL{
+		Query:  "DELETE FROM " + TokenTable{}.TableName() + " WHERE refresh_expired_at <= ?",
+		Values: []interface{}{CurrentClock.Now().UTC()},
+	})
+	if res.Error != nil {
+		simplelog.LogErrorAny("token", res.Error, "failed to purge expired tokens")
+	}
+}
@@ -0,0 +1,193 @@
+package suresql
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Interactive transactions: a transaction holds a connection of its own between requests, so a client
+// can read, decide and write in one transaction. Only the database/sql backends (MySQL, CockroachDB,
+// libSQL, DuckDB) can: rqlite runs every request on its own, the Postgres package has no transactions
+// and ClickHouse has none at all. A transaction idle for tx/idle_sec or open for tx/max_sec is rolled back.
+
+const (
+	TX_DEFAULT_IDLE_SEC = 30
+	TX_DEFAULT_MAX_SEC  = 300
+	TX_DEFAULT_MAX_OPEN = 20
+)
+
+var (
+	ErrTxNotSupported = medaerror.MedaError{Message: "interactive transactions are not supported by this DBMS"}
+	ErrTxNotFound     = medaerror.MedaError{Message: "transaction not found, it was committed, rolled back or expired"}
+	ErrTxLimit        = medaerror.MedaError{Message: "too many open transactions, retry later"}
+)
+
+var txReturningRegex = regexp.MustCompile(`\bRETURNING\b`)
+
+// TxRequest is the body of /db/api/tx/exec, /tx/commit and /tx/rollback, only exec has statements
+type TxRequest struct {
+	Tx         string                  `json:"tx"`                   // token returned by /tx/begin
+	Statements []string                `json:"statements,omitempty"` // Raw SQL statements to run in order
+	ParamSQL   []orm.ParametereizedSQL `json:"param_sql,omitempty"`  // Parameterized SQL statements, after the raw ones
+}
+
+// TxBeginResponse is the transaction opened by /db/api/tx/begin
+type TxBeginResponse struct {
+	Tx        string    `json:"tx"`
+	IdleSec   int       `json:"idle_sec"`   // rolled back when no statement comes for this long
+	ExpiresAt time.Time `json:"expires_at"` // rolled back at this time if still open
+}
+
+// TxResult is the outcome of one statement, reads return their rows
+type TxResult struct {
+	Records      []orm.DBRecord `json:"records,omitempty"`
+	RowsAffected int            `json:"rows_affected,omitempty"`
+	LastInsertID int            `json:"last_insert_id,omitempty"`
+	Timing       float64        `json:"timing"`
+}
+
+// TxExecResponse is the response of /db/api/tx/exec
+type TxExecResponse struct {
+	Results       []TxResult `json:"results"`
+	ExecutionTime float64    `json:"execution_time"`
+	RowsAffected  int        `json:"rows_affected"`
+}
+
+// TxSettings are the limits of the interactive transactions (settings tx/...)
+func TxSettings() (idle, max time.Duration, maxOpen int) {
+	idle, max, maxOpen = TX_DEFAULT_IDLE_SEC*time.Second, TX_DEFAULT_MAX_SEC*time.Second, TX_DEFAULT_MAX_OPEN
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_TX, SETTING_KEY_TX_IDLE_SEC); ok && s.IntValue > 0 {
+		idle = time.Duration(s.IntValue) * time.Second
+	}
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_TX, SETTING_KEY_TX_MAX_SEC); ok && s.IntValue > 0 {
+		max = time.Duration(s.IntValue) * time.Second
+	}
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_TX, SETTING_KEY_TX_MAX_OPEN); ok {
+		maxOpen = s.IntValue
+	}
+	return idle, max, maxOpen
+}
+
+// SQLTx is an open transaction on a connection taken out of the pool, statements run one at a time
+type SQLTx struct {
+	mu     sync.Mutex
+	db     *SQLDatabase
+	conn   *sql.Conn
+	tx     *sql.Tx
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   bool
+}
+
+// BeginInteractiveTx takes a connection of db and begins a transaction on it, rolled back by the
+// database/sql package at the latest after lifetime on CurrentClock
+func BeginInteractiveTx(db SureSQLDB, lifetime time.Duration) (*SQLTx, error) {
+	if f, ok := db.(faultyDB); ok {
+		db = f.SureSQLDB
+	}
+	sqlDB, ok := db.(*SQLDatabase)
+	if !ok {
+		return nil, ErrTxNotSupported
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-CurrentClock.After(lifetime):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	conn, err := sqlDB.DB.Conn(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		conn.Close()
+		cancel()
+		return nil, err
+	}
+	return &SQLTx{db: sqlDB, conn: conn, tx: tx, ctx: ctx, cancel: cancel}, nil
+}
+
+// isTxReadStatement tells if the statement returns rows, reads and writes with RETURNING
+func isTxReadStatement(query string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(query))
+	return isReadStatement(upper) || strings.HasPrefix(upper, "SHOW") || strings.HasPrefix(upper, "EXPLAIN") ||
+		strings.HasPrefix(upper, "PRAGMA") || strings.HasPrefix(upper, "VALUES") || txReturningRegex.MatchString(upper)
+}
+
+// Run runs one statement in the transaction with the statement timeout of the DBMS
+func (t *SQLTx) Run(p orm.ParametereizedSQL) (TxResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done || t.ctx.Err() != nil {
+		return TxResult{}, ErrTxNotFound
+	}
+	ctx, cancel := t.ctx, context.CancelFunc(func() {})
+	if t.db.Flavor.QueryTime > 0 {
+		ctx, cancel = context.WithTimeout(t.ctx, t.db.Flavor.QueryTime)
+	}
+	defer cancel()
+
+	start := time.Now()
+	if isTxReadStatement(p.Query) {
+		rows, err := t.tx.QueryContext(ctx, t.db.sql(p.Query), p.Values...)
+		if err != nil {
+			return TxResult{}, err
+		}
+		defer rows.Close()
+		records, err := scanSQLRows(rows, sqlTableName(p.Query))
+		if err != nil {
+			return TxResult{}, err
+		}
+		return TxResult{Records: records, Timing: time.Since(start).Seconds()}, nil
+	}
+	res, err := t.tx.ExecContext(ctx, t.db.sql(p.Query), p.Values...)
+	if err != nil {
+		return TxResult{}, err
+	}
+	r := sqlResult(res, start)
+	return TxResult{RowsAffected: r.RowsAffected, LastInsertID: r.LastInsertID, Timing: r.Timing}, nil
+}
+
+// Commit commits and gives the connection back to the pool
+func (t *SQLTx) Commit() error {
+	return t.end(true)
+}
+
+// Rollback rolls back and gives the connection back to the pool, it is safe to call more than once: a
+// transaction that already ended is left as it is
+func (t *SQLTx) Rollback() error {
+	return t.end(false)
+}
+
+func (t *SQLTx) end(commit bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		if !commit {
+			return nil
+		}
+		return ErrTxNotFound
+	}
+	t.done = true
+	defer t.cancel()
+	defer t.conn.Close()
+	if t.ctx.Err() != nil {
+		return ErrTxNotFound
+	}
+	if commit {
+		return t.tx.Commit()
+	}
+	return t.tx.Rollback()
+}
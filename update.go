@@ -0,0 +1,87 @@
+package suresql
+
+import (
+	"context"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Updates without SQL: /db/api/update sets columns of the rows of a table matching an orm.Condition, the
+// statement is rendered by the query builder like the selects of /db/api/query. An update without a
+// condition would change the whole table, it needs all_rows. Rows of integrity tables get their checksum
+// written again, for the rows that matched before the update.
+
+var ErrUpdateNoCondition = medaerror.MedaError{Message: "update without a condition changes every row, set all_rows to do that"}
+
+// BuildUpdateRequest checks the request and renders its statement in the dialect of the node
+func BuildUpdateRequest(req UpdateRequest) (orm.ParametereizedSQL, error) {
+	if err := ValidateTableName(req.Table, false); err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	paramSQL, err := BuildUpdate(CurrentDialect(), req.Table, req.Values, req.Condition)
+	if err != nil {
+		return orm.ParametereizedSQL{}, err
+	}
+	if !req.AllRows && !conditionFilters(req.Condition) {
+		return orm.ParametereizedSQL{}, ErrUpdateNoCondition
+	}
+	return paramSQL, nil
+}
+
+// conditionFilters tells if the condition renders a WHERE, nested conditions may all be empty
+func conditionFilters(c *orm.Condition) bool {
+	where, err := NewQueryBuilder(CurrentDialect()).Where(c)
+	return err == nil && where != ""
+}
+
+// UpdateRows runs the update of the request on db and rehashes the rows it changed in integrity tables
+func UpdateRows(db SureSQLDB, req UpdateRequest, paramSQL orm.ParametereizedSQL) (orm.BasicSQLResult, error) {
+	t, checksummed := integrityTable(req.Table)
+	var keys []interface{}
+	if checksummed {
+		var err error
+		if keys, err = updatedKeys(db, t, req); err != nil {
+			return orm.BasicSQLResult{}, err
+		}
+	}
+	result := db.ExecOneSQLParameterized(paramSQL)
+	if result.Error != nil {
+		return result, result.Error
+	}
+	if checksummed && len(keys) > 0 {
+		if _, err := RehashIntegrity(context.Background(), req.Table, keys); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// updatedKeys are the keys of the rows the update changes, the new key when it sets the key column
+func updatedKeys(db SureSQLDB, t IntegrityTable, req UpdateRequest) ([]interface{}, error) {
+	for column, v := range req.Values {
+		if strings.EqualFold(column, t.KeyColumn) {
+			return []interface{}{v}, nil
+		}
+	}
+	b := NewQueryBuilder(CurrentDialect())
+	query := "SELECT " + t.KeyColumn + " FROM " + req.Table
+	where, err := b.Where(req.Condition)
+	if err != nil {
+		return nil, err
+	}
+	if where != "" {
+		query += " WHERE " + where
+	}
+	records, err := db.SelectOneSQLParameterized(orm.ParametereizedSQL{Query: query, Values: b.Args()})
+	if err != nil && err != orm.ErrSQLNoRows {
+		return nil, err
+	}
+	keys := make([]interface{}, 0, len(records))
+	for _, rec := range records {
+		keys = append(keys, rec.Data[t.KeyColumn])
+	}
+	return keys, nil
+}
@@ -0,0 +1,87 @@
+package suresql
+
+import (
+	"context"
+	"strings"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Upserts without SQL: /db/api/upsert inserts records and resolves a conflict on the conflict columns
+// (a unique or primary key) by the strategy, rendered by the query builder with the syntax of the DBMS:
+// ON CONFLICT on SQLite (rqlite) and PostgreSQL, ON DUPLICATE KEY UPDATE and REPLACE INTO on MySQL.
+// ClickHouse tables are append-only, upserts are refused there. Rows of integrity tables get their
+// checksum written again, for the keys in the records.
+
+const (
+	UPSERT_IGNORE  = "ignore"  // a conflicting record is skipped, the row stays as it is
+	UPSERT_UPDATE  = "update"  // the update columns of the row are set from the record
+	UPSERT_REPLACE = "replace" // the row is replaced by the record
+)
+
+var ErrUpsertTables = medaerror.MedaError{Message: "upsert records must all be of one table"}
+
+// BuildUpsertRequest checks the request and renders the statement of every record in the dialect of the node
+func BuildUpsertRequest(req UpsertRequest) ([]orm.ParametereizedSQL, error) {
+	if len(req.Records) == 0 {
+		return nil, medaerror.NewString("no records provided")
+	}
+	table := req.Records[0].TableName
+	if err := ValidateTableName(table, false); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(strings.TrimSpace(CurrentNode.GetInternalConfig().DBMS), "CLICKHOUSE") {
+		return nil, ErrClickHouseAppendOnly
+	}
+	strategy := req.Strategy
+	if strategy == "" {
+		strategy = UPSERT_UPDATE
+	}
+	statements := make([]orm.ParametereizedSQL, 0, len(req.Records))
+	for _, rec := range req.Records {
+		if rec.TableName != table {
+			return nil, ErrUpsertTables
+		}
+		paramSQL, err := BuildUpsert(CurrentDialect(), rec, req.ConflictColumns, strategy, req.UpdateColumns)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, paramSQL)
+	}
+	return statements, nil
+}
+
+// UpsertRecords runs the statements of the request on db and rehashes the rows of integrity tables
+func UpsertRecords(db SureSQLDB, req UpsertRequest, statements []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	var results []orm.BasicSQLResult
+	if len(statements) == 1 {
+		result := db.ExecOneSQLParameterized(statements[0])
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		results = []orm.BasicSQLResult{result}
+	} else {
+		var err error
+		if results, err = db.ExecManySQLParameterized(statements); err != nil {
+			return results, err
+		}
+	}
+	table := req.Records[0].TableName
+	if t, checksummed := integrityTable(table); checksummed {
+		// an update leaves the columns that are not in the record, the checksum is computed from the row
+		keys := make([]interface{}, 0, len(req.Records))
+		for _, rec := range req.Records {
+			if key, ok := rec.Data[t.KeyColumn]; ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			if _, err := RehashIntegrity(context.Background(), table, keys); err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,27 @@
+package suresql
+
+import "time"
+
+const (
+	DEFAULT_SLOW_REQUEST = 1000 * time.Millisecond
+)
+
+// SlowRequestThreshold is the duration after which a response warns that the request was slow
+// (setting query/slow_ms), 0 disables it
+func SlowRequestThreshold() time.Duration {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_QUERY, SETTING_KEY_QUERY_SLOW_MS); ok {
+		if s.IntValue <= 0 {
+			return 0
+		}
+		return time.Duration(s.IntValue) * time.Millisecond
+	}
+	return DEFAULT_SLOW_REQUEST
+}
+
+// DefaultQueryLimit is the row limit of queries that do not set one (setting query/default_limit), 0 is none
+func DefaultQueryLimit() int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_QUERY, SETTING_KEY_QUERY_DEFAULT_LIMIT); ok && s.IntValue > 0 {
+		return s.IntValue
+	}
+	return 0
+}
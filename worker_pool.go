@@ -0,0 +1,146 @@
+package suresql
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Parallel statements: the independent statements of a request with parallel run at once. The goroutine of
+// the request takes statements too, the other workers come from the node wide query/workers slots, so all
+// parallel requests together never start more goroutines than that and a request never waits for a slot,
+// with none free it runs its statements one by one. Statements are numbered over the raw
+// statements then the parameterized ones, like atomic batches, a failed one does not stop the others.
+
+const (
+	DEFAULT_QUERY_WORKERS = 8
+	MAX_QUERY_WORKERS     = 256
+)
+
+// WorkerPool lends workers up to the query/workers setting
+type WorkerPool struct {
+	mu   sync.Mutex
+	busy int
+}
+
+var StatementWorkers = &WorkerPool{}
+
+// QueryWorkers reads query/workers
+func QueryWorkers() int {
+	n := DEFAULT_QUERY_WORKERS
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_QUERY, SETTING_KEY_QUERY_WORKERS); ok && s.IntValue > 0 {
+		n = s.IntValue
+	}
+	if n > MAX_QUERY_WORKERS {
+		n = MAX_QUERY_WORKERS
+	}
+	return n
+}
+
+// Run calls fn for 0 to n-1, on the calling goroutine and the workers free in the pool, and returns when all
+// calls returned. fn writes its result at its index, so the results keep the order of the statements.
+func (p *WorkerPool) Run(n int, fn func(i int)) {
+	var next atomic.Int64
+	work := func() {
+		for {
+			i := int(next.Add(1) - 1)
+			if i >= n {
+				return
+			}
+			fn(i)
+		}
+	}
+	var wg sync.WaitGroup
+	for extra := 1; extra < n && p.acquire(); extra++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer p.release()
+			work()
+		}()
+	}
+	work()
+	wg.Wait()
+}
+
+// Busy is the number of workers lent
+func (p *WorkerPool) Busy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.busy
+}
+
+func (p *WorkerPool) acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.busy >= QueryWorkers() {
+		return false
+	}
+	p.busy++
+	return true
+}
+
+func (p *WorkerPool) release() {
+	p.mu.Lock()
+	p.busy--
+	p.mu.Unlock()
+}
+
+// parallelError is the error of the failed statement i (from 0) of n, the first one in request order
+func parallelError(i, n int, err error) error {
+	e := medaerror.Errorf("statement %d of %d failed: %s", i+1, n, err.Error())
+	e.Data = AtomicFailure{Statement: i + 1, Error: err.Error()}
+	e.Err = err
+	return e
+}
+
+// ExecParallel runs the raw statements then the parameterized ones on the worker pool. All results are
+// returned in request order, with the error of the first failed statement.
+func ExecParallel(db SureSQLDB, statements []string, ps []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	n := len(statements) + len(ps)
+	results := make([]orm.BasicSQLResult, n)
+	StatementWorkers.Run(n, func(i int) {
+		if i < len(statements) {
+			results[i] = db.ExecOneSQL(statements[i])
+		} else {
+			results[i] = db.ExecOneSQLParameterized(ps[i-len(statements)])
+		}
+	})
+	for i, r := range results {
+		if r.Error != nil {
+			return results, parallelError(i, n, r.Error)
+		}
+	}
+	return results, nil
+}
+
+// SelectParallel runs the raw selects then the parameterized ones on the worker pool. The records and the
+// milliseconds of every select are in request order, a select without rows has no records.
+func SelectParallel(db SureSQLDB, statements []string, ps []orm.ParametereizedSQL) ([][]orm.DBRecord, []float64, error) {
+	n := len(statements) + len(ps)
+	records := make([][]orm.DBRecord, n)
+	times := make([]float64, n)
+	errs := make([]error, n)
+	StatementWorkers.Run(n, func(i int) {
+		start := time.Now()
+		if i < len(statements) {
+			records[i], errs[i] = SelectStatement(db, orm.ParametereizedSQL{Query: statements[i]}, true)
+		} else {
+			records[i], errs[i] = SelectStatement(db, ps[i-len(statements)], false)
+		}
+		times[i] = float64(time.Since(start).Microseconds()) / 1000
+		if errs[i] == orm.ErrSQLNoRows {
+			records[i], errs[i] = []orm.DBRecord{}, nil
+		}
+	})
+	for i, err := range errs {
+		if err != nil {
+			return nil, nil, parallelError(i, n, err)
+		}
+	}
+	return records, times, nil
+}
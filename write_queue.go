@@ -0,0 +1,310 @@
+package suresql
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+
+	"github.com/medatechnology/goutil/medaerror"
+	"github.com/medatechnology/goutil/simplelog"
+)
+
+// Queued writes: an insert with queue: true is answered at once with a sequence number and written in
+// the background, in the order the node got them. The orm package ignores its own queue flag, the queue
+// is kept here so it works the same on every DBMS. GET /db/api/queue?sequence=N tells if the write is
+// queued, done (committed by the DBMS) or failed, with wait= it blocks until then. The outcome is kept
+// for write_queue/keep_sec, a failed write goes to the dead letters. The sequence is of the node that
+// queued it, at most write_queue/max_pending records wait at once. The queue lives in memory, what is
+// still queued when the process dies is lost, poll for done before relying on a write.
+
+const (
+	WRITE_QUEUE_DEFAULT_MAX_PENDING = 10000 // records
+	WRITE_QUEUE_DEFAULT_KEEP_SEC    = 3600
+	WRITE_QUEUE_MAX_WAIT            = 30 * time.Second
+
+	QUEUED_WRITE_QUEUED = "queued"
+	QUEUED_WRITE_DONE   = "done"
+	QUEUED_WRITE_FAILED = "failed"
+)
+
+var (
+	ErrWriteQueueFull     = medaerror.MedaError{Message: "write queue is full, retry later or insert without queue"}
+	ErrQueuedWriteUnknown = medaerror.MedaError{Message: "queued write not found, it may be of another node or expired"}
+)
+
+// QueuedWrite is one queued insert request and its outcome
+type QueuedWrite struct {
+	Sequence     int64                `json:"sequence"`
+	Status       string               `json:"status"`
+	Records      int                  `json:"records"`
+	RowsAffected int                  `json:"rows_affected"`
+	Results      []orm.BasicSQLResult `json:"results,omitempty"`
+	Error        string               `json:"error,omitempty"`
+	DeadLetterID int                  `json:"dead_letter_id,omitempty"`
+	QueuedAt     time.Time            `json:"queued_at"`
+	DoneAt       *time.Time           `json:"done_at,omitempty"`
+}
+
+// WriteQueueStatus is the state of the queue of the node
+type WriteQueueStatus struct {
+	Pending         int        `json:"pending"`         // requests not written yet
+	PendingRecords  int        `json:"pending_records"` // records in them
+	LastSequence    int64      `json:"last_sequence"`   // last given out
+	LastDone        int64      `json:"last_done"`       // every sequence up to this one is written or failed
+	Failed          int64      `json:"failed"`
+	OldestPendingAt *time.Time `json:"oldest_pending_at,omitempty"`
+}
+
+// queuedInsert is a queued request with what is needed to write it
+type queuedInsert struct {
+	write     QueuedWrite
+	username  string
+	db        SureSQLDB
+	records   []orm.DBRecord
+	sameTable bool
+	onDone    func(QueuedWrite)
+	done      chan struct{}
+}
+
+// WriteQueue writes the queued inserts one request at a time
+type WriteQueue struct {
+	mu       sync.Mutex
+	pending  []*queuedInsert
+	records  int
+	sequence int64
+	lastDone int64
+	failed   int64
+	outcomes map[int64]*queuedInsert
+	wake     chan struct{}
+	ticker   Ticker
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	cancel   context.CancelFunc
+}
+
+var (
+	WriteQ             *WriteQueue
+	writeQueueInitOnce sync.Once
+)
+
+// InitWriteQueue initializes the global write queue
+func InitWriteQueue() {
+	writeQueueInitOnce.Do(func() {
+		WriteQ = &WriteQueue{
+			outcomes: map[int64]*queuedInsert{},
+			wake:     make(chan struct{}, 1),
+			stopChan: make(chan struct{}),
+		}
+	})
+}
+
+// StartWriteQueue starts writing the queued inserts
+func StartWriteQueue(ctx context.Context) {
+	if WriteQ == nil {
+		InitWriteQueue()
+	}
+	WriteQ.Start(ctx)
+}
+
+// StopWriteQueue stops the writer after the requests queued so far are written
+func StopWriteQueue() {
+	if WriteQ != nil {
+		WriteQ.Stop()
+	}
+}
+
+func writeQueueSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_WRITE_QUEUE, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// Start runs the writer until Stop or ctx is done
+func (q *WriteQueue) Start(ctx context.Context) {
+	q.mu.Lock()
+	if q.running {
+		q.mu.Unlock()
+		return
+	}
+	q.running = true
+	q.ticker = CurrentClock.NewTicker(time.Minute)
+	ctx, q.cancel = context.WithCancel(ctx)
+	q.mu.Unlock()
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		for {
+			q.drain()
+			select {
+			case <-q.wake:
+			case <-q.ticker.C():
+				q.expire()
+			case <-q.stopChan:
+				q.drain()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the writer, what is queued is written first
+func (q *WriteQueue) Stop() {
+	q.mu.Lock()
+	if !q.running {
+		q.mu.Unlock()
+		return
+	}
+	q.running = false
+	q.ticker.Stop()
+	close(q.stopChan)
+	q.mu.Unlock()
+	q.wg.Wait()
+	q.cancel()
+}
+
+// Enqueue queues the records of an insert request of the user on db, onDone is called once it is written
+// or failed (ie: to settle the quota)
+func (q *WriteQueue) Enqueue(db SureSQLDB, username string, records []orm.DBRecord, sameTable bool, onDone func(QueuedWrite)) (QueuedWrite, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if max := writeQueueSetting(SETTING_KEY_WRITE_QUEUE_MAX_PENDING, WRITE_QUEUE_DEFAULT_MAX_PENDING); q.records+len(records) > max {
+		return QueuedWrite{}, ErrWriteQueueFull
+	}
+	q.sequence++
+	item := &queuedInsert{
+		write:     QueuedWrite{Sequence: q.sequence, Status: QUEUED_WRITE_QUEUED, Records: len(records), QueuedAt: time.Now().UTC()},
+		username:  username,
+		db:        db,
+		records:   records,
+		sameTable: sameTable,
+		onDone:    onDone,
+		done:      make(chan struct{}),
+	}
+	q.pending = append(q.pending, item)
+	q.records += len(records)
+	q.outcomes[item.write.Sequence] = item
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return item.write, nil
+}
+
+// drain writes the pending requests in order
+func (q *WriteQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		item := q.pending[0]
+		q.mu.Unlock()
+
+		w := q.write(item)
+
+		q.mu.Lock()
+		q.pending = q.pending[1:]
+		q.records -= len(item.records)
+		q.lastDone = w.Sequence
+		if w.Status == QUEUED_WRITE_FAILED {
+			q.failed++
+		}
+		item.write = w
+		item.records, item.db = nil, nil
+		q.mu.Unlock()
+		close(item.done)
+		if item.onDone != nil {
+			item.onDone(w)
+		}
+	}
+}
+
+// write inserts the records of one request the way /db/api/insert does without queue
+func (q *WriteQueue) write(item *queuedInsert) QueuedWrite {
+	w := item.write
+	var results []orm.BasicSQLResult
+	var err error
+	switch {
+	case len(item.records) == 1:
+		res := item.db.InsertOneDBRecord(item.records[0], false)
+		results, err = []orm.BasicSQLResult{res}, res.Error
+	case item.sameTable:
+		results, err = InsertManySameTable(item.db, item.records)
+	default:
+		results, err = item.db.InsertManyDBRecords(item.records, false)
+	}
+	ResultCache.InvalidateRecords(item.records)
+	now := time.Now().UTC()
+	w.DoneAt = &now
+	if err != nil {
+		w.Status, w.Error = QUEUED_WRITE_FAILED, err.Error()
+		target := item.records[0].TableName
+		w.DeadLetterID, _ = AddDeadLetter(DEAD_LETTER_SOURCE_QUEUE, target, item.username, item.records, err)
+		simplelog.LogFormat("write queue: sequence %d of %s failed: %s", w.Sequence, item.username, err.Error())
+		return w
+	}
+	w.Status, w.Results = QUEUED_WRITE_DONE, results
+	w.RowsAffected = len(item.records)
+	if !item.sameTable && len(item.records) > 1 {
+		w.RowsAffected = len(results)
+	}
+	return w
+}
+
+// expire forgets the outcomes older than write_queue/keep_sec
+func (q *WriteQueue) expire() {
+	keep := time.Duration(writeQueueSetting(SETTING_KEY_WRITE_QUEUE_KEEP_SEC, WRITE_QUEUE_DEFAULT_KEEP_SEC)) * time.Second
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for seq, item := range q.outcomes {
+		if item.write.DoneAt != nil && time.Since(*item.write.DoneAt) > keep {
+			delete(q.outcomes, seq)
+		}
+	}
+}
+
+// Get returns the queued write of the user, waiting up to wait (at most WRITE_QUEUE_MAX_WAIT) while it
+// is still queued
+func (q *WriteQueue) Get(sequence int64, username string, wait time.Duration) (QueuedWrite, error) {
+	q.mu.Lock()
+	item, ok := q.outcomes[sequence]
+	if !ok || item.username != username {
+		q.mu.Unlock()
+		return QueuedWrite{}, ErrQueuedWriteUnknown
+	}
+	done := item.done
+	q.mu.Unlock()
+
+	if wait > WRITE_QUEUE_MAX_WAIT {
+		wait = WRITE_QUEUE_MAX_WAIT
+	}
+	if wait > 0 {
+		select {
+		case <-done:
+		case <-CurrentClock.After(wait):
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return item.write, nil
+}
+
+// Status returns the depth of the queue
+func (q *WriteQueue) Status() WriteQueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := WriteQueueStatus{Pending: len(q.pending), PendingRecords: q.records, LastSequence: q.sequence, LastDone: q.lastDone, Failed: q.failed}
+	if len(q.pending) > 0 {
+		oldest := q.pending[0].write.QueuedAt
+		status.OldestPendingAt = &oldest
+	}
+	return status
+}
@@ -0,0 +1,436 @@
+package suresql
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	orm "github.com/medatechnology/simpleorm"
+	"github.com/medatechnology/simpleorm/rqlite"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// Serialized writes on rqlite: with write_serializer/enabled the write statements of the API users are
+// not sent one request at a time, they wait for write_serializer/flush_ms (or until max_statements are
+// waiting) and go to rqlite in one /db/execute, in the order the node got them. rqlite commits such a
+// batch in one raft entry, which is much faster than one entry per request. Only writes on the same
+// rqlite credentials are batched together, and not in a transaction: every statement has its own result
+// and error, the request waiting for it gets exactly its own back once rqlite answered, as if it was sent
+// alone. Atomic batches, transactions and the writes of the node itself are never serialized.
+
+const (
+	WRITE_SERIALIZER_DEFAULT_FLUSH_MS       = 5
+	WRITE_SERIALIZER_DEFAULT_MAX_STATEMENTS = 100
+	WRITE_SERIALIZER_MAX_FLUSH_MS           = 1000
+)
+
+var ErrWriteSerializerStopped = medaerror.MedaError{Message: "write serializer stopped before the write was sent"}
+
+// WriteSerializerStatus counts what the serializer sent since the node started
+type WriteSerializerStatus struct {
+	Running    bool  `json:"running"`
+	Pending    int   `json:"pending"`    // statements waiting for the next batch
+	Batches    int64 `json:"batches"`    // sent to rqlite
+	Writes     int64 `json:"writes"`     // driver calls served by the batches
+	Statements int64 `json:"statements"` // in the batches
+	Failed     int64 `json:"failed"`     // batches rqlite did not answer, all their writes got the error
+}
+
+// serializerKey are the rqlite credentials of a connection, writes with the same key share a batch
+type serializerKey struct {
+	url      string
+	username string
+	password string
+}
+
+// serializedWrite is the statements of one driver call and what rqlite answered for them
+type serializedWrite struct {
+	key        serializerKey
+	db         *rqlite.RQLiteDirectDB
+	statements []orm.ParametereizedSQL
+	results    []orm.BasicSQLResult
+	err        error
+	done       chan struct{}
+}
+
+// WriteSerializer sends the waiting writes to rqlite in batches
+type WriteSerializer struct {
+	mu         sync.Mutex
+	pending    []*serializedWrite
+	statements int
+	wake       chan struct{} // the first write of a batch arrived
+	full       chan struct{} // the batch reached max_statements
+	status     WriteSerializerStatus
+	stopChan   chan struct{}
+	wg         sync.WaitGroup
+	running    bool
+	cancel     context.CancelFunc
+}
+
+var (
+	WriteS                  *WriteSerializer
+	writeSerializerInitOnce sync.Once
+)
+
+// InitWriteSerializer initializes the global write serializer
+func InitWriteSerializer() {
+	writeSerializerInitOnce.Do(func() {
+		WriteS = &WriteSerializer{
+			wake:     make(chan struct{}, 1),
+			full:     make(chan struct{}, 1),
+			stopChan: make(chan struct{}),
+		}
+	})
+}
+
+// StartWriteSerializer starts sending the serialized writes, they are serialized only while it runs
+func StartWriteSerializer(ctx context.Context) {
+	if WriteS == nil {
+		InitWriteSerializer()
+	}
+	WriteS.Start(ctx)
+}
+
+// StopWriteSerializer stops the serializer after the waiting writes are sent
+func StopWriteSerializer() {
+	if WriteS != nil {
+		WriteS.Stop()
+	}
+}
+
+func writeSerializerSetting(key string, def int) int {
+	if s, ok := CurrentNode.Settings.SettingExist(SETTING_CATEGORY_WRITE_SERIALIZER, key); ok {
+		return s.IntValue
+	}
+	return def
+}
+
+// WriteSerializerEnabled reads write_serializer/enabled, it applies to rqlite only
+func WriteSerializerEnabled() bool {
+	dbms := strings.ToUpper(strings.TrimSpace(CurrentNode.GetInternalConfig().DBMS))
+	if dbms != "" && dbms != "RQLITE" {
+		return false
+	}
+	return writeSerializerSetting(SETTING_KEY_WRITE_SERIALIZER_ENABLED, 0) != 0
+}
+
+// writeSerializerFlush is write_serializer/flush_ms, at most WRITE_SERIALIZER_MAX_FLUSH_MS
+func writeSerializerFlush() time.Duration {
+	ms := writeSerializerSetting(SETTING_KEY_WRITE_SERIALIZER_FLUSH_MS, WRITE_SERIALIZER_DEFAULT_FLUSH_MS)
+	if ms < 0 {
+		ms = WRITE_SERIALIZER_DEFAULT_FLUSH_MS
+	}
+	if ms > WRITE_SERIALIZER_MAX_FLUSH_MS {
+		ms = WRITE_SERIALIZER_MAX_FLUSH_MS
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func writeSerializerMaxStatements() int {
+	max := writeSerializerSetting(SETTING_KEY_WRITE_SERIALIZER_MAX_STMTS, WRITE_SERIALIZER_DEFAULT_MAX_STATEMENTS)
+	if max <= 0 {
+		return WRITE_SERIALIZER_DEFAULT_MAX_STATEMENTS
+	}
+	return max
+}
+
+// WithSerializedWrites wraps the rqlite connection of an API user so its writes go through the
+// serializer, db is returned as it is when the serializer is off or not running
+func WithSerializedWrites(db SureSQLDB) SureSQLDB {
+	r, ok := db.(*rqlite.RQLiteDirectDB)
+	if !ok || r.HTTPClient == nil || WriteS == nil || !WriteS.Running() || !WriteSerializerEnabled() {
+		return db
+	}
+	return serializedDB{r}
+}
+
+// Running tells if the serializer is sending
+func (s *WriteSerializer) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Start runs the serializer until Stop or ctx is done
+func (s *WriteSerializer) Start(ctx context.Context) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = true
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case <-s.wake:
+			case <-s.stopChan:
+				s.flush()
+				return
+			case <-ctx.Done():
+				s.abandon()
+				return
+			}
+			// the first write waits for the others of its batch
+			select {
+			case <-CurrentClock.After(writeSerializerFlush()):
+			case <-s.full:
+			case <-s.stopChan:
+				s.flush()
+				return
+			case <-ctx.Done():
+				s.abandon()
+				return
+			}
+			s.flush()
+		}
+	}()
+}
+
+// Stop stops the serializer, what is waiting is sent first, later writes go to rqlite directly
+func (s *WriteSerializer) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	close(s.stopChan)
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.cancel()
+}
+
+// Status returns the counters and what is waiting
+func (s *WriteSerializer) Status() WriteSerializerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Running = s.running
+	status.Pending = s.statements
+	return status
+}
+
+// Execute queues the statements of one driver call on db and waits until rqlite answered them, the
+// results are in the order of the statements and each has its own error
+func (s *WriteSerializer) Execute(db *rqlite.RQLiteDirectDB, statements []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	w := &serializedWrite{
+		key:        serializerKey{url: db.Config.URL, username: db.Config.Username, password: db.Config.Password},
+		db:         db,
+		statements: statements,
+		done:       make(chan struct{}),
+	}
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return rqliteExecute(db, statements, false)
+	}
+	s.pending = append(s.pending, w)
+	s.statements += len(statements)
+	first, full := len(s.pending) == 1, s.statements >= writeSerializerMaxStatements()
+	s.mu.Unlock()
+	if first {
+		wakeUp(s.wake)
+	}
+	if full {
+		wakeUp(s.full)
+	}
+	<-w.done
+	return w.results, w.err
+}
+
+func wakeUp(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// flush sends the waiting writes, one batch per credentials in the order of their first write, a batch
+// holds up to max_statements (a bigger write goes alone)
+func (s *WriteSerializer) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending, s.statements = nil, 0
+	s.mu.Unlock()
+	// drop a stale full signal, its writes are in this flush
+	select {
+	case <-s.full:
+	default:
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	max := writeSerializerMaxStatements()
+	var keys []serializerKey
+	groups := map[serializerKey][]*serializedWrite{}
+	for _, w := range pending {
+		if _, ok := groups[w.key]; !ok {
+			keys = append(keys, w.key)
+		}
+		groups[w.key] = append(groups[w.key], w)
+	}
+	for _, key := range keys {
+		var batch []*serializedWrite
+		count := 0
+		for _, w := range groups[key] {
+			if len(batch) > 0 && count+len(w.statements) > max {
+				s.send(batch)
+				batch, count = nil, 0
+			}
+			batch = append(batch, w)
+			count += len(w.statements)
+		}
+		s.send(batch)
+	}
+}
+
+// send executes one batch on the connection of its first write and hands every write its results, when
+// rqlite did not answer all of them get the error, nothing is sent again
+func (s *WriteSerializer) send(batch []*serializedWrite) {
+	var statements []orm.ParametereizedSQL
+	for _, w := range batch {
+		statements = append(statements, w.statements...)
+	}
+	results, err := rqliteExecute(batch[0].db, statements, false)
+	if err == nil && len(results) != len(statements) {
+		err = medaerror.Errorf("rqlite execute returned %d results for %d statements", len(results), len(statements))
+	}
+
+	s.mu.Lock()
+	s.status.Batches++
+	s.status.Writes += int64(len(batch))
+	s.status.Statements += int64(len(statements))
+	if err != nil {
+		s.status.Failed++
+	}
+	s.mu.Unlock()
+
+	offset := 0
+	for _, w := range batch {
+		if err != nil {
+			w.err = err
+		} else {
+			w.results = results[offset : offset+len(w.statements)]
+		}
+		offset += len(w.statements)
+		close(w.done)
+	}
+}
+
+// abandon fails the waiting writes when the serializer is cancelled, none of them was sent
+func (s *WriteSerializer) abandon() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending, s.statements = nil, 0
+	s.running = false
+	s.mu.Unlock()
+	for _, w := range pending {
+		w.err = ErrWriteSerializerStopped
+		close(w.done)
+	}
+}
+
+// serializedDB sends the writes of the connection through WriteS, reads and the rest are the connection's
+type serializedDB struct {
+	*rqlite.RQLiteDirectDB
+}
+
+// execute runs the statements through the serializer, a failed statement fails the call the way the
+// orm package does
+func (d serializedDB) execute(statements []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	results, err := WriteS.Execute(d.RQLiteDirectDB, statements)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if r.Error != nil {
+			return nil, medaerror.Errorf("execute error: %s", r.Error.Error())
+		}
+	}
+	return results, nil
+}
+
+func (d serializedDB) executeOne(statement orm.ParametereizedSQL) orm.BasicSQLResult {
+	results, err := d.execute([]orm.ParametereizedSQL{statement})
+	if err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return results[0]
+}
+
+func (d serializedDB) ExecOneSQL(sql string) orm.BasicSQLResult {
+	return d.executeOne(orm.ParametereizedSQL{Query: sql})
+}
+
+func (d serializedDB) ExecOneSQLParameterized(sql orm.ParametereizedSQL) orm.BasicSQLResult {
+	return d.executeOne(sql)
+}
+
+func (d serializedDB) ExecManySQL(sql []string) ([]orm.BasicSQLResult, error) {
+	statements := make([]orm.ParametereizedSQL, len(sql))
+	for i, s := range sql {
+		statements[i] = orm.ParametereizedSQL{Query: s}
+	}
+	return d.execute(statements)
+}
+
+func (d serializedDB) ExecManySQLParameterized(sql []orm.ParametereizedSQL) ([]orm.BasicSQLResult, error) {
+	return d.execute(sql)
+}
+
+func (d serializedDB) InsertOneDBRecord(record orm.DBRecord, queue bool) orm.BasicSQLResult {
+	query, values := record.ToInsertSQLParameterized()
+	return d.executeOne(orm.ParametereizedSQL{Query: query, Values: values})
+}
+
+func (d serializedDB) InsertManyDBRecords(records []orm.DBRecord, queue bool) ([]orm.BasicSQLResult, error) {
+	statements := make([]orm.ParametereizedSQL, len(records))
+	for i := range records {
+		query, values := records[i].ToInsertSQLParameterized()
+		statements[i] = orm.ParametereizedSQL{Query: query, Values: values}
+	}
+	return d.execute(statements)
+}
+
+func (d serializedDB) InsertManyDBRecordsSameTable(records []orm.DBRecord, queue bool) ([]orm.BasicSQLResult, error) {
+	if len(records) == 0 {
+		return d.RQLiteDirectDB.InsertManyDBRecordsSameTable(records, queue)
+	}
+	return d.execute(BuildBulkInsert(DialectSQLite, records, BulkInsertMaxParams("RQLITE")))
+}
+
+func (d serializedDB) InsertOneTableStruct(obj orm.TableStruct, queue bool) orm.BasicSQLResult {
+	record, err := orm.TableStructToDBRecord(obj)
+	if err != nil {
+		return orm.BasicSQLResult{Error: err}
+	}
+	return d.InsertOneDBRecord(record, queue)
+}
+
+func (d serializedDB) InsertManyTableStructs(objs []orm.TableStruct, queue bool) ([]orm.BasicSQLResult, error) {
+	if len(objs) == 0 {
+		return d.RQLiteDirectDB.InsertManyTableStructs(objs, queue)
+	}
+	records := make([]orm.DBRecord, len(objs))
+	for i, obj := range objs {
+		record, err := orm.TableStructToDBRecord(obj)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = record
+	}
+	for _, r := range records[1:] {
+		if r.TableName != records[0].TableName {
+			return d.InsertManyDBRecords(records, queue)
+		}
+	}
+	return d.InsertManyDBRecordsSameTable(records, queue)
+}
@@ -0,0 +1,303 @@
+package suresql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/medatechnology/goutil/medaerror"
+)
+
+// A small YAML reader for the bootstrap file, only the subset that file needs: block maps, block
+// lists (of scalars, maps or lists), plain/quoted scalars, literal blocks (| and |-), flow lists of
+// scalars and comments. Anchors, tags, multi documents and folded (>) blocks are not supported.
+// Maps decode to map[string]interface{}, lists to []interface{} and every scalar to string.
+
+var ErrYAMLInvalid = medaerror.MedaError{Message: "invalid yaml"}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string // without the indentation, comments are still there
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// ParseYAML parses the supported YAML subset, an empty document returns nil
+func ParseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, yamlError(i+1, "tabs are not allowed for indentation")
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(raw) - len(trimmed), text: strings.TrimRight(trimmed, " \t")})
+	}
+	if !p.skipBlank() {
+		return nil, nil
+	}
+	if p.lines[p.pos].text == "---" {
+		p.pos++
+		if !p.skipBlank() {
+			return nil, nil
+		}
+	}
+	v, err := p.parseNode(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank() {
+		return nil, yamlError(p.lines[p.pos].num, "unexpected indentation")
+	}
+	return v, nil
+}
+
+func yamlError(line int, msg string) error {
+	return medaerror.Errorf("%s: line %d: %s", ErrYAMLInvalid.Message, line, msg)
+}
+
+// skipBlank moves past empty and comment lines, false at the end of the document
+func (p *yamlParser) skipBlank() bool {
+	for p.pos < len(p.lines) {
+		t := p.lines[p.pos].text
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return true
+		}
+		p.pos++
+	}
+	return false
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	if isListItem(p.lines[p.pos].text) {
+		return p.parseList(indent)
+	}
+	return p.parseMap(indent)
+}
+
+func (p *yamlParser) parseMap(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.skipBlank() {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, yamlError(l.num, "unexpected indentation")
+		}
+		if isListItem(l.text) {
+			return nil, yamlError(l.num, "list item in a map")
+		}
+		key, value, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, yamlError(l.num, "expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, yamlError(l.num, "duplicate key "+key)
+		}
+		p.pos++
+		v, err := p.parseValue(value, indent, l.num, true)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseList(indent int) (interface{}, error) {
+	list := []interface{}{}
+	for p.skipBlank() {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isListItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, yamlError(l.num, "unexpected indentation")
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if isListItem(rest) {
+			// "- - item" starts a list at the column of the inner dash
+			p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.text) - len(rest), text: rest}
+			v, err := p.parseList(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		if _, _, isMap := splitYAMLKey(rest); isMap && !strings.HasPrefix(rest, "\"") && !strings.HasPrefix(rest, "'") {
+			// "- key: value" starts a map at the column of the key, continue parsing this line as that map
+			p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.text) - len(rest), text: rest}
+			v, err := p.parseMap(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		p.pos++
+		v, err := p.parseValue(rest, indent, l.num, false)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// parseValue handles what is after "key:" or "- ", nested blocks must be indented more than the parent,
+// except a list under a map key which YAML allows at the same indentation.
+func (p *yamlParser) parseValue(value string, indent, num int, inMap bool) (interface{}, error) {
+	value = stripYAMLComment(value)
+	switch value {
+	case "|", "|-", "|+":
+		return p.parseLiteral(indent, value != "|-"), nil
+	case ">", ">-", ">+":
+		return nil, yamlError(num, "folded blocks are not supported, use |")
+	case "":
+		if !p.skipBlank() {
+			return "", nil
+		}
+		next := p.lines[p.pos]
+		if next.indent > indent || (inMap && next.indent == indent && isListItem(next.text)) {
+			return p.parseNode(next.indent)
+		}
+		return "", nil
+	}
+	return parseYAMLScalar(value, num)
+}
+
+// parseLiteral reads a | block, the lines keep their newlines and the indentation of the first line is removed
+func (p *yamlParser) parseLiteral(indent int, keepNewline bool) string {
+	var lines []string
+	blockIndent := -1
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.text == "" {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		if l.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = l.indent
+		}
+		if l.indent < blockIndent {
+			break
+		}
+		lines = append(lines, strings.Repeat(" ", l.indent-blockIndent)+l.text)
+		p.pos++
+	}
+	// trailing empty lines belong to whatever comes next
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		p.pos--
+	}
+	s := strings.Join(lines, "\n")
+	if keepNewline && s != "" {
+		s += "\n"
+	}
+	return s
+}
+
+func parseYAMLScalar(value string, num int) (interface{}, error) {
+	switch {
+	case value == "~" || value == "null":
+		return "", nil
+	case strings.HasPrefix(value, "\""):
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, yamlError(num, "invalid double quoted string")
+		}
+		return s, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return nil, yamlError(num, "invalid single quoted string")
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	case value == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") {
+			return nil, yamlError(num, "invalid flow list")
+		}
+		list := []interface{}{}
+		inner := strings.TrimSpace(value[1 : len(value)-1])
+		if inner == "" {
+			return list, nil
+		}
+		for _, item := range strings.Split(inner, ",") {
+			v, err := parseYAMLScalar(strings.TrimSpace(item), num)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case strings.HasPrefix(value, "{"), strings.HasPrefix(value, "&"), strings.HasPrefix(value, "*"), strings.HasPrefix(value, "!"):
+		return nil, yamlError(num, "flow maps, anchors and tags are not supported")
+	}
+	return value, nil
+}
+
+// splitYAMLKey splits "key: value" or "key:", the key may be quoted
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" {
+		return "", "", false
+	}
+	if q := text[0]; q == '"' || q == '\'' {
+		end := strings.IndexByte(text[1:], q)
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", false
+		}
+		rest := text[end+3:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		return text[1 : end+1], strings.TrimSpace(rest), true
+	}
+	if strings.HasPrefix(text, "#") {
+		return "", "", false
+	}
+	if strings.HasSuffix(text, ":") && !strings.Contains(text[:len(text)-1], ": ") {
+		return strings.TrimSpace(text[:len(text)-1]), "", true
+	}
+	i := strings.Index(text, ": ")
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:]), true
+}
+
+// stripYAMLComment removes " # comment" outside of quotes
+func stripYAMLComment(value string) string {
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' || c == '\'' && quote == '\'' && i+1 < len(value) && value[i+1] == '\'' {
+				// an escape, or a doubled single quote
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || value[i-1] == ' ' || value[i-1] == '[' || value[i-1] == ',' {
+				quote = c
+			}
+		case c == '#' && (i == 0 || value[i-1] == ' '):
+			return strings.TrimSpace(value[:i])
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,91 @@
+package suresql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type yamlMap = map[string]interface{}
+type yamlList = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		want interface{}
+	}{
+		{"empty", "", nil},
+		{"only comments", "# nothing\n\n  # here\n", nil},
+		{"document start", "---\na: 1\n", yamlMap{"a": "1"}},
+		{"scalars stay text", "n: 42\nb: true\nf: 1.5\n", yamlMap{"n": "42", "b": "true", "f": "1.5"}},
+		{"null", "a: ~\nb: null\nc:\n", yamlMap{"a": "", "b": "", "c": ""}},
+		{"crlf", "a: 1\r\nb: 2\r\n", yamlMap{"a": "1", "b": "2"}},
+
+		// nesting
+		{"nested maps", "a:\n  b:\n    c: d\n  e: f\ng: h\n", yamlMap{"a": yamlMap{"b": yamlMap{"c": "d"}, "e": "f"}, "g": "h"}},
+		{"list of scalars", "- a\n- b\n", yamlList{"a", "b"}},
+		{"list under key", "k:\n  - a\n  - b\n", yamlMap{"k": yamlList{"a", "b"}}},
+		{"list at key indentation", "k:\n- a\n- b\nz: 1\n", yamlMap{"k": yamlList{"a", "b"}, "z": "1"}},
+		{"list of maps", "users:\n  - name: a\n    role: admin\n  - name: b\n", yamlMap{"users": yamlList{yamlMap{"name": "a", "role": "admin"}, yamlMap{"name": "b"}}}},
+		{"list in list item map", "- k:\n    - 1\n    - 2\n  j: x\n", yamlList{yamlMap{"k": yamlList{"1", "2"}, "j": "x"}}},
+		{"nested lists", "- - x\n  - y\n- z\n", yamlList{yamlList{"x", "y"}, "z"}},
+		{"flow list", "a: [1, 'b', \"c\"]\nb: []\nc: {}\n", yamlMap{"a": yamlList{"1", "b", "c"}, "b": yamlList{}, "c": yamlMap{}}},
+
+		// quoting
+		{"double quoted", `a: "x: y # z\t"`, yamlMap{"a": "x: y # z\t"}},
+		{"single quoted", "a: 'it''s # here'", yamlMap{"a": "it's # here"}},
+		{"quoted key", "'a: b': 1\n\"c\": 2\n", yamlMap{"a: b": "1", "c": "2"}},
+		{"quoted list item with colon", "- 'a: b'\n", yamlList{"a: b"}},
+		{"placeholder", "password: '${ADMIN_PASSWORD}'", yamlMap{"password": "${ADMIN_PASSWORD}"}},
+		{"colon without space", "url: http://x:80/y\n", yamlMap{"url": "http://x:80/y"}},
+
+		// comments
+		{"trailing comments", "a: 1 # one\nb: 'x # y' # two\n# line\nc: d#e\n", yamlMap{"a": "1", "b": "x # y", "c": "d#e"}},
+		{"comment after key", "a: # none\n  b: c\n", yamlMap{"a": yamlMap{"b": "c"}}},
+
+		// literal blocks
+		{"literal", "sql: |\n  CREATE TABLE t (\n    id INTEGER\n  );\nnext: 1\n", yamlMap{"sql": "CREATE TABLE t (\n  id INTEGER\n);\n", "next": "1"}},
+		{"literal strip", "k: |-\n\n  x\n\ny: z", yamlMap{"k": "\nx", "y": "z"}},
+		{"literal in list", "- |\n  a # not a comment\n- b\n", yamlList{"a # not a comment\n", "b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseYAML([]byte(c.doc))
+			if err != nil {
+				t.Fatalf("%q: %v", c.doc, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%q\ngot  %#v\nwant %#v", c.doc, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	cases := []struct {
+		doc  string
+		want string // the error names the line
+	}{
+		{"a: 1\n   b: 2\n", "line 2: unexpected indentation"},
+		{"a:\n  b: 1\n    c: 2\n", "line 3: unexpected indentation"},
+		{"- a\n  - b\n", "line 2: unexpected indentation"},
+		{"a: 1\n b: 2\n", "line 2: unexpected indentation"},
+		{"a:\n\tb: 1\n", "line 2: tabs are not allowed"},
+		{"a: 1\n- b\n", "line 2: list item in a map"},
+		{"a: 1\njust text\n", "line 2: expected key: value"},
+		{"a: 1\na: 2\n", "line 2: duplicate key a"},
+		{"a: \"open\n", "line 1: invalid double quoted string"},
+		{"a: 'open\n", "line 1: invalid single quoted string"},
+		{"a: [1, 2\n", "line 1: invalid flow list"},
+		{"a: >\n  text\n", "line 1: folded blocks"},
+		{"a: &anchor x\n", "line 1: flow maps, anchors and tags"},
+		{"a: {b: c}\n", "line 1: flow maps, anchors and tags"},
+	}
+	for _, c := range cases {
+		_, err := ParseYAML([]byte(c.doc))
+		if err == nil || !strings.HasPrefix(err.Error(), ErrYAMLInvalid.Message) || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got error %v, want %q", c.doc, err, c.want)
+		}
+	}
+}